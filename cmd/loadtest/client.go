@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+const listKey = "all"
+
+// client is a single synthetic user driving the proxy. It mimics the behaviour of a typical client:
+// load the first page of rooms, then scroll down the list, open and close rooms and long-poll for
+// updates.
+type client struct {
+	proxyURL    string
+	token       string
+	httpClient  *http.Client
+	rng         *rand.Rand
+	stats       *stats
+	pageSize    int64
+	pollTimeout time.Duration
+	// if set, also abandon connections and abort long-polls to find leaks when clients go away
+	soak bool
+
+	pos       string
+	listEnd   int64
+	listCount int
+	seenRooms []string
+	subs      map[string]struct{}
+}
+
+func (c *client) request() sync3.Request {
+	subs := make(map[string]sync3.RoomSubscription, len(c.subs))
+	for roomID := range c.subs {
+		subs[roomID] = sync3.RoomSubscription{
+			TimelineLimit: 20,
+			RequiredState: [][2]string{{"*", "*"}},
+		}
+	}
+	return sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			listKey: {
+				Ranges: sync3.SliceRanges{{0, c.listEnd}},
+				Sort:   []string{sync3.SortByRecency, sync3.SortByName},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+					RequiredState: [][2]string{{"m.room.avatar", ""}, {"m.room.name", ""}},
+				},
+			},
+		},
+		RoomSubscriptions: subs,
+	}
+}
+
+// run drives the proxy until the context is cancelled.
+func (c *client) run(ctx context.Context) {
+	c.subs = make(map[string]struct{})
+	c.listEnd = c.pageSize - 1
+	for ctx.Err() == nil {
+		if c.pos == "" {
+			c.do(ctx, actionInitial, 0)
+			continue
+		}
+		switch n := c.rng.Intn(100); {
+		case c.soak && n < 3:
+			// start a new connection, leaving the proxy to clean up the old one
+			c.pos = ""
+			c.subs = make(map[string]struct{})
+			c.listEnd = c.pageSize - 1
+			c.stats.recordReconnect()
+		case c.soak && n < 6:
+			c.abortPoll(ctx)
+		case n < 30 && int64(c.listCount) > c.listEnd+1:
+			c.listEnd += c.pageSize
+			c.do(ctx, actionScroll, 0)
+		case n < 50 && len(c.seenRooms) > 0:
+			roomID := c.seenRooms[c.rng.Intn(len(c.seenRooms))]
+			if _, exists := c.subs[roomID]; exists {
+				delete(c.subs, roomID)
+				c.do(ctx, actionUnsubscribe, 0)
+			} else {
+				c.subs[roomID] = struct{}{}
+				c.do(ctx, actionSubscribe, 0)
+			}
+		default:
+			c.do(ctx, actionPoll, c.pollTimeout)
+		}
+	}
+}
+
+// abortPoll starts a long-poll and gives up on it part way through, like a client going offline.
+func (c *client) abortPoll(ctx context.Context) {
+	abortCtx, cancel := context.WithTimeout(ctx, time.Duration(c.rng.Int63n(int64(c.pollTimeout)+1)))
+	defer cancel()
+	err := c.doRequest(abortCtx, actionPoll, c.pollTimeout)
+	if err != nil && abortCtx.Err() != nil && ctx.Err() == nil {
+		c.stats.recordAbort()
+	} else if err != nil && ctx.Err() == nil {
+		c.stats.recordError(actionPoll)
+	}
+}
+
+func (c *client) do(ctx context.Context, a action, timeout time.Duration) {
+	if err := c.doRequest(ctx, a, timeout); err != nil && ctx.Err() == nil {
+		c.stats.recordError(a)
+		// back off so a broken proxy doesn't turn into a busy loop.
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (c *client) doRequest(ctx context.Context, a action, timeout time.Duration) error {
+	body, err := json.Marshal(c.request())
+	if err != nil {
+		return err
+	}
+	qps := url.Values{}
+	qps.Set("timeout", fmt.Sprintf("%d", timeout.Milliseconds()))
+	if c.pos != "" {
+		qps.Set("pos", c.pos)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.proxyURL+"/_matrix/client/unstable/org.matrix.msc3575/sync?"+qps.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	start := time.Now()
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	dur := time.Since(start)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		if res.StatusCode == 400 {
+			// the connection has probably expired, start again.
+			c.pos = ""
+		}
+		return fmt.Errorf("HTTP %d: %s", res.StatusCode, resBody)
+	}
+	var resp sync3.Response
+	if err := json.Unmarshal(resBody, &resp); err != nil {
+		return err
+	}
+	c.pos = resp.Pos
+	ops := make(map[string]int)
+	if list, ok := resp.Lists[listKey]; ok {
+		c.listCount = list.Count
+		for _, op := range list.Ops {
+			ops[op.Op()]++
+		}
+	}
+	for roomID := range resp.Rooms {
+		if !c.seen(roomID) {
+			c.seenRooms = append(c.seenRooms, roomID)
+		}
+	}
+	c.stats.record(a, dur, ops, len(resp.Rooms))
+	return nil
+}
+
+func (c *client) seen(roomID string) bool {
+	for _, r := range c.seenRooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
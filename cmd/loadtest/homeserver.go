@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/matrix-org/sliding-sync/testutils/v2server"
+)
+
+// maxV2LongPoll caps how long the mock v2 server will hold open a /sync request.
+const maxV2LongPoll = 30 * time.Second
+
+// syntheticUser is a single user known to the mock v2 server.
+type syntheticUser struct {
+	UserID      string `json:"user_id"`
+	DeviceID    string `json:"device_id"`
+	AccessToken string `json:"access_token"`
+	// Responses are returned in order to this user's v2 /sync requests before any live traffic.
+	Responses []sync2.SyncResponse `json:"responses"`
+
+	// the rooms this user is joined to, used to fan out live events.
+	rooms []string
+}
+
+// corpus is a recorded set of v2 sync responses which will be replayed to the proxy.
+type corpus struct {
+	Users []*syntheticUser `json:"users"`
+}
+
+func loadCorpus(path string) (*corpus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c corpus
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to decode corpus %s: %w", path, err)
+	}
+	if len(c.Users) == 0 {
+		return nil, fmt.Errorf("corpus %s contains no users", path)
+	}
+	for i, u := range c.Users {
+		if u.UserID == "" || u.AccessToken == "" {
+			return nil, fmt.Errorf("corpus %s: user %d is missing user_id or access_token", path, i)
+		}
+		if u.DeviceID == "" {
+			u.DeviceID = "LOADTEST"
+		}
+	}
+	return &c, nil
+}
+
+// homeserver serves either generated rooms or a recorded corpus to the proxy using the mock v2
+// server from the integration tests, then injects live message events at a fixed rate.
+type homeserver struct {
+	*v2server.Server
+	users   []*syntheticUser
+	members map[string][]*syntheticUser // room ID -> joined users
+	eventID atomic.Int64
+}
+
+// newGeneratedHomeserver creates numUsers users. Each user is joined to roomsPerUser rooms picked
+// from a shared pool of numRooms rooms, so rooms have overlapping memberships like a real deployment.
+func newGeneratedHomeserver(rng *rand.Rand, numUsers, numRooms, roomsPerUser, timelineLen int) *homeserver {
+	if roomsPerUser > numRooms {
+		roomsPerUser = numRooms
+	}
+	hs := &homeserver{
+		members: make(map[string][]*syntheticUser),
+	}
+	users := make([]*syntheticUser, numUsers)
+	for i := range users {
+		users[i] = &syntheticUser{
+			UserID:      fmt.Sprintf("@loadtest_%d:localhost", i),
+			DeviceID:    "LOADTEST",
+			AccessToken: fmt.Sprintf("loadtest_token_%d", i),
+		}
+		for _, r := range rng.Perm(numRooms)[:roomsPerUser] {
+			roomID := fmt.Sprintf("!loadtest_%d:localhost", r)
+			users[i].rooms = append(users[i].rooms, roomID)
+			hs.members[roomID] = append(hs.members[roomID], users[i])
+		}
+	}
+	// now every room knows its members, build the initial sync response for each user.
+	baseTS := time.Now().Add(-24 * time.Hour)
+	for _, u := range users {
+		join := make(map[string]sync2.SyncV2JoinResponse, len(u.rooms))
+		for _, roomID := range u.rooms {
+			join[roomID] = hs.initialRoom(rng, roomID, baseTS, timelineLen)
+		}
+		u.Responses = []sync2.SyncResponse{{
+			NextBatch: "initial",
+			Rooms:     sync2.SyncRoomsResponse{Join: join},
+		}}
+	}
+	hs.start(users)
+	return hs
+}
+
+// newCorpusHomeserver creates a homeserver which replays the given corpus. Live events are
+// injected into every room which appears in a user's recorded join responses.
+func newCorpusHomeserver(c *corpus) *homeserver {
+	hs := &homeserver{
+		members: make(map[string][]*syntheticUser),
+	}
+	for _, u := range c.Users {
+		seen := make(map[string]bool)
+		for _, res := range u.Responses {
+			for roomID := range res.Rooms.Join {
+				if seen[roomID] {
+					continue
+				}
+				seen[roomID] = true
+				u.rooms = append(u.rooms, roomID)
+				hs.members[roomID] = append(hs.members[roomID], u)
+			}
+		}
+	}
+	hs.start(c.Users)
+	return hs
+}
+
+// start makes the mock v2 server and queues each user's responses on it.
+func (hs *homeserver) start(users []*syntheticUser) {
+	// the mock v2 server logs every response it queues and serves
+	testutils.Quiet = true
+	hs.Server = v2server.New()
+	hs.TimeToWaitForV2Response = maxV2LongPoll
+	for _, u := range users {
+		// make room for all the recorded responses, as well as live events
+		if size := len(u.Responses) + v2server.DefaultQueueSize; size > hs.QueueSize {
+			hs.QueueSize = size
+		}
+	}
+	for _, u := range users {
+		hs.AddAccountWithDeviceID(u.UserID, u.DeviceID, u.AccessToken)
+		for _, res := range u.Responses {
+			hs.QueueResponse(u.AccessToken, res)
+		}
+	}
+	hs.users = users
+}
+
+func (hs *homeserver) newEvent(evType string, stateKey *string, sender string, content interface{}, ts time.Time) json.RawMessage {
+	ev := map[string]interface{}{
+		"type":             evType,
+		"sender":           sender,
+		"content":          content,
+		"event_id":         fmt.Sprintf("$loadtest_%d", hs.eventID.Add(1)),
+		"origin_server_ts": ts.UnixMilli(),
+	}
+	if stateKey != nil {
+		ev["state_key"] = *stateKey
+	}
+	j, _ := json.Marshal(ev)
+	return j
+}
+
+func (hs *homeserver) initialRoom(rng *rand.Rand, roomID string, baseTS time.Time, timelineLen int) sync2.SyncV2JoinResponse {
+	members := hs.members[roomID]
+	creator := members[0].UserID
+	empty := ""
+	ts := baseTS.Add(time.Duration(rng.Intn(3600)) * time.Second)
+	state := []json.RawMessage{
+		hs.newEvent("m.room.create", &empty, creator, map[string]interface{}{"creator": creator}, ts),
+		hs.newEvent("m.room.power_levels", &empty, creator, map[string]interface{}{"users": map[string]int{creator: 100}}, ts),
+		hs.newEvent("m.room.join_rules", &empty, creator, map[string]interface{}{"join_rule": "public"}, ts),
+		hs.newEvent("m.room.name", &empty, creator, map[string]interface{}{"name": "Load test " + roomID}, ts),
+	}
+	for _, m := range members {
+		userID := m.UserID
+		state = append(state, hs.newEvent("m.room.member", &userID, userID, map[string]interface{}{"membership": "join"}, ts))
+	}
+	timeline := make([]json.RawMessage, timelineLen)
+	for i := range timeline {
+		ts = ts.Add(time.Duration(1+rng.Intn(60)) * time.Second)
+		sender := members[rng.Intn(len(members))].UserID
+		timeline[i] = hs.newEvent("m.room.message", nil, sender, map[string]interface{}{"msgtype": "m.text", "body": fmt.Sprintf("message %d", i)}, ts)
+	}
+	return sync2.SyncV2JoinResponse{
+		State: sync2.EventsResponse{Events: state},
+		Timeline: sync2.TimelineResponse{
+			Events:    timeline,
+			Limited:   true,
+			PrevBatch: "prev_" + roomID,
+		},
+	}
+}
+
+// injectEvents sends a message into a random room every interval until stop is closed.
+func (hs *homeserver) injectEvents(rng *rand.Rand, interval time.Duration, stop <-chan struct{}) {
+	roomIDs := make([]string, 0, len(hs.members))
+	for roomID := range hs.members {
+		roomIDs = append(roomIDs, roomID)
+	}
+	if len(roomIDs) == 0 || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		roomID := roomIDs[rng.Intn(len(roomIDs))]
+		members := hs.members[roomID]
+		sender := members[rng.Intn(len(members))].UserID
+		ev := hs.newEvent("m.room.message", nil, sender, map[string]interface{}{"msgtype": "m.text", "body": "live"}, time.Now())
+		res := sync2.SyncResponse{
+			NextBatch: fmt.Sprintf("live_%d", hs.eventID.Load()),
+			Rooms: sync2.SyncRoomsResponse{Join: map[string]sync2.SyncV2JoinResponse{
+				roomID: {Timeline: sync2.TimelineResponse{Events: []json.RawMessage{ev}}},
+			}},
+		}
+		for _, m := range members {
+			// if the proxy isn't keeping up with this user, drop the event rather than block
+			// every other user.
+			hs.TryQueueResponse(m.AccessToken, res)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Command loadtest drives a sliding sync proxy with many synthetic users and reports latency
+// percentiles and list operation counts, so that performance changes can be measured repeatably.
+//
+// The homeserver is always mocked: either rooms are generated, or a recorded corpus of v2 sync
+// responses is replayed. By default the proxy is run in-process against the mock, which requires
+// a Postgres database. Alternatively, -proxy targets an already running proxy, in which case that
+// proxy must have SYNCV3_SERVER set to the address given in -v2-bind.
+//
+// With -soak, clients also abandon connections and abort long-polls part way through, and the
+// in-process proxy's goroutines and heap are checked for leaks. The command exits non-zero if they
+// grow beyond the given limits.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+// run runs the load test and returns the exit code. It doesn't exit itself, so that deferred
+// teardown of the proxy and mock v2 server runs first.
+func run() int {
+	var (
+		proxyURL      = flag.String("proxy", "", "URL of a running proxy to test. If unset, a proxy is started in-process using -db.")
+		db            = flag.String("db", os.Getenv("SYNCV3_DB"), "Postgres connection string for the in-process proxy. Defaults to $SYNCV3_DB. The database should be empty.")
+		v2Bind        = flag.String("v2-bind", "", "Address to bind the mock v2 server to, required with -proxy e.g 'localhost:8009'.")
+		corpusPath    = flag.String("corpus", "", "Path to a JSON corpus of recorded v2 sync responses to replay, instead of generating rooms.")
+		numUsers      = flag.Int("users", 50, "Number of synthetic users to generate.")
+		numRooms      = flag.Int("rooms", 500, "Size of the pool of rooms users are joined to.")
+		roomsPerUser  = flag.Int("rooms-per-user", 100, "Number of rooms each generated user is joined to.")
+		timelineLen   = flag.Int("timeline", 10, "Number of timeline events in each generated room.")
+		duration      = flag.Duration("duration", time.Minute, "How long to run the test for, excluding ramp up.")
+		rampUp        = flag.Duration("ramp-up", 10*time.Second, "Time over which users are started.")
+		eventInterval = flag.Duration("event-interval", 100*time.Millisecond, "How often to send a live event into a random room. 0 disables live events.")
+		pollTimeout   = flag.Duration("poll-timeout", 5*time.Second, "Long-poll timeout clients use when they have nothing else to do.")
+		pageSize      = flag.Int64("page-size", 20, "Number of rooms clients request per page when scrolling.")
+		seed          = flag.Int64("seed", 1, "Random seed, so runs are repeatable.")
+
+		soak               = flag.Bool("soak", false, "Run a soak test: clients also reconnect and abort long-polls, and the proxy is checked for goroutine and heap leaks. Requires the in-process proxy; use a long -duration.")
+		soakWarmUp         = flag.Duration("soak-warm-up", time.Minute, "Time after ramp up before the goroutine and heap baseline is taken.")
+		soakInterval       = flag.Duration("soak-interval", 10*time.Second, "How often goroutines and heap usage are sampled.")
+		maxGoroutineGrowth = flag.Float64("max-goroutine-growth", 1.5, "Fail the soak test if goroutines exceed this multiple of the baseline.")
+		maxHeapGrowth      = flag.Float64("max-heap-growth", 2, "Fail the soak test if heap usage exceeds this multiple of the baseline.")
+	)
+	flag.Parse()
+	if *soak && *proxyURL != "" {
+		return fail("-soak requires the in-process proxy, as leaks are measured in this process")
+	}
+	if *v2Bind == "" && *proxyURL != "" {
+		return fail("-v2-bind is required with -proxy")
+	}
+	if *proxyURL == "" && *db == "" {
+		return fail("one of -proxy or -db is required")
+	}
+
+	rng := rand.New(rand.NewSource(*seed))
+	var v2 *homeserver
+	if *corpusPath != "" {
+		c, err := loadCorpus(*corpusPath)
+		if err != nil {
+			return fail("%s", err)
+		}
+		v2 = newCorpusHomeserver(c)
+	} else {
+		v2 = newGeneratedHomeserver(rng, *numUsers, *numRooms, *roomsPerUser, *timelineLen)
+	}
+
+	var v2URL string
+	if *v2Bind != "" {
+		ln, err := net.Listen("tcp", *v2Bind)
+		if err != nil {
+			return fail("failed to listen on %s: %s", *v2Bind, err)
+		}
+		v2Srv := &http.Server{Handler: v2}
+		go v2Srv.Serve(ln)
+		defer v2Srv.Close()
+		v2URL = "http://" + ln.Addr().String()
+	} else {
+		srv := httptest.NewServer(v2)
+		defer srv.Close()
+		v2URL = srv.URL
+	}
+	// make waiting /sync requests return, so the servers above can close.
+	defer v2.Close()
+	fmt.Printf("mock v2 server listening on %s with %d users\n", v2URL, len(v2.users))
+
+	if *proxyURL == "" {
+		h2, h3 := syncv3.Setup(v2URL, *db, "loadtest", syncv3.Opts{
+			MaxPendingEventUpdates: 2000,
+		})
+		defer h2.Teardown()
+		defer h3.(*handler.SyncLiveHandler).Teardown()
+		srv := httptest.NewServer(syncv3.ServerOpts{}.Router(h3, v2URL))
+		defer srv.Close()
+		*proxyURL = srv.URL
+	}
+	fmt.Printf("testing proxy %s for %v\n", *proxyURL, *duration)
+
+	stopInjecting := make(chan struct{})
+	injectorDone := make(chan struct{})
+	go func() {
+		defer close(injectorDone)
+		v2.injectEvents(rand.New(rand.NewSource(*seed+1)), *eventInterval, stopInjecting)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *rampUp+*duration)
+	defer cancel()
+	var leaks *leakDetector
+	if *soak {
+		leaks = newLeakDetector(*maxGoroutineGrowth, *maxHeapGrowth)
+		go leaks.run(ctx, time.Now(), *rampUp+*soakWarmUp, *soakInterval)
+	}
+	st := newStats()
+	httpClient := &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: len(v2.users)},
+	}
+	var wg sync.WaitGroup
+	var stagger time.Duration
+	if len(v2.users) > 0 {
+		stagger = *rampUp / time.Duration(len(v2.users))
+	}
+	start := time.Now()
+	// start users in a stable order so runs with the same seed are comparable.
+	tokens := make([]string, 0, len(v2.users))
+	for _, u := range v2.users {
+		tokens = append(tokens, u.AccessToken)
+	}
+	sort.Strings(tokens)
+	for i, token := range tokens {
+		c := &client{
+			proxyURL:    *proxyURL,
+			token:       token,
+			httpClient:  httpClient,
+			rng:         rand.New(rand.NewSource(*seed + int64(i) + 2)),
+			stats:       st,
+			pageSize:    *pageSize,
+			pollTimeout: *pollTimeout,
+			soak:        *soak,
+		}
+		delay := stagger * time.Duration(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			c.run(ctx)
+		}()
+	}
+	wg.Wait()
+	close(stopInjecting)
+	// the v2 server can't be closed while events are being queued on it
+	<-injectorDone
+	st.report(os.Stdout, time.Since(start))
+	if leaks != nil && !leaks.report(os.Stdout) {
+		return 1
+	}
+	return 0
+}
+
+// fail prints the error and returns the exit code for it.
+func fail(format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	return 1
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"text/tabwriter"
+	"time"
+)
+
+// sample is a measurement of the resources used by this process.
+type sample struct {
+	at         time.Duration // since the start of the test
+	goroutines int
+	heapBytes  uint64 // live heap after a GC
+}
+
+func takeSample(start time.Time) sample {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return sample{
+		at:         time.Since(start),
+		goroutines: runtime.NumGoroutine(),
+		heapBytes:  ms.HeapAlloc,
+	}
+}
+
+// leakDetector periodically samples goroutines and heap usage during a soak test, and fails if they
+// grow too far beyond a baseline taken once the test has warmed up. Under steady load a proxy
+// without leaks levels off, whereas leaked Conns, notifier registrations or goroutines blocked on
+// channels nobody reads grow without bound.
+//
+// Samples cover the whole process, so only make sense with the in-process proxy. They include the
+// synthetic clients and mock v2 server, but those use a constant amount once every user has started.
+type leakDetector struct {
+	maxGoroutineGrowth float64
+	maxHeapGrowth      float64
+
+	samples  []sample
+	baseline *sample
+	failures []string
+	done     chan struct{}
+}
+
+func newLeakDetector(maxGoroutineGrowth, maxHeapGrowth float64) *leakDetector {
+	return &leakDetector{
+		maxGoroutineGrowth: maxGoroutineGrowth,
+		maxHeapGrowth:      maxHeapGrowth,
+		done:               make(chan struct{}),
+	}
+}
+
+// run samples every interval until ctx is done, taking the baseline after warmUp.
+func (d *leakDetector) run(ctx context.Context, start time.Time, warmUp, interval time.Duration) {
+	defer close(d.done)
+	select {
+	case <-time.After(warmUp):
+	case <-ctx.Done():
+		return
+	}
+	baseline := takeSample(start)
+	d.baseline = &baseline
+	d.samples = append(d.samples, baseline)
+	fmt.Printf("soak baseline: %d goroutines, %s heap\n", baseline.goroutines, formatBytes(baseline.heapBytes))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.check(takeSample(start))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *leakDetector) check(s sample) {
+	d.samples = append(d.samples, s)
+	if limit := int(float64(d.baseline.goroutines) * d.maxGoroutineGrowth); s.goroutines > limit {
+		d.failures = append(d.failures, fmt.Sprintf(
+			"at %v: %d goroutines exceeds limit of %d", s.at.Round(time.Second), s.goroutines, limit,
+		))
+	}
+	if limit := uint64(float64(d.baseline.heapBytes) * d.maxHeapGrowth); s.heapBytes > limit {
+		d.failures = append(d.failures, fmt.Sprintf(
+			"at %v: %s heap exceeds limit of %s", s.at.Round(time.Second), formatBytes(s.heapBytes), formatBytes(limit),
+		))
+	}
+}
+
+// report waits for run to return, then writes every sample and any failures, returning false if
+// the test failed.
+func (d *leakDetector) report(w io.Writer) bool {
+	<-d.done
+	if d.baseline == nil {
+		fmt.Fprintln(w, "\nsoak test ended before the baseline was taken, increase -duration or reduce -soak-warm-up")
+		return false
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "elapsed\tgoroutines\theap\t")
+	for _, s := range d.samples {
+		fmt.Fprintf(tw, "%v\t%d\t%s\t\n", s.at.Round(time.Second), s.goroutines, formatBytes(s.heapBytes))
+	}
+	tw.Flush()
+	if len(d.failures) == 0 {
+		fmt.Fprintln(w, "soak test passed: goroutines and heap stayed within limits")
+		return true
+	}
+	fmt.Fprintf(w, "soak test FAILED, possible leak:\n")
+	for _, f := range d.failures {
+		fmt.Fprintf(w, "  %s\n", f)
+	}
+	return false
+}
+
+func formatBytes(b uint64) string {
+	return fmt.Sprintf("%.1fMiB", float64(b)/(1<<20))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// action is a kind of request a synthetic client makes.
+type action string
+
+const (
+	actionInitial     action = "initial"
+	actionScroll      action = "scroll"
+	actionSubscribe   action = "subscribe"
+	actionUnsubscribe action = "unsubscribe"
+	actionPoll        action = "poll"
+)
+
+var actions = []action{actionInitial, actionScroll, actionSubscribe, actionUnsubscribe, actionPoll}
+
+// stats collects latencies and operation counts across all synthetic clients.
+type stats struct {
+	mu        sync.Mutex
+	latencies map[action][]time.Duration
+	errors    map[action]int
+	ops       map[string]int // list op name -> count
+	rooms     int
+	// soak tests only
+	reconnects int
+	aborts     int
+}
+
+func newStats() *stats {
+	return &stats{
+		latencies: make(map[action][]time.Duration),
+		errors:    make(map[action]int),
+		ops:       make(map[string]int),
+	}
+}
+
+func (s *stats) record(a action, dur time.Duration, ops map[string]int, numRooms int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies[a] = append(s.latencies[a], dur)
+	for op, n := range ops {
+		s.ops[op] += n
+	}
+	s.rooms += numRooms
+}
+
+func (s *stats) recordError(a action) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[a]++
+}
+
+func (s *stats) recordReconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconnects++
+}
+
+func (s *stats) recordAbort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborts++
+}
+
+// percentile returns the p-th percentile (0-100) of the given sorted durations using the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// report writes a summary table of everything recorded so far.
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "action\treqs\terrors\treq/s\tp50\tp90\tp99\tmax\t")
+	total := 0
+	for _, a := range actions {
+		lats := append([]time.Duration(nil), s.latencies[a]...)
+		if len(lats) == 0 && s.errors[a] == 0 {
+			continue
+		}
+		total += len(lats)
+		sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+		fmt.Fprintf(
+			tw, "%s\t%d\t%d\t%.1f\t%v\t%v\t%v\t%v\t\n",
+			a, len(lats), s.errors[a], float64(len(lats))/elapsed.Seconds(),
+			percentile(lats, 50).Round(time.Microsecond), percentile(lats, 90).Round(time.Microsecond),
+			percentile(lats, 99).Round(time.Microsecond), percentile(lats, 100).Round(time.Microsecond),
+		)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d requests in %v (%.1f req/s), %d rooms returned\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), s.rooms)
+	opNames := make([]string, 0, len(s.ops))
+	for op := range s.ops {
+		opNames = append(opNames, op)
+	}
+	sort.Strings(opNames)
+	for _, op := range opNames {
+		fmt.Fprintf(w, "  %s ops: %d\n", op, s.ops[op])
+	}
+	if s.reconnects > 0 || s.aborts > 0 {
+		fmt.Fprintf(w, "%d reconnects, %d aborted long-polls\n", s.reconnects, s.aborts)
+	}
+}
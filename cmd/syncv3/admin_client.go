@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+)
+
+// cliActor names whoever is running this command, for the audit log.
+func cliActor() string {
+	name := os.Getenv("USER")
+	if name == "" {
+		name = "unknown"
+	}
+	return "cli:" + name
+}
+
+// callAdminAPI makes a request to the admin API of the proxy running at proxyURL and decodes the
+// JSON response into out.
+func callAdminAPI(proxyURL, adminToken, method, path string, out interface{}) error {
+	u := strings.TrimSuffix(proxyURL, "/") + "/_syncv3/admin" + path
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set(handler.AdminActorHeader, cliActor())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("HTTP %d: %s", res.StatusCode, string(body))
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+)
+
+const inspectUsage = `Usage: syncv3 inspect --user USER_ID [--proxy URL]
+
+Prints what the proxy knows about a user: their devices and poller positions from the database,
+the number of rooms they are in and, if --proxy is given, their active sliding sync sessions and
+the sticky request parameters of each. Requires %s to be set, and %s to be set when using --proxy.
+
+`
+
+func executeInspect() {
+	inspectFlags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	userID := inspectFlags.String("user", "", "The user ID to inspect")
+	proxyURL := inspectFlags.String("proxy", "", "The base URL of a running proxy to fetch active sessions from, e.g 'http://localhost:8008'. Include any path prefix.")
+	inspectFlags.Usage = func() {
+		fmt.Fprintf(inspectFlags.Output(), inspectUsage, EnvDB, EnvAdminToken)
+		inspectFlags.PrintDefaults()
+	}
+	inspectFlags.Parse(os.Args[2:])
+
+	if !strings.HasPrefix(*userID, "@") {
+		inspectFlags.Usage()
+		os.Exit(1)
+	}
+	dbConnString := dbConnString()
+	if dbConnString == "" {
+		fmt.Printf("%s or %s must be set\n", EnvDB, EnvDBFile)
+		os.Exit(1)
+	}
+	if *proxyURL != "" && os.Getenv(EnvAdminToken) == "" {
+		fmt.Printf("%s must be set when using --proxy\n", EnvAdminToken)
+		os.Exit(1)
+	}
+
+	store := state.NewStorage(dbConnString)
+	defer store.Teardown()
+	devicesTable := sync2.NewDevicesTable(store.DB)
+
+	fmt.Printf("User: %s\n\n", *userID)
+
+	devices, err := devicesTable.DevicesForUser(*userID)
+	if err != nil {
+		fatalInspect("failed to load devices: %s", err)
+	}
+	fmt.Printf("Devices (%d):\n", len(devices))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  DEVICE\tTOKENS\tLAST SEEN\tSINCE\n")
+	for _, d := range devices {
+		lastSeen := "never"
+		if d.LastSeen != nil {
+			lastSeen = d.LastSeen.Format(time.RFC3339)
+		}
+		since := d.Since
+		if since == "" {
+			since = "(none, initial sync pending)"
+		}
+		fmt.Fprintf(w, "  %s\t%d\t%s\t%s\n", d.DeviceID, d.NumTokens, lastSeen, since)
+	}
+	w.Flush()
+	if len(devices) == 0 {
+		fmt.Println("  The proxy has never polled for this user.")
+	}
+
+	latestNID, err := store.LatestEventNID()
+	if err != nil {
+		fatalInspect("failed to load latest event NID: %s", err)
+	}
+	joinedRooms, err := store.JoinedRoomsAfterPosition(*userID, latestNID)
+	if err != nil {
+		fatalInspect("failed to load joined rooms: %s", err)
+	}
+	invites, err := store.InvitesTable.SelectAllInvitesForUser(*userID)
+	if err != nil {
+		fatalInspect("failed to load invites: %s", err)
+	}
+	fmt.Printf("\nRooms: %d joined, %d invited\n", len(joinedRooms), len(invites))
+
+	if *proxyURL == "" {
+		fmt.Println("\nSessions: pass --proxy to list active sessions.")
+		return
+	}
+	var conns handler.AdminUserConns
+	err = callAdminAPI(*proxyURL, os.Getenv(EnvAdminToken), "GET", "/users/"+url.PathEscape(*userID)+"/conns", &conns)
+	if err != nil {
+		fatalInspect("failed to fetch sessions: %s", err)
+	}
+	fmt.Printf("\nSessions (%d):\n", len(conns.Conns))
+	for _, c := range conns.Conns {
+		fmt.Printf("  device=%s conn_id=%q\n", c.DeviceID, c.ConnID)
+		if c.StickyRequest == nil {
+			fmt.Println("    (no requests processed yet)")
+			continue
+		}
+		sticky, _ := json.MarshalIndent(c.StickyRequest, "    ", "  ")
+		fmt.Printf("    %s\n", sticky)
+	}
+}
+
+func fatalInspect(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+	os.Exit(1)
+}
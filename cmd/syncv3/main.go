@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -23,7 +25,11 @@ import (
 
 	syncv3 "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+	"github.com/matrix-org/sliding-sync/webhook"
 )
 
 var GitCommit string
@@ -56,14 +62,66 @@ const (
 	EnvIdleTimeoutSecs        = "SYNCV3_DB_IDLE_TIMEOUT_SECS"
 	EnvHTTPTimeoutSecs        = "SYNCV3_HTTP_TIMEOUT_SECS"
 	EnvHTTPInitialTimeoutSecs = "SYNCV3_HTTP_INITIAL_TIMEOUT_SECS"
+	EnvDisabledExtensions     = "SYNCV3_DISABLED_EXTENSIONS"
+	EnvReusePort              = "SYNCV3_REUSEPORT"
+	EnvShutdownTimeoutSecs    = "SYNCV3_SHUTDOWN_TIMEOUT_SECS"
+	EnvSlowRequestMSecs       = "SYNCV3_SLOW_REQUEST_MSECS"
+	EnvCORSAllowedOrigins     = "SYNCV3_CORS_ALLOWED_ORIGINS"
+	EnvCORSAllowedHeaders     = "SYNCV3_CORS_ALLOWED_HEADERS"
+	EnvCORSMaxAgeSecs         = "SYNCV3_CORS_MAX_AGE_SECS"
+	EnvPathPrefix             = "SYNCV3_PATH_PREFIX"
+	EnvMaxRequestBodyBytes    = "SYNCV3_MAX_REQUEST_BODY_BYTES"
+	EnvNewConnsPerIPPerMin    = "SYNCV3_NEW_CONNS_PER_IP_PER_MIN"
+	EnvTrustForwardedFor      = "SYNCV3_TRUST_X_FORWARDED_FOR"
+	EnvReqsPerUserPerMin      = "SYNCV3_REQS_PER_USER_PER_MIN"
+	EnvAdminToken             = "SYNCV3_ADMIN_TOKEN"
+	EnvMaxRoomsPerResponse    = "SYNCV3_MAX_ROOMS_PER_RESPONSE"
+	EnvTypingDebounceMSecs    = "SYNCV3_TYPING_DEBOUNCE_MSECS"
+	EnvTypingExpirySecs       = "SYNCV3_TYPING_EXPIRY_SECS"
+	EnvOIDCIntrospectionURL   = "SYNCV3_OIDC_INTROSPECTION_URL"
+	EnvOIDCClientID           = "SYNCV3_OIDC_CLIENT_ID"
+	EnvOIDCClientSecret       = "SYNCV3_OIDC_CLIENT_SECRET"
+	EnvOIDCServerName         = "SYNCV3_OIDC_SERVER_NAME"
+	EnvOIDCWhoAmIFallback     = "SYNCV3_OIDC_WHOAMI_FALLBACK"
+	EnvOIDCCacheSecs          = "SYNCV3_OIDC_CACHE_SECS"
+	EnvWebhookURL             = "SYNCV3_WEBHOOK_URL"
+	EnvWebhookSecret          = "SYNCV3_WEBHOOK_SECRET"
+	EnvWebhookNotify          = "SYNCV3_WEBHOOK_NOTIFY"
+	EnvWebhookMaxRetries      = "SYNCV3_WEBHOOK_MAX_RETRIES"
+	EnvWellKnownProxyURL      = "SYNCV3_WELL_KNOWN_PROXY_URL"
+	EnvWellKnownMergeURL      = "SYNCV3_WELL_KNOWN_MERGE_URL"
+	EnvPassthroughPaths       = "SYNCV3_PASSTHROUGH_PATHS"
+	EnvDBFile                 = "SYNCV3_DB_FILE"
+	EnvDBPasswordFile         = "SYNCV3_DB_PASSWORD_FILE"
+	EnvDBSSLMode              = "SYNCV3_DB_SSLMODE"
+	EnvDBSSLCert              = "SYNCV3_DB_SSLCERT"
+	EnvDBSSLKey               = "SYNCV3_DB_SSLKEY"
+	EnvDBSSLRootCert          = "SYNCV3_DB_SSLROOTCERT"
+	EnvEventAge               = "SYNCV3_EVENT_AGE"
+	EnvEventAgeTS             = "SYNCV3_EVENT_AGE_TS"
+	EnvToDeviceMaxMessages    = "SYNCV3_TO_DEVICE_MAX_MESSAGES"
+	EnvToDeviceMaxBytes       = "SYNCV3_TO_DEVICE_MAX_BYTES"
+	EnvSyncPaths              = "SYNCV3_SYNC_PATHS"
+	EnvInternalBindAddr       = "SYNCV3_INTERNAL_BINDADDR"
+	EnvInternalToken          = "SYNCV3_INTERNAL_TOKEN"
+	EnvTimelineBackfill       = "SYNCV3_TIMELINE_BACKFILL"
+	EnvRoomSummaryFallback    = "SYNCV3_ROOM_SUMMARY_FALLBACK"
+	EnvLocalMessages          = "SYNCV3_LOCAL_MESSAGES"
+	EnvDefaultLists           = "SYNCV3_DEFAULT_LISTS"
+	EnvPhasedInitialSyncRooms = "SYNCV3_PHASED_INITIAL_SYNC_ROOMS"
+	EnvMaxResponseBytes       = "SYNCV3_MAX_RESPONSE_BYTES"
+	EnvMaxListOps             = "SYNCV3_MAX_LIST_OPS"
+	EnvInstanceName           = "SYNCV3_INSTANCE_NAME"
+	EnvExperimental           = "SYNCV3_EXPERIMENTAL"
+	EnvInMemory               = "SYNCV3_IN_MEMORY"
 )
 
 var helpMsg = fmt.Sprintf(`
 Environment var
 %s     Required. The destination homeserver to talk to (CS API HTTPS URL) e.g 'https://matrix-client.matrix.org' (Supports unix socket: /path/to/socket)
-%s         Required. The postgres connection string: https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING
+%s         Required. The postgres connection string: https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING Can instead be read from a file, see below.
 %s     Required. A secret to use to encrypt access tokens. Must remain the same for the lifetime of the database.
-%s   Default: 0.0.0.0:8008.  The interface and port to listen on. (Supports unix socket: /path/to/socket)
+%s   Default: 0.0.0.0:8008.  The interface and port to listen on. (Supports unix socket: /path/to/socket) Multiple addresses can be comma-separated e.g '127.0.0.1:8008,[::1]:8008'.
 %s   Default: unset. Path to a certificate file to serve to HTTPS clients. Specifying this enables TLS on the bound address.
 %s    Default: unset. Path to a key file for the certificate. Must be provided along with the certificate file.
 %s      Default: unset. The bind addr for pprof debugging e.g ':6060'. If not set, does not listen.
@@ -77,8 +135,69 @@ Environment var
 %s Default: 3600. The maximum amount of time a database connection may be idle, in seconds. 0 means no limit.
 %s Default: 300. The timeout in seconds for normal HTTP requests.
 %s Default: 1800. The timeout in seconds for initial sync requests.
+%s Default: unset. Comma-separated list of extensions to ignore e.g 'typing,receipts'. Valid values are to_device, e2ee, account_data, typing, receipts and debug.
+%s Default: unset. If '1', sets SO_REUSEPORT on the listening socket so a new process can take over the bind address before the old one exits. Ignored when using systemd socket activation.
+%s Default: 30. The maximum time in seconds to wait for in-flight requests to complete when shutting down.
+%s Default: 50000. Requests which take longer than this many milliseconds to process are logged with a timing breakdown and counted in metrics.
+%s Default: *. Comma-separated list of origins allowed to make cross-origin requests e.g 'https://app.element.io'.
+%s Default: Origin,X-Requested-With,Content-Type,Accept,Authorization. Comma-separated list of headers allowed in cross-origin requests.
+%s Default: 0. How long in seconds browsers may cache CORS preflight responses. 0 means no Access-Control-Max-Age header is sent.
+%s Default: unset. A path prefix to serve all endpoints under e.g '/sliding-sync' serves '/sliding-sync/_matrix/client/v3/sync'.
+%s Default: 10485760. The maximum size in bytes of a sync request body. Larger requests are rejected with HTTP 413.
+%s Default: 0. The maximum number of new connections each client IP address can make per minute. 0 means no limit.
+%s Default: 0. The number of reverse proxies in front of the proxy which append to the X-Forwarded-For header. Client IP addresses are taken from that many entries from the right of the header. 0 ignores the header.
+%s Default: 0. The maximum number of sync requests each user can make per minute, across all their devices. 0 means no limit.
+%s Default: unset. A secret token which enables the admin API at /_syncv3/admin. Requests must send it as 'Authorization: Bearer <token>'.
+%s Default: 0. The maximum number of rooms to send for list ranges in a single response. Remaining rooms are sent in following responses. 0 means no limit.
+%s Default: 0. The minimum time in milliseconds between typing notifications for each room. Typing changes in between are coalesced. 0 sends every change immediately.
+%s Default: 60. Clears typing notifications in rooms which have had no typing updates for this many seconds, in case the update which stopped users typing was missed. 0 never clears them.
+%s Default: unset. The OAuth 2.0 token introspection endpoint of the OIDC provider, for homeservers which delegate auth (MSC3861). If set, access tokens are introspected instead of calling /whoami.
+%s Default: unset. The client ID to authenticate to the introspection endpoint with.
+%s Default: unset. The client secret to authenticate to the introspection endpoint with.
+%s Default: unset. The homeserver's server name e.g 'example.com'. Required if the introspection endpoint is set.
+%s Default: unset. If '1', tokens which the OIDC provider does not recognise are looked up with /whoami as well.
+%s Default: 60. How long in seconds to cache token introspection results for. 0 disables caching.
+%s Default: unset. A URL to POST notifications about new events to. If unset, no notifications are sent.
+%s Default: unset. A secret to sign webhook request bodies with. The HMAC-SHA256 is sent in the X-Sliding-Sync-Signature header.
+%s Default: new_rooms,memberships. Comma-separated list of what to send webhook notifications for: 'new_rooms', 'memberships' and/or event types e.g 'm.room.message'.
+%s Default: 5. The number of times to retry a failed webhook notification before dropping it.
+%s Default: unset. The public URL of this proxy e.g 'https://slidingsync.example.com'. If set, /.well-known/matrix/client is served advertising it.
+%s Default: unset. The URL of the homeserver's /.well-known/matrix/client to add the proxy to. If unset, it is fetched from the destination homeserver.
+%s Default: unset. Comma-separated list of client-server API paths to forward to the homeserver e.g '/_matrix/client/versions,/_matrix/client/v3/capabilities'. Paths ending in '/' forward everything beneath them.
+%s Default: unset. A file containing the postgres connection string, used instead of the connection string variable. Re-read on SIGHUP.
+%s Default: unset. A file containing the postgres password, which overrides any in the connection string. Re-read on SIGHUP.
+%s Default: unset. The postgres sslmode e.g 'verify-full', which overrides any in the connection string.
+%s Default: unset. Path to a client certificate to authenticate to postgres with.
+%s Default: unset. Path to the key for the postgres client certificate.
+%s Default: unset. Path to the CA certificate(s) used to verify the postgres server.
+%s Default: recompute. How to serve unsigned.age in events: 'recompute' updates it to the current age, 'strip' removes it.
+%s Default: unset. If '1', events include unsigned.age_ts: the time the event was created, in milliseconds since the epoch.
+%s Default: 0. The maximum number of to-device messages to send in each response, overriding larger limits requested by clients. 0 means the client's limit is used.
+%s Default: 1048576. The maximum total size in bytes of to-device messages to send in each response. Remaining messages are sent once the client acknowledges these ones. At least one message is always sent. 0 means no limit.
+%s Default: /_matrix/client/v3/sync,/_matrix/client/unstable/org.matrix.msc3575/sync. Comma-separated list of paths to serve the sync endpoint on, beneath the path prefix.
+%s Default: unset. A separate address to serve the admin API, /metrics and /debug/pprof/ on, instead of the public address. (Supports unix socket: /path/to/socket)
+%s Default: unset. A secret token required as 'Authorization: Bearer <token>' for /metrics and /debug/pprof/ on the internal address. The admin API still uses the admin token.
+%s Default: unset. If '1', when clients ask for more timeline events than the proxy has stored for a room, older events are fetched from the homeserver's /messages.
+%s Default: unset. If '1', the homeserver's room summary API is queried for invites whose stripped state has no room name or alias, so they can be named and counted.
+%s Default: unset. If '1', serve /rooms/{roomID}/messages from the proxy's stored events when paginating backwards, forwarding to the homeserver when the proxy has nothing older.
+%s Default: unset. A JSON object of lists to use when a connection's first request has no lists or room subscriptions e.g '{"rooms":{"ranges":[[0,19]],"timeline_limit":1}}'. The lists stay in place for the rest of the connection.
+%s Default: 0. Initial responses with at least this many rooms are sent in phases: first room names and ordering without timelines or required state, then timelines and required state for this many rooms per response. 0 sends everything at once.
+%s Default: 0. The maximum size in bytes of room data in each response. Rooms which don't fit are sent in the following responses, which clients are told to request straight away with 'pending: true'. 0 means no limit.
+%s Default: 0. The maximum number of list operations caused by new events in each response. Lists with further changes are re-sent with one SYNC per range in the following response, which clients are told to request straight away with 'pending: true'. 0 means no limit.
+%s Default: unset. A name for this instance, which must differ between instances that share a secret and database. Connection positions issued by one instance are rejected by the others. Keep it the same across restarts so connections can be resumed.
+%s Default: unset. Comma-separated list of experimental behaviours to turn on e.g 'timeline_backfill,local_messages'. Valid values are timeline_backfill, room_summary_fallback and local_messages, which are the same as setting the variables above to '1'.
+%s Default: unset. If '1', everything is stored in memory instead of postgres, and the database variables are not needed. All data is lost when the proxy stops, so this is only for development and testing.
 `, EnvServer, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvOTLP, EnvOTLPUsername, EnvOTLPPassword,
-	EnvSentryDsn, EnvLogLevel, EnvMaxConns, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs)
+	EnvSentryDsn, EnvLogLevel, EnvMaxConns, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs, EnvDisabledExtensions,
+	EnvReusePort, EnvShutdownTimeoutSecs, EnvSlowRequestMSecs, EnvCORSAllowedOrigins,
+	EnvCORSAllowedHeaders, EnvCORSMaxAgeSecs, EnvPathPrefix, EnvMaxRequestBodyBytes,
+	EnvNewConnsPerIPPerMin, EnvTrustForwardedFor, EnvReqsPerUserPerMin, EnvAdminToken, EnvMaxRoomsPerResponse, EnvTypingDebounceMSecs, EnvTypingExpirySecs,
+	EnvOIDCIntrospectionURL, EnvOIDCClientID, EnvOIDCClientSecret, EnvOIDCServerName, EnvOIDCWhoAmIFallback, EnvOIDCCacheSecs,
+	EnvWebhookURL, EnvWebhookSecret, EnvWebhookNotify, EnvWebhookMaxRetries, EnvWellKnownProxyURL, EnvWellKnownMergeURL,
+	EnvPassthroughPaths, EnvDBFile, EnvDBPasswordFile, EnvDBSSLMode, EnvDBSSLCert, EnvDBSSLKey, EnvDBSSLRootCert,
+	EnvEventAge, EnvEventAgeTS, EnvToDeviceMaxMessages, EnvToDeviceMaxBytes, EnvSyncPaths,
+	EnvInternalBindAddr, EnvInternalToken, EnvTimelineBackfill, EnvRoomSummaryFallback, EnvLocalMessages,
+	EnvDefaultLists, EnvPhasedInitialSyncRooms, EnvMaxResponseBytes, EnvMaxListOps, EnvInstanceName, EnvExperimental, EnvInMemory)
 
 func defaulting(in, dft string) string {
 	if in == "" {
@@ -87,6 +206,48 @@ func defaulting(in, dft string) string {
 	return in
 }
 
+// splitList splits a comma-separated env var value into its trimmed elements. Returns nil
+// if the value is empty.
+// Experimental behaviours which can be turned on with EnvExperimental, as well as with their own
+// variables.
+const (
+	experimentalTimelineBackfill    = "timeline_backfill"
+	experimentalRoomSummaryFallback = "room_summary_fallback"
+	experimentalLocalMessages       = "local_messages"
+)
+
+var experimentalNames = []string{experimentalTimelineBackfill, experimentalRoomSummaryFallback, experimentalLocalMessages}
+
+// parseExperimental validates a list of experimental behaviours and returns them as a set.
+func parseExperimental(names []string) (map[string]bool, error) {
+	enabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		known := false
+		for _, expName := range experimentalNames {
+			if name == expName {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown experimental behaviour '%s', must be one of %v", name, experimentalNames)
+		}
+		enabled[name] = true
+	}
+	return enabled, nil
+}
+
+func splitList(in string) []string {
+	if in == "" {
+		return nil
+	}
+	var out []string
+	for _, v := range strings.Split(in, ",") {
+		out = append(out, strings.TrimSpace(v))
+	}
+	return out
+}
+
 func main() {
 	fmt.Printf("Sync v3 [%s] (%s)\n", version, GitCommit)
 	sync2.ProxyVersion = version
@@ -96,6 +257,18 @@ func main() {
 		executeMigrations()
 		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == "purge" {
+		executePurge()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		executeInspect()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "resync" {
+		executeResync()
+		return
+	}
 
 	args := map[string]string{
 		EnvServer:                 os.Getenv(EnvServer),
@@ -116,8 +289,64 @@ func main() {
 		EnvIdleTimeoutSecs:        defaulting(os.Getenv(EnvIdleTimeoutSecs), "3600"),
 		EnvHTTPTimeoutSecs:        defaulting(os.Getenv(EnvHTTPTimeoutSecs), "300"),
 		EnvHTTPInitialTimeoutSecs: defaulting(os.Getenv(EnvHTTPInitialTimeoutSecs), "1800"),
+		EnvDisabledExtensions:     os.Getenv(EnvDisabledExtensions),
+		EnvReusePort:              os.Getenv(EnvReusePort),
+		EnvShutdownTimeoutSecs:    defaulting(os.Getenv(EnvShutdownTimeoutSecs), "30"),
+		EnvSlowRequestMSecs:       defaulting(os.Getenv(EnvSlowRequestMSecs), "50000"),
+		EnvCORSAllowedOrigins:     os.Getenv(EnvCORSAllowedOrigins),
+		EnvCORSAllowedHeaders:     os.Getenv(EnvCORSAllowedHeaders),
+		EnvCORSMaxAgeSecs:         defaulting(os.Getenv(EnvCORSMaxAgeSecs), "0"),
+		EnvPathPrefix:             os.Getenv(EnvPathPrefix),
+		EnvMaxRequestBodyBytes:    defaulting(os.Getenv(EnvMaxRequestBodyBytes), "10485760"),
+		EnvNewConnsPerIPPerMin:    defaulting(os.Getenv(EnvNewConnsPerIPPerMin), "0"),
+		EnvTrustForwardedFor:      defaulting(os.Getenv(EnvTrustForwardedFor), "0"),
+		EnvReqsPerUserPerMin:      defaulting(os.Getenv(EnvReqsPerUserPerMin), "0"),
+		EnvAdminToken:             os.Getenv(EnvAdminToken),
+		EnvMaxRoomsPerResponse:    defaulting(os.Getenv(EnvMaxRoomsPerResponse), "0"),
+		EnvTypingDebounceMSecs:    defaulting(os.Getenv(EnvTypingDebounceMSecs), "0"),
+		EnvTypingExpirySecs:       defaulting(os.Getenv(EnvTypingExpirySecs), "60"),
+		EnvOIDCIntrospectionURL:   os.Getenv(EnvOIDCIntrospectionURL),
+		EnvOIDCClientID:           os.Getenv(EnvOIDCClientID),
+		EnvOIDCClientSecret:       os.Getenv(EnvOIDCClientSecret),
+		EnvOIDCServerName:         os.Getenv(EnvOIDCServerName),
+		EnvOIDCWhoAmIFallback:     os.Getenv(EnvOIDCWhoAmIFallback),
+		EnvOIDCCacheSecs:          defaulting(os.Getenv(EnvOIDCCacheSecs), "60"),
+		EnvWebhookURL:             os.Getenv(EnvWebhookURL),
+		EnvWebhookSecret:          os.Getenv(EnvWebhookSecret),
+		EnvWebhookNotify:          defaulting(os.Getenv(EnvWebhookNotify), "new_rooms,memberships"),
+		EnvWebhookMaxRetries:      defaulting(os.Getenv(EnvWebhookMaxRetries), "5"),
+		EnvWellKnownProxyURL:      os.Getenv(EnvWellKnownProxyURL),
+		EnvWellKnownMergeURL:      os.Getenv(EnvWellKnownMergeURL),
+		EnvPassthroughPaths:       os.Getenv(EnvPassthroughPaths),
+		EnvEventAge:               defaulting(os.Getenv(EnvEventAge), "recompute"),
+		EnvEventAgeTS:             os.Getenv(EnvEventAgeTS),
+		EnvToDeviceMaxMessages:    defaulting(os.Getenv(EnvToDeviceMaxMessages), "0"),
+		EnvToDeviceMaxBytes:       defaulting(os.Getenv(EnvToDeviceMaxBytes), "1048576"),
+		EnvSyncPaths:              os.Getenv(EnvSyncPaths),
+		EnvInternalBindAddr:       os.Getenv(EnvInternalBindAddr),
+		EnvInternalToken:          os.Getenv(EnvInternalToken),
+		EnvTimelineBackfill:       os.Getenv(EnvTimelineBackfill),
+		EnvRoomSummaryFallback:    os.Getenv(EnvRoomSummaryFallback),
+		EnvLocalMessages:          os.Getenv(EnvLocalMessages),
+		EnvDefaultLists:           os.Getenv(EnvDefaultLists),
+		EnvPhasedInitialSyncRooms: defaulting(os.Getenv(EnvPhasedInitialSyncRooms), "0"),
+		EnvMaxResponseBytes:       defaulting(os.Getenv(EnvMaxResponseBytes), "0"),
+		EnvMaxListOps:             defaulting(os.Getenv(EnvMaxListOps), "0"),
+		EnvInstanceName:           os.Getenv(EnvInstanceName),
+		EnvExperimental:           os.Getenv(EnvExperimental),
+		EnvInMemory:               os.Getenv(EnvInMemory),
+	}
+	dsn, err := sqlutil.NewReloadableDSN(dbOpts())
+	if err != nil {
+		fmt.Print(helpMsg)
+		fmt.Printf("\nfailed to build the database connection string: %s\n", err)
+		os.Exit(1)
 	}
+	args[EnvDB] = dsn.String()
 	requiredEnvVars := []string{EnvServer, EnvDB, EnvSecret, EnvBindAddr}
+	if args[EnvInMemory] == "1" {
+		requiredEnvVars = []string{EnvServer, EnvSecret, EnvBindAddr}
+	}
 	for _, requiredEnvVar := range requiredEnvVars {
 		if args[requiredEnvVar] == "" {
 			fmt.Print(helpMsg)
@@ -131,6 +360,11 @@ func main() {
 		fmt.Printf("\nboth %s and %s must be set together\n", EnvTLSCert, EnvTLSKey)
 		os.Exit(1)
 	}
+	if args[EnvOIDCIntrospectionURL] != "" && args[EnvOIDCServerName] == "" {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s must be set when %s is set\n", EnvOIDCServerName, EnvOIDCIntrospectionURL)
+		os.Exit(1)
+	}
 	// pprof
 	if args[EnvPPROF] != "" {
 		go func() {
@@ -210,14 +444,192 @@ func main() {
 	if err != nil {
 		panic("invalid value for " + EnvHTTPInitialTimeoutSecs + ": " + args[EnvHTTPInitialTimeoutSecs])
 	}
+	shutdownTimeoutSecs, err := strconv.Atoi(args[EnvShutdownTimeoutSecs])
+	if err != nil {
+		panic("invalid value for " + EnvShutdownTimeoutSecs + ": " + args[EnvShutdownTimeoutSecs])
+	}
+	slowRequestMSecs, err := strconv.Atoi(args[EnvSlowRequestMSecs])
+	if err != nil {
+		panic("invalid value for " + EnvSlowRequestMSecs + ": " + args[EnvSlowRequestMSecs])
+	}
+	maxRequestBodyBytes, err := strconv.ParseInt(args[EnvMaxRequestBodyBytes], 10, 64)
+	if err != nil {
+		panic("invalid value for " + EnvMaxRequestBodyBytes + ": " + args[EnvMaxRequestBodyBytes])
+	}
+	newConnsPerIPPerMin, err := strconv.Atoi(args[EnvNewConnsPerIPPerMin])
+	if err != nil {
+		panic("invalid value for " + EnvNewConnsPerIPPerMin + ": " + args[EnvNewConnsPerIPPerMin])
+	}
+	reqsPerUserPerMin, err := strconv.Atoi(args[EnvReqsPerUserPerMin])
+	if err != nil {
+		panic("invalid value for " + EnvReqsPerUserPerMin + ": " + args[EnvReqsPerUserPerMin])
+	}
+	maxRoomsPerResponse, err := strconv.Atoi(args[EnvMaxRoomsPerResponse])
+	if err != nil {
+		panic("invalid value for " + EnvMaxRoomsPerResponse + ": " + args[EnvMaxRoomsPerResponse])
+	}
+	typingDebounceMSecs, err := strconv.Atoi(args[EnvTypingDebounceMSecs])
+	if err != nil {
+		panic("invalid value for " + EnvTypingDebounceMSecs + ": " + args[EnvTypingDebounceMSecs])
+	}
+	typingExpirySecs, err := strconv.Atoi(args[EnvTypingExpirySecs])
+	if err != nil || typingExpirySecs < 0 {
+		panic("invalid value for " + EnvTypingExpirySecs + ": " + args[EnvTypingExpirySecs])
+	}
+	var oidcIntrospection *sync2.IntrospectionOpts
+	if args[EnvOIDCIntrospectionURL] != "" {
+		oidcCacheSecs, err := strconv.Atoi(args[EnvOIDCCacheSecs])
+		if err != nil {
+			panic("invalid value for " + EnvOIDCCacheSecs + ": " + args[EnvOIDCCacheSecs])
+		}
+		oidcIntrospection = &sync2.IntrospectionOpts{
+			Endpoint:         args[EnvOIDCIntrospectionURL],
+			ClientID:         args[EnvOIDCClientID],
+			ClientSecret:     args[EnvOIDCClientSecret],
+			ServerName:       args[EnvOIDCServerName],
+			FallbackToWhoAmI: args[EnvOIDCWhoAmIFallback] == "1",
+			CacheTTL:         time.Duration(oidcCacheSecs) * time.Second,
+		}
+	}
+	var webhookOpts *webhook.Opts
+	if args[EnvWebhookURL] != "" {
+		webhookMaxRetries, err := strconv.Atoi(args[EnvWebhookMaxRetries])
+		if err != nil {
+			panic("invalid value for " + EnvWebhookMaxRetries + ": " + args[EnvWebhookMaxRetries])
+		}
+		webhookOpts = &webhook.Opts{
+			URL:        args[EnvWebhookURL],
+			Secret:     args[EnvWebhookSecret],
+			MaxRetries: webhookMaxRetries,
+		}
+		for _, notify := range splitList(args[EnvWebhookNotify]) {
+			switch notify {
+			case "new_rooms":
+				webhookOpts.NewRooms = true
+			case "memberships":
+				webhookOpts.Memberships = true
+			default:
+				webhookOpts.EventTypes = append(webhookOpts.EventTypes, notify)
+			}
+		}
+	}
+	if args[EnvEventAge] != "recompute" && args[EnvEventAge] != "strip" {
+		panic("invalid value for " + EnvEventAge + ": " + args[EnvEventAge])
+	}
+	toDeviceMaxMessages, err := strconv.Atoi(args[EnvToDeviceMaxMessages])
+	if err != nil || toDeviceMaxMessages < 0 {
+		panic("invalid value for " + EnvToDeviceMaxMessages + ": " + args[EnvToDeviceMaxMessages])
+	}
+	toDeviceMaxBytes, err := strconv.Atoi(args[EnvToDeviceMaxBytes])
+	if err != nil || toDeviceMaxBytes < 0 {
+		panic("invalid value for " + EnvToDeviceMaxBytes + ": " + args[EnvToDeviceMaxBytes])
+	}
+	syncPaths := splitList(args[EnvSyncPaths])
+	for _, path := range syncPaths {
+		if !strings.HasPrefix(path, "/") {
+			panic("invalid value for " + EnvSyncPaths + ": " + args[EnvSyncPaths])
+		}
+	}
+	phasedInitialSyncRooms, err := strconv.Atoi(args[EnvPhasedInitialSyncRooms])
+	if err != nil || phasedInitialSyncRooms < 0 {
+		panic("invalid value for " + EnvPhasedInitialSyncRooms + ": " + args[EnvPhasedInitialSyncRooms])
+	}
+	maxResponseBytes, err := strconv.Atoi(args[EnvMaxResponseBytes])
+	if err != nil || maxResponseBytes < 0 {
+		panic("invalid value for " + EnvMaxResponseBytes + ": " + args[EnvMaxResponseBytes])
+	}
+	trustedProxies, err := strconv.Atoi(args[EnvTrustForwardedFor])
+	if err != nil || trustedProxies < 0 {
+		panic("invalid value for " + EnvTrustForwardedFor + ": " + args[EnvTrustForwardedFor])
+	}
+	maxListOps, err := strconv.Atoi(args[EnvMaxListOps])
+	if err != nil || maxListOps < 0 {
+		panic("invalid value for " + EnvMaxListOps + ": " + args[EnvMaxListOps])
+	}
+	var defaultLists map[string]sync3.RequestList
+	if args[EnvDefaultLists] != "" {
+		if err := json.Unmarshal([]byte(args[EnvDefaultLists]), &defaultLists); err != nil {
+			panic("invalid value for " + EnvDefaultLists + ": " + err.Error())
+		}
+		if err := (&sync3.Request{Lists: defaultLists}).Validate(); err != nil {
+			panic("invalid value for " + EnvDefaultLists + ": " + err.Error())
+		}
+	}
+	experimental, err := parseExperimental(splitList(args[EnvExperimental]))
+	if err != nil {
+		panic("invalid value for " + EnvExperimental + ": " + err.Error())
+	}
+	corsMaxAgeSecs, err := strconv.Atoi(args[EnvCORSMaxAgeSecs])
+	if err != nil {
+		panic("invalid value for " + EnvCORSMaxAgeSecs + ": " + args[EnvCORSMaxAgeSecs])
+	}
 	h2, h3 := syncv3.Setup(args[EnvServer], args[EnvDB], args[EnvSecret], syncv3.Opts{
-		AddPrometheusMetrics:  args[EnvPrometheus] != "",
-		DBMaxConns:            maxConnsInt,
-		DBConnMaxIdleTime:     time.Duration(idleTimeSecs) * time.Second,
-		MaxTransactionIDDelay: time.Second,
-		HTTPTimeout:           time.Duration(httpTimeoutSecs) * time.Second,
-		HTTPLongTimeout:       time.Duration(httpLongTimeoutSecs) * time.Second,
+		AddPrometheusMetrics:     args[EnvPrometheus] != "" || args[EnvInternalBindAddr] != "",
+		DBMaxConns:               maxConnsInt,
+		DBConnMaxIdleTime:        time.Duration(idleTimeSecs) * time.Second,
+		MaxTransactionIDDelay:    time.Second,
+		HTTPTimeout:              time.Duration(httpTimeoutSecs) * time.Second,
+		HTTPLongTimeout:          time.Duration(httpLongTimeoutSecs) * time.Second,
+		DisabledExtensions:       splitList(args[EnvDisabledExtensions]),
+		SlowRequestThreshold:     time.Duration(slowRequestMSecs) * time.Millisecond,
+		MaxRequestBodyBytes:      maxRequestBodyBytes,
+		NewConnsPerIPPerMinute:   newConnsPerIPPerMin,
+		TrustedProxies:           trustedProxies,
+		RequestsPerUserPerMinute: reqsPerUserPerMin,
+		MaxRoomsPerResponse:      maxRoomsPerResponse,
+		TypingDebounce:           time.Duration(typingDebounceMSecs) * time.Millisecond,
+		TypingExpiry:             time.Duration(typingExpirySecs) * time.Second,
+		OIDCIntrospection:        oidcIntrospection,
+		Webhook:                  webhookOpts,
+		DSN:                      dsn,
+		EventAge: internal.EventAgeOpts{
+			Strip:        args[EnvEventAge] == "strip",
+			IncludeAgeTS: args[EnvEventAgeTS] == "1",
+		},
+		ToDeviceMaxMessages:    toDeviceMaxMessages,
+		ToDeviceMaxBytes:       toDeviceMaxBytes,
+		TimelineBackfill:       args[EnvTimelineBackfill] == "1" || experimental[experimentalTimelineBackfill],
+		RoomSummaryFallback:    args[EnvRoomSummaryFallback] == "1" || experimental[experimentalRoomSummaryFallback],
+		DefaultLists:           defaultLists,
+		PhasedInitialSyncRooms: phasedInitialSyncRooms,
+		MaxResponseBytes:       maxResponseBytes,
+		MaxListOpsPerResponse:  maxListOps,
+		InstanceName:           args[EnvInstanceName],
+		InMemoryStorage:        args[EnvInMemory] == "1",
 	})
+	go reloadDSNOnSIGHUP(dsn)
+
+	var wellKnown *syncv3.WellKnownOpts
+	if args[EnvWellKnownProxyURL] != "" {
+		wellKnown = &syncv3.WellKnownOpts{
+			ProxyURL: args[EnvWellKnownProxyURL],
+			MergeURL: args[EnvWellKnownMergeURL],
+		}
+	}
+
+	var adminAPI http.Handler
+	if args[EnvAdminToken] != "" {
+		adminAPI = handler.NewAdminAPI(h3.(*handler.SyncLiveHandler), h2, args[EnvAdminToken])
+	}
+	var internalSrv *http.Server
+	if args[EnvInternalBindAddr] != "" {
+		internalSrv = syncv3.RunInternalServer(syncv3.InternalServerOpts{
+			BindAddr: args[EnvInternalBindAddr],
+			Token:    args[EnvInternalToken],
+			Admin:    adminAPI,
+			Metrics:  true,
+			PProf:    true,
+		})
+		// keep internals off the public listener
+		adminAPI = nil
+	}
+	var messagesAPI func(homeserver http.Handler) http.Handler
+	if args[EnvLocalMessages] == "1" || experimental[experimentalLocalMessages] {
+		syncHandler := h3.(*handler.SyncLiveHandler) // before h3 is wrapped in middleware
+		messagesAPI = func(homeserver http.Handler) http.Handler {
+			return handler.NewMessagesAPI(syncHandler, homeserver)
+		}
+	}
 
 	go h2.StartV2Pollers()
 	go h2.Store.Cleaner(time.Hour)
@@ -233,13 +645,70 @@ func main() {
 		h3 = sentryHandler.Handle(h3)
 	}
 
-	syncv3.RunSyncV3Server(h3, args[EnvBindAddr], args[EnvServer], args[EnvTLSCert], args[EnvTLSKey])
-	WaitForShutdown(args[EnvSentryDsn] != "")
+	srv := syncv3.StartSyncV3Server(h3, args[EnvServer], syncv3.ServerOpts{
+		BindAddrs:  splitList(args[EnvBindAddr]),
+		TLSCert:    args[EnvTLSCert],
+		TLSKey:     args[EnvTLSKey],
+		ReusePort:  args[EnvReusePort] == "1",
+		PathPrefix: args[EnvPathPrefix],
+		CORS: syncv3.CORSOpts{
+			AllowedOrigins: splitList(args[EnvCORSAllowedOrigins]),
+			AllowedHeaders: splitList(args[EnvCORSAllowedHeaders]),
+			MaxAge:         time.Duration(corsMaxAgeSecs) * time.Second,
+		},
+		Admin:            adminAPI,
+		WellKnown:        wellKnown,
+		PassthroughPaths: splitList(args[EnvPassthroughPaths]),
+		SyncPaths:        syncPaths,
+		Messages:         messagesAPI,
+	})
+	WaitForShutdown(args[EnvSentryDsn] != "", srv, internalSrv, time.Duration(shutdownTimeoutSecs)*time.Second)
+}
+
+// dbOpts returns how to build the database connection string from the environment.
+func dbOpts() sqlutil.DSNOpts {
+	return sqlutil.DSNOpts{
+		DSN:          os.Getenv(EnvDB),
+		DSNFile:      os.Getenv(EnvDBFile),
+		PasswordFile: os.Getenv(EnvDBPasswordFile),
+		SSLMode:      os.Getenv(EnvDBSSLMode),
+		SSLCert:      os.Getenv(EnvDBSSLCert),
+		SSLKey:       os.Getenv(EnvDBSSLKey),
+		SSLRootCert:  os.Getenv(EnvDBSSLRootCert),
+	}
+}
+
+// dbConnString returns the database connection string from the environment, exiting if it cannot
+// be built.
+func dbConnString() string {
+	dsn, err := dbOpts().BuildDSN()
+	if err != nil {
+		fmt.Printf("failed to build the database connection string: %s\n", err)
+		os.Exit(1)
+	}
+	return dsn
+}
+
+// reloadDSNOnSIGHUP re-reads the database credentials whenever the process receives SIGHUP, so
+// they can be rotated without a restart. New database connections use the new credentials.
+func reloadDSNOnSIGHUP(dsn *sqlutil.ReloadableDSN) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if err := dsn.Reload(); err != nil {
+			fmt.Printf("Failed to reload database credentials: %s\n", err)
+			continue
+		}
+		fmt.Printf("Reloaded database credentials\n")
+	}
 }
 
 // WaitForShutdown blocks until the process receives a SIGINT or SIGTERM signal
-// (see `man 7 signal`). It performs any last cleanup tasks and then exits.
-func WaitForShutdown(sentryInUse bool) {
+// (see `man 7 signal`). It stops accepting new requests and waits up to shutdownTimeout
+// for in-flight requests to complete, performs any last cleanup tasks and then exits.
+// internalSrv is the server for admin, metrics and pprof endpoints, or nil if there isn't one.
+// It is shut down after srv so metrics can be scraped while requests drain.
+func WaitForShutdown(sentryInUse bool, srv, internalSrv *http.Server, shutdownTimeout time.Duration) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	select {
@@ -249,6 +718,18 @@ func WaitForShutdown(sentryInUse bool) {
 
 	fmt.Printf("Shutdown signal received...")
 
+	// Stop listening so a replacement process can take over, then drain in-flight requests.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Printf("Failed to gracefully shut down HTTP server: %s", err)
+	}
+	if internalSrv != nil {
+		if err := internalSrv.Shutdown(ctx); err != nil {
+			fmt.Printf("Failed to gracefully shut down internal HTTP server: %s", err)
+		}
+	}
+
 	if sentryInUse {
 		fmt.Printf("Flushing sentry events...")
 		if !sentry.Flush(time.Second * 5) {
@@ -261,7 +742,7 @@ func WaitForShutdown(sentryInUse bool) {
 
 func executeMigrations() {
 	envArgs := map[string]string{
-		EnvDB: os.Getenv(EnvDB),
+		EnvDB: dbConnString(),
 	}
 	requiredEnvVars := []string{EnvDB}
 	for _, requiredEnvVar := range requiredEnvVars {
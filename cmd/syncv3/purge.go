@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+const purgeUsage = `Usage: syncv3 purge (--room ROOM_ID | --user USER_ID) [--dry-run]
+
+Removes data stored by the proxy. Requires %s to be set.
+
+--room removes all events, state snapshots, receipts, typing notifications, invites, unread
+counts and account data for the room.
+
+--user removes the user's access tokens, devices, to-device messages, device data, account
+data, invites, unread counts and private receipts. Events and public receipts sent by the user
+are left in place as other users can see them.
+
+Running proxies keep purged data in memory and will re-fetch it from the homeserver, so stop
+the proxy before purging, or make sure the room or user is no longer in use.
+
+`
+
+func executePurge() {
+	purgeFlags := flag.NewFlagSet("purge", flag.ExitOnError)
+	roomID := purgeFlags.String("room", "", "The room ID to purge")
+	userID := purgeFlags.String("user", "", "The user ID to purge")
+	dryRun := purgeFlags.Bool("dry-run", false, "Print the number of rows which would be removed, without removing them")
+	purgeFlags.Usage = func() {
+		fmt.Fprintf(purgeFlags.Output(), purgeUsage, EnvDB)
+		purgeFlags.PrintDefaults()
+	}
+	purgeFlags.Parse(os.Args[2:])
+
+	if (*roomID == "") == (*userID == "") {
+		purgeFlags.Usage()
+		os.Exit(1)
+	}
+	dbConnString := dbConnString()
+	if dbConnString == "" {
+		fmt.Printf("%s or %s must be set\n", EnvDB, EnvDBFile)
+		os.Exit(1)
+	}
+
+	store := state.NewStorage(dbConnString)
+	defer store.Teardown()
+
+	var counts []state.PurgeCount
+	var err error
+	var target string
+	if *roomID != "" {
+		if !strings.HasPrefix(*roomID, "!") {
+			fmt.Printf("invalid room ID %q\n", *roomID)
+			os.Exit(1)
+		}
+		target = *roomID
+		counts, err = store.PurgeRoom(*roomID, *dryRun)
+	} else {
+		if !strings.HasPrefix(*userID, "@") {
+			fmt.Printf("invalid user ID %q\n", *userID)
+			os.Exit(1)
+		}
+		target = *userID
+		counts, err = store.PurgeUser(*userID, *dryRun)
+	}
+	if !*dryRun {
+		entry := state.AuditEntry{
+			Timestamp: time.Now().UnixMilli(),
+			Actor:     cliActor(),
+			Action:    "purge_room",
+			Target:    target,
+			Status:    200,
+		}
+		if *userID != "" {
+			entry.Action = "purge_user"
+		}
+		if err != nil {
+			entry.Status = 500
+			entry.Error = err.Error()
+		}
+		if auditErr := store.AuditTable.Insert(&entry); auditErr != nil {
+			fmt.Printf("failed to record purge in the audit log: %s\n", auditErr)
+		}
+	}
+	if err != nil {
+		fmt.Printf("failed to purge %s: %s\n", target, err)
+		os.Exit(1)
+	}
+
+	if *dryRun {
+		fmt.Printf("Dry run: purging %s would remove:\n", target)
+	} else {
+		fmt.Printf("Purged %s, removing:\n", target)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	var total int64
+	for _, c := range counts {
+		fmt.Fprintf(w, "  %s\t%d\n", c.Table, c.Rows)
+		total += c.Rows
+	}
+	fmt.Fprintf(w, "  total\t%d\n", total)
+	w.Flush()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+)
+
+const resyncUsage = `Usage: syncv3 resync --user USER_ID --proxy URL
+
+Forces a running proxy to fetch everything for a user again from the homeserver. The user's pollers
+are stopped and will start again from an initial sync, and all of their sliding sync sessions are
+closed so that clients do an initial sync too. Use this when a user's data in the proxy looks wrong.
+Requires %s to be set to the proxy's admin token.
+
+`
+
+func executeResync() {
+	resyncFlags := flag.NewFlagSet("resync", flag.ExitOnError)
+	userID := resyncFlags.String("user", "", "The user ID to resync")
+	proxyURL := resyncFlags.String("proxy", "", "The base URL of the running proxy, e.g 'http://localhost:8008'. Include any path prefix.")
+	resyncFlags.Usage = func() {
+		fmt.Fprintf(resyncFlags.Output(), resyncUsage, EnvAdminToken)
+		resyncFlags.PrintDefaults()
+	}
+	resyncFlags.Parse(os.Args[2:])
+
+	if !strings.HasPrefix(*userID, "@") || *proxyURL == "" {
+		resyncFlags.Usage()
+		os.Exit(1)
+	}
+	if os.Getenv(EnvAdminToken) == "" {
+		fmt.Printf("%s must be set\n", EnvAdminToken)
+		os.Exit(1)
+	}
+
+	var res handler.AdminUserResync
+	err := callAdminAPI(*proxyURL, os.Getenv(EnvAdminToken), "POST", "/users/"+url.PathEscape(*userID)+"/resync", &res)
+	if err != nil {
+		fmt.Printf("failed to resync %s: %s\n", *userID, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Resync started for %s, closed %d sessions.\n", res.UserID, res.ConnsClosed)
+}
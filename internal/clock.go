@@ -0,0 +1,23 @@
+package internal
+
+import "time"
+
+// Clock is the source of time for code which has time-based behaviour such as backoff, expiry
+// and retention. Production code uses RealClock. Tests can substitute a fake clock, such as
+// testutils.FakeClock, to advance time deterministically rather than sleeping.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is a Clock backed by the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -13,7 +14,8 @@ import (
 type ctx string
 
 var (
-	ctxData ctx = "syncv3_data"
+	ctxData       ctx = "syncv3_data"
+	ctxCommitTime ctx = "syncv3_commit_time"
 )
 
 // logging metadata for a single request
@@ -35,6 +37,12 @@ type data struct {
 	numLists             int
 	roomSubs             int
 	roomUnsubs           int
+	// breakdown of where time was spent. These are atomic as they may be updated from
+	// multiple goroutines working on the same request.
+	dbTime        atomic.Int64
+	sortTime      atomic.Int64
+	serialiseTime atomic.Int64
+	waitTime      atomic.Int64
 }
 
 // prepare a request context so it can contain syncv3 info
@@ -64,6 +72,9 @@ func AssociateUserIDWithRequest(ctx context.Context, userID, deviceID string) co
 	}
 	hub.ConfigureScope(func(scope *sentry.Scope) {
 		scope.SetUser(sentry.User{Username: userID, ID: deviceID})
+		if requestID, ok := ctx.Value(OTLPTagRequestID).(string); ok {
+			scope.SetTag(string(OTLPTagRequestID), requestID)
+		}
 	})
 	return sentry.SetHubOnContext(ctx, hub)
 }
@@ -179,3 +190,72 @@ func RequestContextDurations(ctx context.Context) (setup time.Duration, processi
 	da := d.(*data)
 	return da.setupTime, da.processingTime
 }
+
+// RequestBreakdown is a summary of where time was spent when processing a single request.
+type RequestBreakdown struct {
+	// DB is the time spent loading data from the database.
+	DB time.Duration
+	// Sort is the time spent sorting room lists.
+	Sort time.Duration
+	// Serialise is the time spent encoding the response.
+	Serialise time.Duration
+	// Wait is the time spent blocked waiting for live updates. This is not processing time.
+	Wait time.Duration
+}
+
+func AddRequestContextDBDuration(ctx context.Context, dur time.Duration) {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return
+	}
+	d.(*data).dbTime.Add(int64(dur))
+}
+
+func AddRequestContextSortDuration(ctx context.Context, dur time.Duration) {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return
+	}
+	d.(*data).sortTime.Add(int64(dur))
+}
+
+func AddRequestContextWaitDuration(ctx context.Context, dur time.Duration) {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return
+	}
+	d.(*data).waitTime.Add(int64(dur))
+}
+
+func SetRequestContextSerialiseDuration(ctx context.Context, dur time.Duration) {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return
+	}
+	d.(*data).serialiseTime.Store(int64(dur))
+}
+
+func RequestContextBreakdown(ctx context.Context) (b RequestBreakdown) {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return
+	}
+	da := d.(*data)
+	b.DB = time.Duration(da.dbTime.Load())
+	b.Sort = time.Duration(da.sortTime.Load())
+	b.Serialise = time.Duration(da.serialiseTime.Load())
+	b.Wait = time.Duration(da.waitTime.Load())
+	return
+}
+
+// ContextWithCommitTime records when the data being processed in this context was committed to the
+// database, so the time taken to deliver it to clients can be measured.
+func ContextWithCommitTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, ctxCommitTime, t)
+}
+
+// CommitTime returns the time set with ContextWithCommitTime, or the zero time if there is none.
+func CommitTime(ctx context.Context) time.Time {
+	t, _ := ctx.Value(ctxCommitTime).(time.Time)
+	return t
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequestContextBreakdown(t *testing.T) {
+	// no request context: no-op
+	AddRequestContextDBDuration(context.Background(), time.Second)
+	if got := RequestContextBreakdown(context.Background()); got != (RequestBreakdown{}) {
+		t.Fatalf("got breakdown %+v without request context, want zero", got)
+	}
+
+	ctx := RequestContext(context.Background())
+	AddRequestContextDBDuration(ctx, time.Second)
+	AddRequestContextDBDuration(ctx, 2*time.Second)
+	AddRequestContextSortDuration(ctx, 3*time.Millisecond)
+	AddRequestContextWaitDuration(ctx, 10*time.Second)
+	SetRequestContextSerialiseDuration(ctx, 5*time.Millisecond)
+	want := RequestBreakdown{
+		DB:        3 * time.Second,
+		Sort:      3 * time.Millisecond,
+		Serialise: 5 * time.Millisecond,
+		Wait:      10 * time.Second,
+	}
+	if got := RequestContextBreakdown(ctx); got != want {
+		t.Fatalf("got breakdown %+v want %+v", got, want)
+	}
+}
+
+func TestCommitTime(t *testing.T) {
+	if got := CommitTime(context.Background()); !got.IsZero() {
+		t.Fatalf("got commit time %v without one being set, want zero", got)
+	}
+	now := time.Now()
+	ctx := ContextWithCommitTime(context.Background(), now)
+	if got := CommitTime(ctx); !got.Equal(now) {
+		t.Fatalf("got commit time %v want %v", got, now)
+	}
+}
@@ -4,23 +4,25 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/getsentry/sentry-go"
-
-	"github.com/rs/zerolog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = NewLogger()
 
 type HandlerError struct {
 	StatusCode int
 	Err        error
 	ErrCode    string
+	// RetryAfterMs is set for M_LIMIT_EXCEEDED errors to tell the client when to retry.
+	RetryAfterMs int64
+	// SoftLogout is set for M_UNKNOWN_TOKEN errors when the client can re-authenticate the same
+	// device without losing its data.
+	SoftLogout bool
 }
 
 func (e *HandlerError) Error() string {
@@ -32,14 +34,18 @@ func (e *HandlerError) Unwrap() error {
 }
 
 type jsonError struct {
-	Err  string `json:"error"`
-	Code string `json:"errcode,omitempty"`
+	Err          string `json:"error"`
+	Code         string `json:"errcode,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+	SoftLogout   bool   `json:"soft_logout,omitempty"`
 }
 
 func (e HandlerError) JSON() []byte {
 	je := jsonError{
-		Err:  e.Error(),
-		Code: e.ErrCode,
+		Err:          e.Error(),
+		Code:         e.ErrCode,
+		RetryAfterMs: e.RetryAfterMs,
+		SoftLogout:   e.SoftLogout,
 	}
 	b, _ := json.Marshal(je)
 	return b
@@ -53,6 +59,17 @@ func ExpiredSessionError() *HandlerError {
 	}
 }
 
+// RateLimitedError is returned when a client has made too many requests and should retry after
+// the given duration.
+func RateLimitedError(retryAfter time.Duration, reason string) *HandlerError {
+	return &HandlerError{
+		StatusCode:   http.StatusTooManyRequests,
+		Err:          fmt.Errorf("rate limited: %s", reason),
+		ErrCode:      "M_LIMIT_EXCEEDED",
+		RetryAfterMs: retryAfter.Milliseconds(),
+	}
+}
+
 // Assert that the expression is true, similar to assert() in C. If expr is false, print or panic.
 //
 // If expr is false and SYNCV3_DEBUG=1 then the program panics.
@@ -1,6 +1,50 @@
 package internal
 
-import "github.com/tidwall/gjson"
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+)
+
+// Event is an event's JSON along with the fields which are read most often. The fields are
+// extracted once when the event is loaded, so that the notifier and caches don't need to parse
+// them out of the JSON again.
+type Event struct {
+	JSON   json.RawMessage
+	ID     string
+	Type   string
+	Sender string
+	// nil if this is not a state event
+	StateKey  *string
+	Timestamp uint64
+	Content   gjson.Result
+	// unsigned.transaction_id, or the empty string if there is none
+	TransactionID string
+	// true if this is a membership event which changes the user's membership, rather than
+	// their profile
+	IsMembershipChange bool
+}
+
+// NewEvent parses the event JSON given.
+func NewEvent(eventJSON json.RawMessage) *Event {
+	ev := gjson.ParseBytes(eventJSON)
+	e := &Event{
+		JSON:          eventJSON,
+		ID:            ev.Get("event_id").Str,
+		Type:          ev.Get("type").Str,
+		Sender:        ev.Get("sender").Str,
+		Timestamp:     ev.Get("origin_server_ts").Uint(),
+		Content:       ev.Get("content"),
+		TransactionID: ev.Get("unsigned.transaction_id").Str,
+	}
+	if sk := ev.Get("state_key"); sk.Exists() {
+		e.StateKey = &sk.Str
+	}
+	if e.Type == "m.room.member" && e.StateKey != nil {
+		e.IsMembershipChange = IsMembershipChange(ev)
+	}
+	return e
+}
 
 func IsMembershipChange(eventJSON gjson.Result) bool {
 	// membership event possibly, make sure the membership has changed else
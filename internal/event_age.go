@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// EventAgeOpts controls how unsigned.age is served to clients. The age in an event is relative to
+// when the homeserver sent it, so it is stale as soon as the event is stored. When events are
+// received, WithAgeTS replaces it with the absolute unsigned.age_ts, which Apply then uses to
+// recompute the age whenever the event is served.
+type EventAgeOpts struct {
+	// Strip removes unsigned.age rather than recomputing it.
+	Strip bool
+	// IncludeAgeTS keeps unsigned.age_ts: the time the event was created, in milliseconds since
+	// the epoch, according to the homeserver's clock.
+	IncludeAgeTS bool
+}
+
+// WithAgeTS replaces unsigned.age with unsigned.age_ts, given the time the event was received from
+// the homeserver. Events without an age are returned unchanged.
+func WithAgeTS(eventJSON json.RawMessage, receivedAt time.Time) json.RawMessage {
+	age := gjson.GetBytes(eventJSON, "unsigned.age")
+	if !age.Exists() {
+		return eventJSON
+	}
+	newJSON, err := sjson.SetBytes(eventJSON, "unsigned.age_ts", receivedAt.UnixMilli()-age.Int())
+	if err != nil {
+		return eventJSON
+	}
+	newJSON, err = sjson.DeleteBytes(newJSON, "unsigned.age")
+	if err != nil {
+		return eventJSON
+	}
+	return newJSON
+}
+
+// Apply returns the event with unsigned.age recomputed from unsigned.age_ts, or removed, as
+// configured. Events stored before age_ts was recorded only have a stale age, which is removed.
+func (o EventAgeOpts) Apply(eventJSON json.RawMessage, now time.Time) json.RawMessage {
+	unsigned := gjson.GetBytes(eventJSON, "unsigned")
+	ageTS := unsigned.Get("age_ts")
+	hasAge := unsigned.Get("age").Exists()
+	if !ageTS.Exists() && !hasAge {
+		return eventJSON
+	}
+	newJSON := eventJSON
+	var err error
+	if o.Strip || !ageTS.Exists() {
+		if hasAge {
+			newJSON, err = sjson.DeleteBytes(newJSON, "unsigned.age")
+		}
+	} else {
+		age := now.UnixMilli() - ageTS.Int()
+		if age < 0 {
+			// the homeserver's clock is ahead of ours
+			age = 0
+		}
+		newJSON, err = sjson.SetBytes(newJSON, "unsigned.age", age)
+	}
+	if err == nil && ageTS.Exists() && !o.IncludeAgeTS {
+		newJSON, err = sjson.DeleteBytes(newJSON, "unsigned.age_ts")
+	}
+	if err != nil {
+		return eventJSON
+	}
+	return newJSON
+}
+
+// ApplyAll is Apply for a list of events. The list is copied rather than modified in place, as
+// served events are often shared with caches.
+func (o EventAgeOpts) ApplyAll(events []json.RawMessage, now time.Time) []json.RawMessage {
+	if len(events) == 0 {
+		return events
+	}
+	result := make([]json.RawMessage, len(events))
+	for i := range events {
+		result[i] = o.Apply(events[i], now)
+	}
+	return result
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWithAgeTS(t *testing.T) {
+	receivedAt := time.UnixMilli(100000)
+	got := WithAgeTS(json.RawMessage(`{"type":"m.room.message","unsigned":{"age":2500,"transaction_id":"txn"}}`), receivedAt)
+	want := `{"type":"m.room.message","unsigned":{"transaction_id":"txn","age_ts":97500}}`
+	if string(got) != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+	noAge := json.RawMessage(`{"type":"m.room.message"}`)
+	if got := WithAgeTS(noAge, receivedAt); string(got) != string(noAge) {
+		t.Errorf("event without an age was modified: %s", got)
+	}
+}
+
+func TestEventAgeOptsApply(t *testing.T) {
+	now := time.UnixMilli(100000)
+	stored := json.RawMessage(`{"type":"m.room.message","unsigned":{"age_ts":97500}}`)
+	legacy := json.RawMessage(`{"type":"m.room.message","unsigned":{"age":12}}`)
+	future := json.RawMessage(`{"type":"m.room.message","unsigned":{"age_ts":100500}}`)
+	testCases := []struct {
+		name  string
+		opts  EventAgeOpts
+		event json.RawMessage
+		want  string
+	}{
+		{
+			name:  "recompute",
+			event: stored,
+			want:  `{"type":"m.room.message","unsigned":{"age":2500}}`,
+		},
+		{
+			name:  "recompute with age_ts",
+			opts:  EventAgeOpts{IncludeAgeTS: true},
+			event: stored,
+			want:  `{"type":"m.room.message","unsigned":{"age_ts":97500,"age":2500}}`,
+		},
+		{
+			name:  "strip",
+			opts:  EventAgeOpts{Strip: true},
+			event: stored,
+			want:  `{"type":"m.room.message","unsigned":{}}`,
+		},
+		{
+			name:  "stale age without age_ts is removed",
+			event: legacy,
+			want:  `{"type":"m.room.message","unsigned":{}}`,
+		},
+		{
+			name:  "clock skew",
+			event: future,
+			want:  `{"type":"m.room.message","unsigned":{"age":0}}`,
+		},
+	}
+	for _, tc := range testCases {
+		got := tc.opts.Apply(tc.event, now)
+		if string(got) != tc.want {
+			t.Errorf("%s: got %s want %s", tc.name, got, tc.want)
+		}
+	}
+}
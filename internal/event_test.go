@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewEvent(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		json                 string
+		wantStateKey         *string
+		wantMembershipChange bool
+	}{
+		{
+			name: "message",
+			json: `{"event_id":"$a","type":"m.room.message","sender":"@alice:localhost","origin_server_ts":123,"content":{"body":"hi"},"unsigned":{"transaction_id":"txn"}}`,
+		},
+		{
+			name:                 "join",
+			json:                 `{"event_id":"$a","type":"m.room.member","state_key":"@alice:localhost","sender":"@alice:localhost","origin_server_ts":123,"content":{"membership":"join"},"unsigned":{"transaction_id":"txn"}}`,
+			wantStateKey:         ptr("@alice:localhost"),
+			wantMembershipChange: true,
+		},
+		{
+			name:         "profile change",
+			json:         `{"event_id":"$a","type":"m.room.member","state_key":"@alice:localhost","sender":"@alice:localhost","origin_server_ts":123,"content":{"membership":"join","displayname":"Alice"},"unsigned":{"transaction_id":"txn","prev_content":{"membership":"join"}}}`,
+			wantStateKey: ptr("@alice:localhost"),
+		},
+		{
+			name:         "empty state key",
+			json:         `{"event_id":"$a","type":"m.room.name","state_key":"","sender":"@alice:localhost","origin_server_ts":123,"content":{"name":"hi"},"unsigned":{"transaction_id":"txn"}}`,
+			wantStateKey: ptr(""),
+		},
+	}
+	for _, tc := range testCases {
+		ev := NewEvent(json.RawMessage(tc.json))
+		if string(ev.JSON) != tc.json {
+			t.Errorf("%s: JSON was modified", tc.name)
+		}
+		if ev.ID != "$a" || ev.Sender != "@alice:localhost" || ev.Timestamp != 123 || ev.TransactionID != "txn" {
+			t.Errorf("%s: got %+v", tc.name, ev)
+		}
+		if (ev.StateKey == nil) != (tc.wantStateKey == nil) || (ev.StateKey != nil && *ev.StateKey != *tc.wantStateKey) {
+			t.Errorf("%s: got state key %v want %v", tc.name, ev.StateKey, tc.wantStateKey)
+		}
+		if ev.IsMembershipChange != tc.wantMembershipChange {
+			t.Errorf("%s: got IsMembershipChange=%v want %v", tc.name, ev.IsMembershipChange, tc.wantMembershipChange)
+		}
+		if !ev.Content.IsObject() {
+			t.Errorf("%s: content was not parsed: %v", tc.name, ev.Content)
+		}
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
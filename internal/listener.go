@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemd passes inherited sockets starting at this file descriptor.
+// See sd_listen_fds(3).
+const listenFDsStart = 3
+
+// InheritedListener returns the listening socket passed to this process via systemd socket
+// activation, or nil if no socket was passed. Only the first socket is used. The LISTEN_*
+// environment variables are cleared so they are not inherited by child processes.
+func InheritedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	numFDs, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFDs < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFDsStart), "LISTEN_FD_3")
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited fd %d is not a listening socket: %w", listenFDsStart, err)
+	}
+	// FileListener dups the fd, so we can close our copy.
+	f.Close()
+	return listener, nil
+}
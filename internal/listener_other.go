@@ -0,0 +1,13 @@
+//go:build !linux
+
+package internal
+
+import (
+	"fmt"
+	"net"
+)
+
+// ListenReusePort is only supported on linux.
+func ListenReusePort(addr string) (net.Listener, error) {
+	return nil, fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+}
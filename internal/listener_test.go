@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestInheritedListenerIgnoresOtherProcesses(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	l, err := InheritedListener()
+	if err != nil {
+		t.Fatalf("InheritedListener: %s", err)
+	}
+	if l != nil {
+		t.Fatalf("InheritedListener: returned a listener for another process's sockets")
+	}
+	if os.Getenv("LISTEN_FDS") != "1" {
+		t.Fatalf("InheritedListener: cleared env vars meant for another process")
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on linux")
+	}
+	first, err := ListenReusePort("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenReusePort: %s", err)
+	}
+	defer first.Close()
+	// a second listener can bind the same address, as a replacement process would.
+	second, err := ListenReusePort(first.Addr().String())
+	if err != nil {
+		t.Fatalf("ListenReusePort on same address: %s", err)
+	}
+	second.Close()
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// logOutput is where the logger of every package writes, so programs which embed the proxy can
+// redirect all of its logs with SetLogOutput.
+var logOutput = &swappableWriter{w: defaultLogOutput()}
+
+func defaultLogOutput() io.Writer {
+	return zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		TimeFormat: "15:04:05",
+	}
+}
+
+type swappableWriter struct {
+	mu sync.RWMutex
+	w  io.Writer
+}
+
+func (s *swappableWriter) Write(p []byte) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.w.Write(p)
+}
+
+// NewLogger returns a logger which writes to the proxy's log output. Packages should create one
+// at startup rather than using zerolog.New directly.
+func NewLogger() zerolog.Logger {
+	return zerolog.New(logOutput).With().Timestamp().Logger()
+}
+
+// SetLogOutput sends all logs to w, one zerolog JSON object per write. If w is nil, logs are
+// written to stderr in a human readable format, which is the default.
+func SetLogOutput(w io.Writer) {
+	if w == nil {
+		w = defaultLogOutput()
+	}
+	logOutput.mu.Lock()
+	defer logOutput.mu.Unlock()
+	logOutput.w = w
+}
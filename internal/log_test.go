@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestSetLogOutput(t *testing.T) {
+	// loggers are made when packages are initialised, before the output is set
+	logger := NewLogger()
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	defer SetLogOutput(nil)
+
+	logger.Warn().Str("user", "@alice:localhost").Msg("hello")
+	line := buf.Bytes()
+	if got := gjson.GetBytes(line, "message").Str; got != "hello" {
+		t.Errorf("got message %q want hello in %s", got, line)
+	}
+	if got := gjson.GetBytes(line, "user").Str; got != "@alice:localhost" {
+		t.Errorf("got user %q want @alice:localhost in %s", got, line)
+	}
+
+	SetLogOutput(nil)
+	buf.Reset()
+	logger.Warn().Msg("to stderr")
+	if buf.Len() != 0 {
+		t.Errorf("wrote %s after the output was reset", buf.String())
+	}
+}
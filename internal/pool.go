@@ -1,5 +1,10 @@
 package internal
 
+import (
+	"context"
+	"sync"
+)
+
 type WorkerPool struct {
 	N  int
 	ch chan func()
@@ -65,3 +70,76 @@ func (wp *WorkerPool) worker() {
 		fn()
 	}
 }
+
+// ForEachChunk splits items into chunks of at most chunkSize and calls fn for each chunk, with up to
+// maxWorkers calls in flight at once. Blocks until every call has returned. Unlike WorkerPool this
+// is meant for fanning out work within a single request: the goroutines exit when the work is done.
+// If there is only one chunk, fn is called on the calling goroutine.
+func ForEachChunk[T any](items []T, chunkSize, maxWorkers int, fn func(chunk []T)) {
+	if len(items) == 0 {
+		return
+	}
+	if chunkSize <= 0 || len(items) <= chunkSize || maxWorkers <= 1 {
+		fn(items)
+		return
+	}
+	numChunks := (len(items) + chunkSize - 1) / chunkSize
+	ch := make(chan []T, numChunks)
+	for i := 0; i < len(items); i += chunkSize {
+		end := i + chunkSize
+		if end > len(items) {
+			end = len(items)
+		}
+		ch <- items[i:end]
+	}
+	close(ch)
+	if maxWorkers > numChunks {
+		maxWorkers = numChunks
+	}
+	var wg sync.WaitGroup
+	wg.Add(maxWorkers)
+	for i := 0; i < maxWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for chunk := range ch {
+				fn(chunk)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Semaphore limits how many goroutines can hold it at once. A nil *Semaphore places no limit.
+type Semaphore struct {
+	ch chan struct{}
+}
+
+// NewSemaphore returns a Semaphore which can be held by up to n goroutines at once, or nil if
+// n <= 0.
+func NewSemaphore(n int) *Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &Semaphore{ch: make(chan struct{}, n)}
+}
+
+// Acquire blocks until the semaphore can be held, or returns the context's error if it is done
+// first. Call Release when done, only if Acquire returned nil.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s.ch
+}
@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"context"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -184,3 +187,110 @@ func assertStates(t *testing.T, mu *sync.Mutex, running []*workerState, wantStat
 		}
 	}
 }
+
+func TestForEachChunk(t *testing.T) {
+	items := make([]int, 105)
+	for i := range items {
+		items[i] = i
+	}
+	var mu sync.Mutex
+	var got []int
+	var chunkSizes []int
+	var inFlight, maxInFlight atomic.Int32
+	ForEachChunk(items, 10, 3, func(chunk []int) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, chunk...)
+		chunkSizes = append(chunkSizes, len(chunk))
+	})
+	if len(got) != len(items) {
+		t.Fatalf("got %d items want %d", len(got), len(items))
+	}
+	sort.Ints(got)
+	for i := range got {
+		if got[i] != i {
+			t.Fatalf("item %d: got %d, items were dropped or duplicated", i, got[i])
+		}
+	}
+	if len(chunkSizes) != 11 {
+		t.Errorf("got %d chunks want 11", len(chunkSizes))
+	}
+	for _, size := range chunkSizes {
+		if size > 10 {
+			t.Errorf("got chunk of size %d, want at most 10", size)
+		}
+	}
+	if maxInFlight.Load() > 3 {
+		t.Errorf("had %d calls in flight, want at most 3", maxInFlight.Load())
+	}
+
+	// a single chunk runs on the calling goroutine
+	calls := 0
+	ForEachChunk(items[:5], 10, 3, func(chunk []int) {
+		calls++
+	})
+	if calls != 1 {
+		t.Errorf("got %d calls want 1", calls)
+	}
+	ForEachChunk(nil, 10, 3, func(chunk []int) {
+		t.Errorf("called with no items")
+	})
+}
+
+func TestSemaphore(t *testing.T) {
+	sem := NewSemaphore(2)
+	var inFlight, maxInFlight atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sem.Acquire(context.Background()); err != nil {
+				t.Errorf("Acquire: %s", err)
+				return
+			}
+			defer sem.Release()
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	if maxInFlight.Load() != 2 {
+		t.Errorf("got %d holders at once, want 2", maxInFlight.Load())
+	}
+
+	// cancelled waiters give up
+	full := NewSemaphore(1)
+	if err := full.Acquire(context.Background()); err != nil {
+		t.Fatalf("Acquire: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := full.Acquire(ctx); err != context.Canceled {
+		t.Errorf("Acquire with cancelled context: got %v want %v", err, context.Canceled)
+	}
+	full.Release()
+
+	// no limit
+	var unlimited *Semaphore = NewSemaphore(0)
+	unlimited.Acquire(context.Background())
+	unlimited.Acquire(context.Background())
+	unlimited.Release()
+	unlimited.Release()
+}
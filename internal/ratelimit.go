@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket rate limiter which tracks a separate bucket per key, e.g per IP
+// address or per user ID. A nil *RateLimiter allows everything.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// tokens added per second
+	rate float64
+	// the maximum number of tokens a bucket can hold
+	burst     float64
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter makes a rate limiter which allows perMinute events per key on average, with up to
+// burst events at once. Returns nil (allow everything) if perMinute is not positive. If burst is not
+// positive, it defaults to perMinute.
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &RateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		now:     time.Now,
+	}
+}
+
+// Allow consumes a token for this key if one is available. If not, it returns false along with
+// how long the caller should wait before retrying.
+func (r *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if r == nil {
+		return true, 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.maybePrune(now)
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{
+			tokens: r.burst,
+			last:   now,
+		}
+		r.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / r.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// maybePrune removes buckets which would have refilled completely, as they are indistinguishable
+// from a brand new bucket. This bounds memory usage to the number of recently active keys.
+// Must be called with the lock held.
+func (r *RateLimiter) maybePrune(now time.Time) {
+	if now.Sub(r.lastPrune) < time.Minute {
+		return
+	}
+	r.lastPrune = now
+	refillTime := time.Duration(r.burst / r.rate * float64(time.Second))
+	for key, b := range r.buckets {
+		if now.Sub(b.last) >= refillTime {
+			delete(r.buckets, key)
+		}
+	}
+}
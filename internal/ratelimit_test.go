@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var nilLimiter *RateLimiter
+	if ok, _ := nilLimiter.Allow("a"); !ok {
+		t.Fatalf("nil RateLimiter should allow everything")
+	}
+	if NewRateLimiter(0, 5) != nil {
+		t.Fatalf("NewRateLimiter with rate 0 should return nil")
+	}
+
+	now := time.Now()
+	rl := NewRateLimiter(60, 2) // 1 per second, burst of 2
+	rl.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.Allow("a"); !ok {
+			t.Fatalf("request %d should be allowed by burst", i)
+		}
+	}
+	ok, wait := rl.Allow("a")
+	if ok {
+		t.Fatalf("request over burst should be rejected")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Fatalf("got wait %v want (0,1s]", wait)
+	}
+	// other keys are unaffected
+	if ok, _ := rl.Allow("b"); !ok {
+		t.Fatalf("different key should be allowed")
+	}
+	// a token refills after a second
+	now = now.Add(time.Second)
+	if ok, _ := rl.Allow("a"); !ok {
+		t.Fatalf("request should be allowed after refilling")
+	}
+	if ok, _ := rl.Allow("a"); ok {
+		t.Fatalf("only one token should have refilled")
+	}
+
+	// idle buckets are pruned
+	now = now.Add(time.Hour)
+	rl.Allow("c")
+	if len(rl.buckets) != 1 {
+		t.Fatalf("got %d buckets after pruning, want 1", len(rl.buckets))
+	}
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -14,3 +15,28 @@ func ExtractAccessToken(req *http.Request) (accessToken string, err error) {
 	accessToken = strings.TrimPrefix(ah, "Bearer ")
 	return accessToken, nil
 }
+
+// ClientIP returns the IP address of the client making this request. If trustedProxies is more than
+// 0, requests are assumed to pass through that many reverse proxies, each of which appends the
+// address it received the request from to X-Forwarded-For. The client's address is then that many
+// entries from the right, as entries further left are whatever the client sent. If the header has
+// fewer entries than that, the address which connected to us is used.
+func ClientIP(req *http.Request, trustedProxies int) string {
+	if trustedProxies > 0 {
+		var hops []string
+		for _, xff := range req.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(xff, ",")...)
+		}
+		if len(hops) >= trustedProxies {
+			if ip := strings.TrimSpace(hops[len(hops)-trustedProxies]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		// e.g unix sockets, which have no port
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	testCases := []struct {
+		name           string
+		remoteAddr     string
+		xff            []string
+		trustedProxies int
+		want           string
+	}{
+		{
+			name:       "no proxies",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"1.2.3.4"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:           "one proxy",
+			remoteAddr:     "10.0.0.1:1234",
+			xff:            []string{"1.2.3.4"},
+			trustedProxies: 1,
+			want:           "1.2.3.4",
+		},
+		{
+			name:           "one proxy, forged by the client",
+			remoteAddr:     "10.0.0.1:1234",
+			xff:            []string{"6.6.6.6, 1.2.3.4"},
+			trustedProxies: 1,
+			want:           "1.2.3.4",
+		},
+		{
+			name:           "two proxies across headers",
+			remoteAddr:     "10.0.0.1:1234",
+			xff:            []string{"6.6.6.6, 1.2.3.4", "10.0.0.2"},
+			trustedProxies: 2,
+			want:           "1.2.3.4",
+		},
+		{
+			name:           "fewer entries than proxies",
+			remoteAddr:     "10.0.0.1:1234",
+			xff:            []string{"1.2.3.4"},
+			trustedProxies: 2,
+			want:           "10.0.0.1",
+		},
+		{
+			name:           "no header",
+			remoteAddr:     "10.0.0.1:1234",
+			trustedProxies: 1,
+			want:           "10.0.0.1",
+		},
+		{
+			name:       "unix socket",
+			remoteAddr: "@",
+			want:       "@",
+		},
+	}
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for _, xff := range tc.xff {
+			req.Header.Add("X-Forwarded-For", xff)
+		}
+		if got := ClientIP(req, tc.trustedProxies); got != tc.want {
+			t.Errorf("%s: got %q want %q", tc.name, got, tc.want)
+		}
+	}
+}
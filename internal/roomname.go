@@ -52,6 +52,18 @@ type RoomMetadata struct {
 	TypingEvent json.RawMessage
 }
 
+// LastMessageNID returns the NID of the event most recently seen in this room, or 0 if there
+// is none. Unlike LastMessageTimestamp, this only ever increases as new events arrive.
+func (m *RoomMetadata) LastMessageNID() int64 {
+	var nid int64
+	for _, evMeta := range m.LatestEventsByType {
+		if evMeta.NID > nid {
+			nid = evMeta.NID
+		}
+	}
+	return nid
+}
+
 func NewRoomMetadata(roomID string) *RoomMetadata {
 	return &RoomMetadata{
 		RoomID:             roomID,
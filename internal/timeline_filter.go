@@ -0,0 +1,74 @@
+package internal
+
+// TimelineFilter limits which events are returned in room timelines, e.g to hide reactions and
+// membership changes from room previews.
+type TimelineFilter struct {
+	// Types are the only event types to include. If empty, all types are included.
+	Types []string `json:"types,omitempty"`
+	// NotTypes are event types to exclude. Takes priority over Types.
+	NotTypes []string `json:"not_types,omitempty"`
+}
+
+// IsEmpty returns true if the filter includes every event. A nil filter is empty.
+func (f *TimelineFilter) IsEmpty() bool {
+	return f == nil || (len(f.Types) == 0 && len(f.NotTypes) == 0)
+}
+
+// Include returns true if events of this type pass the filter.
+func (f *TimelineFilter) Include(eventType string) bool {
+	if f == nil {
+		return true
+	}
+	for _, t := range f.NotTypes {
+		if t == eventType {
+			return false
+		}
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Union returns a filter which includes every event either filter includes.
+func (f *TimelineFilter) Union(other *TimelineFilter) *TimelineFilter {
+	if f.IsEmpty() || other.IsEmpty() {
+		return nil
+	}
+	var result TimelineFilter
+	// an empty Types includes all types
+	if len(f.Types) > 0 && len(other.Types) > 0 {
+		result.Types = unionStrings(f.Types, other.Types)
+	}
+	// only exclude types which both exclude
+	for _, t := range f.NotTypes {
+		for _, o := range other.NotTypes {
+			if t == o {
+				result.NotTypes = append(result.NotTypes, t)
+				break
+			}
+		}
+	}
+	if result.IsEmpty() {
+		return nil
+	}
+	return &result
+}
+
+func unionStrings(a, b []string) []string {
+	seen := make(map[string]struct{}, len(a)+len(b))
+	result := make([]string, 0, len(a)+len(b))
+	for _, s := range append(append([]string{}, a...), b...) {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		result = append(result, s)
+	}
+	return result
+}
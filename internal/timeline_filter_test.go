@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTimelineFilterInclude(t *testing.T) {
+	testCases := []struct {
+		name    string
+		filter  *TimelineFilter
+		include map[string]bool
+	}{
+		{
+			name:    "nil",
+			filter:  nil,
+			include: map[string]bool{"m.room.message": true, "m.reaction": true},
+		},
+		{
+			name:    "types",
+			filter:  &TimelineFilter{Types: []string{"m.room.message", "m.room.encrypted"}},
+			include: map[string]bool{"m.room.message": true, "m.room.encrypted": true, "m.reaction": false},
+		},
+		{
+			name:    "not_types",
+			filter:  &TimelineFilter{NotTypes: []string{"m.reaction"}},
+			include: map[string]bool{"m.room.message": true, "m.reaction": false},
+		},
+		{
+			name:    "not_types take priority",
+			filter:  &TimelineFilter{Types: []string{"m.room.message", "m.reaction"}, NotTypes: []string{"m.reaction"}},
+			include: map[string]bool{"m.room.message": true, "m.reaction": false, "m.room.member": false},
+		},
+	}
+	for _, tc := range testCases {
+		for eventType, want := range tc.include {
+			if got := tc.filter.Include(eventType); got != want {
+				t.Errorf("%s: Include(%s) got %v want %v", tc.name, eventType, got, want)
+			}
+		}
+	}
+}
+
+func TestTimelineFilterUnion(t *testing.T) {
+	messages := &TimelineFilter{Types: []string{"m.room.message"}, NotTypes: []string{"m.reaction", "m.room.member"}}
+	encrypted := &TimelineFilter{Types: []string{"m.room.encrypted", "m.room.message"}, NotTypes: []string{"m.room.member"}}
+	testCases := []struct {
+		name string
+		a, b *TimelineFilter
+		want *TimelineFilter
+	}{
+		{
+			name: "nil includes everything",
+			a:    messages,
+			b:    nil,
+			want: nil,
+		},
+		{
+			name: "both filtered",
+			a:    messages,
+			b:    encrypted,
+			want: &TimelineFilter{Types: []string{"m.room.message", "m.room.encrypted"}, NotTypes: []string{"m.room.member"}},
+		},
+		{
+			name: "no types includes every type",
+			a:    messages,
+			b:    &TimelineFilter{NotTypes: []string{"m.reaction"}},
+			want: &TimelineFilter{NotTypes: []string{"m.reaction"}},
+		},
+		{
+			name: "nothing in common",
+			a:    &TimelineFilter{NotTypes: []string{"m.reaction"}},
+			b:    &TimelineFilter{NotTypes: []string{"m.room.member"}},
+			want: nil,
+		},
+	}
+	for _, tc := range testCases {
+		if got := tc.a.Union(tc.b); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -28,6 +28,8 @@ var (
 	OTLPTagUserID   TraceKey = "user_id"
 	OTLPTagConnID   TraceKey = "conn_id"
 	OTLPTagTxnID    TraceKey = "txn_id"
+	// OTLPTagRequestID is the ID generated for each request, which is also returned to clients.
+	OTLPTagRequestID TraceKey = "request_id"
 )
 
 // SetAttributeOnContext sets one of the trace tag keys on the given context, so derived spans will use said tags.
@@ -38,7 +40,7 @@ func SetAttributeOnContext(ctx context.Context, key TraceKey, val string) contex
 // attributesFromContext sets span tags based on data in the provided ctx
 func attributesFromContext(ctx context.Context) []otrace.SpanStartOption {
 	var attrs []attribute.KeyValue
-	for _, tag := range []TraceKey{OTLPTagConnID, OTLPTagDeviceID, OTLPTagUserID, OTLPTagTxnID} {
+	for _, tag := range []TraceKey{OTLPTagConnID, OTLPTagDeviceID, OTLPTagUserID, OTLPTagTxnID, OTLPTagRequestID} {
 		val := ctx.Value(tag)
 		if val == nil {
 			continue
@@ -0,0 +1,93 @@
+package slidingsync
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// InternalServerOpts configures a listener for operator endpoints, kept apart from the public
+// sync API so it can be bound somewhere clients can't reach.
+type InternalServerOpts struct {
+	// BindAddr is either a TCP host:port or a unix socket path.
+	BindAddr string
+	// Token, if set, must be sent as 'Authorization: Bearer <token>' to use the metrics and pprof
+	// endpoints. The admin API checks its own token.
+	Token string
+	// Admin serves the admin API under /_syncv3/admin. If nil, the admin API is not served.
+	Admin http.Handler
+	// Metrics serves Prometheus metrics at /metrics.
+	Metrics bool
+	// PProf serves profiling endpoints under /debug/pprof/.
+	PProf bool
+}
+
+// Router returns the HTTP routes for the internal listener.
+func (o InternalServerOpts) Router() *mux.Router {
+	r := mux.NewRouter()
+	if o.Admin != nil {
+		r.PathPrefix("/_syncv3/admin/").Handler(http.StripPrefix("/_syncv3/admin", o.Admin))
+	}
+	if o.Metrics {
+		r.Handle("/metrics", o.requireToken(promhttp.Handler()))
+	}
+	if o.PProf {
+		r.Handle("/debug/pprof/cmdline", o.requireToken(http.HandlerFunc(pprof.Cmdline)))
+		r.Handle("/debug/pprof/profile", o.requireToken(http.HandlerFunc(pprof.Profile)))
+		r.Handle("/debug/pprof/symbol", o.requireToken(http.HandlerFunc(pprof.Symbol)))
+		r.Handle("/debug/pprof/trace", o.requireToken(http.HandlerFunc(pprof.Trace)))
+		// serves the index and named profiles e.g /debug/pprof/heap
+		r.PathPrefix("/debug/pprof/").Handler(o.requireToken(http.HandlerFunc(pprof.Index)))
+	}
+	return r
+}
+
+func (o InternalServerOpts) requireToken(next http.Handler) http.Handler {
+	if o.Token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authHeader := req.Header.Get("Authorization")
+		if !strings.HasPrefix(authHeader, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authHeader, "Bearer ")), []byte(o.Token)) != 1 {
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// RunInternalServer starts serving the internal listener in the background and returns the
+// underlying HTTP server, which can be used to shut it down.
+func RunInternalServer(opts InternalServerOpts) *http.Server {
+	var listener net.Listener
+	var err error
+	if internal.IsUnixSocket(opts.BindAddr) {
+		listener, err = unixSocketListener(opts.BindAddr)
+	} else {
+		listener, err = net.Listen("tcp", opts.BindAddr)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to listen for internal endpoints")
+	}
+	logger.Info().Bool("admin", opts.Admin != nil).Bool("metrics", opts.Metrics).Bool("pprof", opts.PProf).
+		Msgf("listening for internal endpoints on %s", opts.BindAddr)
+	httpServer := &http.Server{
+		Handler: opts.Router(),
+	}
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			sentry.CaptureException(err)
+			logger.Fatal().Err(err).Msg("failed to serve internal endpoints")
+		}
+	}()
+	return httpServer
+}
@@ -0,0 +1,48 @@
+package slidingsync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInternalServerRouter(t *testing.T) {
+	admin := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/users/@alice:localhost/conns" {
+			t.Errorf("admin API got path %s", req.URL.Path)
+		}
+		w.WriteHeader(http.StatusTeapot)
+	})
+	r := InternalServerOpts{
+		Token:   "s3cret",
+		Admin:   admin,
+		Metrics: true,
+		PProf:   true,
+	}.Router()
+	testCases := []struct {
+		path     string
+		token    string
+		wantCode int
+	}{
+		{path: "/metrics", wantCode: http.StatusUnauthorized},
+		{path: "/metrics", token: "wrong", wantCode: http.StatusUnauthorized},
+		{path: "/metrics", token: "s3cret", wantCode: http.StatusOK},
+		{path: "/debug/pprof/", wantCode: http.StatusUnauthorized},
+		{path: "/debug/pprof/", token: "s3cret", wantCode: http.StatusOK},
+		{path: "/debug/pprof/goroutine", token: "s3cret", wantCode: http.StatusOK},
+		// the admin API checks its own token
+		{path: "/_syncv3/admin/users/@alice:localhost/conns", wantCode: http.StatusTeapot},
+		{path: "/_matrix/client/v3/sync", token: "s3cret", wantCode: http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s with token '%s': got status %d want %d", tc.path, tc.token, w.Code, tc.wantCode)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package slidingsync
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// newPassthroughProxy returns a handler which forwards requests to the destination homeserver,
+// removing the path prefix first.
+func newPassthroughProxy(destV2Server, pathPrefix string) http.Handler {
+	target, _ := url.Parse(internal.GetBaseURL(destV2Server))
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, pathPrefix)
+		req.URL.RawPath = ""
+		director(req)
+		// homeservers may serve different content per virtual host
+		req.Host = target.Host
+	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		// CORS headers are set by the proxy, so drop the homeserver's to avoid sending them twice
+		for _, header := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Methods", "Access-Control-Allow-Headers", "Access-Control-Max-Age"} {
+			res.Header.Del(header)
+		}
+		return nil
+	}
+	if internal.IsUnixSocket(destV2Server) {
+		proxy.Transport = internal.UnixTransport(destV2Server)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		logger.Warn().Err(err).Str("path", req.URL.Path).Msg("passthrough request to homeserver failed")
+		herr := internal.HandlerError{
+			StatusCode: http.StatusBadGateway,
+			Err:        err,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+	}
+	return proxy
+}
+
+// addPassthroughRoutes forwards requests for these paths to the destination homeserver. Paths ending
+// in "/" forward everything beneath them.
+func addPassthroughRoutes(r *mux.Router, paths []string, destV2Server, pathPrefix string, allowCORS func(http.Handler) http.HandlerFunc) {
+	if len(paths) == 0 {
+		return
+	}
+	proxy := allowCORS(newPassthroughProxy(destV2Server, pathPrefix))
+	for _, path := range paths {
+		if strings.HasSuffix(path, "/") {
+			r.PathPrefix(pathPrefix + path).Handler(proxy)
+		} else {
+			r.Handle(pathPrefix+path, proxy)
+		}
+	}
+}
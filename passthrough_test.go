@@ -0,0 +1,137 @@
+package slidingsync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterPassthroughPaths(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("X-Path", req.URL.Path)
+		w.Header().Set("X-Auth", req.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hs.Close()
+	sync := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	r := ServerOpts{
+		PathPrefix:       "/sliding-sync",
+		PassthroughPaths: []string{"/_matrix/client/versions", "/_matrix/client/v3/profile/"},
+	}.Router(sync, hs.URL)
+
+	testCases := []struct {
+		path     string
+		wantCode int
+		wantPath string
+	}{
+		{path: "/sliding-sync/_matrix/client/versions", wantCode: http.StatusAccepted, wantPath: "/_matrix/client/versions"},
+		{path: "/sliding-sync/_matrix/client/v3/profile/@alice:localhost/displayname", wantCode: http.StatusAccepted, wantPath: "/_matrix/client/v3/profile/@alice:localhost/displayname"},
+		{path: "/sliding-sync/_matrix/client/v3/capabilities", wantCode: http.StatusNotFound},
+		// sync is never forwarded
+		{path: "/sliding-sync/_matrix/client/v3/sync", wantCode: http.StatusTeapot},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Authorization", "Bearer foo")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got status %d want %d", tc.path, w.Code, tc.wantCode)
+		}
+		if tc.wantPath == "" {
+			continue
+		}
+		if got := w.Header().Get("X-Path"); got != tc.wantPath {
+			t.Errorf("%s: forwarded to %s want %s", tc.path, got, tc.wantPath)
+		}
+		if got := w.Header().Get("X-Auth"); got != "Bearer foo" {
+			t.Errorf("%s: Authorization header was not forwarded, got %q", tc.path, got)
+		}
+		if got := w.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 {
+			t.Errorf("%s: got Access-Control-Allow-Origin %v, want it once", tc.path, got)
+		}
+	}
+}
+
+func TestRouterMessages(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Path", req.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hs.Close()
+	sync := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	r := ServerOpts{
+		PathPrefix:       "/sliding-sync",
+		PassthroughPaths: []string{"/_matrix/client/v3/rooms/"},
+		Messages: func(homeserver http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Query().Get("dir") == "b" {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				homeserver.ServeHTTP(w, req)
+			})
+		},
+	}.Router(sync, hs.URL)
+
+	testCases := []struct {
+		path     string
+		wantCode int
+		wantPath string
+	}{
+		{path: "/sliding-sync/_matrix/client/v3/rooms/!a:localhost/messages?dir=b", wantCode: http.StatusOK},
+		{path: "/sliding-sync/_matrix/client/r0/rooms/!a:localhost/messages?dir=b", wantCode: http.StatusOK},
+		{path: "/sliding-sync/_matrix/client/v3/rooms/!a:localhost/messages?dir=f", wantCode: http.StatusAccepted, wantPath: "/_matrix/client/v3/rooms/!a:localhost/messages"},
+		// other room endpoints are still forwarded
+		{path: "/sliding-sync/_matrix/client/v3/rooms/!a:localhost/state", wantCode: http.StatusAccepted, wantPath: "/_matrix/client/v3/rooms/!a:localhost/state"},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got status %d want %d", tc.path, w.Code, tc.wantCode)
+		}
+		if got := w.Header().Get("X-Path"); got != tc.wantPath {
+			t.Errorf("%s: forwarded to %q want %q", tc.path, got, tc.wantPath)
+		}
+	}
+}
+
+func TestRouterPassthroughPathsDoNotShadowProxyRoutes(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hs.Close()
+	sync := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	r := ServerOpts{
+		PathPrefix:       "/sliding-sync",
+		PassthroughPaths: []string{"/"},
+		Admin: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	}.Router(sync, hs.URL)
+
+	testCases := []struct {
+		path     string
+		wantCode int
+	}{
+		{path: "/sliding-sync/_matrix/client/v3/sync", wantCode: http.StatusTeapot},
+		{path: "/sliding-sync/_syncv3/admin/conns", wantCode: http.StatusOK},
+		{path: "/sliding-sync/client/server.json", wantCode: http.StatusOK},
+		{path: "/sliding-sync/_matrix/client/versions", wantCode: http.StatusAccepted},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got status %d want %d", tc.path, w.Code, tc.wantCode)
+		}
+	}
+}
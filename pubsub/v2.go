@@ -2,6 +2,7 @@ package pubsub
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 )
@@ -24,6 +25,7 @@ type V2Listener interface {
 	OnReceipt(p *V2Receipt)
 	OnDeviceMessages(p *V2DeviceMessages)
 	OnExpiredToken(p *V2ExpiredToken)
+	OnPollerDied(p *V2PollerDied)
 	OnInvalidateRoom(p *V2InvalidateRoom)
 	OnStateRedaction(p *V2StateRedaction)
 }
@@ -39,6 +41,8 @@ type V2Accumulate struct {
 	RoomID    string
 	PrevBatch string
 	EventNIDs []int64
+	// When the events were committed to the database.
+	CommittedAt time.Time
 }
 
 func (*V2Accumulate) Type() string { return "V2Accumulate" }
@@ -127,10 +131,21 @@ func (*V2DeviceMessages) Type() string { return "V2DeviceMessages" }
 type V2ExpiredToken struct {
 	UserID   string
 	DeviceID string
+	// SoftLogout is true if the device can be logged back into with a new access token.
+	SoftLogout bool
 }
 
 func (*V2ExpiredToken) Type() string { return "V2ExpiredToken" }
 
+// V2PollerDied is emitted when a device's poller stops unexpectedly. Unlike V2ExpiredToken, the
+// access token may still be valid, so a new poller can be started for the device.
+type V2PollerDied struct {
+	UserID   string
+	DeviceID string
+}
+
+func (*V2PollerDied) Type() string { return "V2PollerDied" }
+
 // V2StateRedaction is emitted when a timeline is seen that contains one or more
 // redaction events targeting a piece of room state. The redaction will be emitted
 // before its corresponding V2Accumulate payload is emitted.
@@ -192,6 +207,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnDeviceMessages(pl)
 	case *V2ExpiredToken:
 		v.receiver.OnExpiredToken(pl)
+	case *V2PollerDied:
+		v.receiver.OnPollerDied(pl)
 	case *V2InvalidateRoom:
 		v.receiver.OnInvalidateRoom(pl)
 	case *V2StateRedaction:
@@ -6,6 +6,7 @@ const ChanV3 = "v3ch"
 // V3Listener describes the messages that incoming sliding sync requests will publish.
 type V3Listener interface {
 	EnsurePolling(p *V3EnsurePolling)
+	ForceResync(p *V3ForceResync)
 }
 
 type V3EnsurePolling struct {
@@ -18,6 +19,15 @@ type V3EnsurePolling struct {
 
 func (*V3EnsurePolling) Type() string { return "V3EnsurePolling" }
 
+// V3ForceResync is emitted when an admin asks for all of a user's data to be fetched again from
+// the homeserver. Pollers for the user are stopped and their since tokens are reset, so the next
+// EnsurePolling for each device does an initial sync.
+type V3ForceResync struct {
+	UserID string
+}
+
+func (*V3ForceResync) Type() string { return "V3ForceResync" }
+
 type V3Sub struct {
 	listener Listener
 	receiver V3Listener
@@ -38,6 +48,8 @@ func (v *V3Sub) onMessage(p Payload) {
 	switch pl := p.(type) {
 	case *V3EnsurePolling:
 		v.receiver.EnsurePolling(pl)
+	case *V3ForceResync:
+		v.receiver.ForceResync(pl)
 	default:
 		logger.Warn().Str("type", p.Type()).Msg("V3Sub: unhandled payload type")
 	}
@@ -0,0 +1,143 @@
+package slidingsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+)
+
+// Config configures a proxy embedded in another Go program with New.
+type Config struct {
+	// DestinationServer is the URL of the homeserver to proxy, like SYNCV3_SERVER.
+	DestinationServer string
+	// DB is the Postgres connection string, like SYNCV3_DB. Not needed if Opts.DSN or
+	// Opts.InMemoryStorage is set.
+	DB string
+	// Secret encrypts access tokens stored in the database, like SYNCV3_SECRET. It must not
+	// change between runs against the same database.
+	Secret string
+	// Opts configures how the proxy behaves.
+	Opts Opts
+	// Server configures how HTTP requests are routed. BindAddrs are only used by Start.
+	Server ServerOpts
+	// AdminToken, if set, serves the admin API under /_syncv3/admin, authenticated with this token.
+	AdminToken string
+	// LocalMessages serves /rooms/{roomID}/messages from events stored by the proxy where possible.
+	LocalMessages bool
+	// LogOutput, if set, receives the proxy's logs as zerolog JSON objects, one per write, instead
+	// of human readable logs on stderr. Logging is process wide, so this affects every proxy in
+	// the process.
+	LogOutput io.Writer
+}
+
+// Server is a proxy running in-process. It polls the homeserver for users as soon as it is made
+// with New, and serves requests from Handler, or from its own listeners once Start is called.
+type Server struct {
+	h2      *handler2.Handler
+	h3      *handler.SyncLiveHandler
+	opts    ServerOpts
+	handler http.Handler
+
+	mu         sync.Mutex
+	httpServer *http.Server
+	stopped    bool
+}
+
+// New sets up a proxy: it connects to the database, runs migrations, loads caches and resumes
+// polling for users who have used the proxy before. Call Stop to shut it down.
+func New(cfg Config) (*Server, error) {
+	if cfg.DestinationServer == "" {
+		return nil, fmt.Errorf("DestinationServer must be set")
+	}
+	if cfg.DB == "" && cfg.Opts.DSN == nil && !cfg.Opts.InMemoryStorage {
+		return nil, fmt.Errorf("DB must be set")
+	}
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("Secret must be set")
+	}
+	if cfg.LogOutput != nil {
+		internal.SetLogOutput(cfg.LogOutput)
+	}
+	h2, h3, err := setup(cfg.DestinationServer, cfg.DB, cfg.Secret, cfg.Opts)
+	if err != nil {
+		return nil, err
+	}
+	opts := cfg.Server
+	if cfg.AdminToken != "" {
+		opts.Admin = handler.NewAdminAPI(h3, h2, cfg.AdminToken)
+	}
+	if cfg.LocalMessages {
+		opts.Messages = func(homeserver http.Handler) http.Handler {
+			return handler.NewMessagesAPI(h3, homeserver)
+		}
+	}
+	go h2.StartV2Pollers()
+	go h2.Store.Cleaner(time.Hour)
+	return &Server{
+		h2:      h2,
+		h3:      h3,
+		opts:    opts,
+		handler: newServer(opts.Router(h3, cfg.DestinationServer)),
+	}, nil
+}
+
+// Handler returns the proxy's HTTP handler, for serving it from an existing HTTP server instead
+// of calling Start.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// AddHooks registers hooks which are called when sync activity happens, like new events or room
+// list changes. See handler.Hooks.
+func (s *Server) AddHooks(hooks handler.Hooks) {
+	s.h3.AddHooks(hooks)
+}
+
+// Start listens on the configured bind addresses and serves requests in the background. Errors
+// after listening has started are logged.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return fmt.Errorf("server has been stopped")
+	}
+	if s.httpServer != nil {
+		return fmt.Errorf("server already started")
+	}
+	listeners, err := s.opts.listeners()
+	if err != nil {
+		return err
+	}
+	s.httpServer = &http.Server{
+		Handler: s.handler,
+	}
+	s.opts.serve(s.httpServer, listeners, func(err error) {
+		logger.Err(err).Msg("failed to serve")
+	})
+	return nil
+}
+
+// Stop stops serving requests, waiting for in-flight requests until ctx is done, then stops
+// polling and closes the database. The server can't be started again.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+	var err error
+	if s.httpServer != nil {
+		err = s.httpServer.Shutdown(ctx)
+	}
+	s.h3.Teardown()
+	s.h2.Teardown()
+	return err
+}
@@ -0,0 +1,56 @@
+package slidingsync
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+func TestNewValidatesConfig(t *testing.T) {
+	valid := Config{
+		DestinationServer: "http://localhost:8008",
+		DB:                "user=xxxxx dbname=syncv3_test sslmode=disable",
+		Secret:            "secret",
+	}
+	testCases := []struct {
+		name    string
+		modify  func(cfg *Config)
+		wantErr string
+	}{
+		{
+			name:    "no destination server",
+			modify:  func(cfg *Config) { cfg.DestinationServer = "" },
+			wantErr: "DestinationServer",
+		},
+		{
+			name:    "no database",
+			modify:  func(cfg *Config) { cfg.DB = "" },
+			wantErr: "DB",
+		},
+		{
+			name:    "no secret",
+			modify:  func(cfg *Config) { cfg.Secret = "" },
+			wantErr: "Secret",
+		},
+		{
+			name: "authenticator and OIDC",
+			modify: func(cfg *Config) {
+				cfg.Opts.Authenticator = sync2.StaticAuthenticator{}
+				cfg.Opts.OIDCIntrospection = &sync2.IntrospectionOpts{}
+			},
+			wantErr: "Authenticator",
+		},
+	}
+	for _, tc := range testCases {
+		cfg := valid
+		tc.modify(&cfg)
+		srv, err := New(cfg)
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %v, want one mentioning %s", tc.name, err, tc.wantErr)
+		}
+		if srv != nil {
+			t.Errorf("%s: got a server despite the error", tc.name)
+		}
+	}
+}
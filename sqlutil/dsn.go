@@ -0,0 +1,134 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// DSNOpts describes how to build the Postgres connection string, so credentials and TLS settings
+// don't need to be written inline.
+type DSNOpts struct {
+	// DSN is the connection string, as a URL or key=value pairs. Ignored if DSNFile is set.
+	DSN string
+	// DSNFile is a file containing the connection string.
+	DSNFile string
+	// PasswordFile is a file containing the password, which overrides any in the connection string.
+	PasswordFile string
+	// TLS settings, which override any in the connection string. See
+	// https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-PARAMKEYWORDS
+	SSLMode     string
+	SSLCert     string
+	SSLKey      string
+	SSLRootCert string
+}
+
+// BuildDSN reads any files and returns the connection string as key=value pairs.
+func (o DSNOpts) BuildDSN() (string, error) {
+	dsn := o.DSN
+	if o.DSNFile != "" {
+		b, err := os.ReadFile(o.DSNFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read connection string file: %w", err)
+		}
+		dsn = strings.TrimSpace(string(b))
+	}
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		dsn, err = pq.ParseURL(dsn)
+		if err != nil {
+			return "", fmt.Errorf("invalid connection string URL: %w", err)
+		}
+	}
+	params := [][2]string{
+		{"sslmode", o.SSLMode},
+		{"sslcert", o.SSLCert},
+		{"sslkey", o.SSLKey},
+		{"sslrootcert", o.SSLRootCert},
+	}
+	if o.PasswordFile != "" {
+		b, err := os.ReadFile(o.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %w", err)
+		}
+		params = append(params, [2]string{"password", strings.TrimRight(string(b), "\r\n")})
+	}
+	// later values for the same key take precedence
+	for _, param := range params {
+		if param[1] == "" {
+			continue
+		}
+		dsn += " " + param[0] + "=" + quoteDSNValue(param[1])
+	}
+	return strings.TrimSpace(dsn), nil
+}
+
+// quoteDSNValue quotes a value in a key=value connection string.
+func quoteDSNValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// ReloadableDSN is a connection string which can be rebuilt from its files, e.g after credentials
+// have been rotated.
+type ReloadableDSN struct {
+	opts DSNOpts
+	dsn  atomic.Pointer[string]
+}
+
+func NewReloadableDSN(opts DSNOpts) (*ReloadableDSN, error) {
+	r := &ReloadableDSN{opts: opts}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// String returns the current connection string.
+func (r *ReloadableDSN) String() string {
+	return *r.dsn.Load()
+}
+
+// Reload rebuilds the connection string. On error, the previous connection string is kept.
+func (r *ReloadableDSN) Reload() error {
+	dsn, err := r.opts.BuildDSN()
+	if err != nil {
+		return err
+	}
+	r.dsn.Store(&dsn)
+	return nil
+}
+
+// OpenReloadable opens a DB with this driver which uses the current connection string whenever it
+// makes a new connection. Existing connections are unaffected by reloads.
+func OpenReloadable(driverName string, dsn *ReloadableDSN) (*sqlx.DB, error) {
+	// sql.Open doesn't connect, it just gets hold of the driver
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+	return sqlx.NewDb(sql.OpenDB(&reloadingConnector{driver: d, dsn: dsn}), driverName), nil
+}
+
+type reloadingConnector struct {
+	driver driver.Driver
+	dsn    *ReloadableDSN
+}
+
+func (c *reloadingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn.String())
+}
+
+func (c *reloadingConnector) Driver() driver.Driver {
+	return c.driver
+}
@@ -0,0 +1,92 @@
+package sqlutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDSNOptsBuildDSN(t *testing.T) {
+	dir := t.TempDir()
+	dsnFile := filepath.Join(dir, "dsn")
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(dsnFile, []byte("user=syncv3 dbname=syncv3 host=db\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(passwordFile, []byte("it's s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name string
+		opts DSNOpts
+		want string
+	}{
+		{
+			name: "inline connection string is unchanged",
+			opts: DSNOpts{DSN: "user=syncv3 dbname=syncv3 sslmode=disable"},
+			want: "user=syncv3 dbname=syncv3 sslmode=disable",
+		},
+		{
+			name: "URLs are converted to key=value pairs",
+			opts: DSNOpts{DSN: "postgres://syncv3@db/syncv3", SSLMode: "verify-full"},
+			want: "dbname='syncv3' host='db' user='syncv3' sslmode='verify-full'",
+		},
+		{
+			name: "files and TLS settings",
+			opts: DSNOpts{
+				DSN:          "ignored",
+				DSNFile:      dsnFile,
+				PasswordFile: passwordFile,
+				SSLMode:      "verify-ca",
+				SSLCert:      "/certs/client.crt",
+				SSLKey:       "/certs/client.key",
+				SSLRootCert:  "/certs/ca.crt",
+			},
+			want: `user=syncv3 dbname=syncv3 host=db sslmode='verify-ca' sslcert='/certs/client.crt' sslkey='/certs/client.key' sslrootcert='/certs/ca.crt' password='it\'s s3cret'`,
+		},
+	}
+	for _, tc := range testCases {
+		got, err := tc.opts.BuildDSN()
+		if err != nil {
+			t.Fatalf("%s: BuildDSN: %s", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := (DSNOpts{DSNFile: filepath.Join(dir, "missing")}).BuildDSN(); err == nil {
+		t.Errorf("BuildDSN with a missing file did not return an error")
+	}
+}
+
+func TestReloadableDSN(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("one"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dsn, err := NewReloadableDSN(DSNOpts{DSN: "user=syncv3", PasswordFile: passwordFile})
+	if err != nil {
+		t.Fatalf("NewReloadableDSN: %s", err)
+	}
+	if got := dsn.String(); got != "user=syncv3 password='one'" {
+		t.Errorf("got %s", got)
+	}
+	if err := os.WriteFile(passwordFile, []byte("two"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := dsn.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	if got := dsn.String(); got != "user=syncv3 password='two'" {
+		t.Errorf("got %s after reload", got)
+	}
+	// a failed reload keeps the previous value
+	os.Remove(passwordFile)
+	if err := dsn.Reload(); err == nil {
+		t.Errorf("Reload with a missing file did not return an error")
+	}
+	if got := dsn.String(); got != "user=syncv3 password='two'" {
+		t.Errorf("got %s after failed reload", got)
+	}
+}
@@ -0,0 +1,244 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// InstrumentedDriverName is a postgres driver which records how long queries take. Open a DB with
+// this driver name and call RegisterPrometheusMetrics to export the timings.
+const InstrumentedDriverName = "postgres-instrumented"
+
+func init() {
+	sql.Register(InstrumentedDriverName, &instrumentedDriver{Driver: &pq.Driver{}})
+	// so sqlx.Rebind produces $1 placeholders, as it does for "postgres"
+	sqlx.BindDriver(InstrumentedDriverName, sqlx.DOLLAR)
+}
+
+// The histograms queries and table operations are recorded to. Nil until RegisterPrometheusMetrics
+// is called.
+var (
+	queryDurations          atomic.Pointer[prometheus.HistogramVec]
+	tableOperationDurations atomic.Pointer[prometheus.HistogramVec]
+)
+
+var durationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// RegisterPrometheusMetrics exports connection pool stats for db, the latency of all queries made via
+// the instrumented driver labelled by query family, and the latency of operations timed with
+// TableMetrics. Returns a function which unregisters the metrics.
+func RegisterPrometheusMetrics(db *sqlx.DB) (unregister func()) {
+	hv := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "query_duration_secs",
+		Help:      "Time taken in seconds for a query to return, labelled by the statement and table being queried. Excludes reading rows.",
+		Buckets:   durationBuckets,
+	}, []string{"family"})
+	tableHV := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "table_operation_duration_secs",
+		Help:      "Time taken in seconds for an operation on a table, labelled by the table and operation. Includes reading rows.",
+		Buckets:   durationBuckets,
+	}, []string{"table", "operation"})
+	pool := collectors.NewDBStatsCollector(db.DB, "syncv3")
+	prometheus.MustRegister(hv)
+	prometheus.MustRegister(tableHV)
+	prometheus.MustRegister(pool)
+	queryDurations.Store(hv)
+	tableOperationDurations.Store(tableHV)
+	return func() {
+		queryDurations.CompareAndSwap(hv, nil)
+		tableOperationDurations.CompareAndSwap(tableHV, nil)
+		prometheus.Unregister(hv)
+		prometheus.Unregister(tableHV)
+		prometheus.Unregister(pool)
+	}
+}
+
+// TableMetrics times the operations of a table struct, so slow queries can be attributed to the
+// operation, and so the index, responsible. Operations are timed whichever driver the DB uses.
+type TableMetrics struct {
+	table string
+}
+
+func NewTableMetrics(table string) TableMetrics {
+	return TableMetrics{table: table}
+}
+
+// Observe records an operation which started at start. Call it deferred at the top of the
+// operation's method:
+//
+//	defer t.metrics.Observe("SelectByNIDs", time.Now())
+func (m TableMetrics) Observe(operation string, start time.Time) {
+	hv := tableOperationDurations.Load()
+	if hv == nil {
+		return
+	}
+	hv.WithLabelValues(m.table, operation).Observe(time.Since(start).Seconds())
+}
+
+func observeQuery(query string, start time.Time) {
+	hv := queryDurations.Load()
+	if hv == nil {
+		return
+	}
+	hv.WithLabelValues(QueryFamily(query)).Observe(time.Since(start).Seconds())
+}
+
+// QueryFamily groups queries by the kind of statement and the first table they touch, e.g
+// "select syncv3_events". This keeps the number of metric labels bounded, as queries built with
+// sqlx.In vary in their number of parameters.
+func QueryFamily(query string) string {
+	verb := ""
+	prev := ""
+	for len(query) > 0 {
+		var word string
+		word, query = nextWord(query)
+		if word == "" {
+			continue
+		}
+		lower := strings.ToLower(word)
+		if verb == "" {
+			verb = lower
+			if verb == "update" || verb == "copy" {
+				// the table immediately follows
+				prev = "from"
+			}
+			continue
+		}
+		switch prev {
+		case "from", "into", "join":
+			if !strings.HasPrefix(word, "(") {
+				if i := strings.IndexAny(lower, "(),;"); i != -1 {
+					lower = lower[:i]
+				}
+				return verb + " " + strings.Trim(lower, `"`)
+			}
+		}
+		prev = lower
+	}
+	if verb == "" {
+		return "unknown"
+	}
+	return verb
+}
+
+// nextWord returns the next whitespace delimited word in s, and the remainder of s.
+func nextWord(s string) (word, rest string) {
+	s = strings.TrimLeft(s, " \t\r\n")
+	i := strings.IndexAny(s, " \t\r\n")
+	if i == -1 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+type instrumentedDriver struct {
+	driver.Driver
+}
+
+func (d *instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn}, nil
+}
+
+// instrumentedConn wraps a pq connection, timing each query. It implements the same optional driver
+// interfaces as pq so database/sql behaves identically.
+type instrumentedConn struct {
+	driver.Conn
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeQuery(query, start)
+	}
+	return res, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeQuery(query, start)
+	}
+	return rows, err
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+type instrumentedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	defer observeQuery(s.query, start)
+	if sec, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return sec.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(namedValuesToValues(args)) //nolint:staticcheck
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	defer observeQuery(s.query, start)
+	if sqc, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return sqc.QueryContext(ctx, args)
+	}
+	return s.Stmt.Query(namedValuesToValues(args)) //nolint:staticcheck
+}
+
+func namedValuesToValues(named []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(named))
+	for i := range named {
+		values[i] = named[i].Value
+	}
+	return values
+}
@@ -0,0 +1,68 @@
+package sqlutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestQueryFamily(t *testing.T) {
+	testCases := []struct {
+		query string
+		want  string
+	}{
+		{query: `SELECT event_nid FROM syncv3_events WHERE event_id = $1`, want: "select syncv3_events"},
+		{query: "\n\t\tSELECT a.x, b.y\n\t\tFROM syncv3_rooms a JOIN syncv3_snapshots b ON a.current_snapshot_id = b.snapshot_id", want: "select syncv3_rooms"},
+		{query: `SELECT COUNT(*) FROM (SELECT 1 FROM syncv3_events) AS x`, want: "select syncv3_events"},
+		{query: `INSERT INTO syncv3_txns(user_id, event_id) VALUES($1, $2) ON CONFLICT DO NOTHING`, want: "insert syncv3_txns"},
+		{query: `insert into "syncv3_unread" (room_id) values ($1)`, want: "insert syncv3_unread"},
+		{query: `UPDATE syncv3_sync2_devices SET since = $1 WHERE user_id = $2`, want: "update syncv3_sync2_devices"},
+		{query: `DELETE FROM syncv3_to_device_messages WHERE user_id = $1 AND position <= $2`, want: "delete syncv3_to_device_messages"},
+		{query: `WITH x AS (SELECT * FROM syncv3_receipts) SELECT * FROM x`, want: "with syncv3_receipts"},
+		{query: `COPY syncv3_events (event_id) FROM STDIN`, want: "copy syncv3_events"},
+		{query: `BEGIN`, want: "begin"},
+		{query: "  ", want: "unknown"},
+	}
+	for _, tc := range testCases {
+		if got := QueryFamily(tc.query); got != tc.want {
+			t.Errorf("QueryFamily(%q): got %q want %q", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestTableMetrics(t *testing.T) {
+	metrics := NewTableMetrics("events")
+	// not registered yet, so this is dropped
+	metrics.Observe("SelectByNIDs", time.Now())
+
+	// opening doesn't connect, so no database is needed
+	db, err := sqlx.Open(InstrumentedDriverName, "host=localhost")
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+	defer db.Close()
+	unregister := RegisterPrometheusMetrics(db)
+	metrics.Observe("SelectByNIDs", time.Now().Add(-time.Second))
+	metrics.Observe("SelectByNIDs", time.Now())
+	metrics.Observe("Insert", time.Now())
+
+	wantCounts := map[string]uint64{"SelectByNIDs": 2, "Insert": 1}
+	for operation, wantCount := range wantCounts {
+		observer, err := tableOperationDurations.Load().GetMetricWithLabelValues("events", operation)
+		if err != nil {
+			t.Fatalf("GetMetricWithLabelValues: %s", err)
+		}
+		var m dto.Metric
+		observer.(prometheus.Metric).Write(&m)
+		if got := m.GetHistogram().GetSampleCount(); got != wantCount {
+			t.Errorf("%s: got %d samples want %d", operation, got, wantCount)
+		}
+	}
+	unregister()
+	if tableOperationDurations.Load() != nil {
+		t.Errorf("table operation metrics still recorded after unregistering")
+	}
+}
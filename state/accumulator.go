@@ -101,7 +101,7 @@ func (a *Accumulator) calculateNewSnapshot(old StrippedEvents, new Event) (Strip
 }
 
 // roomInfoDelta calculates what the RoomInfo should be given a list of new events.
-func (a *Accumulator) roomInfoDelta(roomID string, events []Event) RoomInfo {
+func roomInfoDelta(roomID string, events []Event) RoomInfo {
 	isEncrypted := false
 	var upgradedRoomID *string
 	var roomType *string
@@ -299,7 +299,7 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 		}
 
 		// check for metadata events
-		info := a.roomInfoDelta(roomID, events)
+		info := roomInfoDelta(roomID, events)
 
 		// these events do not have a state snapshot ID associated with them as we don't know what
 		// order the state events came down in, it's only a snapshot. This means only timeline events
@@ -330,6 +330,12 @@ type AccumulateResult struct {
 	// IncludesStateRedaction is set to true when we have accumulated a redaction to a
 	// piece of room state.
 	IncludesStateRedaction bool
+	// NumDuplicates is the number of timeline events which were ignored because they were
+	// already known to the proxy, or repeated within the timeline.
+	NumDuplicates int
+	// MissingSnapshot is set when the timeline was ignored because the proxy has no state for
+	// the room, so the state needs to be fetched from the homeserver.
+	MissingSnapshot bool
 }
 
 // Accumulate internal state from a user's sync response. The timeline order MUST be in the order
@@ -349,14 +355,15 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	// - there to be no duplicate events
 	// - if there are new events, they are always new.
 	// Both of these assumptions can be false for different reasons
-	incomingEvents := parseAndDeduplicateTimelineEvents(roomID, timeline)
-	newEvents, err := a.filterToNewTimelineEvents(txn, incomingEvents)
+	incomingEvents, numRepeated := parseAndDeduplicateTimelineEvents(roomID, timeline)
+	newEvents, numKnown, err := a.filterToNewTimelineEvents(txn, incomingEvents)
 	if err != nil {
 		err = fmt.Errorf("filterTimelineEvents: %w", err)
 		return AccumulateResult{}, err
 	}
+	numDuplicates := numRepeated + numKnown
 	if len(newEvents) == 0 {
-		return AccumulateResult{}, nil // nothing to do
+		return AccumulateResult{NumDuplicates: numDuplicates}, nil // nothing to do
 	}
 
 	// If this timeline was limited and we don't recognise its first event E, mark it
@@ -419,7 +426,7 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 			})
 			// the HS gave us bad data so there's no point retrying
 			// by not returning an error, we are telling the poller it is fine to not retry this request.
-			return AccumulateResult{}, nil
+			return AccumulateResult{NumDuplicates: numDuplicates, MissingSnapshot: true}, nil
 		}
 	}
 
@@ -427,13 +434,16 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	if err != nil {
 		return AccumulateResult{}, err
 	}
+	// another poller may have inserted some of these events since we checked
+	numDuplicates += len(newEvents) - len(eventIDToNID)
 	if len(eventIDToNID) == 0 {
 		// nothing to do, we already know about these events
-		return AccumulateResult{}, nil
+		return AccumulateResult{NumDuplicates: numDuplicates}, nil
 	}
 
 	result := AccumulateResult{
-		NumNew: len(eventIDToNID),
+		NumNew:        len(eventIDToNID),
+		NumDuplicates: numDuplicates,
 	}
 
 	var latestNID int64
@@ -558,7 +568,7 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	}
 
 	// the last fetched snapshot ID is the current one
-	info := a.roomInfoDelta(roomID, postInsertEvents)
+	info := roomInfoDelta(roomID, postInsertEvents)
 	if err = a.roomsTable.Upsert(txn, info, snapID, latestNID); err != nil {
 		return AccumulateResult{}, fmt.Errorf("failed to UpdateCurrentSnapshotID to %d: %w", snapID, err)
 	}
@@ -567,8 +577,11 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 
 // - parses it and returns Event structs.
 // - removes duplicate events: this is just a bug which has been seen on Synapse on matrix.org
-func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineResponse) []Event {
+// parseAndDeduplicateTimelineEvents parses the timeline, removing any events which appear more than
+// once. Returns the parsed events and the number of repeats removed.
+func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineResponse) ([]Event, int) {
 	dedupedEvents := make([]Event, 0, len(timeline.Events))
+	numRepeated := 0
 	seenEvents := make(map[string]struct{})
 	for i, rawEvent := range timeline.Events {
 		e := Event{
@@ -585,6 +598,7 @@ func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineRes
 			logger.Warn().Str("event_id", e.ID).Str("room_id", roomID).Msg(
 				"Accumulator.filterToNewTimelineEvents: seen the same event ID twice, ignoring",
 			)
+			numRepeated++
 			continue
 		}
 		if i == 0 && timeline.PrevBatch != "" {
@@ -597,17 +611,16 @@ func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineRes
 		dedupedEvents = append(dedupedEvents, e)
 		seenEvents[e.ID] = struct{}{}
 	}
-	return dedupedEvents
+	return dedupedEvents, numRepeated
 }
 
 // filterToNewTimelineEvents takes a raw timeline array from sync v2 and applies sanity to it:
 // - removes old events: this is an edge case when joining rooms over federation, see https://github.com/matrix-org/sliding-sync/issues/192
 // - check which events are unknown. If all events are known, filter them all out.
-func (a *Accumulator) filterToNewTimelineEvents(txn *sqlx.Tx, dedupedEvents []Event) ([]Event, error) {
-	// if we only have a single timeline event we cannot determine if it is old or not, as we rely on already seen events
-	// being after (higher index) than it.
-	if len(dedupedEvents) <= 1 {
-		return dedupedEvents, nil
+// Returns the new events and the number of events which were already known.
+func (a *Accumulator) filterToNewTimelineEvents(txn *sqlx.Tx, dedupedEvents []Event) ([]Event, int, error) {
+	if len(dedupedEvents) == 0 {
+		return nil, 0, nil
 	}
 
 	// Figure out which of these events are unseen and hence brand new live events.
@@ -619,12 +632,27 @@ func (a *Accumulator) filterToNewTimelineEvents(txn *sqlx.Tx, dedupedEvents []Ev
 	}
 	unknownEventIDs, err := a.eventsTable.SelectUnknownEventIDs(txn, dedupedEventIDs)
 	if err != nil {
-		return nil, fmt.Errorf("filterToNewTimelineEvents: failed to SelectUnknownEventIDs: %w", err)
+		return nil, 0, fmt.Errorf("filterToNewTimelineEvents: failed to SelectUnknownEventIDs: %w", err)
 	}
+	newEvents, numKnown := newTimelineEvents(dedupedEvents, unknownEventIDs)
+	return newEvents, numKnown, nil
+}
+
+// newTimelineEvents returns the events at the end of the timeline which come after every event
+// the proxy already knows about, given the IDs of the events which are unknown. Also returns the
+// number of events which were already known.
+func newTimelineEvents(dedupedEvents []Event, unknownEventIDs map[string]struct{}) ([]Event, int) {
+	numKnown := len(dedupedEvents) - len(unknownEventIDs)
 
 	if len(unknownEventIDs) == 0 {
-		// every event has been seen already, no work to do
-		return nil, nil
+		// every event has been seen already, no work to do. This is common when timelines overlap,
+		// e.g. when two pollers see the same room, or a since token is rewound.
+		return nil, numKnown
+	}
+	// if we only have a single unseen timeline event we cannot determine if it is old or not, as we
+	// rely on already seen events being after (higher index) than it.
+	if len(dedupedEvents) == 1 {
+		return dedupedEvents, 0
 	}
 
 	// In the happy case, we expect to see timeline arrays like this: (SEEN=S, UNSEEN=U)
@@ -651,7 +679,7 @@ func (a *Accumulator) filterToNewTimelineEvents(txn *sqlx.Tx, dedupedEvents []Ev
 	// C is seen event s[A,B,C] => s[2+1:] => []
 	// B is seen event s[A,B,C] => s[1+1:] => [C]
 	// A is seen event s[A,B,C] => s[0+1:] => [B,C]
-	return dedupedEvents[seenIndex+1:], nil
+	return dedupedEvents[seenIndex+1:], numKnown
 }
 
 func ensureStateHasCreateEvent(events []Event) error {
@@ -144,6 +144,27 @@ func TestAccumulatorInitialiseBadInputs(t *testing.T) {
 	}
 }
 
+// Test that timelines for rooms without state are ignored, and flagged so the state can be fetched.
+func TestAccumulatorAccumulateMissingSnapshot(t *testing.T) {
+	const roomID = "!TestAccumulatorAccumulateMissingSnapshot:localhost"
+	db, close := connectToDB(t)
+	defer close()
+	accumulator := NewAccumulator(db)
+	var result AccumulateResult
+	err := sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) (err error) {
+		result, err = accumulator.Accumulate(txn, userID, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+			testutils.NewEvent(t, "m.room.message", userID, map[string]any{"body": "hello"}),
+		}})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+	if result.NumNew != 0 || !result.MissingSnapshot {
+		t.Fatalf("got result %+v, want no new events and MissingSnapshot", result)
+	}
+}
+
 func TestAccumulatorAccumulate(t *testing.T) {
 	roomID := "!TestAccumulatorAccumulate:localhost"
 	roomEvents := []json.RawMessage{
@@ -489,13 +510,39 @@ func TestAccumulatorDupeEvents(t *testing.T) {
 		t.Fatalf("failed to Initialise accumulator: %s", err)
 	}
 
+	var result AccumulateResult
 	err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
-		_, err = accumulator.Accumulate(txn, userID, roomID, joinRoom.Timeline)
+		result, err = accumulator.Accumulate(txn, userID, roomID, joinRoom.Timeline)
 		return err
 	})
 	if err != nil {
 		t.Fatalf("failed to Accumulate: %s", err)
 	}
+	// $b is already known from the state block
+	if result.NumDuplicates != 1 {
+		t.Errorf("got %d duplicates, want 1", result.NumDuplicates)
+	}
+
+	// Accumulating the same timeline again, either in full or just a single event, is a no-op.
+	timelines := []sync2.TimelineResponse{
+		joinRoom.Timeline,
+		{Events: joinRoom.Timeline.Events[1:2]},
+	}
+	for _, timeline := range timelines {
+		err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+			result, err = accumulator.Accumulate(txn, userID, roomID, timeline)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("failed to Accumulate: %s", err)
+		}
+		if result.NumNew != 0 || len(result.TimelineNIDs) != 0 {
+			t.Errorf("re-accumulating known events returned new events: %+v", result)
+		}
+		if result.NumDuplicates != len(timeline.Events) {
+			t.Errorf("got %d duplicates, want %d", result.NumDuplicates, len(timeline.Events))
+		}
+	}
 }
 
 // Regression test for corrupt state snapshots.
@@ -880,3 +927,41 @@ func currentSnapshotNIDs(t *testing.T, snapshotTable *SnapshotTable, roomID stri
 	})
 	return events
 }
+
+var accumulatorBenchmarkCounter atomic.Int64
+
+// Benchmark storing the state and timelines of every room in a dataset, as happens when the first
+// sync for a new user is processed.
+func BenchmarkAccumulatorIngestion(b *testing.B) {
+	db, close := connectToDB(b)
+	defer close()
+	accumulator := NewAccumulator(db)
+	for _, numRooms := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("num_rooms_%d", numRooms), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// every iteration needs new rooms, else the accumulator has nothing to do
+				b.StopTimer()
+				ds := testutils.NewDataset(b, "@bench:dataset", testutils.DatasetOpts{
+					Name:           fmt.Sprintf("BenchmarkAccumulatorIngestion_%d", accumulatorBenchmarkCounter.Add(1)),
+					NumRooms:       numRooms,
+					MaxMembers:     20,
+					TimelineLength: 10,
+					Seed:           1,
+				})
+				b.StartTimer()
+				for _, room := range ds.Rooms {
+					if _, err := accumulator.Initialise(room.RoomID, room.State); err != nil {
+						b.Fatalf("failed to Initialise %s: %s", room.RoomID, err)
+					}
+					err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+						_, err := accumulator.Accumulate(txn, ds.UserID, room.RoomID, sync2.TimelineResponse{Events: room.Timeline})
+						return err
+					})
+					if err != nil {
+						b.Fatalf("failed to Accumulate %s: %s", room.RoomID, err)
+					}
+				}
+			}
+		})
+	}
+}
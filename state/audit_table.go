@@ -0,0 +1,63 @@
+package state
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// AuditEntry records a single admin operation.
+type AuditEntry struct {
+	ID int64 `db:"audit_id" json:"id"`
+	// Unix milliseconds when the operation finished.
+	Timestamp int64 `db:"ts" json:"ts"`
+	// Who performed the operation, as best we can tell, e.g an address or a name they supplied.
+	Actor string `db:"actor" json:"actor"`
+	// The operation e.g "resync" or "purge_room".
+	Action string `db:"action" json:"action"`
+	// The user or room the operation was performed on, if any.
+	Target string `db:"target" json:"target"`
+	// The HTTP status code of the operation, or 200 for operations outside the admin API.
+	Status int `db:"status" json:"status"`
+	// Why the operation failed, if it did.
+	Error string `db:"error" json:"error,omitempty"`
+}
+
+// AuditTable stores a record of admin operations, as many of them destroy data. Entries are never
+// removed by the proxy.
+type AuditTable struct {
+	db *sqlx.DB
+}
+
+func NewAuditTable(db *sqlx.DB) *AuditTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_admin_audit (
+		audit_id BIGSERIAL PRIMARY KEY,
+		ts BIGINT NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		error TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_admin_audit_target_idx ON syncv3_admin_audit(target, audit_id);
+	`)
+	return &AuditTable{db}
+}
+
+// Insert records the entry, setting its ID.
+func (t *AuditTable) Insert(entry *AuditEntry) error {
+	return t.db.QueryRow(
+		`INSERT INTO syncv3_admin_audit(ts, actor, action, target, status, error) VALUES($1, $2, $3, $4, $5, $6) RETURNING audit_id`,
+		entry.Timestamp, entry.Actor, entry.Action, entry.Target, entry.Status, entry.Error,
+	).Scan(&entry.ID)
+}
+
+// Select returns up to `limit` entries with IDs less than `before`, newest first. If target or
+// action are set, only matching entries are returned. A `before` of 0 starts from the newest entry.
+func (t *AuditTable) Select(target, action string, before int64, limit int) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := t.db.Select(&entries, `SELECT audit_id, ts, actor, action, target, status, error FROM syncv3_admin_audit
+		WHERE ($1 = '' OR target = $1) AND ($2 = '' OR action = $2) AND ($3 = 0 OR audit_id < $3)
+		ORDER BY audit_id DESC LIMIT $4`, target, action, before, limit)
+	return entries, err
+}
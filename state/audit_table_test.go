@@ -0,0 +1,54 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAuditTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewAuditTable(db)
+	alice := "@TestAuditTable_alice:localhost"
+	roomID := "!TestAuditTable:localhost"
+	entries := []AuditEntry{
+		{Timestamp: 1000, Actor: "127.0.0.1", Action: "resync", Target: alice, Status: 200},
+		{Timestamp: 2000, Actor: "ops", Action: "backfill_state", Target: roomID, Status: 502, Error: "homeserver said no"},
+		{Timestamp: 3000, Actor: "ops", Action: "resync", Target: alice, Status: 200},
+	}
+	for i := range entries {
+		if err := table.Insert(&entries[i]); err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+		if entries[i].ID == 0 {
+			t.Fatalf("Insert did not set the ID")
+		}
+	}
+
+	got, err := table.Select(alice, "", 0, 10)
+	assertNoError(t, err)
+	if !reflect.DeepEqual(got, []AuditEntry{entries[2], entries[0]}) {
+		t.Errorf("Select by target: got %+v", got)
+	}
+	got, err = table.Select(roomID, "backfill_state", 0, 10)
+	assertNoError(t, err)
+	if !reflect.DeepEqual(got, []AuditEntry{entries[1]}) {
+		t.Errorf("Select by target and action: got %+v", got)
+	}
+	// paginate one at a time
+	got, err = table.Select(alice, "", 0, 1)
+	assertNoError(t, err)
+	if !reflect.DeepEqual(got, []AuditEntry{entries[2]}) {
+		t.Errorf("Select first page: got %+v", got)
+	}
+	got, err = table.Select(alice, "", got[0].ID, 1)
+	assertNoError(t, err)
+	if !reflect.DeepEqual(got, []AuditEntry{entries[0]}) {
+		t.Errorf("Select second page: got %+v", got)
+	}
+	got, err = table.Select(alice, "", got[0].ID, 1)
+	assertNoError(t, err)
+	if len(got) != 0 {
+		t.Errorf("Select past the end: got %+v", got)
+	}
+}
@@ -0,0 +1,60 @@
+package state
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// BackfillTable remembers which backfilled events each user was given by the homeserver's
+// /messages. Backfilled events are shared by everyone in the room, but the homeserver applied the
+// history visibility of the user who fetched them, so they are only ever read back for that user.
+type BackfillTable struct {
+	db *sqlx.DB
+}
+
+func NewBackfillTable(db *sqlx.DB) *BackfillTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_backfills (
+		user_id TEXT NOT NULL,
+		room_id TEXT NOT NULL,
+		-- the backfilled events this user can see, newest first
+		event_nids BIGINT[] NOT NULL,
+		-- the token to paginate back from the oldest event, or '' if it is the start of the room
+		prev_batch TEXT NOT NULL,
+		UNIQUE(user_id, room_id)
+	);
+	`)
+	return &BackfillTable{db: db}
+}
+
+// Select returns the backfilled event NIDs for this user in this room, newest first, and the
+// token to paginate back from the oldest of them. Returns ok=false if nothing has been backfilled.
+func (t *BackfillTable) Select(txn *sqlx.Tx, userID, roomID string) (nids []int64, prevBatch string, ok bool, err error) {
+	var eventNIDs pq.Int64Array
+	err = txn.QueryRow(
+		`SELECT event_nids, prev_batch FROM syncv3_backfills WHERE user_id=$1 AND room_id=$2`, userID, roomID,
+	).Scan(&eventNIDs, &prevBatch)
+	if err == sql.ErrNoRows {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	return eventNIDs, prevBatch, true, nil
+}
+
+// Append adds older backfilled event NIDs, newest first, for this user in this room and replaces
+// the token to paginate back from.
+func (t *BackfillTable) Append(txn *sqlx.Tx, userID, roomID string, nids []int64, prevBatch string) error {
+	_, err := txn.Exec(`
+	INSERT INTO syncv3_backfills (user_id, room_id, event_nids, prev_batch) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (user_id, room_id) DO UPDATE SET
+		event_nids = syncv3_backfills.event_nids || EXCLUDED.event_nids,
+		prev_batch = EXCLUDED.prev_batch`,
+		userID, roomID, pq.Int64Array(nids), prevBatch,
+	)
+	return err
+}
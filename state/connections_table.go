@@ -0,0 +1,70 @@
+package state
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// ConnectionsTable stores the sticky request parameters of each sliding sync connection, i.e the
+// lists, room subscriptions and extensions the client asked for, so that connections can be
+// resumed after the proxy restarts.
+type ConnectionsTable struct {
+	db    *sqlx.DB
+	clock internal.Clock
+}
+
+func NewConnectionsTable(db *sqlx.DB) *ConnectionsTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_connections (
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		conn_id TEXT NOT NULL,
+		request BYTEA NOT NULL,
+		updated_ts BIGINT NOT NULL,
+		UNIQUE(user_id, device_id, conn_id)
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_connections_updated_ts_idx ON syncv3_connections(updated_ts);
+	`)
+	return &ConnectionsTable{db: db, clock: internal.RealClock}
+}
+
+// Upsert stores the sticky request of this connection, replacing any earlier one.
+func (t *ConnectionsTable) Upsert(userID, deviceID, connID string, request []byte) error {
+	_, err := t.db.Exec(`
+	INSERT INTO syncv3_connections (user_id, device_id, conn_id, request, updated_ts) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (user_id, device_id, conn_id) DO UPDATE SET request = EXCLUDED.request, updated_ts = EXCLUDED.updated_ts`,
+		userID, deviceID, connID, request, t.clock.Now().UnixMilli(),
+	)
+	return err
+}
+
+// Select returns the sticky request of this connection if it was stored after `after`, else nil.
+func (t *ConnectionsTable) Select(userID, deviceID, connID string, after time.Time) ([]byte, error) {
+	var request []byte
+	err := t.db.QueryRow(
+		`SELECT request FROM syncv3_connections WHERE user_id=$1 AND device_id=$2 AND conn_id=$3 AND updated_ts > $4`,
+		userID, deviceID, connID, after.UnixMilli(),
+	).Scan(&request)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return request, err
+}
+
+// Delete removes the stored request of this connection.
+func (t *ConnectionsTable) Delete(userID, deviceID, connID string) error {
+	_, err := t.db.Exec(
+		`DELETE FROM syncv3_connections WHERE user_id=$1 AND device_id=$2 AND conn_id=$3`, userID, deviceID, connID,
+	)
+	return err
+}
+
+// Clean removes connections which haven't been stored since boundaryTime.
+func (t *ConnectionsTable) Clean(boundaryTime time.Time) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_connections WHERE updated_ts <= $1`, boundaryTime.UnixMilli())
+	return err
+}
@@ -0,0 +1,64 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectionsTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@alice:connections"
+	deviceID := "alice_phone"
+	table := NewConnectionsTable(db)
+	longAgo := time.Now().Add(-time.Hour)
+
+	// empty table select
+	got, err := table.Select(userID, deviceID, "room-list", longAgo)
+	assertNoError(t, err)
+	assertValue(t, "select on empty table", got, []byte(nil))
+
+	// insert and select
+	assertNoError(t, table.Upsert(userID, deviceID, "room-list", []byte(`{"lists":{}}`)))
+	assertNoError(t, table.Upsert(userID, deviceID, "encryption", []byte(`{"extensions":{}}`)))
+	got, err = table.Select(userID, deviceID, "room-list", longAgo)
+	assertNoError(t, err)
+	assertValue(t, "select after insert", string(got), `{"lists":{}}`)
+
+	// upserts replace
+	assertNoError(t, table.Upsert(userID, deviceID, "room-list", []byte(`{"lists":{"a":{}}}`)))
+	got, err = table.Select(userID, deviceID, "room-list", longAgo)
+	assertNoError(t, err)
+	assertValue(t, "select after upsert", string(got), `{"lists":{"a":{}}}`)
+
+	// connections stored before `after` aren't returned
+	got, err = table.Select(userID, deviceID, "room-list", time.Now().Add(time.Minute))
+	assertNoError(t, err)
+	assertValue(t, "select with later after", got, []byte(nil))
+
+	// other devices don't see the connection
+	got, err = table.Select(userID, "another_device", "room-list", longAgo)
+	assertNoError(t, err)
+	assertValue(t, "select for another device", got, []byte(nil))
+
+	// delete only removes that connection
+	assertNoError(t, table.Delete(userID, deviceID, "room-list"))
+	got, err = table.Select(userID, deviceID, "room-list", longAgo)
+	assertNoError(t, err)
+	assertValue(t, "select after delete", got, []byte(nil))
+	got, err = table.Select(userID, deviceID, "encryption", longAgo)
+	assertNoError(t, err)
+	assertValue(t, "select other conn after delete", string(got), `{"extensions":{}}`)
+
+	// no-op cleanup
+	assertNoError(t, table.Clean(time.Now().Add(-time.Minute)))
+	got, err = table.Select(userID, deviceID, "encryption", longAgo)
+	assertNoError(t, err)
+	assertValue(t, "select after no-op clean", string(got), `{"extensions":{}}`)
+
+	// real cleanup
+	assertNoError(t, table.Clean(time.Now()))
+	got, err = table.Select(userID, deviceID, "encryption", longAgo)
+	assertNoError(t, err)
+	assertValue(t, "select after clean", got, []byte(nil))
+}
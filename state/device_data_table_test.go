@@ -193,3 +193,36 @@ func TestDeviceDataTableBitset(t *testing.T) {
 	bothUpdate.SetOTKCountChanged()
 	assertDeviceData(t, *got, bothUpdate)
 }
+
+// Tests that a used up fallback key is stored as an empty slice and not confused with no change.
+func TestDeviceDataTableFallbackKeysUsedUp(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewDeviceDataTable(db)
+	userID := "@TestDeviceDataTableFallbackKeysUsedUp"
+	deviceID := "BOB"
+
+	err := table.Upsert(userID, deviceID, internal.DeviceKeyData{FallbackKeyTypes: []string{"signed_curve25519"}}, nil)
+	assertNoError(t, err)
+	_, err = table.Select(userID, deviceID, true)
+	mustNotError(t, err)
+
+	// the fallback key is used, so sync v2 sends an empty array
+	err = table.Upsert(userID, deviceID, internal.DeviceKeyData{FallbackKeyTypes: []string{}}, nil)
+	assertNoError(t, err)
+	// then a response without the field, which must not clobber the empty array
+	err = table.Upsert(userID, deviceID, internal.DeviceKeyData{}, nil)
+	assertNoError(t, err)
+
+	got, err := table.Select(userID, deviceID, true)
+	mustNotError(t, err)
+	want := internal.DeviceData{
+		UserID:   userID,
+		DeviceID: deviceID,
+		DeviceKeyData: internal.DeviceKeyData{
+			FallbackKeyTypes: []string{},
+		},
+	}
+	want.SetFallbackKeysChanged()
+	assertDeviceData(t, *got, want)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -44,6 +45,10 @@ type Event struct {
 }
 
 func (ev *Event) ensureFieldsSetOnEvent() error {
+	// stored events are written into responses verbatim, so they must be valid JSON
+	if !gjson.ValidBytes(ev.JSON) {
+		return fmt.Errorf("event JSON is invalid")
+	}
 	evJSON := gjson.ParseBytes(ev.JSON)
 	if ev.RoomID == "" {
 		roomIDResult := evJSON.Get("room_id")
@@ -107,7 +112,8 @@ type membershipEvent struct {
 
 // EventTable stores events. A unique numeric ID is associated with each event.
 type EventTable struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	metrics sqlutil.TableMetrics
 }
 
 // NewEventTable makes a new EventTable
@@ -115,6 +121,9 @@ func NewEventTable(db *sqlx.DB) *EventTable {
 	// make sure tables are made
 	db.MustExec(`
 	CREATE SEQUENCE IF NOT EXISTS syncv3_event_nids_seq;
+	-- events backfilled from the homeserver are older than everything the proxy has seen, so they
+	-- get negative NIDs counting down from below EventsStart, which keeps them out of NID ranges.
+	CREATE SEQUENCE IF NOT EXISTS syncv3_event_backfill_nids_seq INCREMENT BY -1 START WITH -2;
 	CREATE TABLE IF NOT EXISTS syncv3_events (
 		event_nid BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('syncv3_event_nids_seq'),
 		event_id TEXT NOT NULL UNIQUE,
@@ -133,19 +142,21 @@ func NewEventTable(db *sqlx.DB) *EventTable {
 		missing_previous BOOLEAN NOT NULL DEFAULT FALSE
 	);
 
-	-- index for querying all joined rooms for a given user
-	CREATE INDEX IF NOT EXISTS syncv3_events_type_sk_idx ON syncv3_events(event_type, state_key);
+	-- the index for querying joined rooms and membership logs for a given user is created by the
+	-- hot_query_indexes migration
 	-- index for querying membership deltas in particular rooms
 	CREATE INDEX IF NOT EXISTS syncv3_events_type_room_nid_idx ON syncv3_events(event_type, room_id, event_nid);
-	-- index for querying events in a given room
+	-- index for querying events in a given room, including the latest event used for room ordering.
+	-- Lookups by event ID and event NID use the UNIQUE and PRIMARY KEY indexes.
 	CREATE INDEX IF NOT EXISTS syncv3_nid_room_state_idx ON syncv3_events(room_id, event_nid, is_state);
 
 	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(event_nid, event_type, state_key);
 	`)
-	return &EventTable{db}
+	return &EventTable{db: db, metrics: sqlutil.NewTableMetrics("events")}
 }
 
 func (t *EventTable) SelectHighestNID() (highest int64, err error) {
+	defer t.metrics.Observe("SelectHighestNID", time.Now())
 	var result sql.NullInt64
 	err = t.db.QueryRow(
 		`SELECT MAX(event_nid) as e FROM syncv3_events`,
@@ -160,27 +171,81 @@ func (t *EventTable) SelectHighestNID() (highest int64, err error) {
 // The NIDs assigned to new events will respect the order of the given events, e.g. if
 // we insert new events A and B in that order, then NID(A) < NID(B).
 func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map[string]int64, error) {
+	defer t.metrics.Observe("Insert", time.Now())
 	if checkFields {
 		events = filterAndEnsureFieldsSet(events)
 	}
 	result := make(map[string]int64)
+	if err := stripTxnIDs(events); err != nil {
+		return nil, err
+	}
+	chunks := sqlutil.Chunkify(9, MaxPostgresParameters, EventChunker(events))
+	var eventID string
+	var eventNID int64
+	for _, chunk := range chunks {
+		rows, err := txn.NamedQuery(`
+		INSERT INTO syncv3_events (event_id, event, event_type, state_key, room_id, membership, prev_batch, is_state, missing_previous)
+        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :is_state, :missing_previous)
+        ON CONFLICT (event_id) DO NOTHING
+        RETURNING event_id, event_nid`, chunk)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := rows.Scan(&eventID, &eventNID); err != nil {
+				return nil, err
+			}
+			result[eventID] = eventNID
+		}
+	}
+	return result, nil
+}
+
+// stripTxnIDs removes unsigned.txn_id from the events in-place, as it is only meant for the sender's
+// device and is stored separately.
+func stripTxnIDs(events []Event) error {
 	for i := range events {
 		if !gjson.GetBytes(events[i].JSON, "unsigned.txn_id").Exists() {
 			continue
 		}
 		js, err := sjson.DeleteBytes(events[i].JSON, "unsigned.txn_id")
 		if err != nil {
-			return nil, err
+			return err
 		}
 		events[i].JSON = js
 	}
-	chunks := sqlutil.Chunkify(9, MaxPostgresParameters, EventChunker(events))
+	return nil
+}
+
+// InsertBackfill inserts events which were fetched from the homeserver's /messages, newest first,
+// and which are older than every event the proxy has for the room. They are given negative NIDs
+// in descending order, so they are never part of a live NID range. The prev_batch token is
+// attached to the oldest event. Returns a map of event ID to NID for new events only.
+func (t *EventTable) InsertBackfill(txn *sqlx.Tx, roomID string, events []json.RawMessage, prevBatch string) (map[string]int64, error) {
+	defer t.metrics.Observe("InsertBackfill", time.Now())
+	backfilled := make([]Event, len(events))
+	for i := range events {
+		backfilled[i] = Event{
+			JSON:   events[i],
+			RoomID: roomID,
+		}
+	}
+	backfilled = filterAndEnsureFieldsSet(backfilled)
+	if len(backfilled) > 0 && prevBatch != "" {
+		backfilled[len(backfilled)-1].PrevBatch = sql.NullString{
+			String: prevBatch,
+			Valid:  true,
+		}
+	}
+	result := make(map[string]int64)
+	chunks := sqlutil.Chunkify(9, MaxPostgresParameters, EventChunker(backfilled))
 	var eventID string
 	var eventNID int64
 	for _, chunk := range chunks {
 		rows, err := txn.NamedQuery(`
-		INSERT INTO syncv3_events (event_id, event, event_type, state_key, room_id, membership, prev_batch, is_state, missing_previous)
-        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :is_state, :missing_previous)
+		INSERT INTO syncv3_events (event_nid, event_id, event, event_type, state_key, room_id, membership, prev_batch, is_state, missing_previous)
+        VALUES (nextval('syncv3_event_backfill_nids_seq'), :event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :is_state, :missing_previous)
         ON CONFLICT (event_id) DO NOTHING
         RETURNING event_id, event_nid`, chunk)
 		if err != nil {
@@ -218,6 +283,7 @@ func (t *EventTable) selectAny(txn *sqlx.Tx, numWanted int, queryStr string, pqA
 // is true, we return an error if the number of events returned doesn't match the number
 // of given nids.
 func (t *EventTable) SelectByNIDs(txn *sqlx.Tx, verifyAll bool, nids []int64) (events []Event, err error) {
+	defer t.metrics.Observe("SelectByNIDs", time.Now())
 	wanted := 0
 	if verifyAll {
 		wanted = len(nids)
@@ -232,6 +298,7 @@ func (t *EventTable) SelectByNIDs(txn *sqlx.Tx, verifyAll bool, nids []int64) (e
 // event row in the database. The returned events are ordered by ascending NID; the
 // order of the event IDs is irrelevant.
 func (t *EventTable) SelectByIDs(txn *sqlx.Tx, verifyAll bool, ids []string) (events []Event, err error) {
+	defer t.metrics.Observe("SelectByIDs", time.Now())
 	wanted := 0
 	if verifyAll {
 		wanted = len(ids)
@@ -244,6 +311,7 @@ func (t *EventTable) SelectByIDs(txn *sqlx.Tx, verifyAll bool, ids []string) (ev
 // SelectNIDsByIDs does just that. Returns a map from event ID to nid, with a key-value
 // pair for every event_id that was found in the database.
 func (t *EventTable) SelectNIDsByIDs(txn *sqlx.Tx, ids []string) (nids map[string]int64, err error) {
+	defer t.metrics.Observe("SelectNIDsByIDs", time.Now())
 	// Select NIDs using a single parameter which is a string array
 	// https://stackoverflow.com/questions/52712022/what-is-the-most-performant-way-to-rewrite-a-large-in-clause
 	result := make(map[string]int64, len(ids))
@@ -259,6 +327,7 @@ func (t *EventTable) SelectNIDsByIDs(txn *sqlx.Tx, ids []string) (nids map[strin
 }
 
 func (t *EventTable) SelectStrippedEventsByNIDs(txn *sqlx.Tx, verifyAll bool, nids []int64) (StrippedEvents, error) {
+	defer t.metrics.Observe("SelectStrippedEventsByNIDs", time.Now())
 	wanted := 0
 	if verifyAll {
 		wanted = len(nids)
@@ -270,6 +339,7 @@ func (t *EventTable) SelectStrippedEventsByNIDs(txn *sqlx.Tx, verifyAll bool, ni
 }
 
 func (t *EventTable) SelectStrippedEventsByIDs(txn *sqlx.Tx, verifyAll bool, ids []string) (StrippedEvents, error) {
+	defer t.metrics.Observe("SelectStrippedEventsByIDs", time.Now())
 	wanted := 0
 	if verifyAll {
 		wanted = len(ids)
@@ -284,6 +354,7 @@ func (t *EventTable) SelectStrippedEventsByIDs(txn *sqlx.Tx, verifyAll bool, ids
 // SelectUnknownEventIDs accepts a list of event IDs and returns the subset of those which are not known to the DB.
 // It MUST be called within a transaction, or else will panic.
 func (t *EventTable) SelectUnknownEventIDs(txn *sqlx.Tx, maybeUnknownEventIDs []string) (map[string]struct{}, error) {
+	defer t.metrics.Observe("SelectUnknownEventIDs", time.Now())
 	// Note: in practice, the order of rows returned matches the order of rows of
 	// array entries. But I don't think that's guaranteed. Return an (unordered) set
 	// out of paranoia.
@@ -306,6 +377,7 @@ func (t *EventTable) SelectUnknownEventIDs(txn *sqlx.Tx, maybeUnknownEventIDs []
 
 // UpdateBeforeSnapshotID sets the before_state_snapshot_id field to `snapID` for the given NIDs.
 func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, eventNID, snapID, replacesNID int64) error {
+	defer t.metrics.Observe("UpdateBeforeSnapshotID", time.Now())
 	_, err := txn.Exec(
 		`UPDATE syncv3_events SET before_state_snapshot_id=$1, event_replaces_nid=$2 WHERE event_nid = $3`, snapID, replacesNID, eventNID,
 	)
@@ -320,6 +392,7 @@ func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, eventNID, snapID, repl
 //  2. Fetches the highest event_nid before or equal to $2 for each room in room_ids (`max_ev_nid` CTE)
 //  3. Fetches the latest events for each room using the data provided from room_ids and max_ev_nid (the `evs` LATERAL)
 func (t *EventTable) LatestEventInRooms(txn *sqlx.Tx, roomIDs []string, highestNID int64) (events []Event, err error) {
+	defer t.metrics.Observe("LatestEventInRooms", time.Now())
 	err = txn.Select(
 		&events,
 		`
@@ -355,6 +428,7 @@ FROM room_ids,
 //  1. Create a list of the passed in roomIDs (`room_ids` CTE)
 //  2. Fetches the latest eventNIDs for each room using the data provided from room_ids (the `evs` LATERAL)
 func (t *EventTable) LatestEventNIDInRooms(txn *sqlx.Tx, roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
+	defer t.metrics.Observe("LatestEventNIDInRooms", time.Now())
 	var events []Event
 	err = txn.Select(
 		&events,
@@ -379,7 +453,44 @@ FROM room_ids,
 	return
 }
 
+// LatestEventMetadataInRooms returns the NID, type and timestamp of the most recent event with an
+// NID <= highestNID in each of the given rooms, keyed by room ID. Rooms without such an event are
+// omitted. Unlike LatestEventInRooms, the event JSON is not returned.
+func (t *EventTable) LatestEventMetadataInRooms(roomIDs []string, highestNID int64) (map[string]RoomLatestEvent, error) {
+	defer t.metrics.Observe("LatestEventMetadataInRooms", time.Now())
+	var rows []struct {
+		RoomID string `db:"room_id"`
+		RoomLatestEvent
+	}
+	err := t.db.Select(
+		&rows,
+		`
+WITH room_ids AS (
+    select unnest($1::text[]) AS room_id
+)
+SELECT room_ids.room_id, evs.event_nid, evs.event_type, evs.origin_server_ts
+FROM room_ids,
+    LATERAL (
+            SELECT event_nid, event_type,
+                COALESCE((convert_from(event, 'UTF8')::jsonb->>'origin_server_ts')::bigint, 0) AS origin_server_ts
+            FROM syncv3_events e
+            WHERE e.room_id = room_ids.room_id AND event_nid <= $2
+            ORDER BY event_nid DESC LIMIT 1
+            ) AS evs;`,
+		pq.StringArray(roomIDs), highestNID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	roomToEvent := make(map[string]RoomLatestEvent, len(rows))
+	for _, row := range rows {
+		roomToEvent[row.RoomID] = row.RoomLatestEvent
+	}
+	return roomToEvent, nil
+}
+
 func (t *EventTable) Redact(txn *sqlx.Tx, roomVer string, redacteeEventIDToRedactEvent map[string]*Event) error {
+	defer t.metrics.Observe("Redact", time.Now())
 	eventIDs := make([]string, 0, len(redacteeEventIDToRedactEvent))
 	for e := range redacteeEventIDToRedactEvent {
 		eventIDs = append(eventIDs, e)
@@ -389,25 +500,11 @@ func (t *EventTable) Redact(txn *sqlx.Tx, roomVer string, redacteeEventIDToRedac
 	if err != nil {
 		return fmt.Errorf("EventTable.Redact[%v]: %w", eventIDs, err)
 	}
-	rv, err := gomatrixserverlib.GetRoomVersion(gomatrixserverlib.RoomVersion(roomVer))
-	if err != nil {
-		// unknown room version... let's just default to "1"
-		rv = gomatrixserverlib.MustGetRoomVersion(gomatrixserverlib.RoomVersionV1)
-		logger.Warn().Str("version", roomVer).Err(err).Msg(
-			"Redact: GetRoomVersion: unknown room version, defaulting to v1",
-		)
-	}
+	rv := redactionRoomVersion(roomVer)
 	for i := range eventsToRedact {
-		eventsToRedact[i].JSON, err = rv.RedactEventJSON(eventsToRedact[i].JSON)
-		if err != nil {
-			return fmt.Errorf("RedactEventJSON[%s]: %w", eventsToRedact[i].ID, err)
-		}
-		// also set unsigned.redacted_because as EX relies on it
-		eventsToRedact[i].JSON, err = sjson.SetBytes(
-			eventsToRedact[i].JSON, "unsigned.redacted_because", json.RawMessage(redacteeEventIDToRedactEvent[eventsToRedact[i].ID].JSON),
-		)
+		eventsToRedact[i].JSON, err = redactEventJSON(rv, eventsToRedact[i], redacteeEventIDToRedactEvent[eventsToRedact[i].ID])
 		if err != nil {
-			return fmt.Errorf("RedactEventJSON[%s]: setting redacted_because %w", eventsToRedact[i].ID, err)
+			return err
 		}
 		_, err = txn.Exec(`UPDATE syncv3_events SET event=$1 WHERE event_id=$2`, eventsToRedact[i].JSON, eventsToRedact[i].ID)
 		if err != nil {
@@ -417,12 +514,50 @@ func (t *EventTable) Redact(txn *sqlx.Tx, roomVer string, redacteeEventIDToRedac
 	return nil
 }
 
-func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int) ([]Event, error) {
+// redactionRoomVersion returns the room version whose redaction algorithm applies to the room.
+func redactionRoomVersion(roomVer string) gomatrixserverlib.IRoomVersion {
+	rv, err := gomatrixserverlib.GetRoomVersion(gomatrixserverlib.RoomVersion(roomVer))
+	if err != nil {
+		// unknown room version... let's just default to "1"
+		rv = gomatrixserverlib.MustGetRoomVersion(gomatrixserverlib.RoomVersionV1)
+		logger.Warn().Str("version", roomVer).Err(err).Msg(
+			"Redact: GetRoomVersion: unknown room version, defaulting to v1",
+		)
+	}
+	return rv
+}
+
+// redactEventJSON returns the JSON of the event after it has been redacted by the redaction event.
+func redactEventJSON(rv gomatrixserverlib.IRoomVersion, ev Event, redaction *Event) ([]byte, error) {
+	eventJSON, err := rv.RedactEventJSON(ev.JSON)
+	if err != nil {
+		return nil, fmt.Errorf("RedactEventJSON[%s]: %w", ev.ID, err)
+	}
+	// also set unsigned.redacted_because as EX relies on it
+	eventJSON, err = sjson.SetBytes(eventJSON, "unsigned.redacted_because", json.RawMessage(redaction.JSON))
+	if err != nil {
+		return nil, fmt.Errorf("RedactEventJSON[%s]: setting redacted_because %w", ev.ID, err)
+	}
+	return eventJSON, nil
+}
+
+func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int, filter *internal.TimelineFilter) ([]Event, error) {
+	defer t.metrics.Observe("SelectLatestEventsBetween", time.Now())
 	var events []Event
+	var err error
 	// do not pull in events which were in the v2 state block
-	err := txn.Select(&events, `SELECT event_nid, event, missing_previous FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND room_id = $3 AND is_state=FALSE ORDER BY event_nid DESC LIMIT $4`,
-		lowerExclusive, upperInclusive, roomID, limit,
-	)
+	if filter.IsEmpty() {
+		err = txn.Select(&events, `SELECT event_nid, event, missing_previous FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND room_id = $3 AND is_state=FALSE ORDER BY event_nid DESC LIMIT $4`,
+			lowerExclusive, upperInclusive, roomID, limit,
+		)
+	} else {
+		err = txn.Select(&events, `SELECT event_nid, event, missing_previous FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND room_id = $3 AND is_state=FALSE
+		AND (cardinality($5::text[]) = 0 OR event_type = ANY($5)) AND NOT (event_type = ANY($6))
+		ORDER BY event_nid DESC LIMIT $4`,
+			// nil arrays are NULL, which would never match
+			lowerExclusive, upperInclusive, roomID, limit, pq.StringArray(append([]string{}, filter.Types...)), pq.StringArray(append([]string{}, filter.NotTypes...)),
+		)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -482,6 +617,7 @@ SELECT room_id, event_nid, event FROM syncv3_events, max_by_ev_type WHERE event_
 // Select all events between the bounds matching the type, state_key given.
 // Used to work out which rooms the user was joined to at a given point in time.
 func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
+	defer t.metrics.Observe("SelectEventsWithTypeStateKey", time.Now())
 	var events []Event
 	err := t.db.Select(&events,
 		`SELECT event_nid, room_id, event FROM syncv3_events
@@ -495,6 +631,7 @@ func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lo
 // Select all events between the bounds matching the type, state_key given, in the rooms specified only.
 // Used to work out which rooms the user was joined to at a given point in time.
 func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(roomIDs []string, eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
+	defer t.metrics.Observe("SelectEventsWithTypeStateKeyInRooms", time.Now())
 	var events []Event
 	query, args, err := sqlx.In(
 		`SELECT event_nid, room_id, event FROM syncv3_events
@@ -513,6 +650,7 @@ func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(roomIDs []string, event
 
 // Select all events matching the given event type in a room. Used to implement the room member stream (paginated room lists)
 func (t *EventTable) SelectEventNIDsWithTypeInRoom(txn *sqlx.Tx, eventType string, limit int, targetRoom string, lowerExclusive, upperInclusive int64) (eventNIDs []int64, err error) {
+	defer t.metrics.Observe("SelectEventNIDsWithTypeInRoom", time.Now())
 	err = txn.Select(
 		&eventNIDs, `SELECT event_nid FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND event_type = $3 AND room_id = $4 ORDER BY event_nid ASC LIMIT $5`,
 		lowerExclusive, upperInclusive, eventType, targetRoom, limit,
@@ -522,6 +660,7 @@ func (t *EventTable) SelectEventNIDsWithTypeInRoom(txn *sqlx.Tx, eventType strin
 
 // SelectClosestPrevBatchByID is the same as SelectClosestPrevBatch but works on event IDs not NIDs
 func (t *EventTable) SelectClosestPrevBatchByID(roomID string, eventID string) (prevBatch string, err error) {
+	defer t.metrics.Observe("SelectClosestPrevBatchByID", time.Now())
 	err = t.db.QueryRow(
 		`SELECT prev_batch FROM syncv3_events WHERE prev_batch IS NOT NULL AND room_id=$1 AND event_nid >= (
 			SELECT event_nid FROM syncv3_events WHERE event_id = $2
@@ -533,9 +672,37 @@ func (t *EventTable) SelectClosestPrevBatchByID(roomID string, eventID string) (
 	return
 }
 
+// readUpToLimit is the most events after a read receipt which SelectIsReadUpTo will check.
+const readUpToLimit = 50
+
+// SelectIsReadUpTo returns true if eventID is in this room and every later event in the room was
+// sent by userID, i.e. a read receipt at eventID means the user has read everything which could
+// have notified them.
+func (t *EventTable) SelectIsReadUpTo(roomID, userID, eventID string) (bool, error) {
+	defer t.metrics.Observe("SelectIsReadUpTo", time.Now())
+	var events []Event
+	err := t.db.Select(&events, `SELECT event_nid, event FROM syncv3_events WHERE room_id=$1 AND event_nid >= (
+		SELECT event_nid FROM syncv3_events WHERE event_id=$2 AND room_id=$1
+	) ORDER BY event_nid ASC LIMIT $3`, roomID, eventID, readUpToLimit+1)
+	if err != nil {
+		return false, err
+	}
+	// if we don't know the event, or there are lots of events after it, assume it isn't
+	if len(events) == 0 || len(events) > readUpToLimit {
+		return false, nil
+	}
+	for _, ev := range events[1:] {
+		if gjson.GetBytes(ev.JSON, "sender").Str != userID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 // Select the closest prev batch token for the provided event NID. Returns the empty string if there
 // is no closest.
 func (t *EventTable) SelectClosestPrevBatch(txn *sqlx.Tx, roomID string, eventNID int64) (prevBatch string, err error) {
+	defer t.metrics.Observe("SelectClosestPrevBatch", time.Now())
 	err = txn.QueryRow(
 		`SELECT prev_batch FROM syncv3_events WHERE prev_batch IS NOT NULL AND room_id=$1 AND event_nid >= $2 LIMIT 1`, roomID, eventNID,
 	).Scan(&prevBatch)
@@ -545,7 +712,24 @@ func (t *EventTable) SelectClosestPrevBatch(txn *sqlx.Tx, roomID string, eventNI
 	return
 }
 
+// SelectNIDForPrevBatch returns the NID of the event in the room which the prev_batch token paginates
+// back from, or 0 if there is no such event or the proxy doesn't have the events before it.
+func (t *EventTable) SelectNIDForPrevBatch(txn *sqlx.Tx, roomID, prevBatch string) (int64, error) {
+	defer t.metrics.Observe("SelectNIDForPrevBatch", time.Now())
+	var nid int64
+	var missingPrevious bool
+	err := txn.QueryRow(
+		`SELECT event_nid, missing_previous FROM syncv3_events WHERE room_id=$1 AND prev_batch=$2 AND event_nid > 0
+		ORDER BY event_nid ASC LIMIT 1`, roomID, prevBatch,
+	).Scan(&nid, &missingPrevious)
+	if err == sql.ErrNoRows || missingPrevious {
+		return 0, nil
+	}
+	return nid, err
+}
+
 func (t *EventTable) SelectCreateEvent(txn *sqlx.Tx, roomID string) (json.RawMessage, error) {
+	defer t.metrics.Observe("SelectCreateEvent", time.Now())
 	var evJSON []byte
 	// there is only 1 create event
 	err := txn.QueryRow(`SELECT event FROM syncv3_events WHERE room_id=$1 AND event_type='m.room.create' AND state_key=''`, roomID).Scan(&evJSON)
@@ -11,6 +11,7 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/tidwall/gjson"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/matrix-org/sliding-sync/testutils"
 )
@@ -350,6 +351,19 @@ func TestEventTableMembershipDetection(t *testing.T) {
 	}
 }
 
+// Test that events which aren't valid JSON are not stored, as stored events are sent to clients verbatim.
+func TestEventTableRejectsInvalidJSON(t *testing.T) {
+	valid := testutils.NewEvent(t, "m.room.message", "@alice:localhost", map[string]interface{}{"body": "hi"})
+	invalid := append([]byte{}, valid[:len(valid)-1]...) // no closing brace
+	got := filterAndEnsureFieldsSet([]Event{
+		{RoomID: "!a:localhost", JSON: invalid},
+		{RoomID: "!a:localhost", JSON: valid},
+	})
+	if len(got) != 1 || string(got[0].JSON) != string(valid) {
+		t.Errorf("got %d events, want only the valid event", len(got))
+	}
+}
+
 func TestChunkify(t *testing.T) {
 	// Make 100 dummy events
 	events := make([]Event, 100)
@@ -850,6 +864,68 @@ func TestLatestEventNIDInRooms(t *testing.T) {
 
 }
 
+func TestLatestEventMetadataInRooms(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewEventTable(db)
+
+	// Insert the following:
+	// - Room FIRST: [N]
+	// - Room SECOND: [N+1, N+2]
+	first := "!TestLatestEventMetadataInRooms_FIRST"
+	second := "!TestLatestEventMetadataInRooms_SECOND"
+	var result map[string]int64
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
+		result, err = table.Insert(txn, []Event{
+			{
+				ID:     "$TestLatestEventMetadataInRooms_N",
+				Type:   "m.room.message",
+				RoomID: first,
+				JSON:   []byte(`{"type":"m.room.message","origin_server_ts":1}`),
+			},
+			{
+				ID:     "$TestLatestEventMetadataInRooms_N+1",
+				Type:   "m.room.message",
+				RoomID: second,
+				JSON:   []byte(`{"type":"m.room.message","origin_server_ts":2}`),
+			},
+			{
+				ID:     "$TestLatestEventMetadataInRooms_N+2",
+				Type:   "m.reaction",
+				RoomID: second,
+				JSON:   []byte(`{"type":"m.reaction","origin_server_ts":3}`),
+			},
+		}, false)
+		return err
+	})
+	assertNoError(t, err)
+
+	got, err := table.LatestEventMetadataInRooms([]string{first, second, "!unknown"}, result["$TestLatestEventMetadataInRooms_N+2"])
+	assertNoError(t, err)
+	if len(got) != 2 {
+		t.Fatalf("got %d rooms want 2: %+v", len(got), got)
+	}
+	if got[first].NID != result["$TestLatestEventMetadataInRooms_N"] {
+		t.Errorf("got NID %d want %d", got[first].NID, result["$TestLatestEventMetadataInRooms_N"])
+	}
+	if got[second].NID != result["$TestLatestEventMetadataInRooms_N+2"] {
+		t.Errorf("got NID %d want %d", got[second].NID, result["$TestLatestEventMetadataInRooms_N+2"])
+	}
+	if got[second].Type != "m.reaction" {
+		t.Errorf("got type %s want m.reaction", got[second].Type)
+	}
+	if got[second].Timestamp != 3 {
+		t.Errorf("got timestamp %d want 3", got[second].Timestamp)
+	}
+
+	// events after highestNID are ignored
+	got, err = table.LatestEventMetadataInRooms([]string{first, second}, result["$TestLatestEventMetadataInRooms_N+1"])
+	assertNoError(t, err)
+	if got[second].NID != result["$TestLatestEventMetadataInRooms_N+1"] {
+		t.Errorf("got NID %d want %d", got[second].NID, result["$TestLatestEventMetadataInRooms_N+1"])
+	}
+}
+
 func TestEventTableSelectUnknownEventIDs(t *testing.T) {
 	db, close := connectToDB(t)
 	defer close()
@@ -1218,7 +1294,7 @@ func TestEventTable_SelectLatestEventsBetween_MissingPrevious(t *testing.T) {
 		// We're using the notation (X, Y] for a half-open interval excluding X but including Y.
 		idRange := fmt.Sprintf("(%s, %s]", tc.FromIDExclusive, tc.ToIDInclusive)
 		t.Log(idRange + " " + tc.Desc)
-		fetched, err := table.SelectLatestEventsBetween(txn, roomID, nids[prefix+tc.FromIDExclusive], nids[prefix+tc.ToIDInclusive], 10)
+		fetched, err := table.SelectLatestEventsBetween(txn, roomID, nids[prefix+tc.FromIDExclusive], nids[prefix+tc.ToIDInclusive], 10, nil)
 		assertNoError(t, err)
 		fetchedIDs := make([]string, 0, len(fetched))
 		for _, ev := range fetched {
@@ -1227,3 +1303,184 @@ func TestEventTable_SelectLatestEventsBetween_MissingPrevious(t *testing.T) {
 		assertValue(t, "fetchedIDs "+idRange+" limit 10", fetchedIDs, tc.ExpectIDs)
 	}
 }
+
+func TestEventTable_SelectLatestEventsBetween_Filter(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewEventTable(db)
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	roomID := fmt.Sprintf("!%s", t.Name())
+	events := []Event{
+		{ID: "message1", Type: "m.room.message"},
+		{ID: "reaction", Type: "m.reaction"},
+		{ID: "encrypted", Type: "m.room.encrypted"},
+		{ID: "message2", Type: "m.room.message"},
+	}
+	prefix := "$" + t.Name() + "-"
+	for i := range events {
+		events[i].JSON = []byte(fmt.Sprintf(`{"event_id":"%s","type":"%s"}`, events[i].ID, events[i].Type))
+		events[i].ID = prefix + events[i].ID
+		events[i].RoomID = roomID
+	}
+	nids, err := table.Insert(txn, events, false)
+	assertNoError(t, err)
+
+	testCases := []struct {
+		filter    *internal.TimelineFilter
+		expectIDs []string
+	}{
+		{
+			filter:    nil,
+			expectIDs: []string{"message2", "encrypted", "reaction", "message1"},
+		},
+		{
+			filter:    &internal.TimelineFilter{Types: []string{"m.room.message", "m.room.encrypted"}},
+			expectIDs: []string{"message2", "encrypted", "message1"},
+		},
+		{
+			filter:    &internal.TimelineFilter{NotTypes: []string{"m.reaction"}},
+			expectIDs: []string{"message2", "encrypted", "message1"},
+		},
+		{
+			filter:    &internal.TimelineFilter{Types: []string{"m.room.message", "m.reaction"}, NotTypes: []string{"m.reaction"}},
+			expectIDs: []string{"message2", "message1"},
+		},
+	}
+	for _, tc := range testCases {
+		fetched, err := table.SelectLatestEventsBetween(txn, roomID, 0, nids[prefix+"message2"], 10, tc.filter)
+		assertNoError(t, err)
+		fetchedIDs := make([]string, 0, len(fetched))
+		for _, ev := range fetched {
+			fetchedIDs = append(fetchedIDs, gjson.GetBytes(ev.JSON, "event_id").Str)
+		}
+		assertValue(t, fmt.Sprintf("fetchedIDs with filter %+v", tc.filter), fetchedIDs, tc.expectIDs)
+	}
+}
+
+func TestEventTable_InsertBackfill(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewEventTable(db)
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	roomID := fmt.Sprintf("!%s", t.Name())
+	prefix := "$" + t.Name() + "-"
+	nids, err := table.Insert(txn, []Event{
+		{ID: prefix + "live", RoomID: roomID, JSON: []byte(fmt.Sprintf(`{"event_id":"%slive","type":"m.room.message"}`, prefix))},
+	}, false)
+	assertNoError(t, err)
+
+	// /messages returns events newest first, and they have no room_id
+	backfilled := []json.RawMessage{
+		[]byte(fmt.Sprintf(`{"event_id":"%snewer","type":"m.room.message","sender":"@alice:localhost"}`, prefix)),
+		[]byte(fmt.Sprintf(`{"event_id":"%solder","type":"m.room.message","sender":"@alice:localhost"}`, prefix)),
+	}
+	backfilledNIDs, err := table.InsertBackfill(txn, roomID, backfilled, "prev_older")
+	assertNoError(t, err)
+	assertValue(t, "len(backfilledNIDs)", len(backfilledNIDs), 2)
+	if backfilledNIDs[prefix+"older"] >= backfilledNIDs[prefix+"newer"] || backfilledNIDs[prefix+"newer"] >= EventsStart {
+		t.Errorf("backfilled events got NIDs %v, want negative NIDs with the oldest lowest", backfilledNIDs)
+	}
+
+	// backfilled events are not part of the live timeline
+	fetched, err := table.SelectLatestEventsBetween(txn, roomID, EventsStart, nids[prefix+"live"], 10, nil)
+	assertNoError(t, err)
+	assertValue(t, "len(fetched)", len(fetched), 1)
+
+	events, err := table.SelectByIDs(txn, true, []string{prefix + "older"})
+	assertNoError(t, err)
+	assertValue(t, "backfilled room ID", events[0].RoomID, roomID)
+	var prevBatch sql.NullString
+	assertNoError(t, txn.QueryRow(`SELECT prev_batch FROM syncv3_events WHERE event_id=$1`, prefix+"older").Scan(&prevBatch))
+	assertValue(t, "prev_batch of oldest backfilled event", prevBatch.String, "prev_older")
+
+	// backfilling the same events again is a no-op
+	backfilledNIDs, err = table.InsertBackfill(txn, roomID, backfilled, "prev_older")
+	assertNoError(t, err)
+	assertValue(t, "len(backfilledNIDs) when backfilling again", len(backfilledNIDs), 0)
+}
+
+func TestEventTableSelectIsReadUpTo(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewEventTable(db)
+	roomID := "!TestEventTableSelectIsReadUpTo:localhost"
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		_, err := table.Insert(txn, []Event{
+			{ID: "$read1", Type: "m.room.message", RoomID: roomID, JSON: []byte(`{"sender":"` + bob + `"}`)},
+			{ID: "$read2", Type: "m.room.message", RoomID: roomID, JSON: []byte(`{"sender":"` + bob + `"}`)},
+			{ID: "$read3", Type: "m.room.message", RoomID: roomID, JSON: []byte(`{"sender":"` + alice + `"}`)},
+		}, false)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+	testCases := []struct {
+		eventID string
+		want    bool
+	}{
+		// bob's later message is unread
+		{eventID: "$read1", want: false},
+		// only alice's own message is later
+		{eventID: "$read2", want: true},
+		{eventID: "$read3", want: true},
+		{eventID: "$unknown", want: false},
+	}
+	for _, tc := range testCases {
+		got, err := table.SelectIsReadUpTo(roomID, alice, tc.eventID)
+		if err != nil {
+			t.Fatalf("SelectIsReadUpTo: %s", err)
+		}
+		assertVal(t, "SelectIsReadUpTo "+tc.eventID, got, tc.want)
+	}
+}
+
+func TestEventTable_SelectNIDForPrevBatch(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewEventTable(db)
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	roomID := fmt.Sprintf("!%s", t.Name())
+	prefix := "$" + t.Name() + "-"
+	events := []Event{
+		{ID: prefix + "first", PrevBatch: sql.NullString{String: "prev_first", Valid: true}},
+		{ID: prefix + "second"},
+		{ID: prefix + "after-gap", PrevBatch: sql.NullString{String: "prev_gap", Valid: true}, MissingPrevious: true},
+	}
+	for i := range events {
+		events[i].RoomID = roomID
+		events[i].JSON = []byte(fmt.Sprintf(`{"event_id":"%s","type":"m.room.message"}`, events[i].ID))
+	}
+	nids, err := table.Insert(txn, events, false)
+	assertNoError(t, err)
+
+	nid, err := table.SelectNIDForPrevBatch(txn, roomID, "prev_first")
+	assertNoError(t, err)
+	assertValue(t, "NID for prev_first", nid, nids[prefix+"first"])
+
+	// the proxy doesn't have the events before a gap
+	nid, err = table.SelectNIDForPrevBatch(txn, roomID, "prev_gap")
+	assertNoError(t, err)
+	assertValue(t, "NID for prev_gap", nid, int64(0))
+
+	nid, err = table.SelectNIDForPrevBatch(txn, roomID, "unknown")
+	assertNoError(t, err)
+	assertValue(t, "NID for unknown token", nid, int64(0))
+	nid, err = table.SelectNIDForPrevBatch(txn, "!other:localhost", "prev_first")
+	assertNoError(t, err)
+	assertValue(t, "NID for token in another room", nid, int64(0))
+}
@@ -28,10 +28,17 @@ import (
 //
 // When an invite is rejected, it appears in the `leave` section which then causes the invite to be
 // removed from this table.
+//
+// If the homeserver's room summary is fetched for an invite, it is stored at the end of the invite
+// state as an event of type InviteSummaryEventType, which is never sent to clients.
 type InvitesTable struct {
 	db *sqlx.DB
 }
 
+// InviteSummaryEventType is the type of the pseudo state event holding the homeserver's room
+// summary for an invite. Its content is the response from the room summary API.
+const InviteSummaryEventType = "org.matrix.sliding_sync.room_summary"
+
 func NewInvitesTable(db *sqlx.DB) *InvitesTable {
 	// make sure tables are made
 	db.MustExec(`
@@ -62,6 +69,22 @@ func (t *InvitesTable) RemoveInvite(userID, roomID string) error {
 // memberships. Users who final membership is not "invite" have their outstanding
 // invites to this room deleted.
 func (t *InvitesTable) RemoveSupersededInvites(txn *sqlx.Tx, roomID string, newEvents []Event) error {
+	usersToRemove := supersededInviteUserIDs(newEvents)
+	if len(usersToRemove) == 0 {
+		return nil
+	}
+
+	_, err := txn.Exec(`
+		DELETE FROM syncv3_invites
+		WHERE user_id = ANY($1) AND room_id = $2
+	`, pq.StringArray(usersToRemove), roomID)
+
+	return err
+}
+
+// supersededInviteUserIDs returns the users whose latest membership in the events is no longer an
+// invite.
+func supersededInviteUserIDs(newEvents []Event) (userIDs []string) {
 	memberships := map[string]string{} // user ID -> memberships
 	for _, ev := range newEvents {
 		if ev.Type != "m.room.member" {
@@ -70,23 +93,12 @@ func (t *InvitesTable) RemoveSupersededInvites(txn *sqlx.Tx, roomID string, newE
 		memberships[ev.StateKey] = ev.Membership
 	}
 
-	var usersToRemove []string
 	for userID, membership := range memberships {
 		if membership != "invite" && membership != "_invite" {
-			usersToRemove = append(usersToRemove, userID)
+			userIDs = append(userIDs, userID)
 		}
 	}
-
-	if len(usersToRemove) == 0 {
-		return nil
-	}
-
-	_, err := txn.Exec(`
-		DELETE FROM syncv3_invites
-		WHERE user_id = ANY($1) AND room_id = $2
-	`, pq.StringArray(usersToRemove), roomID)
-
-	return err
+	return userIDs
 }
 
 func (t *InvitesTable) InsertInvite(userID, roomID string, inviteRoomState []json.RawMessage) error {
@@ -102,6 +114,24 @@ func (t *InvitesTable) InsertInvite(userID, roomID string, inviteRoomState []jso
 	return err
 }
 
+// UpdateInviteState replaces the invite state of an invite, if the user is still invited to the
+// room. Returns false if they are not.
+func (t *InvitesTable) UpdateInviteState(userID, roomID string, inviteRoomState []json.RawMessage) (bool, error) {
+	blob, err := json.Marshal(inviteRoomState)
+	if err != nil {
+		return false, err
+	}
+	res, err := t.db.Exec(
+		`UPDATE syncv3_invites SET invite_state = $3 WHERE user_id = $1 AND room_id = $2`,
+		userID, roomID, blob,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
 func (t *InvitesTable) SelectInviteState(userID, roomID string) (inviteState []json.RawMessage, err error) {
 	var blob json.RawMessage
 	if err := t.db.QueryRow(`SELECT invite_state FROM syncv3_invites WHERE user_id=$1 AND room_id=$2`, userID, roomID).Scan(&blob); err != nil && err != sql.ErrNoRows {
@@ -285,3 +285,36 @@ func jsonArrStr(a []json.RawMessage) (result string) {
 	}
 	return
 }
+
+func TestInviteTable_UpdateInviteState(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewInvitesTable(db)
+	alice := "@alice:localhost"
+	roomA := "!update-a:localhost"
+	roomB := "!update-b:localhost"
+	inviteState := []json.RawMessage{[]byte(`{"foo":"bar"}`)}
+	updatedState := []json.RawMessage{[]byte(`{"foo":"bar"}`), []byte(`{"type":"` + InviteSummaryEventType + `"}`)}
+
+	if err := table.InsertInvite(alice, roomA, inviteState); err != nil {
+		t.Fatalf("failed to InsertInvite: %s", err)
+	}
+	updated, err := table.UpdateInviteState(alice, roomA, updatedState)
+	if err != nil {
+		t.Fatalf("failed to UpdateInviteState: %s", err)
+	}
+	if !updated {
+		t.Errorf("UpdateInviteState: got false, want true")
+	}
+	assertInvites(t, table, alice, map[string][]json.RawMessage{roomA: updatedState})
+
+	// updating an invite which was rejected must not resurrect it
+	updated, err = table.UpdateInviteState(alice, roomB, updatedState)
+	if err != nil {
+		t.Fatalf("failed to UpdateInviteState: %s", err)
+	}
+	if updated {
+		t.Errorf("UpdateInviteState: got true for a missing invite, want false")
+	}
+	assertInvites(t, table, alice, map[string][]json.RawMessage{roomA: updatedState})
+}
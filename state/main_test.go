@@ -16,7 +16,7 @@ func TestMain(m *testing.M) {
 	os.Exit(exitCode)
 }
 
-func connectToDB(t *testing.T) (*sqlx.DB, func()) {
+func connectToDB(t testing.TB) (*sqlx.DB, func()) {
 	db, err := sqlx.Open("postgres", postgresConnectionString)
 	if err != nil {
 		t.Fatalf("failed to open SQL db: %s", err)
@@ -0,0 +1,1919 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/getsentry/sentry-go"
+	"github.com/tidwall/gjson"
+	"golang.org/x/exp/slices"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// MemoryStorage keeps everything which Storage keeps in postgres in memory instead, so the proxy
+// can run without a database e.g for local development. Nothing survives a restart.
+//
+// It behaves like Storage, using the same NID, snapshot and position schemes, but makes no attempt
+// to scale: every operation takes a single lock, and some scan every event in a room.
+type MemoryStorage struct {
+	MaxTimelineLimit int
+	clock            internal.Clock
+	shutdownCh       chan struct{}
+	shutdown         bool
+
+	mu sync.Mutex
+	// event NID -> event. Live events have NIDs counting up from 1, backfilled events count down from -2.
+	events       map[int64]*Event
+	eventIDToNID map[string]int64
+	// room ID -> NIDs of every event in the room, ascending
+	roomEventNIDs map[string][]int64
+	// state key -> NIDs of every m.room.member event for that user, ascending
+	memberEventNIDs  map[string][]int64
+	latestNID        int64
+	backfillNID      int64
+	snapshots        map[int64]*SnapshotRow
+	latestSnapshotID int64
+	rooms            map[string]*memoryRoom
+	// SpaceRelation.Key() -> relation
+	spaces map[string]SpaceRelation
+	// user ID, room ID -> backfilled events
+	backfills map[[2]string]memoryBackfill
+	// user ID -> room ID, type -> account data
+	accountData         map[string]map[[2]string]AccountData
+	latestAccountDataID int64
+	// user ID -> room ID -> invite state
+	invites map[string]map[string][]json.RawMessage
+	// user ID -> room ID -> highlight count, notification count
+	unread map[string]map[string][2]int
+	// user ID, device ID -> cbor encoded internal.DeviceKeyData
+	deviceData map[[2]string][]byte
+	// user ID, device ID -> bucket -> target user ID -> target state
+	deviceLists map[[2]string]map[int]internal.MapStringInt
+	// user ID, device ID, event ID -> txn ID
+	txns map[[3]string]txnRow
+	// user ID, device ID -> messages, ascending position
+	toDevice map[[2]string][]ToDeviceRow
+	// user ID, device ID -> ack pos, unack pos
+	toDeviceAckPos    map[[2]string][2]int64
+	latestToDevicePos int64
+	// public then private receipts: room ID -> user ID, thread ID -> receipt
+	receipts [2]map[string]map[[2]string]internal.Receipt
+	// ascending ID
+	audit []AuditEntry
+	// user ID, device ID, conn ID -> sticky request
+	connections map[[3]string]memoryConnection
+}
+
+type memoryRoom struct {
+	info              RoomInfo
+	currentSnapshotID int64
+	latestNID         int64
+}
+
+type memoryBackfill struct {
+	nids      []int64 // newest first
+	prevBatch string
+}
+
+type memoryConnection struct {
+	request   []byte
+	updatedTS int64
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		MaxTimelineLimit: 50,
+		clock:            internal.RealClock,
+		shutdownCh:       make(chan struct{}),
+		events:           make(map[int64]*Event),
+		eventIDToNID:     make(map[string]int64),
+		roomEventNIDs:    make(map[string][]int64),
+		memberEventNIDs:  make(map[string][]int64),
+		backfillNID:      EventsStart,
+		snapshots:        make(map[int64]*SnapshotRow),
+		rooms:            make(map[string]*memoryRoom),
+		spaces:           make(map[string]SpaceRelation),
+		backfills:        make(map[[2]string]memoryBackfill),
+		accountData:      make(map[string]map[[2]string]AccountData),
+		invites:          make(map[string]map[string][]json.RawMessage),
+		unread:           make(map[string]map[string][2]int),
+		deviceData:       make(map[[2]string][]byte),
+		deviceLists:      make(map[[2]string]map[int]internal.MapStringInt),
+		txns:             make(map[[3]string]txnRow),
+		toDevice:         make(map[[2]string][]ToDeviceRow),
+		toDeviceAckPos:   make(map[[2]string][2]int64),
+		receipts: [2]map[string]map[[2]string]internal.Receipt{
+			make(map[string]map[[2]string]internal.Receipt),
+			make(map[string]map[[2]string]internal.Receipt),
+		},
+		connections: make(map[[3]string]memoryConnection),
+	}
+}
+
+// SetClock replaces the clock used for retention, so tests can control which data is cleaned up.
+func (m *MemoryStorage) SetClock(clock internal.Clock) {
+	m.clock = clock
+}
+
+func (m *MemoryStorage) TimelineLimit() int {
+	return m.MaxTimelineLimit
+}
+
+func (m *MemoryStorage) nextEventNID() int64 {
+	m.latestNID++
+	return m.latestNID
+}
+
+func (m *MemoryStorage) nextBackfillEventNID() int64 {
+	m.backfillNID--
+	return m.backfillNID
+}
+
+// insertEvents stores the events which aren't already stored, giving each the next NID from nextNID.
+// Returns a map of event ID to NID for new events only.
+func (m *MemoryStorage) insertEvents(events []Event, nextNID func() int64) map[string]int64 {
+	result := make(map[string]int64)
+	for _, ev := range events {
+		if _, exists := m.eventIDToNID[ev.ID]; exists {
+			continue
+		}
+		stored := ev
+		stored.NID = nextNID()
+		stored.BeforeStateSnapshotID = 0
+		stored.ReplacesNID = 0
+		m.events[stored.NID] = &stored
+		m.eventIDToNID[stored.ID] = stored.NID
+		m.roomEventNIDs[stored.RoomID] = insertNID(m.roomEventNIDs[stored.RoomID], stored.NID)
+		if stored.Type == "m.room.member" {
+			m.memberEventNIDs[stored.StateKey] = insertNID(m.memberEventNIDs[stored.StateKey], stored.NID)
+		}
+		result[stored.ID] = stored.NID
+	}
+	return result
+}
+
+// insertNID inserts the NID into the ascending NIDs.
+func insertNID(nids []int64, nid int64) []int64 {
+	i := sort.Search(len(nids), func(i int) bool { return nids[i] >= nid })
+	return slices.Insert(nids, i, nid)
+}
+
+// nidsBetween returns the NIDs in (lowerExclusive, upperInclusive] from the ascending NIDs.
+func nidsBetween(nids []int64, lowerExclusive, upperInclusive int64) []int64 {
+	i := sort.Search(len(nids), func(i int) bool { return nids[i] > lowerExclusive })
+	j := sort.Search(len(nids), func(j int) bool { return nids[j] > upperInclusive })
+	if j <= i {
+		return nil
+	}
+	return nids[i:j]
+}
+
+// eventsByNIDs returns copies of the events in ascending NID order. If verifyAll is true, it is an
+// error for any of the NIDs to be missing.
+func (m *MemoryStorage) eventsByNIDs(verifyAll bool, nids []int64) ([]Event, error) {
+	events := make([]Event, 0, len(nids))
+	seen := make(map[int64]struct{}, len(nids))
+	for _, nid := range nids {
+		ev, ok := m.events[nid]
+		if !ok {
+			continue
+		}
+		if _, ok = seen[nid]; ok {
+			continue
+		}
+		seen[nid] = struct{}{}
+		events = append(events, *ev)
+	}
+	if verifyAll && len(events) != len(nids) {
+		return nil, internal.NewDataError("events lookup got %d events wanted %d", len(events), len(nids))
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].NID < events[j].NID
+	})
+	return events, nil
+}
+
+// latestEventInRoom returns the event in the room with the highest NID <= highestNID, or nil.
+func (m *MemoryStorage) latestEventInRoom(roomID string, highestNID int64) *Event {
+	nids := m.roomEventNIDs[roomID]
+	i := sort.Search(len(nids), func(i int) bool { return nids[i] > highestNID })
+	if i == 0 {
+		return nil
+	}
+	return m.events[nids[i-1]]
+}
+
+// latestEventsBetween returns up to limit timeline events in the room with NIDs in
+// (lowerExclusive, upperInclusive] which pass the filter, newest first, stopping at the first
+// event which is missing its previous event.
+func (m *MemoryStorage) latestEventsBetween(roomID string, lowerExclusive, upperInclusive int64, limit int, filter *internal.TimelineFilter) []Event {
+	nids := nidsBetween(m.roomEventNIDs[roomID], lowerExclusive, upperInclusive)
+	var events []Event
+	for i := len(nids) - 1; i >= 0 && len(events) < limit; i-- {
+		ev := m.events[nids[i]]
+		// do not pull in events which were in the v2 state block
+		if ev.IsState || !filter.Include(ev.Type) {
+			continue
+		}
+		events = append(events, *ev)
+		if ev.MissingPrevious {
+			break
+		}
+	}
+	return events
+}
+
+// closestPrevBatch returns the prev_batch token of the first event in the room at or after the NID
+// which has one, or "" if there isn't one.
+func (m *MemoryStorage) closestPrevBatch(roomID string, eventNID int64) string {
+	nids := m.roomEventNIDs[roomID]
+	i := sort.Search(len(nids), func(i int) bool { return nids[i] >= eventNID })
+	for _, nid := range nids[i:] {
+		if ev := m.events[nid]; ev.PrevBatch.Valid {
+			return ev.PrevBatch.String
+		}
+	}
+	return ""
+}
+
+func (m *MemoryStorage) snapshot(snapshotID int64) (*SnapshotRow, error) {
+	if snapshotID == 0 {
+		return nil, fmt.Errorf("MemoryStorage.snapshot: snapshot ID requested is 0")
+	}
+	row, ok := m.snapshots[snapshotID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return row, nil
+}
+
+// stateNIDs returns a new slice of the NIDs of the state events in the snapshot, which the caller
+// may modify.
+func stateNIDs(row *SnapshotRow) []int64 {
+	nids := make([]int64, 0, len(row.MembershipEvents)+len(row.OtherEvents))
+	nids = append(nids, row.MembershipEvents...)
+	return append(nids, row.OtherEvents...)
+}
+
+func (m *MemoryStorage) insertSnapshot(roomID string, state stateMap) int64 {
+	memberNIDs, otherNIDs := state.NIDs()
+	m.latestSnapshotID++
+	m.snapshots[m.latestSnapshotID] = &SnapshotRow{
+		SnapshotID:       m.latestSnapshotID,
+		RoomID:           roomID,
+		OtherEvents:      otherNIDs,
+		MembershipEvents: memberNIDs,
+	}
+	return m.latestSnapshotID
+}
+
+func (m *MemoryStorage) stateMapAtSnapshot(snapshotID int64) (stateMap, error) {
+	row, err := m.snapshot(snapshotID)
+	if err != nil {
+		return stateMap{}, err
+	}
+	events, err := m.eventsByNIDs(true, stateNIDs(row))
+	if err != nil {
+		return stateMap{}, err
+	}
+	state := stateMap{
+		Memberships: make(map[string]int64, len(row.MembershipEvents)),
+		Other:       make(map[[2]string]int64, len(row.OtherEvents)),
+	}
+	for _, e := range events {
+		state.Ingest(e)
+	}
+	return state, nil
+}
+
+// earliestSnapshotContaining returns the ID of the room's oldest snapshot which contains the event.
+func (m *MemoryStorage) earliestSnapshotContaining(roomID string, eventNID int64) (int64, error) {
+	var earliest int64
+	for snapshotID, row := range m.snapshots {
+		if row.RoomID != roomID || (earliest != 0 && snapshotID > earliest) {
+			continue
+		}
+		if slices.Contains(row.MembershipEvents, eventNID) || slices.Contains(row.OtherEvents, eventNID) {
+			earliest = snapshotID
+		}
+	}
+	if earliest == 0 {
+		return 0, sql.ErrNoRows
+	}
+	return earliest, nil
+}
+
+func (m *MemoryStorage) currentSnapshotID(roomID string) int64 {
+	if room, ok := m.rooms[roomID]; ok {
+		return room.currentSnapshotID
+	}
+	return 0
+}
+
+// upsertRoom mirrors RoomsTable.Upsert: the room info is only ever added to, never cleared.
+func (m *MemoryStorage) upsertRoom(info RoomInfo, snapshotID, latestNID int64) {
+	room, ok := m.rooms[info.ID]
+	if !ok {
+		room = &memoryRoom{info: RoomInfo{ID: info.ID}}
+		m.rooms[info.ID] = room
+	}
+	room.currentSnapshotID = snapshotID
+	room.latestNID = latestNID
+	if info.IsEncrypted {
+		room.info.IsEncrypted = true
+	}
+	if info.UpgradedRoomID != nil {
+		room.info.UpgradedRoomID = info.UpgradedRoomID
+	}
+	if info.Type != nil {
+		room.info.Type = info.Type
+	}
+	if info.PredecessorRoomID != nil {
+		room.info.PredecessorRoomID = info.PredecessorRoomID
+	}
+}
+
+func (m *MemoryStorage) removeInvites(roomID string, userIDs []string) {
+	for _, userID := range userIDs {
+		delete(m.invites[userID], roomID)
+	}
+}
+
+func (m *MemoryStorage) handleSpaceUpdates(events []Event) {
+	added, removed := spaceRelationUpdates(events)
+	for _, r := range added {
+		m.spaces[r.Key()] = r
+	}
+	for _, r := range removed {
+		delete(m.spaces, r.Key())
+	}
+}
+
+// Initialise behaves like Accumulator.Initialise.
+func (m *MemoryStorage) Initialise(roomID string, state []json.RawMessage) (InitialiseResult, error) {
+	var res InitialiseResult
+	if len(state) == 0 {
+		return res, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	startingSnapshotID := m.currentSnapshotID(roomID)
+	events := make([]Event, len(state))
+	for i := range events {
+		events[i] = Event{
+			JSON:    state[i],
+			RoomID:  roomID,
+			IsState: true,
+		}
+	}
+	events = filterAndEnsureFieldsSet(events)
+	if len(events) == 0 {
+		return res, fmt.Errorf("failed to parse state block, all events were filtered out")
+	}
+	if startingSnapshotID == 0 {
+		if err := ensureStateHasCreateEvent(events); err != nil {
+			return res, err
+		}
+	}
+	if err := stripTxnIDs(events); err != nil {
+		return res, fmt.Errorf("failed to insert events: %w", err)
+	}
+	newEventIDToNID := m.insertEvents(events, m.nextEventNID)
+	if len(newEventIDToNID) == 0 {
+		if startingSnapshotID == 0 {
+			logger.Error().Str("room_id", roomID).Msg(
+				"MemoryStorage.Initialise: room has no current snapshot but also no new inserted events, doing nothing. This is probably a bug.",
+			)
+		}
+		return res, nil
+	}
+
+	var currentState stateMap
+	if startingSnapshotID > 0 {
+		var err error
+		currentState, err = m.stateMapAtSnapshot(startingSnapshotID)
+		if err != nil {
+			return res, fmt.Errorf("failed to load state map: %w", err)
+		}
+	} else {
+		currentState = stateMap{
+			Memberships: make(map[string]int64, len(events)),
+			Other:       make(map[[2]string]int64),
+		}
+	}
+	for _, ev := range events {
+		if nid, isNew := newEventIDToNID[ev.ID]; isNew {
+			ev.NID = nid
+			currentState.Ingest(ev)
+		}
+	}
+	snapshotID := m.insertSnapshot(roomID, currentState)
+	latestNID := int64(0)
+	for _, nid := range stateNIDs(m.snapshots[snapshotID]) {
+		if nid > latestNID {
+			latestNID = nid
+		}
+	}
+	m.removeInvites(roomID, supersededInviteUserIDs(events))
+	m.handleSpaceUpdates(events)
+	m.upsertRoom(roomInfoDelta(roomID, events), snapshotID, latestNID)
+
+	res.AddedEvents = true
+	res.SnapshotID = snapshotID
+	res.ReplacedExistingSnapshot = startingSnapshotID > 0
+	return res, nil
+}
+
+// Accumulate behaves like Accumulator.Accumulate.
+func (m *MemoryStorage) Accumulate(userID, roomID string, timeline sync2.TimelineResponse) (AccumulateResult, error) {
+	if len(timeline.Events) == 0 {
+		return AccumulateResult{}, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	incomingEvents, numRepeated := parseAndDeduplicateTimelineEvents(roomID, timeline)
+	unknownEventIDs := make(map[string]struct{})
+	for _, ev := range incomingEvents {
+		if _, known := m.eventIDToNID[ev.ID]; !known {
+			unknownEventIDs[ev.ID] = struct{}{}
+		}
+	}
+	newEvents, numKnown := newTimelineEvents(incomingEvents, unknownEventIDs)
+	numDuplicates := numRepeated + numKnown
+	if len(newEvents) == 0 {
+		return AccumulateResult{NumDuplicates: numDuplicates}, nil
+	}
+	if timeline.Limited {
+		incomingEvents[0].MissingPrevious = newEvents[0].ID == incomingEvents[0].ID
+	}
+
+	snapID := m.currentSnapshotID(roomID)
+	if snapID == 0 && (newEvents[0].Type != "m.room.create" || newEvents[0].StateKey != "") {
+		logger.Warn().
+			Str("event_id", newEvents[0].ID).
+			Str("event_type", newEvents[0].Type).
+			Str("event_state_key", newEvents[0].StateKey).
+			Str("room_id", roomID).
+			Str("user_id", userID).
+			Int("len_timeline", len(newEvents)).
+			Msg("MemoryStorage: skipping processing of timeline, as no snapshot exists")
+		return AccumulateResult{NumDuplicates: numDuplicates, MissingSnapshot: true}, nil
+	}
+
+	if err := stripTxnIDs(newEvents); err != nil {
+		return AccumulateResult{}, err
+	}
+	eventIDToNID := m.insertEvents(newEvents, m.nextEventNID)
+	result := AccumulateResult{
+		NumNew:        len(eventIDToNID),
+		NumDuplicates: numDuplicates,
+	}
+
+	var latestNID int64
+	postInsertEvents := make([]Event, 0, len(eventIDToNID))
+	redactTheseEventIDs := make(map[string]*Event)
+	for i, ev := range newEvents {
+		ev.NID = eventIDToNID[ev.ID]
+		parsedEv := gjson.ParseBytes(ev.JSON)
+		if parsedEv.Get("state_key").Exists() {
+			ev.IsState = true
+		}
+		if ev.NID > latestNID {
+			latestNID = ev.NID
+		}
+		if !ev.IsState && ev.Type == "m.room.redaction" {
+			redactsEventID := parsedEv.Get("redacts").Str
+			if redactsEventID == "" {
+				redactsEventID = parsedEv.Get("content.redacts").Str
+			}
+			if redactsEventID != "" {
+				redactTheseEventIDs[redactsEventID] = &newEvents[i]
+			}
+		}
+		postInsertEvents = append(postInsertEvents, ev)
+		result.TimelineNIDs = append(result.TimelineNIDs, ev.NID)
+	}
+
+	if len(redactTheseEventIDs) > 0 {
+		if err := m.redact(roomID, redactTheseEventIDs); err != nil {
+			return AccumulateResult{}, err
+		}
+	}
+
+	for _, ev := range postInsertEvents {
+		var replacesNID int64
+		beforeSnapID := snapID
+		if ev.IsState {
+			state := stateMap{
+				Memberships: make(map[string]int64),
+				Other:       make(map[[2]string]int64),
+			}
+			if snapID != 0 {
+				var err error
+				state, err = m.stateMapAtSnapshot(snapID)
+				if err != nil {
+					return AccumulateResult{}, fmt.Errorf("failed to load state for snapshot %d: %s", snapID, err)
+				}
+			}
+			replacesNID = state.Ingest(ev)
+			snapID = m.insertSnapshot(roomID, state)
+		}
+		stored := m.events[ev.NID]
+		stored.BeforeStateSnapshotID = beforeSnapID
+		stored.ReplacesNID = replacesNID
+	}
+
+	if len(redactTheseEventIDs) > 0 {
+		// we need to emit a cache invalidation if we have redacted some state in the current snapshot
+		currentState := make(map[int64]struct{})
+		if row, ok := m.snapshots[snapID]; ok {
+			for _, nid := range stateNIDs(row) {
+				currentState[nid] = struct{}{}
+			}
+		}
+		for eventID := range redactTheseEventIDs {
+			nid, ok := m.eventIDToNID[eventID]
+			if _, isState := currentState[nid]; ok && isState {
+				result.IncludesStateRedaction = true
+				break
+			}
+		}
+	}
+
+	m.removeInvites(roomID, supersededInviteUserIDs(postInsertEvents))
+	m.handleSpaceUpdates(postInsertEvents)
+	m.upsertRoom(roomInfoDelta(roomID, postInsertEvents), snapID, latestNID)
+	return result, nil
+}
+
+// redact behaves like EventTable.Redact, using the room version from the room's create event.
+func (m *MemoryStorage) redact(roomID string, redacteeEventIDToRedactEvent map[string]*Event) error {
+	var createEvent *Event
+	for _, nid := range m.roomEventNIDs[roomID] {
+		if ev := m.events[nid]; ev.Type == "m.room.create" && ev.StateKey == "" {
+			createEvent = ev
+			break
+		}
+	}
+	if createEvent == nil {
+		return fmt.Errorf("SelectCreateEvent: %w", sql.ErrNoRows)
+	}
+	roomVersion := gjson.GetBytes(createEvent.JSON, "content.room_version").Str
+	if roomVersion == "" {
+		// Defaults to "1" if the key does not exist.
+		roomVersion = "1"
+		logger.Warn().Str("room", roomID).Msg(
+			"Redact: no content.room_version in create event, defaulting to v1",
+		)
+	}
+	rv := redactionRoomVersion(roomVersion)
+	for eventID, redaction := range redacteeEventIDToRedactEvent {
+		nid, ok := m.eventIDToNID[eventID]
+		if !ok {
+			// we don't have the event being redacted, which is fine
+			continue
+		}
+		ev := m.events[nid]
+		eventJSON, err := redactEventJSON(rv, *ev, redaction)
+		if err != nil {
+			return err
+		}
+		ev.JSON = eventJSON
+	}
+	return nil
+}
+
+func (m *MemoryStorage) LatestEventNID() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latestNID, nil
+}
+
+// EventNIDsByIDs returns the NIDs of the given events which exist, keyed by event ID.
+func (m *MemoryStorage) EventNIDsByIDs(eventIDs []string) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nids := make(map[string]int64, len(eventIDs))
+	for _, eventID := range eventIDs {
+		if nid, ok := m.eventIDToNID[eventID]; ok {
+			nids[eventID] = nid
+		}
+	}
+	return nids, nil
+}
+
+// EventNIDs loads the given events, parsing out their commonly used fields. The events
+// are returned in ascending NID order; the order of eventNIDs is ignored.
+func (m *MemoryStorage) EventNIDs(eventNIDs []int64) ([]*internal.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events, err := m.eventsByNIDs(true, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	e := make([]*internal.Event, len(events))
+	for i := range events {
+		e[i] = internal.NewEvent(events[i].JSON)
+	}
+	return e, nil
+}
+
+// IsReadUpTo behaves like EventTable.SelectIsReadUpTo.
+func (m *MemoryStorage) IsReadUpTo(roomID, userID, eventID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nid, ok := m.eventIDToNID[eventID]
+	if !ok || m.events[nid].RoomID != roomID {
+		return false, nil
+	}
+	nids := m.roomEventNIDs[roomID]
+	nids = nids[sort.Search(len(nids), func(i int) bool { return nids[i] >= nid }):]
+	if len(nids) > readUpToLimit {
+		return false, nil
+	}
+	for _, nid := range nids[1:] {
+		if gjson.GetBytes(m.events[nid].JSON, "sender").Str != userID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// GlobalSnapshot loads the metadata of every room with joined members, calling onJoinedMember for
+// each joined member in the order they joined.
+func (m *MemoryStorage) GlobalSnapshot(onJoinedMember JoinedMemberFunc) (StartupSnapshot, error) {
+	m.mu.Lock()
+	metadata, joinedMembers := m.allJoinedMembers()
+	m.metadataForAllRooms(metadata)
+	m.mu.Unlock()
+	// call back without holding the lock, in case the callback uses the storage
+	for _, member := range joinedMembers {
+		onJoinedMember(member[0], member[1])
+	}
+	return StartupSnapshot{GlobalMetadata: metadata}, nil
+}
+
+// allJoinedMembers behaves like Storage.AllJoinedMembers, but returns the room ID and user ID of
+// each joined member instead of calling back.
+func (m *MemoryStorage) allJoinedMembers() (metadata map[string]internal.RoomMetadata, joinedMembers [][2]string) {
+	var membershipNIDs []int64
+	for _, room := range m.rooms {
+		if row, ok := m.snapshots[room.currentSnapshotID]; ok {
+			membershipNIDs = append(membershipNIDs, row.MembershipEvents...)
+		}
+	}
+	slices.Sort(membershipNIDs)
+	joinCounts := make(map[string]int)
+	inviteCounts := make(map[string]int)
+	heroNIDs := make(map[string]*circularSlice[int64])
+	for _, nid := range membershipNIDs {
+		ev, ok := m.events[nid]
+		if !ok {
+			continue
+		}
+		switch ev.Membership {
+		case "join", "_join":
+			joinCounts[ev.RoomID]++
+			joinedMembers = append(joinedMembers, [2]string{ev.RoomID, ev.StateKey})
+		case "invite", "_invite":
+			inviteCounts[ev.RoomID]++
+		default:
+			continue
+		}
+		heroes := heroNIDs[ev.RoomID]
+		if heroes == nil {
+			heroes = &circularSlice[int64]{max: 6}
+			heroNIDs[ev.RoomID] = heroes
+		}
+		heroes.append(nid)
+	}
+
+	var allHeroNIDs []int64
+	for _, nids := range heroNIDs {
+		allHeroNIDs = append(allHeroNIDs, nids.vals...)
+	}
+	slices.Sort(allHeroNIDs)
+	heroes := make(map[string][]internal.Hero)
+	// loop backwards so the most recent hero is first in the hero list
+	for i := len(allHeroNIDs) - 1; i >= 0; i-- {
+		ev := m.events[allHeroNIDs[i]]
+		evJSON := gjson.ParseBytes(ev.JSON)
+		heroes[ev.RoomID] = append(heroes[ev.RoomID], internal.Hero{
+			ID:     ev.StateKey,
+			Name:   evJSON.Get("content.displayname").Str,
+			Avatar: evJSON.Get("content.avatar_url").Str,
+		})
+	}
+
+	metadata = make(map[string]internal.RoomMetadata)
+	for roomID, joinCount := range joinCounts {
+		md := internal.NewRoomMetadata(roomID)
+		md.JoinCount = joinCount
+		md.InviteCount = inviteCounts[roomID]
+		md.Heroes = heroes[roomID]
+		metadata[roomID] = *md
+	}
+	return metadata, joinedMembers
+}
+
+// metadataForAllRooms behaves like Storage.MetadataForAllRooms.
+func (m *MemoryStorage) metadataForAllRooms(result map[string]internal.RoomMetadata) {
+	loadMetadata := func(roomID string) internal.RoomMetadata {
+		metadata, ok := result[roomID]
+		if !ok {
+			metadata = *internal.NewRoomMetadata(roomID)
+		}
+		return metadata
+	}
+
+	// work out latest timestamps
+	for roomID := range m.rooms {
+		latestByType := make(map[string]*Event)
+		for _, nid := range m.roomEventNIDs[roomID] {
+			ev := m.events[nid]
+			latestByType[ev.Type] = ev
+		}
+		for _, ev := range latestByType {
+			metadata := loadMetadata(roomID)
+			parsed := gjson.ParseBytes(ev.JSON)
+			ts := parsed.Get("origin_server_ts").Uint()
+			if ts > metadata.LastMessageTimestamp {
+				metadata.LastMessageTimestamp = ts
+			}
+			metadata.LatestEventsByType[parsed.Get("type").Str] = internal.EventMetadata{
+				NID:       ev.NID,
+				Timestamp: ts,
+			}
+			metadata.RoomID = roomID
+			result[roomID] = metadata
+		}
+	}
+
+	// select the name / canonical alias / avatar for all rooms
+	for roomID, room := range m.rooms {
+		row, ok := m.snapshots[room.currentSnapshotID]
+		if !ok {
+			continue
+		}
+		var stateEvents []*Event
+		for _, nid := range row.OtherEvents {
+			ev, ok := m.events[nid]
+			if ok && (ev.Type == "m.room.name" || ev.Type == "m.room.canonical_alias" || ev.Type == "m.room.avatar") {
+				stateEvents = append(stateEvents, ev)
+			}
+		}
+		if len(stateEvents) == 0 {
+			continue
+		}
+		metadata := loadMetadata(roomID)
+		for _, ev := range stateEvents {
+			if ev.StateKey != "" {
+				continue
+			}
+			switch ev.Type {
+			case "m.room.name":
+				metadata.NameEvent = gjson.GetBytes(ev.JSON, "content.name").Str
+			case "m.room.canonical_alias":
+				metadata.CanonicalAlias = gjson.GetBytes(ev.JSON, "content.alias").Str
+			case "m.room.avatar":
+				metadata.AvatarEvent = gjson.GetBytes(ev.JSON, "content.url").Str
+			}
+		}
+		result[roomID] = metadata
+	}
+
+	var spaceRoomIDs []string
+	for roomID, room := range m.rooms {
+		metadata := loadMetadata(roomID)
+		metadata.Encrypted = room.info.IsEncrypted
+		metadata.UpgradedRoomID = room.info.UpgradedRoomID
+		metadata.PredecessorRoomID = room.info.PredecessorRoomID
+		metadata.RoomType = room.info.Type
+		result[roomID] = metadata
+		if metadata.IsSpace() {
+			spaceRoomIDs = append(spaceRoomIDs, roomID)
+		}
+	}
+
+	// select space children
+	spaceRoomToRelations := make(map[string][]SpaceRelation)
+	for _, r := range m.spaces {
+		spaceRoomToRelations[r.Parent] = append(spaceRoomToRelations[r.Parent], r)
+	}
+	for _, roomID := range spaceRoomIDs {
+		relations, ok := spaceRoomToRelations[roomID]
+		if !ok {
+			continue
+		}
+		metadata := loadMetadata(roomID)
+		metadata.ChildSpaceRooms = make(map[string]struct{}, len(relations))
+		for _, r := range relations {
+			// For now we only honour child state events, but we store all the mappings just in case.
+			if r.Relation == RelationMSpaceChild {
+				metadata.ChildSpaceRooms[r.Child] = struct{}{}
+			}
+		}
+		result[roomID] = metadata
+	}
+}
+
+// ResetMetadataState updates the given metadata in-place to reflect the current state
+// of the room. This is only safe to call from the subscriber goroutine; it is not safe
+// to call from the connection goroutines.
+func (m *MemoryStorage) ResetMetadataState(metadata *internal.RoomMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []Event
+	if row, ok := m.snapshots[m.currentSnapshotID(metadata.RoomID)]; ok {
+		for _, nid := range stateNIDs(row) {
+			ev, ok := m.events[nid]
+			if !ok {
+				continue
+			}
+			switch ev.Type {
+			case "m.room.name", "m.room.avatar", "m.room.canonical_alias", "m.room.encryption":
+				if ev.StateKey == "" {
+					events = append(events, *ev)
+				}
+			case "m.room.member":
+				switch ev.Membership {
+				case "join", "_join", "invite", "_invite":
+					events = append(events, *ev)
+				}
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].NID < events[j].NID
+	})
+	resetMetadataFromState(metadata, events)
+	return nil
+}
+
+// FetchMemberships returns the joined, invited and all other members of the room, in no particular
+// order.
+func (m *MemoryStorage) FetchMemberships(roomID string) (joins, invites, leaves []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	row, ok := m.snapshots[m.currentSnapshotID(roomID)]
+	if !ok {
+		return []string{}, []string{}, []string{}, nil
+	}
+	joins = make([]string, 0, len(row.MembershipEvents))
+	invites = make([]string, 0, len(row.MembershipEvents))
+	leaves = make([]string, 0, len(row.MembershipEvents))
+	for _, nid := range row.MembershipEvents {
+		ev, ok := m.events[nid]
+		if !ok {
+			continue
+		}
+		switch ev.Membership {
+		case "join", "_join":
+			joins = append(joins, ev.StateKey)
+		case "invite", "_invite":
+			invites = append(invites, ev.StateKey)
+		default:
+			leaves = append(leaves, ev.StateKey)
+		}
+	}
+	return joins, invites, leaves, nil
+}
+
+func (m *MemoryStorage) StateSnapshot(snapID int64) ([]json.RawMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	row, err := m.snapshot(snapID)
+	if err != nil {
+		return nil, err
+	}
+	events, err := m.eventsByNIDs(true, stateNIDs(row))
+	if err != nil {
+		return nil, fmt.Errorf("failed to select state snapshot %v: %s", snapID, err)
+	}
+	state := make([]json.RawMessage, len(events))
+	for i := range events {
+		state[i] = events[i].JSON
+	}
+	return state, nil
+}
+
+// StateAtSnapshot returns the room and the state events in a snapshot. Returns sql.ErrNoRows if there
+// is no such snapshot.
+func (m *MemoryStorage) StateAtSnapshot(snapshotID int64) (roomID string, events []Event, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	row, err := m.snapshot(snapshotID)
+	if err != nil {
+		return "", nil, err
+	}
+	events, err = m.eventsByNIDs(true, stateNIDs(row))
+	return row.RoomID, events, err
+}
+
+// StateAfterEvent returns the room state after the event with this NID, along with the snapshot the
+// state was built from. Returns sql.ErrNoRows if there is no such event, or the event isn't part of
+// any snapshot e.g because it was backfilled.
+func (m *MemoryStorage) StateAfterEvent(eventNID int64) (roomID string, snapshotID int64, events []Event, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ev, ok := m.events[eventNID]
+	if !ok {
+		return "", 0, nil, sql.ErrNoRows
+	}
+	snapshotID = ev.BeforeStateSnapshotID
+	if snapshotID == 0 {
+		// the event was in the state block of a v2 response, so the snapshot made from that block
+		// is the earliest state we know about which includes it
+		snapshotID, err = m.earliestSnapshotContaining(ev.RoomID, eventNID)
+		if err != nil {
+			return "", 0, nil, err
+		}
+	}
+	row, err := m.snapshot(snapshotID)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	stateEventNIDs := stateNIDs(row)
+	if ev.BeforeStateSnapshotID != 0 {
+		stateEventNIDs = rollForward(stateEventNIDs, *ev)
+	}
+	events, err = m.eventsByNIDs(true, stateEventNIDs)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return ev.RoomID, snapshotID, events, nil
+}
+
+// StateDiff returns how the room's state changed between two snapshots. Returns sql.ErrNoRows if
+// either snapshot doesn't exist or isn't in this room.
+func (m *MemoryStorage) StateDiff(roomID string, fromSnapshotID, toSnapshotID int64) (StateDelta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var nidsBySnapshot [2]map[int64]bool
+	for i, snapshotID := range []int64{fromSnapshotID, toSnapshotID} {
+		row, err := m.snapshot(snapshotID)
+		if err != nil {
+			return StateDelta{}, err
+		}
+		if row.RoomID != roomID {
+			return StateDelta{}, sql.ErrNoRows
+		}
+		nids := make(map[int64]bool, len(row.MembershipEvents)+len(row.OtherEvents))
+		for _, nid := range stateNIDs(row) {
+			nids[nid] = true
+		}
+		nidsBySnapshot[i] = nids
+	}
+	var changedNIDs []int64
+	for i := range nidsBySnapshot {
+		for nid := range nidsBySnapshot[i] {
+			if !nidsBySnapshot[1-i][nid] {
+				changedNIDs = append(changedNIDs, nid)
+			}
+		}
+	}
+	if len(changedNIDs) == 0 {
+		return StateDelta{}, nil
+	}
+	changed, err := m.eventsByNIDs(true, changedNIDs)
+	if err != nil {
+		return StateDelta{}, err
+	}
+	var oldEvents, newEvents []Event
+	for _, ev := range changed {
+		if nidsBySnapshot[0][ev.NID] {
+			oldEvents = append(oldEvents, ev)
+		} else {
+			newEvents = append(newEvents, ev)
+		}
+	}
+	return diffStateEvents(oldEvents, newEvents), nil
+}
+
+// stateFilterIncludes returns true if the event matches a filter of event type to state keys, where
+// no state keys means any state key.
+func stateFilterIncludes(eventTypesToStateKeys map[string][]string, ev Event) bool {
+	stateKeys, ok := eventTypesToStateKeys[ev.Type]
+	if !ok {
+		return false
+	}
+	return len(stateKeys) == 0 || slices.Contains(stateKeys, ev.StateKey)
+}
+
+// Look up room state after the given event position and no further. eventTypesToStateKeys is a map of event type to a list of state keys for that event type.
+// If the list of state keys is empty then all events matching that event type will be returned. If the map is empty entirely, then all room state
+// will be returned.
+func (m *MemoryStorage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []string, pos int64, eventTypesToStateKeys map[string][]string) (map[string][]Event, error) {
+	_, span := internal.StartSpan(ctx, "RoomStateAfterEventPosition")
+	defer span.End()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// as with Storage, the rooms can be ahead of pos, in which case the slower lookup is needed
+	fastNIDs := make([]int64, 0, len(roomIDs))
+	var slowEvents []Event
+	seenRooms := make(map[string]struct{}, len(roomIDs))
+	for _, roomID := range roomIDs {
+		room, ok := m.rooms[roomID]
+		if _, seen := seenRooms[roomID]; !ok || seen {
+			continue
+		}
+		seenRooms[roomID] = struct{}{}
+		if room.latestNID <= pos {
+			fastNIDs = append(fastNIDs, room.latestNID)
+		} else if ev := m.latestEventInRoom(roomID, pos); ev != nil {
+			slowEvents = append(slowEvents, *ev)
+		}
+	}
+	latestEvents, err := m.eventsByNIDs(true, fastNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select latest nids in rooms %v: %s", roomIDs, err)
+	}
+	latestEvents = append(latestEvents, slowEvents...)
+	for i, ev := range latestEvents {
+		if ev.BeforeStateSnapshotID == 0 {
+			// if there is no before snapshot then this last event NID is _part of_ the initial state,
+			// ergo the state after this == the current state and we can safely ignore the lastEventNID
+			latestEvents[i].BeforeStateSnapshotID = m.currentSnapshotID(ev.RoomID)
+		}
+	}
+
+	roomToEvents := make(map[string][]Event, len(roomIDs))
+	if len(eventTypesToStateKeys) == 0 {
+		for _, ev := range latestEvents {
+			row, err := m.snapshot(ev.BeforeStateSnapshotID)
+			if err != nil {
+				return nil, err
+			}
+			events, err := m.eventsByNIDs(true, rollForward(stateNIDs(row), ev))
+			if err != nil {
+				return nil, fmt.Errorf("failed to select state snapshot %v for room %v: %s", ev.BeforeStateSnapshotID, ev.RoomID, err)
+			}
+			roomToEvents[ev.RoomID] = events
+		}
+		return roomToEvents, nil
+	}
+
+	hasMembershipFilter := false
+	hasOtherFilter := false
+	for evType := range eventTypesToStateKeys {
+		if evType == "m.room.member" {
+			hasMembershipFilter = true
+		} else {
+			hasOtherFilter = true
+		}
+	}
+	for _, latest := range latestEvents {
+		if row, ok := m.snapshots[latest.BeforeStateSnapshotID]; ok {
+			var nids []int64
+			if hasMembershipFilter {
+				nids = append(nids, row.MembershipEvents...)
+			}
+			if hasOtherFilter {
+				nids = append(nids, row.OtherEvents...)
+			}
+			events, _ := m.eventsByNIDs(false, nids)
+			for _, ev := range events {
+				if !stateFilterIncludes(eventTypesToStateKeys, ev) {
+					continue
+				}
+				if latest.ReplacesNID == ev.NID {
+					// this event is replaced by the last event
+					ev = latest
+				}
+				roomToEvents[latest.RoomID] = append(roomToEvents[latest.RoomID], ev)
+			}
+		}
+		// handle the most recent event which won't be in the snapshot but may need to be.
+		// we handle the replace case but don't handle brand new state events
+		if latest.ReplacesNID == 0 && stateFilterIncludes(eventTypesToStateKeys, latest) {
+			roomToEvents[latest.RoomID] = append(roomToEvents[latest.RoomID], latest)
+		}
+	}
+	return roomToEvents, nil
+}
+
+// JoinedRoomsAfterPosition returns a map from joined room IDs to EventMetadata.
+func (m *MemoryStorage) JoinedRoomsAfterPosition(userID string, pos int64) (map[string]internal.EventMetadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nids := nidsBetween(m.memberEventNIDs[userID], 0, pos)
+	membershipEvents := make([]Event, len(nids))
+	for i, nid := range nids {
+		membershipEvents[i] = *m.events[nid]
+	}
+	return determineJoinedRoomsFromMemberships(membershipEvents)
+}
+
+// visibleEventNIDsForRooms behaves like Storage.visibleEventNIDsBetweenForRooms with a `from` of 0.
+func (m *MemoryStorage) visibleEventNIDsForRooms(userID string, roomIDs []string, to int64) (map[string][2]int64, error) {
+	inRooms := make(map[string]struct{}, len(roomIDs))
+	for _, roomID := range roomIDs {
+		inRooms[roomID] = struct{}{}
+	}
+	var membershipEvents []Event
+	for _, nid := range nidsBetween(m.memberEventNIDs[userID], 0, to) {
+		if ev := m.events[nid]; hasKey(inRooms, ev.RoomID) {
+			membershipEvents = append(membershipEvents, *ev)
+		}
+	}
+	return visibleEventNIDsWithData(map[string]internal.EventMetadata{}, membershipEvents, userID, 0, to)
+}
+
+func hasKey[K comparable, V any](m map[K]V, key K) bool {
+	_, ok := m[key]
+	return ok
+}
+
+// LatestEventsInRooms returns the most recent events
+// - in the given rooms
+// - that the user has permission to see
+// - with NIDs <= `to`.
+// - which pass the filter, if there is one.
+// Up to `limit` events are chosen per room. This limit be itself be limited according to MaxTimelineLimit.
+func (m *MemoryStorage) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int, filter *internal.TimelineFilter) (map[string]*LatestEvents, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	roomIDToRange, err := m.visibleEventNIDsForRooms(userID, roomIDs, to)
+	if err != nil {
+		return nil, err
+	}
+	if m.MaxTimelineLimit != 0 && limit > m.MaxTimelineLimit {
+		limit = m.MaxTimelineLimit
+	}
+	result := make(map[string]*LatestEvents, len(roomIDs))
+	for roomID, r := range roomIDToRange {
+		var earliestEventNID int64
+		var latestEventNID int64
+		var roomEvents []json.RawMessage
+		// the most recent event will be first
+		for _, ev := range m.latestEventsBetween(roomID, r[0]-1, r[1], limit, filter) {
+			if latestEventNID == 0 {
+				latestEventNID = ev.NID
+			}
+			roomEvents = append(roomEvents, ev.JSON)
+			earliestEventNID = ev.NID
+		}
+		if !filter.IsEmpty() {
+			// events filtered out have still been seen, so they shouldn't be sent live later
+			latestEventNID = r[1]
+		}
+		slices.Reverse(roomEvents)
+		latestEvents := LatestEvents{
+			LatestNID: latestEventNID,
+			Timeline:  roomEvents,
+		}
+		if earliestEventNID != 0 {
+			latestEvents.PrevBatch = m.closestPrevBatch(roomID, earliestEventNID)
+		}
+		result[roomID] = &latestEvents
+	}
+	return result, nil
+}
+
+// LatestEventMetadataInRooms returns the most recent event with an NID <= highestNID in each of the
+// given rooms.
+func (m *MemoryStorage) LatestEventMetadataInRooms(roomIDs []string, highestNID int64) (map[string]RoomLatestEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	roomToEvent := make(map[string]RoomLatestEvent, len(roomIDs))
+	for _, roomID := range roomIDs {
+		ev := m.latestEventInRoom(roomID, highestNID)
+		if ev == nil {
+			continue
+		}
+		roomToEvent[roomID] = RoomLatestEvent{
+			NID:       ev.NID,
+			Type:      ev.Type,
+			Timestamp: gjson.GetBytes(ev.JSON, "origin_server_ts").Uint(),
+		}
+	}
+	return roomToEvent, nil
+}
+
+func (m *MemoryStorage) GetClosestPrevBatch(roomID string, eventNID int64) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closestPrevBatch(roomID, eventNID)
+}
+
+// MessagesBefore returns up to `limit` events in the room the user can see, at or before the NID `to`,
+// newest first. It stops at the first gap in the proxy's copy of the timeline. Also returns the
+// prev_batch token closest to the oldest event.
+func (m *MemoryStorage) MessagesBefore(userID, roomID string, to int64, limit int) (events []Event, prevBatch string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	roomIDToRange, err := m.visibleEventNIDsForRooms(userID, []string{roomID}, to)
+	if err != nil {
+		return nil, "", err
+	}
+	r, ok := roomIDToRange[roomID]
+	if !ok {
+		return nil, "", nil
+	}
+	events = m.latestEventsBetween(roomID, r[0]-1, r[1], limit, nil)
+	if len(events) == 0 {
+		return events, "", nil
+	}
+	return events, m.closestPrevBatch(roomID, events[len(events)-1].NID), nil
+}
+
+// PrevBatchEventNID returns the NID of the event which the prev_batch token paginates back from, if
+// the proxy has the events before it, else 0.
+func (m *MemoryStorage) PrevBatchEventNID(roomID, prevBatch string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, nid := range m.roomEventNIDs[roomID] {
+		ev := m.events[nid]
+		if nid <= 0 || !ev.PrevBatch.Valid || ev.PrevBatch.String != prevBatch {
+			continue
+		}
+		if ev.MissingPrevious {
+			return 0, nil
+		}
+		return nid, nil
+	}
+	return 0, nil
+}
+
+// BackfillTimeline stores events which the homeserver's /messages returned to this user, newest
+// first, which precede the events the proxy has for this room. prevBatch is the token to paginate
+// back from the oldest of them, or "" if they reach the start of the room.
+func (m *MemoryStorage) BackfillTimeline(userID, roomID string, events []json.RawMessage, prevBatch string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	backfilled := make([]Event, len(events))
+	for i := range events {
+		backfilled[i] = Event{
+			JSON:   events[i],
+			RoomID: roomID,
+		}
+	}
+	backfilled = filterAndEnsureFieldsSet(backfilled)
+	if len(backfilled) > 0 && prevBatch != "" {
+		backfilled[len(backfilled)-1].PrevBatch = sql.NullString{
+			String: prevBatch,
+			Valid:  true,
+		}
+	}
+	m.insertEvents(backfilled, m.nextBackfillEventNID)
+
+	key := [2]string{userID, roomID}
+	backfill := m.backfills[key]
+	seen := make(map[int64]struct{}, len(backfill.nids))
+	for _, nid := range backfill.nids {
+		seen[nid] = struct{}{}
+	}
+	for _, ev := range events {
+		nid, ok := m.eventIDToNID[gjson.GetBytes(ev, "event_id").Str]
+		if !ok || nid >= EventsStart {
+			continue // live events are already visible through the user's membership
+		}
+		if _, ok := seen[nid]; ok {
+			continue
+		}
+		seen[nid] = struct{}{}
+		backfill.nids = append(backfill.nids, nid)
+	}
+	backfill.prevBatch = prevBatch
+	m.backfills[key] = backfill
+	return nil
+}
+
+// BackfilledTimeline returns up to `limit` of the events previously backfilled for this user in
+// this room, newest first, and the token to paginate back from the oldest backfilled event.
+// Returns ok=false if nothing has been backfilled for this user.
+func (m *MemoryStorage) BackfilledTimeline(userID, roomID string, limit int) (events []json.RawMessage, prevBatch string, ok bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	backfill, ok := m.backfills[[2]string{userID, roomID}]
+	if !ok {
+		return nil, "", false, nil
+	}
+	nids := backfill.nids
+	if len(nids) > limit {
+		nids = nids[:limit]
+	}
+	// ordered by ascending NID, i.e oldest first
+	evs, err := m.eventsByNIDs(false, nids)
+	if err != nil {
+		return nil, "", false, err
+	}
+	events = make([]json.RawMessage, 0, len(evs))
+	for i := len(evs) - 1; i >= 0; i-- {
+		events = append(events, evs[i].JSON)
+	}
+	return events, backfill.prevBatch, true, nil
+}
+
+func (m *MemoryStorage) AccountData(userID, roomID string, eventTypes []string) ([]AccountData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var data []AccountData
+	for key, ad := range m.accountData[userID] {
+		if key[0] == roomID && slices.Contains(eventTypes, key[1]) {
+			data = append(data, ad)
+		}
+	}
+	return data, nil
+}
+
+func (m *MemoryStorage) RoomAccountDatasWithType(userID, eventType string) ([]AccountData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var data []AccountData
+	for key, ad := range m.accountData[userID] {
+		if key[0] != AccountDataGlobalRoom && key[1] == eventType {
+			data = append(data, ad)
+		}
+	}
+	return data, nil
+}
+
+// Pull out all account data for this user. If roomIDs is empty, global account data is returned.
+// If roomIDs is non-empty, all account data for these rooms are extracted.
+func (m *MemoryStorage) AccountDatas(userID string, roomIDs ...string) ([]AccountData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var datas []AccountData
+	for key, ad := range m.accountData[userID] {
+		if (len(roomIDs) == 0 && key[0] == AccountDataGlobalRoom) || slices.Contains(roomIDs, key[0]) {
+			datas = append(datas, ad)
+		}
+	}
+	return datas, nil
+}
+
+// InsertAccountData stores the account data events, folding events of the same type into the
+// latest one. Returns the account data which was stored.
+func (m *MemoryStorage) InsertAccountData(userID, roomID string, events []json.RawMessage) ([]AccountData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	typeIndexes := make(map[string]int, len(events))
+	data := make([]AccountData, 0, len(events))
+	for _, ev := range events {
+		ad := AccountData{
+			UserID: userID,
+			RoomID: roomID,
+			Data:   ev,
+			Type:   gjson.ParseBytes(ev).Get("type").Str,
+		}
+		// later data always wins as it is more recent
+		if i, ok := typeIndexes[ad.Type]; ok {
+			data[i] = ad
+			continue
+		}
+		typeIndexes[ad.Type] = len(data)
+		data = append(data, ad)
+	}
+	userData := m.accountData[userID]
+	if userData == nil {
+		userData = make(map[[2]string]AccountData)
+		m.accountData[userID] = userData
+	}
+	for _, ad := range data {
+		m.latestAccountDataID++
+		ad.ID = m.latestAccountDataID
+		userData[[2]string{roomID, ad.Type}] = ad
+	}
+	return data, nil
+}
+
+func (m *MemoryStorage) AllNonZeroUnreadCounts(userID string, callback func(roomID string, highlightCount, notificationCount int)) error {
+	m.mu.Lock()
+	nonZero := make(map[string][2]int)
+	for roomID, counts := range m.unread[userID] {
+		if counts[0] > 0 || counts[1] > 0 {
+			nonZero[roomID] = counts
+		}
+	}
+	m.mu.Unlock()
+	for roomID, counts := range nonZero {
+		callback(roomID, counts[0], counts[1])
+	}
+	return nil
+}
+
+// UnreadCounters returns the unread counts of the user in the room, or sql.ErrNoRows if they have
+// never been set.
+func (m *MemoryStorage) UnreadCounters(userID, roomID string) (highlightCount, notificationCount int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts, ok := m.unread[userID][roomID]
+	if !ok {
+		return 0, 0, sql.ErrNoRows
+	}
+	return counts[0], counts[1], nil
+}
+
+// UpdateUnreadCounters sets the counts which are non-nil.
+func (m *MemoryStorage) UpdateUnreadCounters(userID, roomID string, highlightCount, notificationCount *int) error {
+	if highlightCount == nil && notificationCount == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	userCounts := m.unread[userID]
+	if userCounts == nil {
+		userCounts = make(map[string][2]int)
+		m.unread[userID] = userCounts
+	}
+	counts := userCounts[roomID]
+	if highlightCount != nil {
+		counts[0] = *highlightCount
+	}
+	if notificationCount != nil {
+		counts[1] = *notificationCount
+	}
+	userCounts[roomID] = counts
+	return nil
+}
+
+// AllInvitesForUser returns a map of room ID to invite state for all of the user's invites.
+func (m *MemoryStorage) AllInvitesForUser(userID string) (map[string][]json.RawMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string][]json.RawMessage, len(m.invites[userID]))
+	for roomID, inviteState := range m.invites[userID] {
+		result[roomID] = slices.Clone(inviteState)
+	}
+	return result, nil
+}
+
+// InviteState returns the invite state of the user's invite to the room, or nil if there isn't one.
+func (m *MemoryStorage) InviteState(userID, roomID string) ([]json.RawMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.invites[userID][roomID]), nil
+}
+
+func (m *MemoryStorage) InsertInvite(userID, roomID string, inviteRoomState []json.RawMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.invites[userID] == nil {
+		m.invites[userID] = make(map[string][]json.RawMessage)
+	}
+	m.invites[userID][roomID] = slices.Clone(inviteRoomState)
+	return nil
+}
+
+// UpdateInviteState replaces the invite state of an invite, if the user is still invited to the
+// room. Returns false if they are not.
+func (m *MemoryStorage) UpdateInviteState(userID, roomID string, inviteRoomState []json.RawMessage) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.invites[userID][roomID]; !ok {
+		return false, nil
+	}
+	m.invites[userID][roomID] = slices.Clone(inviteRoomState)
+	return true, nil
+}
+
+func (m *MemoryStorage) RemoveInvite(userID, roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.invites[userID], roomID)
+	return nil
+}
+
+// DeviceData behaves like DeviceDataTable.Select: it returns nil if there is no device data, and
+// if swap is true, moves the new device list changes to the sent bucket and clears ChangedBits.
+func (m *MemoryStorage) DeviceData(userID, deviceID string, swap bool) (*internal.DeviceData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{userID, deviceID}
+	data, ok := m.deviceData[key]
+	if !ok {
+		return nil, nil
+	}
+	var keyData internal.DeviceKeyData
+	if err := cbor.Unmarshal(data, &keyData); err != nil {
+		return nil, err
+	}
+	result := &internal.DeviceData{
+		UserID:        userID,
+		DeviceID:      deviceID,
+		DeviceKeyData: keyData,
+	}
+	buckets := m.deviceLists[key]
+	var deviceListChanges internal.MapStringInt
+	if swap {
+		// the sent changes have been acknowledged, so the new ones are now the sent ones
+		deviceListChanges = buckets[BucketNew]
+		delete(buckets, BucketNew)
+		delete(buckets, BucketSent)
+		if len(deviceListChanges) > 0 {
+			buckets[BucketSent] = deviceListChanges
+		}
+	} else {
+		deviceListChanges = buckets[BucketSent]
+	}
+	for targetUserID, targetState := range deviceListChanges {
+		switch targetState {
+		case internal.DeviceListChanged:
+			result.DeviceListChanged = append(result.DeviceListChanged, targetUserID)
+		case internal.DeviceListLeft:
+			result.DeviceListLeft = append(result.DeviceListLeft, targetUserID)
+		}
+	}
+	if !swap {
+		return result, nil
+	}
+	keyData.ChangedBits = 0
+	data, err := cbor.Marshal(keyData)
+	if err != nil {
+		return nil, err
+	}
+	m.deviceData[key] = data
+	return result, nil
+}
+
+// UpsertDeviceData combines the stored device data for this user|device with the partial entry
+// `keys`, and adds the device list changes to the new bucket.
+func (m *MemoryStorage) UpsertDeviceData(userID, deviceID string, keys internal.DeviceKeyData, deviceListChanges map[string]int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{userID, deviceID}
+	if len(deviceListChanges) > 0 {
+		buckets := m.deviceLists[key]
+		if buckets == nil {
+			buckets = make(map[int]internal.MapStringInt)
+			m.deviceLists[key] = buckets
+		}
+		newChanges := buckets[BucketNew]
+		if newChanges == nil {
+			newChanges = make(internal.MapStringInt)
+			buckets[BucketNew] = newChanges
+		}
+		for targetUserID, targetState := range deviceListChanges {
+			if targetState != internal.DeviceListChanged && targetState != internal.DeviceListLeft {
+				sentry.CaptureException(fmt.Errorf("MemoryStorage.UpsertDeviceData invalid target_state: %d this is a programming error", targetState))
+				continue
+			}
+			newChanges[targetUserID] = targetState
+		}
+	}
+	var keyData internal.DeviceKeyData
+	if data, ok := m.deviceData[key]; ok {
+		if err := cbor.Unmarshal(data, &keyData); err != nil {
+			return err
+		}
+	}
+	if keys.FallbackKeyTypes != nil {
+		keyData.FallbackKeyTypes = keys.FallbackKeyTypes
+		keyData.SetFallbackKeysChanged()
+	}
+	if keys.OTKCounts != nil {
+		keyData.OTKCounts = keys.OTKCounts
+		keyData.SetOTKCountChanged()
+	}
+	data, err := cbor.Marshal(keyData)
+	if err != nil {
+		return err
+	}
+	m.deviceData[key] = data
+	return nil
+}
+
+func (m *MemoryStorage) TransactionIDs(userID, deviceID string, eventIDs []string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string]string, len(eventIDs))
+	for _, eventID := range eventIDs {
+		if row, ok := m.txns[[3]string{userID, deviceID, eventID}]; ok {
+			result[eventID] = row.TxnID
+		}
+	}
+	return result, nil
+}
+
+// InsertTransactionIDs stores the transaction IDs of events sent by this device. As with
+// TransactionsTable, nothing is stored if any of the events already has a transaction ID.
+func (m *MemoryStorage) InsertTransactionIDs(userID, deviceID string, eventIDToTxnID map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for eventID := range eventIDToTxnID {
+		if _, exists := m.txns[[3]string{userID, deviceID, eventID}]; exists {
+			return fmt.Errorf("transaction ID for event %s is already stored for %s|%s", eventID, userID, deviceID)
+		}
+	}
+	ts := m.clock.Now().UnixMilli()
+	for eventID, txnID := range eventIDToTxnID {
+		m.txns[[3]string{userID, deviceID, eventID}] = txnRow{
+			UserID:    userID,
+			DeviceID:  deviceID,
+			EventID:   eventID,
+			TxnID:     txnID,
+			Timestamp: ts,
+		}
+	}
+	return nil
+}
+
+// InsertToDeviceMessages behaves like ToDeviceTable.InsertMessages.
+func (m *MemoryStorage) InsertToDeviceMessages(userID, deviceID string, msgs []json.RawMessage) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{userID, deviceID}
+	unackPos := m.toDeviceAckPos[key][1]
+	rows, hashes := newToDeviceRows(userID, deviceID, msgs)
+	if len(hashes) > 0 {
+		stored := make(map[string]struct{})
+		for _, row := range m.toDevice[key] {
+			if slices.Contains(hashes, row.ContentHash) {
+				stored[row.ContentHash] = struct{}{}
+			}
+		}
+		if len(stored) > 0 {
+			rows = withoutStoredToDeviceRows(rows, stored)
+		}
+	}
+	cancels, allRequests, allCancels := setToDeviceActions(userID, deviceID, rows)
+	if len(cancels) > 0 {
+		// delete request events which have the same unique key, only if they are not sent to the client already (unacked)
+		cancelledInDBSet := make(map[string]struct{})
+		kept := make([]ToDeviceRow, 0, len(m.toDevice[key]))
+		for _, row := range m.toDevice[key] {
+			if row.UniqueKey != nil && row.Position > unackPos && slices.Contains(cancels, *row.UniqueKey) {
+				cancelledInDBSet[*row.UniqueKey] = struct{}{}
+				continue
+			}
+			kept = append(kept, row)
+		}
+		m.toDevice[key] = kept
+		rows = withoutCancelledToDeviceRows(rows, cancelledInDBSet, allRequests, allCancels)
+	}
+	var lastPos int64
+	for _, row := range rows {
+		m.latestToDevicePos++
+		row.Position = m.latestToDevicePos
+		m.toDevice[key] = append(m.toDevice[key], row)
+		lastPos = row.Position
+	}
+	return lastPos, nil
+}
+
+// ToDeviceAckPositions returns the highest position this device has acknowledged, and the highest
+// position which has been sent to it.
+func (m *MemoryStorage) ToDeviceAckPositions(userID, deviceID string) (ackPos, unackPos int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	positions := m.toDeviceAckPos[[2]string{userID, deviceID}]
+	return positions[0], positions[1], nil
+}
+
+// AckToDeviceMessages records that the device has received all messages up to and including this
+// position, and deletes them.
+func (m *MemoryStorage) AckToDeviceMessages(userID, deviceID string, toIncl int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{userID, deviceID}
+	rows := m.toDevice[key]
+	m.toDevice[key] = rows[sort.Search(len(rows), func(i int) bool { return rows[i].Position > toIncl }):]
+	positions, ok := m.toDeviceAckPos[key]
+	if !ok {
+		positions[1] = toIncl
+	}
+	if toIncl > positions[0] {
+		positions[0] = toIncl
+	}
+	m.toDeviceAckPos[key] = positions
+	return nil
+}
+
+func (m *MemoryStorage) ToDeviceMessagesWithinSize(userID, deviceID string, from, limit int64, maxBytes int) (msgs []json.RawMessage, upTo int64, more bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := m.toDevice[[2]string{userID, deviceID}]
+	rows = rows[sort.Search(len(rows), func(i int) bool { return rows[i].Position > from }):]
+	if int64(len(rows)) > limit+1 {
+		rows = rows[:limit+1]
+	}
+	msgs, upTo, more = toDeviceMessagesWithinSize(userID, deviceID, rows, from, limit, maxBytes)
+	return msgs, upTo, more, nil
+}
+
+func (m *MemoryStorage) SetToDeviceUnackedPosition(userID, deviceID string, pos int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{userID, deviceID}
+	positions := m.toDeviceAckPos[key]
+	positions[1] = pos
+	m.toDeviceAckPos[key] = positions
+	return nil
+}
+
+// InsertReceipts stores the receipts in a receipt EDU, returning the receipts which are new.
+func (m *MemoryStorage) InsertReceipts(roomID string, ephEvent json.RawMessage) ([]internal.Receipt, error) {
+	readReceipts, privateReceipts, err := UnpackReceiptsFromEDU(roomID, ephEvent)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var newReceipts []internal.Receipt
+	for i, receipts := range [][]internal.Receipt{readReceipts, privateReceipts} {
+		roomReceipts := m.receipts[i][roomID]
+		if roomReceipts == nil {
+			roomReceipts = make(map[[2]string]internal.Receipt)
+			m.receipts[i][roomID] = roomReceipts
+		}
+		for _, r := range receipts {
+			key := [2]string{r.UserID, r.ThreadID}
+			if old, ok := roomReceipts[key]; ok && (old.EventID == r.EventID || old.TS > r.TS) {
+				continue
+			}
+			roomReceipts[key] = r
+			newReceipts = append(newReceipts, r)
+		}
+	}
+	return newReceipts, nil
+}
+
+// ReceiptsForEvents returns the non-private receipts for the events in the room.
+func (m *MemoryStorage) ReceiptsForEvents(roomID string, eventIDs []string) ([]internal.Receipt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var receipts []internal.Receipt
+	for _, r := range m.receipts[0][roomID] {
+		if slices.Contains(eventIDs, r.EventID) {
+			receipts = append(receipts, r)
+		}
+	}
+	return receipts, nil
+}
+
+// ReceiptsForUser returns all (including private) receipts for this user in these rooms.
+func (m *MemoryStorage) ReceiptsForUser(roomIDs []string, userID string) (map[string][]internal.Receipt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	receiptsByRoom := make(map[string][]internal.Receipt)
+	for i := range m.receipts {
+		for _, roomID := range roomIDs {
+			for key, r := range m.receipts[i][roomID] {
+				if key[0] == userID {
+					receiptsByRoom[roomID] = append(receiptsByRoom[roomID], r)
+				}
+			}
+		}
+	}
+	return receiptsByRoom, nil
+}
+
+// deleteDepartedMembersReceipts deletes receipts sent by users who are no longer joined to the room.
+// Returns the number of receipts deleted.
+func (m *MemoryStorage) deleteDepartedMembersReceipts() int64 {
+	var total int64
+	for roomID, room := range m.rooms {
+		row, ok := m.snapshots[room.currentSnapshotID]
+		if !ok {
+			continue
+		}
+		departed := make(map[string]struct{})
+		for _, nid := range row.MembershipEvents {
+			if ev, ok := m.events[nid]; ok && ev.Membership != "join" && ev.Membership != "_join" {
+				departed[ev.StateKey] = struct{}{}
+			}
+		}
+		for i := range m.receipts {
+			for key := range m.receipts[i][roomID] {
+				if hasKey(departed, key[0]) {
+					delete(m.receipts[i][roomID], key)
+					total++
+				}
+			}
+		}
+	}
+	return total
+}
+
+// InsertAuditEntry records the entry, setting its ID.
+func (m *MemoryStorage) InsertAuditEntry(entry *AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.ID = int64(len(m.audit)) + 1
+	m.audit = append(m.audit, *entry)
+	return nil
+}
+
+// SelectAuditEntries returns up to `limit` entries with IDs less than `before`, newest first. If
+// target or action are set, only matching entries are returned. A `before` of 0 starts from the
+// newest entry.
+func (m *MemoryStorage) SelectAuditEntries(target, action string, before int64, limit int) ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []AuditEntry{}
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		entry := m.audit[i]
+		if (target != "" && entry.Target != target) || (action != "" && entry.Action != action) || (before != 0 && entry.ID >= before) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// SaveConnection stores the sticky request of this connection, replacing any earlier one.
+func (m *MemoryStorage) SaveConnection(userID, deviceID, connID string, request []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections[[3]string{userID, deviceID, connID}] = memoryConnection{
+		request:   slices.Clone(request),
+		updatedTS: m.clock.Now().UnixMilli(),
+	}
+	return nil
+}
+
+// LoadConnection returns the sticky request of this connection if it was stored after `after`, else nil.
+func (m *MemoryStorage) LoadConnection(userID, deviceID, connID string, after time.Time) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conn, ok := m.connections[[3]string{userID, deviceID, connID}]
+	if !ok || conn.updatedTS <= after.UnixMilli() {
+		return nil, nil
+	}
+	return slices.Clone(conn.request), nil
+}
+
+func (m *MemoryStorage) DeleteConnection(userID, deviceID, connID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.connections, [3]string{userID, deviceID, connID})
+	return nil
+}
+
+// removeInaccessibleStateSnapshots behaves like Storage.RemoveInaccessibleStateSnapshots.
+func (m *MemoryStorage) removeInaccessibleStateSnapshots() int {
+	numToKeep := m.MaxTimelineLimit + 1
+	roomToSnapshotIDs := make(map[string][]int64)
+	for snapshotID, row := range m.snapshots {
+		roomToSnapshotIDs[row.RoomID] = append(roomToSnapshotIDs[row.RoomID], snapshotID)
+	}
+	numDeleted := 0
+	for _, snapshotIDs := range roomToSnapshotIDs {
+		if len(snapshotIDs) <= numToKeep {
+			continue
+		}
+		slices.Sort(snapshotIDs)
+		for _, snapshotID := range snapshotIDs[:len(snapshotIDs)-numToKeep] {
+			delete(m.snapshots, snapshotID)
+			numDeleted++
+		}
+	}
+	return numDeleted
+}
+
+// clean removes the data which Storage.Cleaner removes.
+func (m *MemoryStorage) clean(boundaryTime time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	boundary := boundaryTime.UnixMilli()
+	for key, row := range m.txns {
+		if row.Timestamp <= boundary {
+			delete(m.txns, key)
+		}
+	}
+	for key, conn := range m.connections {
+		if conn.updatedTS <= boundary {
+			delete(m.connections, key)
+		}
+	}
+	numSnapshots := m.removeInaccessibleStateSnapshots()
+	logger.Info().Int("rows_affected", numSnapshots).Msg("RemoveInaccessibleStateSnapshots: deleted rows")
+	numReceipts := m.deleteDepartedMembersReceipts()
+	logger.Info().Int64("rows_affected", numReceipts).Msg("Cleaner: deleted receipts of departed members")
+}
+
+func (m *MemoryStorage) Cleaner(n time.Duration) {
+Loop:
+	for {
+		select {
+		case <-m.clock.After(n):
+			now := m.clock.Now()
+			boundaryTime := now.Add(-1 * n)
+			if n < time.Hour {
+				boundaryTime = now.Add(-1 * time.Hour)
+			}
+			logger.Info().Time("boundaryTime", boundaryTime).Msg("Cleaner running")
+			m.clean(boundaryTime)
+		case <-m.shutdownCh:
+			break Loop
+		}
+	}
+}
+
+func (m *MemoryStorage) Teardown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.shutdown {
+		m.shutdown = true
+		close(m.shutdownCh)
+	}
+}
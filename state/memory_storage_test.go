@@ -0,0 +1,153 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
+)
+
+func TestMemoryStorageTimeline(t *testing.T) {
+	store := NewMemoryStorage()
+	defer store.Teardown()
+	roomID := "!TestMemoryStorageTimeline:localhost"
+	alice := "@alice_TestMemoryStorageTimeline:localhost"
+	bob := "@bob_TestMemoryStorageTimeline:localhost"
+	eventIDs := func(events []json.RawMessage) (ids []string) {
+		for _, ev := range events {
+			ids = append(ids, gjson.GetBytes(ev, "event_id").Str)
+		}
+		return
+	}
+
+	res, err := store.Initialise(roomID, createInitialEvents(t, alice))
+	assertNoError(t, err)
+	assertValue(t, "res.AddedEvents", res.AddedEvents, true)
+
+	beforeBob := []json.RawMessage{
+		testutils.NewMessageEvent(t, alice, "before bob"),
+		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "The Room"}),
+	}
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: beforeBob, PrevBatch: "batch A"})
+	assertNoError(t, err)
+	afterBob := []json.RawMessage{
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewMessageEvent(t, alice, "after bob"),
+	}
+	accRes, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: afterBob})
+	assertNoError(t, err)
+	assertValue(t, "accRes.NumNew", accRes.NumNew, 2)
+
+	// accumulating the same events again does nothing
+	accRes, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: afterBob})
+	assertNoError(t, err)
+	assertValue(t, "duplicate accRes.NumNew", accRes.NumNew, 0)
+	assertValue(t, "duplicate accRes.NumDuplicates", accRes.NumDuplicates, 2)
+
+	latestNID, err := store.LatestEventNID()
+	assertNoError(t, err)
+
+	// alice sees everything, bob only sees events from when he joined
+	latest, err := store.LatestEventsInRooms(alice, []string{roomID}, latestNID, 10, nil)
+	assertNoError(t, err)
+	assertValue(t, "alice's timeline", eventIDs(latest[roomID].Timeline), eventIDs(append(beforeBob, afterBob...)))
+	assertValue(t, "alice's prev_batch", latest[roomID].PrevBatch, "batch A")
+	latest, err = store.LatestEventsInRooms(bob, []string{roomID}, latestNID, 10, nil)
+	assertNoError(t, err)
+	assertValue(t, "bob's timeline", eventIDs(latest[roomID].Timeline), eventIDs(afterBob))
+
+	joined, err := store.JoinedRoomsAfterPosition(bob, latestNID)
+	assertNoError(t, err)
+	if _, ok := joined[roomID]; !ok {
+		t.Fatalf("JoinedRoomsAfterPosition: bob is not joined to the room: %v", joined)
+	}
+
+	var joinedMembers []string
+	snapshot, err := store.GlobalSnapshot(func(roomID, userID string) {
+		joinedMembers = append(joinedMembers, userID)
+	})
+	assertNoError(t, err)
+	assertValue(t, "joined members", joinedMembers, []string{alice, bob})
+	metadata := snapshot.GlobalMetadata[roomID]
+	assertValue(t, "join count", metadata.JoinCount, 2)
+	assertValue(t, "room name", metadata.NameEvent, "The Room")
+
+	state, err := store.RoomStateAfterEventPosition(context.Background(), []string{roomID}, latestNID, map[string][]string{
+		"m.room.name": nil,
+	})
+	assertNoError(t, err)
+	assertValue(t, "state events", len(state[roomID]), 1)
+	assertValue(t, "state event ID", state[roomID][0].ID, gjson.GetBytes(beforeBob[1], "event_id").Str)
+}
+
+func TestMemoryStorageRedactsState(t *testing.T) {
+	store := NewMemoryStorage()
+	defer store.Teardown()
+	roomID := "!TestMemoryStorageRedactsState:localhost"
+	alice := "@alice_TestMemoryStorageRedactsState:localhost"
+	_, err := store.Initialise(roomID, createInitialEvents(t, alice))
+	assertNoError(t, err)
+	nameEvent := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "The Room"})
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{nameEvent}})
+	assertNoError(t, err)
+
+	redaction, err := json.Marshal(map[string]interface{}{
+		"event_id":         "$redaction_TestMemoryStorageRedactsState",
+		"type":             "m.room.redaction",
+		"sender":           alice,
+		"origin_server_ts": gjson.GetBytes(nameEvent, "origin_server_ts").Int() + 1,
+		"redacts":          gjson.GetBytes(nameEvent, "event_id").Str,
+		"content":          map[string]interface{}{},
+	})
+	assertNoError(t, err)
+	res, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{redaction}})
+	assertNoError(t, err)
+	assertValue(t, "IncludesStateRedaction", res.IncludesStateRedaction, true)
+
+	metadata := internal.NewRoomMetadata(roomID)
+	assertNoError(t, store.ResetMetadataState(metadata))
+	assertValue(t, "room name after redaction", metadata.NameEvent, "")
+}
+
+func TestMemoryStorageToDevice(t *testing.T) {
+	store := NewMemoryStorage()
+	defer store.Teardown()
+	alice := "@alice_TestMemoryStorageToDevice:localhost"
+	deviceID := "ALICE"
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room_key","content":{"i":1}}`),
+		json.RawMessage(`{"type":"m.room_key","content":{"i":2}}`),
+		json.RawMessage(`{"type":"m.room_key","content":{"i":3}}`),
+	}
+	lastPos, err := store.InsertToDeviceMessages(alice, deviceID, msgs)
+	assertNoError(t, err)
+
+	got, upTo, more, err := store.ToDeviceMessagesWithinSize(alice, deviceID, 0, 2, 0)
+	assertNoError(t, err)
+	assertValue(t, "num messages", len(got), 2)
+	assertValue(t, "more", more, true)
+
+	assertNoError(t, store.AckToDeviceMessages(alice, deviceID, upTo))
+	got, upTo, more, err = store.ToDeviceMessagesWithinSize(alice, deviceID, 0, 10, 0)
+	assertNoError(t, err)
+	assertValue(t, "num messages after ack", len(got), 1)
+	assertValue(t, "upTo after ack", upTo, lastPos)
+	assertValue(t, "more after ack", more, false)
+
+	// device list changes move to the sent bucket when swapped
+	assertNoError(t, store.UpsertDeviceData(alice, deviceID, internal.DeviceKeyData{
+		OTKCounts: internal.MapStringInt{"signed_curve25519": 5},
+	}, map[string]int{"@bob:localhost": internal.DeviceListChanged}))
+	dd, err := store.DeviceData(alice, deviceID, true)
+	assertNoError(t, err)
+	assertValue(t, "changed", dd.DeviceListChanged, []string{"@bob:localhost"})
+	assertValue(t, "otk counts", dd.OTKCounts, internal.MapStringInt{"signed_curve25519": 5})
+	dd, err = store.DeviceData(alice, deviceID, false)
+	assertNoError(t, err)
+	assertValue(t, "changed after swap", dd.DeviceListChanged, []string{"@bob:localhost"})
+	assertValue(t, "changed bits after swap", dd.ChangedBits, 0)
+}
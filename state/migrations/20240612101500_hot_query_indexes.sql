@@ -0,0 +1,22 @@
+-- +goose NO TRANSACTION
+
+-- These indexes are built concurrently so large deployments can keep serving traffic whilst the
+-- migration runs. This cannot happen inside a transaction.
+
+-- +goose Up
+-- Membership log scans (SelectEventsWithTypeStateKey) filter on type and state key, then walk a
+-- range of event NIDs. The old (event_type, state_key) index made postgres sort every membership
+-- event a user has ever had.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS syncv3_events_type_sk_nid_idx ON syncv3_events(event_type, state_key, event_nid);
+DROP INDEX CONCURRENTLY IF EXISTS syncv3_events_type_sk_idx;
+
+-- To-device selects and deletes always filter on the user and device, then a range of positions.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS syncv3_to_device_messages_user_device_pos_idx ON syncv3_to_device_messages(user_id, device_id, position);
+DROP INDEX CONCURRENTLY IF EXISTS syncv3_to_device_messages_device_idx;
+
+-- +goose Down
+CREATE INDEX CONCURRENTLY IF NOT EXISTS syncv3_to_device_messages_device_idx ON syncv3_to_device_messages(device_id);
+DROP INDEX CONCURRENTLY IF EXISTS syncv3_to_device_messages_user_device_pos_idx;
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS syncv3_events_type_sk_idx ON syncv3_events(event_type, state_key);
+DROP INDEX CONCURRENTLY IF EXISTS syncv3_events_type_sk_nid_idx;
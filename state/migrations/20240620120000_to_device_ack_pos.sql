@@ -0,0 +1,7 @@
+-- +goose Up
+-- Track the highest position each device has acknowledged, so to-device messages are only deleted
+-- once a device has confirmed it received them.
+ALTER TABLE IF EXISTS syncv3_to_device_ack_pos ADD COLUMN IF NOT EXISTS ack_pos BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_to_device_ack_pos DROP COLUMN IF EXISTS ack_pos;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- Identify identical to-device messages so they are only stored once per device. Existing messages
+-- get an empty hash, so are never treated as duplicates.
+ALTER TABLE IF EXISTS syncv3_to_device_messages ADD COLUMN IF NOT EXISTS content_hash TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_hash_idx ON syncv3_to_device_messages(user_id, device_id, content_hash);
+
+-- +goose Down
+DROP INDEX IF EXISTS syncv3_to_device_messages_hash_idx;
+ALTER TABLE IF EXISTS syncv3_to_device_messages DROP COLUMN IF EXISTS content_hash;
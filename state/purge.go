@@ -0,0 +1,104 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// PurgeCount is the number of rows removed from a single table by a purge.
+type PurgeCount struct {
+	Table string
+	Rows  int64
+}
+
+type purgeQuery struct {
+	table string
+	where string
+}
+
+// Queries to remove all data about a room. Receipts, typing and account data for the room are
+// removed for all users.
+var purgeRoomQueries = []purgeQuery{
+	{"syncv3_events", "room_id = $1"},
+	{"syncv3_snapshots", "room_id = $1"},
+	{"syncv3_rooms", "room_id = $1"},
+	{"syncv3_invites", "room_id = $1"},
+	{"syncv3_unread", "room_id = $1"},
+	{"syncv3_spaces", "parent = $1 OR child = $1"},
+	{"syncv3_typing", "room_id = $1"},
+	{"syncv3_receipts", "room_id = $1"},
+	{"syncv3_receipts_private", "room_id = $1"},
+	{"syncv3_account_data", "room_id = $1"},
+	{"syncv3_backfills", "room_id = $1"},
+}
+
+// Queries to remove all data which belongs to a user. Data the user has contributed to rooms, such as
+// events and public receipts, is left alone as other users can see it.
+var purgeUserQueries = []purgeQuery{
+	{"syncv3_sync2_tokens", "user_id = $1"},
+	{"syncv3_sync2_devices", "user_id = $1"},
+	{"syncv3_to_device_messages", "user_id = $1"},
+	{"syncv3_to_device_ack_pos", "user_id = $1"},
+	{"syncv3_device_data", "user_id = $1"},
+	{"syncv3_device_list_updates", "user_id = $1"},
+	{"syncv3_account_data", "user_id = $1"},
+	{"syncv3_invites", "user_id = $1"},
+	{"syncv3_unread", "user_id = $1"},
+	{"syncv3_txns", "user_id = $1"},
+	{"syncv3_receipts_private", "user_id = $1"},
+	{"syncv3_backfills", "user_id = $1"},
+	{"syncv3_connections", "user_id = $1"},
+}
+
+var errPurgeDryRun = errors.New("dry run")
+
+// PurgeRoom removes everything the proxy has stored about the given room, returning the number of rows
+// removed from each table. If dryRun is true, the deletions are rolled back so only the counts are
+// returned.
+//
+// This only touches the database: running proxy processes will keep the room in their in-memory caches
+// until they are restarted, and will store it again if any poller sees it in a sync v2 response.
+func (s *Storage) PurgeRoom(roomID string, dryRun bool) ([]PurgeCount, error) {
+	return s.purge(purgeRoomQueries, roomID, dryRun)
+}
+
+// PurgeUser removes everything the proxy has stored which belongs to the given user, including their
+// access tokens and devices, returning the number of rows removed from each table. If dryRun is true,
+// the deletions are rolled back so only the counts are returned.
+//
+// As with PurgeRoom, this only touches the database: running proxy processes will keep polling on behalf
+// of the user until they are restarted.
+func (s *Storage) PurgeUser(userID string, dryRun bool) ([]PurgeCount, error) {
+	return s.purge(purgeUserQueries, userID, dryRun)
+}
+
+func (s *Storage) purge(queries []purgeQuery, arg string, dryRun bool) (counts []PurgeCount, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		for _, q := range queries {
+			res, err := txn.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s`, q.table, q.where), arg)
+			if err != nil {
+				return fmt.Errorf("failed to purge %s: %w", q.table, err)
+			}
+			rows, err := res.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("failed to count rows purged from %s: %w", q.table, err)
+			}
+			counts = append(counts, PurgeCount{Table: q.table, Rows: rows})
+		}
+		if dryRun {
+			// roll back the transaction, we only want the counts
+			return errPurgeDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errPurgeDryRun) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -0,0 +1,119 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func purgedRows(counts []PurgeCount, table string) int64 {
+	for _, c := range counts {
+		if c.Table == table {
+			return c.Rows
+		}
+	}
+	return -1
+}
+
+func TestStoragePurgeRoom(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStoragePurgeRoom:localhost"
+	otherRoomID := "!TestStoragePurgeRoom_other:localhost"
+	for _, r := range []string{roomID, otherRoomID} {
+		mustPersistEvents(t, r, store, persistOpts{
+			withInitialEvents: true,
+			numTimelineEvents: 5,
+		})
+	}
+	mustNotError(t, store.InvitesTable.InsertInvite("@purge-invitee:localhost", roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.member", "@purge-invitee:localhost", userID, map[string]interface{}{"membership": "invite"}),
+	}))
+
+	// a dry run reports what would be removed, but doesn't remove it
+	counts, err := store.PurgeRoom(roomID, true)
+	mustNotError(t, err)
+	if got := purgedRows(counts, "syncv3_events"); got != 9 { // 4 initial events + 5 timeline events
+		t.Errorf("dry run: got %d events, want 9", got)
+	}
+	if got := purgedRows(counts, "syncv3_rooms"); got != 1 {
+		t.Errorf("dry run: got %d rooms, want 1", got)
+	}
+	if got := purgedRows(counts, "syncv3_invites"); got != 1 {
+		t.Errorf("dry run: got %d invites, want 1", got)
+	}
+	mustHaveNumEvents(t, store.DB, roomID, 9)
+
+	// now do it for real
+	realCounts, err := store.PurgeRoom(roomID, false)
+	mustNotError(t, err)
+	assertValue(t, "dry run counts", counts, realCounts)
+	mustHaveNumEvents(t, store.DB, roomID, 0)
+	mustHaveNumSnapshots(t, store.DB, roomID, 0)
+	// the other room is untouched
+	mustHaveNumEvents(t, store.DB, otherRoomID, 9)
+
+	// purging again does nothing
+	counts, err = store.PurgeRoom(roomID, false)
+	mustNotError(t, err)
+	for _, c := range counts {
+		if c.Rows != 0 {
+			t.Errorf("purging twice: removed %d rows from %s", c.Rows, c.Table)
+		}
+	}
+}
+
+func TestStoragePurgeUser(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	// make sure the sync2 tables exist
+	v2Store := sync2.NewStore(postgresConnectionString, "secret")
+	defer v2Store.Teardown()
+	alice := "@TestStoragePurgeUser_alice:localhost"
+	bob := "@TestStoragePurgeUser_bob:localhost"
+	for _, u := range []string{alice, bob} {
+		mustNotError(t, sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+			if err := v2Store.DevicesTable.InsertDevice(txn, u, "DEVICE"); err != nil {
+				return err
+			}
+			_, err := v2Store.TokensTable.Insert(txn, "token_"+u, u, "DEVICE", time.Now())
+			return err
+		}))
+		_, err := store.ToDeviceTable.InsertMessages(u, "DEVICE", []json.RawMessage{
+			json.RawMessage(`{"type":"m.room_key_request","sender":"@someone:localhost","content":{}}`),
+		})
+		mustNotError(t, err)
+	}
+
+	counts, err := store.PurgeUser(alice, false)
+	mustNotError(t, err)
+	for _, table := range []string{"syncv3_sync2_devices", "syncv3_sync2_tokens", "syncv3_to_device_messages"} {
+		if got := purgedRows(counts, table); got != 1 {
+			t.Errorf("got %d rows purged from %s, want 1", got, table)
+		}
+	}
+	// bob is untouched
+	token, err := v2Store.TokensTable.Token("token_" + bob)
+	mustNotError(t, err)
+	assertValue(t, "bob's user ID", token.UserID, bob)
+	_, err = v2Store.TokensTable.Token("token_" + alice)
+	if err == nil {
+		t.Errorf("alice's token still exists after purge")
+	}
+}
+
+func mustHaveNumEvents(t *testing.T, db *sqlx.DB, roomID string, numEvents int) {
+	t.Helper()
+	var count int
+	if err := db.QueryRow(`SELECT count(*) FROM syncv3_events WHERE room_id=$1`, roomID).Scan(&count); err != nil {
+		t.Fatalf("failed to count events: %s", err)
+	}
+	if count != numEvents {
+		t.Fatalf("mustHaveNumEvents: got %d want %d", count, numEvents)
+	}
+}
@@ -125,6 +125,66 @@ func (t *ReceiptTable) SelectReceiptsForUser(roomIDs []string, userID string) (r
 	return receiptsByRoom, nil
 }
 
+// departedMembersBatchSize is the number of rooms whose departed members' receipts are deleted in
+// one statement, so the cleanup doesn't hold locks on the whole receipts tables at once.
+const departedMembersBatchSize = 500
+
+// DeleteDepartedMembers deletes receipts sent by users who are no longer joined to the room, so the
+// tables only hold receipts for current members. Rooms are cleaned up in batches of
+// departedMembersBatchSize. Returns the number of receipts deleted.
+func (t *ReceiptTable) DeleteDepartedMembers() (int64, error) {
+	var total int64
+	lastRoomID := ""
+	for {
+		var roomIDs []string
+		err := t.db.Select(
+			&roomIDs, `SELECT room_id FROM syncv3_rooms WHERE room_id > $1 ORDER BY room_id LIMIT $2`,
+			lastRoomID, departedMembersBatchSize,
+		)
+		if err != nil {
+			return total, fmt.Errorf("failed to select rooms: %s", err)
+		}
+		if len(roomIDs) == 0 {
+			return total, nil
+		}
+		lastRoomID = roomIDs[len(roomIDs)-1]
+		n, err := t.deleteDepartedMembersInRooms(roomIDs)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if len(roomIDs) < departedMembersBatchSize {
+			return total, nil
+		}
+	}
+}
+
+func (t *ReceiptTable) deleteDepartedMembersInRooms(roomIDs []string) (int64, error) {
+	var total int64
+	for _, tableName := range []string{"syncv3_receipts", "syncv3_receipts_private"} {
+		result, err := t.db.Exec(`
+		WITH departed AS (
+			SELECT syncv3_events.room_id, syncv3_events.state_key AS user_id
+			FROM syncv3_rooms
+			JOIN syncv3_snapshots ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id
+			JOIN syncv3_events ON syncv3_events.event_nid = ANY(syncv3_snapshots.membership_events)
+			WHERE syncv3_rooms.room_id = ANY($1) AND syncv3_events.membership NOT IN ('join', '_join')
+		)
+		DELETE FROM `+tableName+` USING departed
+		WHERE `+tableName+`.room_id = departed.room_id AND `+tableName+`.user_id = departed.user_id`,
+			pq.StringArray(roomIDs),
+		)
+		if err != nil {
+			return total, fmt.Errorf("failed to delete receipts from %s: %s", tableName, err)
+		}
+		n, err := result.RowsAffected()
+		if err == nil {
+			total += n
+		}
+	}
+	return total, nil
+}
+
 func (t *ReceiptTable) bulkInsert(tableName string, txn *sqlx.Tx, receipts []internal.Receipt) (newReceipts []internal.Receipt, err error) {
 	if len(receipts) == 0 {
 		return
@@ -138,7 +198,7 @@ func (t *ReceiptTable) bulkInsert(tableName string, txn *sqlx.Tx, receipts []int
 	for _, chunk := range chunks {
 		rows, err := txn.NamedQuery(`
 			INSERT INTO `+tableName+` AS old (room_id, event_id, user_id, ts, thread_id)
-			VALUES (:room_id, :event_id, :user_id, :ts, :thread_id) ON CONFLICT (room_id, user_id, thread_id) DO UPDATE SET event_id=excluded.event_id, ts=excluded.ts WHERE old.event_id <> excluded.event_id
+			VALUES (:room_id, :event_id, :user_id, :ts, :thread_id) ON CONFLICT (room_id, user_id, thread_id) DO UPDATE SET event_id=excluded.event_id, ts=excluded.ts WHERE old.event_id <> excluded.event_id AND old.ts <= excluded.ts
 			RETURNING room_id, user_id, thread_id, event_id, ts`, chunk)
 		if err != nil {
 			return nil, err
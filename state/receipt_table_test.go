@@ -325,6 +325,22 @@ func TestReceiptTable(t *testing.T) {
 		},
 	})
 
+	// older receipt for user -> no delta, the newer receipt is kept
+	newReceipts, err = table.Insert(roomA, json.RawMessage(`{
+			"content": {
+			  "$bbbbbbbb:matrix.org": {
+				"m.read": {
+				  "@rikj:jki.re": {
+					"ts": 1436400000000
+				  }
+				}
+			  }
+			},
+			"type": "m.receipt"
+		  }`))
+	assertNoError(t, err)
+	parsedReceiptsEqual(t, newReceipts, nil)
+
 	// selecting multiple receipts
 	table.Insert(roomA, json.RawMessage(`{
 		"content": {
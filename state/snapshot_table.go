@@ -2,9 +2,11 @@ package state
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
 type SnapshotRow struct {
@@ -17,7 +19,8 @@ type SnapshotRow struct {
 // SnapshotTable stores room state snapshots. Each snapshot has a unique numeric ID.
 // Not every event will be associated with a snapshot.
 type SnapshotTable struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	metrics sqlutil.TableMetrics
 }
 
 func NewSnapshotsTable(db *sqlx.DB) *SnapshotTable {
@@ -32,10 +35,11 @@ func NewSnapshotsTable(db *sqlx.DB) *SnapshotTable {
 		UNIQUE(snapshot_id, room_id)
 	);
 	`)
-	return &SnapshotTable{db}
+	return &SnapshotTable{db: db, metrics: sqlutil.NewTableMetrics("snapshots")}
 }
 
 func (t *SnapshotTable) CurrentSnapshots(txn *sqlx.Tx) (map[string][]int64, error) {
+	defer t.metrics.Observe("CurrentSnapshots", time.Now())
 	rows, err := txn.Query(
 		`SELECT syncv3_rooms.room_id, events, membership_events FROM syncv3_snapshots JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id`,
 	)
@@ -58,6 +62,7 @@ func (t *SnapshotTable) CurrentSnapshots(txn *sqlx.Tx) (map[string][]int64, erro
 
 // Select a row based on its snapshot ID.
 func (s *SnapshotTable) Select(txn *sqlx.Tx, snapshotID int64) (row SnapshotRow, err error) {
+	defer s.metrics.Observe("Select", time.Now())
 	if snapshotID == 0 {
 		err = fmt.Errorf("SnapshotTable.Select: snapshot ID requested is 0")
 		return
@@ -66,8 +71,19 @@ func (s *SnapshotTable) Select(txn *sqlx.Tx, snapshotID int64) (row SnapshotRow,
 	return
 }
 
+// SelectEarliestContaining returns the ID of the room's oldest snapshot which contains the event.
+func (s *SnapshotTable) SelectEarliestContaining(txn *sqlx.Tx, roomID string, eventNID int64) (snapshotID int64, err error) {
+	defer s.metrics.Observe("SelectEarliestContaining", time.Now())
+	err = txn.QueryRow(
+		`SELECT snapshot_id FROM syncv3_snapshots WHERE room_id = $1 AND ($2 = ANY(events) OR $2 = ANY(membership_events))
+		ORDER BY snapshot_id ASC LIMIT 1`, roomID, eventNID,
+	).Scan(&snapshotID)
+	return
+}
+
 // Insert the row. Modifies SnapshotID to be the inserted primary key.
 func (s *SnapshotTable) Insert(txn *sqlx.Tx, row *SnapshotRow) error {
+	defer s.metrics.Observe("Insert", time.Now())
 	var id int64
 	if row.MembershipEvents == nil {
 		row.MembershipEvents = []int64{}
@@ -85,6 +101,7 @@ func (s *SnapshotTable) Insert(txn *sqlx.Tx, row *SnapshotRow) error {
 
 // Delete the snapshot IDs given
 func (s *SnapshotTable) Delete(txn *sqlx.Tx, snapshotIDs []int64) error {
+	defer s.metrics.Observe("Delete", time.Now())
 	query, args, err := sqlx.In(`DELETE FROM syncv3_snapshots WHERE snapshot_id = ANY(?)`, pq.Int64Array(snapshotIDs))
 	if err != nil {
 		return err
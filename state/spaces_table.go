@@ -26,6 +26,25 @@ func (sr *SpaceRelation) Key() string {
 	return fmt.Sprintf("%s-%s-%d", sr.Parent, sr.Child, sr.Relation)
 }
 
+// HasValidVia returns true if the content of an m.space.child or m.space.parent event has a valid
+// via field: a non-empty array of server names. Relations without one are treated as removed.
+func HasValidVia(content gjson.Result) bool {
+	via := content.Get("via")
+	if !via.IsArray() {
+		return false
+	}
+	servers := via.Array()
+	if len(servers) == 0 {
+		return false
+	}
+	for _, server := range servers {
+		if server.Type != gjson.String || server.Str == "" {
+			return false
+		}
+	}
+	return true
+}
+
 // Returns a space relation from a compatible event, else nil.
 func NewSpaceRelationFromEvent(ev Event) (sr *SpaceRelation, isDeleted bool) {
 	event := gjson.ParseBytes(ev.JSON)
@@ -40,14 +59,14 @@ func NewSpaceRelationFromEvent(ev Event) (sr *SpaceRelation, isDeleted bool) {
 			Relation:    RelationMSpaceChild,
 			Ordering:    event.Get("content.ordering").Str,
 			IsSuggested: event.Get("content.suggested").Bool(),
-		}, !event.Get("content.via").IsArray()
+		}, !HasValidVia(event.Get("content"))
 	case "m.space.parent":
 		return &SpaceRelation{
 			Parent:   ev.StateKey,
 			Child:    ev.RoomID,
 			Relation: RelationMSpaceParent,
 			// parent events have a Canonical field but we don't care?
-		}, !event.Get("content.via").IsArray()
+		}, !HasValidVia(event.Get("content"))
 	default:
 		return nil, false
 	}
@@ -119,7 +138,36 @@ func (t *SpacesTable) SelectChildren(txn *sqlx.Tx, spaces []string) (map[string]
 	return result, nil
 }
 
+// Select all relations where these rooms are the child, from either side of the relation
+func (t *SpacesTable) SelectParents(txn *sqlx.Tx, rooms []string) (map[string][]SpaceRelation, error) {
+	result := make(map[string][]SpaceRelation)
+	var data []SpaceRelation
+	err := txn.Select(&data, `SELECT parent, child, relation, ordering, suggested FROM syncv3_spaces WHERE child = ANY($1)`, pq.StringArray(rooms))
+	if err != nil {
+		return nil, err
+	}
+	// bucket by child
+	for _, d := range data {
+		result[d.Child] = append(result[d.Child], d)
+	}
+	return result, nil
+}
+
 func (t *SpacesTable) HandleSpaceUpdates(txn *sqlx.Tx, events []Event) error {
+	added, removed := spaceRelationUpdates(events)
+	// update the database
+	if err := t.BulkInsert(txn, added); err != nil {
+		return fmt.Errorf("failed to BulkInsert: %s", err)
+	}
+	if err := t.BulkDelete(txn, removed); err != nil {
+		return fmt.Errorf("failed to BulkDelete: %s", err)
+	}
+
+	return nil
+}
+
+// spaceRelationUpdates returns the space relations which the events add or remove.
+func spaceRelationUpdates(events []Event) (added, removed []SpaceRelation) {
 	// pull out relations, and bucket them so the last event wins to ensure we always use the latest
 	// values in case someone repeatedly adds/removes the same space
 	relations := make(map[string]struct {
@@ -140,7 +188,6 @@ func (t *SpacesTable) HandleSpaceUpdates(txn *sqlx.Tx, events []Event) error {
 	}
 
 	// now bucket by add/remove for bulk operations
-	var added, removed []SpaceRelation
 	for _, r := range relations {
 		if r.isDeleted {
 			removed = append(removed, *r.relation)
@@ -148,15 +195,7 @@ func (t *SpacesTable) HandleSpaceUpdates(txn *sqlx.Tx, events []Event) error {
 			added = append(added, *r.relation)
 		}
 	}
-	// update the database
-	if err := t.BulkInsert(txn, added); err != nil {
-		return fmt.Errorf("failed to BulkInsert: %s", err)
-	}
-	if err := t.BulkDelete(txn, removed); err != nil {
-		return fmt.Errorf("failed to BulkDelete: %s", err)
-	}
-
-	return nil
+	return added, removed
 }
 
 type SpaceRelationChunker []SpaceRelation
@@ -90,6 +90,25 @@ func TestSpacesTable(t *testing.T) {
 	}
 	matchAnyOrder(t, children, []SpaceRelation{s1, s2})
 
+	// select from the child's side
+	s3 := SpaceRelation{
+		Parent:   parent,
+		Child:    child1,
+		Relation: RelationMSpaceParent,
+	}
+	if err := table.BulkInsert(txn, []SpaceRelation{s3}); err != nil {
+		t.Fatalf("BulkInsert: %s", err)
+	}
+	result, err = table.SelectParents(txn, []string{child1, child2})
+	if err != nil {
+		t.Fatalf("SelectParents: %s", err)
+	}
+	matchAnyOrder(t, result[child1], []SpaceRelation{s1, s3})
+	matchAnyOrder(t, result[child2], []SpaceRelation{s2})
+	if err = table.BulkDelete(txn, []SpaceRelation{s3}); err != nil {
+		t.Fatalf("BulkDelete: %s", err)
+	}
+
 	// basic delete
 	if err = table.BulkDelete(txn, []SpaceRelation{s1, s2}); err != nil {
 		t.Fatalf("BulkDelete: %s", err)
@@ -171,6 +190,36 @@ func TestNewSpaceRelationFromEvent(t *testing.T) {
 				Relation: RelationMSpaceChild,
 			},
 		},
+		// child: empty via
+		{
+			event: Event{
+				Type:     "m.space.child",
+				StateKey: "!child",
+				RoomID:   "!parent",
+				JSON:     json.RawMessage(`{"type":"m.space.child","state_key":"!child","room_id":"!parent","content":{"via":[]}}`),
+			},
+			wantDeleted: true,
+			wantRelation: &SpaceRelation{
+				Parent:   "!parent",
+				Child:    "!child",
+				Relation: RelationMSpaceChild,
+			},
+		},
+		// child: via which isn't a list of server names
+		{
+			event: Event{
+				Type:     "m.space.child",
+				StateKey: "!child",
+				RoomID:   "!parent",
+				JSON:     json.RawMessage(`{"type":"m.space.child","state_key":"!child","room_id":"!parent","content":{"via":["example.com",42,""]}}`),
+			},
+			wantDeleted: true,
+			wantRelation: &SpaceRelation{
+				Parent:   "!parent",
+				Child:    "!child",
+				Relation: RelationMSpaceChild,
+			},
+		},
 		// child: not a state event
 		{
 			event: Event{
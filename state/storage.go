@@ -2,9 +2,9 @@ package state
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
@@ -18,24 +18,25 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sqlutil"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger()
 
 // Max number of parameters in a single SQL command
 const MaxPostgresParameters = 65535
 
-// StartupSnapshot represents a snapshot of startup data for the sliding sync HTTP API instances
+// StartupSnapshot represents a snapshot of startup data for the sliding sync HTTP API instances.
+// Joined members are not included as there can be millions of them: they are streamed to the
+// caller of GlobalSnapshot instead.
 type StartupSnapshot struct {
-	GlobalMetadata   map[string]internal.RoomMetadata // room_id -> metadata
-	AllJoinedMembers map[string][]string              // room_id -> [user_id]
+	GlobalMetadata map[string]internal.RoomMetadata // room_id -> metadata
 }
 
+// JoinedMemberFunc is called once for each joined member of each room when loading a snapshot.
+// Members of a room are provided in the order they joined.
+type JoinedMemberFunc func(roomID, userID string)
+
 type LatestEvents struct {
 	Timeline  []json.RawMessage
 	PrevBatch string
@@ -68,10 +69,16 @@ type Storage struct {
 	TransactionsTable *TransactionsTable
 	DeviceDataTable   *DeviceDataTable
 	ReceiptTable      *ReceiptTable
+	AuditTable        *AuditTable
+	BackfillTable     *BackfillTable
+	ConnectionsTable  *ConnectionsTable
 	DB                *sqlx.DB
 	MaxTimelineLimit  int
+	clock             internal.Clock
 	shutdownCh        chan struct{}
 	shutdown          bool
+	// unregisters DB metrics, if they were registered
+	unregisterMetrics func()
 }
 
 func NewStorage(postgresURI string) *Storage {
@@ -95,7 +102,7 @@ func NewStorageWithDB(db *sqlx.DB, addPrometheusMetrics bool) *Storage {
 		entityName:    "server",
 	}
 
-	return &Storage{
+	s := &Storage{
 		Accumulator:       acc,
 		ToDeviceTable:     NewToDeviceTable(db),
 		UnreadTable:       NewUnreadTable(db),
@@ -105,10 +112,18 @@ func NewStorageWithDB(db *sqlx.DB, addPrometheusMetrics bool) *Storage {
 		TransactionsTable: NewTransactionsTable(db),
 		DeviceDataTable:   NewDeviceDataTable(db),
 		ReceiptTable:      NewReceiptTable(db),
+		AuditTable:        NewAuditTable(db),
+		BackfillTable:     NewBackfillTable(db),
+		ConnectionsTable:  NewConnectionsTable(db),
 		DB:                db,
 		MaxTimelineLimit:  50,
+		clock:             internal.RealClock,
 		shutdownCh:        make(chan struct{}),
 	}
+	if addPrometheusMetrics {
+		s.unregisterMetrics = sqlutil.RegisterPrometheusMetrics(db)
+	}
+	return s
 }
 
 func (s *Storage) LatestEventNID() (int64, error) {
@@ -176,8 +191,8 @@ func (s *Storage) PrepareSnapshot(txn *sqlx.Tx) (tableName string, err error) {
 
 // GlobalSnapshot snapshots the entire database for the purposes of initialising
 // a sliding sync instance. It will atomically grab metadata for all rooms and all joined members
-// in a single transaction.
-func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
+// in a single transaction. Joined members are passed to onJoinedMember as they are read.
+func (s *Storage) GlobalSnapshot(onJoinedMember JoinedMemberFunc) (ss StartupSnapshot, err error) {
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
 		tempTableName, err := s.PrepareSnapshot(txn)
 		if err != nil {
@@ -186,7 +201,7 @@ func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
 			return err
 		}
 		var metadata map[string]internal.RoomMetadata
-		ss.AllJoinedMembers, metadata, err = s.AllJoinedMembers(txn, tempTableName)
+		metadata, err = s.AllJoinedMembers(txn, tempTableName, onJoinedMember)
 		if err != nil {
 			err = fmt.Errorf("GlobalSnapshot: failed to call AllJoinedMembers: %w", err)
 			sentry.CaptureException(err)
@@ -329,7 +344,13 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 	if err != nil {
 		return fmt.Errorf("ResetMetadataState[%s]: %w", metadata.RoomID, err)
 	}
+	resetMetadataFromState(metadata, events)
+	return nil
+}
 
+// resetMetadataFromState updates the metadata in-place from the room's current name, avatar,
+// canonical alias, encryption and joined or invited membership events, in ascending NID order.
+func resetMetadataFromState(metadata *internal.RoomMetadata, events []Event) {
 	heroMemberships := circularSlice[*Event]{max: 6}
 	metadata.JoinCount = 0
 	metadata.InviteCount = 0
@@ -358,7 +379,9 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 				metadata.InviteCount++
 			}
 		case "m.space.child":
-			metadata.ChildSpaceRooms[ev.StateKey] = struct{}{}
+			if HasValidVia(gjson.GetBytes(ev.JSON, "content")) {
+				metadata.ChildSpaceRooms[ev.StateKey] = struct{}{}
+			}
 		}
 	}
 
@@ -377,7 +400,6 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 	// These shouldn't be changing during a room's lifetime in normal operation.
 
 	// We haven't updated LatestEventsByType because that's not part of the timeline.
-	return nil
 }
 
 // FetchMemberships looks up the latest snapshot for the given room and determines the
@@ -476,18 +498,16 @@ func (s *Storage) Initialise(roomID string, state []json.RawMessage) (Initialise
 	return s.Accumulator.Initialise(roomID, state)
 }
 
-// EventNIDs fetches the raw JSON form of events given a slice of eventNIDs. The events
+// EventNIDs loads the given events, parsing out their commonly used fields. The events
 // are returned in ascending NID order; the order of eventNIDs is ignored.
-func (s *Storage) EventNIDs(eventNIDs []int64) ([]json.RawMessage, error) {
-	// TODO: this selects a bunch of rows from the DB, but we only use the raw JSON
-	// itself.
+func (s *Storage) EventNIDs(eventNIDs []int64) ([]*internal.Event, error) {
 	events, err := s.EventsTable.SelectByNIDs(nil, true, eventNIDs)
 	if err != nil {
 		return nil, err
 	}
-	e := make([]json.RawMessage, len(events))
+	e := make([]*internal.Event, len(events))
 	for i := range events {
-		e[i] = events[i].JSON
+		e[i] = internal.NewEvent(events[i].JSON)
 	}
 	return e, nil
 }
@@ -511,6 +531,179 @@ func (s *Storage) StateSnapshot(snapID int64) (state []json.RawMessage, err erro
 	return
 }
 
+// rollForward applies the event to the state event NIDs from its before snapshot, giving the state
+// after the event.
+func rollForward(stateEventNIDs []int64, ev Event) []int64 {
+	if !gjson.ParseBytes(ev.JSON).Get("state_key").Exists() {
+		return stateEventNIDs
+	}
+	if ev.ReplacesNID != 0 {
+		// we determined at insert time of this event that this event replaces a nid in the snapshot.
+		// find it and replace it
+		for j := range stateEventNIDs {
+			if stateEventNIDs[j] == ev.ReplacesNID {
+				stateEventNIDs[j] = ev.NID
+				break
+			}
+		}
+		return stateEventNIDs
+	}
+	// the event is still state, but it doesn't replace anything, so just add it onto the snapshot,
+	// but only if we haven't already
+	for _, nid := range stateEventNIDs {
+		if nid == ev.NID {
+			return stateEventNIDs
+		}
+	}
+	return append(stateEventNIDs, ev.NID)
+}
+
+// StateAtSnapshot returns the room and the state events in a snapshot. Returns sql.ErrNoRows if there
+// is no such snapshot.
+func (s *Storage) StateAtSnapshot(snapshotID int64) (roomID string, events []Event, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		snapshotRow, err := s.Accumulator.snapshotTable.Select(txn, snapshotID)
+		if err != nil {
+			return err
+		}
+		roomID = snapshotRow.RoomID
+		events, err = s.EventsTable.SelectByNIDs(txn, true, append(snapshotRow.MembershipEvents, snapshotRow.OtherEvents...))
+		return err
+	})
+	return
+}
+
+// StateAfterEvent returns the room state after the event with this NID, along with the snapshot the
+// state was built from. Returns sql.ErrNoRows if there is no such event, or the event isn't part of
+// any snapshot e.g because it was backfilled.
+func (s *Storage) StateAfterEvent(eventNID int64) (roomID string, snapshotID int64, events []Event, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		evs, err := s.EventsTable.SelectByNIDs(txn, false, []int64{eventNID})
+		if err != nil {
+			return err
+		}
+		if len(evs) == 0 {
+			return sql.ErrNoRows
+		}
+		ev := evs[0]
+		roomID = ev.RoomID
+		snapshotID = ev.BeforeStateSnapshotID
+		if snapshotID == 0 {
+			// the event was in the state block of a v2 response, so the snapshot made from that block
+			// is the earliest state we know about which includes it
+			snapshotID, err = s.Accumulator.snapshotTable.SelectEarliestContaining(txn, roomID, eventNID)
+			if err != nil {
+				return err
+			}
+		}
+		snapshotRow, err := s.Accumulator.snapshotTable.Select(txn, snapshotID)
+		if err != nil {
+			return err
+		}
+		stateEventNIDs := append(snapshotRow.MembershipEvents, snapshotRow.OtherEvents...)
+		if ev.BeforeStateSnapshotID != 0 {
+			stateEventNIDs = rollForward(stateEventNIDs, ev)
+		}
+		events, err = s.EventsTable.SelectByNIDs(txn, true, stateEventNIDs)
+		return err
+	})
+	return
+}
+
+// StateDelta is the difference between a room's state at two snapshots.
+type StateDelta struct {
+	// Added are events whose (type, state_key) is only in the newer state.
+	Added []Event
+	// Removed are events whose (type, state_key) is only in the older state.
+	Removed []Event
+	// Replaced are events whose (type, state_key) is in both states but with different events.
+	Replaced []ReplacedStateEvent
+}
+
+// ReplacedStateEvent is a state event which was replaced by another with the same (type, state_key).
+type ReplacedStateEvent struct {
+	Old Event
+	New Event
+}
+
+// StateDiff returns how the room's state changed between two snapshots, which needn't be
+// consecutive. Only the events which differ are loaded, so this is cheaper than loading both
+// snapshots. Events in each part of the delta are in ascending NID order (by New for Replaced).
+// Returns sql.ErrNoRows if either snapshot doesn't exist or isn't in this room.
+func (s *Storage) StateDiff(roomID string, fromSnapshotID, toSnapshotID int64) (delta StateDelta, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		var nidsBySnapshot [2]map[int64]bool
+		for i, snapshotID := range []int64{fromSnapshotID, toSnapshotID} {
+			snapshotRow, err := s.Accumulator.snapshotTable.Select(txn, snapshotID)
+			if err != nil {
+				return err
+			}
+			if snapshotRow.RoomID != roomID {
+				return sql.ErrNoRows
+			}
+			nids := make(map[int64]bool, len(snapshotRow.MembershipEvents)+len(snapshotRow.OtherEvents))
+			for _, nid := range append(snapshotRow.MembershipEvents, snapshotRow.OtherEvents...) {
+				nids[nid] = true
+			}
+			nidsBySnapshot[i] = nids
+		}
+		var changedNIDs []int64
+		for i := range nidsBySnapshot {
+			for nid := range nidsBySnapshot[i] {
+				if !nidsBySnapshot[1-i][nid] {
+					changedNIDs = append(changedNIDs, nid)
+				}
+			}
+		}
+		if len(changedNIDs) == 0 {
+			return nil
+		}
+		changed, err := s.EventsTable.SelectByNIDs(txn, true, changedNIDs)
+		if err != nil {
+			return err
+		}
+		var oldEvents, newEvents []Event
+		for _, ev := range changed {
+			if nidsBySnapshot[0][ev.NID] {
+				oldEvents = append(oldEvents, ev)
+			} else {
+				newEvents = append(newEvents, ev)
+			}
+		}
+		delta = diffStateEvents(oldEvents, newEvents)
+		return nil
+	})
+	return
+}
+
+// diffStateEvents pairs up the state events which are only in the older state with those which are
+// only in the newer state by (type, state_key). Both must be in ascending NID order.
+func diffStateEvents(oldEvents, newEvents []Event) (delta StateDelta) {
+	type stateTuple struct {
+		eventType string
+		stateKey  string
+	}
+	oldByTuple := make(map[stateTuple]Event, len(oldEvents))
+	for _, ev := range oldEvents {
+		oldByTuple[stateTuple{ev.Type, ev.StateKey}] = ev
+	}
+	for _, ev := range newEvents {
+		tuple := stateTuple{ev.Type, ev.StateKey}
+		if old, ok := oldByTuple[tuple]; ok {
+			delta.Replaced = append(delta.Replaced, ReplacedStateEvent{Old: old, New: ev})
+			delete(oldByTuple, tuple)
+		} else {
+			delta.Added = append(delta.Added, ev)
+		}
+	}
+	for _, ev := range oldEvents {
+		if _, ok := oldByTuple[stateTuple{ev.Type, ev.StateKey}]; ok {
+			delta.Removed = append(delta.Removed, ev)
+		}
+	}
+	return delta
+}
+
 // Look up room state after the given event position and no further. eventTypesToStateKeys is a map of event type to a list of state keys for that event type.
 // If the list of state keys is empty then all events matching that event type will be returned. If the map is empty entirely, then all room state
 // will be returned.
@@ -572,33 +765,7 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 				if err != nil {
 					return err
 				}
-				allStateEventNIDs := append(snapshotRow.MembershipEvents, snapshotRow.OtherEvents...)
-				// we need to roll forward if this event is state
-				if gjson.ParseBytes(ev.JSON).Get("state_key").Exists() {
-					if ev.ReplacesNID != 0 {
-						// we determined at insert time of this event that this event replaces a nid in the snapshot.
-						// find it and replace it
-						for j := range allStateEventNIDs {
-							if allStateEventNIDs[j] == ev.ReplacesNID {
-								allStateEventNIDs[j] = ev.NID
-								break
-							}
-						}
-					} else {
-						// the event is still state, but it doesn't replace anything, so just add it onto the snapshot,
-						// but only if we haven't already
-						alreadyExists := false
-						for _, nid := range allStateEventNIDs {
-							if nid == ev.NID {
-								alreadyExists = true
-								break
-							}
-						}
-						if !alreadyExists {
-							allStateEventNIDs = append(allStateEventNIDs, ev.NID)
-						}
-					}
-				}
+				allStateEventNIDs := rollForward(append(snapshotRow.MembershipEvents, snapshotRow.OtherEvents...), ev)
 				events, err := s.Accumulator.eventsTable.SelectByNIDs(txn, true, allStateEventNIDs)
 				if err != nil {
 					return fmt.Errorf("failed to select state snapshot %v for room %v: %s", ev.BeforeStateSnapshotID, ev.RoomID, err)
@@ -711,8 +878,9 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 // - in the given rooms
 // - that the user has permission to see
 // - with NIDs <= `to`.
+// - which pass the filter, if there is one.
 // Up to `limit` events are chosen per room. This limit be itself be limited according to MaxTimelineLimit.
-func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*LatestEvents, error) {
+func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int, filter *internal.TimelineFilter) (map[string]*LatestEvents, error) {
 	roomIDToRange, err := s.visibleEventNIDsBetweenForRooms(userID, roomIDs, 0, to)
 	if err != nil {
 		return nil, err
@@ -727,7 +895,7 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 			var latestEventNID int64
 			var roomEvents []json.RawMessage
 			// the most recent event will be first
-			events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit)
+			events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit, filter)
 			if err != nil {
 				return fmt.Errorf("room %s failed to SelectEventsBetween: %s", roomID, err)
 			}
@@ -741,6 +909,10 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 					break
 				}
 			}
+			if !filter.IsEmpty() {
+				// events filtered out have still been seen, so they shouldn't be sent live later
+				latestEventNID = r[1]
+			}
 			// we want the most recent event to be last, so reverse the slice now in-place.
 			slices.Reverse(roomEvents)
 			latestEvents := LatestEvents{
@@ -806,6 +978,80 @@ func (s *Storage) RemoveInaccessibleStateSnapshots() error {
 	return nil
 }
 
+// BackfillTimeline stores events which the homeserver's /messages returned to this user, newest
+// first, which precede the events the proxy has for this room. prevBatch is the token to paginate
+// back from the oldest of them, or "" if they reach the start of the room. Backfilled events are
+// never sent down the live stream.
+func (s *Storage) BackfillTimeline(userID, roomID string, events []json.RawMessage, prevBatch string) error {
+	return sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		_, err := s.EventsTable.InsertBackfill(txn, roomID, events, prevBatch)
+		if err != nil {
+			return fmt.Errorf("failed to insert backfilled events for room %s: %w", roomID, err)
+		}
+		// Some of the events may have been backfilled already, or even be live events, so look up
+		// the NIDs of all of them rather than using the ones which were just inserted.
+		eventIDs := make([]string, 0, len(events))
+		for _, ev := range events {
+			eventIDs = append(eventIDs, gjson.GetBytes(ev, "event_id").Str)
+		}
+		eventIDToNID, err := s.EventsTable.SelectNIDsByIDs(txn, eventIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select backfilled event NIDs for room %s: %w", roomID, err)
+		}
+		existingNIDs, _, _, err := s.BackfillTable.Select(txn, userID, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to select backfill for room %s: %w", roomID, err)
+		}
+		seen := make(map[int64]struct{}, len(existingNIDs))
+		for _, nid := range existingNIDs {
+			seen[nid] = struct{}{}
+		}
+		var nids []int64
+		for _, eventID := range eventIDs {
+			nid, ok := eventIDToNID[eventID]
+			if !ok || nid >= EventsStart {
+				continue // live events are already visible through the user's membership
+			}
+			if _, ok := seen[nid]; ok {
+				continue
+			}
+			seen[nid] = struct{}{}
+			nids = append(nids, nid)
+		}
+		if err = s.BackfillTable.Append(txn, userID, roomID, nids, prevBatch); err != nil {
+			return fmt.Errorf("failed to store backfill for room %s: %w", roomID, err)
+		}
+		return nil
+	})
+}
+
+// BackfilledTimeline returns up to `limit` of the events previously backfilled for this user in
+// this room, newest first, and the token to paginate back from the oldest backfilled event ("" at
+// the start of the room). Returns ok=false if nothing has been backfilled for this user.
+func (s *Storage) BackfilledTimeline(userID, roomID string, limit int) (events []json.RawMessage, prevBatch string, ok bool, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		var nids []int64
+		nids, prevBatch, ok, err = s.BackfillTable.Select(txn, userID, roomID)
+		if err != nil || !ok {
+			return err
+		}
+		if len(nids) > limit {
+			nids = nids[:limit]
+		}
+		// ordered by ascending NID, i.e oldest first
+		evs, err := s.EventsTable.SelectByNIDs(txn, false, nids)
+		if err != nil {
+			return err
+		}
+		events = make([]json.RawMessage, 0, len(evs))
+		for i := len(evs) - 1; i >= 0; i-- {
+			events = append(events, evs[i].JSON)
+		}
+		return nil
+	})
+	return
+}
+
 func (s *Storage) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string) {
 	var err error
 	sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
@@ -816,6 +1062,39 @@ func (s *Storage) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch
 	return
 }
 
+// MessagesBefore returns up to `limit` events in the room the user can see, at or before the NID `to`,
+// newest first. It stops at the first gap in the proxy's copy of the timeline, so the oldest event
+// may have MissingPrevious set. Also returns the prev_batch token closest to the oldest event.
+func (s *Storage) MessagesBefore(userID, roomID string, to int64, limit int) (events []Event, prevBatch string, err error) {
+	roomIDToRange, err := s.visibleEventNIDsBetweenForRooms(userID, []string{roomID}, 0, to)
+	if err != nil {
+		return nil, "", err
+	}
+	r, ok := roomIDToRange[roomID]
+	if !ok {
+		return nil, "", nil
+	}
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		events, err = s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit, nil)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+		prevBatch, err = s.EventsTable.SelectClosestPrevBatch(txn, roomID, events[len(events)-1].NID)
+		return err
+	})
+	return events, prevBatch, err
+}
+
+// PrevBatchEventNID returns the NID of the event which the prev_batch token paginates back from, if
+// the proxy has the events before it, else 0.
+func (s *Storage) PrevBatchEventNID(roomID, prevBatch string) (nid int64, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		nid, err = s.EventsTable.SelectNIDForPrevBatch(txn, roomID, prevBatch)
+		return err
+	})
+	return
+}
+
 // visibleEventNIDsBetweenForRooms determines which events a given user has permission to see.
 // It accepts a nid range [from, to]. For each given room, it calculates the NID range
 // [A1, B1] within [from, to] in which the user has permission to see events.
@@ -830,7 +1109,7 @@ func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []strin
 			return nil, fmt.Errorf("VisibleEventNIDsBetweenForRooms.SelectEventsWithTypeStateKeyInRooms: %s", err)
 		}
 	}
-	joinTimingsAtFromByRoomID, err := s.determineJoinedRoomsFromMemberships(membershipEvents)
+	joinTimingsAtFromByRoomID, err := determineJoinedRoomsFromMemberships(membershipEvents)
 	if err != nil {
 		return nil, fmt.Errorf("failed to work out joined rooms for %s at pos %d: %s", userID, from, err)
 	}
@@ -841,7 +1120,7 @@ func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []strin
 		return nil, fmt.Errorf("failed to load membership events: %s", err)
 	}
 
-	return s.visibleEventNIDsWithData(joinTimingsAtFromByRoomID, membershipEvents, userID, from, to)
+	return visibleEventNIDsWithData(joinTimingsAtFromByRoomID, membershipEvents, userID, from, to)
 }
 
 // Work out the NID ranges to pull events from for this user. Given a from and to event nid stream position,
@@ -885,10 +1164,10 @@ func (s *Storage) VisibleEventNIDsBetween(userID string, from, to int64) (map[st
 		return nil, fmt.Errorf("failed to load membership events: %s", err)
 	}
 
-	return s.visibleEventNIDsWithData(joinTimingsAtFromByRoomID, membershipEvents, userID, from, to)
+	return visibleEventNIDsWithData(joinTimingsAtFromByRoomID, membershipEvents, userID, from, to)
 }
 
-func (s *Storage) visibleEventNIDsWithData(joinTimingsAtFromByRoomID map[string]internal.EventMetadata, membershipEvents []Event, userID string, from, to int64) (map[string][2]int64, error) {
+func visibleEventNIDsWithData(joinTimingsAtFromByRoomID map[string]internal.EventMetadata, membershipEvents []Event, userID string, from, to int64) (map[string][2]int64, error) {
 	// load membership events in order and bucket based on room ID
 	roomIDToLogs := make(map[string][]membershipEvent)
 	for _, ev := range membershipEvents {
@@ -991,9 +1270,10 @@ func (s *Storage) RoomMembershipDelta(roomID string, from, to int64, limit int)
 	return
 }
 
-// Extract all rooms with joined members, and include the joined user list. Requires a prepared snapshot in order to be called.
-// Populates the join/invite count and heroes for the returned metadata.
-func (s *Storage) AllJoinedMembers(txn *sqlx.Tx, tempTableName string) (joinedMembers map[string][]string, metadata map[string]internal.RoomMetadata, err error) {
+// Extract all rooms with joined members, calling onJoinedMember for each joined user. Requires a prepared snapshot in order to be called.
+// Populates the join/invite count and heroes for the returned metadata. The joined users are not
+// held in memory here, so memory use scales with the number of rooms rather than memberships.
+func (s *Storage) AllJoinedMembers(txn *sqlx.Tx, tempTableName string, onJoinedMember JoinedMemberFunc) (metadata map[string]internal.RoomMetadata, err error) {
 	// Select the most recent members for each room to serve as Heroes. The spec is ambiguous here:
 	// "This should be the first 5 members of the room, ordered by stream ordering, which are joined or invited."
 	// Unclear if this is the first 5 *most recent* (backwards) or forwards. For now we'll use the most recent
@@ -1003,10 +1283,10 @@ func (s *Storage) AllJoinedMembers(txn *sqlx.Tx, tempTableName string) (joinedMe
 		on membership_nid = event_nid WHERE membership='join' OR membership='_join' OR membership='invite' OR membership='_invite' ORDER BY event_nid ASC`,
 	)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	defer rows.Close()
-	joinedMembers = make(map[string][]string)
+	joinCounts := make(map[string]int)
 	inviteCounts := make(map[string]int)
 	heroNIDs := make(map[string]*circularSlice[int64])
 	var stateKey string
@@ -1015,7 +1295,7 @@ func (s *Storage) AllJoinedMembers(txn *sqlx.Tx, tempTableName string) (joinedMe
 	var nid int64
 	for rows.Next() {
 		if err := rows.Scan(&nid, &roomID, &stateKey, &membership); err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		heroes := heroNIDs[roomID]
 		if heroes == nil {
@@ -1026,9 +1306,8 @@ func (s *Storage) AllJoinedMembers(txn *sqlx.Tx, tempTableName string) (joinedMe
 		case "join":
 			fallthrough
 		case "_join":
-			users := joinedMembers[roomID]
-			users = append(users, stateKey)
-			joinedMembers[roomID] = users
+			joinCounts[roomID] = joinCounts[roomID] + 1
+			onJoinedMember(roomID, stateKey)
 			heroes.append(nid)
 		case "invite":
 			fallthrough
@@ -1037,6 +1316,9 @@ func (s *Storage) AllJoinedMembers(txn *sqlx.Tx, tempTableName string) (joinedMe
 			heroes.append(nid)
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
 	// now select the membership events for the heroes
 	var allHeroNIDs []int64
@@ -1045,7 +1327,7 @@ func (s *Storage) AllJoinedMembers(txn *sqlx.Tx, tempTableName string) (joinedMe
 	}
 	heroEvents, err := s.EventsTable.SelectByNIDs(txn, true, allHeroNIDs)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	heroes := make(map[string][]internal.Hero)
 	// loop backwards so the most recent hero is first in the hero list
@@ -1062,22 +1344,28 @@ func (s *Storage) AllJoinedMembers(txn *sqlx.Tx, tempTableName string) (joinedMe
 	}
 
 	metadata = make(map[string]internal.RoomMetadata)
-	for roomID, members := range joinedMembers {
+	for roomID, joinCount := range joinCounts {
 		m := internal.NewRoomMetadata(roomID)
-		m.JoinCount = len(members)
+		m.JoinCount = joinCount
 		m.InviteCount = inviteCounts[roomID]
 		m.Heroes = heroes[roomID]
 		metadata[roomID] = *m
 	}
-	return joinedMembers, metadata, nil
+	return metadata, nil
+}
+
+// SetClock replaces the clock used for retention, so tests can control which data is cleaned up.
+func (s *Storage) SetClock(clock internal.Clock) {
+	s.clock = clock
+	s.TransactionsTable.clock = clock
 }
 
 func (s *Storage) Cleaner(n time.Duration) {
 Loop:
 	for {
 		select {
-		case <-time.After(n):
-			now := time.Now()
+		case <-s.clock.After(n):
+			now := s.clock.Now()
 			boundaryTime := now.Add(-1 * n)
 			if n < time.Hour {
 				boundaryTime = now.Add(-1 * time.Hour)
@@ -1088,12 +1376,24 @@ Loop:
 				logger.Warn().Err(err).Msg("failed to clean txn ID table")
 				sentry.CaptureException(err)
 			}
+			if err = s.ConnectionsTable.Clean(boundaryTime); err != nil {
+				logger.Warn().Err(err).Msg("failed to clean connections table")
+				sentry.CaptureException(err)
+			}
 			// we also want to clean up stale state snapshots which are inaccessible, to
 			// keep the size of the syncv3_snapshots table low.
 			if err = s.RemoveInaccessibleStateSnapshots(); err != nil {
 				logger.Warn().Err(err).Msg("failed to remove inaccessible state snapshots")
 				sentry.CaptureException(err)
 			}
+			// receipts are only sent for current members, so drop those of members who have left.
+			numReceipts, err := s.ReceiptTable.DeleteDepartedMembers()
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed to delete receipts of departed members")
+				sentry.CaptureException(err)
+			} else {
+				logger.Info().Int64("rows_affected", numReceipts).Msg("Cleaner: deleted receipts of departed members")
+			}
 		case <-s.shutdownCh:
 			break Loop
 		}
@@ -1137,6 +1437,24 @@ func (s *Storage) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roo
 	return roomToNID, err
 }
 
+// RoomLatestEvent is the most recent event in a room as of some position.
+type RoomLatestEvent struct {
+	NID       int64  `db:"event_nid"`
+	Type      string `db:"event_type"`
+	Timestamp uint64 `db:"origin_server_ts"`
+}
+
+// LatestEventMetadataInRooms returns the most recent event with an NID <= highestNID in each of the
+// given rooms, in one round trip. Unlike LatestEventNIDInRooms this always queries the events table,
+// but returns enough to order rooms without querying each room separately.
+func (s *Storage) LatestEventMetadataInRooms(roomIDs []string, highestNID int64) (map[string]RoomLatestEvent, error) {
+	roomToEvent, err := s.EventsTable.LatestEventMetadataInRooms(roomIDs, highestNID)
+	if err != nil {
+		return nil, fmt.Errorf("LatestEventMetadataInRooms: %w", err)
+	}
+	return roomToEvent, nil
+}
+
 // Returns a map from joined room IDs to EventMetadata, which is nil iff a non-nil error
 // is returned.
 func (s *Storage) JoinedRoomsAfterPosition(userID string, pos int64) (
@@ -1147,7 +1465,7 @@ func (s *Storage) JoinedRoomsAfterPosition(userID string, pos int64) (
 	if err != nil {
 		return nil, fmt.Errorf("JoinedRoomsAfterPosition.SelectEventsWithTypeStateKey: %s", err)
 	}
-	return s.determineJoinedRoomsFromMemberships(membershipEvents)
+	return determineJoinedRoomsFromMemberships(membershipEvents)
 }
 
 // determineJoinedRoomsFromMemberships scans a slice of membership events from multiple
@@ -1158,7 +1476,7 @@ func (s *Storage) JoinedRoomsAfterPosition(userID string, pos int64) (
 //
 // Returns a map from joined room IDs to EventMetadata, which is nil iff a non-nil error
 // is returned.
-func (s *Storage) determineJoinedRoomsFromMemberships(membershipEvents []Event) (
+func determineJoinedRoomsFromMemberships(membershipEvents []Event) (
 	joinTimingByRoomID map[string]internal.EventMetadata, err error,
 ) {
 	joinTimingByRoomID = make(map[string]internal.EventMetadata, len(membershipEvents))
@@ -1192,6 +1510,9 @@ func (s *Storage) Teardown() {
 	if !s.shutdown {
 		s.shutdown = true
 		close(s.shutdownCh)
+		if s.unregisterMetrics != nil {
+			s.unregisterMetrics()
+		}
 	}
 
 	err := s.Accumulator.db.Close()
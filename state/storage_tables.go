@@ -0,0 +1,132 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// The methods in this file expose single table operations on Storage, so that the handlers can
+// depend on interfaces of the operations they need rather than on Storage and its tables. Each
+// forwards to the table of the same name.
+
+// TimelineLimit returns the most timeline events which are returned per room, 0 for no limit.
+func (s *Storage) TimelineLimit() int {
+	return s.MaxTimelineLimit
+}
+
+// EventNIDsByIDs returns the NIDs of the given events which exist, keyed by event ID.
+func (s *Storage) EventNIDsByIDs(eventIDs []string) (nids map[string]int64, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		nids, err = s.EventsTable.SelectNIDsByIDs(txn, eventIDs)
+		return err
+	})
+	return
+}
+
+func (s *Storage) IsReadUpTo(roomID, userID, eventID string) (bool, error) {
+	return s.EventsTable.SelectIsReadUpTo(roomID, userID, eventID)
+}
+
+func (s *Storage) AllNonZeroUnreadCounts(userID string, callback func(roomID string, highlightCount, notificationCount int)) error {
+	return s.UnreadTable.SelectAllNonZeroCountsForUser(userID, callback)
+}
+
+func (s *Storage) UnreadCounters(userID, roomID string) (highlightCount, notificationCount int, err error) {
+	return s.UnreadTable.SelectUnreadCounters(userID, roomID)
+}
+
+func (s *Storage) UpdateUnreadCounters(userID, roomID string, highlightCount, notificationCount *int) error {
+	return s.UnreadTable.UpdateUnreadCounters(userID, roomID, highlightCount, notificationCount)
+}
+
+func (s *Storage) AllInvitesForUser(userID string) (map[string][]json.RawMessage, error) {
+	return s.InvitesTable.SelectAllInvitesForUser(userID)
+}
+
+func (s *Storage) InviteState(userID, roomID string) ([]json.RawMessage, error) {
+	return s.InvitesTable.SelectInviteState(userID, roomID)
+}
+
+func (s *Storage) InsertInvite(userID, roomID string, inviteRoomState []json.RawMessage) error {
+	return s.InvitesTable.InsertInvite(userID, roomID, inviteRoomState)
+}
+
+func (s *Storage) UpdateInviteState(userID, roomID string, inviteRoomState []json.RawMessage) (bool, error) {
+	return s.InvitesTable.UpdateInviteState(userID, roomID, inviteRoomState)
+}
+
+func (s *Storage) RemoveInvite(userID, roomID string) error {
+	return s.InvitesTable.RemoveInvite(userID, roomID)
+}
+
+func (s *Storage) DeviceData(userID, deviceID string, swap bool) (*internal.DeviceData, error) {
+	return s.DeviceDataTable.Select(userID, deviceID, swap)
+}
+
+func (s *Storage) UpsertDeviceData(userID, deviceID string, keys internal.DeviceKeyData, deviceListChanges map[string]int) error {
+	return s.DeviceDataTable.Upsert(userID, deviceID, keys, deviceListChanges)
+}
+
+func (s *Storage) TransactionIDs(userID, deviceID string, eventIDs []string) (map[string]string, error) {
+	return s.TransactionsTable.Select(userID, deviceID, eventIDs)
+}
+
+func (s *Storage) InsertTransactionIDs(userID, deviceID string, eventIDToTxnID map[string]string) error {
+	return s.TransactionsTable.Insert(userID, deviceID, eventIDToTxnID)
+}
+
+func (s *Storage) InsertReceipts(roomID string, ephEvent json.RawMessage) ([]internal.Receipt, error) {
+	return s.ReceiptTable.Insert(roomID, ephEvent)
+}
+
+func (s *Storage) ReceiptsForEvents(roomID string, eventIDs []string) ([]internal.Receipt, error) {
+	return s.ReceiptTable.SelectReceiptsForEvents(roomID, eventIDs)
+}
+
+func (s *Storage) ReceiptsForUser(roomIDs []string, userID string) (map[string][]internal.Receipt, error) {
+	return s.ReceiptTable.SelectReceiptsForUser(roomIDs, userID)
+}
+
+func (s *Storage) InsertToDeviceMessages(userID, deviceID string, msgs []json.RawMessage) (int64, error) {
+	return s.ToDeviceTable.InsertMessages(userID, deviceID, msgs)
+}
+
+func (s *Storage) ToDeviceAckPositions(userID, deviceID string) (ackPos, unackPos int64, err error) {
+	return s.ToDeviceTable.AckPositions(userID, deviceID)
+}
+
+func (s *Storage) AckToDeviceMessages(userID, deviceID string, toIncl int64) error {
+	return s.ToDeviceTable.AckMessagesUpToAndIncluding(userID, deviceID, toIncl)
+}
+
+func (s *Storage) ToDeviceMessagesWithinSize(userID, deviceID string, from, limit int64, maxBytes int) (msgs []json.RawMessage, upTo int64, more bool, err error) {
+	return s.ToDeviceTable.MessagesWithinSize(userID, deviceID, from, limit, maxBytes)
+}
+
+func (s *Storage) SetToDeviceUnackedPosition(userID, deviceID string, pos int64) error {
+	return s.ToDeviceTable.SetUnackedPosition(userID, deviceID, pos)
+}
+
+func (s *Storage) InsertAuditEntry(entry *AuditEntry) error {
+	return s.AuditTable.Insert(entry)
+}
+
+func (s *Storage) SelectAuditEntries(target, action string, before int64, limit int) ([]AuditEntry, error) {
+	return s.AuditTable.Select(target, action, before, limit)
+}
+
+func (s *Storage) SaveConnection(userID, deviceID, connID string, request []byte) error {
+	return s.ConnectionsTable.Upsert(userID, deviceID, connID, request)
+}
+
+func (s *Storage) LoadConnection(userID, deviceID, connID string, after time.Time) ([]byte, error) {
+	return s.ConnectionsTable.Select(userID, deviceID, connID, after)
+}
+
+func (s *Storage) DeleteConnection(userID, deviceID, connID string) error {
+	return s.ConnectionsTable.Delete(userID, deviceID, connID)
+}
@@ -3,6 +3,7 @@ package state
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -630,7 +631,10 @@ func TestGlobalSnapshot(t *testing.T) {
 		_, err := store.Initialise(roomID, stateEvents)
 		assertNoError(t, err)
 	}
-	snapshot, err := store.GlobalSnapshot()
+	joinedMembers := make(map[string][]string)
+	snapshot, err := store.GlobalSnapshot(func(roomID, userID string) {
+		joinedMembers[roomID] = append(joinedMembers[roomID], userID)
+	})
 	assertNoError(t, err)
 	wantJoinedMembers := map[string][]string{
 		roomAlice:    {alice},
@@ -638,8 +642,8 @@ func TestGlobalSnapshot(t *testing.T) {
 		roomAliceBob: {bob, alice}, // user IDs are ordered by event nid, and bob joined first so he is first
 		roomSpace:    {bob},
 	}
-	if !reflect.DeepEqual(snapshot.AllJoinedMembers, wantJoinedMembers) {
-		t.Errorf("Snapshot.AllJoinedMembers:\ngot:  %+v\nwant: %+v", snapshot.AllJoinedMembers, wantJoinedMembers)
+	if !reflect.DeepEqual(joinedMembers, wantJoinedMembers) {
+		t.Errorf("GlobalSnapshot joined members:\ngot:  %+v\nwant: %+v", joinedMembers, wantJoinedMembers)
 	}
 	wantMetadata := map[string]internal.RoomMetadata{
 		roomAlice: {
@@ -782,7 +786,7 @@ func TestAllJoinedMembers(t *testing.T) {
 	}
 
 	// should get all joined members correctly
-	var joinedMembers map[string][]string
+	joinedMembers := make(map[string][]string)
 	// should set join/invite counts correctly
 	var roomMetadatas map[string]internal.RoomMetadata
 	err := sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
@@ -790,7 +794,9 @@ func TestAllJoinedMembers(t *testing.T) {
 		if err != nil {
 			return err
 		}
-		joinedMembers, roomMetadatas, err = store.AllJoinedMembers(txn, tableName)
+		roomMetadatas, err = store.AllJoinedMembers(txn, tableName, func(roomID, userID string) {
+			joinedMembers[roomID] = append(joinedMembers[roomID], userID)
+		})
 		return err
 	})
 	assertNoError(t, err)
@@ -1136,3 +1142,191 @@ func verifyRange(t *testing.T, result map[string][2]int64, roomID string, wantRa
 		t.Errorf("%s range got %v want %v", roomID, gotRange, wantRange)
 	}
 }
+
+func TestStorageStateAtSnapshotAndAfterEvent(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageStateAtSnapshotAndAfterEvent:localhost"
+	alice := "@alice:localhost"
+	createEvent := testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice})
+	joinEvent := testutils.NewJoinEvent(t, alice)
+	initResult, err := store.Initialise(roomID, []json.RawMessage{createEvent, joinEvent})
+	if err != nil {
+		t.Fatalf("Initialise returned error: %s", err)
+	}
+	nameEvent := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "first"})
+	messageEvent := testutils.NewMessageEvent(t, alice, "hello")
+	renameEvent := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "second"})
+	accResult, err := store.Accumulate(userID, roomID, sync2.TimelineResponse{
+		Events: []json.RawMessage{nameEvent, messageEvent, renameEvent},
+	})
+	if err != nil {
+		t.Fatalf("Accumulate returned error: %s", err)
+	}
+	var createNID int64
+	err = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+		nids, err := store.EventsTable.SelectNIDsByIDs(txn, []string{gjson.GetBytes(createEvent, "event_id").Str})
+		createNID = nids[gjson.GetBytes(createEvent, "event_id").Str]
+		return err
+	})
+	if err != nil {
+		t.Fatalf("SelectNIDsByIDs returned error: %s", err)
+	}
+
+	assertState := func(name string, gotEvents []Event, wantEvents []json.RawMessage) {
+		t.Helper()
+		if len(gotEvents) != len(wantEvents) {
+			t.Fatalf("%s: got %d events want %d : got %+v", name, len(gotEvents), len(wantEvents), gotEvents)
+		}
+		for i := range wantEvents {
+			if !bytes.Equal(gotEvents[i].JSON, wantEvents[i]) {
+				t.Errorf("%s: pos %d\ngot  %s\nwant %s", name, i, gotEvents[i].JSON, wantEvents[i])
+			}
+		}
+	}
+
+	gotRoomID, events, err := store.StateAtSnapshot(initResult.SnapshotID)
+	assertNoError(t, err)
+	assertValue(t, "StateAtSnapshot room ID", gotRoomID, roomID)
+	assertState("StateAtSnapshot", events, []json.RawMessage{createEvent, joinEvent})
+
+	// events in the state block are in the snapshot made from it
+	gotRoomID, snapshotID, events, err := store.StateAfterEvent(createNID)
+	assertNoError(t, err)
+	assertValue(t, "StateAfterEvent(create) room ID", gotRoomID, roomID)
+	assertValue(t, "StateAfterEvent(create) snapshot ID", snapshotID, initResult.SnapshotID)
+	assertState("StateAfterEvent(create)", events, []json.RawMessage{createEvent, joinEvent})
+
+	_, _, events, err = store.StateAfterEvent(accResult.TimelineNIDs[1])
+	assertNoError(t, err)
+	assertState("StateAfterEvent(message)", events, []json.RawMessage{createEvent, joinEvent, nameEvent})
+
+	// the state after a state event includes it
+	_, _, events, err = store.StateAfterEvent(accResult.TimelineNIDs[2])
+	assertNoError(t, err)
+	assertState("StateAfterEvent(rename)", events, []json.RawMessage{createEvent, joinEvent, renameEvent})
+
+	if _, _, _, err = store.StateAfterEvent(999999999); err != sql.ErrNoRows {
+		t.Errorf("StateAfterEvent for an unknown event: got %v want sql.ErrNoRows", err)
+	}
+	if _, _, err = store.StateAtSnapshot(999999999); err != sql.ErrNoRows {
+		t.Errorf("StateAtSnapshot for an unknown snapshot: got %v want sql.ErrNoRows", err)
+	}
+}
+
+func TestStorageStateDiff(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageStateDiff:localhost"
+	alice := "@alice:localhost"
+	createEvent := testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice})
+	joinEvent := testutils.NewJoinEvent(t, alice)
+	initResult, err := store.Initialise(roomID, []json.RawMessage{createEvent, joinEvent})
+	if err != nil {
+		t.Fatalf("Initialise returned error: %s", err)
+	}
+	nameEvent := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "first"})
+	messageEvent := testutils.NewMessageEvent(t, alice, "hello")
+	renameEvent := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "second"})
+	accResult, err := store.Accumulate(userID, roomID, sync2.TimelineResponse{
+		Events: []json.RawMessage{nameEvent, messageEvent, renameEvent},
+	})
+	if err != nil {
+		t.Fatalf("Accumulate returned error: %s", err)
+	}
+	// the state before the message includes the first name
+	_, namedSnapshotID, _, err := store.StateAfterEvent(accResult.TimelineNIDs[1])
+	assertNoError(t, err)
+	var renamedSnapshotID int64
+	err = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+		renamedSnapshotID, err = store.Accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+		return err
+	})
+	assertNoError(t, err)
+
+	eventJSONs := func(events []Event) (result []json.RawMessage) {
+		for _, ev := range events {
+			result = append(result, ev.JSON)
+		}
+		return
+	}
+	testCases := []struct {
+		name         string
+		from, to     int64
+		wantAdded    []json.RawMessage
+		wantRemoved  []json.RawMessage
+		wantReplaced [][2]json.RawMessage
+	}{
+		{name: "no change", from: initResult.SnapshotID, to: initResult.SnapshotID},
+		{name: "named", from: initResult.SnapshotID, to: namedSnapshotID, wantAdded: []json.RawMessage{nameEvent}},
+		{name: "renamed", from: namedSnapshotID, to: renamedSnapshotID, wantReplaced: [][2]json.RawMessage{{nameEvent, renameEvent}}},
+		{name: "backwards", from: renamedSnapshotID, to: initResult.SnapshotID, wantRemoved: []json.RawMessage{renameEvent}},
+	}
+	for _, tc := range testCases {
+		delta, err := store.StateDiff(roomID, tc.from, tc.to)
+		if err != nil {
+			t.Fatalf("%s: StateDiff returned error: %s", tc.name, err)
+		}
+		assertValue(t, tc.name+" added", eventJSONs(delta.Added), tc.wantAdded)
+		assertValue(t, tc.name+" removed", eventJSONs(delta.Removed), tc.wantRemoved)
+		var gotReplaced [][2]json.RawMessage
+		for _, r := range delta.Replaced {
+			gotReplaced = append(gotReplaced, [2]json.RawMessage{r.Old.JSON, r.New.JSON})
+		}
+		assertValue(t, tc.name+" replaced", gotReplaced, tc.wantReplaced)
+	}
+
+	if _, err = store.StateDiff(roomID, initResult.SnapshotID, 999999999); err != sql.ErrNoRows {
+		t.Errorf("StateDiff to an unknown snapshot: got %v want sql.ErrNoRows", err)
+	}
+	if _, err = store.StateDiff("!other:localhost", initResult.SnapshotID, renamedSnapshotID); err != sql.ErrNoRows {
+		t.Errorf("StateDiff in the wrong room: got %v want sql.ErrNoRows", err)
+	}
+}
+
+func TestStorageBackfilledTimeline(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageBackfilledTimeline:localhost"
+	alice := "@alice_TestStorageBackfilledTimeline:localhost"
+	bob := "@bob_TestStorageBackfilledTimeline:localhost"
+	newEvent := func(body string) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": body})
+	}
+	eventIDs := func(events []json.RawMessage) (ids []string) {
+		for _, ev := range events {
+			ids = append(ids, gjson.GetBytes(ev, "event_id").Str)
+		}
+		return
+	}
+
+	_, _, ok, err := store.BackfilledTimeline(alice, roomID, 10)
+	assertNoError(t, err)
+	assertValue(t, "ok before backfilling", ok, false)
+
+	// /messages returns events newest first
+	newer := []json.RawMessage{newEvent("4"), newEvent("3")}
+	older := []json.RawMessage{newEvent("2"), newEvent("1")}
+	assertNoError(t, store.BackfillTimeline(alice, roomID, newer, "prev_3"))
+	// overlapping pages are only stored once
+	assertNoError(t, store.BackfillTimeline(alice, roomID, append([]json.RawMessage{newer[1]}, older...), ""))
+
+	events, prevBatch, ok, err := store.BackfilledTimeline(alice, roomID, 10)
+	assertNoError(t, err)
+	assertValue(t, "ok", ok, true)
+	assertValue(t, "events", eventIDs(events), eventIDs(append(append([]json.RawMessage{}, newer...), older...)))
+	assertValue(t, "prev_batch at the start of the room", prevBatch, "")
+
+	events, _, _, err = store.BackfilledTimeline(alice, roomID, 3)
+	assertNoError(t, err)
+	assertValue(t, "limited events", eventIDs(events), eventIDs(append(append([]json.RawMessage{}, newer...), older[0])))
+
+	// bob gets his own view of the room's history, even though the events are shared
+	_, _, ok, err = store.BackfilledTimeline(bob, roomID, 10)
+	assertNoError(t, err)
+	assertValue(t, "ok for bob", ok, false)
+	assertNoError(t, store.BackfillTimeline(bob, roomID, older, ""))
+	events, _, _, err = store.BackfilledTimeline(bob, roomID, 10)
+	assertNoError(t, err)
+	assertValue(t, "bob's events", eventIDs(events), eventIDs(older))
+}
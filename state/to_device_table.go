@@ -1,9 +1,12 @@
 package state
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -18,7 +21,8 @@ const (
 
 // ToDeviceTable stores to_device messages for devices.
 type ToDeviceTable struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	metrics sqlutil.TableMetrics
 }
 
 type ToDeviceRow struct {
@@ -30,6 +34,8 @@ type ToDeviceRow struct {
 	Sender    string  `db:"sender"`
 	UniqueKey *string `db:"unique_key"`
 	Action    int     `db:"action"`
+	// ContentHash identifies identical messages, which are only stored once per device
+	ContentHash string `db:"content_hash"`
 }
 
 type ToDeviceRowChunker []ToDeviceRow
@@ -54,33 +60,67 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 		message TEXT NOT NULL,
 		-- nullable as these fields are not on all to-device events
 		unique_key TEXT,
-		action SMALLINT DEFAULT 0 -- 0 means unknown
+		action SMALLINT DEFAULT 0, -- 0 means unknown
+		content_hash TEXT NOT NULL DEFAULT '' -- see toDeviceContentHash
 	);
 	CREATE TABLE IF NOT EXISTS syncv3_to_device_ack_pos (
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
 		PRIMARY KEY (user_id, device_id),
-		unack_pos BIGINT NOT NULL
+		unack_pos BIGINT NOT NULL, -- the highest position sent to the device
+		ack_pos BIGINT NOT NULL DEFAULT 0 -- the highest position the device has acknowledged
 	);
-	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_device_idx ON syncv3_to_device_messages(device_id);
+	-- the (user_id, device_id, position) index is created by the hot_query_indexes migration, and
+	-- the (user_id, device_id, content_hash) index by the to_device_content_hash migration
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_ukey_idx ON syncv3_to_device_messages(unique_key, device_id);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_pos_device_idx ON syncv3_to_device_messages(position, device_id);
 	`)
-	return &ToDeviceTable{db}
+	return &ToDeviceTable{db: db, metrics: sqlutil.NewTableMetrics("to_device")}
 }
 
 func (t *ToDeviceTable) SetUnackedPosition(userID, deviceID string, pos int64) error {
+	defer t.metrics.Observe("SetUnackedPosition", time.Now())
 	_, err := t.db.Exec(`INSERT INTO syncv3_to_device_ack_pos(user_id, device_id, unack_pos) VALUES($1,$2,$3) ON CONFLICT (user_id, device_id)
 	DO UPDATE SET unack_pos=excluded.unack_pos`, userID, deviceID, pos)
 	return err
 }
 
+// AckPositions returns the highest position this device has acknowledged, and the highest position
+// which has been sent to it. Both are 0 if nothing has been sent to the device.
+func (t *ToDeviceTable) AckPositions(userID, deviceID string) (ackPos, unackPos int64, err error) {
+	defer t.metrics.Observe("AckPositions", time.Now())
+	err = t.db.QueryRow(
+		`SELECT ack_pos, unack_pos FROM syncv3_to_device_ack_pos WHERE user_id=$1 AND device_id=$2`, userID, deviceID,
+	).Scan(&ackPos, &unackPos)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// AckMessagesUpToAndIncluding records that the device has received all messages up to and including
+// this position, and deletes them.
+func (t *ToDeviceTable) AckMessagesUpToAndIncluding(userID, deviceID string, toIncl int64) error {
+	defer t.metrics.Observe("AckMessagesUpToAndIncluding", time.Now())
+	return sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		_, err := txn.Exec(`DELETE FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND position <= $3`, userID, deviceID, toIncl)
+		if err != nil {
+			return err
+		}
+		_, err = txn.Exec(`INSERT INTO syncv3_to_device_ack_pos(user_id, device_id, unack_pos, ack_pos) VALUES($1,$2,$3,$3) ON CONFLICT (user_id, device_id)
+		DO UPDATE SET ack_pos=GREATEST(syncv3_to_device_ack_pos.ack_pos, excluded.ack_pos)`, userID, deviceID, toIncl)
+		return err
+	})
+}
+
 func (t *ToDeviceTable) DeleteMessagesUpToAndIncluding(userID, deviceID string, toIncl int64) error {
+	defer t.metrics.Observe("DeleteMessagesUpToAndIncluding", time.Now())
 	_, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND position <= $3`, userID, deviceID, toIncl)
 	return err
 }
 
 func (t *ToDeviceTable) DeleteAllMessagesForDevice(userID, deviceID string) error {
+	defer t.metrics.Observe("DeleteAllMessagesForDevice", time.Now())
 	// TODO: should these deletes take place in a transaction?
 	_, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2`, userID, deviceID)
 	if err != nil {
@@ -94,12 +134,45 @@ func (t *ToDeviceTable) DeleteAllMessagesForDevice(userID, deviceID string) erro
 // Returns the fetches messages ordered by ascending position, as well as the position of the last to-device message
 // fetched.
 func (t *ToDeviceTable) Messages(userID, deviceID string, from, limit int64) (msgs []json.RawMessage, upTo int64, err error) {
-	upTo = from
+	defer t.metrics.Observe("Messages", time.Now())
+	msgs, upTo, _, err = t.MessagesWithinSize(userID, deviceID, from, limit, 0)
+	return
+}
+
+// MessagesWithinSize is like Messages, but stops before the total size of the messages exceeds maxBytes,
+// unless that would return no messages at all. 0 means no size limit. Also returns whether there are
+// more messages after upTo.
+func (t *ToDeviceTable) MessagesWithinSize(userID, deviceID string, from, limit int64, maxBytes int) (msgs []json.RawMessage, upTo int64, more bool, err error) {
+	defer t.metrics.Observe("MessagesWithinSize", time.Now())
 	var rows []ToDeviceRow
+	// select an extra row to find out if there are more messages
 	err = t.db.Select(&rows,
 		`SELECT position, message FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND position > $3 ORDER BY position ASC LIMIT $4`,
-		userID, deviceID, from, limit,
+		userID, deviceID, from, limit+1,
 	)
+	msgs, upTo, more = toDeviceMessagesWithinSize(userID, deviceID, rows, from, limit, maxBytes)
+	return
+}
+
+// toDeviceMessagesWithinSize applies the limits of MessagesWithinSize to the device's rows after
+// `from`, in ascending position order, which include one more row than the limit if there are more.
+func toDeviceMessagesWithinSize(userID, deviceID string, rows []ToDeviceRow, from, limit int64, maxBytes int) (msgs []json.RawMessage, upTo int64, more bool) {
+	upTo = from
+	if int64(len(rows)) > limit {
+		rows = rows[:limit]
+		more = true
+	}
+	if maxBytes > 0 {
+		size := 0
+		for i := range rows {
+			size += len(rows[i].Message)
+			if size > maxBytes && i > 0 {
+				rows = rows[:i]
+				more = true
+				break
+			}
+		}
+	}
 	if len(rows) == 0 {
 		return
 	}
@@ -116,7 +189,21 @@ func (t *ToDeviceTable) Messages(userID, deviceID string, from, limit int64) (ms
 	return
 }
 
+// toDeviceContentHash identifies a to-device message by its sender, type and content, so the same
+// message delivered twice by overlapping v2 polls can be spotted.
+func toDeviceContentHash(m gjson.Result) string {
+	h := sha256.New()
+	for _, field := range []string{m.Get("sender").Str, m.Get("type").Str, m.Get("content").Raw} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// InsertMessages stores to-device messages for this device. Messages which are identical to one
+// already waiting to be sent to the device, or earlier in msgs, are dropped.
 func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawMessage) (pos int64, err error) {
+	defer t.metrics.Observe("InsertMessages", time.Now())
 	var lastPos int64
 	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
 		var unackPos int64
@@ -125,45 +212,26 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 			return fmt.Errorf("unable to select unacked pos: %s", err)
 		}
 
-		// Some of these events may be "cancel" actions. If we find events for the unique key of this event, then delete them
-		// and ignore the "cancel" action.
-		cancels := []string{}
-		allRequests := make(map[string]struct{})
-		allCancels := make(map[string]struct{})
-
-		rows := make([]ToDeviceRow, len(msgs))
-		for i := range msgs {
-			m := gjson.ParseBytes(msgs[i])
-			rows[i] = ToDeviceRow{
-				UserID:   userID,
-				DeviceID: deviceID,
-				Message:  string(msgs[i]),
-				Type:     m.Get("type").Str,
-				Sender:   m.Get("sender").Str,
-			}
-			msgId := m.Get(`content.org\.matrix\.msgid`).Str
-			if msgId != "" {
-				logger.Debug().Str("msgid", msgId).Str("user", userID).Str("device", deviceID).Msg("ToDeviceTable.InsertMessages")
+		rows, hashes := newToDeviceRows(userID, deviceID, msgs)
+		if len(hashes) > 0 {
+			var storedHashes []string
+			err = txn.Select(&storedHashes, `SELECT content_hash FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND content_hash = ANY($3)`,
+				userID, deviceID, pq.StringArray(hashes))
+			if err != nil {
+				return fmt.Errorf("failed to select duplicate messages: %s", err)
 			}
-			switch rows[i].Type {
-			case "m.room_key_request":
-				action := m.Get("content.action").Str
-				if action == "request" {
-					rows[i].Action = ActionRequest
-				} else if action == "request_cancellation" {
-					rows[i].Action = ActionCancel
+			if len(storedHashes) > 0 {
+				stored := make(map[string]struct{}, len(storedHashes))
+				for _, hash := range storedHashes {
+					stored[hash] = struct{}{}
 				}
-				// "the same request_id and requesting_device_id fields, sent by the same user."
-				key := fmt.Sprintf("%s-%s-%s-%s", rows[i].Type, rows[i].Sender, m.Get("content.requesting_device_id").Str, m.Get("content.request_id").Str)
-				rows[i].UniqueKey = &key
-			}
-			if rows[i].Action == ActionCancel && rows[i].UniqueKey != nil {
-				cancels = append(cancels, *rows[i].UniqueKey)
-				allCancels[*rows[i].UniqueKey] = struct{}{}
-			} else if rows[i].Action == ActionRequest && rows[i].UniqueKey != nil {
-				allRequests[*rows[i].UniqueKey] = struct{}{}
+				rows = withoutStoredToDeviceRows(rows, stored)
 			}
 		}
+
+		// Some of these events may be "cancel" actions. If we find events for the unique key of this event, then delete them
+		// and ignore the "cancel" action.
+		cancels, allRequests, allCancels := setToDeviceActions(userID, deviceID, rows)
 		if len(cancels) > 0 {
 			var cancelled []string
 			// delete action: request events which have the same unique key, for this device inbox, only if they are not sent to the client already (unacked)
@@ -176,35 +244,17 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 			for _, ukey := range cancelled {
 				cancelledInDBSet[ukey] = struct{}{}
 			}
-			// do not insert the cancelled unique keys
-			newRows := make([]ToDeviceRow, 0, len(rows))
-			for i := range rows {
-				if rows[i].UniqueKey != nil {
-					ukey := *rows[i].UniqueKey
-					_, exists := cancelledInDBSet[ukey]
-					if exists {
-						continue // the request was deleted so don't insert the cancel
-					}
-					// we may be requesting and cancelling in one go, check it and ignore if so
-					_, reqExists := allRequests[ukey]
-					_, cancelExists := allCancels[ukey]
-					if reqExists && cancelExists {
-						continue
-					}
-				}
-				newRows = append(newRows, rows[i])
-			}
-			rows = newRows
+			rows = withoutCancelledToDeviceRows(rows, cancelledInDBSet, allRequests, allCancels)
 		}
 		// we may have nothing to do if the entire set of events were cancellations
 		if len(rows) == 0 {
 			return nil
 		}
 
-		chunks := sqlutil.Chunkify(7, MaxPostgresParameters, ToDeviceRowChunker(rows))
+		chunks := sqlutil.Chunkify(8, MaxPostgresParameters, ToDeviceRowChunker(rows))
 		for _, chunk := range chunks {
-			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key)
-        VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key) RETURNING position`, chunk)
+			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key, content_hash)
+        VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key, :content_hash) RETURNING position`, chunk)
 			if err != nil {
 				return err
 			}
@@ -220,3 +270,106 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 	})
 	return lastPos, err
 }
+
+// newToDeviceRows makes rows for the messages to this device, dropping messages which are identical
+// to earlier ones. Returns the rows and the content hashes of the rows which may already be stored.
+func newToDeviceRows(userID, deviceID string, msgs []json.RawMessage) (rows []ToDeviceRow, hashes []string) {
+	rows = make([]ToDeviceRow, 0, len(msgs))
+	hashes = make([]string, 0, len(msgs))
+	seenHashes := make(map[string]struct{}, len(msgs))
+	for i := range msgs {
+		m := gjson.ParseBytes(msgs[i])
+		row := ToDeviceRow{
+			UserID:      userID,
+			DeviceID:    deviceID,
+			Message:     string(msgs[i]),
+			Type:        m.Get("type").Str,
+			Sender:      m.Get("sender").Str,
+			ContentHash: toDeviceContentHash(m),
+		}
+		if row.Type == "m.room_key_request" {
+			// these are deduplicated by their unique key instead, as a request may be cancelled
+			// and then made again
+			rows = append(rows, row)
+			continue
+		}
+		if _, seen := seenHashes[row.ContentHash]; seen {
+			logger.Debug().Str("user", userID).Str("device", deviceID).Str("type", row.Type).Str("sender", row.Sender).Msg("ToDeviceTable.InsertMessages: dropping duplicate message")
+			continue
+		}
+		seenHashes[row.ContentHash] = struct{}{}
+		hashes = append(hashes, row.ContentHash)
+		rows = append(rows, row)
+	}
+	return rows, hashes
+}
+
+// withoutStoredToDeviceRows drops the rows whose content hashes are in stored.
+func withoutStoredToDeviceRows(rows []ToDeviceRow, stored map[string]struct{}) []ToDeviceRow {
+	newRows := rows[:0]
+	for _, row := range rows {
+		if _, exists := stored[row.ContentHash]; exists {
+			logger.Debug().Str("user", row.UserID).Str("device", row.DeviceID).Str("type", row.Type).Str("sender", row.Sender).Msg("ToDeviceTable.InsertMessages: dropping message which is already stored")
+			continue
+		}
+		newRows = append(newRows, row)
+	}
+	return newRows
+}
+
+// setToDeviceActions sets the action and unique key of room key requests and cancellations. Returns
+// the unique keys of the cancellations, and the sets of unique keys which are requested and cancelled.
+func setToDeviceActions(userID, deviceID string, rows []ToDeviceRow) (cancels []string, allRequests, allCancels map[string]struct{}) {
+	allRequests = make(map[string]struct{})
+	allCancels = make(map[string]struct{})
+	for i := range rows {
+		m := gjson.Parse(rows[i].Message)
+		msgId := m.Get(`content.org\.matrix\.msgid`).Str
+		if msgId != "" {
+			logger.Debug().Str("msgid", msgId).Str("user", userID).Str("device", deviceID).Msg("ToDeviceTable.InsertMessages")
+		}
+		switch rows[i].Type {
+		case "m.room_key_request":
+			action := m.Get("content.action").Str
+			if action == "request" {
+				rows[i].Action = ActionRequest
+			} else if action == "request_cancellation" {
+				rows[i].Action = ActionCancel
+			}
+			// "the same request_id and requesting_device_id fields, sent by the same user."
+			key := fmt.Sprintf("%s-%s-%s-%s", rows[i].Type, rows[i].Sender, m.Get("content.requesting_device_id").Str, m.Get("content.request_id").Str)
+			rows[i].UniqueKey = &key
+		}
+		if rows[i].Action == ActionCancel && rows[i].UniqueKey != nil {
+			cancels = append(cancels, *rows[i].UniqueKey)
+			allCancels[*rows[i].UniqueKey] = struct{}{}
+		} else if rows[i].Action == ActionRequest && rows[i].UniqueKey != nil {
+			allRequests[*rows[i].UniqueKey] = struct{}{}
+		}
+	}
+	return cancels, allRequests, allCancels
+}
+
+// withoutCancelledToDeviceRows drops the cancellations of stored requests which were deleted, and
+// requests which are cancelled in the same batch.
+func withoutCancelledToDeviceRows(rows []ToDeviceRow, cancelledInDBSet, allRequests, allCancels map[string]struct{}) []ToDeviceRow {
+	// do not insert the cancelled unique keys
+	newRows := make([]ToDeviceRow, 0, len(rows))
+	for i := range rows {
+		if rows[i].UniqueKey != nil {
+			ukey := *rows[i].UniqueKey
+			_, exists := cancelledInDBSet[ukey]
+			if exists {
+				continue // the request was deleted so don't insert the cancel
+			}
+			// we may be requesting and cancelling in one go, check it and ignore if so
+			_, reqExists := allRequests[ukey]
+			_, cancelExists := allCancels[ukey]
+			if reqExists && cancelExists {
+				continue
+			}
+		}
+		newRows = append(newRows, rows[i])
+	}
+	return newRows
+}
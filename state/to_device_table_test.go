@@ -237,6 +237,142 @@ func TestToDeviceTableNoDeleteUnacks(t *testing.T) {
 	bytesEqual(t, gotMsgs[1], cancelEv)
 }
 
+// Test that acknowledging messages records the acked position and deletes them, and that the acked
+// position never goes backwards.
+func TestToDeviceTableAckPositions(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@TestToDeviceTableAckPositions:localhost"
+	deviceID := "ACK_DEVICE"
+	table := NewToDeviceTable(db)
+
+	ackPos, unackPos, err := table.AckPositions(userID, deviceID)
+	assertNoError(t, err)
+	if ackPos != 0 || unackPos != 0 {
+		t.Fatalf("got ack=%d unack=%d for unknown device, want 0,0", ackPos, unackPos)
+	}
+
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":1}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":2}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":3}}`),
+	}
+	_, err = table.InsertMessages(userID, deviceID, msgs)
+	assertNoError(t, err)
+	gotMsgs, upTo, err := table.Messages(userID, deviceID, 0, 2)
+	assertNoError(t, err)
+	if len(gotMsgs) != 2 {
+		t.Fatalf("got %d msgs, want 2", len(gotMsgs))
+	}
+	assertNoError(t, table.SetUnackedPosition(userID, deviceID, upTo))
+
+	ackPos, unackPos, err = table.AckPositions(userID, deviceID)
+	assertNoError(t, err)
+	if ackPos != 0 || unackPos != upTo {
+		t.Fatalf("got ack=%d unack=%d after sending, want 0,%d", ackPos, unackPos, upTo)
+	}
+
+	assertNoError(t, table.AckMessagesUpToAndIncluding(userID, deviceID, upTo))
+	ackPos, unackPos, err = table.AckPositions(userID, deviceID)
+	assertNoError(t, err)
+	if ackPos != upTo || unackPos != upTo {
+		t.Fatalf("got ack=%d unack=%d after acking, want %d,%d", ackPos, unackPos, upTo, upTo)
+	}
+	gotMsgs, _, err = table.Messages(userID, deviceID, 0, 10)
+	assertNoError(t, err)
+	if len(gotMsgs) != 1 {
+		t.Fatalf("got %d msgs after acking, want 1", len(gotMsgs))
+	}
+	bytesEqual(t, gotMsgs[0], msgs[2])
+
+	// acking an older position doesn't move the acked position backwards
+	assertNoError(t, table.AckMessagesUpToAndIncluding(userID, deviceID, upTo-1))
+	ackPos, _, err = table.AckPositions(userID, deviceID)
+	assertNoError(t, err)
+	if ackPos != upTo {
+		t.Fatalf("got ack=%d after acking an older position, want %d", ackPos, upTo)
+	}
+}
+
+// Test that the same message delivered twice is only stored once.
+func TestToDeviceTableDeduplicates(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@TestToDeviceTableDeduplicates:localhost"
+	deviceID := "DEDUPE_DEVICE"
+	table := NewToDeviceTable(db)
+
+	msg1 := json.RawMessage(`{"sender":"alice","type":"m.room.encrypted","content":{"ciphertext":"1"}}`)
+	msg2 := json.RawMessage(`{"sender":"alice","type":"m.room.encrypted","content":{"ciphertext":"2"}}`)
+	// same content from a different sender is a different message
+	msg3 := json.RawMessage(`{"sender":"bob","type":"m.room.encrypted","content":{"ciphertext":"1"}}`)
+
+	_, err := table.InsertMessages(userID, deviceID, []json.RawMessage{msg1, msg2, msg1})
+	assertNoError(t, err)
+	// an overlapping poll delivers them again
+	_, err = table.InsertMessages(userID, deviceID, []json.RawMessage{msg2, msg3})
+	assertNoError(t, err)
+
+	gotMsgs, _, err := table.Messages(userID, deviceID, 0, 10)
+	assertNoError(t, err)
+	if len(gotMsgs) != 3 {
+		t.Fatalf("got %d msgs, want 3: %v", len(gotMsgs), jsonArrStr(gotMsgs))
+	}
+	bytesEqual(t, gotMsgs[0], msg1)
+	bytesEqual(t, gotMsgs[1], msg2)
+	bytesEqual(t, gotMsgs[2], msg3)
+}
+
+func TestToDeviceTableMessagesWithinSize(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@TestToDeviceTableMessagesWithinSize:localhost"
+	deviceID := "SIZE_DEVICE"
+	table := NewToDeviceTable(db)
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":"111111111111111111111111111111"}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":"2"}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":"3"}}`),
+	}
+	_, err := table.InsertMessages(userID, deviceID, msgs)
+	assertNoError(t, err)
+
+	testCases := []struct {
+		name     string
+		limit    int64
+		maxBytes int
+		want     []json.RawMessage
+		wantMore bool
+	}{
+		{name: "no limits", limit: 10, want: msgs},
+		{name: "exact count", limit: 3, want: msgs},
+		{name: "count limited", limit: 2, want: msgs[:2], wantMore: true},
+		{name: "size limited", limit: 10, maxBytes: len(msgs[0]) + len(msgs[1]), want: msgs[:2], wantMore: true},
+		{name: "first message too big", limit: 10, maxBytes: 1, want: msgs[:1], wantMore: true},
+	}
+	for _, tc := range testCases {
+		got, upTo, more, err := table.MessagesWithinSize(userID, deviceID, 0, tc.limit, tc.maxBytes)
+		assertNoError(t, err)
+		if len(got) != len(tc.want) {
+			t.Fatalf("%s: got %d msgs, want %d", tc.name, len(got), len(tc.want))
+		}
+		for i := range got {
+			bytesEqual(t, got[i], tc.want[i])
+		}
+		if more != tc.wantMore {
+			t.Errorf("%s: got more=%v want %v", tc.name, more, tc.wantMore)
+		}
+		if tc.wantMore {
+			// the rest of the messages are returned from upTo
+			rest, _, _, err := table.MessagesWithinSize(userID, deviceID, upTo, 10, 0)
+			assertNoError(t, err)
+			if len(rest) != len(msgs)-len(got) {
+				t.Errorf("%s: got %d remaining msgs, want %d", tc.name, len(rest), len(msgs)-len(got))
+			}
+		}
+	}
+}
+
 // Guard against possible message truncation?
 func TestToDeviceTableBytesInEqualBytesOut(t *testing.T) {
 	db, close := connectToDB(t)
@@ -5,6 +5,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/internal"
 )
 
 type txnRow struct {
@@ -16,7 +17,8 @@ type txnRow struct {
 }
 
 type TransactionsTable struct {
-	db *sqlx.DB
+	db    *sqlx.DB
+	clock internal.Clock
 }
 
 func NewTransactionsTable(db *sqlx.DB) *TransactionsTable {
@@ -31,11 +33,11 @@ func NewTransactionsTable(db *sqlx.DB) *TransactionsTable {
 		UNIQUE(user_id, device_id, event_id)
 	);
 	`)
-	return &TransactionsTable{db}
+	return &TransactionsTable{db: db, clock: internal.RealClock}
 }
 
 func (t *TransactionsTable) Insert(userID, deviceID string, eventIDToTxnID map[string]string) error {
-	ts := time.Now()
+	ts := t.clock.Now()
 	rows := make([]txnRow, 0, len(eventIDToTxnID))
 	for eventID, txnID := range eventIDToTxnID {
 		rows = append(rows, txnRow{
@@ -2,16 +2,19 @@ package state
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
 // TypingTable stores who is currently typing
 // TODO: If 2 users are in the same room and 1 is on a laggy synchotron, we'll flip flop who is
 // typing with live / stale data. Maybe do this per user per room?
 type TypingTable struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	metrics sqlutil.TableMetrics
 }
 
 func NewTypingTable(db *sqlx.DB) *TypingTable {
@@ -24,10 +27,11 @@ func NewTypingTable(db *sqlx.DB) *TypingTable {
 		user_ids TEXT[] NOT NULL
 	);
 	`)
-	return &TypingTable{db}
+	return &TypingTable{db: db, metrics: sqlutil.NewTableMetrics("typing")}
 }
 
 func (t *TypingTable) SelectHighestID() (id int64, err error) {
+	defer t.metrics.Observe("SelectHighestID", time.Now())
 	var result sql.NullInt64
 	err = t.db.QueryRow(
 		`SELECT MAX(stream_id) FROM syncv3_typing`,
@@ -39,6 +43,7 @@ func (t *TypingTable) SelectHighestID() (id int64, err error) {
 }
 
 func (t *TypingTable) SetTyping(roomID string, userIDs []string) (position int64, err error) {
+	defer t.metrics.Observe("SetTyping", time.Now())
 	if userIDs == nil {
 		userIDs = []string{}
 	}
@@ -51,6 +56,7 @@ func (t *TypingTable) SetTyping(roomID string, userIDs []string) (position int64
 }
 
 func (t *TypingTable) Typing(roomID string, fromStreamIDExcl, toStreamIDIncl int64) (userIDs []string, latest int64, err error) {
+	defer t.metrics.Observe("Typing", time.Now())
 	var userIDsArray pq.StringArray
 	err = t.db.QueryRow(
 		`SELECT stream_id, user_ids FROM syncv3_typing WHERE room_id=$1 AND stream_id > $2 AND stream_id <= $3`,
@@ -0,0 +1,34 @@
+package sync2
+
+import (
+	"context"
+)
+
+// Authenticator identifies the user and device which own an access token, when the proxy sees a
+// token for the first time. Implementations must return HTTP401 (or HTTP401SoftLogout) for tokens
+// which aren't valid; other errors are treated as the authenticator being unavailable.
+//
+// Every Client is an Authenticator which asks the homeserver's /whoami, which is the default. The
+// identified token is still used to poll the homeserver, so it must be valid there too.
+type Authenticator interface {
+	WhoAmI(ctx context.Context, accessToken string) (userID, deviceID string, err error)
+}
+
+// StaticIdentity is the owner of an access token in a StaticAuthenticator.
+type StaticIdentity struct {
+	UserID   string
+	DeviceID string
+}
+
+// StaticAuthenticator identifies access tokens using a fixed map of access token to owner, which is
+// useful for tests and for deployments which provision tokens out of band. Tokens which aren't in
+// the map are rejected.
+type StaticAuthenticator map[string]StaticIdentity
+
+func (a StaticAuthenticator) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
+	id, ok := a[accessToken]
+	if !ok {
+		return "", "", HTTP401
+	}
+	return id.UserID, id.DeviceID, nil
+}
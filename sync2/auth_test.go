@@ -0,0 +1,22 @@
+package sync2
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStaticAuthenticator(t *testing.T) {
+	auth := StaticAuthenticator{
+		"alice_token": {UserID: "@alice:localhost", DeviceID: "ALICE"},
+	}
+	userID, deviceID, err := auth.WhoAmI(context.Background(), "alice_token")
+	if err != nil {
+		t.Fatalf("WhoAmI: %s", err)
+	}
+	if userID != "@alice:localhost" || deviceID != "ALICE" {
+		t.Errorf("got %s %s want @alice:localhost ALICE", userID, deviceID)
+	}
+	if _, _, err = auth.WhoAmI(context.Background(), "unknown"); err != HTTP401 {
+		t.Errorf("got err %v for unknown token, want HTTP401", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -20,6 +21,43 @@ const AccountDataGlobalRoom = ""
 var ProxyVersion = ""
 var HTTP401 error = fmt.Errorf("HTTP 401")
 
+// HTTP401SoftLogout is returned when the homeserver responds with a 401 with soft_logout set. The
+// access token is no longer valid, but the device still exists and can be logged back into.
+var HTTP401SoftLogout error = fmt.Errorf("HTTP 401 soft logout")
+
+// masqueradeSeparator joins an appservice token to the user ID it is masquerading as. Appservice
+// tokens are shared between all of the appservice's users, so the pair is treated as the access
+// token of each virtual user.
+const masqueradeSeparator = "?user_id="
+
+// AppserviceDeviceID is the device ID used for virtual users of appservices which do not
+// masquerade as a specific device.
+const AppserviceDeviceID = "_appservice"
+
+// MasqueradingToken returns the access token used to act as userID with this appservice token.
+func MasqueradingToken(asToken, userID string) string {
+	return asToken + masqueradeSeparator + userID
+}
+
+// MasqueradedUserID returns the user ID which this access token masquerades as, or "" if it was
+// not made with MasqueradingToken.
+func MasqueradedUserID(accessToken string) string {
+	_, userID, _ := strings.Cut(accessToken, masqueradeSeparator)
+	return userID
+}
+
+// setAuthorization authenticates this request with the access token, adding the user_id query
+// parameter for masquerading tokens.
+func setAuthorization(req *http.Request, accessToken string) {
+	asToken, userID, masquerading := strings.Cut(accessToken, masqueradeSeparator)
+	req.Header.Set("Authorization", "Bearer "+asToken)
+	if masquerading {
+		query := req.URL.Query()
+		query.Set("user_id", userID)
+		req.URL.RawQuery = query.Encode()
+	}
+}
+
 type Client interface {
 	// Versions fetches and parses the list of Matrix versions that the homeserver
 	// advertises itself as supporting.
@@ -29,6 +67,22 @@ type Client interface {
 	// homeserver supports Matrix >= 1.1.)
 	WhoAmI(ctx context.Context, accessToken string) (userID, deviceID string, err error)
 	DoSyncV2(ctx context.Context, accessToken, since string, isFirst bool, toDeviceOnly bool) (*SyncResponse, int, error)
+	// Messages paginates backwards through a room's timeline from the `from` token using the CSAPI
+	// /messages endpoint, returning up to `limit` events.
+	Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error)
+	// RoomState fetches the current state of a room using the CSAPI /rooms/{roomId}/state endpoint.
+	RoomState(ctx context.Context, accessToken, roomID string) ([]json.RawMessage, error)
+	// RoomSummary fetches a summary of a room, which the user need not be joined to, using the
+	// room summary API (MSC3266).
+	RoomSummary(ctx context.Context, accessToken, roomID string) (json.RawMessage, error)
+}
+
+// MessagesResponse is a response to /messages with dir=b.
+type MessagesResponse struct {
+	// Chunk contains the events, newest first.
+	Chunk []json.RawMessage `json:"chunk"`
+	// End is the token to paginate further back from. Empty if there are no older events.
+	End string `json:"end"`
 }
 
 // HTTPClient represents a Sync v2 Client.
@@ -86,20 +140,25 @@ func (v *HTTPClient) Versions(ctx context.Context) ([]string, error) {
 	return parsedRes.Result, nil
 }
 
-// Return sync2.HTTP401 if this request returns 401
+// Return sync2.HTTP401 if this request returns 401, or sync2.HTTP401SoftLogout if the device
+// has been soft logged out.
 func (v *HTTPClient) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", v.DestinationServer+"/_matrix/client/r0/account/whoami", nil)
 	if err != nil {
 		return "", "", err
 	}
 	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+	setAuthorization(req, accessToken)
 	res, err := v.Client.Do(req)
 	if err != nil {
 		return "", "", err
 	}
 	if res.StatusCode != 200 {
 		if res.StatusCode == 401 {
+			defer res.Body.Close()
+			if isSoftLogout(res.Body) {
+				return "", "", HTTP401SoftLogout
+			}
 			return "", "", HTTP401
 		}
 		return "", "", fmt.Errorf("/whoami returned HTTP %d", res.StatusCode)
@@ -118,11 +177,11 @@ func (v *HTTPClient) WhoAmI(ctx context.Context, accessToken string) (string, st
 func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
 	syncURL := v.createSyncURL(since, isFirst, toDeviceOnly)
 	req, err := http.NewRequestWithContext(ctx, "GET", syncURL, nil)
-	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
-	req.Header.Set("Authorization", "Bearer "+accessToken)
 	if err != nil {
 		return nil, 0, fmt.Errorf("DoSyncV2: NewRequest failed: %w", err)
 	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	setAuthorization(req, accessToken)
 	var res *http.Response
 	if isFirst {
 		res, err = v.LongTimeoutClient.Do(req)
@@ -132,6 +191,7 @@ func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, is
 	if err != nil {
 		return nil, 0, fmt.Errorf("DoSyncV2: request failed: %w", err)
 	}
+	defer res.Body.Close()
 	switch res.StatusCode {
 	case 200:
 		var svr SyncResponse
@@ -139,11 +199,114 @@ func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, is
 			return nil, 0, fmt.Errorf("DoSyncV2: response body decode JSON failed: %w", err)
 		}
 		return &svr, 200, nil
+	case 401:
+		if isSoftLogout(res.Body) {
+			return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s: %w", res.Status, HTTP401SoftLogout)
+		}
+		return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s", res.Status)
 	default:
 		return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s", res.Status)
 	}
 }
 
+func (v *HTTPClient) Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error) {
+	qps := url.Values{
+		"dir":   []string{"b"},
+		"from":  []string{from},
+		"limit": []string{fmt.Sprintf("%d", limit)},
+	}
+	messagesURL := v.DestinationServer + "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/messages?" + qps.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", messagesURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Messages: NewRequest failed: %w", err)
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	setAuthorization(req, accessToken)
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Messages: request failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Messages: response returned %s", res.Status)
+	}
+	var messages MessagesResponse
+	if err := json.NewDecoder(res.Body).Decode(&messages); err != nil {
+		return nil, fmt.Errorf("Messages: response body decode JSON failed: %w", err)
+	}
+	return &messages, nil
+}
+
+func (v *HTTPClient) RoomState(ctx context.Context, accessToken, roomID string) ([]json.RawMessage, error) {
+	stateURL := v.DestinationServer + "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/state"
+	req, err := http.NewRequestWithContext(ctx, "GET", stateURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("RoomState: NewRequest failed: %w", err)
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	setAuthorization(req, accessToken)
+	res, err := v.LongTimeoutClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("RoomState: request failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("RoomState: response returned %s", res.Status)
+	}
+	var state []json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&state); err != nil {
+		return nil, fmt.Errorf("RoomState: response body decode JSON failed: %w", err)
+	}
+	return state, nil
+}
+
+func (v *HTTPClient) RoomSummary(ctx context.Context, accessToken, roomID string) (json.RawMessage, error) {
+	summaryURLs := []string{
+		v.DestinationServer + "/_matrix/client/v1/room_summary/" + url.PathEscape(roomID),
+		// homeservers which predate the stable endpoint
+		v.DestinationServer + "/_matrix/client/unstable/im.nheko.summary/summary/" + url.PathEscape(roomID),
+	}
+	for _, summaryURL := range summaryURLs {
+		req, err := http.NewRequestWithContext(ctx, "GET", summaryURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("RoomSummary: NewRequest failed: %w", err)
+		}
+		req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+		setAuthorization(req, accessToken)
+		res, err := v.Client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("RoomSummary: request failed: %w", err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("RoomSummary: failed to read response body: %w", err)
+		}
+		switch res.StatusCode {
+		case 200:
+			if !gjson.ValidBytes(body) || !gjson.ParseBytes(body).IsObject() {
+				return nil, fmt.Errorf("RoomSummary: response body is not a JSON object")
+			}
+			return body, nil
+		case 404:
+			// either the endpoint or the room is unknown, so try the next endpoint
+			continue
+		default:
+			return nil, fmt.Errorf("RoomSummary: response returned %s", res.Status)
+		}
+	}
+	return nil, fmt.Errorf("RoomSummary: room summary is not available")
+}
+
+// isSoftLogout returns true if this error response body has soft_logout set.
+func isSoftLogout(body io.Reader) bool {
+	b, err := io.ReadAll(io.LimitReader(body, 64*1024))
+	if err != nil {
+		return false
+	}
+	return gjson.GetBytes(b, "soft_logout").Bool()
+}
+
 func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) string {
 	qps := "?"
 	if isFirst { // first time polling for v2-sync in this process
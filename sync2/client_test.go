@@ -1,8 +1,13 @@
 package sync2
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSyncURL(t *testing.T) {
@@ -79,3 +84,137 @@ func TestSyncURL(t *testing.T) {
 		}
 	}
 }
+
+func TestSetAuthorizationMasquerading(t *testing.T) {
+	testCases := []struct {
+		accessToken string
+		wantAuth    string
+		wantQuery   url.Values
+	}{
+		{
+			accessToken: "syt_token",
+			wantAuth:    "Bearer syt_token",
+			wantQuery:   url.Values{"since": {"s1"}},
+		},
+		{
+			accessToken: MasqueradingToken("as_token", "@_bridge_alice:example.com"),
+			wantAuth:    "Bearer as_token",
+			wantQuery:   url.Values{"since": {"s1"}, "user_id": {"@_bridge_alice:example.com"}},
+		},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest("GET", "https://example.com/_matrix/client/r0/sync?since=s1", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		setAuthorization(req, tc.accessToken)
+		if got := req.Header.Get("Authorization"); got != tc.wantAuth {
+			t.Errorf("%s: got Authorization %q want %q", tc.accessToken, got, tc.wantAuth)
+		}
+		if got := req.URL.Query(); !reflect.DeepEqual(got, tc.wantQuery) {
+			t.Errorf("%s: got query %v want %v", tc.accessToken, got, tc.wantQuery)
+		}
+	}
+	if got := MasqueradedUserID(MasqueradingToken("as_token", "@alice:example.com")); got != "@alice:example.com" {
+		t.Errorf("MasqueradedUserID: got %q", got)
+	}
+	if got := MasqueradedUserID("syt_token"); got != "" {
+		t.Errorf("MasqueradedUserID: got %q for a normal token", got)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.EscapedPath() != "/_matrix/client/v3/rooms/%21room:localhost/messages" {
+			t.Errorf("got path %s", req.URL.EscapedPath())
+		}
+		want := url.Values{"dir": {"b"}, "from": {"prev_1"}, "limit": {"5"}}
+		if got := req.URL.Query(); !reflect.DeepEqual(got, want) {
+			t.Errorf("got query %v want %v", got, want)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer syt_token" {
+			t.Errorf("got Authorization %q", got)
+		}
+		w.Write([]byte(`{"chunk":[{"event_id":"$b"},{"event_id":"$a"}],"start":"prev_1","end":"prev_0"}`))
+	}))
+	defer srv.Close()
+	client := NewHTTPClient(time.Second, time.Second, srv.URL)
+	res, err := client.Messages(context.Background(), "syt_token", "!room:localhost", "prev_1", 5)
+	if err != nil {
+		t.Fatalf("Messages returned error: %s", err)
+	}
+	if len(res.Chunk) != 2 || string(res.Chunk[0]) != `{"event_id":"$b"}` || res.End != "prev_0" {
+		t.Errorf("got response %+v", res)
+	}
+}
+
+func TestRoomState(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.EscapedPath() != "/_matrix/client/v3/rooms/%21room:localhost/state" {
+			t.Errorf("got path %s", req.URL.EscapedPath())
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer syt_token" {
+			t.Errorf("got Authorization %q", got)
+		}
+		if req.URL.Query().Get("user_id") == "nobody" {
+			w.WriteHeader(403)
+			return
+		}
+		w.Write([]byte(`[{"type":"m.room.create","state_key":""},{"type":"m.room.name","state_key":""}]`))
+	}))
+	defer srv.Close()
+	client := NewHTTPClient(time.Second, time.Second, srv.URL)
+	state, err := client.RoomState(context.Background(), "syt_token", "!room:localhost")
+	if err != nil {
+		t.Fatalf("RoomState returned error: %s", err)
+	}
+	if len(state) != 2 || string(state[1]) != `{"type":"m.room.name","state_key":""}` {
+		t.Errorf("got state %s", state)
+	}
+	if _, err = client.RoomState(context.Background(), MasqueradingToken("syt_token", "nobody"), "!room:localhost"); err == nil {
+		t.Errorf("RoomState returned no error for HTTP 403")
+	}
+}
+
+func TestRoomSummary(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.EscapedPath())
+		switch req.URL.EscapedPath() {
+		case "/_matrix/client/v1/room_summary/%21stable:localhost":
+			w.Write([]byte(`{"room_id":"!stable:localhost","num_joined_members":3}`))
+		case "/_matrix/client/unstable/im.nheko.summary/summary/%21unstable:localhost":
+			w.Write([]byte(`{"room_id":"!unstable:localhost","name":"Unstable"}`))
+		case "/_matrix/client/v1/room_summary/%21broken:localhost":
+			w.WriteHeader(500)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+	client := NewHTTPClient(time.Second, time.Second, srv.URL)
+	testCases := []struct {
+		roomID    string
+		wantBody  string
+		wantPaths int
+	}{
+		{roomID: "!stable:localhost", wantBody: `{"room_id":"!stable:localhost","num_joined_members":3}`, wantPaths: 1},
+		{roomID: "!unstable:localhost", wantBody: `{"room_id":"!unstable:localhost","name":"Unstable"}`, wantPaths: 2},
+		{roomID: "!unknown:localhost", wantPaths: 2},
+		{roomID: "!broken:localhost", wantPaths: 1},
+	}
+	for _, tc := range testCases {
+		paths = nil
+		summary, err := client.RoomSummary(context.Background(), "syt_token", tc.roomID)
+		if tc.wantBody == "" {
+			if err == nil {
+				t.Errorf("%s: RoomSummary returned no error", tc.roomID)
+			}
+		} else if err != nil || string(summary) != tc.wantBody {
+			t.Errorf("%s: RoomSummary got %s, %v want %s", tc.roomID, summary, err, tc.wantBody)
+		}
+		if len(paths) != tc.wantPaths {
+			t.Errorf("%s: made requests to %v, want %d requests", tc.roomID, paths, tc.wantPaths)
+		}
+	}
+}
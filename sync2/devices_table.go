@@ -47,6 +47,16 @@ func (t *DevicesTable) UpdateDeviceSince(userID, deviceID, since string) error {
 	return err
 }
 
+// ResetSinceForUser clears the since token for all of the user's devices, so their pollers start
+// again with an initial sync. Returns the number of devices reset.
+func (t *DevicesTable) ResetSinceForUser(userID string) (int64, error) {
+	res, err := t.db.Exec(`UPDATE syncv3_sync2_devices SET since = '' WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 // FindOldDevices fetches the user_id and device_id of all devices which haven't /synced
 // for at least as long as the given inactivityPeriod. Such devices are returned in
 // no particular order.
@@ -65,3 +75,22 @@ func (t *DevicesTable) FindOldDevices(inactivityPeriod time.Duration) (devices [
 	)
 	return
 }
+
+// DeviceActivity is a device along with a summary of the access tokens held for it.
+type DeviceActivity struct {
+	Device
+	NumTokens int        `db:"num_tokens"`
+	LastSeen  *time.Time `db:"last_seen"` // nil if there are no tokens for this device
+}
+
+// DevicesForUser returns all devices the proxy knows about for this user, sorted by device ID.
+func (t *DevicesTable) DevicesForUser(userID string) (devices []DeviceActivity, err error) {
+	err = t.db.Select(&devices, `
+		SELECT user_id, device_id, since, COUNT(token_hash) AS num_tokens, MAX(last_seen) AS last_seen
+		FROM syncv3_sync2_devices LEFT JOIN syncv3_sync2_tokens USING(user_id, device_id)
+		WHERE user_id = $1
+		GROUP BY user_id, device_id, since
+		ORDER BY device_id
+	`, userID)
+	return
+}
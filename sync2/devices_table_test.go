@@ -252,3 +252,52 @@ func TestDevicesTable_FindOldDevices(t *testing.T) {
 		t.Errorf("Got %+v, but expected %v+", oldDevices, expectedDevices)
 	}
 }
+
+func TestDevicesTable_DevicesForUser(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	tokens := NewTokensTable(db, "my_secret")
+	devices := NewDevicesTable(db)
+
+	alice := "@TestDevicesTable_DevicesForUser_alice:test"
+	bob := "@TestDevicesTable_DevicesForUser_bob:test"
+	newest := time.Now().Truncate(time.Second)
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		for _, d := range []Device{{alice, "no_tokens", ""}, {alice, "two_tokens", ""}, {bob, "bobs_device", ""}} {
+			if err := devices.InsertDevice(txn, d.UserID, d.DeviceID); err != nil {
+				return err
+			}
+		}
+		if _, err := tokens.Insert(txn, "TestDevicesTable_DevicesForUser_1", alice, "two_tokens", newest.Add(-time.Hour)); err != nil {
+			return err
+		}
+		if _, err := tokens.Insert(txn, "TestDevicesTable_DevicesForUser_2", alice, "two_tokens", newest); err != nil {
+			return err
+		}
+		_, err := tokens.Insert(txn, "TestDevicesTable_DevicesForUser_3", bob, "bobs_device", newest)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to insert devices: %s", err)
+	}
+	if err = devices.UpdateDeviceSince(alice, "two_tokens", "s1"); err != nil {
+		t.Fatalf("UpdateDeviceSince: %s", err)
+	}
+
+	got, err := devices.DevicesForUser(alice)
+	if err != nil {
+		t.Fatalf("DevicesForUser: %s", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("DevicesForUser: got %d devices, want 2: %+v", len(got), got)
+	}
+	if got[0].DeviceID != "no_tokens" || got[0].NumTokens != 0 || got[0].LastSeen != nil {
+		t.Errorf("DevicesForUser: got %+v for device without tokens", got[0])
+	}
+	if got[1].DeviceID != "two_tokens" || got[1].NumTokens != 2 || got[1].Since != "s1" {
+		t.Errorf("DevicesForUser: got %+v for device with tokens", got[1])
+	}
+	if got[1].LastSeen == nil || !got[1].LastSeen.Equal(newest) {
+		t.Errorf("DevicesForUser: got last seen %v want %v", got[1].LastSeen, newest)
+	}
+}
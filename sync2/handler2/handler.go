@@ -2,16 +2,13 @@ package handler2
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
-	"os"
 	"sync"
 	"time"
 
-	"github.com/jmoiron/sqlx"
-	"github.com/matrix-org/sliding-sync/sqlutil"
-
 	"github.com/getsentry/sentry-go"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -19,50 +16,95 @@ import (
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger()
+
+// Store is the storage which the v2 handler writes what the pollers receive to. Implemented by
+// state.Storage and state.MemoryStorage.
+type Store interface {
+	// Accumulate stores new timeline events, returning the NIDs of events which weren't seen before.
+	Accumulate(userID, roomID string, timeline sync2.TimelineResponse) (state.AccumulateResult, error)
+	// Initialise stores the state of a room, creating a snapshot if the room is new.
+	Initialise(roomID string, roomState []json.RawMessage) (state.InitialiseResult, error)
+	FetchMemberships(roomID string) (joins, invites, leaves []string, err error)
+	InsertAccountData(userID, roomID string, events []json.RawMessage) ([]state.AccountData, error)
+	UpsertDeviceData(userID, deviceID string, keys internal.DeviceKeyData, deviceListChanges map[string]int) error
+	InsertTransactionIDs(userID, deviceID string, eventIDToTxnID map[string]string) error
+	EventNIDsByIDs(eventIDs []string) (map[string]int64, error)
+	IsReadUpTo(roomID, userID, eventID string) (bool, error)
+	InsertReceipts(roomID string, ephEvent json.RawMessage) ([]internal.Receipt, error)
+	UnreadCounters(userID, roomID string) (highlightCount, notificationCount int, err error)
+	UpdateUnreadCounters(userID, roomID string, highlightCount, notificationCount *int) error
+	InsertToDeviceMessages(userID, deviceID string, msgs []json.RawMessage) (int64, error)
+	InsertInvite(userID, roomID string, inviteRoomState []json.RawMessage) error
+	UpdateInviteState(userID, roomID string, inviteRoomState []json.RawMessage) (bool, error)
+	RemoveInvite(userID, roomID string) error
+	// Cleaner periodically removes data which is no longer needed, every n until Teardown.
+	Cleaner(n time.Duration)
+	Teardown()
+}
+
+// V2Store is the storage of access tokens and since tokens used to run pollers. Implemented by
+// sync2.Storage and sync2.MemoryStore.
+type V2Store interface {
+	TokenForEachDevice() ([]sync2.TokenForPoller, error)
+	// LatestTokenForUsers returns the most recently seen token of any of the users, or sql.ErrNoRows.
+	LatestTokenForUsers(userIDs []string) (*sync2.Token, error)
+	GetTokenAndSince(userID, deviceID, tokenHash string) (accessToken, since string, err error)
+	DeleteToken(accessTokenHash string) error
+	UpdateDeviceSince(userID, deviceID, since string) error
+	ResetSinceForUser(userID string) (int64, error)
+	FindOldDevices(inactivityPeriod time.Duration) ([]sync2.Device, error)
+	Teardown()
+}
 
 // Handler is responsible for starting v2 pollers at startup;
 // processing v2 data (as a sync2.V2DataReceiver) and publishing updates (pubsub.Payload to V2Listeners);
 // and receiving and processing EnsurePolling events.
 type Handler struct {
-	pMap    sync2.IPollerMap
-	v2Store *sync2.Storage
-	Store   *state.Storage
-	v2Pub   pubsub.Notifier
-	v3Sub   *pubsub.V3Sub
+	pMap     sync2.IPollerMap
+	v2Client sync2.Client
+	v2Store  V2Store
+	Store    Store
+	v2Pub    pubsub.Notifier
+	v3Sub    *pubsub.V3Sub
 	// user_id|room_id|event_type => fnv_hash(last_event_bytes)
 	accountDataMap *sync.Map
 	unreadMap      map[string]struct {
 		Highlight int
 		Notif     int
 	}
+	unreadMu *sync.Mutex
 	// room_id -> PollerID, stores which Poller is allowed to update typing notifications
 	typingHandler map[string]sync2.PollerID
 	typingMu      *sync.Mutex
 	PendingTxnIDs *sync2.PendingTransactionIDs
+	// room_id -> rooms whose timelines were ignored as the proxy has no state for them
+	stateBackfills   map[string]*stateBackfill
+	stateBackfillsMu *sync.Mutex
+	// if true, fetch the homeserver's room summary for invites which lack a name
+	inviteSummaries bool
 
 	deviceDataTicker   *sync2.DeviceDataTicker
 	pollerExpiryTicker *time.Ticker
 	e2eeWorkerPool     *internal.WorkerPool
 
-	numPollers prometheus.Gauge
-	subSystem  string
+	numPollers         prometheus.Gauge
+	numDuplicateEvents prometheus.Counter
+	subSystem          string
 }
 
 func NewHandler(
-	pMap sync2.IPollerMap, v2Store *sync2.Storage, store *state.Storage,
+	pMap sync2.IPollerMap, v2Client sync2.Client, v2Store V2Store, store Store,
 	pub pubsub.Notifier, sub pubsub.Listener, enablePrometheus bool, deviceDataUpdateDuration time.Duration,
+	inviteSummaries bool,
 ) (*Handler, error) {
 	h := &Handler{
 		pMap:      pMap,
+		v2Client:  v2Client,
 		v2Store:   v2Store,
 		Store:     store,
 		subSystem: "poller",
@@ -72,7 +114,11 @@ func NewHandler(
 		}),
 		accountDataMap:   &sync.Map{},
 		typingMu:         &sync.Mutex{},
+		unreadMu:         &sync.Mutex{},
 		typingHandler:    make(map[string]sync2.PollerID),
+		stateBackfills:   make(map[string]*stateBackfill),
+		stateBackfillsMu: &sync.Mutex{},
+		inviteSummaries:  inviteSummaries,
 		PendingTxnIDs:    sync2.NewPendingTransactionIDs(pMap.DeviceIDs),
 		deviceDataTicker: sync2.NewDeviceDataTicker(deviceDataUpdateDuration),
 		e2eeWorkerPool:   internal.NewWorkerPool(500), // TODO: assign as fraction of db max conns, not hardcoded
@@ -105,6 +151,11 @@ func (h *Handler) Listen() {
 	go h.deviceDataTicker.Run()
 }
 
+// PollerStatuses returns what each of this user's pollers is doing.
+func (h *Handler) PollerStatuses(userID string) []sync2.PollerStatus {
+	return h.pMap.Statuses(userID)
+}
+
 func (h *Handler) Teardown() {
 	// stop polling and tear down DB conns
 	h.v3Sub.Teardown()
@@ -119,10 +170,13 @@ func (h *Handler) Teardown() {
 	if h.numPollers != nil {
 		prometheus.Unregister(h.numPollers)
 	}
+	if h.numDuplicateEvents != nil {
+		prometheus.Unregister(h.numDuplicateEvents)
+	}
 }
 
 func (h *Handler) StartV2Pollers() {
-	tokens, err := h.v2Store.TokensTable.TokenForEachDevice(nil)
+	tokens, err := h.v2Store.TokenForEachDevice()
 	if err != nil {
 		logger.Err(err).Msg("StartV2Pollers: failed to query tokens")
 		sentry.CaptureException(err)
@@ -183,28 +237,38 @@ func (h *Handler) updateMetrics() {
 	h.numPollers.Set(float64(h.pMap.NumPollers()))
 }
 
-func (h *Handler) OnTerminated(ctx context.Context, pollerID sync2.PollerID) {
+func (h *Handler) OnTerminated(ctx context.Context, pollerID sync2.PollerID, unexpected bool) {
 	// Check if this device is handling any typing notifications, of so, remove it
 	h.typingMu.Lock()
-	defer h.typingMu.Unlock()
 	for roomID, devID := range h.typingHandler {
 		if devID == pollerID {
 			delete(h.typingHandler, roomID)
 		}
 	}
+	h.typingMu.Unlock()
 	h.updateMetrics()
+	if unexpected {
+		// Nothing is polling this device any more, so its connections would silently stop getting
+		// to-device messages. Notify v3 side so it can close them and poll again.
+		logger.Warn().Str("user", pollerID.UserID).Str("device", pollerID.DeviceID).Msg("V2: poller died")
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2PollerDied{
+			UserID:   pollerID.UserID,
+			DeviceID: pollerID.DeviceID,
+		})
+	}
 }
 
-func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
-	err := h.v2Store.TokensTable.Delete(accessTokenHash)
+func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+	err := h.v2Store.DeleteToken(accessTokenHash)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("device", deviceID).Str("access_token_hash", accessTokenHash).Msg("V2: failed to expire token")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 	}
 	// Notify v3 side so it can remove the connection from ConnMap
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ExpiredToken{
-		UserID:   userID,
-		DeviceID: deviceID,
+		UserID:     userID,
+		DeviceID:   deviceID,
+		SoftLogout: softLogout,
 	})
 }
 
@@ -216,11 +280,18 @@ func (h *Handler) addPrometheusMetrics() {
 		Help:      "Number of active sync v2 pollers.",
 	})
 	prometheus.MustRegister(h.numPollers)
+	h.numDuplicateEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "num_duplicate_events",
+		Help:      "Number of sync v2 timeline events ignored because they were already known.",
+	})
+	prometheus.MustRegister(h.numDuplicateEvents)
 }
 
 // Emits nothing as no downstream components need it.
 func (h *Handler) UpdateDeviceSince(ctx context.Context, userID, deviceID, since string) {
-	err := h.v2Store.DevicesTable.UpdateDeviceSince(userID, deviceID, since)
+	err := h.v2Store.UpdateDeviceSince(userID, deviceID, since)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("device", deviceID).Str("since", since).Msg("V2: failed to persist since token")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -232,7 +303,7 @@ func (h *Handler) OnE2EEData(ctx context.Context, userID, deviceID string, otkCo
 	wg.Add(1)
 	h.e2eeWorkerPool.Queue(func() {
 		defer wg.Done()
-		err := h.Store.DeviceDataTable.Upsert(userID, deviceID, internal.DeviceKeyData{
+		err := h.Store.UpsertDeviceData(userID, deviceID, internal.DeviceKeyData{
 			OTKCounts:        otkCounts,
 			FallbackKeyTypes: fallbackKeyTypes,
 		}, deviceListChanges)
@@ -264,11 +335,14 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 	// Also remember events which were sent by this user but lack a transaction ID.
 	eventIDsLackingTxns := make([]string, 0, len(timeline.Events))
 
+	receivedAt := time.Now()
 	for i := range timeline.Events {
 		// Delete MSC4115 field as it isn't accurate when we reuse the same event for >1 user
 		timeline.Events[i], _ = sjson.DeleteBytes(timeline.Events[i], "unsigned.membership")
 		// escape .'s in the key name
 		timeline.Events[i], _ = sjson.DeleteBytes(timeline.Events[i], `unsigned.io\.element\.msc4115\.membership`)
+		// the age is relative to now, so store when the event was created instead
+		timeline.Events[i] = internal.WithAgeTS(timeline.Events[i], receivedAt)
 		parsed := gjson.ParseBytes(timeline.Events[i])
 		eventID := parsed.Get("event_id").Str
 
@@ -285,7 +359,7 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 
 	if len(eventIDToTxnID) > 0 {
 		// persist the txn IDs
-		err := h.Store.TransactionsTable.Insert(userID, deviceID, eventIDToTxnID)
+		err := h.Store.InsertTransactionIDs(userID, deviceID, eventIDToTxnID)
 		if err != nil {
 			logger.Err(err).Str("user", userID).Str("device", deviceID).Int("num_txns", len(eventIDToTxnID)).Msg("failed to persist txn IDs for user")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -299,6 +373,13 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return err
 	}
+	if accResult.NumDuplicates > 0 && h.numDuplicateEvents != nil {
+		h.numDuplicateEvents.Add(float64(accResult.NumDuplicates))
+	}
+	if accResult.MissingSnapshot {
+		// This user is in the room, so the homeserver will give us its state with their token.
+		h.queueMissingRoomState(roomID, userID, deviceID, timeline)
+	}
 
 	// Consumers should reload state content before processing new timeline events.
 	if accResult.IncludesStateRedaction {
@@ -310,9 +391,10 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 	// We've updated the database. Now tell any pubsub listeners what we learned.
 	if accResult.NumNew != 0 {
 		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Accumulate{
-			RoomID:    roomID,
-			PrevBatch: timeline.PrevBatch,
-			EventNIDs: accResult.TimelineNIDs,
+			RoomID:      roomID,
+			PrevBatch:   timeline.PrevBatch,
+			EventNIDs:   accResult.TimelineNIDs,
+			CommittedAt: time.Now(),
 		})
 	}
 
@@ -323,10 +405,7 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 		// all events with txnIDs.
 		var nidsByIDs map[string]int64
 		eventIDsToFetch := append(eventIDsWithTxns, eventIDsLackingTxns...)
-		err = sqlutil.WithTransaction(h.Store.DB, func(txn *sqlx.Tx) error {
-			nidsByIDs, err = h.Store.EventsTable.SelectNIDsByIDs(txn, eventIDsToFetch)
-			return err
-		})
+		nidsByIDs, err = h.Store.EventNIDsByIDs(eventIDsToFetch)
 		if err != nil {
 			logger.Err(err).
 				Int("timeline", len(timeline.Events)).
@@ -369,10 +448,13 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 }
 
 func (h *Handler) Initialise(ctx context.Context, roomID string, state []json.RawMessage) error {
+	receivedAt := time.Now()
 	for i := range state { // Delete MSC4115 field as it isn't accurate when we reuse the same event for >1 user
 		state[i], _ = sjson.DeleteBytes(state[i], "unsigned.membership")
 		// escape .'s in the key name
 		state[i], _ = sjson.DeleteBytes(state[i], `unsigned.io\.element\.msc4115\.membership`)
+		// the age is relative to now, so store when the event was created instead
+		state[i] = internal.WithAgeTS(state[i], receivedAt)
 	}
 	res, err := h.Store.Initialise(roomID, state)
 	if err != nil {
@@ -393,6 +475,135 @@ func (h *Handler) Initialise(ctx context.Context, roomID string, state []json.Ra
 	return nil
 }
 
+// BackfillRoomState repairs the proxy's state for a room by fetching its current state from the
+// homeserver with the token of one of the given users, or of any joined member if none are given,
+// and merging in any state events the proxy didn't know about. Returns whose token was used and
+// how many state events were fetched.
+func (h *Handler) BackfillRoomState(ctx context.Context, roomID string, userIDs []string) (usedUserID string, numStateEvents int, err error) {
+	if len(userIDs) == 0 {
+		userIDs, _, _, err = h.Store.FetchMemberships(roomID)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to load members of %s: %w", roomID, err)
+		}
+		if len(userIDs) == 0 {
+			return "", 0, fmt.Errorf("no joined members of %s are known, specify a user to fetch the state as", roomID)
+		}
+	}
+	token, err := h.v2Store.LatestTokenForUsers(userIDs)
+	if err == sql.ErrNoRows {
+		return "", 0, fmt.Errorf("none of the users have used the proxy, so there is no token to fetch the state of %s with", roomID)
+	} else if err != nil {
+		return "", 0, fmt.Errorf("failed to load token: %w", err)
+	}
+	roomState, err := h.v2Client.RoomState(ctx, token.AccessToken, roomID)
+	if err != nil {
+		return token.UserID, 0, err
+	}
+	if err = h.Initialise(ctx, roomID, roomState); err != nil {
+		return token.UserID, len(roomState), err
+	}
+	logger.Info().Str("room", roomID).Str("user", token.UserID).Int("state", len(roomState)).Msg("V2: backfilled room state")
+	return token.UserID, len(roomState), nil
+}
+
+const (
+	// the most ignored timelines kept per room to replay once its state has been fetched
+	maxIgnoredTimelines = 10
+	// how long to wait before fetching a room's state again after failing, doubling each time
+	stateBackfillMinBackoff = 30 * time.Second
+	stateBackfillMaxBackoff = time.Hour
+)
+
+// stateBackfill tracks fetching the state of a room whose timelines were ignored because the proxy
+// had no state for it.
+type stateBackfill struct {
+	inProgress bool
+	failures   int
+	retryAfter time.Time
+	// ignored timelines in the order they were received, replayed once the room has state
+	timelines []ignoredTimeline
+}
+
+type ignoredTimeline struct {
+	userID   string
+	deviceID string
+	timeline sync2.TimelineResponse
+}
+
+// queueMissingRoomState keeps a timeline which was ignored because the proxy has no state for the
+// room, and starts fetching the room's state unless that is already happening or recently failed.
+func (h *Handler) queueMissingRoomState(roomID, userID, deviceID string, timeline sync2.TimelineResponse) {
+	h.stateBackfillsMu.Lock()
+	defer h.stateBackfillsMu.Unlock()
+	b := h.stateBackfills[roomID]
+	if b == nil {
+		b = &stateBackfill{}
+		h.stateBackfills[roomID] = b
+	}
+	if len(b.timelines) < maxIgnoredTimelines {
+		b.timelines = append(b.timelines, ignoredTimeline{userID: userID, deviceID: deviceID, timeline: timeline})
+	}
+	if b.inProgress || time.Now().Before(b.retryAfter) {
+		return
+	}
+	b.inProgress = true
+	go h.backfillMissingRoomState(roomID, userID)
+}
+
+// backfillMissingRoomState fetches the state of a room then replays the timelines which were
+// ignored whilst it had none. Failures are retried with exponential backoff when the room's next
+// timeline arrives.
+func (h *Handler) backfillMissingRoomState(roomID, userID string) {
+	defer internal.ReportPanicsToSentry()
+	ctx := context.Background()
+	_, _, err := h.BackfillRoomState(ctx, roomID, []string{userID})
+	h.stateBackfillsMu.Lock()
+	b := h.stateBackfills[roomID]
+	if err != nil {
+		b.inProgress = false
+		backoff := h.recordStateBackfillFailure(b)
+		h.stateBackfillsMu.Unlock()
+		logger.Warn().Err(err).Str("room", roomID).Str("user", userID).Dur("retry_after", backoff).Msg("V2: failed to backfill missing room state")
+		return
+	}
+	timelines := b.timelines
+	b.timelines = nil
+	h.stateBackfillsMu.Unlock()
+
+	// Timelines which are still ignored are queued up again, but not fetched whilst inProgress is set.
+	for _, t := range timelines {
+		if err := h.Accumulate(ctx, t.userID, t.deviceID, roomID, t.timeline); err != nil {
+			logger.Warn().Err(err).Str("room", roomID).Str("user", t.userID).Msg("V2: failed to replay timeline after backfilling room state")
+		}
+	}
+
+	h.stateBackfillsMu.Lock()
+	defer h.stateBackfillsMu.Unlock()
+	b.inProgress = false
+	if len(b.timelines) > 0 {
+		// the room still has no state, e.g the homeserver returned a partial state
+		backoff := h.recordStateBackfillFailure(b)
+		logger.Warn().Str("room", roomID).Str("user", userID).Dur("retry_after", backoff).Msg("V2: room still has no state after backfilling it")
+		return
+	}
+	delete(h.stateBackfills, roomID)
+}
+
+// recordStateBackfillFailure sets when a room's state can next be fetched. Must be called with
+// stateBackfillsMu held.
+func (h *Handler) recordStateBackfillFailure(b *stateBackfill) time.Duration {
+	backoff := stateBackfillMaxBackoff
+	if b.failures < 7 { // 30s * 2^7 > 1h
+		backoff = stateBackfillMinBackoff << b.failures
+	}
+	if backoff > stateBackfillMaxBackoff {
+		backoff = stateBackfillMaxBackoff
+	}
+	b.failures++
+	b.retryAfter = time.Now().Add(backoff)
+	return backoff
+}
+
 func (h *Handler) SetTyping(ctx context.Context, pollerID sync2.PollerID, roomID string, ephEvent json.RawMessage) {
 	h.typingMu.Lock()
 	defer h.typingMu.Unlock()
@@ -418,7 +629,7 @@ func (h *Handler) SetTyping(ctx context.Context, pollerID sync2.PollerID, roomID
 func (h *Handler) OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage) {
 	// update our records - we make an artifically new RR event if there are genuine changes
 	// else it returns nil
-	newReceipts, err := h.Store.ReceiptTable.Insert(roomID, ephEvent)
+	newReceipts, err := h.Store.InsertReceipts(roomID, ephEvent)
 	if err != nil {
 		logger.Err(err).Str("room", roomID).Msg("failed to store receipts")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -431,10 +642,52 @@ func (h *Handler) OnReceipt(ctx context.Context, userID, roomID, ephEventType st
 		RoomID:   roomID,
 		Receipts: newReceipts,
 	})
+	for _, r := range newReceipts {
+		// Only the poller's own user's public m.read receipts clear counts: the homeserver is the
+		// source of truth for everyone else's counts, and threaded receipts don't mark the whole
+		// room as read.
+		if r.UserID != userID || r.IsPrivate || (r.ThreadID != "" && r.ThreadID != "main") {
+			continue
+		}
+		h.clearUnreadCountsIfRead(ctx, roomID, r.UserID, r.EventID)
+	}
+}
+
+// clearUnreadCountsIfRead zeroes the user's unread counts in this room if they have read up to
+// eventID, so the room shows as read on all their connections without waiting for the homeserver
+// to send new counts to each of their pollers.
+func (h *Handler) clearUnreadCountsIfRead(ctx context.Context, roomID, userID, eventID string) {
+	h.unreadMu.Lock()
+	defer h.unreadMu.Unlock()
+	entry, ok := h.unreadMap[roomID+userID]
+	if !ok {
+		// we may not have seen counts for this room since starting up
+		var err error
+		entry.Highlight, entry.Notif, err = h.Store.UnreadCounters(userID, roomID)
+		if err != nil && err != sql.ErrNoRows {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to select unread counters")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
+		}
+	}
+	if entry.Highlight == 0 && entry.Notif == 0 {
+		return
+	}
+	isRead, err := h.Store.IsReadUpTo(roomID, userID, eventID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to check if room is read")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if !isRead {
+		return
+	}
+	zero := 0
+	h.updateUnreadCounts(ctx, roomID, userID, &zero, &zero)
 }
 
 func (h *Handler) AddToDeviceMessages(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error {
-	_, err := h.Store.ToDeviceTable.InsertMessages(userID, deviceID, msgs)
+	_, err := h.Store.InsertToDeviceMessages(userID, deviceID, msgs)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("device", deviceID).Int("msgs", len(msgs)).Msg("V2: failed to store to-device messages")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -448,6 +701,13 @@ func (h *Handler) AddToDeviceMessages(ctx context.Context, userID, deviceID stri
 }
 
 func (h *Handler) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
+	h.unreadMu.Lock()
+	defer h.unreadMu.Unlock()
+	h.updateUnreadCounts(ctx, roomID, userID, highlightCount, notifCount)
+}
+
+// updateUnreadCounts must be called with unreadMu held.
+func (h *Handler) updateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
 	// only touch the DB and notify if they have changed. sync v2 will alwyas include the counts
 	// even if they haven't changed :(
 	key := roomID + userID
@@ -471,7 +731,7 @@ func (h *Handler) UpdateUnreadCounts(ctx context.Context, roomID, userID string,
 		Notif:     nc,
 	}
 
-	err := h.Store.UnreadTable.UpdateUnreadCounters(userID, roomID, highlightCount, notifCount)
+	err := h.Store.UpdateUnreadCounters(userID, roomID, highlightCount, notifCount)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update unread counters")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -525,7 +785,7 @@ func (h *Handler) OnAccountData(ctx context.Context, userID, roomID string, even
 }
 
 func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error {
-	err := h.Store.InvitesTable.InsertInvite(userID, roomID, inviteState)
+	err := h.Store.InsertInvite(userID, roomID, inviteState)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert invite")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -535,12 +795,74 @@ func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteSta
 		UserID: userID,
 		RoomID: roomID,
 	})
+	if h.inviteSummaries && inviteNeedsSummary(userID, inviteState) {
+		go h.addInviteSummary(userID, roomID, inviteState)
+	}
 	return nil
 }
 
+// inviteNeedsSummary returns true if the stripped state of an invite isn't enough to name the room.
+// DMs are named after the inviter, so never need a summary.
+func inviteNeedsSummary(userID string, inviteState []json.RawMessage) bool {
+	for _, ev := range inviteState {
+		parsed := gjson.ParseBytes(ev)
+		switch parsed.Get("type").Str {
+		case "m.room.name", "m.room.canonical_alias", state.InviteSummaryEventType:
+			return false
+		case "m.room.member":
+			if parsed.Get("state_key").Str == userID && parsed.Get("content.is_direct").Bool() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// addInviteSummary fetches the homeserver's summary of a room the user is invited to, and stores it
+// with the invite so the room can be named and counted.
+func (h *Handler) addInviteSummary(userID, roomID string, inviteState []json.RawMessage) {
+	defer internal.ReportPanicsToSentry()
+	log := logger.With().Str("user", userID).Str("room", roomID).Logger()
+	token, err := h.v2Store.LatestTokenForUsers([]string{userID})
+	if err != nil {
+		log.Warn().Err(err).Msg("V2: failed to load access token for invite summary")
+		return
+	}
+	summary, err := h.v2Client.RoomSummary(context.Background(), token.AccessToken, roomID)
+	if err != nil {
+		log.Debug().Err(err).Msg("V2: failed to fetch invite summary")
+		return
+	}
+	summaryEvent, err := json.Marshal(map[string]interface{}{
+		"type":      state.InviteSummaryEventType,
+		"state_key": "",
+		"content":   summary,
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("V2: failed to marshal invite summary")
+		return
+	}
+	newInviteState := make([]json.RawMessage, 0, len(inviteState)+1)
+	newInviteState = append(newInviteState, inviteState...)
+	newInviteState = append(newInviteState, summaryEvent)
+	updated, err := h.Store.UpdateInviteState(userID, roomID, newInviteState)
+	if err != nil {
+		log.Err(err).Msg("V2: failed to store invite summary")
+		return
+	}
+	if !updated {
+		// the invite was accepted or rejected while we fetched the summary
+		return
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InviteRoom{
+		UserID: userID,
+		RoomID: roomID,
+	})
+}
+
 func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEv json.RawMessage) error {
 	// remove any invites for this user if they are rejecting an invite
-	err := h.Store.InvitesTable.RemoveInvite(userID, roomID)
+	err := h.Store.RemoveInvite(userID, roomID)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire invite")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -567,7 +889,7 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 	defer func() {
 		log.Info().Msg("EnsurePolling: preprocessing done")
 	}()
-	accessToken, since, err := h.v2Store.TokensTable.GetTokenAndSince(p.UserID, p.DeviceID, p.AccessTokenHash)
+	accessToken, since, err := h.v2Store.GetTokenAndSince(p.UserID, p.DeviceID, p.AccessTokenHash)
 	if err != nil {
 		log.Err(err).Msg("V3Sub: EnsurePolling unknown device")
 		sentry.CaptureException(err)
@@ -595,6 +917,21 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 	}()
 }
 
+// ForceResync stops all pollers for the user and resets their since tokens. The API process
+// will close the user's connections, and the pollers will be recreated with an initial sync
+// when the user's devices next make a request.
+func (h *Handler) ForceResync(p *pubsub.V3ForceResync) {
+	numTerminated := h.pMap.TerminateUserPollers(p.UserID)
+	numReset, err := h.v2Store.ResetSinceForUser(p.UserID)
+	if err != nil {
+		logger.Err(err).Str("user", p.UserID).Msg("ForceResync: failed to reset since tokens")
+		sentry.CaptureException(err)
+		return
+	}
+	h.updateMetrics()
+	logger.Info().Str("user", p.UserID).Int("pollers_terminated", numTerminated).Int64("devices_reset", numReset).Msg("ForceResync: done")
+}
+
 func (h *Handler) startPollerExpiryTicker() {
 	if h.pollerExpiryTicker != nil {
 		return
@@ -612,7 +949,7 @@ func (h *Handler) startPollerExpiryTicker() {
 // This function does not normally need to be called manually (StartV2Pollers queues it
 // up to run hourly); we expose it publicly only for testing purposes.
 func (h *Handler) ExpireOldPollers() {
-	devices, err := h.v2Store.DevicesTable.FindOldDevices(30 * 24 * time.Hour)
+	devices, err := h.v2Store.FindOldDevices(30 * 24 * time.Hour)
 	if err != nil {
 		logger.Err(err).Msg("Error fetching old devices")
 		sentry.CaptureException(err)
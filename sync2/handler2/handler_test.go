@@ -36,7 +36,8 @@ type pollInfo struct {
 }
 
 type mockPollerMap struct {
-	calls []pollInfo
+	calls           []pollInfo
+	terminatedUsers []string
 }
 
 func (p *mockPollerMap) NumPollers() int {
@@ -44,6 +45,10 @@ func (p *mockPollerMap) NumPollers() int {
 }
 func (p *mockPollerMap) Terminate() {}
 
+func (p *mockPollerMap) Statuses(userID string) []sync2.PollerStatus {
+	return nil
+}
+
 func (p *mockPollerMap) DeviceIDs(userID string) []string {
 	return nil
 }
@@ -52,6 +57,11 @@ func (p *mockPollerMap) ExpirePollers([]sync2.PollerID) int {
 	return 0
 }
 
+func (p *mockPollerMap) TerminateUserPollers(userID string) int {
+	p.terminatedUsers = append(p.terminatedUsers, userID)
+	return 1
+}
+
 func (p *mockPollerMap) EnsurePolling(pid sync2.PollerID, accessToken, v2since string, isStartup bool, logger zerolog.Logger) (bool, error) {
 	p.calls = append(p.calls, pollInfo{
 		pid:         pid,
@@ -145,7 +155,7 @@ func TestHandlerFreshEnsurePolling(t *testing.T) {
 	pMap := &mockPollerMap{}
 	pub := newMockPub()
 	sub := &mockSub{}
-	h, err := handler2.NewHandler(pMap, v2Store, store, pub, sub, false, time.Minute)
+	h, err := handler2.NewHandler(pMap, nil, v2Store, store, pub, sub, false, time.Minute, false)
 	assertNoError(t, err)
 	alice := "@alice:localhost"
 	deviceID := "ALICE"
@@ -187,13 +197,60 @@ func TestHandlerFreshEnsurePolling(t *testing.T) {
 
 }
 
+// Test that ForceResync terminates the user's pollers and resets their since tokens, so the next
+// EnsurePolling does an initial sync.
+func TestHandlerForceResync(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	pMap := &mockPollerMap{}
+	pub := newMockPub()
+	sub := &mockSub{}
+	h, err := handler2.NewHandler(pMap, nil, v2Store, store, pub, sub, false, time.Minute, false)
+	assertNoError(t, err)
+	alice := "@TestHandlerForceResync_alice:localhost"
+	deviceID := "ALICE"
+	token := "TestHandlerForceResync_aliceToken"
+
+	var tok *sync2.Token
+	sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		err = v2Store.DevicesTable.InsertDevice(txn, alice, deviceID)
+		assertNoError(t, err)
+		tok, err = v2Store.TokensTable.Insert(txn, token, alice, deviceID, time.Now())
+		assertNoError(t, err)
+		return nil
+	})
+	assertNoError(t, v2Store.DevicesTable.UpdateDeviceSince(alice, deviceID, "s123"))
+
+	h.ForceResync(&pubsub.V3ForceResync{UserID: alice})
+	if len(pMap.terminatedUsers) != 1 || pMap.terminatedUsers[0] != alice {
+		t.Fatalf("ForceResync: got terminated users %v want [%s]", pMap.terminatedUsers, alice)
+	}
+
+	ch := pub.WaitForPayloadType((&pubsub.V2InitialSyncComplete{}).Type())
+	h.EnsurePolling(&pubsub.V3EnsurePolling{
+		UserID:          alice,
+		DeviceID:        deviceID,
+		AccessTokenHash: tok.AccessTokenHash,
+	})
+	pub.DoWait(t, "didn't see V2InitialSyncComplete", ch, false)
+	pMap.assertCallExists(t, pollInfo{
+		pid: sync2.PollerID{
+			UserID:   alice,
+			DeviceID: deviceID,
+		},
+		accessToken: token,
+		v2since:     "",
+		isStartup:   false,
+	})
+}
+
 func TestSetTypingConcurrently(t *testing.T) {
 	store := state.NewStorage(postgresURI)
 	v2Store := sync2.NewStore(postgresURI, "secret")
 	pMap := &mockPollerMap{}
 	pub := newMockPub()
 	sub := &mockSub{}
-	h, err := handler2.NewHandler(pMap, v2Store, store, pub, sub, false, time.Minute)
+	h, err := handler2.NewHandler(pMap, nil, v2Store, store, pub, sub, false, time.Minute, false)
 	assertNoError(t, err)
 	ctx := context.Background()
 
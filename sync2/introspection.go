@@ -0,0 +1,174 @@
+package sync2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// The scope prefix which MSC2967 uses to bind an access token to a Matrix device.
+const msc2967DeviceScopePrefix = "urn:matrix:org.matrix.msc2967.client:device:"
+
+// IntrospectionOpts configures identifying access tokens via OAuth 2.0 token introspection
+// (RFC 7662), for homeservers which delegate authentication to an OIDC provider (MSC3861).
+type IntrospectionOpts struct {
+	// Endpoint is the URL of the OIDC provider's introspection endpoint.
+	Endpoint string
+	// ClientID and ClientSecret authenticate the proxy to the introspection endpoint using
+	// HTTP Basic auth. If ClientID is empty, no Authorization header is sent.
+	ClientID     string
+	ClientSecret string
+	// ServerName is the homeserver's server name, used to build user IDs from the username
+	// in introspection responses.
+	ServerName string
+	// FallbackToWhoAmI also asks the homeserver's /whoami about tokens which the OIDC provider
+	// does not recognise, for deployments which are part way through migrating to OIDC.
+	FallbackToWhoAmI bool
+	// CacheTTL is how long introspection results are cached for. Active tokens are never cached
+	// beyond their expiry time. 0 disables caching.
+	CacheTTL time.Duration
+}
+
+type introspectionResult struct {
+	userID   string
+	deviceID string
+	active   bool
+	expires  time.Time
+}
+
+// IntrospectingClient is a Client which identifies access tokens using token introspection
+// rather than /whoami. All other requests are sent to the wrapped Client.
+type IntrospectingClient struct {
+	Client
+	opts       IntrospectionOpts
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	cache map[string]introspectionResult // token hash -> result
+}
+
+func NewIntrospectingClient(client Client, timeout time.Duration, opts IntrospectionOpts) *IntrospectingClient {
+	return &IntrospectingClient{
+		Client:     client,
+		opts:       opts,
+		httpClient: newClient(timeout, opts.Endpoint),
+		cache:      make(map[string]introspectionResult),
+	}
+}
+
+// WhoAmI introspects the access token. Returns sync2.HTTP401 if the token is not active, unless
+// the homeserver's /whoami recognises it when FallbackToWhoAmI is set. Appservice tokens are
+// issued by the homeserver, so masquerading tokens are always looked up with /whoami.
+func (c *IntrospectingClient) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
+	if MasqueradedUserID(accessToken) != "" {
+		return c.Client.WhoAmI(ctx, accessToken)
+	}
+	res, err := c.introspect(ctx, accessToken)
+	if err != nil {
+		return "", "", err
+	}
+	if !res.active {
+		if c.opts.FallbackToWhoAmI {
+			return c.Client.WhoAmI(ctx, accessToken)
+		}
+		return "", "", HTTP401
+	}
+	return res.userID, res.deviceID, nil
+}
+
+func (c *IntrospectingClient) introspect(ctx context.Context, accessToken string) (introspectionResult, error) {
+	tokenHash := hashToken(accessToken)
+	now := time.Now()
+	c.mu.Lock()
+	res, ok := c.cache[tokenHash]
+	c.mu.Unlock()
+	if ok && now.Before(res.expires) {
+		return res, nil
+	}
+
+	res, err := c.doIntrospect(ctx, accessToken)
+	if err != nil {
+		return res, err
+	}
+	if c.opts.CacheTTL > 0 {
+		expires := now.Add(c.opts.CacheTTL)
+		if res.expires.IsZero() || expires.Before(res.expires) {
+			res.expires = expires
+		}
+		c.mu.Lock()
+		// drop expired results so the cache doesn't grow without bound
+		for hash, cached := range c.cache {
+			if !now.Before(cached.expires) {
+				delete(c.cache, hash)
+			}
+		}
+		c.cache[tokenHash] = res
+		c.mu.Unlock()
+	}
+	return res, nil
+}
+
+func (c *IntrospectingClient) doIntrospect(ctx context.Context, accessToken string) (introspectionResult, error) {
+	var res introspectionResult
+	form := url.Values{
+		"token":           {accessToken},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.opts.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.opts.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(c.opts.ClientID), url.QueryEscape(c.opts.ClientSecret))
+	}
+	httpRes, err := c.httpClient.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != 200 {
+		return res, fmt.Errorf("token introspection returned HTTP %d", httpRes.StatusCode)
+	}
+	body, err := io.ReadAll(httpRes.Body)
+	if err != nil {
+		return res, err
+	}
+	return parseIntrospectionResponse(gjson.ParseBytes(body), c.opts.ServerName)
+}
+
+// parseIntrospectionResponse extracts the user and device from an introspection response. Tokens
+// without a username or device scope cannot be used with sync, so are treated as inactive.
+func parseIntrospectionResponse(response gjson.Result, serverName string) (introspectionResult, error) {
+	var res introspectionResult
+	if !response.IsObject() {
+		return res, fmt.Errorf("token introspection returned invalid JSON")
+	}
+	if !response.Get("active").Bool() {
+		return res, nil
+	}
+	if exp := response.Get("exp"); exp.Exists() {
+		res.expires = time.Unix(exp.Int(), 0)
+	}
+	username := response.Get("username").Str
+	for _, scope := range strings.Fields(response.Get("scope").Str) {
+		if strings.HasPrefix(scope, msc2967DeviceScopePrefix) {
+			res.deviceID = strings.TrimPrefix(scope, msc2967DeviceScopePrefix)
+		}
+	}
+	if username == "" || res.deviceID == "" {
+		return res, nil
+	}
+	res.userID = "@" + username + ":" + serverName
+	res.active = true
+	return res, nil
+}
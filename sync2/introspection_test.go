@@ -0,0 +1,92 @@
+package sync2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type whoAmIClient struct {
+	Client
+	userID, deviceID string
+}
+
+func (c *whoAmIClient) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
+	if c.userID == "" {
+		return "", "", HTTP401
+	}
+	return c.userID, c.deviceID, nil
+}
+
+func TestIntrospectingClientWhoAmI(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "proxy" || pass != "s3cret" {
+			w.WriteHeader(401)
+			return
+		}
+		switch req.FormValue("token") {
+		case "good":
+			w.Write([]byte(`{"active":true,"username":"alice","scope":"openid urn:matrix:org.matrix.msc2967.client:api:* urn:matrix:org.matrix.msc2967.client:device:ABCDEF"}`))
+		case "no_device":
+			w.Write([]byte(`{"active":true,"username":"alice","scope":"openid"}`))
+		default:
+			w.Write([]byte(`{"active":false}`))
+		}
+	}))
+	defer srv.Close()
+
+	opts := IntrospectionOpts{
+		Endpoint:     srv.URL,
+		ClientID:     "proxy",
+		ClientSecret: "s3cret",
+		ServerName:   "example.com",
+		CacheTTL:     time.Minute,
+	}
+	client := NewIntrospectingClient(&whoAmIClient{}, time.Second, opts)
+	ctx := context.Background()
+
+	userID, deviceID, err := client.WhoAmI(ctx, "good")
+	if err != nil {
+		t.Fatalf("WhoAmI: %s", err)
+	}
+	if userID != "@alice:example.com" || deviceID != "ABCDEF" {
+		t.Errorf("got user %q device %q, want @alice:example.com ABCDEF", userID, deviceID)
+	}
+	// the result is cached
+	if _, _, err = client.WhoAmI(ctx, "good"); err != nil {
+		t.Fatalf("WhoAmI: %s", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("introspection endpoint called %d times, want 1", got)
+	}
+
+	for _, token := range []string{"bad", "no_device"} {
+		if _, _, err = client.WhoAmI(ctx, token); err != HTTP401 {
+			t.Errorf("WhoAmI(%s): got err %v, want HTTP401", token, err)
+		}
+	}
+
+	// tokens the OIDC provider does not know about are looked up with the homeserver if enabled
+	opts.FallbackToWhoAmI = true
+	client = NewIntrospectingClient(&whoAmIClient{userID: "@bob:example.com", deviceID: "LEGACY"}, time.Second, opts)
+	userID, deviceID, err = client.WhoAmI(ctx, "bad")
+	if err != nil {
+		t.Fatalf("WhoAmI: %s", err)
+	}
+	if userID != "@bob:example.com" || deviceID != "LEGACY" {
+		t.Errorf("got user %q device %q, want @bob:example.com LEGACY", userID, deviceID)
+	}
+
+	// failures to introspect are not treated as invalid tokens
+	opts.ClientSecret = "wrong"
+	client = NewIntrospectingClient(&whoAmIClient{}, time.Second, opts)
+	if _, _, err = client.WhoAmI(ctx, "good"); err == nil || err == HTTP401 {
+		t.Errorf("WhoAmI with bad client credentials: got err %v, want a non-401 error", err)
+	}
+}
@@ -0,0 +1,200 @@
+package sync2
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// MemoryStore keeps the tokens and devices which Storage keeps in postgres in memory instead. As
+// nothing is written to disk, access tokens are held in plaintext. Nothing survives a restart.
+type MemoryStore struct {
+	mu sync.Mutex
+	// token hash -> token
+	tokens map[string]Token
+	// user ID, device ID -> since token
+	devices map[[2]string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tokens:  make(map[string]Token),
+		devices: make(map[[2]string]string),
+	}
+}
+
+// Token returns the stored token for an access token, or sql.ErrNoRows if there isn't one.
+func (s *MemoryStore) Token(accessToken string) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[hashToken(accessToken)]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &token, nil
+}
+
+// LatestTokenForUsers returns the most recently seen token belonging to any of these users.
+// Errors with sql.ErrNoRows if none of them have a token.
+func (s *MemoryStore) LatestTokenForUsers(userIDs []string) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var latest *Token
+	for _, token := range s.tokens {
+		token := token
+		if !slices.Contains(userIDs, token.UserID) {
+			continue
+		}
+		if latest == nil || token.LastSeen.After(latest.LastSeen) {
+			latest = &token
+		}
+	}
+	if latest == nil {
+		return nil, sql.ErrNoRows
+	}
+	return latest, nil
+}
+
+// TokenForEachDevice returns the most recently used token for each device.
+func (s *MemoryStore) TokenForEachDevice() ([]TokenForPoller, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latest := make(map[[2]string]Token)
+	for _, token := range s.tokens {
+		key := [2]string{token.UserID, token.DeviceID}
+		if _, ok := s.devices[key]; !ok {
+			continue
+		}
+		if existing, ok := latest[key]; !ok || token.LastSeen.After(existing.LastSeen) {
+			latest[key] = token
+		}
+	}
+	tokens := make([]TokenForPoller, 0, len(latest))
+	for key, token := range latest {
+		token := token
+		tokens = append(tokens, TokenForPoller{
+			Token: &token,
+			Since: s.devices[key],
+		})
+	}
+	return tokens, nil
+}
+
+// InsertTokenAndDevice stores a new access token for the device, and the device if it is new.
+func (s *MemoryStore) InsertTokenAndDevice(accessToken, userID, deviceID string, lastSeen time.Time) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := Token{
+		AccessToken:     accessToken,
+		AccessTokenHash: hashToken(accessToken),
+		UserID:          userID,
+		DeviceID:        deviceID,
+		LastSeen:        lastSeen,
+	}
+	if _, exists := s.tokens[token.AccessTokenHash]; !exists {
+		s.tokens[token.AccessTokenHash] = token
+	}
+	key := [2]string{userID, deviceID}
+	if _, exists := s.devices[key]; !exists {
+		s.devices[key] = ""
+	}
+	return &token, nil
+}
+
+// MaybeUpdateLastSeen behaves like TokensTable.MaybeUpdateLastSeen.
+func (s *MemoryStore) MaybeUpdateLastSeen(token *Token, newLastSeen time.Time) error {
+	if newLastSeen.Sub(token.LastSeen) < (24 * time.Hour) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.tokens[token.AccessTokenHash]; ok {
+		stored.LastSeen = newLastSeen
+		s.tokens[token.AccessTokenHash] = stored
+	}
+	token.LastSeen = newLastSeen
+	return nil
+}
+
+func (s *MemoryStore) GetTokenAndSince(userID, deviceID, tokenHash string) (accessToken, since string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[tokenHash]
+	if !ok {
+		return "", "", sql.ErrNoRows
+	}
+	since, ok = s.devices[[2]string{token.UserID, token.DeviceID}]
+	if !ok {
+		return "", "", sql.ErrNoRows
+	}
+	if token.UserID != userID || token.DeviceID != deviceID {
+		return "", "", fmt.Errorf(
+			"token (hash %s) found with user+device mismatch: got (%s, %s), expected (%s, %s)",
+			tokenHash, token.UserID, token.DeviceID, userID, deviceID,
+		)
+	}
+	return token.AccessToken, since, nil
+}
+
+// DeleteToken deletes the token with this hash, if there is one.
+func (s *MemoryStore) DeleteToken(accessTokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, accessTokenHash)
+	return nil
+}
+
+func (s *MemoryStore) UpdateDeviceSince(userID, deviceID, since string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [2]string{userID, deviceID}
+	if _, ok := s.devices[key]; ok {
+		s.devices[key] = since
+	}
+	return nil
+}
+
+// ResetSinceForUser clears the since token for all of the user's devices, so their pollers start
+// again with an initial sync. Returns the number of devices reset.
+func (s *MemoryStore) ResetSinceForUser(userID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var numReset int64
+	for key := range s.devices {
+		if key[0] == userID {
+			s.devices[key] = ""
+			numReset++
+		}
+	}
+	return numReset, nil
+}
+
+// FindOldDevices returns the devices whose tokens have all not been seen for at least the
+// inactivityPeriod, in no particular order.
+func (s *MemoryStore) FindOldDevices(inactivityPeriod time.Duration) ([]Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lastSeen := make(map[[2]string]time.Time)
+	for _, token := range s.tokens {
+		key := [2]string{token.UserID, token.DeviceID}
+		if token.LastSeen.After(lastSeen[key]) {
+			lastSeen[key] = token.LastSeen
+		}
+	}
+	boundary := time.Now().Add(-inactivityPeriod)
+	var devices []Device
+	for key, seen := range lastSeen {
+		if _, ok := s.devices[key]; ok && seen.Before(boundary) {
+			devices = append(devices, Device{
+				UserID:   key[0],
+				DeviceID: key[1],
+			})
+		}
+	}
+	return devices, nil
+}
+
+func (s *MemoryStore) Teardown() {}
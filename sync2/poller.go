@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"runtime/debug"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -25,10 +26,6 @@ type PollerID struct {
 	DeviceID string
 }
 
-// alias time.Sleep/time.Since so tests can monkey patch it out
-var timeSleep = time.Sleep
-var timeSince = time.Since
-
 // log at most once every duration. Always logs before terminating.
 var logInterval = 30 * time.Second
 
@@ -63,10 +60,13 @@ type V2DataReceiver interface {
 	OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
 	// Sent when there is a _change_ in E2EE data, not all the time
 	OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
-	// Sent when the poll loop terminates
-	OnTerminated(ctx context.Context, pollerID PollerID)
-	// Sent when the token gets a 401 response
-	OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string)
+	// Sent when the poll loop terminates. unexpected is true if the loop stopped without being
+	// terminated, e.g because it panicked, in which case the device is no longer being polled even
+	// though its access token may still be valid.
+	OnTerminated(ctx context.Context, pollerID PollerID, unexpected bool)
+	// Sent when the token gets a 401 response. softLogout is true if the homeserver indicated that
+	// the device can be logged back into, in which case the device's data should be kept.
+	OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool)
 }
 
 type IPollerMap interface {
@@ -77,6 +77,33 @@ type IPollerMap interface {
 	// ExpirePollers requests that the given pollers are terminated as if their access
 	// tokens had expired. Returns the number of pollers successfully terminated.
 	ExpirePollers(ids []PollerID) int
+	// TerminateUserPollers stops all pollers for this user without expiring their access
+	// tokens. Returns the number of pollers terminated.
+	TerminateUserPollers(userID string) int
+	// Statuses returns what each of this user's pollers is doing.
+	Statuses(userID string) []PollerStatus
+}
+
+// PollerStatus describes what a poller is doing, so operators can tell whether a device is being
+// polled without reading logs.
+type PollerStatus struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	// Since is the since token the next poll will use. Empty until the initial sync has completed.
+	Since string `json:"since"`
+	// LastPollTS is when the last poll returned, in milliseconds since the epoch. 0 if no poll has
+	// returned yet.
+	LastPollTS int64 `json:"last_poll_ts"`
+	// FailCount is the number of consecutive failed polls. The poller waits between polls while
+	// this is non-zero.
+	FailCount  int  `json:"fail_count"`
+	BackingOff bool `json:"backing_off"`
+	// LastError is the most recent error, which may have been followed by successful polls.
+	LastError   string `json:"last_error,omitempty"`
+	LastErrorTS int64  `json:"last_error_ts,omitempty"`
+	// Terminated is true if the poller has stopped and will be replaced by the next request for
+	// this device.
+	Terminated bool `json:"terminated"`
 }
 
 // PollerMap is a map of device ID to Poller
@@ -87,6 +114,7 @@ type PollerMap struct {
 	Pollers                     map[PollerID]*poller
 	executor                    chan func()
 	executorRunning             bool
+	clock                       internal.Clock
 	processHistogramVec         *prometheus.HistogramVec
 	timelineSizeHistogramVec    *prometheus.HistogramVec
 	gappyStateSizeVec           *prometheus.HistogramVec
@@ -119,11 +147,17 @@ type PollerMap struct {
 //
 // NOT to-device messages,or since tokens.
 func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
+	return NewPollerMapWithClock(v2Client, enablePrometheus, internal.RealClock)
+}
+
+// NewPollerMapWithClock is NewPollerMap with a custom clock for the pollers' backoff and timing.
+func NewPollerMapWithClock(v2Client Client, enablePrometheus bool, clock internal.Clock) *PollerMap {
 	pm := &PollerMap{
 		v2Client: v2Client,
 		pollerMu: &sync.Mutex{},
 		Pollers:  make(map[PollerID]*poller),
 		executor: make(chan func(), 0),
+		clock:    clock,
 	}
 	if enablePrometheus {
 		pm.processHistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -222,6 +256,39 @@ func (h *PollerMap) DeviceIDs(userID string) []string {
 	return devices
 }
 
+// Statuses returns what each of this user's pollers is doing, ordered by device ID.
+func (h *PollerMap) Statuses(userID string) []PollerStatus {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	statuses := []PollerStatus{}
+	for _, p := range h.Pollers {
+		if p.userID == userID {
+			statuses = append(statuses, p.Status())
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].DeviceID < statuses[j].DeviceID
+	})
+	return statuses
+}
+
+// TerminateUserPollers stops all pollers for this user. Unlike ExpirePollers, access tokens are not
+// expired so a later EnsurePolling call will start polling again. Returns the number of pollers
+// terminated.
+func (h *PollerMap) TerminateUserPollers(userID string) int {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	numTerminated := 0
+	for pid, p := range h.Pollers {
+		if pid.UserID != userID || p.terminated.Load() {
+			continue
+		}
+		p.Terminate()
+		numTerminated++
+	}
+	return numTerminated
+}
+
 func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 	h.pollerMu.Lock()
 	numTerminated := 0
@@ -239,7 +306,7 @@ func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 		p.Terminate()
 		// Ensure that we won't recreate this poller on startup. If it reappears later,
 		// we'll make another EnsurePolling call which will recreate the poller.
-		h.callbacks.OnExpiredToken(context.Background(), hashToken(p.accessToken), p.userID, p.deviceID)
+		h.callbacks.OnExpiredToken(context.Background(), hashToken(p.accessToken), p.userID, p.deviceID, false)
 		numTerminated++
 	}
 
@@ -288,7 +355,7 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 
 	// replace the poller. If we don't need to wait, then we just want to nab to-device events initially.
 	// We don't do that on startup though as we cannot be sure that other pollers will not be using expired tokens.
-	poller = newPoller(pid, accessToken, h.v2Client, h, logger, !needToWait && !isStartup)
+	poller = newPoller(pid, accessToken, h.v2Client, h, logger, !needToWait && !isStartup, h.clock)
 	poller.processHistogramVec = h.processHistogramVec
 	poller.timelineSizeVec = h.timelineSizeHistogramVec
 	poller.gappyStateSizeVec = h.gappyStateSizeVec
@@ -375,12 +442,12 @@ func (h *PollerMap) AddToDeviceMessages(ctx context.Context, userID, deviceID st
 	return h.callbacks.AddToDeviceMessages(ctx, userID, deviceID, msgs)
 }
 
-func (h *PollerMap) OnTerminated(ctx context.Context, pollerID PollerID) {
-	h.callbacks.OnTerminated(ctx, pollerID)
+func (h *PollerMap) OnTerminated(ctx context.Context, pollerID PollerID, unexpected bool) {
+	h.callbacks.OnTerminated(ctx, pollerID, unexpected)
 }
 
-func (h *PollerMap) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
-	h.callbacks.OnExpiredToken(ctx, accessTokenHash, userID, deviceID)
+func (h *PollerMap) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+	h.callbacks.OnExpiredToken(ctx, accessTokenHash, userID, deviceID, softLogout)
 }
 
 func (h *PollerMap) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
@@ -440,6 +507,12 @@ type poller struct {
 	// flag set to true when poll() returns due to expired access tokens
 	terminated *atomic.Bool
 	wg         *sync.WaitGroup
+	// used for backoff and timing, so tests can control time
+	clock internal.Clock
+
+	// what the poller is doing, for operators
+	statusMu sync.Mutex
+	status   PollerStatus
 
 	// stats about poll response data, for logging purposes
 	lastLogged              time.Time
@@ -461,7 +534,7 @@ type poller struct {
 	totalNumPolls          prometheus.Counter
 }
 
-func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataReceiver, logger zerolog.Logger, initialToDeviceOnly bool) *poller {
+func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataReceiver, logger zerolog.Logger, initialToDeviceOnly bool, clock internal.Clock) *poller {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	return &poller{
@@ -474,9 +547,37 @@ func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataR
 		logger:              logger,
 		wg:                  &wg,
 		initialToDeviceOnly: initialToDeviceOnly,
+		clock:               clock,
+		status: PollerStatus{
+			UserID:   pid.UserID,
+			DeviceID: pid.DeviceID,
+		},
 	}
 }
 
+// Status returns what the poller is doing.
+func (p *poller) Status() PollerStatus {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	status := p.status
+	status.Terminated = p.terminated.Load()
+	return status
+}
+
+func (p *poller) updateStatus(fn func(status *PollerStatus)) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	fn(&p.status)
+}
+
+// recordError remembers the error which made this poll fail.
+func (p *poller) recordError(err error) {
+	p.updateStatus(func(status *PollerStatus) {
+		status.LastError = err.Error()
+		status.LastErrorTS = p.clock.Now().UnixMilli()
+	})
+}
+
 // Blocks until the initial sync has been done on this poller.
 func (p *poller) WaitUntilInitialSync() {
 	p.wg.Wait()
@@ -514,10 +615,14 @@ func (p *poller) Poll(since string) {
 			logger.Error().Str("user", p.userID).Str("device", p.deviceID).Msgf("%s. Traceback:\n%s", panicErr, debug.Stack())
 			internal.GetSentryHubFromContextOrDefault(ctx).RecoverWithContext(ctx, panicErr)
 		}
+		// The loop only stops without being terminated if it panicked. Mark it as terminated so the
+		// next EnsurePolling call replaces it.
+		unexpected := !p.terminated.Load()
+		p.Terminate()
 		p.receiver.OnTerminated(ctx, PollerID{
 			UserID:   p.userID,
 			DeviceID: p.deviceID,
-		})
+		}, unexpected)
 	}()
 
 	state := pollLoopState{
@@ -531,6 +636,11 @@ func (p *poller) Poll(since string) {
 		ctx, task := internal.StartTask(ctx, "Poll")
 		err := p.poll(ctx, &state)
 		task.End()
+		p.updateStatus(func(status *PollerStatus) {
+			status.Since = state.since
+			status.FailCount = state.failCount
+			status.BackingOff = state.failCount > 0
+		})
 		if err != nil {
 			break
 		}
@@ -555,7 +665,7 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 			// 3s * 1000 = 3000s = 50 minutes
 			errMsg := "poller: access token has failed >1000 times to /sync, terminating loop"
 			p.logger.Warn().Msg(errMsg)
-			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
+			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID, false)
 			p.Terminate()
 			return fmt.Errorf(errMsg)
 		}
@@ -564,12 +674,12 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		// requests it might force the server to do the work all over again :(
 		waitTime := 3 * time.Second
 		p.logger.Warn().Str("duration", waitTime.String()).Int("fail-count", s.failCount).Msg("Poller: waiting before next poll")
-		timeSleep(waitTime)
+		p.clock.Sleep(waitTime)
 	}
 	if p.terminated.Load() {
 		return fmt.Errorf("poller terminated")
 	}
-	start := time.Now()
+	start := p.clock.Now()
 	spanCtx, region := internal.StartSpan(ctx, "DoSyncV2")
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Inc()
@@ -579,21 +689,35 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		p.numOutstandingSyncReqs.Dec()
 	}
 	region.End()
-	p.trackRequestDuration(timeSince(start), s.since == "", s.firstTime)
+	p.updateStatus(func(status *PollerStatus) {
+		status.LastPollTS = p.clock.Now().UnixMilli()
+	})
+	p.trackRequestDuration(p.clock.Since(start), s.since == "", s.firstTime)
 	if p.terminated.Load() {
 		return fmt.Errorf("poller terminated")
 	}
 	if err != nil {
+		p.recordError(fmt.Errorf("sync v2 returned HTTP %d: %w", statusCode, err))
 		// check if temporary
 		isFatal := statusCode == 401 || statusCode == 403
 		if !isFatal {
 			p.logger.Warn().Int("code", statusCode).Err(err).Msg("Poller: sync v2 poll returned temporary error")
 			s.failCount += 1
 			return nil
+		} else if errors.Is(err, HTTP401SoftLogout) {
+			errMsg := "poller: device has been soft logged out, pausing until the device logs back in"
+			p.logger.Warn().Msg(errMsg)
+			// store how far we got, so polling resumes from here with the device's next access token
+			if s.since != "" {
+				p.receiver.UpdateDeviceSince(ctx, p.userID, p.deviceID, s.since)
+			}
+			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID, true)
+			p.Terminate()
+			return fmt.Errorf(errMsg)
 		} else {
 			errMsg := "poller: access token has been invalidated, terminating loop"
 			p.logger.Warn().Msg(errMsg)
-			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
+			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID, false)
 			p.Terminate()
 			return fmt.Errorf(errMsg)
 		}
@@ -602,7 +726,7 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		p.logger.Info().Msg("Poller: valid initial sync response received")
 	}
 	p.initialToDeviceOnly = false
-	start = time.Now()
+	start = p.clock.Now()
 	s.failCount = 0
 
 	// If any of these sections return an error, we will NOT increment the since token and so
@@ -610,18 +734,21 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	retryErr := p.parseE2EEData(ctx, resp)
 	if shouldRetry(retryErr) {
 		p.logger.Err(retryErr).Msg("Poller: parseE2EEData returned an error")
+		p.recordError(fmt.Errorf("parseE2EEData: %w", retryErr))
 		s.failCount += 1
 		return nil
 	}
 	retryErr = p.parseGlobalAccountData(ctx, resp)
 	if shouldRetry(retryErr) {
 		p.logger.Err(retryErr).Msg("Poller: parseGlobalAccountData returned an error")
+		p.recordError(fmt.Errorf("parseGlobalAccountData: %w", retryErr))
 		s.failCount += 1
 		return nil
 	}
 	retryErr = p.parseRoomsResponse(ctx, resp)
 	if shouldRetry(retryErr) {
 		p.logger.Err(retryErr).Msg("Poller: parseRoomsResponse returned an error")
+		p.recordError(fmt.Errorf("parseRoomsResponse: %w", retryErr))
 		s.failCount += 1
 		return nil
 	}
@@ -634,6 +761,7 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	retryErr = p.parseToDeviceMessages(ctx, resp)
 	if shouldRetry(retryErr) {
 		p.logger.Err(retryErr).Msg("Poller: parseToDeviceMessages returned an error")
+		p.recordError(fmt.Errorf("parseToDeviceMessages: %w", retryErr))
 		s.failCount += 1
 		return nil
 	}
@@ -643,17 +771,18 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 
 	s.since = resp.NextBatch
 	// Persist the since token if it either was more than one minute ago since we
-	// last stored it OR the response contains to-device messages
-	if timeSince(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0 {
+	// last stored it OR the response contains to-device messages. Terminated pollers don't
+	// persist as their since token may have been reset whilst this response was processed.
+	if (p.clock.Since(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0) && !p.terminated.Load() {
 		p.receiver.UpdateDeviceSince(ctx, p.userID, p.deviceID, s.since)
-		s.lastStoredSince = time.Now()
+		s.lastStoredSince = p.clock.Now()
 	}
 
 	if s.firstTime {
 		s.firstTime = false
 		p.wg.Done()
 	}
-	p.trackProcessDuration(timeSince(start), wasInitial, wasFirst)
+	p.trackProcessDuration(p.clock.Since(start), wasInitial, wasFirst)
 	p.maybeLogStats(false)
 	return nil
 }
@@ -955,11 +1084,11 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 }
 
 func (p *poller) maybeLogStats(force bool) {
-	if !force && timeSince(p.lastLogged) < logInterval {
+	if !force && p.clock.Since(p.lastLogged) < logInterval {
 		// only log at most once every logInterval
 		return
 	}
-	p.lastLogged = time.Now()
+	p.lastLogged = p.clock.Now()
 	p.logger.Info().Ints(
 		"rooms [timeline,state,typing,receipts,invites]", []int{
 			p.totalTimelineCalls, p.totalStateCalls, p.totalTyping, p.totalReceipts, p.totalInvites,
@@ -7,7 +7,9 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,10 +20,8 @@ import (
 
 const initialSinceToken = "0"
 
-// monkey patch out time.Since with a test controlled value.
-// This is done in the init block so we can make sure we swap it out BEFORE any pollers
-// start. If we wait until pollers exist, we get data races. This includes pollers in tests
-// which don't use timeSince, hence the init block.
+// monkey patch out time.Since with a test controlled value. Every poller in these tests is given
+// a patchedClock, so the values must be guarded against pollers which are still running.
 var (
 	timeSinceMu    sync.Mutex
 	timeSinceValue = time.Duration(0) // 0 means use the real impl
@@ -43,28 +43,32 @@ func setTimeSleepDelay(val time.Duration, fn ...func(d time.Duration)) {
 		timeSleepCheck = fn[0]
 	}
 }
-func init() {
-	timeSince = func(t time.Time) time.Duration {
-		timeSinceMu.Lock()
-		defer timeSinceMu.Unlock()
-		if timeSinceValue == 0 {
-			return time.Since(t)
-		}
-		return timeSinceValue
+
+// patchedClock uses the real clock unless a test has set timeSinceValue or timeSleepValue.
+type patchedClock struct{}
+
+func (patchedClock) Now() time.Time { return time.Now() }
+func (patchedClock) Since(t time.Time) time.Duration {
+	timeSinceMu.Lock()
+	defer timeSinceMu.Unlock()
+	if timeSinceValue == 0 {
+		return time.Since(t)
 	}
-	timeSleep = func(d time.Duration) {
-		timeSleepMu.Lock()
-		defer timeSleepMu.Unlock()
-		if timeSleepCheck != nil {
-			timeSleepCheck(d)
-		}
-		if timeSleepValue == 0 {
-			time.Sleep(d)
-			return
-		}
-		time.Sleep(timeSleepValue)
+	return timeSinceValue
+}
+func (patchedClock) Sleep(d time.Duration) {
+	timeSleepMu.Lock()
+	defer timeSleepMu.Unlock()
+	if timeSleepCheck != nil {
+		timeSleepCheck(d)
+	}
+	if timeSleepValue == 0 {
+		time.Sleep(d)
+		return
 	}
+	time.Sleep(timeSleepValue)
 }
+func (patchedClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
 
 // Tests that EnsurePolling works in the happy case
 func TestPollerMapEnsurePolling(t *testing.T) {
@@ -99,7 +103,7 @@ func TestPollerMapEnsurePolling(t *testing.T) {
 	})
 	accumulator.incomingProcess = make(chan struct{})
 	accumulator.unblockProcess = make(chan struct{})
-	pm := NewPollerMap(client, false)
+	pm := NewPollerMapWithClock(client, false, patchedClock{})
 	pm.SetCallbacks(accumulator)
 
 	ensurePollingUnblocked := make(chan struct{})
@@ -182,7 +186,7 @@ func TestPollerMapEnsurePollingIdempotent(t *testing.T) {
 	})
 	accumulator.incomingProcess = make(chan struct{})
 	accumulator.unblockProcess = make(chan struct{})
-	pm := NewPollerMap(client, false)
+	pm := NewPollerMapWithClock(client, false, patchedClock{})
 	pm.SetCallbacks(accumulator)
 
 	ensurePollingUnblocked := make(chan struct{})
@@ -253,7 +257,7 @@ func TestPollerMapEnsurePollingFailsWithExpiredToken(t *testing.T) {
 		t.Logf("Responding to token '%s' with 401 Unauthorized", authHeader)
 		return nil, http.StatusUnauthorized, fmt.Errorf("RUH ROH unrecognised token")
 	})
-	pm := NewPollerMap(client, false)
+	pm := NewPollerMapWithClock(client, false, patchedClock{})
 	pm.SetCallbacks(accumulator)
 
 	created, err := pm.EnsurePolling(PollerID{}, "dummy_token", "", true, zerolog.New(os.Stderr))
@@ -273,7 +277,7 @@ func TestPollerMap_ExpirePollers(t *testing.T) {
 		}
 		return &r, 200, nil
 	})
-	pm := NewPollerMap(client, false)
+	pm := NewPollerMapWithClock(client, false, patchedClock{})
 	pm.SetCallbacks(receiver)
 
 	// Start 5 pollers.
@@ -338,6 +342,62 @@ func TestPollerMap_ExpirePollers(t *testing.T) {
 	}
 }
 
+func TestPollerMap_TerminateUserPollers(t *testing.T) {
+	receiver, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		r := SyncResponse{
+			NextBatch: "batchy-mc-batchface",
+		}
+		return &r, 200, nil
+	})
+	var expiredTokens atomic.Int64
+	receiver.onExpiredToken = func(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+		expiredTokens.Add(1)
+	}
+	pm := NewPollerMapWithClock(client, false, patchedClock{})
+	pm.SetCallbacks(receiver)
+
+	pollerSpecs := []struct {
+		UserID   string
+		DeviceID string
+		Token    string
+	}{
+		{UserID: "alice", DeviceID: "a_device1", Token: "a_token1"},
+		{UserID: "alice", DeviceID: "a_device2", Token: "a_token2"},
+		{UserID: "bob", DeviceID: "b_device", Token: "b_token"},
+	}
+	for i, spec := range pollerSpecs {
+		if _, err := pm.EnsurePolling(PollerID{UserID: spec.UserID, DeviceID: spec.DeviceID}, spec.Token, "", true, logger); err != nil {
+			t.Errorf("EnsurePolling error for poller #%d (%v): %s", i, spec, err)
+		}
+	}
+
+	if got := pm.TerminateUserPollers("alice"); got != 2 {
+		t.Errorf("TerminateUserPollers: got %d want 2", got)
+	}
+	// terminating again does nothing
+	if got := pm.TerminateUserPollers("alice"); got != 0 {
+		t.Errorf("TerminateUserPollers: got %d want 0 on second call", got)
+	}
+	if got := expiredTokens.Load(); got != 0 {
+		t.Errorf("TerminateUserPollers expired %d tokens, want 0", got)
+	}
+	if got := pm.DeviceIDs("alice"); len(got) != 0 {
+		t.Errorf("alice still has pollers for %v", got)
+	}
+	if got := pm.DeviceIDs("bob"); len(got) != 1 {
+		t.Errorf("bob has pollers for %v, want [b_device]", got)
+	}
+
+	// alice's pollers are recreated on the next EnsurePolling
+	created, err := pm.EnsurePolling(PollerID{UserID: "alice", DeviceID: "a_device1"}, "a_token1", "", false, logger)
+	if err != nil {
+		t.Fatalf("EnsurePolling: %s", err)
+	}
+	if !created {
+		t.Errorf("EnsurePolling did not recreate a terminated poller")
+	}
+}
+
 // Check that a call to Poll starts polling and accumulating, and terminates on 401s.
 func TestPollerPollFromNothing(t *testing.T) {
 	nextSince := "next"
@@ -370,7 +430,7 @@ func TestPollerPollFromNothing(t *testing.T) {
 	})
 	var wg sync.WaitGroup
 	wg.Add(1)
-	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, patchedClock{})
 	go func() {
 		defer wg.Done()
 		poller.Poll("")
@@ -395,6 +455,35 @@ func TestPollerPollFromNothing(t *testing.T) {
 	}
 }
 
+// Check that soft logouts terminate the poller without losing the device's position.
+func TestPollerPausesOnSoftLogout(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		if since == "" {
+			return &SyncResponse{NextBatch: "1"}, 200, nil
+		}
+		if since == "1" {
+			return &SyncResponse{NextBatch: "2"}, 200, nil
+		}
+		return nil, 401, fmt.Errorf("DoSyncV2: %w", HTTP401SoftLogout)
+	})
+	var gotSoftLogout *bool
+	accumulator.onExpiredToken = func(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+		gotSoftLogout = &softLogout
+	}
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, patchedClock{})
+	poller.Poll("")
+
+	if gotSoftLogout == nil || !*gotSoftLogout {
+		t.Fatalf("OnExpiredToken was not called with softLogout=true")
+	}
+	if !poller.terminated.Load() {
+		t.Errorf("poller was not terminated")
+	}
+	// the since token is stored so polling resumes from here once the device logs back in
+	mustEqualSince(t, accumulator.pollerIDToSince[pid], "2")
+}
+
 // Check that a call to Poll starts polling with an existing since token and accumulates timeline entries
 func TestPollerPollFromExisting(t *testing.T) {
 	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
@@ -460,7 +549,7 @@ func TestPollerPollFromExisting(t *testing.T) {
 	})
 	var wg sync.WaitGroup
 	wg.Add(1)
-	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, patchedClock{})
 	go func() {
 		defer wg.Done()
 		poller.Poll(since)
@@ -503,7 +592,7 @@ func TestPollerPollUpdateDeviceSincePeriodically(t *testing.T) {
 		return <-syncResponses, 200, nil
 	})
 	accumulator.updateSinceCalled = make(chan struct{}, 1)
-	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, patchedClock{})
 	defer poller.Terminate()
 	go func() {
 		poller.Poll(initialSinceToken)
@@ -613,7 +702,7 @@ func TestPollerGivesUpEventually(t *testing.T) {
 	}()
 	var wg sync.WaitGroup
 	wg.Add(1)
-	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, patchedClock{})
 	go func() {
 		defer wg.Done()
 		poller.Poll("")
@@ -685,7 +774,7 @@ func TestPollerBackoff(t *testing.T) {
 	}()
 	var wg sync.WaitGroup
 	wg.Add(1)
-	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, patchedClock{})
 	go func() {
 		defer wg.Done()
 		poller.Poll("some_since_value")
@@ -705,6 +794,49 @@ func TestPollerBackoff(t *testing.T) {
 	}
 }
 
+func TestPollerStatus(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	var p *poller
+	var statusAfterRecovering PollerStatus
+	numCalls := 0
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		numCalls++
+		switch numCalls {
+		case 1:
+			if status := p.Status(); status.LastPollTS != 0 || status.Since != "" {
+				t.Errorf("got status %+v before the first poll", status)
+			}
+			return nil, 502, fmt.Errorf("bad gateway")
+		case 2:
+			if status := p.Status(); status.FailCount != 1 || !status.BackingOff || status.LastPollTS == 0 {
+				t.Errorf("got status %+v after a failed poll, want it to be backing off", status)
+			}
+			return &SyncResponse{NextBatch: "next"}, 200, nil
+		case 3:
+			statusAfterRecovering = p.Status()
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	setTimeSleepDelay(time.Millisecond)
+	defer setTimeSleepDelay(0)
+	p = newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, patchedClock{})
+	p.Poll("")
+
+	if statusAfterRecovering.Since != "next" || statusAfterRecovering.FailCount != 0 || statusAfterRecovering.BackingOff {
+		t.Errorf("got status %+v after a successful poll, want since=next and not backing off", statusAfterRecovering)
+	}
+	// the error is kept after recovering
+	if !strings.Contains(statusAfterRecovering.LastError, "HTTP 502") || statusAfterRecovering.LastErrorTS == 0 {
+		t.Errorf("got last error %q at %d, want the 502", statusAfterRecovering.LastError, statusAfterRecovering.LastErrorTS)
+	}
+	if statusAfterRecovering.Terminated {
+		t.Errorf("poller was terminated before the token was invalidated")
+	}
+	if status := p.Status(); !status.Terminated || status.UserID != pid.UserID || status.DeviceID != pid.DeviceID {
+		t.Errorf("got status %+v after the token was invalidated, want it terminated", status)
+	}
+}
+
 // Regression test to make sure that if you start polling with an invalid token, we do end up unblocking WaitUntilInitialSync
 // and don't end up blocking forever.
 func TestPollerUnblocksIfTerminatedInitially(t *testing.T) {
@@ -715,7 +847,7 @@ func TestPollerUnblocksIfTerminatedInitially(t *testing.T) {
 
 	pollUnblocked := make(chan struct{})
 	waitUntilInitialSyncUnblocked := make(chan struct{})
-	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, patchedClock{})
 	go func() {
 		poller.Poll("")
 		close(pollUnblocked)
@@ -740,6 +872,50 @@ func TestPollerUnblocksIfTerminatedInitially(t *testing.T) {
 	}
 }
 
+// Test that a poller which panics reports that it terminated unexpectedly, and is marked as
+// terminated so it gets replaced, whereas a poller which is terminated does not.
+func TestPollerReportsUnexpectedTermination(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	testCases := []struct {
+		name           string
+		panics         bool
+		wantUnexpected bool
+	}{
+		{name: "panic", panics: true, wantUnexpected: true},
+		{name: "terminated", panics: false, wantUnexpected: false},
+	}
+	for _, tc := range testCases {
+		var p *poller
+		accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+			if since == "" {
+				return &SyncResponse{NextBatch: "1"}, 200, nil
+			}
+			if tc.panics {
+				panic("oh no")
+			}
+			p.Terminate()
+			return nil, 0, fmt.Errorf("terminated")
+		})
+		terminated := make(chan bool, 1)
+		accumulator.onTerminated = func(ctx context.Context, pollerID PollerID, unexpected bool) {
+			terminated <- unexpected
+		}
+		p = newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false, patchedClock{})
+		go p.Poll("")
+		select {
+		case unexpected := <-terminated:
+			if unexpected != tc.wantUnexpected {
+				t.Errorf("%s: got unexpected=%v want %v", tc.name, unexpected, tc.wantUnexpected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: OnTerminated was not called", tc.name)
+		}
+		if !p.terminated.Load() {
+			t.Errorf("%s: poller was not marked as terminated", tc.name)
+		}
+	}
+}
+
 // Test that the poller sends the same sync v2 request, without incrementing the since token,
 // when an errorable callback returns an error.
 func TestPollerResendsOnCallbackError(t *testing.T) {
@@ -1010,7 +1186,7 @@ func TestPollerResendsOnCallbackError(t *testing.T) {
 			},
 		}
 		receiver := tc.generateReceiver()
-		poller := newPoller(pid, "Authorization: hello world", client, receiver, zerolog.New(os.Stderr), false)
+		poller := newPoller(pid, "Authorization: hello world", client, receiver, zerolog.New(os.Stderr), false, patchedClock{})
 		waitForInitialSync(t, poller)
 		select {
 		case <-waitForStuckPolling:
@@ -1082,7 +1258,7 @@ func TestPollerDoesNotResendOnDataError(t *testing.T) {
 			}, 200, nil
 		},
 	}
-	poller := newPoller(pid, "Authorization: hello world", client, receiver, zerolog.New(os.Stderr), false)
+	poller := newPoller(pid, "Authorization: hello world", client, receiver, zerolog.New(os.Stderr), false, patchedClock{})
 	waitForInitialSync(t, poller)
 	select {
 	case <-waitForSuccess:
@@ -1112,7 +1288,7 @@ func TestPollerResendsOnDataErrorWithOtherErrors(t *testing.T) {
 			return internal.NewDataError("onLeftRoom this is a test: %v", 42)
 		},
 	}
-	poller := newPoller(pid, "Authorization: hello world", nil, receiver, zerolog.New(os.Stderr), false)
+	poller := newPoller(pid, "Authorization: hello world", nil, receiver, zerolog.New(os.Stderr), false, patchedClock{})
 	testCases := []struct {
 		name      string
 		res       SyncResponse
@@ -1274,6 +1450,15 @@ func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isF
 func (c *mockClient) WhoAmI(ctx context.Context, authHeader string) (string, string, error) {
 	return "@alice:localhost", "device_123", nil
 }
+func (c *mockClient) Messages(ctx context.Context, authHeader, roomID, from string, limit int) (*MessagesResponse, error) {
+	return &MessagesResponse{}, nil
+}
+func (c *mockClient) RoomState(ctx context.Context, authHeader, roomID string) ([]json.RawMessage, error) {
+	return nil, nil
+}
+func (c *mockClient) RoomSummary(ctx context.Context, authHeader, roomID string) (json.RawMessage, error) {
+	return nil, nil
+}
 
 type mockDataReceiver struct {
 	*overrideDataReceiver
@@ -1323,8 +1508,8 @@ type overrideDataReceiver struct {
 	onInvite            func(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error
 	onLeftRoom          func(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
 	onE2EEData          func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
-	onTerminated        func(ctx context.Context, pollerID PollerID)
-	onExpiredToken      func(ctx context.Context, accessTokenHash, userID, deviceID string)
+	onTerminated        func(ctx context.Context, pollerID PollerID, unexpected bool)
+	onExpiredToken      func(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool)
 }
 
 func (s *overrideDataReceiver) Accumulate(ctx context.Context, userID, deviceID, roomID string, timeline TimelineResponse) error {
@@ -1393,17 +1578,17 @@ func (s *overrideDataReceiver) OnE2EEData(ctx context.Context, userID, deviceID
 	}
 	return s.onE2EEData(ctx, userID, deviceID, otkCounts, fallbackKeyTypes, deviceListChanges)
 }
-func (s *overrideDataReceiver) OnTerminated(ctx context.Context, pollerID PollerID) {
+func (s *overrideDataReceiver) OnTerminated(ctx context.Context, pollerID PollerID, unexpected bool) {
 	if s.onTerminated == nil {
 		return
 	}
-	s.onTerminated(ctx, pollerID)
+	s.onTerminated(ctx, pollerID, unexpected)
 }
-func (s *overrideDataReceiver) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
+func (s *overrideDataReceiver) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
 	if s.onExpiredToken == nil {
 		return
 	}
-	s.onExpiredToken(ctx, accessTokenHash, userID, deviceID)
+	s.onExpiredToken(ctx, accessTokenHash, userID, deviceID, softLogout)
 }
 
 func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error)) (*mockDataReceiver, *mockClient) {
@@ -1,17 +1,16 @@
 package sync2
 
 import (
-	"os"
+	"fmt"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/jmoiron/sqlx"
-	"github.com/rs/zerolog"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger()
 
 type Storage struct {
 	DevicesTable *DevicesTable
@@ -43,3 +42,57 @@ func (s *Storage) Teardown() {
 		panic("V2Storage.Teardown: " + err.Error())
 	}
 }
+
+// Token returns the stored token for an access token, or sql.ErrNoRows if there isn't one.
+func (s *Storage) Token(accessToken string) (*Token, error) {
+	return s.TokensTable.Token(accessToken)
+}
+
+func (s *Storage) GetTokenAndSince(userID, deviceID, tokenHash string) (accessToken, since string, err error) {
+	return s.TokensTable.GetTokenAndSince(userID, deviceID, tokenHash)
+}
+
+func (s *Storage) MaybeUpdateLastSeen(token *Token, newLastSeen time.Time) error {
+	return s.TokensTable.MaybeUpdateLastSeen(token, newLastSeen)
+}
+
+// InsertTokenAndDevice stores a new access token for the device, and the device if it is new.
+func (s *Storage) InsertTokenAndDevice(accessToken, userID, deviceID string, lastSeen time.Time) (token *Token, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		token, err = s.TokensTable.Insert(txn, accessToken, userID, deviceID, lastSeen)
+		if err != nil {
+			return fmt.Errorf("failed to insert v2 token: %w", err)
+		}
+		if err = s.DevicesTable.InsertDevice(txn, userID, deviceID); err != nil {
+			return fmt.Errorf("failed to insert v2 device: %w", err)
+		}
+		return nil
+	})
+	return
+}
+
+// TokenForEachDevice returns the most recently used token for each device.
+func (s *Storage) TokenForEachDevice() ([]TokenForPoller, error) {
+	return s.TokensTable.TokenForEachDevice(nil)
+}
+
+// LatestTokenForUsers returns the most recently seen token belonging to any of these users.
+func (s *Storage) LatestTokenForUsers(userIDs []string) (*Token, error) {
+	return s.TokensTable.LatestTokenForUsers(userIDs)
+}
+
+func (s *Storage) DeleteToken(accessTokenHash string) error {
+	return s.TokensTable.Delete(accessTokenHash)
+}
+
+func (s *Storage) UpdateDeviceSince(userID, deviceID, since string) error {
+	return s.DevicesTable.UpdateDeviceSince(userID, deviceID, since)
+}
+
+func (s *Storage) ResetSinceForUser(userID string) (int64, error) {
+	return s.DevicesTable.ResetSinceForUser(userID)
+}
+
+func (s *Storage) FindOldDevices(inactivityPeriod time.Duration) ([]Device, error) {
+	return s.DevicesTable.FindOldDevices(inactivityPeriod)
+}
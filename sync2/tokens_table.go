@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"io"
 	"strings"
 	"time"
@@ -130,6 +131,27 @@ func (t *TokensTable) Token(plaintextToken string) (*Token, error) {
 	return &token, nil
 }
 
+// LatestTokenForUsers returns the most recently seen token belonging to any of these users.
+// Errors with sql.ErrNoRows if none of them have a token.
+func (t *TokensTable) LatestTokenForUsers(userIDs []string) (*Token, error) {
+	var token Token
+	err := t.db.Get(
+		&token,
+		`SELECT token_encrypted, user_id, device_id, last_seen FROM syncv3_sync2_tokens
+		WHERE user_id = ANY($1) ORDER BY last_seen DESC LIMIT 1`,
+		pq.StringArray(userIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	token.AccessToken, err = t.decrypt(token.AccessTokenEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	token.AccessTokenHash = hashToken(token.AccessToken)
+	return &token, nil
+}
+
 // TokenForPoller represents a row of the tokens table, together with any data
 // maintained by pollers for that token's device.
 type TokenForPoller struct {
@@ -1,6 +1,7 @@
 package sync2
 
 import (
+	"database/sql"
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"testing"
@@ -132,6 +133,48 @@ func TestDeletingTokens(t *testing.T) {
 	}
 }
 
+func TestLatestTokenForUsers(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	tokens := NewTokensTable(db, "my_secret")
+
+	alice := "@alice:TestLatestTokenForUsers"
+	bob := "@bob:TestLatestTokenForUsers"
+	seen := time.Now()
+	_ = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		for _, tok := range []struct {
+			token, userID, deviceID string
+			lastSeen                time.Time
+		}{
+			{"alice_old", alice, "A1", seen.Add(-time.Hour)},
+			{"alice_new", alice, "A2", seen},
+			{"bob", bob, "B", seen.Add(-time.Minute)},
+		} {
+			if _, err := tokens.Insert(txn, tok.token, tok.userID, tok.deviceID, tok.lastSeen); err != nil {
+				t.Fatalf("Failed to Insert token: %s", err)
+			}
+		}
+		return nil
+	})
+
+	t.Log("The most recently seen token of any of the users is returned.")
+	token, err := tokens.LatestTokenForUsers([]string{bob, alice})
+	if err != nil {
+		t.Fatalf("LatestTokenForUsers: %s", err)
+	}
+	assertEqualTokens(t, tokens, token, "alice_new", alice, "A2", seen)
+	token, err = tokens.LatestTokenForUsers([]string{bob})
+	if err != nil {
+		t.Fatalf("LatestTokenForUsers: %s", err)
+	}
+	assertEqualTokens(t, tokens, token, "bob", bob, "B", seen.Add(-time.Minute))
+
+	t.Log("Users without tokens return sql.ErrNoRows.")
+	if _, err = tokens.LatestTokenForUsers([]string{"@charlie:TestLatestTokenForUsers"}); err != sql.ErrNoRows {
+		t.Fatalf("LatestTokenForUsers: got error %v want %v", err, sql.ErrNoRows)
+	}
+}
+
 func assertEqualTokens(t *testing.T, table *TokensTable, got *Token, accessToken, userID, deviceID string, lastSeen time.Time) {
 	t.Helper()
 	assertEqual(t, got.AccessToken, accessToken, "Token.AccessToken mismatch")
@@ -3,13 +3,12 @@ package caches
 import (
 	"context"
 	"encoding/json"
-	"os"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
 
@@ -53,12 +52,17 @@ type EventData struct {
 	// Flag set when this event should force the room contents to be resent e.g
 	// state res, initial join, etc
 	ForceInitial bool
+
+	// True if this is a membership event which changes the user's membership, rather than
+	// their profile.
+	IsMembershipChange bool
+
+	// When this event was committed to the database, if known. Used to measure how long it takes to
+	// deliver events to connections.
+	CommittedAt time.Time
 }
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger()
 
 // The purpose of global cache is to store global-level information about all rooms the server is aware of.
 // Global-level information is represented as internal.RoomMetadata and includes things like Heroes, join/invite
@@ -76,10 +80,20 @@ type GlobalCache struct {
 	roomIDToMetadataMu *sync.RWMutex
 
 	// for loading room state not held in-memory TODO: remove to another struct along with associated functions
-	store *state.Storage
+	store GlobalCacheStore
+}
+
+// GlobalCacheStore is the storage used by the global cache to load rooms on demand. Implemented by
+// state.Storage.
+type GlobalCacheStore interface {
+	LatestEventNID() (int64, error)
+	JoinedRoomsAfterPosition(userID string, pos int64) (map[string]internal.EventMetadata, error)
+	LatestEventMetadataInRooms(roomIDs []string, highestNID int64) (map[string]state.RoomLatestEvent, error)
+	RoomStateAfterEventPosition(ctx context.Context, roomIDs []string, pos int64, eventTypesToStateKeys map[string][]string) (map[string][]state.Event, error)
+	ResetMetadataState(metadata *internal.RoomMetadata) error
 }
 
-func NewGlobalCache(store *state.Storage) *GlobalCache {
+func NewGlobalCache(store GlobalCacheStore) *GlobalCache {
 	return &GlobalCache{
 		roomIDToMetadataMu: &sync.RWMutex{},
 		store:              store,
@@ -161,16 +175,48 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (
 		i++
 	}
 
-	latestNIDs, err = c.store.LatestEventNIDInRooms(roomIDs, initialLoadPosition)
+	// load the latest event in every room in one go, rather than asking about each room in turn
+	latestEvents, err := c.store.LatestEventMetadataInRooms(roomIDs, initialLoadPosition)
 	if err != nil {
 		return 0, nil, nil, nil, err
 	}
 
 	// TODO: no guarantee that this state is the same as latest unless called in a dispatcher loop
 	rooms := c.LoadRoomsFromMap(ctx, joinTimingByRoomID)
+	latestNIDs = make(map[string]int64, len(latestEvents))
+	for roomID, latest := range latestEvents {
+		latestNIDs[roomID] = latest.NID
+		seedFromLatestEvent(rooms[roomID], latest, initialLoadPosition)
+	}
 	return initialLoadPosition, rooms, joinTimingByRoomID, latestNIDs, nil
 }
 
+// seedFromLatestEvent rewinds the ordering information in a copy of the metadata to what it was
+// at the load position. The cached metadata may already include events after the load position,
+// which the connection will see again as live updates.
+func seedFromLatestEvent(metadata *internal.RoomMetadata, latest state.RoomLatestEvent, loadPosition int64) {
+	if metadata == nil {
+		return
+	}
+	for evType, evMeta := range metadata.LatestEventsByType {
+		if evMeta.NID > loadPosition {
+			delete(metadata.LatestEventsByType, evType)
+		}
+	}
+	if metadata.LatestEventsByType == nil {
+		metadata.LatestEventsByType = make(map[string]internal.EventMetadata)
+	}
+	if existing, ok := metadata.LatestEventsByType[latest.Type]; !ok || existing.NID < latest.NID {
+		metadata.LatestEventsByType[latest.Type] = internal.EventMetadata{
+			NID:       latest.NID,
+			Timestamp: latest.Timestamp,
+		}
+	}
+	if latest.Timestamp > 0 {
+		metadata.LastMessageTimestamp = latest.Timestamp
+	}
+}
+
 func (c *GlobalCache) LoadStateEvent(ctx context.Context, roomID string, loadPosition int64, evType, stateKey string) json.RawMessage {
 	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, []string{roomID}, loadPosition, map[string][]string{
 		evType: {stateKey},
@@ -327,7 +373,7 @@ func (c *GlobalCache) OnNewEvent(
 		}
 	case "m.space.child": // only track space child changes for now, not parents
 		if ed.StateKey != nil {
-			isDeleted := !ed.Content.Get("via").IsArray()
+			isDeleted := !state.HasValidVia(ed.Content)
 			if isDeleted {
 				delete(metadata.ChildSpaceRooms, *ed.StateKey)
 			} else {
@@ -337,8 +383,7 @@ func (c *GlobalCache) OnNewEvent(
 	case "m.room.member":
 		if ed.StateKey != nil {
 			membership := ed.Content.Get("membership").Str
-			eventJSON := gjson.ParseBytes(ed.Event)
-			if internal.IsMembershipChange(eventJSON) {
+			if ed.IsMembershipChange {
 				metadata.JoinCount = ed.JoinCount
 				metadata.InviteCount = ed.InviteCount
 				if membership == "leave" || membership == "ban" {
@@ -89,6 +89,25 @@ func (u *RoomAccountDataUpdate) Type() string {
 	return fmt.Sprintf("RoomAccountDataUpdate[%s] len=%v", u.RoomID(), len(u.AccountData))
 }
 
+// DMStatusUpdate represents a change to whether a room is a DM, due to new m.direct account data.
+type DMStatusUpdate struct {
+	RoomUpdate
+}
+
+func (u *DMStatusUpdate) Type() string {
+	return fmt.Sprintf("DMStatusUpdate[%s]", u.RoomID())
+}
+
+// RoomOrderUpdate represents a change to a room's position in the user's manual room ordering, due
+// to new AccountDataTypeRoomOrder account data.
+type RoomOrderUpdate struct {
+	RoomUpdate
+}
+
+func (u *RoomOrderUpdate) Type() string {
+	return fmt.Sprintf("RoomOrderUpdate[%s]", u.RoomID())
+}
+
 type DeviceDataUpdate struct {
 	// no data; just wakes up the connection
 	// data comes via sidechannels e.g the database
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 
@@ -16,6 +18,11 @@ import (
 
 const (
 	InvitesAreHighlightsValue = 1 // invite -> highlight count = 1
+
+	// AccountDataTypeRoomOrder is global account data with content {"rooms":[room IDs]}, listing the
+	// rooms the user has pinned in the order they should appear in lists sorted by_manual. As it is
+	// account data, all the user's devices share the same arrangement.
+	AccountDataTypeRoomOrder = "org.matrix.sliding_sync.room_order"
 )
 
 type CacheFinder interface {
@@ -65,6 +72,12 @@ type UserRoomData struct {
 	Tags map[string]float64
 	// JoinTiming tracks our latest join to the room, excluding profile changes.
 	JoinTiming internal.EventMetadata
+	// CutoffNID is the NID of the event which kicked or banned the user from this room, or 0.
+	// Nothing which happened in the room after this event may be sent to the user.
+	CutoffNID int64
+	// ManualOrder is the 1-based position of this room in the user's AccountDataTypeRoomOrder
+	// account data, or 0 if the room is not pinned.
+	ManualOrder int
 }
 
 func NewUserRoomData() UserRoomData {
@@ -88,16 +101,26 @@ type InviteData struct {
 	Encrypted            bool
 	IsDM                 bool
 	RoomType             string
+	// the number of joined members according to the homeserver's room summary, if we have one
+	JoinedCount int
 }
 
 func NewInviteData(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) *InviteData {
 	// work out metadata for this invite. There's an origin_server_ts on the invite m.room.member event
 	id := InviteData{
 		roomID:      roomID,
-		InviteState: inviteState,
+		InviteState: make([]json.RawMessage, 0, len(inviteState)),
 	}
+	var summary *gjson.Result
 	for _, ev := range inviteState {
 		j := gjson.ParseBytes(ev)
+		if j.Get("type").Str == state.InviteSummaryEventType {
+			// not real stripped state, so don't send it to clients
+			content := j.Get("content")
+			summary = &content
+			continue
+		}
+		id.InviteState = append(id.InviteState, ev)
 
 		switch j.Get("type").Str {
 		case "m.room.member":
@@ -135,6 +158,25 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 			id.RoomType = j.Get("content.type").Str
 		}
 	}
+	if summary != nil {
+		// the stripped state takes precedence as it was chosen by the inviter's server
+		if id.NameEvent == "" {
+			id.NameEvent = summary.Get("name").Str
+		}
+		if id.AvatarEvent == "" {
+			id.AvatarEvent = summary.Get("avatar_url").Str
+		}
+		if id.CanonicalAlias == "" {
+			id.CanonicalAlias = summary.Get("canonical_alias").Str
+		}
+		if id.RoomType == "" {
+			id.RoomType = summary.Get("room_type").Str
+		}
+		if !id.Encrypted {
+			id.Encrypted = summary.Get("encryption").Str != ""
+		}
+		id.JoinedCount = int(summary.Get("num_joined_members").Int())
+	}
 	if id.InviteEvent == nil {
 		const errMsg = "cannot make invite, missing invite event for user"
 		logger.Error().Str("invitee", userID).Str("room", roomID).Int("num_invite_state", len(inviteState)).Msg(errMsg)
@@ -164,6 +206,9 @@ func (i *InviteData) RoomMetadata() *internal.RoomMetadata {
 	metadata.CanonicalAlias = i.CanonicalAlias
 	metadata.InviteCount = 1
 	metadata.JoinCount = 1
+	if i.JoinedCount > 0 {
+		metadata.JoinCount = i.JoinedCount
+	}
 	metadata.LastMessageTimestamp = i.LastMessageTimestamp
 	metadata.Encrypted = i.Encrypted
 	metadata.RoomType = roomType
@@ -181,7 +226,7 @@ type UserCacheListener interface {
 
 // Subset of store functions used by the user cache
 type UserCacheStore interface {
-	LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error)
+	LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int, filter *internal.TimelineFilter) (map[string]*state.LatestEvents, error)
 	GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string)
 }
 
@@ -201,27 +246,89 @@ type UserCache struct {
 	joinChecker               JoinChecker
 	ignoredUsers              map[string]struct{}
 	ignoredUsersMu            *sync.RWMutex
+	// incremented before and after every write to roomToData, so it is odd whilst a write is in progress.
+	version         atomic.Uint64
+	listSnapshots   map[string]listSnapshot
+	listSnapshotsMu *sync.Mutex
 }
 
 func NewUserCache(userID string, globalCache *GlobalCache, store UserCacheStore, txnIDs TransactionIDFetcher, joinChecker JoinChecker) *UserCache {
 	// see SyncLiveHandler.userCache for the initialisation proper, which works by
 	// firing off a bunch of OnBlahBlah callbacks.
 	uc := &UserCache{
-		UserID:         userID,
-		roomToDataMu:   &sync.RWMutex{},
-		roomToData:     make(map[string]UserRoomData),
-		listeners:      make(map[int]UserCacheListener),
-		listenersMu:    &sync.RWMutex{},
-		store:          store,
-		globalCache:    globalCache,
-		txnIDs:         txnIDs,
-		joinChecker:    joinChecker,
-		ignoredUsers:   make(map[string]struct{}),
-		ignoredUsersMu: &sync.RWMutex{},
+		UserID:          userID,
+		roomToDataMu:    &sync.RWMutex{},
+		roomToData:      make(map[string]UserRoomData),
+		listeners:       make(map[int]UserCacheListener),
+		listenersMu:     &sync.RWMutex{},
+		store:           store,
+		globalCache:     globalCache,
+		txnIDs:          txnIDs,
+		joinChecker:     joinChecker,
+		ignoredUsers:    make(map[string]struct{}),
+		ignoredUsersMu:  &sync.RWMutex{},
+		listSnapshots:   make(map[string]listSnapshot),
+		listSnapshotsMu: &sync.Mutex{},
 	}
 	return uc
 }
 
+func (c *UserCache) lockRoomDataForWrite() {
+	c.roomToDataMu.Lock()
+	c.version.Add(1)
+}
+
+func (c *UserCache) unlockRoomDataForWrite() {
+	c.version.Add(1)
+	c.roomToDataMu.Unlock()
+}
+
+// Version returns a number which changes whenever the user's room data changes. It is odd whilst
+// the data is being modified. If the version is even and the same before and after reading room
+// data, nothing was modified in between.
+func (c *UserCache) Version() uint64 {
+	return c.version.Load()
+}
+
+// How long sorted lists stored with StoreListSnapshot can be reused for.
+const listSnapshotTTL = 30 * time.Second
+
+type listSnapshot struct {
+	roomIDs []string
+	expires time.Time
+}
+
+// ListSnapshot returns a copy of the sorted room IDs stored with StoreListSnapshot under this key,
+// if they have not expired.
+func (c *UserCache) ListSnapshot(key string) ([]string, bool) {
+	c.listSnapshotsMu.Lock()
+	defer c.listSnapshotsMu.Unlock()
+	snapshot, ok := c.listSnapshots[key]
+	if !ok || time.Now().After(snapshot.expires) {
+		return nil, false
+	}
+	return append([]string(nil), snapshot.roomIDs...), true
+}
+
+// StoreListSnapshot remembers the sorted room IDs of a list for a short time, so other connections
+// for this user which are set up with identical room data and request an identical list can reuse
+// them rather than filtering and sorting all the user's rooms again. The key must capture
+// everything the list depends on.
+func (c *UserCache) StoreListSnapshot(key string, roomIDs []string) {
+	now := time.Now()
+	c.listSnapshotsMu.Lock()
+	defer c.listSnapshotsMu.Unlock()
+	for k, snapshot := range c.listSnapshots {
+		if now.After(snapshot.expires) {
+			delete(c.listSnapshots, k)
+		}
+	}
+	c.listSnapshots[key] = listSnapshot{
+		roomIDs: append([]string(nil), roomIDs...),
+		expires: now.Add(listSnapshotTTL),
+	}
+}
+
 func (c *UserCache) Subsribe(ucl UserCacheListener) (id int) {
 	c.listenersMu.Lock()
 	defer c.listenersMu.Unlock()
@@ -305,14 +412,14 @@ func (c *UserCache) OnRegistered(ctx context.Context) error {
 		// Record when we joined the room. We've just had to scan the history of our
 		// membership in this room to produce joinedRooms above, so we may as well
 		// do this here too.
-		c.roomToDataMu.Lock()
+		c.lockRoomDataForWrite()
 		urd, ok := c.roomToData[room.RoomID]
 		if !ok {
 			urd = NewUserRoomData()
 		}
 		urd.JoinTiming = joinTimings[room.RoomID]
 		c.roomToData[room.RoomID] = urd
-		c.roomToDataMu.Unlock()
+		c.unlockRoomDataForWrite()
 	}
 	return nil
 }
@@ -320,16 +427,16 @@ func (c *UserCache) OnRegistered(ctx context.Context) error {
 // LazyLoadTimelines loads the most recent timeline events (up to `maxTimelineEvents`)
 // for each of the given rooms from the database (plus other timeline-related data).
 // Only events with NID <= loadPos are returned.
-// Events from senders ignored by this user are dropped.
+// Events from senders ignored by this user, or which don't pass the filter, are dropped.
 // Returns nil on error.
-func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomIDs []string, maxTimelineEvents int, filter *internal.TimelineFilter) map[string]state.LatestEvents {
 	_, span := internal.StartSpan(ctx, "LazyLoadTimelines")
 	defer span.End()
 	if c.LazyLoadTimelinesOverride != nil {
 		return c.LazyLoadTimelinesOverride(loadPos, roomIDs, maxTimelineEvents)
 	}
 	result := make(map[string]state.LatestEvents)
-	roomIDToLatestEvents, err := c.store.LatestEventsInRooms(c.UserID, roomIDs, loadPos, maxTimelineEvents)
+	roomIDToLatestEvents, err := c.store.LatestEventsInRooms(c.UserID, roomIDs, loadPos, maxTimelineEvents, filter)
 	if err != nil {
 		logger.Err(err).Strs("rooms", roomIDs).Msg("failed to get LatestEventsInRooms")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -556,9 +663,9 @@ func (c *UserCache) OnUnreadCounts(ctx context.Context, roomID string, highlight
 		}
 		data.NotificationCount = *notifCount
 	}
-	c.roomToDataMu.Lock()
+	c.lockRoomDataForWrite()
 	c.roomToData[roomID] = data
-	c.roomToDataMu.Unlock()
+	c.unlockRoomDataForWrite()
 
 	roomUpdate := &UnreadCountUpdate{
 		RoomUpdate:        c.newRoomUpdate(ctx, roomID),
@@ -575,9 +682,9 @@ func (c *UserCache) OnSpaceUpdate(ctx context.Context, parentRoomID, childRoomID
 	} else {
 		childURD.Spaces[parentRoomID] = struct{}{}
 	}
-	c.roomToDataMu.Lock()
+	c.lockRoomDataForWrite()
 	c.roomToData[childRoomID] = childURD
-	c.roomToDataMu.Unlock()
+	c.unlockRoomDataForWrite()
 
 	// now we need to notify connections for the _child_
 	// but only if they are allowed to see the child event (i.e they are joined to the child room)
@@ -600,15 +707,32 @@ func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 			urd.HighlightCount = 0
 		}
 	}
+	// track whether the user is still in the room as soon as we see their membership change, so the
+	// room is removed from lists along with this event rather than waiting for OnLeftRoom, which may
+	// be dropped as the leave event has already been processed.
+	if eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
+		membership := eventData.Content.Get("membership").Str
+		switch membership {
+		case "leave", "ban":
+			urd.HasLeft = true
+			urd.HighlightCount = 0
+			if eventData.NID > 0 && (membership == "ban" || eventData.Sender != c.UserID) {
+				urd.CutoffNID = eventData.NID
+			}
+		case "join":
+			urd.HasLeft = false
+			urd.CutoffNID = 0
+		}
+	}
 	if eventData.EventType == "m.space.child" && eventData.StateKey != nil {
 		// the children for a space we are a part of have changed. Find the room that was affected and update our cache value.
 		childRoomID := *eventData.StateKey
-		isDeleted := !eventData.Content.Get("via").IsArray()
+		isDeleted := !state.HasValidVia(eventData.Content)
 		c.OnSpaceUpdate(ctx, eventData.RoomID, childRoomID, isDeleted, eventData)
 	}
-	c.roomToDataMu.Lock()
+	c.lockRoomDataForWrite()
 	c.roomToData[eventData.RoomID] = urd
-	c.roomToDataMu.Unlock()
+	c.unlockRoomDataForWrite()
 
 	roomUpdate := &RoomEventUpdate{
 		RoomUpdate: c.newRoomUpdate(ctx, eventData.RoomID),
@@ -630,9 +754,9 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 	urd.HighlightCount = InvitesAreHighlightsValue
 	urd.IsDM = inviteData.IsDM
 	urd.Invite = inviteData
-	c.roomToDataMu.Lock()
+	c.lockRoomDataForWrite()
 	c.roomToData[roomID] = urd
-	c.roomToDataMu.Unlock()
+	c.unlockRoomDataForWrite()
 
 	up := &InviteUpdate{
 		RoomUpdate: &roomUpdateCache{
@@ -654,9 +778,9 @@ func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent js
 	urd.HasLeft = true
 	urd.Invite = nil
 	urd.HighlightCount = 0
-	c.roomToDataMu.Lock()
+	c.lockRoomDataForWrite()
 	c.roomToData[roomID] = urd
-	c.roomToDataMu.Unlock()
+	c.unlockRoomDataForWrite()
 
 	ev := gjson.ParseBytes(leaveEvent)
 	stateKey := ev.Get("state_key").Str
@@ -698,6 +822,10 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 	roomUpdates := make(map[string][]state.AccountData)
 	// room_id -> tag_id -> order
 	tagUpdates := make(map[string]map[string]float64)
+	// rooms which have become, or stopped being, DMs
+	var dmChangedRoomIDs []string
+	// rooms which have moved in the user's manual ordering
+	var orderChangedRoomIDs []string
 	for _, d := range datas {
 		up := roomUpdates[d.RoomID]
 		up = append(up, d)
@@ -714,9 +842,12 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 				return true
 			})
 			// this event REPLACES all DM rooms so reset the DM state on all rooms then update
-			c.roomToDataMu.Lock()
+			c.lockRoomDataForWrite()
 			for roomID, urd := range c.roomToData {
 				_, exists := dmRoomSet[roomID]
+				if urd.IsDM != exists {
+					dmChangedRoomIDs = append(dmChangedRoomIDs, roomID)
+				}
 				urd.IsDM = exists
 				c.roomToData[roomID] = urd
 				delete(dmRoomSet, roomID)
@@ -726,8 +857,36 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 				u := NewUserRoomData()
 				u.IsDM = true
 				c.roomToData[dmRoomID] = u
+				dmChangedRoomIDs = append(dmChangedRoomIDs, dmRoomID)
+			}
+			c.unlockRoomDataForWrite()
+		case AccountDataTypeRoomOrder:
+			if d.RoomID != state.AccountDataGlobalRoom {
+				continue
+			}
+			positions := make(map[string]int)
+			for i, roomIDResult := range gjson.ParseBytes(d.Data).Get("content.rooms").Array() {
+				if _, exists := positions[roomIDResult.Str]; !exists {
+					positions[roomIDResult.Str] = i + 1
+				}
 			}
-			c.roomToDataMu.Unlock()
+			// like m.direct, this event REPLACES the order of all rooms
+			c.lockRoomDataForWrite()
+			for roomID, urd := range c.roomToData {
+				if urd.ManualOrder != positions[roomID] {
+					orderChangedRoomIDs = append(orderChangedRoomIDs, roomID)
+				}
+				urd.ManualOrder = positions[roomID]
+				c.roomToData[roomID] = urd
+				delete(positions, roomID)
+			}
+			for roomID, pos := range positions {
+				u := NewUserRoomData()
+				u.ManualOrder = pos
+				c.roomToData[roomID] = u
+				orderChangedRoomIDs = append(orderChangedRoomIDs, roomID)
+			}
+			c.unlockRoomDataForWrite()
 		case "m.tag":
 			content := gjson.ParseBytes(d.Data).Get("content.tags")
 			if tagUpdates[d.RoomID] == nil {
@@ -756,7 +915,7 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 		}
 	}
 	if len(tagUpdates) > 0 {
-		c.roomToDataMu.Lock()
+		c.lockRoomDataForWrite()
 		// bulk assign tag updates
 		for roomID, tags := range tagUpdates {
 			urd, ok := c.roomToData[roomID]
@@ -766,7 +925,7 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 			urd.Tags = tags
 			c.roomToData[roomID] = urd
 		}
-		c.roomToDataMu.Unlock()
+		c.unlockRoomDataForWrite()
 	}
 	// bucket account data updates per-room and globally then invoke listeners
 	for roomID, updates := range roomUpdates {
@@ -783,7 +942,24 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 			c.emitOnRoomUpdate(ctx, roomUpdate)
 		}
 	}
-
+	// tell connections about rooms whose DM status changed so they can move them between lists
+	for _, roomID := range dmChangedRoomIDs {
+		if !c.joinChecker.IsUserJoined(c.UserID, roomID) && !c.LoadRoomData(roomID).IsInvite {
+			continue
+		}
+		c.emitOnRoomUpdate(ctx, &DMStatusUpdate{
+			RoomUpdate: c.newRoomUpdate(ctx, roomID),
+		})
+	}
+	// tell connections about rooms which have moved so lists sorted by_manual are resorted
+	for _, roomID := range orderChangedRoomIDs {
+		if !c.joinChecker.IsUserJoined(c.UserID, roomID) && !c.LoadRoomData(roomID).IsInvite {
+			continue
+		}
+		c.emitOnRoomUpdate(ctx, &RoomOrderUpdate{
+			RoomUpdate: c.newRoomUpdate(ctx, roomID),
+		})
+	}
 }
 
 func (u *UserCache) ShouldIgnore(userID string) bool {
@@ -7,7 +7,9 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
 )
 
 type joinChecker struct{}
@@ -97,6 +99,57 @@ func TestAnnotateWithTransactionIDs(t *testing.T) {
 	}
 }
 
+type roomUpdateCollector struct {
+	updates []caches.RoomUpdate
+}
+
+func (c *roomUpdateCollector) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	c.updates = append(c.updates, up)
+}
+
+func (c *roomUpdateCollector) OnUpdate(ctx context.Context, up caches.Update) {}
+
+// Test that the user's own leave event marks the room as left in the update for that event, so
+// connections remove the room from their lists straight away.
+func TestUserCacheOwnMembershipSetsHasLeft(t *testing.T) {
+	userID := "@alice:localhost"
+	roomID := "!a:localhost"
+	uc := caches.NewUserCache(userID, caches.NewGlobalCache(nil), nil, &txnIDFetcher{}, &joinChecker{})
+	collector := &roomUpdateCollector{}
+	uc.Subsribe(collector)
+
+	testCases := []struct {
+		membership  string
+		wantHasLeft bool
+	}{
+		{membership: "join", wantHasLeft: false},
+		{membership: "leave", wantHasLeft: true},
+		{membership: "join", wantHasLeft: false},
+		{membership: "ban", wantHasLeft: true},
+	}
+	for i, tc := range testCases {
+		content := fmt.Sprintf(`{"membership":"%s"}`, tc.membership)
+		uc.OnNewEvent(context.Background(), &caches.EventData{
+			Event:     json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"%s","content":%s}`, userID, userID, content)),
+			RoomID:    roomID,
+			EventType: "m.room.member",
+			StateKey:  &userID,
+			Content:   gjson.Parse(content),
+			Sender:    userID,
+			NID:       int64(i + 1),
+		})
+		if got := uc.LoadRoomData(roomID).HasLeft; got != tc.wantHasLeft {
+			t.Errorf("%s: LoadRoomData got HasLeft=%v want %v", tc.membership, got, tc.wantHasLeft)
+		}
+		if len(collector.updates) != i+1 {
+			t.Fatalf("%s: got %d updates, want %d", tc.membership, len(collector.updates), i+1)
+		}
+		if got := collector.updates[i].UserRoomMetadata().HasLeft; got != tc.wantHasLeft {
+			t.Errorf("%s: update got HasLeft=%v want %v", tc.membership, got, tc.wantHasLeft)
+		}
+	}
+}
+
 func js(in interface{}) string {
 	b, _ := json.Marshal(in)
 	return string(b)
@@ -129,3 +182,100 @@ func convertIDTxnToEventStub(sender string, roomToEventIDs map[string][][2]strin
 	}
 	return result
 }
+
+func TestNewInviteDataWithRoomSummary(t *testing.T) {
+	alice := "@alice:localhost"
+	roomID := "!summary:localhost"
+	inviteEvent := json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","sender":"@bob:localhost","origin_server_ts":123,"content":{"membership":"invite"}}`)
+	avatarEvent := json.RawMessage(`{"type":"m.room.avatar","state_key":"","sender":"@bob:localhost","content":{"url":"mxc://stripped"}}`)
+	summaryEvent := json.RawMessage(`{"type":"` + state.InviteSummaryEventType + `","state_key":"","content":{
+		"room_id":"!summary:localhost","name":"Summary Name","avatar_url":"mxc://summary","canonical_alias":"#summary:localhost",
+		"room_type":"m.space","encryption":"m.megolm.v1.aes-sha2","num_joined_members":42}}`)
+
+	id := caches.NewInviteData(context.Background(), alice, roomID, []json.RawMessage{inviteEvent, avatarEvent, summaryEvent})
+	if id == nil {
+		t.Fatalf("NewInviteData returned nil")
+	}
+	if !reflect.DeepEqual(id.InviteState, []json.RawMessage{inviteEvent, avatarEvent}) {
+		t.Errorf("InviteState includes the summary: %s", id.InviteState)
+	}
+	metadata := id.RoomMetadata()
+	if metadata.NameEvent != "Summary Name" {
+		t.Errorf("got name %q want %q", metadata.NameEvent, "Summary Name")
+	}
+	if metadata.AvatarEvent != "mxc://stripped" {
+		t.Errorf("got avatar %q, want the stripped state avatar", metadata.AvatarEvent)
+	}
+	if metadata.CanonicalAlias != "#summary:localhost" {
+		t.Errorf("got alias %q want %q", metadata.CanonicalAlias, "#summary:localhost")
+	}
+	if metadata.RoomType == nil || *metadata.RoomType != "m.space" {
+		t.Errorf("got room type %v want m.space", metadata.RoomType)
+	}
+	if !metadata.Encrypted {
+		t.Errorf("room is not encrypted")
+	}
+	if metadata.JoinCount != 42 {
+		t.Errorf("got join count %d want 42", metadata.JoinCount)
+	}
+
+	// without a summary, the invite counts as a single joined member
+	id = caches.NewInviteData(context.Background(), alice, roomID, []json.RawMessage{inviteEvent})
+	if metadata = id.RoomMetadata(); metadata.JoinCount != 1 || metadata.NameEvent != "" {
+		t.Errorf("got join count %d name %q want 1 and no name", metadata.JoinCount, metadata.NameEvent)
+	}
+}
+
+func TestUserCacheManualRoomOrder(t *testing.T) {
+	userID := "@alice:localhost"
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	roomC := "!c:localhost"
+	uc := caches.NewUserCache(userID, caches.NewGlobalCache(nil), nil, &txnIDFetcher{}, &joinChecker{})
+	collector := &roomUpdateCollector{}
+	uc.Subsribe(collector)
+
+	setOrder := func(roomIDs ...string) {
+		uc.OnAccountData(context.Background(), []state.AccountData{{
+			UserID: userID,
+			RoomID: state.AccountDataGlobalRoom,
+			Type:   caches.AccountDataTypeRoomOrder,
+			Data:   []byte(fmt.Sprintf(`{"type":"%s","content":{"rooms":%s}}`, caches.AccountDataTypeRoomOrder, js(roomIDs))),
+		}})
+	}
+	assertOrder := func(want map[string]int) {
+		t.Helper()
+		for roomID, pos := range want {
+			if got := uc.LoadRoomData(roomID).ManualOrder; got != pos {
+				t.Errorf("%s: got ManualOrder %d want %d", roomID, got, pos)
+			}
+		}
+	}
+	changedRooms := func() map[string]bool {
+		changed := make(map[string]bool)
+		for _, up := range collector.updates {
+			if _, ok := up.(*caches.RoomOrderUpdate); ok {
+				changed[up.RoomID()] = true
+			}
+		}
+		collector.updates = nil
+		return changed
+	}
+
+	setOrder(roomB, roomA)
+	assertOrder(map[string]int{roomA: 2, roomB: 1, roomC: 0})
+	if got := changedRooms(); !reflect.DeepEqual(got, map[string]bool{roomA: true, roomB: true}) {
+		t.Errorf("got order updates for %v", got)
+	}
+	// unpinning B moves A up, and C is pinned for the first time
+	setOrder(roomA, roomC)
+	assertOrder(map[string]int{roomA: 1, roomB: 0, roomC: 2})
+	if got := changedRooms(); !reflect.DeepEqual(got, map[string]bool{roomA: true, roomB: true, roomC: true}) {
+		t.Errorf("got order updates for %v", got)
+	}
+	// no change, no updates
+	setOrder(roomA, roomC)
+	if got := changedRooms(); len(got) != 0 {
+		t.Errorf("got order updates for %v", got)
+	}
+}
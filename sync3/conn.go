@@ -58,6 +58,12 @@ type Conn struct {
 	// - Everything after that is new and unseen, and the first element is the one we want to return.
 	serverResponses []Response
 	lastPos         int64
+	// the pos the client last saw before the proxy restarted, if this connection was resumed. The
+	// first request from this pos is handled as the first request on the connection. 0 once handled.
+	resumePos int64
+
+	// when ConnMap last returned this connection, for expiring idle connections. Guarded by ConnMap.mu.
+	lastUsed time.Time
 
 	// ensure only 1 incoming request is handled per connection
 	mu                         *sync.Mutex
@@ -74,6 +80,19 @@ func NewConn(connID ConnID, h ConnHandler) *Conn {
 	}
 }
 
+// resume marks this new connection as the continuation of a connection which existed before the
+// proxy restarted, where the client last saw pos. Positions carry on from pos so that they don't
+// clash with those the client has already seen. Must be called before the first request.
+func (c *Conn) resume(pos int64) {
+	c.resumePos = pos
+	c.lastPos = pos
+}
+
+// Handler returns the ConnHandler which processes requests for this connection.
+func (c *Conn) Handler() ConnHandler {
+	return c.handler
+}
+
 func (c *Conn) Alive() bool {
 	return c.handler.Alive()
 }
@@ -90,7 +109,7 @@ func (c *Conn) OnUpdate(ctx context.Context, update caches.Update) {
 // upwards but will NOT be logged to Sentry (neither here nor by the caller). Errors
 // should be reported to Sentry as close as possible to the point of creating the error,
 // to provide the best possible Sentry traceback.
-func (c *Conn) tryRequest(ctx context.Context, req *Request, start time.Time) (res *Response, err error) {
+func (c *Conn) tryRequest(ctx context.Context, req *Request, isInitial bool, start time.Time) (res *Response, err error) {
 	// TODO: include useful information from the request in the sentry hub/context
 	// Might be better done in the caller though?
 	defer func() {
@@ -112,13 +131,13 @@ func (c *Conn) tryRequest(ctx context.Context, req *Request, start time.Time) (r
 		}
 	}()
 	taskType := "OnIncomingRequest"
-	if req.pos == 0 {
+	if isInitial {
 		taskType = "OnIncomingRequestInitial"
 	}
 	ctx, task := internal.StartTask(ctx, taskType)
 	defer task.End()
 	internal.Logf(ctx, "connstate", "starting user=%v device=%v pos=%v", c.UserID, c.ConnID.DeviceID, req.pos)
-	return c.handler.OnIncomingRequest(ctx, c.ConnID, req, req.pos == 0, start)
+	return c.handler.OnIncomingRequest(ctx, c.ConnID, req, isInitial, start)
 }
 
 func (c *Conn) isOutstanding(pos int64) bool {
@@ -152,7 +171,7 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	defer c.mu.Unlock()
 	span.End()
 
-	isFirstRequest := req.pos == 0
+	isFirstRequest := req.pos == 0 || (c.resumePos != 0 && req.pos == c.resumePos)
 	isRetransmit := !isFirstRequest && c.lastClientRequest.pos == req.pos
 	isSameRequest := !isFirstRequest && c.lastClientRequest.Same(req)
 
@@ -221,7 +240,7 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 		req.SetTimeoutMSecs(1)
 	}
 
-	resp, err := c.tryRequest(ctx, req, start)
+	resp, err := c.tryRequest(ctx, req, isFirstRequest, start)
 	if err != nil {
 		herr, ok := err.(*internal.HandlerError)
 		if !ok {
@@ -235,6 +254,7 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	// assign the last client request now _after_ we have processed the request so we don't incorrectly
 	// cache errors or panics and result in getting wedged or tightlooping.
 	c.lastClientRequest = *req
+	c.resumePos = 0
 	// this position is the highest stored pos +1
 	resp.Pos = fmt.Sprintf("%d", c.lastPos+1)
 	resp.TxnID = req.TxnID
@@ -7,14 +7,15 @@ import (
 
 	"golang.org/x/exp/slices"
 
-	"github.com/ReneKroon/ttlcache/v2"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// ConnMap stores a collection of Conns.
+// ConnMap stores a collection of Conns. Connections which haven't been used for the TTL are closed.
 type ConnMap struct {
-	cache *ttlcache.Cache
+	ttl   time.Duration
+	clock internal.Clock
+	stop  chan struct{}
 
 	// map of user_id to active connections. Inspect the ConnID to find the device ID.
 	userIDToConn map[string][]*Conn
@@ -26,17 +27,25 @@ type ConnMap struct {
 	expiryBufferFullCounter prometheus.Counter
 
 	mu *sync.Mutex
+	// handlers of connections closed while mu was held, which are destroyed by unlock
+	closed []ConnHandler
 }
 
 func NewConnMap(enablePrometheus bool, ttl time.Duration) *ConnMap {
+	return NewConnMapWithClock(enablePrometheus, ttl, internal.RealClock)
+}
+
+// NewConnMapWithClock is NewConnMap with a custom clock for expiring connections.
+func NewConnMapWithClock(enablePrometheus bool, ttl time.Duration, clock internal.Clock) *ConnMap {
 	cm := &ConnMap{
 		userIDToConn: make(map[string][]*Conn),
 		connIDToConn: make(map[string]*Conn),
-		cache:        ttlcache.NewCache(),
+		ttl:          ttl,
+		clock:        clock,
+		stop:         make(chan struct{}),
 		mu:           &sync.Mutex{},
 	}
-	cm.cache.SetTTL(ttl)
-	cm.cache.SetExpirationCallback(cm.closeConnExpires)
+	go cm.expireConnsPeriodically()
 
 	if enablePrometheus {
 		cm.expiryTimedOutCounter = prometheus.NewCounter(prometheus.CounterOpts{
@@ -65,7 +74,7 @@ func NewConnMap(enablePrometheus bool, ttl time.Duration) *ConnMap {
 }
 
 func (m *ConnMap) Teardown() {
-	m.cache.Close()
+	close(m.stop)
 
 	if m.numConns != nil {
 		prometheus.Unregister(m.numConns)
@@ -107,25 +116,49 @@ func (m *ConnMap) Conns(userID, deviceID string) []*Conn {
 	return conns
 }
 
+// ConnsForUser returns all connections for this user, across all of their devices.
+func (m *ConnMap) ConnsForUser(userID string) []*Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.userIDToConn[userID])
+}
+
+// AllConns returns every active connection.
+func (m *ConnMap) AllConns() []*Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conns := make([]*Conn, 0, len(m.connIDToConn))
+	for _, conn := range m.connIDToConn {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
 // Conn returns a connection with this ConnID. Returns nil if no connection exists.
 func (m *ConnMap) Conn(cid ConnID) *Conn {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	defer m.unlock()
 	return m.getConn(cid)
 }
 
-// getConn returns a connection with this ConnID. Returns nil if no connection exists. Expires connections if the buffer is full.
-// Must hold mu.
+// getConn returns a connection with this ConnID. Returns nil if no connection exists. Expires connections if the buffer is full,
+// or if they have expired since expireConns last ran.
+// Must hold mu, and release it with unlock.
 func (m *ConnMap) getConn(cid ConnID) *Conn {
-	cint, _ := m.cache.Get(cid.String())
-	if cint == nil {
+	conn := m.connIDToConn[cid.String()]
+	if conn == nil {
+		return nil
+	}
+	now := m.clock.Now()
+	if m.expired(conn, now) {
+		m.closeExpiredConn(conn)
 		return nil
 	}
-	conn := cint.(*Conn)
 	if conn.Alive() {
+		conn.lastUsed = now
 		return conn
 	}
-	// e.g buffer exceeded, close it and remove it from the cache
+	// e.g buffer exceeded, close it and remove it from the map
 	logger.Info().Str("conn", cid.String()).Msg("closing connection due to dead connection (buffer full)")
 	m.closeConn(conn)
 	if m.expiryBufferFullCounter != nil {
@@ -138,7 +171,7 @@ func (m *ConnMap) getConn(cid ConnID) *Conn {
 func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandler func() ConnHandler) *Conn {
 	// atomically check if a conn exists already and nuke it if it exists
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	defer m.unlock()
 	conn := m.getConn(cid)
 	if conn != nil {
 		// tear down this connection and fallthrough
@@ -152,10 +185,31 @@ func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandl
 		logger.Trace().Str("conn", cid.String()).Bool("spamming", isSpamming).Msg("closing connection due to CreateConn called again")
 		m.closeConn(conn)
 	}
+	return m.newConn(cid, cancel, newConnHandler)
+}
+
+// ResumeConn creates a connection which carries on from pos, for a client whose connection was lost
+// when the proxy restarted. The first request from pos is handled as the first request on the
+// connection. If the connection has already been resumed, e.g by a concurrent request, that
+// connection is returned instead.
+func (m *ConnMap) ResumeConn(cid ConnID, pos int64, cancel context.CancelFunc, newConnHandler func() ConnHandler) *Conn {
+	m.mu.Lock()
+	defer m.unlock()
+	if conn := m.getConn(cid); conn != nil {
+		conn.SetCancelCallback(cancel)
+		return conn
+	}
+	conn := m.newConn(cid, cancel, newConnHandler)
+	conn.resume(pos)
+	return conn
+}
+
+// newConn makes a connection and adds it to the map. Must be called with mu held.
+func (m *ConnMap) newConn(cid ConnID, cancel context.CancelFunc, newConnHandler func() ConnHandler) *Conn {
 	h := newConnHandler()
 	h.SetCancelCallback(cancel)
-	conn = NewConn(cid, h)
-	m.cache.Set(cid.String(), conn)
+	conn := NewConn(cid, h)
+	conn.lastUsed = m.clock.Now()
 	m.connIDToConn[cid.String()] = conn
 	m.userIDToConn[cid.UserID] = append(m.userIDToConn[cid.UserID], conn)
 	m.updateMetrics(len(m.connIDToConn))
@@ -164,13 +218,12 @@ func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandl
 
 func (m *ConnMap) CloseConnsForDevice(userID, deviceID string) {
 	logger.Trace().Str("user", userID).Str("device", deviceID).Msg("closing connections due to CloseConn()")
-	// gather open connections for this user|device
-	connIDs := m.connIDsForDevice(userID, deviceID)
-	for _, cid := range connIDs {
-		err := m.cache.Remove(cid.String()) // this will fire TTL callbacks which calls closeConn
-		if err != nil {
-			logger.Err(err).Str("cid", cid.String()).Msg("CloseConnsForDevice: cid did not exist in ttlcache")
-			internal.GetSentryHubFromContextOrDefault(context.Background()).CaptureException(err)
+	m.mu.Lock()
+	defer m.unlock()
+	// closeConn modifies userIDToConn so take a copy
+	for _, conn := range slices.Clone(m.userIDToConn[userID]) {
+		if conn.DeviceID == deviceID {
+			m.closeConn(conn)
 		}
 	}
 }
@@ -192,48 +245,79 @@ func (m *ConnMap) connIDsForDevice(userID, deviceID string) []ConnID {
 // conns closed.
 func (m *ConnMap) CloseConnsForUsers(userIDs []string) (closed int) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	defer m.unlock()
 	for _, userID := range userIDs {
-		conns := m.userIDToConn[userID]
+		// closeConn modifies userIDToConn so take a copy
+		conns := slices.Clone(m.userIDToConn[userID])
 		logger.Trace().Str("user", userID).Int("num_conns", len(conns)).Msg("closing all device connections due to CloseConn()")
 
 		for _, conn := range conns {
-			err := m.cache.Remove(conn.String()) // this will fire TTL callbacks which calls closeConn
-			if err != nil {
-				logger.Err(err).Str("cid", conn.String()).Msg("CloseConnsForDevice: cid did not exist in ttlcache")
-				internal.GetSentryHubFromContextOrDefault(context.Background()).CaptureException(err)
-			}
+			m.closeConn(conn)
 		}
 		closed += len(conns)
 	}
 	return closed
 }
 
-func (m *ConnMap) closeConnExpires(connID string, value interface{}) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	conn := value.(*Conn)
-	logger.Info().Str("conn", connID).Msg("closing connection due to expired TTL in cache")
+// expired returns true if the connection hasn't been used for the TTL. Must hold mu.
+func (m *ConnMap) expired(conn *Conn, now time.Time) bool {
+	return now.Sub(conn.lastUsed) >= m.ttl
+}
+
+// must hold mu, and release it with unlock
+func (m *ConnMap) closeExpiredConn(conn *Conn) {
+	logger.Info().Str("conn", conn.String()).Msg("closing connection due to expired TTL")
 	if m.expiryTimedOutCounter != nil {
 		m.expiryTimedOutCounter.Inc()
 	}
 	m.closeConn(conn)
 }
 
-// must hold mu
+// expireConns closes every connection which hasn't been used for the TTL.
+func (m *ConnMap) expireConns() {
+	m.mu.Lock()
+	defer m.unlock()
+	now := m.clock.Now()
+	for _, conn := range m.connIDToConn {
+		if m.expired(conn, now) {
+			m.closeExpiredConn(conn)
+		}
+	}
+}
+
+// expireConnsPeriodically calls expireConns until Teardown. Connections are looked up through
+// getConn, which won't return expired connections, so this only needs to run often enough to
+// free up idle connections.
+func (m *ConnMap) expireConnsPeriodically() {
+	defer internal.ReportPanicsToSentry()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-m.clock.After(m.ttl / 2):
+		}
+		m.expireConns()
+	}
+}
+
+// must hold mu, and release it with unlock
 func (m *ConnMap) closeConn(conn *Conn) {
 	if conn == nil {
 		return
 	}
 
 	connKey := conn.ConnID.String()
+	if m.connIDToConn[connKey] != conn {
+		// already closed, possibly replaced by a new connection with the same ID
+		return
+	}
 	logger.Trace().Str("conn", connKey).Msg("closing connection")
 	// remove conn from all the maps
 	delete(m.connIDToConn, connKey)
 	h := conn.handler
 	conns := m.userIDToConn[conn.UserID]
 	for i := 0; i < len(conns); i++ {
-		if conns[i].DeviceID == conn.DeviceID && conns[i].CID == conn.CID {
+		if conns[i] == conn {
 			// delete without preserving order
 			conns[i] = nil // allow GC
 			conns = slices.Delete(conns, i, i+1)
@@ -241,11 +325,22 @@ func (m *ConnMap) closeConn(conn *Conn) {
 		}
 	}
 	m.userIDToConn[conn.UserID] = conns
-	// remove user cache listeners etc
-	h.Destroy()
+	// remove user cache listeners etc, once mu is released
+	m.closed = append(m.closed, h)
 	m.updateMetrics(len(m.connIDToConn))
 }
 
+// unlock releases mu, then destroys the handlers of connections which were closed while it was held.
+// Destroying a handler can block, e.g on the database, which mustn't hold up every other connection.
+func (m *ConnMap) unlock() {
+	closed := m.closed
+	m.closed = nil
+	m.mu.Unlock()
+	for _, h := range closed {
+		h.Destroy()
+	}
+}
+
 func (m *ConnMap) ClearUpdateQueues(userID, roomID string, nid int64) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/testutils"
 )
 
 const (
@@ -42,6 +43,44 @@ func TestConnMap(t *testing.T) {
 	mustEqual(t, conns[0], conn, "*Conn wasn't the same when fetched via Conns()[0]")
 }
 
+func TestConnMap_ResumeConn(t *testing.T) {
+	cm := NewConnMap(false, time.Minute)
+	cid := ConnID{UserID: alice, DeviceID: "A", CID: "room-list"}
+	_, cancel := context.WithCancel(context.Background())
+	var initialReqs []bool
+	newConnHandler := func() ConnHandler {
+		return &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+			initialReqs = append(initialReqs, isInitial)
+			return &Response{}, nil
+		}}
+	}
+	// the client last saw pos 5 before the restart
+	conn := cm.ResumeConn(cid, 5, cancel, newConnHandler)
+	mustEqual(t, cm.Conn(cid), conn, "resumed conn wasn't stored")
+	// a concurrent request resuming the same connection gets the same conn
+	mustEqual(t, cm.ResumeConn(cid, 5, cancel, newConnHandler), conn, "conn was resumed twice")
+
+	// other positions are unknown
+	_, herr := conn.OnIncomingRequest(context.Background(), &Request{pos: 4}, time.Now())
+	if herr == nil || herr.StatusCode != 400 {
+		t.Fatalf("OnIncomingRequest with unknown pos: got %v want 400", herr)
+	}
+	// the first request from the resumed pos is initial, and positions carry on from there
+	resp, herr := conn.OnIncomingRequest(context.Background(), &Request{pos: 5}, time.Now())
+	if herr != nil {
+		t.Fatalf("OnIncomingRequest: %s", herr)
+	}
+	mustEqual(t, resp.PosInt(), int64(6), "resumed pos")
+	resp, herr = conn.OnIncomingRequest(context.Background(), &Request{pos: 6}, time.Now())
+	if herr != nil {
+		t.Fatalf("OnIncomingRequest: %s", herr)
+	}
+	mustEqual(t, resp.PosInt(), int64(7), "pos after resuming")
+	if !reflect.DeepEqual(initialReqs, []bool{true, false}) {
+		t.Errorf("got isInitial %v want [true false]", initialReqs)
+	}
+}
+
 func TestConnMap_CloseConnsForDevice(t *testing.T) {
 	cm := NewConnMap(false, time.Minute)
 	otherCID := ConnID{UserID: bob, DeviceID: "A", CID: "room-list"}
@@ -103,7 +142,8 @@ func TestConnMap_CloseConnsForUser(t *testing.T) {
 }
 
 func TestConnMap_TTLExpiry(t *testing.T) {
-	cm := NewConnMap(false, time.Second) // 1s expiry
+	clock := testutils.NewFakeClock(time.Now())
+	cm := NewConnMapWithClock(false, time.Second, clock) // 1s expiry
 	expiredCIDs := []ConnID{
 		{UserID: alice, DeviceID: "A", CID: "room-list"},
 		{UserID: alice, DeviceID: "A", CID: "encryption"},
@@ -117,7 +157,7 @@ func TestConnMap_TTLExpiry(t *testing.T) {
 		})
 		cidToConn[cid] = conn
 	}
-	time.Sleep(time.Millisecond * 500)
+	clock.Advance(time.Millisecond * 500)
 
 	unexpiredCIDs := []ConnID{
 		{UserID: alice, DeviceID: "B", CID: "room-list"},
@@ -132,7 +172,8 @@ func TestConnMap_TTLExpiry(t *testing.T) {
 		cidToConn[cid] = conn
 	}
 
-	time.Sleep(510 * time.Millisecond) // all 'A' device conns must have expired
+	clock.Advance(510 * time.Millisecond) // all 'A' device conns must have expired
+	cm.expireConns()
 
 	// Destroy should have been called for all alice|A connections
 	assertDestroyedConns(t, cidToConn, func(cid ConnID) bool {
@@ -140,8 +181,36 @@ func TestConnMap_TTLExpiry(t *testing.T) {
 	})
 }
 
+// Test that connections are destroyed after the map is unlocked, as destroying a connection can block.
+func TestConnMap_DestroyUnlocked(t *testing.T) {
+	clock := testutils.NewFakeClock(time.Now())
+	cm := NewConnMapWithClock(false, time.Second, clock)
+	var numConnsWhenDestroyed []int
+	newConnHandler := func() ConnHandler {
+		return &mockConnHandler{onDestroy: func() {
+			// deadlocks if the map is still locked
+			numConnsWhenDestroyed = append(numConnsWhenDestroyed, len(cm.AllConns()))
+		}}
+	}
+	cid := ConnID{UserID: alice, DeviceID: "A", CID: "room-list"}
+	_, cancel := context.WithCancel(context.Background())
+	cm.CreateConn(cid, cancel, newConnHandler)
+	// replacing a connection
+	cm.CreateConn(cid, cancel, newConnHandler)
+	// closing a connection
+	cm.CloseConnsForDevice(alice, "A")
+	// expiring a connection
+	cm.CreateConn(cid, cancel, newConnHandler)
+	clock.Advance(2 * time.Second)
+	cm.expireConns()
+	if !reflect.DeepEqual(numConnsWhenDestroyed, []int{1, 0, 0}) {
+		t.Errorf("got %v conns when each conn was destroyed, want [1 0 0]", numConnsWhenDestroyed)
+	}
+}
+
 func TestConnMap_TTLExpiryStaggeredDevices(t *testing.T) {
-	cm := NewConnMap(false, time.Second) // 1s expiry
+	clock := testutils.NewFakeClock(time.Now())
+	cm := NewConnMapWithClock(false, time.Second, clock) // 1s expiry
 	expiredCIDs := []ConnID{
 		{UserID: alice, DeviceID: "A", CID: "room-list"},
 		{UserID: alice, DeviceID: "B", CID: "encryption"},
@@ -155,7 +224,7 @@ func TestConnMap_TTLExpiryStaggeredDevices(t *testing.T) {
 		})
 		cidToConn[cid] = conn
 	}
-	time.Sleep(time.Millisecond * 500)
+	clock.Advance(time.Millisecond * 500)
 
 	unexpiredCIDs := []ConnID{
 		{UserID: alice, DeviceID: "B", CID: "room-list"},
@@ -171,7 +240,8 @@ func TestConnMap_TTLExpiryStaggeredDevices(t *testing.T) {
 	}
 
 	// all expiredCIDs should have expired, none from unexpiredCIDs
-	time.Sleep(510 * time.Millisecond)
+	clock.Advance(510 * time.Millisecond)
+	cm.expireConns()
 
 	// Destroy should have been called for all expiredCIDs connections
 	assertDestroyedConns(t, cidToConn, func(cid ConnID) bool {
@@ -212,6 +282,7 @@ func assertDestroyedConns(t *testing.T, cidToConn map[ConnID]*Conn, isDestroyedF
 type mockConnHandler struct {
 	isDestroyed atomic.Bool
 	cancel      context.CancelFunc
+	onDestroy   func()
 }
 
 func (c *mockConnHandler) OnIncomingRequest(ctx context.Context, cid ConnID, req *Request, isInitial bool, start time.Time) (*Response, error) {
@@ -221,6 +292,9 @@ func (c *mockConnHandler) OnUpdate(ctx context.Context, update caches.Update) {}
 func (c *mockConnHandler) PublishEventsUpTo(roomID string, nid int64)         {}
 func (c *mockConnHandler) Destroy() {
 	c.isDestroyed.Store(true)
+	if c.onDestroy != nil {
+		c.onDestroy()
+	}
 }
 func (c *mockConnHandler) Alive() bool {
 	return true // buffer never fills up
@@ -228,3 +302,71 @@ func (c *mockConnHandler) Alive() bool {
 func (c *mockConnHandler) SetCancelCallback(cancel context.CancelFunc) {
 	c.cancel = cancel
 }
+
+func TestConnMap_TTLExpiryWithClock(t *testing.T) {
+	clock := testutils.NewFakeClock(time.Now())
+	cm := NewConnMapWithClock(false, time.Minute, clock)
+	cidToConn := map[ConnID]*Conn{}
+	usedCID := ConnID{UserID: alice, DeviceID: "A", CID: "room-list"}
+	idleCID := ConnID{UserID: alice, DeviceID: "A", CID: "encryption"}
+	for _, cid := range []ConnID{usedCID, idleCID} {
+		_, cancel := context.WithCancel(context.Background())
+		cidToConn[cid] = cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &mockConnHandler{}
+		})
+	}
+
+	clock.Advance(45 * time.Second)
+	mustEqual(t, cm.Conn(usedCID), cidToConn[usedCID], "conn expired before its TTL")
+	clock.Advance(45 * time.Second)
+
+	// the idle conn hasn't been used for 90s so should be expired, but the used conn has only been
+	// idle for 45s.
+	mustEqual(t, cm.Conn(idleCID), (*Conn)(nil), "idle conn did not expire")
+	mustEqual(t, cm.Conn(usedCID), cidToConn[usedCID], "used conn expired")
+	assertDestroyedConns(t, cidToConn, func(cid ConnID) bool {
+		return cid == idleCID
+	})
+
+	// a new conn with the same ID is unaffected by the old one expiring
+	_, cancel := context.WithCancel(context.Background())
+	newConn := cm.CreateConn(idleCID, cancel, func() ConnHandler {
+		return &mockConnHandler{}
+	})
+	mustEqual(t, cm.Conn(idleCID), newConn, "new conn was closed")
+}
+
+func TestConnMap_TTLExpiryInBackground(t *testing.T) {
+	clock := testutils.NewFakeClock(time.Now())
+	cm := NewConnMapWithClock(false, time.Minute, clock)
+	defer cm.Teardown()
+	cid := ConnID{UserID: alice, DeviceID: "A", CID: "room-list"}
+	_, cancel := context.WithCancel(context.Background())
+	conn := cm.CreateConn(cid, cancel, func() ConnHandler {
+		return &mockConnHandler{}
+	})
+
+	// idle conns are closed without anyone looking them up
+	for i := 0; i < 2; i++ {
+		waitForClockWaiters(t, clock)
+		clock.Advance(30 * time.Second)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !conn.handler.(*mockConnHandler).isDestroyed.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("conn was not expired in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitForClockWaiters(t *testing.T, clock *testutils.FakeClock) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for clock.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing is waiting on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -3,19 +3,13 @@ package sync3
 import (
 	"context"
 	"encoding/json"
-	"os"
 	"sync"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
-	"github.com/rs/zerolog"
-	"github.com/tidwall/gjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger()
 
 const DispatcherAllUsers = "-"
 
@@ -55,6 +49,12 @@ func (d *Dispatcher) Startup(roomToJoinedUsers map[string][]string) error {
 	return nil
 }
 
+// StartupFrom populates the dispatcher with joined members as they are loaded by load, which must
+// call onJoinedMember for each joined member of each room. Returns the error from load.
+func (d *Dispatcher) StartupFrom(load func(onJoinedMember func(roomID, userID string)) error) error {
+	return d.jrt.StartupFrom(load)
+}
+
 func (d *Dispatcher) Unregister(userID string) {
 	d.userToReceiverMu.Lock()
 	defer d.userToReceiverMu.Unlock()
@@ -95,25 +95,18 @@ func (d *Dispatcher) ReceiverForUser(userID string) Receiver {
 	return d.userToReceiver[userID]
 }
 
-func (d *Dispatcher) newEventData(event json.RawMessage, roomID string, latestPos int64) *caches.EventData {
-	// parse the event to pull out fields we care about
-	var stateKey *string
-	ev := gjson.ParseBytes(event)
-	if sk := ev.Get("state_key"); sk.Exists() {
-		stateKey = &sk.Str
-	}
-	eventType := ev.Get("type").Str
-
+func (d *Dispatcher) newEventData(ev *internal.Event, roomID string, latestPos int64) *caches.EventData {
 	return &caches.EventData{
-		Event:         event,
-		RoomID:        roomID,
-		EventType:     eventType,
-		StateKey:      stateKey,
-		Content:       ev.Get("content"),
-		NID:           latestPos,
-		Timestamp:     ev.Get("origin_server_ts").Uint(),
-		Sender:        ev.Get("sender").Str,
-		TransactionID: ev.Get("unsigned.transaction_id").Str,
+		Event:              ev.JSON,
+		RoomID:             roomID,
+		EventType:          ev.Type,
+		StateKey:           ev.StateKey,
+		Content:            ev.Content,
+		NID:                latestPos,
+		Timestamp:          ev.Timestamp,
+		Sender:             ev.Sender,
+		TransactionID:      ev.TransactionID,
+		IsMembershipChange: ev.IsMembershipChange,
 	}
 }
 
@@ -126,7 +119,7 @@ func (d *Dispatcher) OnNewInitialRoomState(ctx context.Context, roomID string, s
 			"OnNewInitialRoomState but have entries in JoinedRoomsTracker already, this should be impossible. Degrading to live events",
 		)
 		for _, s := range state {
-			d.OnNewEvent(ctx, roomID, s, 0)
+			d.OnNewEvent(ctx, roomID, internal.NewEvent(s), 0)
 		}
 		return
 	}
@@ -134,7 +127,7 @@ func (d *Dispatcher) OnNewInitialRoomState(ctx context.Context, roomID string, s
 	eventDatas := make([]*caches.EventData, len(state))
 	var joined, invited []string
 	for i, event := range state {
-		ed := d.newEventData(event, roomID, 0)
+		ed := d.newEventData(internal.NewEvent(event), roomID, 0)
 		eventDatas[i] = ed
 		if ed.EventType == "m.room.member" && ed.StateKey != nil {
 			membership := ed.Content.Get("membership").Str
@@ -168,9 +161,10 @@ func (d *Dispatcher) OnNewInitialRoomState(ctx context.Context, roomID string, s
 }
 
 func (d *Dispatcher) OnNewEvent(
-	ctx context.Context, roomID string, event json.RawMessage, nid int64,
+	ctx context.Context, roomID string, event *internal.Event, nid int64,
 ) {
 	ed := d.newEventData(event, roomID, nid)
+	ed.CommittedAt = internal.CommitTime(ctx)
 
 	// update the tracker
 	targetUser := ""
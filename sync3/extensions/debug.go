@@ -0,0 +1,60 @@
+package extensions
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Client created request params
+type DebugRequest struct {
+	Core
+}
+
+func (r *DebugRequest) Name() string {
+	return "DebugRequest"
+}
+
+// DebugResponse describes how the server built the response it is part of, so client developers can
+// see why a sync is slow without access to the server. It is filled in by the connection once the
+// rest of the response is built, as that is when the numbers are known.
+type DebugResponse struct {
+	// ProcessingMSecs is the time spent building the response, excluding time spent waiting for
+	// live updates.
+	ProcessingMSecs int64 `json:"processing_ms"`
+	// DBMSecs is the time spent loading room data from the database.
+	DBMSecs int64 `json:"db_ms"`
+	// SortMSecs is the time spent sorting room lists.
+	SortMSecs int64 `json:"sort_ms"`
+	// WaitMSecs is the time spent waiting for live updates.
+	WaitMSecs int64 `json:"wait_ms"`
+	// RoomsConsidered is the number of rooms the connection's lists are made from.
+	RoomsConsidered int `json:"rooms_considered"`
+	// QueueDepth is the number of live updates waiting to be sent to the connection, out of at most
+	// QueueCapacity before the connection is expired.
+	QueueDepth    int `json:"queue_depth"`
+	QueueCapacity int `json:"queue_capacity"`
+	// ConnCaches reports lookups in the caches which let a connection avoid recalculating or
+	// resending data when building this response: "sorted_lists" for room lists reused from another
+	// of the user's connections, and "lazy_members" for lazy-loaded members already sent on this
+	// connection. Room data is always served from memory, so isn't included.
+	ConnCaches map[string]DebugCacheStats `json:"conn_caches,omitempty"`
+}
+
+// DebugCacheStats counts lookups in a cache.
+type DebugCacheStats struct {
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+}
+
+// HasData is always false, as debug information alone is no reason to respond.
+func (r *DebugResponse) HasData(isInitial bool) bool {
+	return false
+}
+
+func (r *DebugRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	res.Debug = &DebugResponse{}
+}
+
+func (r *DebugRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+}
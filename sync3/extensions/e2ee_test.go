@@ -0,0 +1,110 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+type stubE2EEFetcher struct {
+	dd *internal.DeviceData
+}
+
+func (f *stubE2EEFetcher) DeviceData(context context.Context, userID, deviceID string, isInitial bool) *internal.DeviceData {
+	return f.dd
+}
+
+// Test that users we no longer share a room with are sent in device_lists.left, even when no other
+// device lists changed, so clients can stop tracking their devices.
+func TestE2EEDeviceListsLeft(t *testing.T) {
+	boolTrue := true
+	ext := &E2EERequest{Core: Core{Enabled: &boolTrue}}
+	fetcher := &stubE2EEFetcher{
+		dd: &internal.DeviceData{
+			UserID:   "@alice:localhost",
+			DeviceID: "ALICE",
+			DeviceListChanges: internal.DeviceListChanges{
+				DeviceListLeft: []string{"@bob:localhost"},
+			},
+		},
+	}
+	var res Response
+	ext.ProcessInitial(context.Background(), &res, Context{
+		Handler:  &Handler{E2EEFetcher: fetcher},
+		UserID:   "@alice:localhost",
+		DeviceID: "ALICE",
+	})
+	if res.E2EE == nil || res.E2EE.DeviceLists == nil {
+		t.Fatalf("got no device lists, want left")
+	}
+	if !reflect.DeepEqual(res.E2EE.DeviceLists.Left, []string{"@bob:localhost"}) {
+		t.Errorf("got left %v want [@bob:localhost]", res.E2EE.DeviceLists.Left)
+	}
+	if len(res.E2EE.DeviceLists.Changed) != 0 {
+		t.Errorf("got changed %v want none", res.E2EE.DeviceLists.Changed)
+	}
+}
+
+// Test that a used up fallback key is sent as an empty array, which tells clients to upload a new
+// one, and that no change omits the field entirely.
+func TestE2EEFallbackKeyTypes(t *testing.T) {
+	boolTrue := true
+	ext := &E2EERequest{Core: Core{Enabled: &boolTrue}}
+	testCases := []struct {
+		name             string
+		fallbackKeyTypes []string
+		changed          bool
+		wantJSON         string
+	}{
+		{
+			name:             "used up",
+			fallbackKeyTypes: []string{},
+			changed:          true,
+			wantJSON:         `{"device_unused_fallback_key_types":[]}`,
+		},
+		{
+			name:             "unused",
+			fallbackKeyTypes: []string{"signed_curve25519"},
+			changed:          true,
+			wantJSON:         `{"device_unused_fallback_key_types":["signed_curve25519"]}`,
+		},
+		{
+			name:             "unchanged",
+			fallbackKeyTypes: []string{},
+			changed:          false,
+		},
+	}
+	for _, tc := range testCases {
+		dd := &internal.DeviceData{
+			DeviceKeyData: internal.DeviceKeyData{
+				FallbackKeyTypes: tc.fallbackKeyTypes,
+			},
+		}
+		if tc.changed {
+			dd.SetFallbackKeysChanged()
+		}
+		var res Response
+		ext.ProcessInitial(context.Background(), &res, Context{
+			Handler: &Handler{E2EEFetcher: &stubE2EEFetcher{dd: dd}},
+		})
+		if tc.wantJSON == "" {
+			if res.E2EE != nil {
+				t.Errorf("%s: got response %+v want none", tc.name, res.E2EE)
+			}
+			continue
+		}
+		if res.E2EE == nil {
+			t.Fatalf("%s: got no response", tc.name)
+		}
+		got, err := json.Marshal(res.E2EE)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal: %s", tc.name, err)
+		}
+		if string(got) != tc.wantJSON {
+			t.Errorf("%s: got %s want %s", tc.name, got, tc.wantJSON)
+		}
+	}
+}
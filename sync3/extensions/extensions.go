@@ -3,19 +3,17 @@ package extensions
 
 import (
 	"context"
-	"os"
+	"encoding/json"
+	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
-	"github.com/rs/zerolog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger()
 
 type GenericRequest interface {
 	// Name provides a name to identify the kind of request. At present, it's only
@@ -155,40 +153,87 @@ func ExtensionEnabled(r GenericRequest) bool {
 	return false
 }
 
+// ExtensionNames is the list of JSON keys for all supported extensions, in the same order as
+// Request.fields(). It is taken from the struct tags on Request so the two can't disagree.
+var ExtensionNames = requestFieldNames()
+
+func requestFieldNames() []string {
+	t := reflect.TypeOf(Request{})
+	names := make([]string, t.NumField())
+	for i := range names {
+		names[i], _, _ = strings.Cut(t.Field(i).Tag.Get("json"), ",")
+	}
+	return names
+}
+
+// NewDisabledExtensions validates a list of extension names and returns them as a set suitable
+// for Handler.Disabled. Returns an error if any name is not a known extension.
+func NewDisabledExtensions(names []string) (map[string]bool, error) {
+	disabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		known := false
+		for _, extName := range ExtensionNames {
+			if name == extName {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown extension '%s', must be one of %v", name, ExtensionNames)
+		}
+		disabled[name] = true
+	}
+	return disabled, nil
+}
+
 // Request is the JSON request body under 'extensions'.
 //
-// To add new extensions, add a field here and return it in fields() whilst setting it correctly
-// in setFields().
+// To add new extensions, add a field here. Every field must be a pointer to a GenericRequest,
+// as fields() and setFields() walk them in order.
 type Request struct {
 	ToDevice    *ToDeviceRequest    `json:"to_device"`
 	E2EE        *E2EERequest        `json:"e2ee"`
 	AccountData *AccountDataRequest `json:"account_data"`
 	Typing      *TypingRequest      `json:"typing"`
 	Receipts    *ReceiptsRequest    `json:"receipts"`
+	Debug       *DebugRequest       `json:"debug"`
 }
 
+// fields returns every extension request in struct order, nil or not. fields()[i] is the
+// extension called ExtensionNames[i].
 func (r *Request) fields() []GenericRequest {
-	return []GenericRequest{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+	v := reflect.ValueOf(r).Elem()
+	fields := make([]GenericRequest, v.NumField())
+	for i := range fields {
+		fields[i] = v.Field(i).Interface().(GenericRequest)
 	}
+	return fields
 }
 
-// these fields must match up in order/type to fields()
+// setFields is the inverse of fields().
 func (r *Request) setFields(fields []GenericRequest) {
-	r.ToDevice = fields[0].(*ToDeviceRequest)
-	r.E2EE = fields[1].(*E2EERequest)
-	r.AccountData = fields[2].(*AccountDataRequest)
-	r.Typing = fields[3].(*TypingRequest)
-	r.Receipts = fields[4].(*ReceiptsRequest)
+	v := reflect.ValueOf(r).Elem()
+	for i, f := range fields {
+		v.Field(i).Set(reflect.ValueOf(f))
+	}
 }
 
 func (r Request) EnabledExtensions() (exts []GenericRequest) {
+	return r.enabledExtensions(nil)
+}
+
+// enabledExtensions returns the extensions which the client has enabled, skipping any which
+// have been disabled by the server operator.
+func (r Request) enabledExtensions(disabled map[string]bool) (exts []GenericRequest) {
 	fields := r.fields()
-	for _, f := range fields {
+	for i, f := range fields {
 		f := f
 		if isNil(f) {
 			continue
 		}
+		if disabled[ExtensionNames[i]] {
+			continue
+		}
 		if ExtensionEnabled(f) {
 			exts = append(exts, f)
 		}
@@ -242,6 +287,9 @@ func (r *Request) InterpretAsInitial() {
 	if r.Receipts != nil {
 		r.Receipts.InterpretAsInitial()
 	}
+	if r.Debug != nil {
+		r.Debug.InterpretAsInitial()
+	}
 }
 
 // Response represents the top-level `extensions` key in the JSON response.
@@ -253,11 +301,12 @@ type Response struct {
 	AccountData *AccountDataResponse `json:"account_data,omitempty"`
 	Typing      *TypingResponse      `json:"typing,omitempty"`
 	Receipts    *ReceiptsResponse    `json:"receipts,omitempty"`
+	Debug       *DebugResponse       `json:"debug,omitempty"`
 }
 
 func (r Response) fields() []GenericResponse {
 	return []GenericResponse{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Debug,
 	}
 }
 
@@ -308,15 +357,35 @@ type HandlerInterface interface {
 	HandleLiveUpdate(ctx context.Context, update caches.Update, req Request, res *Response, extCtx Context)
 }
 
+// Store is the storage used by extensions. Implemented by state.Storage.
+type Store interface {
+	AccountDatas(userID string, roomIDs ...string) ([]state.AccountData, error)
+	ReceiptsForEvents(roomID string, eventIDs []string) ([]internal.Receipt, error)
+	ReceiptsForUser(roomIDs []string, userID string) (map[string][]internal.Receipt, error)
+	ToDeviceAckPositions(userID, deviceID string) (ackPos, unackPos int64, err error)
+	AckToDeviceMessages(userID, deviceID string, toIncl int64) error
+	ToDeviceMessagesWithinSize(userID, deviceID string, from, limit int64, maxBytes int) (msgs []json.RawMessage, upTo int64, more bool, err error)
+	SetToDeviceUnackedPosition(userID, deviceID string, pos int64) error
+}
+
 type Handler struct {
-	Store       *state.Storage
+	Store       Store
 	E2EEFetcher E2EEFetcher
 	GlobalCache *caches.GlobalCache
+	// Disabled is the set of extension names (see ExtensionNames) which the operator has
+	// turned off. Requests for these extensions are silently ignored.
+	Disabled map[string]bool
+	// ToDeviceMaxMessages caps the number of to-device messages sent in each response, overriding
+	// larger client limits. 0 means the client's limit is used.
+	ToDeviceMaxMessages int
+	// ToDeviceMaxBytes caps the total size of to-device messages sent in each response. At least one
+	// message is always sent. 0 means no limit.
+	ToDeviceMaxBytes int
 }
 
 func (h *Handler) HandleLiveUpdate(ctx context.Context, update caches.Update, req Request, res *Response, extCtx Context) {
 	extCtx.Handler = h
-	exts := req.EnabledExtensions()
+	exts := req.enabledExtensions(h.Disabled)
 	for _, ext := range exts {
 		childCtx, region := internal.StartSpan(ctx, "extension_live_"+ext.Name())
 		ext.AppendLive(childCtx, res, extCtx, update)
@@ -326,7 +395,7 @@ func (h *Handler) HandleLiveUpdate(ctx context.Context, update caches.Update, re
 
 func (h *Handler) Handle(ctx context.Context, req Request, extCtx Context) (res Response) {
 	extCtx.Handler = h
-	exts := req.EnabledExtensions()
+	exts := req.enabledExtensions(h.Disabled)
 	for _, ext := range exts {
 		childCtx, region := internal.StartSpan(ctx, "extension_"+ext.Name())
 		ext.ProcessInitial(childCtx, &res, extCtx)
@@ -216,3 +216,38 @@ func TestExtension_ApplyDelta(t *testing.T) {
 		}
 	}
 }
+
+func TestExtension_Disabled(t *testing.T) {
+	_, err := NewDisabledExtensions([]string{"typing", "presence"})
+	if err == nil {
+		t.Fatalf("NewDisabledExtensions: expected error for unknown extension")
+	}
+	disabled, err := NewDisabledExtensions([]string{"typing", "receipts"})
+	assertNoError(t, err)
+	req := Request{
+		AccountData: &AccountDataRequest{Core: Core{Enabled: &boolTrue}},
+		Typing:      &TypingRequest{Core: Core{Enabled: &boolTrue}},
+		Receipts:    &ReceiptsRequest{Core: Core{Enabled: &boolTrue}},
+	}
+	if got := len(req.EnabledExtensions()); got != 3 {
+		t.Fatalf("EnabledExtensions: got %d extensions want 3", got)
+	}
+	got := req.enabledExtensions(disabled)
+	if len(got) != 1 || got[0].Name() != "AccountDataRequest" {
+		t.Fatalf("enabledExtensions: got %v want only account_data", got)
+	}
+}
+
+func TestExtensionNames(t *testing.T) {
+	want := []string{"to_device", "e2ee", "account_data", "typing", "receipts", "debug"}
+	if !reflect.DeepEqual(ExtensionNames, want) {
+		t.Fatalf("ExtensionNames: got %v want %v", ExtensionNames, want)
+	}
+	req := Request{Typing: &TypingRequest{Core: Core{Enabled: &boolTrue}}}
+	fields := req.fields()
+	for i, name := range ExtensionNames {
+		if (name == "typing") == isNil(fields[i]) {
+			t.Errorf("fields()[%d] (%s): got %v", i, name, fields[i])
+		}
+	}
+}
@@ -92,7 +92,7 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		if !r.RoomInScope(roomID, extCtx) {
 			continue
 		}
-		receipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForEvents(roomID, timeline)
+		receipts, err := extCtx.Store.ReceiptsForEvents(roomID, timeline)
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to SelectReceiptsForEvents")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -102,7 +102,7 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		interestedRoomIDs = append(interestedRoomIDs, roomID)
 	}
 	// single shot query to pull out our own receipts for these rooms to always include our own receipts
-	ownReceipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForUser(interestedRoomIDs, extCtx.UserID)
+	ownReceipts, err := extCtx.Store.ReceiptsForUser(interestedRoomIDs, extCtx.UserID)
 	if err != nil {
 		logger.Err(err).Str("user", extCtx.UserID).Strs("rooms", interestedRoomIDs).Msg("failed to SelectReceiptsForUser")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -5,20 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"sync"
 
 	"github.com/matrix-org/sliding-sync/internal"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
-// used to remember since positions to warn when they are not incremented. This can happen
-// when the response is genuinely lost, but then we would expect the Conn cache to pick it up based
-// on resending the `?pos=`, so it could mean they really aren't incrementing it and it's a client bug,
-// which is bad because it can result in duplicate to-device events which breaks the encryption state machine
-var deviceIDToSinceDebugOnly = map[string]int64{}
-var mapMu = &sync.Mutex{}
-
 // Client created request params
 type ToDeviceRequest struct {
 	Core
@@ -45,6 +37,9 @@ func (r *ToDeviceRequest) ApplyDelta(gnext GenericRequest) {
 type ToDeviceResponse struct {
 	NextBatch string            `json:"next_batch"`
 	Events    []json.RawMessage `json:"events,omitempty"`
+	// Limited is true if there are more messages after next_batch, which will be sent once the
+	// client acknowledges these ones.
+	Limited bool `json:"limited,omitempty"`
 }
 
 func (r *ToDeviceResponse) HasData(isInitial bool) bool {
@@ -66,74 +61,84 @@ func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, ext
 	}
 	l := logger.With().Str("user", extCtx.UserID).Str("device", extCtx.DeviceID).Logger()
 
-	mapMu.Lock()
-	lastSentPos, exists := deviceIDToSinceDebugOnly[extCtx.DeviceID]
-	internal.Logf(ctx, "to_device", "since=%v limit=%v last_sent=%v", r.Since, r.Limit, lastSentPos)
-	isFirstRequest := !exists
-	mapMu.Unlock()
-
-	// If this is the first time we've seen this device ID since starting up, ignore the client-provided 'since'
-	// value. This is done to protect against dropped postgres sequences. Consider:
-	//   - 5 to-device messages arrive for Alice
-	//   - Alice requests all messages, gets them and acks them so since=5, and the nextval() sequence is 6.
-	//   - the server admin drops the DB and starts over again. The DB sequence starts back at 1.
-	//   - 2 to-device messages arrive for Alice
-	//   - Alice requests messages from since=5. No messages are returned as the 2 new messages have a lower sequence number.
-	//   - Even worse, those 2 messages are deleted because sending since=5 ACKNOWLEDGES all messages <=5.
-	// By ignoring the first `since` on startup, we effectively force the client into sending since=0. In this scenario,
-	// it will then A) not delete anything as since=0 acknowledges nothing, B) return the 2 to-device events.
-	//
-	// The cost to this is that it is possible to send duplicate to-device events if the server restarts before the client
-	// has time to send the ACK to the server. This isn't fatal as clients do suppress duplicate to-device events.
-	if isFirstRequest {
-		r.Since = ""
+	ackPos, unackPos, err := extCtx.Store.ToDeviceAckPositions(extCtx.UserID, extCtx.DeviceID)
+	if err != nil {
+		l.Err(err).Msg("cannot query to-device ack positions")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
 	}
+	internal.Logf(ctx, "to_device", "since=%v limit=%v acked=%v last_sent=%v", r.Since, r.Limit, ackPos, unackPos)
 
-	var from int64
-	var err error
+	var since int64
 	if r.Since != "" {
-		from, err = strconv.ParseInt(r.Since, 10, 64)
+		since, err = strconv.ParseInt(r.Since, 10, 64)
 		if err != nil {
 			l.Err(err).Str("since", r.Since).Msg("invalid since value")
 			// TODO add context to sentry
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 			return
 		}
-		// the client is confirming messages up to `from` so delete everything up to and including it.
-		if err = extCtx.Store.ToDeviceTable.DeleteMessagesUpToAndIncluding(extCtx.UserID, extCtx.DeviceID, from); err != nil {
-			l.Err(err).Str("since", r.Since).Msg("failed to delete to-device messages up to this value")
+	}
+
+	// Messages are sent from after the highest position the device has acknowledged, so a retried
+	// request gets exactly the messages it didn't acknowledge.
+	from := ackPos
+	switch {
+	case since > unackPos:
+		// The client is acknowledging messages we never sent it. This happens if the database was
+		// reset, as the sequence starts again. Consider:
+		//   - 5 to-device messages arrive for Alice
+		//   - Alice requests all messages, gets them and acks them so since=5, and the nextval() sequence is 6.
+		//   - the server admin drops the DB and starts over again. The DB sequence starts back at 1.
+		//   - 2 to-device messages arrive for Alice
+		//   - Alice requests messages from since=5. No messages would be returned as the 2 new messages have a
+		//     lower sequence number, and worse, they would be deleted as since=5 acknowledges them.
+		// So ignore the since value and send everything the device hasn't acknowledged.
+		l.Warn().Int64("since", since).Int64("last_sent", unackPos).Msg(
+			"Client acknowledged to-device messages which were never sent, ignoring since token",
+		)
+	case since > ackPos:
+		// the client is confirming messages up to `since` so delete everything up to and including it.
+		if err = extCtx.Store.AckToDeviceMessages(extCtx.UserID, extCtx.DeviceID, since); err != nil {
+			l.Err(err).Int64("since", since).Msg("failed to ack to-device messages up to this value")
 			// TODO add context to sentry
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
 		}
-	}
-
-	if from < lastSentPos {
-		// we told the client about a newer position, but yet they are using an older position, yell loudly
-		l.Warn().Int64("last_sent", lastSentPos).Int64("recv", from).Bool("initial", extCtx.IsInitial).Msg(
-			"Client did not increment since token: possibly sending back duplicate to-device events!",
+		from = since
+	case since < unackPos:
+		// The client has not acknowledged messages we sent it. This is expected if the response was
+		// lost, but could mean the client isn't incrementing the since token, which would result in
+		// duplicate to-device events which breaks the encryption state machine.
+		l.Debug().Int64("last_sent", unackPos).Int64("recv", since).Bool("initial", extCtx.IsInitial).Msg(
+			"Client did not acknowledge all sent to-device messages: resending them",
 		)
 	}
 
-	msgs, upTo, err := extCtx.Store.ToDeviceTable.Messages(extCtx.UserID, extCtx.DeviceID, from, int64(r.Limit))
+	limit := r.Limit
+	if extCtx.ToDeviceMaxMessages > 0 && limit > extCtx.ToDeviceMaxMessages {
+		limit = extCtx.ToDeviceMaxMessages
+	}
+	msgs, upTo, limited, err := extCtx.Store.ToDeviceMessagesWithinSize(extCtx.UserID, extCtx.DeviceID, from, int64(limit), extCtx.ToDeviceMaxBytes)
 	if err != nil {
 		l.Err(err).Int64("from", from).Msg("cannot query to-device messages")
 		// TODO add context to sentry
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return
 	}
-	err = extCtx.Store.ToDeviceTable.SetUnackedPosition(extCtx.UserID, extCtx.DeviceID, upTo)
-	if err != nil {
-		l.Err(err).Msg("cannot set unacked position")
-		// TODO add context to sentry
-		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-		return
+	if upTo > unackPos {
+		err = extCtx.Store.SetToDeviceUnackedPosition(extCtx.UserID, extCtx.DeviceID, upTo)
+		if err != nil {
+			l.Err(err).Msg("cannot set unacked position")
+			// TODO add context to sentry
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
+		}
 	}
-	mapMu.Lock()
-	deviceIDToSinceDebugOnly[extCtx.DeviceID] = upTo
-	mapMu.Unlock()
 	// we don't need to aggregate here as we're pulling from the DB and not relying on in-memory structs
 	res.ToDevice = &ToDeviceResponse{
 		NextBatch: fmt.Sprintf("%d", upTo),
 		Events:    msgs,
+		Limited:   limited,
 	}
 }
@@ -41,6 +41,10 @@ func (r *TypingRequest) AppendLive(ctx context.Context, res *Response, extCtx Co
 		if _, exists := extCtx.RoomIDToTimeline[update.RoomID()]; !exists {
 			return
 		}
+		// the typing notification is current, so may be from after the user was kicked/banned
+		if urd := update.UserRoomMetadata(); urd != nil && urd.CutoffNID > 0 {
+			return
+		}
 		ev := update.GlobalRoomMetadata().TypingEvent
 		if ev == nil {
 			return
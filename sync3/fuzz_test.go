@@ -0,0 +1,126 @@
+package sync3
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Fuzz targets for code which operates on untrusted client input. Run with e.g:
+//
+//	go test ./sync3 -run XXX -fuzz FuzzRequestJSON -fuzztime 1m
+//
+// Without -fuzz, the seed corpus is run as a normal test.
+
+func FuzzRequestJSON(f *testing.F) {
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`{"lists":{"a":{"ranges":[[0,20]],"sort":["by_recency","by_name"],"timeline_limit":1,"required_state":[["m.room.member","$LAZY"],["*","*"]]}}}`))
+	f.Add([]byte(`{"lists":{"a":{"ranges":[[0,20],[30,40]],"filters":{"is_dm":true,"spaces":["!a:b"],"room_name_like":"foo","tags":["m.favourite"],"not_tags":["m.lowpriority"]}}}}`))
+	f.Add([]byte(`{"room_subscriptions":{"!a:b":{"timeline_limit":5,"include_old_rooms":{"timeline_limit":1,"required_state":[["m.room.create",""]]}}},"unsubscribe_rooms":["!c:d"]}`))
+	f.Add([]byte(`{"extensions":{"to_device":{"enabled":true,"since":"5"},"e2ee":{"enabled":true},"account_data":{"enabled":true,"lists":["*"],"rooms":["*"]},"typing":{"enabled":true},"receipts":{"enabled":true}}}`))
+	f.Add([]byte(`{"lists":{"a":{"ranges":[[10,0]]}}}`))
+	f.Add([]byte(`{"lists":{"a":{"ranges":[[0,10],[5,15]]}}}`))
+	f.Add([]byte(`{"lists":{"a":{"sort":[]}}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var first Request
+		if err := json.Unmarshal(data, &first); err != nil {
+			return
+		}
+		if err := first.Validate(); err != nil {
+			// the handler rejects these requests before doing anything else with them
+			return
+		}
+		var second Request
+		if err := json.Unmarshal(data, &second); err != nil {
+			t.Fatalf("failed to unmarshal the same data twice: %s", err)
+		}
+		var nilReq *Request
+		initial, _ := nilReq.ApplyDelta(&first)
+		next, _ := initial.ApplyDelta(&second)
+		if !initial.Same(next) {
+			t.Fatalf("request is not the same as itself after applying a delta: %s", data)
+		}
+		for _, listKey := range next.ListKeys() {
+			list := next.Lists[listKey]
+			list.RequiredStateMap("@alice:localhost")
+			list.SortOrderChanged(&list)
+			list.FiltersChanged(&list)
+			list.TimelineLimitChanged(&list)
+			list.Ranges.Delta(first.Lists[listKey].Ranges)
+		}
+		for _, sub := range next.RoomSubscriptions {
+			sub.RequiredStateMap("@alice:localhost")
+			sub.Combine(sub)
+		}
+	})
+}
+
+// inRanges returns true if i is covered by any of the given ranges.
+func inRanges(ranges SliceRanges, i int64) bool {
+	_, ok := ranges.Inside(i)
+	return ok
+}
+
+func FuzzSliceRangesDelta(f *testing.F) {
+	f.Add(int64(0), int64(20), int64(30), int64(40), int64(0), int64(20), int64(25), int64(35))
+	f.Add(int64(0), int64(20), int64(-1), int64(-1), int64(15), int64(25), int64(-1), int64(-1))
+	f.Add(int64(0), int64(20), int64(-1), int64(-1), int64(20), int64(30), int64(21), int64(21))
+	f.Fuzz(func(t *testing.T, a0, a1, b0, b1, c0, c1, d0, d1 int64) {
+		// a negative start means "no range", so we can fuzz 0, 1 or 2 ranges on each side.
+		// Cap values so we can brute force the expected output.
+		const max = 100
+		build := func(pairs ...[2]int64) (r SliceRanges) {
+			for _, p := range pairs {
+				if p[0] < 0 || p[1] < 0 {
+					continue
+				}
+				r = append(r, [2]int64{p[0] % max, p[1] % max})
+			}
+			return r
+		}
+		old := build([2]int64{a0, a1}, [2]int64{b0, b1})
+		next := build([2]int64{c0, c1}, [2]int64{d0, d1})
+		if !old.Valid() || !next.Valid() {
+			return
+		}
+		added, removed, same := old.Delta(next)
+		for i := int64(0); i < max; i++ {
+			inOld, inNext := inRanges(old, i), inRanges(next, i)
+			gotAdded, gotRemoved, gotSame := inRanges(added, i), inRanges(removed, i), inRanges(same, i)
+			if gotAdded != (inNext && !inOld) || gotRemoved != (inOld && !inNext) || gotSame != (inOld && inNext) {
+				t.Fatalf(
+					"Delta(%v, %v) index %d: got added=%v removed=%v same=%v (%v %v %v)",
+					old, next, i, gotAdded, gotRemoved, gotSame, added, removed, same,
+				)
+			}
+		}
+	})
+}
+
+func FuzzCalculateMoveIndexes(f *testing.F) {
+	f.Add(int64(1), int64(4), int64(7), int64(9), 3, 2)
+	f.Add(int64(1), int64(4), int64(7), int64(9), 0, 10)
+	f.Add(int64(1), int64(4), int64(-1), int64(-1), 8, 0)
+	f.Fuzz(func(t *testing.T, a0, a1, b0, b1 int64, fromIndex, toIndex int) {
+		const max = 100
+		var ranges SliceRanges
+		for _, p := range [][2]int64{{a0, a1}, {b0, b1}} {
+			if p[0] < 0 || p[1] < 0 {
+				continue
+			}
+			ranges = append(ranges, [2]int64{p[0] % max, p[1] % max})
+		}
+		if !ranges.Valid() || fromIndex < 0 || toIndex < 0 {
+			return
+		}
+		fromIndex %= max
+		toIndex %= max
+		rl := RequestList{Ranges: ranges}
+		for _, fromTo := range rl.CalculateMoveIndexes(fromIndex, toIndex) {
+			for _, i := range fromTo {
+				if !inRanges(ranges, int64(i)) {
+					t.Fatalf("CalculateMoveIndexes(%v, %d, %d) returned index %d outside the ranges: %v", ranges, fromIndex, toIndex, i, fromTo)
+				}
+			}
+		}
+	})
+}
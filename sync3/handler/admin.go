@@ -0,0 +1,518 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// AdminAPI serves endpoints for operators to inspect and manage the proxy. Every request must include
+// the admin token as a bearer token in the Authorization header. Paths are relative to wherever the
+// API is mounted.
+type AdminAPI struct {
+	h       *SyncLiveHandler
+	v2      V2Admin
+	prewarm *prewarmer
+	state   stateQuerier
+	audit   auditLog
+	token   string
+	router  *mux.Router
+}
+
+// auditLog records admin operations. Implemented by state.Storage.
+type auditLog interface {
+	InsertAuditEntry(entry *state.AuditEntry) error
+	SelectAuditEntries(target, action string, before int64, limit int) ([]state.AuditEntry, error)
+}
+
+// AdminActorHeader may be set on admin requests to say who is making them, for the audit log.
+const AdminActorHeader = "X-Syncv3-Admin-Actor"
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// stateQuerier looks up historical room state. Implemented by state.Storage.
+type stateQuerier interface {
+	StateAtSnapshot(snapshotID int64) (roomID string, events []state.Event, err error)
+	StateAfterEvent(eventNID int64) (roomID string, snapshotID int64, events []state.Event, err error)
+	StateDiff(roomID string, fromSnapshotID, toSnapshotID int64) (state.StateDelta, error)
+}
+
+// V2Admin is the part of the sync v2 side of the proxy used by the admin API. Implemented by
+// handler2.Handler.
+type V2Admin interface {
+	// PollerStatuses reports what a user's pollers are doing.
+	PollerStatuses(userID string) []sync2.PollerStatus
+	// BackfillRoomState fetches a room's state from the homeserver to repair the proxy's copy.
+	BackfillRoomState(ctx context.Context, roomID string, userIDs []string) (usedUserID string, numStateEvents int, err error)
+}
+
+// NewAdminAPI returns an admin API for h which requires the given token. The token must not be empty.
+func NewAdminAPI(h *SyncLiveHandler, v2 V2Admin, token string) *AdminAPI {
+	a := &AdminAPI{
+		h:       h,
+		v2:      v2,
+		prewarm: newPrewarmer(h),
+		token:   token,
+	}
+	if h.Storage != nil {
+		a.state = h.Storage
+		a.audit = h.Storage
+	}
+	a.router = mux.NewRouter()
+	// user IDs can legitimately contain '/', so match on the encoded path and decode vars ourselves.
+	a.router.UseEncodedPath()
+	a.router.HandleFunc("/users/{userID}/conns", a.handle(a.userConns)).Methods("GET")
+	a.router.HandleFunc("/users/{userID}/devices/{deviceID}/conn", a.handle(a.connDump)).Methods("GET")
+	// routes which change things must be named, as the name is the action in the audit log
+	a.router.HandleFunc("/users/{userID}/resync", a.handle(a.userResync)).Methods("POST").Name("resync")
+	a.router.HandleFunc("/users/{userID}/pollers", a.handle(a.userPollers)).Methods("GET")
+	a.router.HandleFunc("/rooms/{roomID}/backfill_state", a.handle(a.roomBackfillState)).Methods("POST").Name("backfill_state")
+	a.router.HandleFunc("/rooms/{roomID}/state", a.handle(a.roomState)).Methods("GET")
+	a.router.HandleFunc("/rooms/{roomID}/state_diff", a.handle(a.roomStateDiff)).Methods("GET")
+	a.router.HandleFunc("/prewarm", a.handle(a.prewarmAccounts)).Methods("POST").Name("prewarm")
+	a.router.HandleFunc("/prewarm", a.handle(a.prewarmStatus)).Methods("GET")
+	a.router.HandleFunc("/audit", a.handle(a.auditEntries)).Methods("GET")
+	return a
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authHeader, "Bearer ")), []byte(a.token)) != 1 {
+		writeAdminError(w, &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        fmt.Errorf("missing or invalid admin token"),
+			ErrCode:    "M_UNKNOWN_TOKEN",
+		})
+		return
+	}
+	a.router.ServeHTTP(w, req)
+}
+
+// handle wraps an admin endpoint, writing its response as JSON.
+func (a *AdminAPI) handle(fn func(req *http.Request, vars map[string]string) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		for k, v := range vars {
+			unescaped, err := url.PathUnescape(v)
+			if err != nil {
+				writeAdminError(w, &internal.HandlerError{
+					StatusCode: http.StatusBadRequest,
+					Err:        fmt.Errorf("invalid path parameter %s: %w", k, err),
+				})
+				return
+			}
+			vars[k] = unescaped
+		}
+		res, err := fn(req, vars)
+		if req.Method != "GET" {
+			a.recordAudit(req, vars, err)
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// recordAudit adds an operation to the audit log. Failures are logged rather than returned, as the
+// operation has already happened.
+func (a *AdminAPI) recordAudit(req *http.Request, vars map[string]string, err error) {
+	if a.audit == nil {
+		return
+	}
+	actor := internal.ClientIP(req, a.h.trustedProxies)
+	if name := req.Header.Get(AdminActorHeader); name != "" {
+		actor = name + " (" + actor + ")"
+	}
+	entry := state.AuditEntry{
+		Timestamp: time.Now().UnixMilli(),
+		Actor:     actor,
+		Target:    vars["userID"],
+		Status:    http.StatusOK,
+	}
+	if route := mux.CurrentRoute(req); route != nil {
+		entry.Action = route.GetName()
+	}
+	if entry.Target == "" {
+		entry.Target = vars["roomID"]
+	}
+	if err != nil {
+		entry.Status = http.StatusInternalServerError
+		if herr, ok := err.(*internal.HandlerError); ok {
+			entry.Status = herr.StatusCode
+		}
+		entry.Error = err.Error()
+	}
+	if err := a.audit.InsertAuditEntry(&entry); err != nil {
+		logger.Err(err).Str("action", entry.Action).Str("target", entry.Target).Msg("admin: failed to record audit entry")
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	herr, ok := err.(*internal.HandlerError)
+	if !ok {
+		herr = &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(herr.StatusCode)
+	w.Write(herr.JSON())
+}
+
+// AdminConn describes a single sliding sync connection.
+type AdminConn struct {
+	DeviceID string `json:"device_id"`
+	ConnID   string `json:"conn_id"`
+	// The combined request parameters for this connection. Nil if the connection has not processed
+	// a request yet.
+	StickyRequest *sync3.Request `json:"sticky_request"`
+}
+
+// AdminUserConns is the response to GET /users/{userID}/conns
+type AdminUserConns struct {
+	UserID string      `json:"user_id"`
+	Conns  []AdminConn `json:"conns"`
+}
+
+func (a *AdminAPI) userConns(req *http.Request, vars map[string]string) (interface{}, error) {
+	userID := vars["userID"]
+	res := AdminUserConns{
+		UserID: userID,
+		Conns:  []AdminConn{},
+	}
+	for _, conn := range a.h.ConnMap.ConnsForUser(userID) {
+		ac := AdminConn{
+			DeviceID: conn.DeviceID,
+			ConnID:   conn.CID,
+		}
+		if cs, ok := conn.Handler().(*ConnState); ok {
+			ac.StickyRequest = cs.StickyRequest()
+		}
+		res.Conns = append(res.Conns, ac)
+	}
+	sort.Slice(res.Conns, func(i, j int) bool {
+		if res.Conns[i].DeviceID != res.Conns[j].DeviceID {
+			return res.Conns[i].DeviceID < res.Conns[j].DeviceID
+		}
+		return res.Conns[i].ConnID < res.Conns[j].ConnID
+	})
+	return res, nil
+}
+
+// connDump returns the internal state of a single connection. The conn_id query parameter selects
+// the connection, and defaults to the connection without a conn_id.
+func (a *AdminAPI) connDump(req *http.Request, vars map[string]string) (interface{}, error) {
+	cid := sync3.ConnID{
+		UserID:   vars["userID"],
+		DeviceID: vars["deviceID"],
+		CID:      req.URL.Query().Get("conn_id"),
+	}
+	// Don't use ConnMap.Conn as that counts as using the connection, keeping it alive.
+	for _, conn := range a.h.ConnMap.ConnsForUser(cid.UserID) {
+		if conn.ConnID != cid {
+			continue
+		}
+		cs, ok := conn.Handler().(*ConnState)
+		if !ok {
+			break
+		}
+		ds := cs.DebugState()
+		ds.ConnID = cid.CID
+		return ds, nil
+	}
+	return nil, &internal.HandlerError{
+		StatusCode: http.StatusNotFound,
+		Err:        fmt.Errorf("no connection %s", cid.String()),
+		ErrCode:    "M_NOT_FOUND",
+	}
+}
+
+// AdminUserResync is the response to POST /users/{userID}/resync
+type AdminUserResync struct {
+	UserID      string `json:"user_id"`
+	ConnsClosed int    `json:"conns_closed"`
+}
+
+// userResync throws away everything the proxy is doing for this user so it starts again from
+// scratch: pollers are stopped and their since tokens reset, and all connections are closed so
+// clients are forced to do an initial sync, which will wait for fresh v2 initial syncs.
+func (a *AdminAPI) userResync(req *http.Request, vars map[string]string) (interface{}, error) {
+	userID := vars["userID"]
+	// Must happen before closing connections, so that by the time clients reconnect their
+	// EnsurePolling calls are queued behind the resync.
+	a.h.EnsurePoller.ForceResync(userID)
+	closed := a.h.ConnMap.CloseConnsForUsers([]string{userID})
+	logger.Info().Str("user", userID).Int("conns_closed", closed).Msg("admin: forced resync for user")
+	return AdminUserResync{
+		UserID:      userID,
+		ConnsClosed: closed,
+	}, nil
+}
+
+// AdminUserPollers is the response to GET /users/{userID}/pollers
+type AdminUserPollers struct {
+	UserID  string               `json:"user_id"`
+	Pollers []sync2.PollerStatus `json:"pollers"`
+}
+
+// userPollers returns what the pollers for each of this user's devices are doing. Devices without
+// a poller aren't being polled, which is normal if they haven't used the proxy since it started.
+func (a *AdminAPI) userPollers(req *http.Request, vars map[string]string) (interface{}, error) {
+	userID := vars["userID"]
+	return AdminUserPollers{
+		UserID:  userID,
+		Pollers: a.v2.PollerStatuses(userID),
+	}, nil
+}
+
+// AdminRoomBackfillState is the response to POST /rooms/{roomID}/backfill_state
+type AdminRoomBackfillState struct {
+	RoomID string `json:"room_id"`
+	// UserID is the user whose token was used to fetch the state.
+	UserID      string `json:"user_id"`
+	StateEvents int    `json:"state_events"`
+}
+
+// roomBackfillState repairs the proxy's state for a room, e.g if it was missed because of a gappy
+// sync, by fetching the room's current state from the homeserver. The state is fetched with the
+// token of the user_id query parameter if given, else with the token of any joined member.
+func (a *AdminAPI) roomBackfillState(req *http.Request, vars map[string]string) (interface{}, error) {
+	roomID := vars["roomID"]
+	userIDs := req.URL.Query()["user_id"]
+	userID, numStateEvents, err := a.v2.BackfillRoomState(req.Context(), roomID, userIDs)
+	if err != nil {
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusBadGateway,
+			Err:        fmt.Errorf("failed to backfill state for %s: %w", roomID, err),
+		}
+	}
+	logger.Info().Str("room", roomID).Str("user", userID).Int("state", numStateEvents).Msg("admin: backfilled room state")
+	return AdminRoomBackfillState{
+		RoomID:      roomID,
+		UserID:      userID,
+		StateEvents: numStateEvents,
+	}, nil
+}
+
+// AdminRoomState is the response to GET /rooms/{roomID}/state
+type AdminRoomState struct {
+	RoomID     string `json:"room_id"`
+	SnapshotID int64  `json:"snapshot_id"`
+	// Set if the state is after an event rather than a snapshot.
+	EventNID int64 `json:"event_nid,omitempty"`
+	// The NIDs of the state events, in the same order as State.
+	EventNIDs []int64           `json:"event_nids"`
+	State     []json.RawMessage `json:"state"`
+}
+
+// roomState returns the room state the proxy has stored at either the snapshot_id or the event_nid
+// query parameter, which is useful for debugging state bugs.
+func (a *AdminAPI) roomState(req *http.Request, vars map[string]string) (interface{}, error) {
+	roomID := vars["roomID"]
+	snapshotID, herr := parseIntParam("snapshot_id", req.URL.Query().Get("snapshot_id"))
+	if herr != nil {
+		return nil, herr
+	}
+	eventNID, herr := parseIntParam("event_nid", req.URL.Query().Get("event_nid"))
+	if herr != nil {
+		return nil, herr
+	}
+	if (snapshotID == 0) == (eventNID == 0) {
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusBadRequest,
+			Err:        fmt.Errorf("exactly one of snapshot_id or event_nid must be given"),
+			ErrCode:    "M_INVALID_PARAM",
+		}
+	}
+	var gotRoomID string
+	var events []state.Event
+	var err error
+	if snapshotID != 0 {
+		gotRoomID, events, err = a.state.StateAtSnapshot(snapshotID)
+	} else {
+		gotRoomID, snapshotID, events, err = a.state.StateAfterEvent(eventNID)
+	}
+	if err == sql.ErrNoRows || (err == nil && gotRoomID != roomID) {
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusNotFound,
+			Err:        fmt.Errorf("no such snapshot or event in %s", roomID),
+			ErrCode:    "M_NOT_FOUND",
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	res := AdminRoomState{
+		RoomID:     roomID,
+		SnapshotID: snapshotID,
+		EventNID:   eventNID,
+		EventNIDs:  make([]int64, len(events)),
+		State:      make([]json.RawMessage, len(events)),
+	}
+	for i := range events {
+		res.EventNIDs[i] = events[i].NID
+		res.State[i] = events[i].JSON
+	}
+	return res, nil
+}
+
+// AdminRoomStateDiff is the response to GET /rooms/{roomID}/state_diff
+type AdminRoomStateDiff struct {
+	RoomID   string                    `json:"room_id"`
+	From     int64                     `json:"from"`
+	To       int64                     `json:"to"`
+	Added    []json.RawMessage         `json:"added"`
+	Removed  []json.RawMessage         `json:"removed"`
+	Replaced []AdminReplacedStateEvent `json:"replaced"`
+}
+
+type AdminReplacedStateEvent struct {
+	Old json.RawMessage `json:"old"`
+	New json.RawMessage `json:"new"`
+}
+
+// roomStateDiff returns how the room state the proxy has stored changed between the snapshot IDs in
+// the from and to query parameters.
+func (a *AdminAPI) roomStateDiff(req *http.Request, vars map[string]string) (interface{}, error) {
+	roomID := vars["roomID"]
+	from, herr := parseIntParam("from", req.URL.Query().Get("from"))
+	if herr != nil {
+		return nil, herr
+	}
+	to, herr := parseIntParam("to", req.URL.Query().Get("to"))
+	if herr != nil {
+		return nil, herr
+	}
+	if from == 0 || to == 0 {
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusBadRequest,
+			Err:        fmt.Errorf("from and to must both be given"),
+			ErrCode:    "M_INVALID_PARAM",
+		}
+	}
+	delta, err := a.state.StateDiff(roomID, from, to)
+	if err == sql.ErrNoRows {
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusNotFound,
+			Err:        fmt.Errorf("no such snapshots in %s", roomID),
+			ErrCode:    "M_NOT_FOUND",
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	res := AdminRoomStateDiff{
+		RoomID:   roomID,
+		From:     from,
+		To:       to,
+		Added:    make([]json.RawMessage, len(delta.Added)),
+		Removed:  make([]json.RawMessage, len(delta.Removed)),
+		Replaced: make([]AdminReplacedStateEvent, len(delta.Replaced)),
+	}
+	for i := range delta.Added {
+		res.Added[i] = delta.Added[i].JSON
+	}
+	for i := range delta.Removed {
+		res.Removed[i] = delta.Removed[i].JSON
+	}
+	for i := range delta.Replaced {
+		res.Replaced[i] = AdminReplacedStateEvent{Old: delta.Replaced[i].Old.JSON, New: delta.Replaced[i].New.JSON}
+	}
+	return res, nil
+}
+
+// AdminAudit is the response to GET /audit
+type AdminAudit struct {
+	// Newest first.
+	Entries []state.AuditEntry `json:"entries"`
+	// Pass as `before` to get the next page. Omitted if there are no more entries.
+	NextBefore int64 `json:"next_before,omitempty"`
+}
+
+// auditEntries returns the audit log of admin operations, newest first. The target and action query
+// parameters filter the entries, and before and limit paginate them.
+func (a *AdminAPI) auditEntries(req *http.Request, vars map[string]string) (interface{}, error) {
+	if a.audit == nil {
+		return nil, fmt.Errorf("no audit log")
+	}
+	query := req.URL.Query()
+	before, herr := parseIntParam("before", query.Get("before"))
+	if herr != nil {
+		return nil, herr
+	}
+	limit, herr := parseIntParam("limit", query.Get("limit"))
+	if herr != nil {
+		return nil, herr
+	}
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	} else if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+	entries, err := a.audit.SelectAuditEntries(query.Get("target"), query.Get("action"), before, int(limit))
+	if err != nil {
+		return nil, err
+	}
+	res := AdminAudit{
+		Entries: entries,
+	}
+	if len(entries) == int(limit) {
+		res.NextBefore = entries[len(entries)-1].ID
+	}
+	return res, nil
+}
+
+// AdminPrewarmRequest is the request body for POST /prewarm
+type AdminPrewarmRequest struct {
+	Accounts []PrewarmAccount `json:"accounts"`
+}
+
+// prewarmAccounts queues accounts to start polling for in the background, so their initial syncs
+// are done before their clients first connect. Returns the progress of all prewarming so far,
+// which can be polled with GET /prewarm.
+func (a *AdminAPI) prewarmAccounts(req *http.Request, vars map[string]string) (interface{}, error) {
+	var body AdminPrewarmRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid request body: %w", err),
+			ErrCode:    "M_BAD_JSON",
+		}
+	}
+	for i, account := range body.Accounts {
+		if account.AccessToken == "" {
+			return nil, &internal.HandlerError{
+				StatusCode: http.StatusBadRequest,
+				Err:        fmt.Errorf("accounts[%d].access_token is missing", i),
+				ErrCode:    "M_INVALID_PARAM",
+			}
+		}
+	}
+	a.prewarm.Add(body.Accounts)
+	logger.Info().Int("accounts", len(body.Accounts)).Msg("admin: queued accounts for prewarming")
+	return a.prewarm.Status(), nil
+}
+
+func (a *AdminAPI) prewarmStatus(req *http.Request, vars map[string]string) (interface{}, error) {
+	return a.prewarm.Status(), nil
+}
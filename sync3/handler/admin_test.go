@@ -0,0 +1,702 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// destroyableConnHandler is a stub ConnHandler which can be closed.
+type destroyableConnHandler struct {
+	sync3.ConnHandler
+	destroyed atomic.Bool
+}
+
+func (c *destroyableConnHandler) Destroy()                                    { c.destroyed.Store(true) }
+func (c *destroyableConnHandler) SetCancelCallback(cancel context.CancelFunc) {}
+
+func TestAdminAPIUserConns(t *testing.T) {
+	h := &SyncLiveHandler{
+		ConnMap: sync3.NewConnMap(false, time.Minute),
+	}
+	// no Teardown as that destroys the conns, which these stub ConnStates don't support.
+	alice := "@alice/with/slashes:localhost"
+	// a connection which has processed a request
+	cs := &ConnState{}
+	cs.stickyReq.Store(&sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {Ranges: sync3.SliceRanges{{0, 20}}},
+		},
+	})
+	h.ConnMap.CreateConn(sync3.ConnID{UserID: alice, DeviceID: "PHONE", CID: "room-list"}, func() {}, func() sync3.ConnHandler {
+		return cs
+	})
+	// a connection which hasn't
+	h.ConnMap.CreateConn(sync3.ConnID{UserID: alice, DeviceID: "LAPTOP"}, func() {}, func() sync3.ConnHandler {
+		return &ConnState{}
+	})
+	h.ConnMap.CreateConn(sync3.ConnID{UserID: "@bob:localhost", DeviceID: "BOB"}, func() {}, func() sync3.ConnHandler {
+		return &ConnState{}
+	})
+
+	api := NewAdminAPI(h, nil, "secret")
+	path := "/users/" + url.PathEscape(alice) + "/conns"
+	testCases := []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{name: "no token", wantCode: 401},
+		{name: "wrong token", token: "wrong", wantCode: 401},
+		{name: "right token", token: "secret", wantCode: 200},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d want %d: %s", tc.name, w.Code, tc.wantCode, w.Body.String())
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+		var res AdminUserConns
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: failed to decode response: %s", tc.name, err)
+		}
+		if res.UserID != alice {
+			t.Errorf("%s: got user ID %s want %s", tc.name, res.UserID, alice)
+		}
+		if len(res.Conns) != 2 {
+			t.Fatalf("%s: got %d conns want 2: %+v", tc.name, len(res.Conns), res.Conns)
+		}
+		// sorted by device ID
+		if res.Conns[0].DeviceID != "LAPTOP" || res.Conns[0].StickyRequest != nil {
+			t.Errorf("%s: got first conn %+v, want LAPTOP without a sticky request", tc.name, res.Conns[0])
+		}
+		if res.Conns[1].DeviceID != "PHONE" || res.Conns[1].ConnID != "room-list" || res.Conns[1].StickyRequest == nil {
+			t.Fatalf("%s: got second conn %+v, want PHONE with a sticky request", tc.name, res.Conns[1])
+		}
+		if got := res.Conns[1].StickyRequest.Lists["a"].Ranges; len(got) != 1 || got[0] != [2]int64{0, 20} {
+			t.Errorf("%s: got sticky ranges %v want [[0,20]]", tc.name, got)
+		}
+	}
+
+	// unknown routes 404
+	req := httptest.NewRequest("GET", "/nope", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown route: got HTTP %d want 404", w.Code)
+	}
+}
+
+func TestAdminAPIUserResync(t *testing.T) {
+	n := &mockNotifier{ch: make(chan pubsub.Payload, 100)}
+	h := &SyncLiveHandler{
+		ConnMap:      sync3.NewConnMap(false, time.Minute),
+		EnsurePoller: NewEnsurePoller(n, false),
+	}
+	defer h.ConnMap.Teardown()
+	alice := "@alice:localhost"
+	var aliceConns []*destroyableConnHandler
+	for _, deviceID := range []string{"PHONE", "LAPTOP"} {
+		ch := &destroyableConnHandler{}
+		aliceConns = append(aliceConns, ch)
+		h.ConnMap.CreateConn(sync3.ConnID{UserID: alice, DeviceID: deviceID}, func() {}, func() sync3.ConnHandler {
+			return ch
+		})
+	}
+	bobConn := &destroyableConnHandler{}
+	h.ConnMap.CreateConn(sync3.ConnID{UserID: "@bob:localhost", DeviceID: "BOB"}, func() {}, func() sync3.ConnHandler {
+		return bobConn
+	})
+	// pretend alice's phone has already been polled
+	h.EnsurePoller.pendingPolls[sync2.PollerID{UserID: alice, DeviceID: "PHONE"}] = pendingInfo{done: true}
+
+	api := NewAdminAPI(h, nil, "secret")
+	// only POST is allowed
+	req := httptest.NewRequest("GET", "/users/"+url.PathEscape(alice)+"/resync", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got HTTP %d want 405", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/users/"+url.PathEscape(alice)+"/resync", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("POST: got HTTP %d want 200: %s", w.Code, w.Body.String())
+	}
+	var res AdminUserResync
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	assertVal(t, res, AdminUserResync{UserID: alice, ConnsClosed: 2})
+
+	p := n.WaitForNextPayload(t, time.Second)
+	fr, ok := p.(*pubsub.V3ForceResync)
+	if !ok {
+		t.Fatalf("unexpected payload: %+v", p)
+	}
+	assertVal(t, fr.UserID, alice)
+	if _, exists := h.EnsurePoller.pendingPolls[sync2.PollerID{UserID: alice, DeviceID: "PHONE"}]; exists {
+		t.Errorf("EnsurePoller still thinks alice's phone has been polled")
+	}
+
+	// conns are closed asynchronously by the TTL cache
+	deadline := time.Now().Add(time.Second)
+	for len(h.ConnMap.ConnsForUser(alice)) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conns := h.ConnMap.ConnsForUser(alice); len(conns) != 0 {
+		t.Fatalf("alice still has %d conns", len(conns))
+	}
+	for i, ch := range aliceConns {
+		if !ch.destroyed.Load() {
+			t.Errorf("alice's conn %d was not destroyed", i)
+		}
+	}
+	if bobConn.destroyed.Load() {
+		t.Errorf("bob's conn was destroyed")
+	}
+}
+
+func TestAdminAPIConnDump(t *testing.T) {
+	h := &SyncLiveHandler{
+		ConnMap: sync3.NewConnMap(false, time.Minute),
+	}
+	// no Teardown as that destroys the conns, which these stub ConnStates don't support.
+	alice := "@alice:localhost"
+	cs := &ConnState{userID: alice, deviceID: "PHONE"}
+	cs.debug.addOp(ConnDebugOp{List: "a", Op: &sync3.ResponseOpSingle{Operation: sync3.OpInvalidate}})
+	h.ConnMap.CreateConn(sync3.ConnID{UserID: alice, DeviceID: "PHONE", CID: "room-list"}, func() {}, func() sync3.ConnHandler {
+		return cs
+	})
+	api := NewAdminAPI(h, nil, "secret")
+
+	testCases := []struct {
+		name     string
+		path     string
+		wantCode int
+	}{
+		{name: "known conn", path: "/users/" + url.PathEscape(alice) + "/devices/PHONE/conn?conn_id=room-list", wantCode: 200},
+		{name: "missing conn_id", path: "/users/" + url.PathEscape(alice) + "/devices/PHONE/conn", wantCode: 404},
+		{name: "unknown device", path: "/users/" + url.PathEscape(alice) + "/devices/LAPTOP/conn?conn_id=room-list", wantCode: 404},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d want %d: %s", tc.name, w.Code, tc.wantCode, w.Body.String())
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+		var res struct {
+			UserID    string `json:"user_id"`
+			DeviceID  string `json:"device_id"`
+			ConnID    string `json:"conn_id"`
+			RecentOps []struct {
+				List string          `json:"list"`
+				Op   json.RawMessage `json:"op"`
+			} `json:"recent_ops"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: failed to decode response: %s", tc.name, err)
+		}
+		assertVal(t, res.UserID, alice)
+		assertVal(t, res.DeviceID, "PHONE")
+		assertVal(t, res.ConnID, "room-list")
+		if len(res.RecentOps) != 1 || res.RecentOps[0].List != "a" || string(res.RecentOps[0].Op) != `{"op":"INVALIDATE"}` {
+			t.Errorf("%s: got recent ops %s", tc.name, w.Body.String())
+		}
+	}
+}
+
+type stubV2Admin struct {
+	pollers  map[string][]sync2.PollerStatus
+	backfill func(roomID string, userIDs []string) (string, int, error)
+}
+
+func (s *stubV2Admin) PollerStatuses(userID string) []sync2.PollerStatus {
+	return s.pollers[userID]
+}
+
+func (s *stubV2Admin) BackfillRoomState(ctx context.Context, roomID string, userIDs []string) (string, int, error) {
+	return s.backfill(roomID, userIDs)
+}
+
+func TestAdminAPIUserPollers(t *testing.T) {
+	h := &SyncLiveHandler{
+		ConnMap: sync3.NewConnMap(false, time.Minute),
+	}
+	defer h.ConnMap.Teardown()
+	alice := "@alice:localhost"
+	pollers := map[string][]sync2.PollerStatus{
+		alice: {
+			{UserID: alice, DeviceID: "LAPTOP", Since: "s1", LastPollTS: 1000},
+			{UserID: alice, DeviceID: "PHONE", FailCount: 2, BackingOff: true, LastError: "sync v2 returned HTTP 502", LastErrorTS: 900},
+		},
+	}
+	api := NewAdminAPI(h, &stubV2Admin{pollers: pollers}, "secret")
+	req := httptest.NewRequest("GET", "/users/"+url.PathEscape(alice)+"/pollers", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("got HTTP %d want 200: %s", w.Code, w.Body.String())
+	}
+	var res AdminUserPollers
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if res.UserID != alice {
+		t.Errorf("got user ID %s want %s", res.UserID, alice)
+	}
+	if !reflect.DeepEqual(res.Pollers, pollers[alice]) {
+		t.Errorf("got pollers %+v want %+v", res.Pollers, pollers[alice])
+	}
+}
+
+func TestAdminAPIRoomBackfillState(t *testing.T) {
+	h := &SyncLiveHandler{
+		ConnMap: sync3.NewConnMap(false, time.Minute),
+	}
+	defer h.ConnMap.Teardown()
+	roomID := "!room:localhost"
+	var gotUserIDs []string
+	api := NewAdminAPI(h, &stubV2Admin{
+		backfill: func(gotRoomID string, userIDs []string) (string, int, error) {
+			if gotRoomID != roomID {
+				t.Errorf("backfilled room %s want %s", gotRoomID, roomID)
+			}
+			gotUserIDs = userIDs
+			if len(userIDs) == 0 {
+				return "@member:localhost", 12, nil
+			}
+			if userIDs[0] == "@stranger:localhost" {
+				return userIDs[0], 0, fmt.Errorf("RoomState: response returned 403 Forbidden")
+			}
+			return userIDs[0], 7, nil
+		},
+	}, "secret")
+	testCases := []struct {
+		query       string
+		wantCode    int
+		wantUserIDs []string
+		wantRes     AdminRoomBackfillState
+	}{
+		{
+			wantCode: 200,
+			wantRes:  AdminRoomBackfillState{RoomID: roomID, UserID: "@member:localhost", StateEvents: 12},
+		},
+		{
+			query:       "?user_id=" + url.QueryEscape("@alice:localhost"),
+			wantCode:    200,
+			wantUserIDs: []string{"@alice:localhost"},
+			wantRes:     AdminRoomBackfillState{RoomID: roomID, UserID: "@alice:localhost", StateEvents: 7},
+		},
+		{
+			query:       "?user_id=" + url.QueryEscape("@stranger:localhost"),
+			wantCode:    502,
+			wantUserIDs: []string{"@stranger:localhost"},
+		},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("POST", "/rooms/"+url.PathEscape(roomID)+"/backfill_state"+tc.query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d want %d: %s", tc.query, w.Code, tc.wantCode, w.Body.String())
+			continue
+		}
+		if !reflect.DeepEqual(gotUserIDs, tc.wantUserIDs) {
+			t.Errorf("%s: backfilled as %v want %v", tc.query, gotUserIDs, tc.wantUserIDs)
+		}
+		if tc.wantCode != 200 {
+			continue
+		}
+		var res AdminRoomBackfillState
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("failed to decode response: %s", err)
+		}
+		if res != tc.wantRes {
+			t.Errorf("%s: got response %+v want %+v", tc.query, res, tc.wantRes)
+		}
+	}
+}
+
+func TestAdminAPIPrewarm(t *testing.T) {
+	h := &SyncLiveHandler{
+		ConnMap: sync3.NewConnMap(false, time.Minute),
+	}
+	defer h.ConnMap.Teardown()
+	api := NewAdminAPI(h, nil, "secret")
+	var mu sync.Mutex
+	var prewarmed []string
+	release := make(chan struct{})
+	api.prewarm.prewarmFn = func(ctx context.Context, account PrewarmAccount) error {
+		<-release
+		if account.AccessToken == "bad" {
+			return fmt.Errorf("access token for %q has expired", account.UserID)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		prewarmed = append(prewarmed, account.UserID)
+		return nil
+	}
+	doRequest := func(method, body string) (int, PrewarmStatus) {
+		t.Helper()
+		req := httptest.NewRequest(method, "/prewarm", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		var status PrewarmStatus
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+		}
+		return w.Code, status
+	}
+
+	if code, _ := doRequest("POST", `{"accounts":[{"user_id":"@alice:localhost"}]}`); code != 400 {
+		t.Errorf("missing access token: got HTTP %d want 400", code)
+	}
+	var accounts []string
+	for i := 0; i < 2*maxParallelPrewarms; i++ {
+		accounts = append(accounts, fmt.Sprintf(`{"user_id":"@user%d:localhost","access_token":"token%d"}`, i, i))
+	}
+	accounts = append(accounts, `{"user_id":"@expired:localhost","access_token":"bad"}`)
+	code, status := doRequest("POST", `{"accounts":[`+strings.Join(accounts, ",")+`]}`)
+	if code != 200 {
+		t.Fatalf("POST /prewarm: got HTTP %d want 200", code)
+	}
+	// only a few accounts are prewarmed at once
+	if status.Queued+status.InProgress != len(accounts) || status.InProgress > maxParallelPrewarms {
+		t.Errorf("got status %+v after queueing %d accounts", status, len(accounts))
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, status = doRequest("GET", "")
+		if status.Done+status.Failed == len(accounts) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for prewarming to finish: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Done != 2*maxParallelPrewarms || status.Failed != 1 || status.Queued != 0 || status.InProgress != 0 {
+		t.Errorf("got status %+v, want all but one account done", status)
+	}
+	if len(status.Errors) != 1 || !strings.Contains(status.Errors[0], "@expired:localhost") {
+		t.Errorf("got errors %v, want one for the expired account", status.Errors)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(prewarmed) != 2*maxParallelPrewarms {
+		t.Errorf("prewarmed %d accounts, want %d", len(prewarmed), 2*maxParallelPrewarms)
+	}
+}
+
+type stubStateQuerier struct {
+	roomID    string
+	snapshots map[int64][]state.Event
+	// event NID -> snapshot ID
+	events map[int64]int64
+	// (from, to) snapshot IDs -> delta
+	deltas map[[2]int64]state.StateDelta
+}
+
+func (s *stubStateQuerier) StateAtSnapshot(snapshotID int64) (string, []state.Event, error) {
+	events, ok := s.snapshots[snapshotID]
+	if !ok {
+		return "", nil, sql.ErrNoRows
+	}
+	return s.roomID, events, nil
+}
+
+func (s *stubStateQuerier) StateAfterEvent(eventNID int64) (string, int64, []state.Event, error) {
+	snapshotID, ok := s.events[eventNID]
+	if !ok {
+		return "", 0, nil, sql.ErrNoRows
+	}
+	return s.roomID, snapshotID, s.snapshots[snapshotID], nil
+}
+
+func (s *stubStateQuerier) StateDiff(roomID string, fromSnapshotID, toSnapshotID int64) (state.StateDelta, error) {
+	_, fromOK := s.snapshots[fromSnapshotID]
+	_, toOK := s.snapshots[toSnapshotID]
+	if !fromOK || !toOK || roomID != s.roomID {
+		return state.StateDelta{}, sql.ErrNoRows
+	}
+	return s.deltas[[2]int64{fromSnapshotID, toSnapshotID}], nil
+}
+
+func TestAdminAPIRoomState(t *testing.T) {
+	h := &SyncLiveHandler{
+		ConnMap: sync3.NewConnMap(false, time.Minute),
+	}
+	defer h.ConnMap.Teardown()
+	roomID := "!room:localhost"
+	createEvent := state.Event{NID: 1, JSON: []byte(`{"type":"m.room.create","state_key":""}`)}
+	joinEvent := state.Event{NID: 2, JSON: []byte(`{"type":"m.room.member","state_key":"@alice:localhost"}`)}
+	api := NewAdminAPI(h, nil, "secret")
+	api.state = &stubStateQuerier{
+		roomID: roomID,
+		snapshots: map[int64][]state.Event{
+			10: {createEvent},
+			11: {createEvent, joinEvent},
+		},
+		events: map[int64]int64{2: 11},
+	}
+	testCases := []struct {
+		roomID   string
+		query    string
+		wantCode int
+		wantRes  AdminRoomState
+	}{
+		{
+			query:    "?snapshot_id=10",
+			wantCode: 200,
+			wantRes:  AdminRoomState{RoomID: roomID, SnapshotID: 10, EventNIDs: []int64{1}, State: []json.RawMessage{createEvent.JSON}},
+		},
+		{
+			query:    "?event_nid=2",
+			wantCode: 200,
+			wantRes: AdminRoomState{
+				RoomID: roomID, SnapshotID: 11, EventNID: 2, EventNIDs: []int64{1, 2}, State: []json.RawMessage{createEvent.JSON, joinEvent.JSON},
+			},
+		},
+		{query: "", wantCode: 400},
+		{query: "?snapshot_id=10&event_nid=2", wantCode: 400},
+		{query: "?snapshot_id=ten", wantCode: 400},
+		{query: "?snapshot_id=12", wantCode: 404},
+		{query: "?event_nid=3", wantCode: 404},
+		// the snapshot exists, but in a different room
+		{roomID: "!other:localhost", query: "?snapshot_id=10", wantCode: 404},
+	}
+	for _, tc := range testCases {
+		if tc.roomID == "" {
+			tc.roomID = roomID
+		}
+		req := httptest.NewRequest("GET", "/rooms/"+url.PathEscape(tc.roomID)+"/state"+tc.query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s%s: got HTTP %d want %d: %s", tc.roomID, tc.query, w.Code, tc.wantCode, w.Body.String())
+			continue
+		}
+		if tc.wantCode != 200 {
+			continue
+		}
+		var res AdminRoomState
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("failed to decode response: %s", err)
+		}
+		if !reflect.DeepEqual(res, tc.wantRes) {
+			t.Errorf("%s: got response %+v want %+v", tc.query, res, tc.wantRes)
+		}
+	}
+}
+
+func TestAdminAPIRoomStateDiff(t *testing.T) {
+	h := &SyncLiveHandler{
+		ConnMap: sync3.NewConnMap(false, time.Minute),
+	}
+	defer h.ConnMap.Teardown()
+	roomID := "!room:localhost"
+	nameEvent := state.Event{NID: 3, JSON: []byte(`{"type":"m.room.name","state_key":"","content":{"name":"first"}}`)}
+	renameEvent := state.Event{NID: 4, JSON: []byte(`{"type":"m.room.name","state_key":"","content":{"name":"second"}}`)}
+	topicEvent := state.Event{NID: 5, JSON: []byte(`{"type":"m.room.topic","state_key":""}`)}
+	api := NewAdminAPI(h, nil, "secret")
+	api.state = &stubStateQuerier{
+		roomID: roomID,
+		snapshots: map[int64][]state.Event{
+			10: {nameEvent, topicEvent},
+			11: {renameEvent},
+		},
+		deltas: map[[2]int64]state.StateDelta{
+			{10, 11}: {
+				Removed:  []state.Event{topicEvent},
+				Replaced: []state.ReplacedStateEvent{{Old: nameEvent, New: renameEvent}},
+			},
+		},
+	}
+	testCases := []struct {
+		query    string
+		wantCode int
+		wantRes  AdminRoomStateDiff
+	}{
+		{
+			query:    "?from=10&to=11",
+			wantCode: 200,
+			wantRes: AdminRoomStateDiff{
+				RoomID:   roomID,
+				From:     10,
+				To:       11,
+				Added:    []json.RawMessage{},
+				Removed:  []json.RawMessage{topicEvent.JSON},
+				Replaced: []AdminReplacedStateEvent{{Old: nameEvent.JSON, New: renameEvent.JSON}},
+			},
+		},
+		{
+			query:    "?from=10&to=10",
+			wantCode: 200,
+			wantRes:  AdminRoomStateDiff{RoomID: roomID, From: 10, To: 10, Added: []json.RawMessage{}, Removed: []json.RawMessage{}, Replaced: []AdminReplacedStateEvent{}},
+		},
+		{query: "?from=10", wantCode: 400},
+		{query: "?from=10&to=eleven", wantCode: 400},
+		{query: "?from=10&to=12", wantCode: 404},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/rooms/"+url.PathEscape(roomID)+"/state_diff"+tc.query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d want %d: %s", tc.query, w.Code, tc.wantCode, w.Body.String())
+			continue
+		}
+		if tc.wantCode != 200 {
+			continue
+		}
+		var res AdminRoomStateDiff
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("failed to decode response: %s", err)
+		}
+		if !reflect.DeepEqual(res, tc.wantRes) {
+			t.Errorf("%s: got response %+v want %+v", tc.query, res, tc.wantRes)
+		}
+	}
+}
+
+type stubAuditLog struct {
+	entries []state.AuditEntry
+}
+
+func (l *stubAuditLog) InsertAuditEntry(entry *state.AuditEntry) error {
+	entry.ID = int64(len(l.entries) + 1)
+	l.entries = append(l.entries, *entry)
+	return nil
+}
+
+func (l *stubAuditLog) SelectAuditEntries(target, action string, before int64, limit int) ([]state.AuditEntry, error) {
+	result := []state.AuditEntry{}
+	for i := len(l.entries) - 1; i >= 0 && len(result) < limit; i-- {
+		e := l.entries[i]
+		if (target == "" || e.Target == target) && (action == "" || e.Action == action) && (before == 0 || e.ID < before) {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+func TestAdminAPIAudit(t *testing.T) {
+	h := &SyncLiveHandler{
+		ConnMap: sync3.NewConnMap(false, time.Minute),
+	}
+	defer h.ConnMap.Teardown()
+	api := NewAdminAPI(h, &stubV2Admin{
+		backfill: func(roomID string, userIDs []string) (string, int, error) {
+			if roomID == "!broken:localhost" {
+				return "", 0, fmt.Errorf("no members")
+			}
+			return "@alice:localhost", 3, nil
+		},
+	}, "secret")
+	auditLog := &stubAuditLog{}
+	api.audit = auditLog
+	do := func(method, path, actor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		if actor != "" {
+			req.Header.Set(AdminActorHeader, actor)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+	do("POST", "/rooms/"+url.PathEscape("!a:localhost")+"/backfill_state", "ops")
+	do("POST", "/rooms/"+url.PathEscape("!broken:localhost")+"/backfill_state", "")
+	// reads are not audited
+	do("GET", "/prewarm", "")
+
+	wantEntries := []state.AuditEntry{
+		{ID: 1, Actor: "ops (10.0.0.1)", Action: "backfill_state", Target: "!a:localhost", Status: 200},
+		{ID: 2, Actor: "10.0.0.1", Action: "backfill_state", Target: "!broken:localhost", Status: 502},
+	}
+	if len(auditLog.entries) != len(wantEntries) {
+		t.Fatalf("got %d audit entries want %d: %+v", len(auditLog.entries), len(wantEntries), auditLog.entries)
+	}
+	for i, want := range wantEntries {
+		got := auditLog.entries[i]
+		if got.Timestamp == 0 {
+			t.Errorf("entry %d has no timestamp", i)
+		}
+		if i == 1 && !strings.Contains(got.Error, "no members") {
+			t.Errorf("entry %d: got error %q", i, got.Error)
+		}
+		got.Timestamp, got.Error = 0, ""
+		if got != want {
+			t.Errorf("entry %d: got %+v want %+v", i, got, want)
+		}
+	}
+
+	w := do("GET", "/audit?limit=1", "")
+	var res AdminAudit
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].ID != 2 || res.NextBefore != 2 {
+		t.Errorf("got first page %+v", res)
+	}
+	w = do("GET", "/audit?limit=1&before=2", "")
+	res = AdminAudit{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].ID != 1 {
+		t.Errorf("got second page %+v", res)
+	}
+	w = do("GET", "/audit?target="+url.QueryEscape("!broken:localhost"), "")
+	res = AdminAudit{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Target != "!broken:localhost" || res.NextBefore != 0 {
+		t.Errorf("got filtered entries %+v", res)
+	}
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/tidwall/gjson"
+)
+
+// TimelineBackfiller tops up timelines which are shorter than the client asked for, because the
+// proxy hasn't seen that much of the room's history.
+type TimelineBackfiller interface {
+	// Backfill prepends older events to the timeline until it has up to `limit` events, updating
+	// its prev_batch.
+	Backfill(ctx context.Context, roomID string, timeline *state.LatestEvents, limit int) error
+}
+
+// homeserverBackfiller backfills timelines from the homeserver's /messages using a device's
+// access token, so the homeserver applies that user's history visibility.
+type homeserverBackfiller struct {
+	h                         *SyncLiveHandler
+	userID, deviceID, tokenID string // tokenID is the access token hash
+}
+
+// backfillsPerUserPerMinute limits how often each user's timelines are backfilled from the
+// homeserver, as an initial sync can ask for many rooms with short timelines. Rooms which aren't
+// backfilled because of the limit get their stored timeline, and are backfilled on a later load.
+const backfillsPerUserPerMinute = 60
+
+func (b *homeserverBackfiller) Backfill(ctx context.Context, roomID string, timeline *state.LatestEvents, limit int) error {
+	ctx, span := internal.StartSpan(ctx, "Backfill")
+	defer span.End()
+	if max := b.h.Storage.TimelineLimit(); max != 0 && limit > max {
+		limit = max
+	}
+	if len(timeline.Timeline) >= limit || timeline.PrevBatch == "" {
+		return nil
+	}
+	// Use events backfilled for this user before, rather than asking the homeserver again.
+	needed := limit - len(timeline.Timeline)
+	stored, storedPrevBatch, ok, err := b.h.Storage.BackfilledTimeline(b.userID, roomID, needed)
+	if err != nil {
+		return fmt.Errorf("failed to load backfilled events: %w", err)
+	}
+	if ok {
+		prependOlderEvents(timeline, stored, limit)
+		if len(stored) == needed {
+			// There may be more stored events, so keep the prev_batch we started from, as below.
+			return nil
+		}
+		// every stored event was used, so carry on from where the last backfill stopped
+		timeline.PrevBatch = storedPrevBatch
+		if timeline.PrevBatch == "" {
+			return nil // the start of the room
+		}
+	}
+	if allowed, _ := b.h.backfillLimiter.Allow(b.userID); !allowed {
+		internal.Logf(ctx, "backfill", "rate limited backfilling %s", roomID)
+		return nil
+	}
+	accessToken, _, err := b.h.V2Store.GetTokenAndSince(b.userID, b.deviceID, b.tokenID)
+	if err != nil {
+		return fmt.Errorf("failed to load access token: %w", err)
+	}
+	// The prev_batch may belong to a later event than the oldest in the timeline, so ask for
+	// enough events to skip over the ones we already have.
+	res, err := b.h.V2.Messages(ctx, accessToken, roomID, timeline.PrevBatch, limit)
+	if err != nil {
+		return err
+	}
+	if err = b.h.Storage.BackfillTimeline(b.userID, roomID, res.Chunk, res.End); err != nil {
+		return err
+	}
+	// If we stopped part way through the chunk there is no token for where we stopped, so keep the
+	// prev_batch we paginated from. Clients will see some events twice, which they de-dupe.
+	if prependOlderEvents(timeline, res.Chunk, limit) {
+		timeline.PrevBatch = res.End
+	}
+	return nil
+}
+
+// prependOlderEvents adds events from older, which is newest first, to the start of the timeline
+// until it has `limit` events, skipping events it already has. Returns true if all of older was used.
+func prependOlderEvents(timeline *state.LatestEvents, older []json.RawMessage, limit int) bool {
+	have := make(map[string]struct{}, len(timeline.Timeline))
+	for _, ev := range timeline.Timeline {
+		have[gjson.GetBytes(ev, "event_id").Str] = struct{}{}
+	}
+	var prepend []json.RawMessage
+	usedAll := true
+	for _, ev := range older {
+		if len(prepend)+len(timeline.Timeline) >= limit {
+			usedAll = false
+			break
+		}
+		if _, ok := have[gjson.GetBytes(ev, "event_id").Str]; ok {
+			continue
+		}
+		prepend = append(prepend, ev)
+	}
+	backfilled := make([]json.RawMessage, 0, len(prepend)+len(timeline.Timeline))
+	for i := len(prepend) - 1; i >= 0; i-- {
+		backfilled = append(backfilled, prepend[i])
+	}
+	timeline.Timeline = append(backfilled, timeline.Timeline...)
+	return usedAll
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/tidwall/gjson"
+)
+
+// stubBackfillStore stores backfilled events in memory. Methods which aren't overridden panic.
+type stubBackfillStore struct {
+	Store
+	// user ID and room ID -> backfilled events, newest first
+	backfilled map[string][]json.RawMessage
+	// user ID and room ID -> prev_batch of the oldest backfilled event
+	prevBatches map[string]string
+}
+
+func (s *stubBackfillStore) TimelineLimit() int { return 50 }
+
+func (s *stubBackfillStore) BackfillTimeline(userID, roomID string, events []json.RawMessage, prevBatch string) error {
+	key := userID + " " + roomID
+	s.backfilled[key] = append(s.backfilled[key], events...)
+	s.prevBatches[key] = prevBatch
+	return nil
+}
+
+func (s *stubBackfillStore) BackfilledTimeline(userID, roomID string, limit int) ([]json.RawMessage, string, bool, error) {
+	key := userID + " " + roomID
+	events, ok := s.backfilled[key]
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, s.prevBatches[key], ok, nil
+}
+
+type stubBackfillV2Store struct {
+	V2Store
+}
+
+func (s *stubBackfillV2Store) GetTokenAndSince(userID, deviceID, tokenHash string) (string, string, error) {
+	return userID + "_token", "", nil
+}
+
+// stubMessagesClient serves /messages for a room with events $1..$N, where $1 is the create event.
+// The token to paginate back from $n is pN.
+type stubMessagesClient struct {
+	sync2.Client
+	calls []string
+}
+
+func (c *stubMessagesClient) Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*sync2.MessagesResponse, error) {
+	c.calls = append(c.calls, accessToken+" "+from)
+	var n int
+	fmt.Sscanf(from, "p%d", &n)
+	res := &sync2.MessagesResponse{}
+	for i := n - 1; i >= 1 && len(res.Chunk) < limit; i-- {
+		res.Chunk = append(res.Chunk, backfillTestEvent(i))
+		if i > 1 {
+			res.End = fmt.Sprintf("p%d", i)
+		} else {
+			res.End = ""
+		}
+	}
+	return res, nil
+}
+
+func backfillTestEvent(i int) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"event_id":"$%d","type":"m.room.message"}`, i))
+}
+
+func backfillTestEventIDs(timeline []json.RawMessage) (ids []string) {
+	for _, ev := range timeline {
+		ids = append(ids, gjson.GetBytes(ev, "event_id").Str)
+	}
+	return
+}
+
+func TestHomeserverBackfiller(t *testing.T) {
+	client := &stubMessagesClient{}
+	h := &SyncLiveHandler{
+		Storage:         &stubBackfillStore{backfilled: map[string][]json.RawMessage{}, prevBatches: map[string]string{}},
+		V2Store:         &stubBackfillV2Store{},
+		V2:              client,
+		backfillLimiter: internal.NewRateLimiter(backfillsPerUserPerMinute, 0),
+	}
+	alice := &homeserverBackfiller{h: h, userID: "alice"}
+	bob := &homeserverBackfiller{h: h, userID: "bob"}
+	// the proxy has only seen $10, and the homeserver has $1..$9 before it
+	backfill := func(b *homeserverBackfiller, limit int) state.LatestEvents {
+		t.Helper()
+		timeline := state.LatestEvents{
+			Timeline:  []json.RawMessage{backfillTestEvent(10)},
+			PrevBatch: "p10",
+		}
+		if err := b.Backfill(context.Background(), "!room", &timeline, limit); err != nil {
+			t.Fatalf("Backfill: %s", err)
+		}
+		return timeline
+	}
+
+	testCases := []struct {
+		name          string
+		backfiller    *homeserverBackfiller
+		limit         int
+		wantIDs       []string
+		wantPrevBatch string
+		wantCalls     []string
+	}{
+		{
+			name:          "the first load asks the homeserver",
+			backfiller:    alice,
+			limit:         3,
+			wantIDs:       []string{"$8", "$9", "$10"},
+			wantPrevBatch: "p10", // the rest of the chunk wasn't used
+			wantCalls:     []string{"alice_token p10"},
+		},
+		{
+			name:          "later loads read the stored backfill",
+			backfiller:    alice,
+			limit:         3,
+			wantIDs:       []string{"$8", "$9", "$10"},
+			wantPrevBatch: "p10",
+		},
+		{
+			name:          "the homeserver is asked for events older than the stored backfill",
+			backfiller:    alice,
+			limit:         5,
+			wantIDs:       []string{"$6", "$7", "$8", "$9", "$10"},
+			wantPrevBatch: "p7",
+			wantCalls:     []string{"alice_token p7"},
+		},
+		{
+			name:          "the homeserver is asked to continue from the end of the stored backfill",
+			backfiller:    alice,
+			limit:         20,
+			wantIDs:       []string{"$1", "$2", "$3", "$4", "$5", "$6", "$7", "$8", "$9", "$10"},
+			wantPrevBatch: "",
+			wantCalls:     []string{"alice_token p2"},
+		},
+		{
+			name:          "the homeserver isn't asked once the start of the room is stored",
+			backfiller:    alice,
+			limit:         20,
+			wantIDs:       []string{"$1", "$2", "$3", "$4", "$5", "$6", "$7", "$8", "$9", "$10"},
+			wantPrevBatch: "",
+		},
+		{
+			name:          "other users don't see the stored backfill",
+			backfiller:    bob,
+			limit:         2,
+			wantIDs:       []string{"$9", "$10"},
+			wantPrevBatch: "p10",
+			wantCalls:     []string{"bob_token p10"},
+		},
+	}
+	for _, tc := range testCases {
+		client.calls = nil
+		timeline := backfill(tc.backfiller, tc.limit)
+		if got := backfillTestEventIDs(timeline.Timeline); !reflect.DeepEqual(got, tc.wantIDs) {
+			t.Errorf("%s: got timeline %v want %v", tc.name, got, tc.wantIDs)
+		}
+		if timeline.PrevBatch != tc.wantPrevBatch {
+			t.Errorf("%s: got prev_batch %q want %q", tc.name, timeline.PrevBatch, tc.wantPrevBatch)
+		}
+		if !reflect.DeepEqual(client.calls, tc.wantCalls) {
+			t.Errorf("%s: got /messages calls %v want %v", tc.name, client.calls, tc.wantCalls)
+		}
+	}
+}
+
+func TestHomeserverBackfillerRateLimit(t *testing.T) {
+	client := &stubMessagesClient{}
+	h := &SyncLiveHandler{
+		Storage:         &stubBackfillStore{backfilled: map[string][]json.RawMessage{}, prevBatches: map[string]string{}},
+		V2Store:         &stubBackfillV2Store{},
+		V2:              client,
+		backfillLimiter: internal.NewRateLimiter(1, 1),
+	}
+	b := &homeserverBackfiller{h: h, userID: "alice"}
+	for _, roomID := range []string{"!a", "!b"} {
+		timeline := state.LatestEvents{
+			Timeline:  []json.RawMessage{backfillTestEvent(10)},
+			PrevBatch: "p10",
+		}
+		if err := b.Backfill(context.Background(), roomID, &timeline, 3); err != nil {
+			t.Fatalf("Backfill: %s", err)
+		}
+	}
+	// only the first room is backfilled
+	assertVal(t, client.calls, []string{"alice_token p10"})
+}
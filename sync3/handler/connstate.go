@@ -1,11 +1,19 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
@@ -27,6 +35,11 @@ type ConnState struct {
 	cancelLatestReq context.CancelFunc
 	lists           *sync3.InternalRequestLists
 
+	// a copy of muxedReq which is safe to read from other goroutines, for admin APIs.
+	stickyReq atomic.Pointer[sync3.Request]
+	// a copy of list state which is safe to read from other goroutines, for admin APIs.
+	debug connDebugTracker
+
 	// Confirmed room subscriptions. Entries in this list have been checked for things like
 	// "is the user joined to this room?" whereas subscriptions in muxedReq are untrusted.
 	roomSubscriptions map[string]sync3.RoomSubscription // room_id -> subscription
@@ -42,6 +55,17 @@ type ConnState struct {
 	anchorLoadPosition int64
 	// roomID -> latest load pos
 	loadPositions map[string]int64
+	// roomID -> which live timeline events to send, for rooms whose timelines are filtered
+	timelineFilters map[string]*internal.TimelineFilter
+	// Identifies the room data loaded by load(), so sorted lists can be shared with other connections
+	// for this user which loaded identical data. Empty if the data could not be identified, and once
+	// live updates may have been applied to the lists.
+	listSnapshotPrefix string
+
+	// limits how much is sent in each response, and remembers what was left out.
+	budget responseBudget
+	// lists to use when the first request on this connection asks for no lists or rooms, or nil.
+	defaultLists map[string]sync3.RequestList
 
 	txnIDWaiter *TxnIDWaiter
 	live        *connStateLive
@@ -50,18 +74,85 @@ type ConnState struct {
 	userCache   *caches.UserCache
 	userCacheID int
 	lazyCache   *LazyCache
+	sentRooms   sentRooms
 
 	joinChecker JoinChecker
+	// tops up short timelines from the homeserver, nil if disabled.
+	backfiller TimelineBackfiller
+	// shared by all connections to limit how many initial load chunks run at once, nil for no limit.
+	initialLoadSem *internal.Semaphore
+	// the sticky request this connection had before the proxy restarted, merged into the first
+	// request. nil once applied, or if this is a new connection.
+	resumeReq *sync3.Request
+	// stores muxedReq so this connection can be resumed after a restart, nil if disabled.
+	saver ConnSaver
+	// the last muxedReq given to saver, when, and for which connection. Guarded by savedReqMu, as
+	// Destroy deletes it from another goroutine.
+	savedReqMu  sync.Mutex
+	savedReq    []byte
+	savedReqAt  time.Time
+	savedReqCID sync3.ConnID
+	destroyed   bool
+	clock       internal.Clock
+	// hooks to call when lists change, nil if there are none.
+	hooks *hookRegistry
+	// lookups in the sorted list and lazy member caches made while building the current response,
+	// for the debug extension.
+	cacheStats map[string]extensions.DebugCacheStats
 
 	extensionsHandler   extensions.HandlerInterface
 	setupHistogramVec   *prometheus.HistogramVec
 	processHistogramVec *prometheus.HistogramVec
 }
 
+// ConnStateOptions configures optional behaviour of a ConnState. The zero value is valid and
+// disables all of it.
+type ConnStateOptions struct {
+	// counts the number of times a blocked connection was woken up by a live update, may be nil.
+	WakeupCounter prometheus.Counter
+	// tracks the time between events being committed and a blocked connection waking up, may be nil.
+	DeliveryHist prometheus.Histogram
+	// counts responses which left out rooms or list operations because of MaxRoomsPerResponse,
+	// MaxResponseBytes or MaxListOps, may be nil.
+	TruncatedResponses prometheus.Counter
+	// the most rooms to send in list SYNC operations in one response, 0 for no limit.
+	MaxRoomsPerResponse int
+	// lists to use when the first request on this connection asks for no lists or rooms, or nil.
+	DefaultLists map[string]sync3.RequestList
+	// initial responses with at least this many rooms are sent in phases, 0 to disable.
+	PhasedInitialSyncRooms int
+	// the most bytes of room data to send in one response, 0 for no limit.
+	MaxResponseBytes int
+	// the most list operations from live updates to send in one response, 0 for no limit.
+	MaxListOps int
+	// tops up short timelines from the homeserver, nil to disable.
+	Backfiller TimelineBackfiller
+	// held while loading each chunk of rooms for initial data, shared by all connections so
+	// parallel loads can't use up the database connection pool. nil for no limit.
+	InitialLoadSemaphore *internal.Semaphore
+	// the stored sticky request of a connection being resumed after a restart, or nil.
+	ResumeRequest *sync3.Request
+	// stores the sticky request after each request so the connection can be resumed, nil to disable.
+	Saver ConnSaver
+	// decides when the sticky request is saved again, defaults to the real clock.
+	Clock internal.Clock
+}
+
+// ConnSaver stores the sticky request of a connection, so that the connection can be resumed with the
+// same lists, room subscriptions and extensions if the proxy restarts. Implemented by state.Storage.
+type ConnSaver interface {
+	SaveConnection(userID, deviceID, connID string, request []byte) error
+	DeleteConnection(userID, deviceID, connID string) error
+}
+
+// saveRequestInterval is how often an unchanged sticky request is saved again, so that it isn't
+// treated as belonging to an expired connection.
+const saveRequestInterval = 5 * time.Minute
+
 func NewConnState(
 	userID, deviceID string, userCache *caches.UserCache, globalCache *caches.GlobalCache,
 	ex extensions.HandlerInterface, joinChecker JoinChecker, setupHistVec *prometheus.HistogramVec, histVec *prometheus.HistogramVec,
-	maxPendingEventUpdates int, maxTransactionIDDelay time.Duration,
+	maxPendingEventUpdates int, maxTransactionIDDelay time.Duration, opts ConnStateOptions,
 ) *ConnState {
 	cs := &ConnState{
 		globalCache:         globalCache,
@@ -70,17 +161,31 @@ func NewConnState(
 		deviceID:            deviceID,
 		anchorLoadPosition:  -1,
 		loadPositions:       make(map[string]int64),
+		timelineFilters:     make(map[string]*internal.TimelineFilter),
 		roomSubscriptions:   make(map[string]sync3.RoomSubscription),
 		lists:               sync3.NewInternalRequestLists(),
 		extensionsHandler:   ex,
 		joinChecker:         joinChecker,
 		lazyCache:           NewLazyCache(),
+		sentRooms:           make(sentRooms),
 		setupHistogramVec:   setupHistVec,
 		processHistogramVec: histVec,
+		budget:              newResponseBudget(opts),
+		defaultLists:        opts.DefaultLists,
+		backfiller:          opts.Backfiller,
+		initialLoadSem:      opts.InitialLoadSemaphore,
+		resumeReq:           opts.ResumeRequest,
+		saver:               opts.Saver,
+		clock:               opts.Clock,
+	}
+	if cs.clock == nil {
+		cs.clock = internal.RealClock
 	}
 	cs.live = &connStateLive{
-		ConnState: cs,
-		updates:   make(chan caches.Update, maxPendingEventUpdates),
+		ConnState:     cs,
+		updates:       make(chan caches.Update, maxPendingEventUpdates),
+		wakeupCounter: opts.WakeupCounter,
+		deliveryHist:  opts.DeliveryHist,
 	}
 	cs.txnIDWaiter = NewTxnIDWaiter(
 		userID,
@@ -95,6 +200,13 @@ func NewConnState(
 	return cs
 }
 
+// StickyRequest returns the combined request parameters which apply to this connection, or nil if
+// no request has been processed yet. Safe to call from any goroutine. The returned request must not
+// be modified.
+func (s *ConnState) StickyRequest() *sync3.Request {
+	return s.stickyReq.Load()
+}
+
 // load the initial joined room list, unfiltered and unsorted, and cache up the fields we care about
 // like the room name. We have synchronisation issues here similar to the ConnMap's initial Load.
 // However, unlike the ConnMap, we cannot just say "don't start any v2 poll loops yet". To keep things
@@ -107,7 +219,10 @@ func NewConnState(
 //   - load() bases its current state based on the latest position, which includes processing of these N events.
 //   - post load() we read N events, processing them a 2nd time.
 func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
+	userVersion := s.userCache.Version()
+	dbStart := time.Now()
 	initialLoadPosition, joinedRooms, joinTimings, loadPositions, err := s.globalCache.LoadJoinedRooms(ctx, s.userID)
+	internal.AddRequestContextDBDuration(ctx, time.Since(dbStart))
 	if err != nil {
 		return err
 	}
@@ -124,28 +239,36 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 		urd.JoinTiming = timing
 
 		interestedEventTimestampsByList := make(map[string]uint64, len(req.Lists))
+		interestedEventNIDsByList := make(map[string]int64, len(req.Lists))
 		for listKey, listReq := range req.Lists {
 			interestingActivityTs := metadata.LastMessageTimestamp
+			interestingActivityNID := metadata.LastMessageNID()
 			if len(listReq.BumpEventTypes) > 0 {
 				// Use the global cache to find the timestamp of the latest interesting
 				// event we can see. If there is no such event, fall back to the
 				// LastMessageTimestamp.
 				joinEvent := joinTimings[metadata.RoomID]
 				interestingActivityTs = joinEvent.Timestamp
+				interestingActivityNID = joinEvent.NID
 				for _, eventType := range listReq.BumpEventTypes {
 					timing := metadata.LatestEventsByType[eventType]
 					// we found a later event which we are authorised to see, use it instead
 					if joinEvent.NID < timing.NID && interestingActivityTs < timing.Timestamp {
 						interestingActivityTs = timing.Timestamp
 					}
+					if interestingActivityNID < timing.NID {
+						interestingActivityNID = timing.NID
+					}
 				}
 			}
 			interestedEventTimestampsByList[listKey] = interestingActivityTs
+			interestedEventNIDsByList[listKey] = interestingActivityNID
 		}
 		rooms[i] = sync3.RoomConnMetadata{
 			RoomMetadata:                  *metadata,
 			UserRoomData:                  urd,
 			LastInterestedEventTimestamps: interestedEventTimestampsByList,
+			LastInterestedEventNIDs:       interestedEventNIDsByList,
 		}
 		i++
 	}
@@ -167,11 +290,87 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 		s.lists.SetRoom(r)
 	}
 	s.anchorLoadPosition = initialLoadPosition
+	if v := s.userCache.Version(); v == userVersion && v%2 == 0 {
+		s.listSnapshotPrefix = fmt.Sprintf("%x/%d", roomsFingerprint(loadPositions, joinTimings), v)
+	}
 	return nil
 }
 
+// roomsFingerprint identifies the state of a set of rooms by their latest event NIDs and the NIDs of
+// the user's joins. Room metadata comes from the global cache, which may briefly lag behind the
+// database, so this is only as precise as the metadata returned by LoadJoinedRooms.
+func roomsFingerprint(latestNIDs map[string]int64, joinTimings map[string]internal.EventMetadata) uint64 {
+	// sum the hashes of each room so the result doesn't depend on map iteration order
+	var sum uint64
+	for roomID, joinTiming := range joinTimings {
+		h := fnv.New64a()
+		h.Write([]byte(roomID))
+		binary.Write(h, binary.LittleEndian, latestNIDs[roomID])
+		binary.Write(h, binary.LittleEndian, joinTiming.NID)
+		sum += h.Sum64()
+	}
+	return sum
+}
+
+// assignList is AssignList with DoNotOverwrite, which reuses the sorted rooms calculated by another
+// of this user's connections if both loaded identical room data and requested an identical list.
+func (s *ConnState) assignList(ctx context.Context, listKey string, reqList *sync3.RequestList) (*sync3.FilteredSortableRooms, bool) {
+	if s.lists.Get(listKey) != nil {
+		return s.lists.AssignList(ctx, listKey, reqList.Filters, reqList.SortOrder(), sync3.DoNotOverwrite)
+	}
+	key := s.listSnapshotKey(reqList)
+	if key == "" {
+		return s.lists.AssignList(ctx, listKey, reqList.Filters, reqList.SortOrder(), sync3.DoNotOverwrite)
+	}
+	if roomIDs, ok := s.userCache.ListSnapshot(key); ok && s.hasRooms(roomIDs) {
+		internal.Logf(ctx, "connstate", "list[%v] reusing sorted rooms from another connection", listKey)
+		s.countCacheLookup("sorted_lists", true)
+		return s.lists.AssignSortedList(listKey, reqList.Filters, roomIDs), true
+	}
+	s.countCacheLookup("sorted_lists", false)
+	roomList, overwritten := s.lists.AssignList(ctx, listKey, reqList.Filters, reqList.SortOrder(), sync3.DoNotOverwrite)
+	s.userCache.StoreListSnapshot(key, roomList.RoomIDs())
+	return roomList, overwritten
+}
+
+// listSnapshotKey returns the key to share the sorted rooms of this list with other connections
+// under, or "" if they cannot be shared.
+func (s *ConnState) listSnapshotKey(reqList *sync3.RequestList) string {
+	// unsorted lists are cheap to calculate
+	if s.listSnapshotPrefix == "" || len(reqList.SortOrder()) == 0 {
+		return ""
+	}
+	params, err := json.Marshal(struct {
+		Filters        *sync3.RequestFilters
+		Sort           []string
+		BumpEventTypes []string
+		BumpOn         []string
+	}{reqList.Filters, reqList.SortOrder(), reqList.BumpEventTypes, reqList.BumpOn})
+	if err != nil {
+		return ""
+	}
+	return s.listSnapshotPrefix + "/" + string(params)
+}
+
+func (s *ConnState) hasRooms(roomIDs []string) bool {
+	for _, roomID := range roomIDs {
+		if s.lists.ReadOnlyRoom(roomID) == nil {
+			return false
+		}
+	}
+	return true
+}
+
 // OnIncomingRequest is guaranteed to be called sequentially (it's protected by a mutex in conn.go)
 func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req *sync3.Request, isInitial bool, start time.Time) (*sync3.Response, error) {
+	if s.resumeReq != nil && s.muxedReq == nil {
+		// The client doesn't know the proxy restarted, so this request only has what changed since
+		// its last one. Apply it on top of what the connection had before the restart.
+		resumed, _ := s.resumeReq.ApplyDelta(req)
+		resumed.TxnID = req.TxnID
+		resumed.SetTimeoutMSecs(req.TimeoutMSecs())
+		req = resumed
+	}
 	if s.anchorLoadPosition <= 0 {
 		// load() needs no ctx so drop it
 		_, region := internal.StartSpan(ctx, "load")
@@ -185,7 +384,38 @@ func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req
 	}
 	setupTime := time.Since(start)
 	s.trackSetupDuration(ctx, setupTime, isInitial)
-	return s.onIncomingRequest(ctx, req, isInitial)
+	resp, err := s.onIncomingRequest(ctx, req, isInitial)
+	if err == nil {
+		s.resumeReq = nil
+		s.saveRequest(cid)
+	}
+	return resp, err
+}
+
+// saveRequest stores muxedReq if it has changed since it was last stored, or if it was last stored
+// long enough ago that it may be mistaken for an expired connection. Failures are only logged, as
+// they only stop the connection being resumed after a restart.
+func (s *ConnState) saveRequest(cid sync3.ConnID) {
+	if s.saver == nil || s.muxedReq == nil {
+		return
+	}
+	reqJSON, err := json.Marshal(s.muxedReq)
+	if err != nil {
+		logger.Warn().Err(err).Str("conn", cid.String()).Msg("failed to marshal sticky request")
+		return
+	}
+	s.savedReqMu.Lock()
+	defer s.savedReqMu.Unlock()
+	if s.destroyed || bytes.Equal(reqJSON, s.savedReq) && s.clock.Since(s.savedReqAt) < saveRequestInterval {
+		return
+	}
+	if err = s.saver.SaveConnection(cid.UserID, cid.DeviceID, cid.CID, reqJSON); err != nil {
+		logger.Warn().Err(err).Str("conn", cid.String()).Msg("failed to save sticky request")
+		return
+	}
+	s.savedReq = reqJSON
+	s.savedReqAt = s.clock.Now()
+	s.savedReqCID = cid
 }
 
 // onIncomingRequest is a callback which fires when the client makes a request to the server. Whilst each request may
@@ -193,9 +423,12 @@ func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req
 // additional locking mechanisms.
 func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request, isInitial bool) (*sync3.Response, error) {
 	start := time.Now()
+	s.cacheStats = nil
+	s.applyDefaultLists(req)
 	// ApplyDelta works fine if s.muxedReq is nil
 	var delta *sync3.RequestDelta
 	s.muxedReq, delta = s.muxedReq.ApplyDelta(req)
+	s.stickyReq.Store(s.muxedReq)
 	internal.Logf(reqCtx, "connstate", "new subs=%v unsubs=%v num_lists=%v", len(delta.Subs), len(delta.Unsubs), len(delta.Lists))
 	for key, l := range delta.Lists {
 		listData := ""
@@ -215,13 +448,19 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	// works out which rooms are subscribed to but doesn't pull room data
 	s.buildRoomSubscriptions(reqCtx, builder, delta.Subs, delta.Unsubs)
 	// works out how rooms get moved about but doesn't pull room data
+	s.budget.start()
 	respLists := s.buildListSubscriptions(reqCtx, builder, delta.Lists)
+	// live updates are about to be applied to the lists, so they no longer match other connections.
+	s.listSnapshotPrefix = ""
 
 	// pull room data and set changes on the response
+	s.addPendingFill(reqCtx, builder)
+	builtSubs := s.budget.phase(reqCtx, builder.BuildSubscriptions(), isInitial)
 	response := &sync3.Response{
-		Rooms: s.buildRooms(reqCtx, builder.BuildSubscriptions()), // pull room data
+		Rooms: s.buildRooms(reqCtx, builtSubs), // pull room data
 		Lists: respLists,
 	}
+	s.budget.fitBytes(reqCtx, builtSubs, response)
 
 	// Handle extensions AFTER processing lists as extensions may need to know which rooms the client
 	// is being notified about (e.g. for room account data)
@@ -250,6 +489,17 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	updateCtx, region := internal.StartSpan(reqCtx, "liveUpdate")
 	s.live.liveUpdate(updateCtx, req, s.muxedReq.Extensions, isInitial, response)
 	region.End()
+	// leave out room fields the client already has
+	s.sentRooms.suppressUnchanged(response.Rooms)
+	// and forget rooms which have left every list range and aren't subscribed to
+	visibleRooms := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	s.sentRooms.forget(func(roomID string) bool {
+		if _, visible := visibleRooms[roomID]; visible {
+			return true
+		}
+		_, subscribed := s.roomSubscriptions[roomID]
+		return subscribed
+	})
 
 	// counts are AFTER events are applied, hence after liveUpdate
 	for listKey := range response.Lists {
@@ -257,19 +507,71 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 		l.Count = s.lists.Count(listKey)
 		response.Lists[listKey] = l
 	}
+	response.Pending = s.budget.finish(reqCtx, s.muxedReq.Lists)
+	s.debug.record(s, response)
+	s.hooks.listsChanged(s.userID, s.deviceID, response.Lists)
 
 	// Add membership events for users sending typing notifications. We do this after live update
 	// and initial room loading code so we LL room members in all cases.
 	if response.Extensions.Typing != nil && response.Extensions.Typing.HasData(isInitial) {
 		s.lazyLoadTypingMembers(reqCtx, response)
 	}
+	s.fillDebugExtension(reqCtx, response, start)
 	return response, nil
 }
 
+// countCacheLookup records a hit or miss in the sorted list or lazy member cache, for the debug extension.
+func (s *ConnState) countCacheLookup(cache string, hit bool) {
+	if s.cacheStats == nil {
+		s.cacheStats = make(map[string]extensions.DebugCacheStats)
+	}
+	stats := s.cacheStats[cache]
+	if hit {
+		stats.Hits++
+	} else {
+		stats.Misses++
+	}
+	s.cacheStats[cache] = stats
+}
+
+// fillDebugExtension fills in the debug extension, if the client asked for it, now that the rest of
+// the response has been built.
+func (s *ConnState) fillDebugExtension(ctx context.Context, response *sync3.Response, start time.Time) {
+	debug := response.Extensions.Debug
+	if debug == nil {
+		return
+	}
+	breakdown := internal.RequestContextBreakdown(ctx)
+	debug.ProcessingMSecs = (time.Since(start) - breakdown.Wait).Milliseconds()
+	debug.DBMSecs = breakdown.DB.Milliseconds()
+	debug.SortMSecs = breakdown.Sort.Milliseconds()
+	debug.WaitMSecs = breakdown.Wait.Milliseconds()
+	debug.RoomsConsidered = s.lists.NumRooms()
+	debug.QueueDepth = len(s.live.updates)
+	debug.QueueCapacity = cap(s.live.updates)
+	debug.ConnCaches = s.cacheStats
+}
+
+// applyDefaultLists adds the default lists to the request if it is the first on this connection and
+// asks for neither lists nor room subscriptions, so thin clients can sync with an empty body. Like
+// any other lists they are sticky, so later empty requests keep using them.
+func (s *ConnState) applyDefaultLists(req *sync3.Request) {
+	if len(s.defaultLists) == 0 || s.muxedReq != nil || len(req.Lists) > 0 || len(req.RoomSubscriptions) > 0 {
+		return
+	}
+	req.Lists = make(map[string]sync3.RequestList, len(s.defaultLists))
+	for listKey, list := range s.defaultLists {
+		req.Lists[listKey] = list
+	}
+}
+
 func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBuilder, listKey string, prevReqList, nextReqList *sync3.RequestList) sync3.ResponseList {
 	ctx, span := internal.StartSpan(ctx, "onIncomingListRequest")
 	defer span.End()
-	roomList, overwritten := s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.DoNotOverwrite)
+	sortStart := time.Now()
+	roomList, overwritten := s.assignList(ctx, listKey, nextReqList)
+	internal.AddRequestContextSortDuration(ctx, time.Since(sortStart))
+	pending := s.budget.takeRanges(listKey)
 
 	if nextReqList.ShouldGetAllRooms() {
 		if overwritten || prevReqList.FiltersChanged(nextReqList) {
@@ -327,19 +629,30 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 				})
 			}
 		}
-		if filtersChanged {
-			// we need to re-create the list as the rooms may have completely changed
-			roomList, _ = s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.Overwrite)
-		}
-		// resort as either we changed the sort order or we added/removed a bunch of rooms
-		if err := roomList.Sort(nextReqList.Sort); err != nil {
-			logger.Err(err).Str("key", listKey).Msg("cannot sort list")
-			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		// a list which was created above already has these filters and sort order
+		if !overwritten {
+			sortStart := time.Now()
+			if filtersChanged {
+				// we need to re-create the list as the rooms may have completely changed
+				roomList, _ = s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.SortOrder(), sync3.Overwrite)
+			}
+			// resort as either we changed the sort order or we added/removed a bunch of rooms
+			if err := roomList.Sort(nextReqList.SortOrder()); err != nil {
+				logger.Err(err).Str("key", listKey).Msg("cannot sort list")
+				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			}
+			internal.AddRequestContextSortDuration(ctx, time.Since(sortStart))
 		}
 		addedRanges = nextReqList.Ranges
 		removedRanges = nil
 	}
 
+	// Ranges which didn't fit in previous responses are sent now, if the client still wants them.
+	// Changing the sort order or filters re-SYNCs everything, so they are no longer needed.
+	if len(pending) > 0 && !sortChanged && !filtersChanged {
+		addedRanges = append(addedRanges, pending.Intersect(requestedRanges(nextReqList, roomList))...)
+	}
+
 	// send INVALIDATE for these ranges
 	if len(removedRanges) > 0 {
 		logger.Trace().Interface("range", removedRanges).Msg("INVALIDATEing because ranges were removed")
@@ -356,27 +669,8 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		})
 	}
 
-	// inform the builder about this list
-	subID := builder.AddSubscription(nextReqList.RoomSubscription)
-
 	// send full room data for these ranges
-	for i := range addedRanges {
-		sr := sync3.SliceRanges([][2]int64{addedRanges[i]})
-		subslice := sr.SliceInto(roomList)
-		if len(subslice) == 0 {
-			continue
-		}
-		sortableRooms := subslice[0].(*sync3.SortableRooms)
-		roomIDs := sortableRooms.RoomIDs()
-		// the builder will populate this with the right room data
-		builder.AddRoomsToSubscription(ctx, subID, roomIDs)
-
-		responseOperations = append(responseOperations, &sync3.ResponseOpRange{
-			Operation: sync3.OpSync,
-			Range:     clampSliceRangeToListSize(ctx, addedRanges[i], roomList.Len()),
-			RoomIDs:   roomIDs,
-		})
-	}
+	responseOperations = append(responseOperations, s.syncRanges(ctx, builder, listKey, nextReqList, roomList, addedRanges)...)
 
 	if prevReqList != nil {
 		// If nothing has changed ordering wise in this list (sort/filter) but the timeline limit / req_state has,
@@ -423,20 +717,77 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 	}
 }
 
+// syncRanges returns SYNC operations for the given ranges of the list, adding their rooms to the
+// builder. Ranges which don't fit in this response's budget are sent in the following responses.
+func (s *ConnState) syncRanges(
+	ctx context.Context, builder *RoomsBuilder, listKey string, reqList *sync3.RequestList,
+	roomList *sync3.FilteredSortableRooms, ranges sync3.SliceRanges,
+) (ops []sync3.ResponseOp) {
+	// inform the builder about this list
+	subID := builder.AddSubscription(reqList.RoomSubscription)
+	for _, r := range ranges {
+		if r[0] >= roomList.Len() {
+			continue // nothing to send
+		}
+		r, ok := s.budget.fitRange(listKey, r, roomList.Len())
+		if !ok {
+			continue
+		}
+		sr := sync3.SliceRanges([][2]int64{r})
+		subslice := sr.SliceInto(roomList)
+		if len(subslice) == 0 {
+			continue
+		}
+		sortableRooms := subslice[0].(*sync3.SortableRooms)
+		roomIDs := sortableRooms.RoomIDs()
+		s.budget.spendRooms(len(roomIDs))
+		// the builder will populate this with the right room data
+		builder.AddRoomsToSubscription(ctx, subID, roomIDs)
+
+		ops = append(ops, &sync3.ResponseOpRange{
+			Operation: sync3.OpSync,
+			Range:     clampSliceRangeToListSize(ctx, r, roomList.Len()),
+			RoomIDs:   roomIDs,
+		})
+	}
+	return ops
+}
+
 func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBuilder, listDeltas map[string]sync3.RequestListDelta) map[string]sync3.ResponseList {
 	ctx, span := internal.StartSpan(ctx, "buildListSubscriptions")
 	defer span.End()
 	result := make(map[string]sync3.ResponseList, len(s.muxedReq.Lists))
-	// loop each list and handle each independently
-	for listKey, list := range listDeltas {
+	// loop each list and handle each independently. Lists are handled in a stable order so that,
+	// if the number of rooms per response is capped, every list gets its chunks in turn.
+	listKeys := internal.Keys(listDeltas)
+	sort.Strings(listKeys)
+	for _, listKey := range listKeys {
+		list := listDeltas[listKey]
 		if list.Curr == nil {
 			// they deleted this list
 			logger.Debug().Str("key", listKey).Msg("list deleted")
 			s.lists.DeleteList(listKey)
+			s.budget.takeRanges(listKey)
 			continue
 		}
 		result[listKey] = s.onIncomingListRequest(ctx, builder, listKey, list.Prev, list.Curr)
 	}
+	// Lists which the client didn't resend are unchanged, but may still have chunks which didn't
+	// fit in previous responses.
+	for _, listKey := range s.budget.pendingListKeys() {
+		if _, ok := listDeltas[listKey]; ok {
+			continue
+		}
+		pending := s.budget.takeRanges(listKey)
+		reqList, ok := s.muxedReq.Lists[listKey]
+		roomList := s.lists.Get(listKey)
+		if !ok || roomList == nil {
+			continue
+		}
+		result[listKey] = sync3.ResponseList{
+			Ops: s.syncRanges(ctx, builder, listKey, &reqList, roomList, pending.Intersect(requestedRanges(&reqList, roomList))),
+		}
+	}
 	return result
 }
 
@@ -465,6 +816,29 @@ func (s *ConnState) buildRoomSubscriptions(ctx context.Context, builder *RoomsBu
 	}
 }
 
+// requestedRanges returns the ranges of the list which the client wants, which is every room if
+// the list is SlowGetAllRooms.
+func requestedRanges(reqList *sync3.RequestList, roomList *sync3.FilteredSortableRooms) sync3.SliceRanges {
+	if reqList.ShouldGetAllRooms() {
+		return sync3.SliceRanges{{0, roomList.Len() - 1}}
+	}
+	return reqList.Ranges
+}
+
+// addPendingFill adds rooms which are waiting for their data to be sent to the builder. Rooms which
+// the client is no longer interested in are dropped.
+func (s *ConnState) addPendingFill(ctx context.Context, builder *RoomsBuilder) {
+	if len(s.budget.pendingFill) == 0 {
+		return
+	}
+	visible := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	s.budget.takeFill(ctx, builder, func(roomID string) bool {
+		_, isVisible := visible[roomID]
+		_, isSubscribed := s.roomSubscriptions[roomID]
+		return (isVisible || isSubscribed) && s.joinChecker.IsUserJoined(s.userID, roomID)
+	})
+}
+
 func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscription) map[string]sync3.Room {
 	ctx, span := internal.StartSpan(ctx, "buildRooms")
 	defer span.End()
@@ -552,6 +926,68 @@ func (s *ConnState) lazyLoadTypingMembers(ctx context.Context, response *sync3.R
 	}
 }
 
+// Rooms are loaded in chunks of this size when building the initial data for many rooms. Up to
+// maxParallelInitialLoads chunks are loaded at once per request, each on its own database connection,
+// and no more than ConnStateOptions.InitialLoadSemaphore allows across all requests.
+const (
+	initialLoadChunkSize    = 50
+	maxParallelInitialLoads = 8
+)
+
+// Timelines are backfilled for up to maxParallelBackfills rooms at once per request, and
+// backfilling gives up after backfillTimeout so a slow homeserver can't hold up the response.
+const (
+	maxParallelBackfills = 4
+	backfillTimeout      = 10 * time.Second
+)
+
+// loadInChunks calls load for chunks of roomIDs in parallel, holding the initial load semaphore for
+// each call. Chunks which are still waiting for the semaphore when ctx is done are skipped.
+func (s *ConnState) loadInChunks(ctx context.Context, roomIDs []string, load func(chunkRoomIDs []string)) {
+	internal.ForEachChunk(roomIDs, initialLoadChunkSize, maxParallelInitialLoads, func(chunkRoomIDs []string) {
+		if err := s.initialLoadSem.Acquire(ctx); err != nil {
+			return
+		}
+		defer s.initialLoadSem.Release()
+		load(chunkRoomIDs)
+	})
+}
+
+// backfillTimelines tops up timelines which are shorter than the limit because the proxy hasn't
+// seen enough of the room. Failures are logged, and the stored timeline is sent instead.
+func (s *ConnState) backfillTimelines(ctx context.Context, timelines map[string]state.LatestEvents, userRoomDatas map[string]caches.UserRoomData, limit int) {
+	var roomIDs []string
+	for roomID, latestEvents := range timelines {
+		if len(latestEvents.Timeline) >= limit || latestEvents.PrevBatch == "" || userRoomDatas[roomID].IsInvite {
+			continue
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	if len(roomIDs) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, backfillTimeout)
+	defer cancel()
+	backfilled := make(map[string]state.LatestEvents, len(roomIDs))
+	var mu sync.Mutex
+	internal.ForEachChunk(roomIDs, 1, maxParallelBackfills, func(chunk []string) {
+		for _, roomID := range chunk {
+			latestEvents := timelines[roomID] // not written to until every backfill is done
+			if err := s.backfiller.Backfill(ctx, roomID, &latestEvents, limit); err != nil {
+				logger.Warn().Err(err).Str("user", s.userID).Str("room", roomID).Msg("failed to backfill timeline")
+				continue
+			}
+			mu.Lock()
+			backfilled[roomID] = latestEvents
+			mu.Unlock()
+		}
+	})
+	for roomID, latestEvents := range backfilled {
+		latestEvents.DiscardIgnoredMessages(s.userCache.ShouldIgnore)
+		timelines[roomID] = latestEvents
+	}
+}
+
 func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSubscription, bumpEventTypes []string, roomIDs ...string) map[string]sync3.Room {
 	ctx, span := internal.StartSpan(ctx, "getInitialRoomData")
 	defer span.End()
@@ -565,17 +1001,65 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	// response to this call to assign new load positions for each room.
 	roomMetadatas := s.globalCache.LoadRooms(ctx, roomIDs...)
 	userRoomDatas := s.userCache.LoadRooms(roomIDs...)
-	timelines := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, roomIDs, int(roomSub.TimelineLimit))
+	rsm := roomSub.RequiredStateMap(s.userID)
+	internal.Logf(ctx, "connstate", "getInitialRoomData for %d rooms, RequiredStateMap: %#v", len(roomIDs), rsm)
 
-	// 1. Prepare lazy loading data structures, txn IDs.
+	// Timelines and required state are loaded in chunks of rooms in parallel, as loading them
+	// one room after another is slow for users in thousands of rooms. State is loaded after every
+	// timeline has been loaded and backfilled, as lazy loading needs to know the timeline senders.
+	timelines := make(map[string]state.LatestEvents, len(roomIDs))
+	var resultsMu sync.Mutex
+	dbStart := time.Now()
+	s.loadInChunks(ctx, roomIDs, func(chunkRoomIDs []string) {
+		chunkTimelines := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, chunkRoomIDs, int(roomSub.TimelineLimit), roomSub.TimelineFilter)
+		resultsMu.Lock()
+		defer resultsMu.Unlock()
+		for roomID, latestEvents := range chunkTimelines {
+			timelines[roomID] = latestEvents
+		}
+	})
+	dbDuration := time.Since(dbStart)
+	// Backfilling waits on the homeserver rather than the database, so it doesn't hold the initial
+	// load semaphore and isn't counted as database time.
+	if s.backfiller != nil && roomSub.TimelineFilter.IsEmpty() {
+		s.backfillTimelines(ctx, timelines, userRoomDatas, int(roomSub.TimelineLimit))
+	}
 	roomToUsersInTimeline := make(map[string][]string, len(timelines))
-	roomToTimeline := make(map[string][]json.RawMessage)
 	for roomID, latestEvents := range timelines {
 		senders := make(map[string]struct{})
 		for _, ev := range latestEvents.Timeline {
 			senders[gjson.GetBytes(ev, "sender").Str] = struct{}{}
 		}
 		roomToUsersInTimeline[roomID] = internal.Keys(senders)
+	}
+
+	// Filter out rooms we are only invited to, as we don't need to fetch the state
+	// since we'll be using the invite_state only.
+	loadRoomIDs := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		userRoomData, ok := userRoomDatas[roomID]
+		if !ok || !userRoomData.IsInvite {
+			loadRoomIDs = append(loadRoomIDs, roomID)
+		}
+	}
+	// by reusing the same global load position anchor here, we can be sure that the state returned here
+	// matches the timeline we loaded earlier - the race conditions happen around pubsub updates and not
+	// the events table itself, so whatever position is picked based on this anchor is immutable.
+	roomIDToState := make(map[string][]json.RawMessage)
+	dbStart = time.Now()
+	s.loadInChunks(ctx, loadRoomIDs, func(chunkRoomIDs []string) {
+		chunkState := s.globalCache.LoadRoomState(ctx, chunkRoomIDs, s.anchorLoadPosition, rsm, roomToUsersInTimeline)
+		resultsMu.Lock()
+		defer resultsMu.Unlock()
+		for roomID, stateEvents := range chunkState {
+			roomIDToState[roomID] = stateEvents
+		}
+	})
+	internal.AddRequestContextDBDuration(ctx, dbDuration+time.Since(dbStart))
+
+	// 1. Prepare lazy loading data structures, txn IDs.
+	roomToTimeline := make(map[string][]json.RawMessage)
+	for roomID, latestEvents := range timelines {
 		roomToTimeline[roomID] = latestEvents.Timeline
 		// remember what we just loaded so if we see these events down the live stream we know to ignore them.
 		// This means that requesting a direct room subscription causes the connection to jump ahead to whatever
@@ -585,37 +1069,21 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		// responses such as an updated room.name without the associated m.room.name event (though this will
 		// come through on the next request -> it converges to the right state so it isn't critical).
 		s.loadPositions[roomID] = latestEvents.LatestNID
+		if roomSub.TimelineFilter.IsEmpty() {
+			delete(s.timelineFilters, roomID)
+		} else {
+			s.timelineFilters[roomID] = roomSub.TimelineFilter
+		}
 	}
 	roomToTimeline = s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, roomToTimeline)
 
-	// 2. Load required state events.
-	rsm := roomSub.RequiredStateMap(s.userID)
+	// 2. Remember which members the client has been sent, for lazy loading.
 	if rsm.IsLazyLoading() {
 		for roomID, userIDs := range roomToUsersInTimeline {
 			s.lazyCache.Add(roomID, userIDs...)
 		}
 	}
 
-	internal.Logf(ctx, "connstate", "getInitialRoomData for %d rooms, RequiredStateMap: %#v", len(roomIDs), rsm)
-
-	// Filter out rooms we are only invited to, as we don't need to fetch the state
-	// since we'll be using the invite_state only.
-	loadRoomIDs := make([]string, 0, len(roomIDs))
-	for _, roomID := range roomIDs {
-		userRoomData, ok := userRoomDatas[roomID]
-		if !ok || !userRoomData.IsInvite {
-			loadRoomIDs = append(loadRoomIDs, roomID)
-		}
-	}
-
-	// by reusing the same global load position anchor here, we can be sure that the state returned here
-	// matches the timeline we loaded earlier - the race conditions happen around pubsub updates and not
-	// the events table itself, so whatever position is picked based on this anchor is immutable.
-	roomIDToState := s.globalCache.LoadRoomState(ctx, loadRoomIDs, s.anchorLoadPosition, rsm, roomToUsersInTimeline)
-	if roomIDToState == nil { // e.g no required_state
-		roomIDToState = make(map[string][]json.RawMessage)
-	}
-
 	// 3. Build sync3.Room structs to return to clients.
 	rooms := make(map[string]sync3.Room, len(roomIDs))
 	for _, roomID := range roomIDs {
@@ -672,7 +1140,7 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			}
 		}
 
-		roomName, calculated := internal.CalculateRoomName(metadata, 5) // TODO: customisable?
+		roomName, calculated := s.roomName(metadata)
 		room := sync3.Room{
 			Name:              roomName,
 			AvatarChange:      sync3.NewAvatarChange(internal.CalculateAvatar(metadata, userRoomData.IsDM)),
@@ -683,6 +1151,7 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			InviteState:       inviteState,
 			Initial:           true,
 			IsDM:              userRoomData.IsDM,
+			DMPartner:         sync3.NewDMPartner(metadata, userRoomData.IsDM),
 			JoinedCount:       metadata.JoinCount,
 			InvitedCount:      &metadata.InviteCount,
 			PrevBatch:         timelines[roomID].PrevBatch,
@@ -697,6 +1166,15 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	return rooms
 }
 
+// roomName calculates the name of a room, reusing the name calculated for this connection's room
+// lists if none of the fields the name depends on have changed since.
+func (s *ConnState) roomName(metadata *internal.RoomMetadata) (name string, calculated bool) {
+	if r := s.lists.ReadOnlyRoom(metadata.RoomID); r != nil && r.CalculatedName != "" && r.SameRoomName(metadata) {
+		return r.CalculatedName, r.NameFromHeroes
+	}
+	return internal.CalculateRoomName(metadata, 5) // TODO: customisable?
+}
+
 func (s *ConnState) trackSetupDuration(ctx context.Context, dur time.Duration, isInitial bool) {
 	internal.SetRequestContextSetupDuration(ctx, dur)
 	if s.setupHistogramVec == nil {
@@ -724,6 +1202,17 @@ func (s *ConnState) trackProcessDuration(ctx context.Context, dur time.Duration,
 // Called when the connection is torn down
 func (s *ConnState) Destroy() {
 	s.userCache.Unsubscribe(s.userCacheID)
+	s.savedReqMu.Lock()
+	s.destroyed = true
+	if s.savedReq != nil {
+		// the connection was closed on purpose, so the client must not be able to resume it.
+		cid := s.savedReqCID
+		if err := s.saver.DeleteConnection(cid.UserID, cid.DeviceID, cid.CID); err != nil {
+			logger.Warn().Err(err).Str("conn", cid.String()).Msg("failed to delete saved sticky request")
+		}
+		s.savedReq = nil
+	}
+	s.savedReqMu.Unlock()
 	logger.Debug().Str("user_id", s.userID).Str("device_id", s.deviceID).Msg("cancelling any in-flight requests")
 	if s.cancelLatestReq != nil {
 		s.cancelLatestReq()
@@ -738,6 +1227,24 @@ func (s *ConnState) UserID() string {
 	return s.userID
 }
 
+// isAfterCutoff returns true if this update happened in a room after the user was kicked or banned
+// from it, e.g events, typing or receipts from other users' pollers, so must not be sent to them.
+func isAfterCutoff(up caches.RoomUpdate) bool {
+	urd := up.UserRoomMetadata()
+	if urd == nil || urd.CutoffNID == 0 {
+		return false
+	}
+	switch update := up.(type) {
+	case *caches.RoomEventUpdate:
+		// the kick/ban itself, and anything AlwaysProcess e.g the leave event from OnLeftRoom, still
+		// needs to be sent so the client knows they have been removed.
+		return !update.EventData.AlwaysProcess && update.EventData.NID > urd.CutoffNID
+	case *caches.TypingUpdate, *caches.ReceiptUpdate:
+		return true
+	}
+	return false
+}
+
 func (s *ConnState) OnUpdate(ctx context.Context, up caches.Update) {
 	// will eventually call s.live.onUpdate
 	s.txnIDWaiter.Ingest(up)
@@ -745,6 +1252,10 @@ func (s *ConnState) OnUpdate(ctx context.Context, up caches.Update) {
 
 // Called by the user cache when updates arrive
 func (s *ConnState) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	if isAfterCutoff(up) {
+		internal.Logf(ctx, "connstate", "dropped %s update in room %s after the user was removed", up.Type(), up.RoomID())
+		return
+	}
 	switch update := up.(type) {
 	case *caches.RoomEventUpdate:
 		if !update.EventData.AlwaysProcess && update.EventData.NID == 0 {
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// The number of list operations to remember per connection for debugging.
+const connDebugMaxOps = 50
+
+// ConnDebugList is the state of a single list on a connection.
+type ConnDebugList struct {
+	Ranges sync3.SliceRanges `json:"ranges"`
+	Count  int               `json:"count"`
+	// The room IDs which the client should have in its sliding windows, in order.
+	VisibleRoomIDs []string `json:"visible_room_ids"`
+}
+
+// ConnDebugOp is a list operation which was sent to the client.
+type ConnDebugOp struct {
+	Time time.Time        `json:"time"`
+	List string           `json:"list"`
+	Op   sync3.ResponseOp `json:"op"`
+}
+
+// ConnDebugState is a dump of a connection's internal state, for diagnosing list bugs.
+type ConnDebugState struct {
+	UserID        string                   `json:"user_id"`
+	DeviceID      string                   `json:"device_id"`
+	ConnID        string                   `json:"conn_id"`
+	StickyRequest *sync3.Request           `json:"sticky_request"`
+	Lists         map[string]ConnDebugList `json:"lists"`
+	// Rooms the client has been given via room subscriptions.
+	RoomSubscriptions []string `json:"room_subscriptions"`
+	// The number of rooms with a load position, i.e. rooms this connection knows about.
+	NumLoadedRooms     int   `json:"num_loaded_rooms"`
+	AnchorLoadPosition int64 `json:"anchor_load_position"`
+	// The number of live updates waiting to be processed, and how many can be queued before the
+	// connection is closed.
+	QueueDepth    int `json:"queue_depth"`
+	QueueCapacity int `json:"queue_capacity"`
+	// The most recent list operations sent to the client, oldest first.
+	RecentOps []ConnDebugOp `json:"recent_ops"`
+	// When the connection last finished processing a request.
+	LastRequestTime *time.Time `json:"last_request_time"`
+}
+
+// connDebugTracker holds a copy of a connection's state as of the end of the last request, which
+// is safe to read from other goroutines.
+type connDebugTracker struct {
+	mu                 sync.Mutex
+	lists              map[string]ConnDebugList
+	roomSubscriptions  []string
+	numLoadedRooms     int
+	anchorLoadPosition int64
+	ops                []ConnDebugOp // ring buffer
+	nextOp             int
+	lastRequestTime    *time.Time
+}
+
+// record the state of s after a response has been built. Must be called on the conn goroutine.
+func (t *connDebugTracker) record(s *ConnState, res *sync3.Response) {
+	now := time.Now()
+	lists := make(map[string]ConnDebugList, len(s.muxedReq.Lists))
+	for listKey, reqList := range s.muxedReq.Lists {
+		lists[listKey] = ConnDebugList{
+			Ranges:         reqList.Ranges,
+			Count:          s.lists.Count(listKey),
+			VisibleRoomIDs: visibleRoomIDs(s.lists.Get(listKey), reqList),
+		}
+	}
+	roomSubs := make([]string, 0, len(s.roomSubscriptions))
+	for roomID := range s.roomSubscriptions {
+		roomSubs = append(roomSubs, roomID)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lists = lists
+	t.roomSubscriptions = roomSubs
+	t.numLoadedRooms = len(s.loadPositions)
+	t.anchorLoadPosition = s.anchorLoadPosition
+	t.lastRequestTime = &now
+	for listKey, l := range res.Lists {
+		for _, op := range l.Ops {
+			t.addOp(ConnDebugOp{Time: now, List: listKey, Op: op})
+		}
+	}
+}
+
+// Must hold mu.
+func (t *connDebugTracker) addOp(op ConnDebugOp) {
+	if len(t.ops) < connDebugMaxOps {
+		t.ops = append(t.ops, op)
+		return
+	}
+	t.ops[t.nextOp] = op
+	t.nextOp = (t.nextOp + 1) % connDebugMaxOps
+}
+
+// Must hold mu.
+func (t *connDebugTracker) recentOps() []ConnDebugOp {
+	ops := make([]ConnDebugOp, 0, len(t.ops))
+	ops = append(ops, t.ops[t.nextOp:]...)
+	return append(ops, t.ops[:t.nextOp]...)
+}
+
+func visibleRoomIDs(list *sync3.FilteredSortableRooms, reqList sync3.RequestList) []string {
+	if list == nil || list.SortableRooms == nil {
+		return []string{}
+	}
+	if reqList.SlowGetAllRooms != nil && *reqList.SlowGetAllRooms {
+		return list.RoomIDs()
+	}
+	roomIDs := []string{}
+	for _, subslice := range reqList.Ranges.SliceInto(list.SortableRooms) {
+		roomIDs = append(roomIDs, subslice.(*sync3.SortableRooms).RoomIDs()...)
+	}
+	return roomIDs
+}
+
+// DebugState returns a dump of this connection's state as of the end of the last request. Safe to
+// call from any goroutine.
+func (s *ConnState) DebugState() ConnDebugState {
+	t := &s.debug
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ds := ConnDebugState{
+		UserID:             s.userID,
+		DeviceID:           s.deviceID,
+		StickyRequest:      s.StickyRequest(),
+		Lists:              t.lists,
+		RoomSubscriptions:  t.roomSubscriptions,
+		NumLoadedRooms:     t.numLoadedRooms,
+		AnchorLoadPosition: t.anchorLoadPosition,
+		RecentOps:          t.recentOps(),
+		LastRequestTime:    t.lastRequestTime,
+	}
+	if ds.Lists == nil {
+		ds.Lists = map[string]ConnDebugList{}
+	}
+	if ds.RoomSubscriptions == nil {
+		ds.RoomSubscriptions = []string{}
+	}
+	if s.live != nil {
+		ds.QueueDepth = len(s.live.updates)
+		ds.QueueCapacity = cap(s.live.updates)
+	}
+	return ds
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+func TestConnStateDebugState(t *testing.T) {
+	userID := "@TestConnStateDebugState_alice:localhost"
+	timestampNow := spec.Timestamp(1632131678061).Time()
+	// sort order B, C, A
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(timestampNow.Add(-8*time.Second)))
+	roomB := newRoomMetadata("!b:localhost", spec.AsTimestamp(timestampNow))
+	roomC := newRoomMetadata("!c:localhost", spec.AsTimestamp(timestampNow.Add(-4*time.Second)))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 123, Timestamp: 123},
+				roomB.RoomID: {NID: 456, Timestamp: 456},
+				roomC.RoomID: {NID: 780, Timestamp: 789},
+			}, map[string]int64{
+				roomA.RoomID: 1,
+				roomB.RoomID: 1,
+				roomC.RoomID: 1,
+			}, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, "DEVICE", userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{})
+
+	// nothing has been processed yet
+	ds := cs.DebugState()
+	assertVal(t, ds.StickyRequest, (*sync3.Request)(nil))
+	assertVal(t, ds.Lists, map[string]ConnDebugList{})
+	assertVal(t, len(ds.RecentOps), 0)
+	assertVal(t, ds.QueueCapacity, 1000)
+
+	_, err := cs.OnIncomingRequest(context.Background(), sync3.ConnID{UserID: userID, DeviceID: "DEVICE"}, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges{{0, 1}},
+		}},
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {TimelineLimit: 1},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error: %s", err)
+	}
+	ds = cs.DebugState()
+	assertVal(t, ds.UserID, userID)
+	assertVal(t, ds.DeviceID, "DEVICE")
+	assertVal(t, ds.Lists, map[string]ConnDebugList{
+		"a": {
+			Ranges:         sync3.SliceRanges{{0, 1}},
+			Count:          3,
+			VisibleRoomIDs: []string{roomB.RoomID, roomC.RoomID},
+		},
+	})
+	assertVal(t, ds.RoomSubscriptions, []string{roomA.RoomID})
+	assertVal(t, ds.NumLoadedRooms, 3)
+	assertVal(t, ds.AnchorLoadPosition, int64(1))
+	if ds.LastRequestTime == nil {
+		t.Errorf("LastRequestTime was not set")
+	}
+	if len(ds.RecentOps) != 1 {
+		t.Fatalf("got %d recent ops, want 1: %+v", len(ds.RecentOps), ds.RecentOps)
+	}
+	assertVal(t, ds.RecentOps[0].List, "a")
+	assertVal(t, ds.RecentOps[0].Op, sync3.ResponseOp(&sync3.ResponseOpRange{
+		Operation: sync3.OpSync,
+		Range:     [2]int64{0, 1},
+		RoomIDs:   []string{roomB.RoomID, roomC.RoomID},
+	}))
+	// must be serialisable for the admin API
+	if _, err := json.Marshal(ds); err != nil {
+		t.Fatalf("failed to marshal debug state: %s", err)
+	}
+}
+
+func TestConnDebugTrackerKeepsLastOps(t *testing.T) {
+	var tracker connDebugTracker
+	total := connDebugMaxOps + 7
+	for i := 0; i < total; i++ {
+		tracker.addOp(ConnDebugOp{
+			List: "a",
+			Op:   &sync3.ResponseOpSingle{Operation: sync3.OpInvalidate, RoomID: string(rune('a' + i%26))},
+		})
+	}
+	ops := tracker.recentOps()
+	if len(ops) != connDebugMaxOps {
+		t.Fatalf("got %d ops, want %d", len(ops), connDebugMaxOps)
+	}
+	// oldest first, and the first 7 were evicted
+	for i, op := range ops {
+		want := string(rune('a' + (i+7)%26))
+		if got := op.Op.(*sync3.ResponseOpSingle).RoomID; got != want {
+			t.Fatalf("op %d: got %s want %s", i, got, want)
+		}
+	}
+}
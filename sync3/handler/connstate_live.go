@@ -9,6 +9,8 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
 )
 
 // the amount of time to try to insert into a full buffer before giving up.
@@ -25,6 +27,10 @@ type connStateLive struct {
 	// saying the client is dead and clean up the conn.
 	updates    chan caches.Update
 	bufferFull bool
+
+	// metrics, may be nil
+	wakeupCounter prometheus.Counter
+	deliveryHist  prometheus.Histogram
 }
 
 // Called when there is an update from the user cache. This callback fires when the server gets a new event and determines this connection MAY be
@@ -62,7 +68,7 @@ func (s *connStateLive) liveUpdate(
 	startTime := time.Now()
 	hasLiveStreamed := false
 	numProcessedUpdates := 0
-	for response.ListOps() == 0 && len(response.Rooms) == 0 && !response.Extensions.HasData(isInitial) {
+	for response.ListOps() == 0 && len(response.Rooms) == 0 && !response.Extensions.HasData(isInitial) && len(s.budget.throttledLists) == 0 {
 		hasLiveStreamed = true
 		timeToWait := time.Duration(req.TimeoutMSecs()) * time.Millisecond
 		timeWaited := time.Since(startTime)
@@ -72,16 +78,21 @@ func (s *connStateLive) liveUpdate(
 			return
 		}
 		log.Trace().Str("dur", timeLeftToWait.String()).Msg("liveUpdate: no response data yet; blocking")
+		waitStart := time.Now()
 		select {
 		case <-ctx.Done(): // client has given up
+			internal.AddRequestContextWaitDuration(ctx, time.Since(waitStart))
 			log.Trace().Msg("liveUpdate: client gave up, or we killed the connection")
 			internal.Logf(ctx, "liveUpdate", "context cancelled")
 			return
 		case <-time.After(timeLeftToWait): // we've timed out
+			internal.AddRequestContextWaitDuration(ctx, time.Since(waitStart))
 			log.Trace().Msg("liveUpdate: timed out")
 			internal.Logf(ctx, "liveUpdate", "timed out after %v", timeLeftToWait)
 			return
 		case update := <-s.updates:
+			internal.AddRequestContextWaitDuration(ctx, time.Since(waitStart))
+			s.trackWakeup(update)
 			s.processUpdate(ctx, update, response, ex)
 			numProcessedUpdates++
 			// if there's more updates and we don't have lots stacked up already, go ahead and process another
@@ -114,9 +125,24 @@ func (s *connStateLive) liveUpdate(
 	// TODO: op consolidation
 }
 
+// trackWakeup records that this connection was woken up from blocking by this update.
+func (s *connStateLive) trackWakeup(update caches.Update) {
+	if s.wakeupCounter != nil {
+		s.wakeupCounter.Inc()
+	}
+	if s.deliveryHist == nil {
+		return
+	}
+	if up, ok := update.(*caches.RoomEventUpdate); ok && !up.EventData.CommittedAt.IsZero() {
+		s.deliveryHist.Observe(time.Since(up.EventData.CommittedAt).Seconds())
+	}
+}
+
 func (s *connStateLive) processUpdate(ctx context.Context, update caches.Update, response *sync3.Response, ex extensions.Request) {
 	internal.Logf(ctx, "liveUpdate", "process live update %s", update.Type())
+	opsBefore := s.budget.listOpCounts(response)
 	s.processLiveUpdate(ctx, update, response)
+	s.budget.limitListOps(response, opsBefore)
 	// pass event to extensions AFTER processing
 	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
 	s.extensionsHandler.HandleLiveUpdate(ctx, update, ex, &response.Extensions, extensions.Context{
@@ -221,7 +247,11 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 		r.HighlightCount = int64(userRoomData.HighlightCount)
 		r.NotificationCount = int64(userRoomData.NotificationCount)
 		if roomEventUpdate != nil && roomEventUpdate.EventData.Event != nil {
-			r.NumLive++
+			// events which don't pass the room's timeline filter still advance the load position
+			included := s.timelineFilters[roomEventUpdate.RoomID()].Include(roomEventUpdate.EventData.EventType)
+			if included {
+				r.NumLive++
+			}
 			advancedPastEvent := false
 			if !roomEventUpdate.EventData.AlwaysProcess {
 				if roomEventUpdate.EventData.NID <= s.loadPositions[roomEventUpdate.RoomID()] {
@@ -235,7 +265,7 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			// - next request bumps a room from outside to inside the window
 			// - the initial:true room from BuildSubscriptions contains the latest live events in the timeline as it's pulled from the DB
 			// - we then process the live events in turn which adds them again.
-			if !advancedPastEvent {
+			if !advancedPastEvent && included {
 				roomIDtoTimeline := s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, map[string][]json.RawMessage{
 					roomEventUpdate.RoomID(): {roomEventUpdate.EventData.Event},
 				})
@@ -249,6 +279,9 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 				r.Timeline = append(r.Timeline, roomIDtoTimeline[roomEventUpdate.RoomID()]...)
 				roomID := roomEventUpdate.RoomID()
 				sender := roomEventUpdate.EventData.Sender
+				if s.lazyCache.IsLazyLoading(roomID) {
+					s.countCacheLookup("lazy_members", s.lazyCache.IsSet(roomID, sender))
+				}
 				if s.lazyCache.IsLazyLoading(roomID) && !s.lazyCache.IsSet(roomID, sender) {
 					// load the state event
 					_, span := internal.StartSpan(ctx, "LazyLoadingMemberEvent")
@@ -273,7 +306,7 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			if delta.RoomNameChanged {
 				metadata := roomUpdate.GlobalRoomMetadata()
 				metadata.RemoveHero(s.userID)
-				roomName, calculated := internal.CalculateRoomName(metadata, 5) // TODO: customisable?
+				roomName, calculated := s.roomName(metadata)
 
 				thisRoom.Name = roomName
 
@@ -286,6 +319,12 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 				metadata.RemoveHero(s.userID)
 				thisRoom.AvatarChange = sync3.NewAvatarChange(internal.CalculateAvatar(metadata, roomUpdate.UserRoomMetadata().IsDM))
 			}
+			if (delta.RoomNameChanged || delta.RoomAvatarChanged) && roomUpdate.UserRoomMetadata().IsDM {
+				// the other user's name or avatar may have changed
+				metadata := roomUpdate.GlobalRoomMetadata()
+				metadata.RemoveHero(s.userID)
+				thisRoom.DMPartner = sync3.NewDMPartner(metadata, true)
+			}
 			if delta.InviteCountChanged {
 				thisRoom.InvitedCount = &roomUpdate.GlobalRoomMetadata().InviteCount
 			}
@@ -294,6 +333,21 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			}
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
+		if delta.IsDMChanged && roomUpdate.UserRoomMetadata().IsDM {
+			// is_dm is omitted when false, so we can only tell the client when a room becomes a DM
+			if !exists {
+				thisRoom = sync3.Room{}
+			}
+			thisRoom.IsDM = true
+			metadata := roomUpdate.GlobalRoomMetadata()
+			metadata.RemoveHero(s.userID)
+			if delta.RoomAvatarChanged {
+				thisRoom.AvatarChange = sync3.NewAvatarChange(internal.CalculateAvatar(metadata, true))
+			}
+			thisRoom.DMPartner = sync3.NewDMPartner(metadata, true)
+			exists = true
+			response.Rooms[roomUpdate.RoomID()] = thisRoom
+		}
 		if delta.HighlightCountChanged || delta.NotificationCountChanged {
 			if !exists {
 				// we need to make this room exist. Other deltas are caused by events so the room exists,
@@ -336,13 +390,22 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 	roomEventUpdate, isRoomEventUpdate := up.(*caches.RoomEventUpdate)
 
 	bumpTimestampInList := make(map[string]uint64, len(s.muxedReq.Lists))
+	bumpNIDInList := make(map[string]int64, len(s.muxedReq.Lists))
 	rup, isRoomUpdate := up.(caches.RoomUpdate)
 	if isRoomUpdate {
 		updateTimestamp := rup.GlobalRoomMetadata().LastMessageTimestamp
+		updateNID := rup.GlobalRoomMetadata().LastMessageNID()
+		activity := bumpActivity(up)
 		for listKey, list := range s.muxedReq.Lists {
-			if len(list.BumpEventTypes) == 0 {
+			if activity != "" && list.BumpsOn(activity) {
+				// This activity has no event of its own, so treat it as the latest thing to
+				// happen on this connection.
+				bumpTimestampInList[listKey] = uint64(time.Now().UnixMilli())
+				bumpNIDInList[listKey] = s.anchorLoadPosition
+			} else if len(list.BumpEventTypes) == 0 {
 				// If this list hasn't provided BumpEventTypes, bump the room list for all room updates.
 				bumpTimestampInList[listKey] = updateTimestamp
+				bumpNIDInList[listKey] = updateNID
 			} else if isRoomEventUpdate {
 				// If BumpEventTypes are provided, only bump the room if we see an event
 				// matching one of the bump types. We don't consult rup.JoinTiming here,
@@ -351,6 +414,7 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 				for _, eventType := range list.BumpEventTypes {
 					if eventType == roomEventUpdate.EventData.EventType {
 						bumpTimestampInList[listKey] = updateTimestamp
+						bumpNIDInList[listKey] = roomEventUpdate.EventData.NID
 						break
 					}
 				}
@@ -359,17 +423,14 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 
 		metadata := rup.GlobalRoomMetadata().DeepCopy()
 		metadata.RemoveHero(s.userID)
-		// TODO: if we change a room from being a DM to not being a DM, we should call
-		// SetRoom and recalculate avatars. To do that we'd need to
-		//  - listen to m.direct global account data events
-		//   - compute the symmetric difference between old and new
-		//   - call SetRooms for each room in the difference.
-		// I'm assuming this happens so rarely that we can ignore this for now. PRs
-		// welcome if you a strong opinion to the contrary.
+		// Changes to m.direct arrive as a DMStatusUpdate for each affected room, so SetRoom
+		// recalculates avatars and moves the room in and out of is_dm-filtered lists. Likewise
+		// changes to the manual room order arrive as a RoomOrderUpdate, resorting by_manual lists.
 		delta = s.lists.SetRoom(sync3.RoomConnMetadata{
 			RoomMetadata:                  *metadata,
 			UserRoomData:                  *rup.UserRoomMetadata(),
 			LastInterestedEventTimestamps: bumpTimestampInList,
+			LastInterestedEventNIDs:       bumpNIDInList,
 		})
 	}
 
@@ -380,6 +441,24 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 	return
 }
 
+// bumpActivity returns the kind of activity in this update which lists can choose to be bumped by,
+// or "" if there is none.
+func bumpActivity(up caches.Update) string {
+	switch update := up.(type) {
+	case *caches.ReceiptUpdate:
+		return sync3.BumpOnReceipts
+	case *caches.TypingUpdate:
+		// only count people starting to type, not everyone stopping
+		typingEvent := update.GlobalRoomMetadata().TypingEvent
+		if len(gjson.GetBytes(typingEvent, "content.user_ids").Array()) > 0 {
+			return sync3.BumpOnTyping
+		}
+	case *caches.RoomAccountDataUpdate:
+		return sync3.BumpOnAccountData
+	}
+	return ""
+}
+
 func (s *connStateLive) processLiveUpdateForList(
 	ctx context.Context, builder *RoomsBuilder, up caches.Update, listOp sync3.ListOp,
 	reqList *sync3.RequestList, intList *sync3.FilteredSortableRooms, resList *sync3.ResponseList,
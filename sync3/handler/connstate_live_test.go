@@ -3,9 +3,13 @@ package handler
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func Test_connStateLive_shouldIncludeHeroes(t *testing.T) {
@@ -88,3 +92,40 @@ func Test_connStateLive_shouldIncludeHeroes(t *testing.T) {
 		})
 	}
 }
+
+func TestConnStateLiveTrackWakeup(t *testing.T) {
+	wakeups := prometheus.NewCounter(prometheus.CounterOpts{Name: "wakeups"})
+	delivery := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "delivery"})
+	s := &connStateLive{
+		wakeupCounter: wakeups,
+		deliveryHist:  delivery,
+	}
+	// events with a commit time are tracked
+	s.trackWakeup(&caches.RoomEventUpdate{
+		EventData: &caches.EventData{CommittedAt: time.Now().Add(-2 * time.Second)},
+	})
+	// events without one, and other updates, only count as wakeups
+	s.trackWakeup(&caches.RoomEventUpdate{EventData: &caches.EventData{}})
+	s.trackWakeup(&caches.TypingUpdate{})
+
+	var m dto.Metric
+	if err := wakeups.Write(&m); err != nil {
+		t.Fatalf("failed to read counter: %s", err)
+	}
+	if got := m.GetCounter().GetValue(); got != 3 {
+		t.Errorf("got %v wakeups, want 3", got)
+	}
+	if err := delivery.Write(&m); err != nil {
+		t.Fatalf("failed to read histogram: %s", err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("got %d delivery samples, want 1", got)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got < 2 {
+		t.Errorf("got delivery time %vs, want at least 2s", got)
+	}
+
+	// nil metrics are fine
+	s = &connStateLive{}
+	s.trackWakeup(&caches.TypingUpdate{})
+}
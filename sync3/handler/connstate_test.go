@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,6 +18,9 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tidwall/gjson"
 )
 
 type joinChecker struct{}
@@ -38,7 +43,7 @@ type NopUserCacheStore struct{}
 func (s *NopUserCacheStore) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string) {
 	return
 }
-func (s *NopUserCacheStore) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error) {
+func (s *NopUserCacheStore) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int, filter *internal.TimelineFilter) (map[string]*state.LatestEvents, error) {
 	return nil, nil
 }
 
@@ -71,6 +76,91 @@ func mockLazyRoomOverride(loadPos int64, roomIDs []string, maxTimelineEvents int
 	return result
 }
 
+// the last message timestamp of the most recent room in a testConnFixture
+const testConnTimestamp = spec.Timestamp(1632131678061)
+
+// testConnRoomID is the ID of the i'th most recent room in a testConnFixture.
+func testConnRoomID(i int) string {
+	return fmt.Sprintf("!%d:localhost", i)
+}
+
+type testConnStateOpts struct {
+	// the number of rooms the user is joined to, see testConnRoomID.
+	numRooms int
+	// loads timelines for the user cache, defaults to mockLazyRoomOverride.
+	lazyLoadTimelines func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents
+	// handles extensions for new connections, defaults to NopExtensionHandler.
+	extensions extensions.HandlerInterface
+	connState  ConnStateOptions
+}
+
+// testConnFixture is a user joined to some rooms, with the caches needed to make connections for them.
+type testConnFixture struct {
+	userID      string
+	rooms       []internal.RoomMetadata // most recent first
+	roomIDs     []string
+	globalCache *caches.GlobalCache
+	userCache   *caches.UserCache
+	dispatcher  *sync3.Dispatcher
+	opts        testConnStateOpts
+}
+
+func newTestConnFixture(t *testing.T, opts testConnStateOpts) *testConnFixture {
+	f := &testConnFixture{
+		userID:      "@" + t.Name() + "_alice:localhost",
+		globalCache: caches.NewGlobalCache(nil),
+		dispatcher:  sync3.NewDispatcher(),
+		opts:        opts,
+	}
+	metadata := make(map[string]internal.RoomMetadata, opts.numRooms)
+	roomToJoinedUsers := make(map[string][]string, opts.numRooms)
+	for i := 0; i < opts.numRooms; i++ {
+		room := newRoomMetadata(testConnRoomID(i), testConnTimestamp-spec.Timestamp(i*1000))
+		room.NameEvent = fmt.Sprintf("Room %d", i)
+		f.rooms = append(f.rooms, room)
+		f.roomIDs = append(f.roomIDs, room.RoomID)
+		metadata[room.RoomID] = room
+		roomToJoinedUsers[room.RoomID] = []string{f.userID}
+	}
+	f.globalCache.Startup(metadata)
+	f.dispatcher.Startup(roomToJoinedUsers)
+	f.globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata, len(f.rooms))
+		joinTimings = make(map[string]internal.EventMetadata, len(f.rooms))
+		loadPositions = make(map[string]int64, len(f.rooms))
+		for i := range f.rooms {
+			room := f.rooms[i]
+			joinedRooms[room.RoomID] = &room
+			joinTimings[room.RoomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+			loadPositions[room.RoomID] = 1
+		}
+		return 1, joinedRooms, joinTimings, loadPositions, nil
+	}
+	f.userCache = caches.NewUserCache(f.userID, f.globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	f.userCache.LazyLoadTimelinesOverride = opts.lazyLoadTimelines
+	if f.userCache.LazyLoadTimelinesOverride == nil {
+		f.userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	}
+	f.dispatcher.Register(context.Background(), f.userCache.UserID, f.userCache)
+	f.dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, f.globalCache)
+	return f
+}
+
+// newConnState makes a new connection for the fixture's user.
+func (f *testConnFixture) newConnState(deviceID string) *ConnState {
+	ex := f.opts.extensions
+	if ex == nil {
+		ex = &NopExtensionHandler{}
+	}
+	return NewConnState(f.userID, deviceID, f.userCache, f.globalCache, ex, &NopJoinTracker{}, nil, nil, 1000, 0, f.opts.connState)
+}
+
+// newTestConnState makes a user joined to opts.numRooms rooms, and a connection for them.
+func newTestConnState(t *testing.T, opts testConnStateOpts) (*ConnState, *testConnFixture) {
+	f := newTestConnFixture(t, opts)
+	return f.newConnState("yep"), f
+}
+
 // Sync an account with 3 rooms and check that we can grab all rooms and they are sorted correctly initially. Checks
 // that basic UPDATE and DELETE/INSERT works when tracking all rooms.
 func TestConnStateInitial(t *testing.T) {
@@ -124,7 +214,7 @@ func TestConnStateInitial(t *testing.T) {
 		}
 		return result
 	}
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{})
 	if userID != cs.UserID() {
 		t.Fatalf("UserID returned wrong value, got %v want %v", cs.UserID(), userID)
 	}
@@ -175,7 +265,7 @@ func TestConnStateInitial(t *testing.T) {
 
 	// bump A to the top
 	newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(timestampNow.Add(1*time.Second)))
-	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, newEvent, 1)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, internal.NewEvent(newEvent), 1)
 
 	// request again for the diff
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
@@ -215,7 +305,7 @@ func TestConnStateInitial(t *testing.T) {
 
 	// another message should just update
 	newEvent = testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(timestampNow.Add(2*time.Second)))
-	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, newEvent, 2)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, internal.NewEvent(newEvent), 2)
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
 			Sort: []string{sync3.SortByRecency},
@@ -241,6 +331,487 @@ func TestConnStateInitial(t *testing.T) {
 	})
 }
 
+// Test that list ranges covering more than maxRoomsPerResponse rooms are sent over several responses.
+func TestConnStateMaxRoomsPerResponse(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMaxRoomsPerResponse_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061)
+	var rooms []*internal.RoomMetadata
+	var roomIDs []string
+	globalCache := caches.NewGlobalCache(nil)
+	dispatcher := sync3.NewDispatcher()
+	roomToJoinedUsers := make(map[string][]string)
+	for i := int64(0); i < 10; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		room := internal.RoomMetadata{
+			RoomID:    roomID,
+			NameEvent: fmt.Sprintf("Room %d", i),
+			// room 0 is most recent, 9 is least recent
+			LastMessageTimestamp: uint64(uint64(timestampNow) - uint64(i*1000)),
+		}
+		rooms = append(rooms, &room)
+		roomIDs = append(roomIDs, roomID)
+		globalCache.Startup(map[string]internal.RoomMetadata{
+			room.RoomID: room,
+		})
+		roomToJoinedUsers[roomID] = []string{userID}
+	}
+	dispatcher.Startup(roomToJoinedUsers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		roomMetadata := make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i, r := range rooms {
+			roomMetadata[r.RoomID] = rooms[i]
+			joinTimings[r.RoomID] = internal.EventMetadata{
+				NID:       123456, // Dummy values
+				Timestamp: 123456,
+			}
+		}
+		return 1, roomMetadata, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	truncated := prometheus.NewCounter(prometheus.CounterOpts{Name: "truncated"})
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{TruncatedResponses: truncated, MaxRoomsPerResponse: 4})
+
+	request := func(ranges sync3.SliceRanges) *sync3.Response {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: ranges,
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+	syncOp := func(start, end int64) *sync3.Response {
+		return &sync3.Response{
+			Lists: map[string]sync3.ResponseList{
+				"a": {
+					Count: len(rooms),
+					Ops: []sync3.ResponseOp{
+						&sync3.ResponseOpRange{
+							Operation: "SYNC",
+							Range:     [2]int64{start, end},
+							RoomIDs:   roomIDs[start : end+1],
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// the first response only includes the first 4 rooms
+	res := request(sync3.SliceRanges{{0, 9}})
+	checkResponse(t, true, res, syncOp(0, 3))
+	if len(res.Rooms) != 4 {
+		t.Errorf("got %d rooms want 4", len(res.Rooms))
+	}
+	// the next responses continue where the last left off
+	res = request(sync3.SliceRanges{{0, 9}})
+	checkResponse(t, true, res, syncOp(4, 7))
+	// ranges which are no longer requested are not sent
+	res = request(sync3.SliceRanges{{0, 8}})
+	want := syncOp(8, 8)
+	want.Lists["a"] = sync3.ResponseList{
+		Count: len(rooms),
+		Ops: append([]sync3.ResponseOp{
+			&sync3.ResponseOpRange{Operation: "INVALIDATE", Range: [2]int64{9, 9}},
+		}, want.Lists["a"].Ops...),
+	}
+	checkResponse(t, true, res, want)
+	if len(cs.budget.pendingRanges) != 0 {
+		t.Errorf("got pending ranges %v, want none", cs.budget.pendingRanges)
+	}
+	var m dto.Metric
+	truncated.Write(&m)
+	if got := m.GetCounter().GetValue(); got != 2 {
+		t.Errorf("got %v truncated responses, want 2", got)
+	}
+
+	// changing the sort order re-SYNCs the whole window in chunks, which continue to be sent if the
+	// client relies on the list being sticky and leaves it out of the following requests.
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByName},
+			Ranges: sync3.SliceRanges{{0, 9}},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if len(res.Rooms) != 4 {
+		t.Errorf("got %d rooms want 4", len(res.Rooms))
+	}
+	for _, chunk := range [][2]int64{{4, 7}, {8, 9}} {
+		res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		checkResponse(t, true, res, syncOp(chunk[0], chunk[1]))
+	}
+	if len(cs.budget.pendingRanges) != 0 {
+		t.Errorf("got pending ranges %v, want none", cs.budget.pendingRanges)
+	}
+}
+
+func TestConnStatePhasedInitialSync(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStatePhasedInitialSync_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061)
+	var rooms []*internal.RoomMetadata
+	var roomIDs []string
+	globalCache := caches.NewGlobalCache(nil)
+	dispatcher := sync3.NewDispatcher()
+	roomToJoinedUsers := make(map[string][]string)
+	for i := int64(0); i < 10; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		room := internal.RoomMetadata{
+			RoomID:               roomID,
+			NameEvent:            fmt.Sprintf("Room %d", i),
+			LastMessageTimestamp: uint64(uint64(timestampNow) - uint64(i*1000)),
+		}
+		rooms = append(rooms, &room)
+		roomIDs = append(roomIDs, roomID)
+		globalCache.Startup(map[string]internal.RoomMetadata{
+			room.RoomID: room,
+		})
+		roomToJoinedUsers[roomID] = []string{userID}
+	}
+	dispatcher.Startup(roomToJoinedUsers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		roomMetadata := make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i, r := range rooms {
+			roomMetadata[r.RoomID] = rooms[i]
+			joinTimings[r.RoomID] = internal.EventMetadata{
+				NID:       123456, // Dummy values
+				Timestamp: 123456,
+			}
+		}
+		return 1, roomMetadata, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		result := make(map[string]state.LatestEvents)
+		for _, roomID := range roomIDs {
+			var timeline []json.RawMessage
+			if maxTimelineEvents > 0 {
+				timeline = []json.RawMessage{[]byte(`{}`)}
+			}
+			result[roomID] = state.LatestEvents{Timeline: timeline}
+		}
+		return result
+	}
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{PhasedInitialSyncRooms: 4})
+
+	request := func(isInitial bool) *sync3.Response {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges{{0, 9}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			}},
+		}, isInitial, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+	assertRooms := func(res *sync3.Response, wantRoomIDs []string, wantTimelines bool) {
+		t.Helper()
+		if len(res.Rooms) != len(wantRoomIDs) {
+			t.Fatalf("got %d rooms want %d", len(res.Rooms), len(wantRoomIDs))
+		}
+		for _, roomID := range wantRoomIDs {
+			room, ok := res.Rooms[roomID]
+			if !ok {
+				t.Fatalf("missing room %s", roomID)
+			}
+			if gotTimeline := len(room.Timeline) > 0; gotTimeline != wantTimelines {
+				t.Errorf("room %s: got timeline %v want %v", roomID, gotTimeline, wantTimelines)
+			}
+			if !room.Initial {
+				t.Errorf("room %s: not initial", roomID)
+			}
+		}
+	}
+
+	// the first response has every room, named, but no timelines
+	res := request(true)
+	assertRooms(res, roomIDs, false)
+	if !res.Pending {
+		t.Errorf("first response is not pending")
+	}
+	if res.Rooms[roomIDs[0]].Name != "Room 0" {
+		t.Errorf("got name %q want Room 0", res.Rooms[roomIDs[0]].Name)
+	}
+	// then timelines are filled in 4 rooms at a time
+	filled := make(map[string]bool)
+	for _, want := range []int{4, 4, 2} {
+		res = request(false)
+		if len(res.Rooms) != want {
+			t.Fatalf("got %d filled rooms want %d", len(res.Rooms), want)
+		}
+		for roomID, room := range res.Rooms {
+			if len(room.Timeline) == 0 {
+				t.Errorf("room %s: no timeline", roomID)
+			}
+			filled[roomID] = true
+		}
+		if wantPending := len(filled) < len(roomIDs); res.Pending != wantPending {
+			t.Errorf("got pending %v want %v", res.Pending, wantPending)
+		}
+	}
+	if len(filled) != len(roomIDs) {
+		t.Errorf("filled %d rooms want %d", len(filled), len(roomIDs))
+	}
+	if len(cs.budget.pendingFill) != 0 {
+		t.Errorf("got pending fill %v, want none", cs.budget.pendingFill)
+	}
+}
+
+// Test that rooms which don't fit in maxResponseBytes are sent in the following responses, with
+// each response marked as pending until everything has been sent.
+func TestConnStateMaxResponseBytes(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMaxResponseBytes_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061)
+	var rooms []*internal.RoomMetadata
+	var roomIDs []string
+	globalCache := caches.NewGlobalCache(nil)
+	dispatcher := sync3.NewDispatcher()
+	roomToJoinedUsers := make(map[string][]string)
+	for i := int64(0); i < 10; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		room := internal.RoomMetadata{
+			RoomID:               roomID,
+			NameEvent:            fmt.Sprintf("Room %d", i),
+			LastMessageTimestamp: uint64(uint64(timestampNow) - uint64(i*1000)),
+		}
+		rooms = append(rooms, &room)
+		roomIDs = append(roomIDs, roomID)
+		globalCache.Startup(map[string]internal.RoomMetadata{
+			room.RoomID: room,
+		})
+		roomToJoinedUsers[roomID] = []string{userID}
+	}
+	dispatcher.Startup(roomToJoinedUsers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		roomMetadata := make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		for i, r := range rooms {
+			roomMetadata[r.RoomID] = rooms[i]
+			joinTimings[r.RoomID] = internal.EventMetadata{
+				NID:       123456, // Dummy values
+				Timestamp: 123456,
+			}
+		}
+		return 1, roomMetadata, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		result := make(map[string]state.LatestEvents)
+		for _, roomID := range roomIDs {
+			var timeline []json.RawMessage
+			if maxTimelineEvents > 0 {
+				timeline = []json.RawMessage{[]byte(`{}`)}
+			}
+			result[roomID] = state.LatestEvents{Timeline: timeline}
+		}
+		return result
+	}
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	// every room is the same size, so allow 3 of them per response
+	var invitedCount int
+	maxResponseBytes := 3 * sync3.Room{
+		Name:         "Room 0",
+		Timeline:     []json.RawMessage{[]byte(`{}`)},
+		Initial:      true,
+		AvatarChange: sync3.DeletedAvatar,
+		InvitedCount: &invitedCount,
+		Timestamp:    uint64(timestampNow),
+	}.EncodedSize()
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{MaxResponseBytes: maxResponseBytes})
+
+	got := make(map[string]bool)
+	for i, want := range []int{3, 3, 3, 1} {
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges{{0, 9}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			}},
+		}, i == 0, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		if len(res.Rooms) != want {
+			t.Fatalf("response %d: got %d rooms want %d", i, len(res.Rooms), want)
+		}
+		// list operations only refer to rooms which are in the response
+		var syncedRoomIDs []string
+		for _, op := range res.Lists["a"].Ops {
+			if op, ok := op.(*sync3.ResponseOpRange); ok && op.Operation == sync3.OpSync {
+				syncedRoomIDs = append(syncedRoomIDs, op.RoomIDs...)
+			}
+		}
+		if len(syncedRoomIDs) != want {
+			t.Errorf("response %d: got %d SYNCed rooms want %d", i, len(syncedRoomIDs), want)
+		}
+		for _, roomID := range syncedRoomIDs {
+			if _, ok := res.Rooms[roomID]; !ok {
+				t.Errorf("response %d: SYNCed room %s is not in the response", i, roomID)
+			}
+		}
+		for roomID, room := range res.Rooms {
+			if got[roomID] {
+				t.Errorf("response %d: room %s sent twice", i, roomID)
+			}
+			if len(room.Timeline) == 0 {
+				t.Errorf("response %d: room %s has no timeline", i, roomID)
+			}
+			got[roomID] = true
+		}
+		if wantPending := i < 3; res.Pending != wantPending {
+			t.Errorf("response %d: got pending %v want %v", i, res.Pending, wantPending)
+		}
+	}
+	if len(got) != len(roomIDs) {
+		t.Errorf("got %d rooms want %d", len(got), len(roomIDs))
+	}
+}
+
+// Test that connections for the same user which load identical rooms share sorted lists.
+func TestConnStateSharesSortedLists(t *testing.T) {
+	userID := "@TestConnStateSharesSortedLists_alice:localhost"
+	timestampNow := spec.Timestamp(1632131678061)
+	var rooms []*internal.RoomMetadata
+	var roomIDs []string
+	globalCache := caches.NewGlobalCache(nil)
+	dispatcher := sync3.NewDispatcher()
+	roomToJoinedUsers := make(map[string][]string)
+	for i := int64(0); i < 5; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		room := internal.RoomMetadata{
+			RoomID:               roomID,
+			NameEvent:            fmt.Sprintf("Room %d", i),
+			LastMessageTimestamp: uint64(uint64(timestampNow) - uint64(i*1000)),
+		}
+		rooms = append(rooms, &room)
+		roomIDs = append(roomIDs, roomID)
+		globalCache.Startup(map[string]internal.RoomMetadata{
+			room.RoomID: room,
+		})
+		roomToJoinedUsers[roomID] = []string{userID}
+	}
+	dispatcher.Startup(roomToJoinedUsers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		roomMetadata := make(map[string]*internal.RoomMetadata)
+		joinTimings = make(map[string]internal.EventMetadata)
+		loadPositions = make(map[string]int64)
+		for i, r := range rooms {
+			roomMetadata[r.RoomID] = rooms[i]
+			joinTimings[r.RoomID] = internal.EventMetadata{
+				NID:       123456, // Dummy values
+				Timestamp: 123456,
+			}
+			loadPositions[r.RoomID] = int64(i + 1)
+		}
+		return 10, roomMetadata, joinTimings, loadPositions, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+
+	reqList := sync3.RequestList{
+		Sort:   []string{sync3.SortByRecency},
+		Ranges: sync3.SliceRanges{{0, 4}},
+	}
+	req := &sync3.Request{Lists: map[string]sync3.RequestList{"a": reqList}}
+	syncOp := func(roomIDs []string) *sync3.Response {
+		return &sync3.Response{
+			Lists: map[string]sync3.ResponseList{
+				"a": {
+					Count: len(roomIDs),
+					Ops: []sync3.ResponseOp{
+						&sync3.ResponseOpRange{Operation: "SYNC", Range: [2]int64{0, 4}, RoomIDs: roomIDs},
+					},
+				},
+			},
+		}
+	}
+	newConn := func(deviceID string) *ConnState {
+		return NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{})
+	}
+
+	phone := newConn("PHONE")
+	res, err := phone.OnIncomingRequest(context.Background(), sync3.ConnID{DeviceID: "PHONE"}, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, syncOp(roomIDs))
+	if phone.listSnapshotPrefix != "" {
+		t.Errorf("lists can still be shared after the first request")
+	}
+
+	laptop := newConn("LAPTOP")
+	if err = laptop.load(context.Background(), req); err != nil {
+		t.Fatalf("load returned error: %s", err)
+	}
+	key := laptop.listSnapshotKey(&reqList)
+	got, ok := userCache.ListSnapshot(key)
+	if !ok {
+		t.Fatalf("no snapshot stored under %s", key)
+	}
+	assertVal(t, got, roomIDs)
+	// replace the stored order so we can tell it is used rather than recalculated
+	reversed := make([]string, len(roomIDs))
+	for i := range roomIDs {
+		reversed[len(roomIDs)-1-i] = roomIDs[i]
+	}
+	userCache.StoreListSnapshot(key, reversed)
+	res, err = laptop.OnIncomingRequest(context.Background(), sync3.ConnID{DeviceID: "LAPTOP"}, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, syncOp(reversed))
+
+	// a change to the user's room data means lists are no longer shared
+	notifCount := 1
+	userCache.OnUnreadCounts(context.Background(), roomIDs[0], nil, &notifCount)
+	tablet := newConn("TABLET")
+	if err = tablet.load(context.Background(), req); err != nil {
+		t.Fatalf("load returned error: %s", err)
+	}
+	if tabletKey := tablet.listSnapshotKey(&reqList); tabletKey == key {
+		t.Errorf("got the same snapshot key after the user's room data changed")
+	}
+}
+
 // Test that multiple ranges can be tracked in a single request
 func TestConnStateMultipleRanges(t *testing.T) {
 	t.Skip("flakey")
@@ -289,7 +860,7 @@ func TestConnStateMultipleRanges(t *testing.T) {
 	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
 	dispatcher.Register(context.Background(), userCache.UserID, userCache)
 	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{})
 
 	// request first page
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
@@ -351,7 +922,7 @@ func TestConnStateMultipleRanges(t *testing.T) {
 	// 8,0,1,2,3,4,5,6,7,9
 	//
 	newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(timestampNow.Time().Add(2*time.Second)))
-	dispatcher.OnNewEvent(context.Background(), roomIDs[8], newEvent, 1)
+	dispatcher.OnNewEvent(context.Background(), roomIDs[8], internal.NewEvent(newEvent), 1)
 
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
@@ -391,7 +962,7 @@ func TestConnStateMultipleRanges(t *testing.T) {
 	// 8,0,1,9,2,3,4,5,6,7 room
 	middleTimestamp := int64((roomIDToRoom[roomIDs[1]].LastMessageTimestamp + roomIDToRoom[roomIDs[2]].LastMessageTimestamp) / 2)
 	newEvent = testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(spec.Timestamp(middleTimestamp).Time()))
-	dispatcher.OnNewEvent(context.Background(), roomIDs[9], newEvent, 1)
+	dispatcher.OnNewEvent(context.Background(), roomIDs[9], internal.NewEvent(newEvent), 1)
 	t.Logf("new event %s : %s", roomIDs[9], string(newEvent))
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
@@ -468,7 +1039,7 @@ func TestBumpToOutsideRange(t *testing.T) {
 	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
 	dispatcher.Register(context.Background(), userCache.UserID, userCache)
 	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{})
 	// Ask for A,B
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
@@ -500,7 +1071,7 @@ func TestBumpToOutsideRange(t *testing.T) {
 
 	// D gets bumped to C's position but it's still outside the range so nothing should happen
 	newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(spec.Timestamp(roomC.LastMessageTimestamp+2).Time()))
-	dispatcher.OnNewEvent(context.Background(), roomD.RoomID, newEvent, 1)
+	dispatcher.OnNewEvent(context.Background(), roomD.RoomID, internal.NewEvent(newEvent), 1)
 
 	// expire the context after 10ms so we don't wait forevar
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
@@ -521,6 +1092,373 @@ func TestBumpToOutsideRange(t *testing.T) {
 	}
 }
 
+// Test that live updates which would exceed maxListOps are coalesced into a SYNC in the next response.
+func TestConnStateMaxListOps(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMaxListOps_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+	roomC := newRoomMetadata("!c:localhost", timestampNow-2000)
+	roomD := newRoomMetadata("!d:localhost", timestampNow-3000)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+		roomD.RoomID: roomD,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+		roomD.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+				roomD.RoomID: &roomD,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 2, Timestamp: 2},
+				roomC.RoomID: {NID: 3, Timestamp: 3},
+				roomD.RoomID: {NID: 4, Timestamp: 4},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{MaxListOps: 2})
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 3},
+			}),
+		}},
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.ListOps() != 1 || res.Pending {
+		t.Fatalf("initial response: got %d ops pending=%v, want 1 SYNC op", res.ListOps(), res.Pending)
+	}
+
+	// bump D, C then B to the top of the list: each is a DELETE and an INSERT
+	for i, room := range []internal.RoomMetadata{roomD, roomC, roomB} {
+		newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(timestampNow.Time().Add(time.Duration(i+1)*time.Second)))
+		dispatcher.OnNewEvent(context.Background(), room.RoomID, internal.NewEvent(newEvent), int64(10+i))
+	}
+	// the first bump fits, the rest are left out rather than queued
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 4,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpSingle{Operation: "DELETE", Index: intPtr(3)},
+					&sync3.ResponseOpSingle{Operation: "INSERT", Index: intPtr(0), RoomID: roomD.RoomID},
+				},
+			},
+		},
+	})
+	if !res.Pending {
+		t.Errorf("got pending=false for a throttled response")
+	}
+	if n := len(cs.live.updates); n != 0 {
+		t.Errorf("got %d updates still queued, want 0", n)
+	}
+	// then the list is SYNCed in its new order in one operation
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 4,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 3},
+						RoomIDs:   []string{roomB.RoomID, roomC.RoomID, roomD.RoomID, roomA.RoomID},
+					},
+				},
+			},
+		},
+	})
+	if res.Pending {
+		t.Errorf("got pending=true after the list was SYNCed")
+	}
+}
+
+// Test that rooms which leave every list range are forgotten, unless they are subscribed to.
+func TestConnStateForgetsSentRooms(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	cs, f := newTestConnState(t, testConnStateOpts{numRooms: 6})
+	subscribedRoomID := f.rooms[0].RoomID
+	request := func(ranges sync3.SliceRanges) *sync3.Response {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: ranges,
+			}},
+			RoomSubscriptions: map[string]sync3.RoomSubscription{
+				subscribedRoomID: {TimelineLimit: 1},
+			},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+	sentRoomIDs := func() []string {
+		roomIDs := internal.Keys(cs.sentRooms)
+		sort.Strings(roomIDs)
+		return roomIDs
+	}
+
+	res := request(sync3.SliceRanges{{0, 2}})
+	want := internal.Keys(res.Rooms)
+	sort.Strings(want)
+	assertVal(t, sentRoomIDs(), want)
+
+	// scroll to the rest of the list: the first page is forgotten apart from the subscription
+	res = request(sync3.SliceRanges{{3, 5}})
+	want = append(internal.Keys(res.Rooms), subscribedRoomID)
+	sort.Strings(want)
+	assertVal(t, len(want), 4)
+	assertVal(t, sentRoomIDs(), want)
+}
+
+// stubConnSaver stores sticky requests in memory.
+type stubConnSaver struct {
+	saved    map[string][]byte // conn ID -> request
+	numSaves int
+}
+
+func (s *stubConnSaver) SaveConnection(userID, deviceID, connID string, request []byte) error {
+	s.saved[connID] = request
+	s.numSaves++
+	return nil
+}
+
+func (s *stubConnSaver) DeleteConnection(userID, deviceID, connID string) error {
+	delete(s.saved, connID)
+	return nil
+}
+
+// Test that a connection resumed after a restart gets the lists and room subscriptions it had before,
+// sent in full.
+func TestConnStateResume(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+		CID:      "room-list",
+	}
+	saver := &stubConnSaver{saved: make(map[string][]byte)}
+	clock := testutils.NewFakeClock(time.Now())
+	f := newTestConnFixture(t, testConnStateOpts{numRooms: 6, connState: ConnStateOptions{Saver: saver, Clock: clock}})
+	subscribedRoomID := f.rooms[4].RoomID
+	cs := f.newConnState("yep")
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges{{0, 1}},
+		}},
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			subscribedRoomID: {TimelineLimit: 1},
+		},
+	}, true, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	savedJSON := saver.saved[ConnID.CID]
+	if savedJSON == nil {
+		t.Fatalf("sticky request wasn't saved")
+	}
+	// an unchanged request is only saved again once saveRequestInterval has passed
+	for _, advance := range []time.Duration{0, saveRequestInterval} {
+		clock.Advance(advance)
+		if _, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now()); err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+	}
+	assertVal(t, saver.numSaves, 2)
+
+	// the proxy restarts, and the client carries on where it left off, asking for one more room
+	var resumeReq sync3.Request
+	if err = json.Unmarshal(savedJSON, &resumeReq); err != nil {
+		t.Fatalf("failed to unmarshal saved request: %s", err)
+	}
+	f.opts.connState.ResumeRequest = &resumeReq
+	cs = f.newConnState("yep")
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{{0, 2}},
+		}},
+	}, true, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertVal(t, res.Lists["a"].Count, 6)
+	want := []string{f.roomIDs[0], f.roomIDs[1], f.roomIDs[2], subscribedRoomID}
+	sort.Strings(want)
+	got := internal.Keys(res.Rooms)
+	sort.Strings(got)
+	assertVal(t, got, want)
+	for roomID, room := range res.Rooms {
+		if !room.Initial {
+			t.Errorf("room %s wasn't sent in full", roomID)
+		}
+	}
+	assertVal(t, cs.StickyRequest().Lists["a"].Sort, []string{sync3.SortByRecency})
+
+	// closing the connection means it can't be resumed
+	cs.Destroy()
+	if _, ok := saver.saved[ConnID.CID]; ok {
+		t.Errorf("sticky request wasn't deleted when the connection was closed")
+	}
+}
+
+// Test that the debug extension reports how the response was built, including sorted lists reused
+// from another connection.
+func TestConnStateDebugExtension(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	f := newTestConnFixture(t, testConnStateOpts{
+		numRooms:   2,
+		extensions: &extensions.Handler{},
+	})
+	boolTrue := true
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+		Extensions: extensions.Request{
+			Debug: &extensions.DebugRequest{Core: extensions.Core{Enabled: &boolTrue}},
+		},
+	}
+	for i, wantStats := range []extensions.DebugCacheStats{{Misses: 1}, {Hits: 1}} {
+		cs := f.newConnState("yep")
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		debug := res.Extensions.Debug
+		if debug == nil {
+			t.Fatalf("connection %d: response has no debug extension", i)
+		}
+		if debug.RoomsConsidered != 2 {
+			t.Errorf("connection %d: got %d rooms considered, want 2", i, debug.RoomsConsidered)
+		}
+		if debug.QueueDepth != 0 || debug.QueueCapacity != 1000 {
+			t.Errorf("connection %d: got queue %d/%d, want 0/1000", i, debug.QueueDepth, debug.QueueCapacity)
+		}
+		if got := debug.ConnCaches["sorted_lists"]; got != wantStats {
+			t.Errorf("connection %d: got sorted_lists stats %+v want %+v", i, got, wantStats)
+		}
+		cs.Destroy()
+	}
+}
+
+// Test that receipts only bump rooms in lists which ask for it.
+func TestConnStateBumpOnReceipts(t *testing.T) {
+	for _, bumpOn := range [][]string{nil, {sync3.BumpOnReceipts}} {
+		ConnID := sync3.ConnID{
+			DeviceID: "d",
+		}
+		userID := "@TestConnStateBumpOnReceipts_alice:localhost"
+		deviceID := "yep"
+		timestampNow := spec.Timestamp(1632131678061)
+		roomA := newRoomMetadata("!a:localhost", timestampNow)
+		roomB := newRoomMetadata("!b:localhost", timestampNow-1000)
+		roomC := newRoomMetadata("!c:localhost", timestampNow-2000)
+		globalCache := caches.NewGlobalCache(nil)
+		globalCache.Startup(map[string]internal.RoomMetadata{
+			roomA.RoomID: roomA,
+			roomB.RoomID: roomB,
+			roomC.RoomID: roomC,
+		})
+		dispatcher := sync3.NewDispatcher()
+		dispatcher.Startup(map[string][]string{
+			roomA.RoomID: {userID},
+			roomB.RoomID: {userID},
+			roomC.RoomID: {userID},
+		})
+		globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+			return 1, map[string]*internal.RoomMetadata{
+					roomA.RoomID: &roomA,
+					roomB.RoomID: &roomB,
+					roomC.RoomID: &roomC,
+				}, map[string]internal.EventMetadata{
+					roomA.RoomID: {NID: 1, Timestamp: 1},
+					roomB.RoomID: {NID: 2, Timestamp: 2},
+					roomC.RoomID: {NID: 3, Timestamp: 3},
+				}, nil, nil
+		}
+		userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+		userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+		dispatcher.Register(context.Background(), userCache.UserID, userCache)
+		dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+		cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{})
+		req := &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort: []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges([][2]int64{
+					{0, 2},
+				}),
+				BumpOn: bumpOn,
+			}},
+		}
+		_, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+
+		dispatcher.OnReceipt(context.Background(), internal.Receipt{
+			RoomID:  roomC.RoomID,
+			EventID: "$c",
+			UserID:  "@bob:localhost",
+		})
+
+		// expire the context after 10ms so we don't wait forevar
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		res, err := cs.OnIncomingRequest(ctx, ConnID, req, false, time.Now())
+		cancel()
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		var movedToTop bool
+		for _, op := range res.Lists["a"].Ops {
+			single, ok := op.(*sync3.ResponseOpSingle)
+			if ok && single.Operation == sync3.OpInsert && single.RoomID == roomC.RoomID && *single.Index == 0 {
+				movedToTop = true
+			}
+		}
+		if wantMoved := bumpOn != nil; movedToTop != wantMoved {
+			t.Errorf("bump_on=%v: got room moved to top %v want %v, ops: %+v", bumpOn, movedToTop, wantMoved, res.Lists["a"].Ops)
+		}
+	}
+}
+
 // Test that room subscriptions can be made and that events are pushed for them.
 func TestConnStateRoomSubscriptions(t *testing.T) {
 	ConnID := sync3.ConnID{
@@ -579,7 +1517,7 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 	}
 	dispatcher.Register(context.Background(), userCache.UserID, userCache)
 	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0, ConnStateOptions{})
 	// subscribe to room D
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
 		RoomSubscriptions: map[string]sync3.RoomSubscription{
@@ -638,7 +1576,7 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 	})
 	// room D gets a new event but it's so old it doesn't bump to the top of the list
 	newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(spec.Timestamp(timestampNow-20000).Time()))
-	dispatcher.OnNewEvent(context.Background(), roomD.RoomID, newEvent, 1)
+	dispatcher.OnNewEvent(context.Background(), roomD.RoomID, internal.NewEvent(newEvent), 1)
 	// we should get this message even though it's not in the range because we are subscribed to this room.
 	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
@@ -806,3 +1744,215 @@ func serialise(t *testing.T, thing interface{}) string {
 func intPtr(val int) *int {
 	return &val
 }
+
+func TestConnStateApplyDefaultLists(t *testing.T) {
+	defaults := map[string]sync3.RequestList{
+		"rooms": {Ranges: sync3.SliceRanges{{0, 9}}},
+	}
+	s := &ConnState{defaultLists: defaults}
+	testCases := []struct {
+		desc      string
+		muxedReq  *sync3.Request
+		req       *sync3.Request
+		wantLists map[string]sync3.RequestList
+	}{
+		{
+			desc:      "empty first request",
+			req:       &sync3.Request{},
+			wantLists: defaults,
+		},
+		{
+			desc: "first request with lists",
+			req: &sync3.Request{Lists: map[string]sync3.RequestList{
+				"mine": {Ranges: sync3.SliceRanges{{0, 1}}},
+			}},
+			wantLists: map[string]sync3.RequestList{
+				"mine": {Ranges: sync3.SliceRanges{{0, 1}}},
+			},
+		},
+		{
+			desc: "first request with room subscriptions",
+			req: &sync3.Request{RoomSubscriptions: map[string]sync3.RoomSubscription{
+				"!a:localhost": {TimelineLimit: 1},
+			}},
+		},
+		{
+			desc:     "empty later request",
+			muxedReq: &sync3.Request{},
+			req:      &sync3.Request{},
+		},
+	}
+	for _, tc := range testCases {
+		s.muxedReq = tc.muxedReq
+		s.applyDefaultLists(tc.req)
+		if !reflect.DeepEqual(tc.req.Lists, tc.wantLists) {
+			t.Errorf("%s: got lists %+v want %+v", tc.desc, tc.req.Lists, tc.wantLists)
+		}
+	}
+}
+
+type roomUpdateCollector struct {
+	updates []caches.RoomUpdate
+}
+
+func (c *roomUpdateCollector) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	c.updates = append(c.updates, up)
+}
+
+func (c *roomUpdateCollector) OnUpdate(ctx context.Context, up caches.Update) {}
+
+func TestIsAfterCutoff(t *testing.T) {
+	ctx := context.Background()
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	roomID := "!a:localhost"
+	userCache := caches.NewUserCache(alice, caches.NewGlobalCache(nil), nil, &NopTransactionFetcher{}, &NopJoinTracker{})
+	collector := &roomUpdateCollector{}
+	userCache.Subsribe(collector)
+	newEvent := func(nid int64, sender, evType string, stateKey *string, content string) {
+		userCache.OnNewEvent(ctx, &caches.EventData{
+			Event:     json.RawMessage(fmt.Sprintf(`{"type":"%s","sender":"%s","content":%s}`, evType, sender, content)),
+			RoomID:    roomID,
+			EventType: evType,
+			StateKey:  stateKey,
+			Content:   gjson.Parse(content),
+			Sender:    sender,
+			NID:       nid,
+		})
+	}
+
+	newEvent(1, bob, "m.room.message", nil, `{"body":"before"}`)
+	newEvent(2, bob, "m.room.member", &alice, `{"membership":"leave"}`)
+	newEvent(3, bob, "m.room.message", nil, `{"body":"after"}`)
+	if len(collector.updates) != 3 {
+		t.Fatalf("got %d updates, want 3", len(collector.updates))
+	}
+	before, kick, after := collector.updates[0], collector.updates[1], collector.updates[2]
+
+	testCases := []struct {
+		name string
+		up   caches.RoomUpdate
+		want bool
+	}{
+		{name: "event before kick", up: before, want: false},
+		{name: "kick", up: kick, want: false},
+		{name: "event after kick", up: after, want: true},
+		{name: "typing after kick", up: &caches.TypingUpdate{RoomUpdate: after}, want: true},
+		{name: "receipt after kick", up: &caches.ReceiptUpdate{RoomUpdate: after}, want: true},
+		{name: "typing before kick", up: &caches.TypingUpdate{RoomUpdate: before}, want: false},
+		{
+			name: "leave event from OnLeftRoom",
+			up: &caches.RoomEventUpdate{
+				RoomUpdate: after,
+				EventData:  &caches.EventData{RoomID: roomID, AlwaysProcess: true},
+			},
+			want: false,
+		},
+	}
+	for _, tc := range testCases {
+		if got := isAfterCutoff(tc.up); got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// rejoining lifts the cutoff
+	newEvent(4, alice, "m.room.member", &alice, `{"membership":"join"}`)
+	newEvent(5, bob, "m.room.message", nil, `{"body":"rejoined"}`)
+	if isAfterCutoff(collector.updates[4]) {
+		t.Errorf("event after rejoining was cut off")
+	}
+}
+
+type stubBackfiller struct {
+	mu         sync.Mutex
+	backfilled []string
+	older      json.RawMessage
+	// if set, backfilling checks that this semaphore isn't held
+	sem        *internal.Semaphore
+	semWasHeld bool
+}
+
+func (b *stubBackfiller) Backfill(ctx context.Context, roomID string, timeline *state.LatestEvents, limit int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sem != nil {
+		acquireCtx, cancel := context.WithTimeout(ctx, time.Second)
+		if err := b.sem.Acquire(acquireCtx); err != nil {
+			b.semWasHeld = true
+		} else {
+			b.sem.Release()
+		}
+		cancel()
+	}
+	b.backfilled = append(b.backfilled, roomID)
+	timeline.Timeline = append([]json.RawMessage{b.older}, timeline.Timeline...)
+	timeline.PrevBatch = "prev_older"
+	return nil
+}
+
+func TestConnStateBackfillsShortTimelines(t *testing.T) {
+	timeline := map[string]json.RawMessage{
+		testConnRoomID(0): testutils.NewEvent(t, "m.room.message", "@bob:localhost", map[string]interface{}{"body": "a"}),
+		testConnRoomID(1): testutils.NewEvent(t, "m.room.message", "@bob:localhost", map[string]interface{}{"body": "b"}),
+	}
+	// the database is free while backfilling, so other requests can load rooms
+	sem := internal.NewSemaphore(1)
+	backfiller := &stubBackfiller{
+		older: testutils.NewEvent(t, "m.room.message", "@bob:localhost", map[string]interface{}{"body": "older"}),
+		sem:   sem,
+	}
+	cs, f := newTestConnState(t, testConnStateOpts{
+		numRooms: 2,
+		lazyLoadTimelines: func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+			result := make(map[string]state.LatestEvents)
+			for _, roomID := range roomIDs {
+				latest := state.LatestEvents{
+					Timeline: []json.RawMessage{timeline[roomID]},
+				}
+				// the proxy has seen the start of room 1, so there is nothing to backfill
+				if roomID == testConnRoomID(0) {
+					latest.PrevBatch = "prev_a"
+				}
+				result[roomID] = latest
+			}
+			return result
+		},
+		connState: ConnStateOptions{Backfiller: backfiller, InitialLoadSemaphore: sem},
+	})
+	roomA, roomB := f.rooms[0], f.rooms[1]
+	res, err := cs.OnIncomingRequest(context.Background(), sync3.ConnID{DeviceID: "d"}, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {TimelineLimit: 5},
+			roomB.RoomID: {TimelineLimit: 5},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if !reflect.DeepEqual(backfiller.backfilled, []string{roomA.RoomID}) {
+		t.Errorf("backfilled rooms %v, want only %s", backfiller.backfilled, roomA.RoomID)
+	}
+	if backfiller.semWasHeld {
+		t.Errorf("initial load semaphore was held while backfilling")
+	}
+	if got := res.Rooms[roomA.RoomID]; !reflect.DeepEqual(got.Timeline, []json.RawMessage{backfiller.older, timeline[roomA.RoomID]}) || got.PrevBatch != "prev_older" {
+		t.Errorf("room A got timeline %s prev_batch %s, want the backfilled event first", got.Timeline, got.PrevBatch)
+	}
+	if got := res.Rooms[roomB.RoomID]; len(got.Timeline) != 1 {
+		t.Errorf("room B got timeline %s, want it unchanged", got.Timeline)
+	}
+
+	// rooms with timeline filters aren't backfilled
+	backfiller.backfilled = nil
+	_, err = cs.OnIncomingRequest(context.Background(), sync3.ConnID{DeviceID: "d"}, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {TimelineLimit: 6, TimelineFilter: &internal.TimelineFilter{Types: []string{"m.room.message"}}},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if len(backfiller.backfilled) != 0 {
+		t.Errorf("backfilled %v for a filtered timeline", backfiller.backfilled)
+	}
+}
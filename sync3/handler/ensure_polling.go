@@ -183,6 +183,33 @@ func (p *EnsurePoller) OnExpiredToken(payload *pubsub.V2ExpiredToken) {
 	// by signalling via the expired flag.
 }
 
+// OnPollerDied forgets that this device has been polled, so the next EnsurePolling call starts a new
+// poller. Devices with an EnsurePolling call in flight are left alone.
+func (p *EnsurePoller) OnPollerDied(payload *pubsub.V2PollerDied) {
+	pid := sync2.PollerID{UserID: payload.UserID, DeviceID: payload.DeviceID}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pending, exists := p.pendingPolls[pid]; exists && pending.done {
+		delete(p.pendingPolls, pid)
+	}
+}
+
+// ForceResync asks the pollers to resync all of this user's devices from scratch, and forgets that
+// they have been polled, so the next EnsurePolling call for each device waits for a fresh initial
+// sync. Devices with an EnsurePolling call in flight are left alone.
+func (p *EnsurePoller) ForceResync(userID string) {
+	p.mu.Lock()
+	for pid, pending := range p.pendingPolls {
+		if pid.UserID == userID && pending.done {
+			delete(p.pendingPolls, pid)
+		}
+	}
+	p.mu.Unlock()
+	p.notifier.Notify(p.chanName, &pubsub.V3ForceResync{
+		UserID: userID,
+	})
+}
+
 func (p *EnsurePoller) Teardown() {
 	p.notifier.Close()
 	if p.numPendingEnsurePolling != nil {
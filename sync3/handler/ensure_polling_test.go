@@ -194,6 +194,62 @@ func TestEnsurePollerDoesntCacheFailures(t *testing.T) {
 	}
 }
 
+// Test that a device is polled again after its poller dies, rather than assuming it is still polled.
+func TestEnsurePollerRepollsAfterPollerDied(t *testing.T) {
+	n := &mockNotifier{ch: make(chan pubsub.Payload, 100)}
+	ctx := context.Background()
+	pid := sync2.PollerID{UserID: "@alice:localhost", DeviceID: "DEVICE"}
+	ep := NewEnsurePoller(n, false)
+
+	finished := make(chan bool) // dummy
+	go func() {
+		_ = ep.EnsurePolling(ctx, pid, "tokenHash")
+		close(finished)
+	}()
+	n.WaitForNextPayload(t, time.Second) // wait for V3EnsurePolling
+	ep.OnInitialSyncComplete(&pubsub.V2InitialSyncComplete{
+		UserID:   pid.UserID,
+		DeviceID: pid.DeviceID,
+		Success:  true,
+	})
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatalf("EnsurePolling didn't unblock after response was sent")
+	}
+
+	ep.OnPollerDied(&pubsub.V2PollerDied{
+		UserID:   pid.UserID,
+		DeviceID: pid.DeviceID,
+	})
+
+	// hitting EnsurePolling again should do a new request
+	var expired atomic.Bool
+	finished = make(chan bool) // dummy
+	go func() {
+		exp := ep.EnsurePolling(ctx, pid, "tokenHash")
+		expired.Store(exp)
+		close(finished)
+	}()
+	p := n.WaitForNextPayload(t, time.Second)
+	if _, ok := p.(*pubsub.V3EnsurePolling); !ok {
+		t.Fatalf("unexpected payload: %+v", p)
+	}
+	ep.OnInitialSyncComplete(&pubsub.V2InitialSyncComplete{
+		UserID:   pid.UserID,
+		DeviceID: pid.DeviceID,
+		Success:  true,
+	})
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatalf("EnsurePolling didn't unblock after response was sent")
+	}
+	if expired.Load() {
+		t.Fatalf("EnsurePolling said token was expired when it wasn't")
+	}
+}
+
 func assertVal(t *testing.T, got, want interface{}) {
 	t.Helper()
 	if !reflect.DeepEqual(got, want) {
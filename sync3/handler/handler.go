@@ -6,9 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"net/url"
-	"os"
 	"reflect"
 	"strconv"
 	"sync"
@@ -16,8 +15,6 @@ import (
 	"time"
 
 	"github.com/getsentry/sentry-go"
-	"github.com/jmoiron/sqlx"
-	"github.com/matrix-org/sliding-sync/sqlutil"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/pubsub"
@@ -26,25 +23,29 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/matrix-org/sliding-sync/webhook"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/singleflight"
 )
 
 const DefaultSessionID = "default"
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+// connTTL is how long a connection can go unused before it expires. Connections stored before a
+// restart are only resumed if they were used within this long.
+const connTTL = 30 * time.Minute
+
+var logger = internal.NewLogger()
 
 // This is a net.http Handler for sync v3. It is responsible for pairing requests to Conns and to
 // ensure that the sync v2 poller is running for this client.
 type SyncLiveHandler struct {
 	V2           sync2.Client
-	Storage      *state.Storage
-	V2Store      *sync2.Storage
+	Auth         sync2.Authenticator // identifies access tokens which haven't been seen before
+	Storage      Store
+	V2Store      V2Store
 	V2Sub        *pubsub.V2Sub
 	EnsurePoller *EnsurePoller
 	ConnMap      *sync3.ConnMap
@@ -55,42 +56,187 @@ type SyncLiveHandler struct {
 	// > (2) when multiple goroutines read, write, and overwrite entries for disjoint sets of keys.
 	userCaches *sync.Map // map[user_id]*UserCache
 	Dispatcher *sync3.Dispatcher
+	// dedupes concurrent loads of the same user cache
+	userCacheLoads singleflight.Group
 
 	GlobalCache            *caches.GlobalCache
 	maxPendingEventUpdates int
 	maxTransactionIDDelay  time.Duration
+	// requests which take longer than this to process (excluding time spent waiting for
+	// live updates) are logged and counted as slow.
+	slowRequestThreshold time.Duration
+	// the largest request body we are willing to read, in bytes.
+	maxRequestBodyBytes int64
+	// limits how often each client IP can create new connections or identify new access tokens.
+	newConnLimiter *internal.RateLimiter
+	// limits how many requests each user can make, across all their devices and connections.
+	userReqLimiter *internal.RateLimiter
+	// the number of reverse proxies in front of the proxy which append to X-Forwarded-For
+	trustedProxies int
+	// the most rooms to send for list ranges in one response, 0 for no limit.
+	maxRoomsPerResponse int
+	// coalesces typing notifications in busy rooms
+	typing *typingCoalescer
+	// clears typing notifications which haven't been updated for a while
+	typingExpiry *typingExpiry
+	// sends notifications about new events to an external URL, nil if not configured
+	webhooks *webhook.Sink
+	// in-process hooks added with AddHooks
+	hooks *hookRegistry
+	// how unsigned.age is served
+	eventAge internal.EventAgeOpts
+	// mints and checks the pos tokens sent to clients
+	posTokens *posTokens
+	// drives connection expiry, and decides which stored connections can be resumed
+	clock internal.Clock
 
 	setupHistVec *prometheus.HistogramVec
 	histVec      *prometheus.HistogramVec
 	slowReqs     prometheus.Counter
+	// rateLimitedReqs counts requests which were rejected by a rate limiter, labelled by limiter.
+	rateLimitedReqs *prometheus.CounterVec
 	// destroyedConns is the number of connections that have been destoryed after
 	// a room invalidation payload.
 	// TODO: could make this a CounterVec labelled by reason, to track expiry due
 	//       to update buffer filling, expiry due to inactivity, etc.
 	destroyedConns prometheus.Counter
+	// connWakeups counts the number of times a blocked connection was woken up by a live update.
+	connWakeups prometheus.Counter
+	// deliveryHist tracks the time between events being committed and a blocked connection waking up.
+	deliveryHist prometheus.Histogram
+	// pendingUpdates and maxPendingUpdates are calculated when scraped.
+	pendingUpdates    prometheus.GaugeFunc
+	maxPendingUpdates prometheus.GaugeFunc
+	// sizes of responses sent to clients, labelled by initial vs incremental.
+	responseBytesHistVec *prometheus.HistogramVec
+	responseOpsHistVec   *prometheus.HistogramVec
+	responseRoomsHistVec *prometheus.HistogramVec
+	// truncatedResponses counts responses which left out rooms or list operations because of
+	// maxRoomsPerResponse, maxResponseBytes or maxListOps.
+	truncatedResponses prometheus.Counter
+
+	// if true, timelines deeper than what is stored are backfilled from the homeserver.
+	timelineBackfill bool
+	// limits how often each user's timelines are backfilled from the homeserver.
+	backfillLimiter *internal.RateLimiter
+	// limits initial load chunks across all connections, nil for no limit.
+	initialLoadSem *internal.Semaphore
+	// lists to use for connections whose first request has no lists or room subscriptions.
+	defaultLists map[string]sync3.RequestList
+	// initial responses with at least this many rooms are sent in phases, 0 to disable.
+	phasedInitialSyncRooms int
+	// the most bytes of room data to send in one response, 0 for no limit.
+	maxResponseBytes int
+	// the most list operations from live updates to send in one response, 0 for no limit.
+	maxListOps int
+}
+
+// HandlerOptions configures optional behaviour of a SyncLiveHandler. The zero value is valid and
+// disables all of it.
+type HandlerOptions struct {
+	// extension names (e.g "e2ee", "typing") which are ignored if requested by clients.
+	DisabledExtensions []string
+	// requests which take longer than this to process are logged and counted as slow.
+	SlowRequestThreshold time.Duration
+	// the largest request body we are willing to read, in bytes.
+	MaxRequestBodyBytes int64
+	// how many new connections each client IP can make per minute, 0 for no limit.
+	NewConnsPerIPPerMinute int
+	// the number of reverse proxies in front of the proxy which append to X-Forwarded-For, 0 to
+	// ignore the header.
+	TrustedProxies int
+	// how many requests each user can make per minute, 0 for no limit.
+	RequestsPerUserPerMinute int
+	// the most rooms to send for list ranges in one response, 0 for no limit.
+	MaxRoomsPerResponse int
+	// the shortest time between typing notifications for each room, 0 to send them immediately.
+	TypingDebounce time.Duration
+	// clears typing notifications which haven't been updated for this long, 0 to never clear them.
+	TypingExpiry time.Duration
+	// sends notifications about new events to an external URL, nil if not configured
+	Webhooks *webhook.Sink
+	// how unsigned.age is served
+	EventAge internal.EventAgeOpts
+	// caps on the to-device messages sent in each response, 0 for no limit.
+	ToDeviceMaxMessages int
+	ToDeviceMaxBytes    int
+	// if true, timelines deeper than what is stored are backfilled from the homeserver.
+	TimelineBackfill bool
+	// lists to use for connections whose first request has no lists or room subscriptions.
+	DefaultLists map[string]sync3.RequestList
+	// initial responses with at least this many rooms are sent in phases, 0 to disable.
+	PhasedInitialSyncRooms int
+	// the most bytes of room data to send in one response, 0 for no limit.
+	MaxResponseBytes int
+	// the most list operations from live updates to send in one response, 0 for no limit.
+	MaxListOps int
+	// identifies unknown access tokens, defaults to the v2 client's /whoami.
+	Auth sync2.Authenticator
+	// drives connection expiry and typing notification timers, defaults to the real clock.
+	Clock internal.Clock
+	// the most chunks of rooms loaded for initial data at once across all connections, 0 for no limit.
+	MaxParallelInitialLoads int
+	// distinguishes the pos tokens of instances which share a secret.
+	InstanceName string
 }
 
 func NewSync3Handler(
-	store *state.Storage, storev2 *sync2.Storage, v2Client sync2.Client, secret string,
+	store Store, storev2 V2Store, v2Client sync2.Client, secret string,
 	pub pubsub.Notifier, sub pubsub.Listener, enablePrometheus bool, maxPendingEventUpdates int,
-	maxTransactionIDDelay time.Duration,
+	maxTransactionIDDelay time.Duration, opts HandlerOptions,
 ) (*SyncLiveHandler, error) {
 	logger.Info().Msg("creating handler")
+	disabled, err := extensions.NewDisabledExtensions(opts.DisabledExtensions)
+	if err != nil {
+		return nil, err
+	}
+	auth := opts.Auth
+	if auth == nil {
+		auth = v2Client
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = internal.RealClock
+	}
 	sh := &SyncLiveHandler{
 		V2:                     v2Client,
+		Auth:                   auth,
 		Storage:                store,
 		V2Store:                storev2,
-		ConnMap:                sync3.NewConnMap(enablePrometheus, 30*time.Minute),
+		ConnMap:                sync3.NewConnMapWithClock(enablePrometheus, connTTL, clock),
 		userCaches:             &sync.Map{},
 		Dispatcher:             sync3.NewDispatcher(),
 		GlobalCache:            caches.NewGlobalCache(store),
 		maxPendingEventUpdates: maxPendingEventUpdates,
 		maxTransactionIDDelay:  maxTransactionIDDelay,
-	}
+		slowRequestThreshold:   opts.SlowRequestThreshold,
+		maxRequestBodyBytes:    opts.MaxRequestBodyBytes,
+		newConnLimiter:         internal.NewRateLimiter(opts.NewConnsPerIPPerMinute, 0),
+		trustedProxies:         opts.TrustedProxies,
+		userReqLimiter:         internal.NewRateLimiter(opts.RequestsPerUserPerMinute, 0),
+		maxRoomsPerResponse:    opts.MaxRoomsPerResponse,
+		webhooks:               opts.Webhooks,
+		hooks:                  &hookRegistry{},
+		eventAge:               opts.EventAge,
+		defaultLists:           opts.DefaultLists,
+		phasedInitialSyncRooms: opts.PhasedInitialSyncRooms,
+		maxResponseBytes:       opts.MaxResponseBytes,
+		maxListOps:             opts.MaxListOps,
+		posTokens:              newPosTokens(secret, opts.InstanceName),
+		clock:                  clock,
+		timelineBackfill:       opts.TimelineBackfill,
+		backfillLimiter:        internal.NewRateLimiter(backfillsPerUserPerMinute, 0),
+		initialLoadSem:         internal.NewSemaphore(opts.MaxParallelInitialLoads),
+	}
+	sh.typing = newTypingCoalescer(opts.TypingDebounce, clock, sh.dispatchTyping)
+	sh.typingExpiry = newTypingExpiry(opts.TypingExpiry, clock, sh.expireTyping)
 	sh.Extensions = &extensions.Handler{
-		Store:       store,
-		E2EEFetcher: sh,
-		GlobalCache: sh.GlobalCache,
+		Store:               store,
+		E2EEFetcher:         sh,
+		GlobalCache:         sh.GlobalCache,
+		Disabled:            disabled,
+		ToDeviceMaxMessages: opts.ToDeviceMaxMessages,
+		ToDeviceMaxBytes:    opts.ToDeviceMaxBytes,
 	}
 
 	if enablePrometheus {
@@ -105,10 +251,17 @@ func NewSync3Handler(
 	return sh, nil
 }
 
-func (h *SyncLiveHandler) Startup(storeSnapshot *state.StartupSnapshot) error {
-	if err := h.Dispatcher.Startup(storeSnapshot.AllJoinedMembers); err != nil {
+// Startup loads all joined members and room metadata from the database. Must be called before serving requests.
+func (h *SyncLiveHandler) Startup() error {
+	var storeSnapshot state.StartupSnapshot
+	err := h.Dispatcher.StartupFrom(func(onJoinedMember func(roomID, userID string)) (err error) {
+		storeSnapshot, err = h.Storage.GlobalSnapshot(onJoinedMember)
+		return err
+	})
+	if err != nil {
 		return fmt.Errorf("failed to load sync3.Dispatcher: %s", err)
 	}
+	logger.Info().Int("rooms", len(storeSnapshot.GlobalMetadata)).Msg("retrieved global snapshot from database")
 	h.Dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, h.GlobalCache)
 	if err := h.GlobalCache.Startup(storeSnapshot.GlobalMetadata); err != nil {
 		return fmt.Errorf("failed to populate global cache: %s", err)
@@ -126,6 +279,7 @@ func (h *SyncLiveHandler) Listen() {
 			sentry.CaptureException(err)
 		}
 	}()
+	h.typingExpiry.Start()
 }
 
 // used in tests to close postgres connections
@@ -135,6 +289,10 @@ func (h *SyncLiveHandler) Teardown() {
 	h.V2Sub.Teardown()
 	h.EnsurePoller.Teardown()
 	h.ConnMap.Teardown()
+	h.typingExpiry.Stop()
+	if h.webhooks != nil {
+		h.webhooks.Close()
+	}
 	if h.setupHistVec != nil {
 		prometheus.Unregister(h.setupHistVec)
 	}
@@ -147,6 +305,33 @@ func (h *SyncLiveHandler) Teardown() {
 	if h.destroyedConns != nil {
 		prometheus.Unregister(h.destroyedConns)
 	}
+	if h.rateLimitedReqs != nil {
+		prometheus.Unregister(h.rateLimitedReqs)
+	}
+	if h.connWakeups != nil {
+		prometheus.Unregister(h.connWakeups)
+	}
+	if h.deliveryHist != nil {
+		prometheus.Unregister(h.deliveryHist)
+	}
+	if h.pendingUpdates != nil {
+		prometheus.Unregister(h.pendingUpdates)
+	}
+	if h.maxPendingUpdates != nil {
+		prometheus.Unregister(h.maxPendingUpdates)
+	}
+	if h.responseBytesHistVec != nil {
+		prometheus.Unregister(h.responseBytesHistVec)
+	}
+	if h.responseOpsHistVec != nil {
+		prometheus.Unregister(h.responseOpsHistVec)
+	}
+	if h.responseRoomsHistVec != nil {
+		prometheus.Unregister(h.responseRoomsHistVec)
+	}
+	if h.truncatedResponses != nil {
+		prometheus.Unregister(h.truncatedResponses)
+	}
 }
 
 func (h *SyncLiveHandler) addPrometheusMetrics() {
@@ -168,7 +353,7 @@ func (h *SyncLiveHandler) addPrometheusMetrics() {
 		Namespace: "sliding_sync",
 		Subsystem: "api",
 		Name:      "slow_requests",
-		Help:      "Counter of slow (>=50s) requests, initial or otherwise.",
+		Help:      "Counter of requests which exceeded the slow request threshold, initial or otherwise.",
 	})
 	h.destroyedConns = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "sliding_sync",
@@ -176,11 +361,117 @@ func (h *SyncLiveHandler) addPrometheusMetrics() {
 		Name:      "destroyed_conns",
 		Help:      "Counter of conns that were destroyed.",
 	})
+	h.rateLimitedReqs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "rate_limited_requests",
+		Help:      "Counter of requests rejected due to rate limiting, labelled by the limit which was hit.",
+	}, []string{"limit"})
 
 	prometheus.MustRegister(h.setupHistVec)
 	prometheus.MustRegister(h.histVec)
 	prometheus.MustRegister(h.slowReqs)
 	prometheus.MustRegister(h.destroyedConns)
+	h.connWakeups = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "conn_wakeups",
+		Help:      "Counter of times a connection waiting for data was woken up by a live update.",
+	})
+	h.deliveryHist = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "event_delivery_duration_secs",
+		Help:      "Time taken in seconds from events being committed to the database to a waiting connection being woken up by them.",
+		Buckets:   []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	})
+	h.pendingUpdates = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "pending_updates",
+		Help:      "Number of live updates queued across all connections, waiting to be processed.",
+	}, func() float64 {
+		total, _ := h.pendingUpdateCounts()
+		return float64(total)
+	})
+	h.maxPendingUpdates = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "max_pending_updates",
+		Help:      "The largest number of live updates queued on a single connection, waiting to be processed.",
+	}, func() float64 {
+		_, max := h.pendingUpdateCounts()
+		return float64(max)
+	})
+	h.responseBytesHistVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "response_size_bytes",
+		Help:      "Size in bytes of serialised sliding sync responses.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10), // 256B to 64MB
+	}, []string{"initial"})
+	countBuckets := []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500}
+	h.responseOpsHistVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "response_num_ops",
+		Help:      "Number of list operations in sliding sync responses.",
+		Buckets:   countBuckets,
+	}, []string{"initial"})
+	h.responseRoomsHistVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "response_num_rooms",
+		Help:      "Number of rooms in sliding sync responses.",
+		Buckets:   countBuckets,
+	}, []string{"initial"})
+
+	prometheus.MustRegister(h.rateLimitedReqs)
+	prometheus.MustRegister(h.connWakeups)
+	prometheus.MustRegister(h.deliveryHist)
+	prometheus.MustRegister(h.pendingUpdates)
+	prometheus.MustRegister(h.maxPendingUpdates)
+	prometheus.MustRegister(h.responseBytesHistVec)
+	prometheus.MustRegister(h.responseOpsHistVec)
+	h.truncatedResponses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "truncated_responses",
+		Help:      "Counter of responses which left out list ranges, rooms or list operations to send later because of the rooms, bytes or list operations per response limits.",
+	})
+	prometheus.MustRegister(h.responseRoomsHistVec)
+	prometheus.MustRegister(h.truncatedResponses)
+}
+
+// trackResponseSize records the size of a response which was sent to a client.
+func (h *SyncLiveHandler) trackResponseSize(resp *sync3.Response, numBytes int64, isInitial bool) {
+	if h.responseBytesHistVec == nil {
+		return
+	}
+	val := "0"
+	if isInitial {
+		val = "1"
+	}
+	h.responseBytesHistVec.WithLabelValues(val).Observe(float64(numBytes))
+	h.responseOpsHistVec.WithLabelValues(val).Observe(float64(resp.ListOps()))
+	h.responseRoomsHistVec.WithLabelValues(val).Observe(float64(len(resp.Rooms)))
+}
+
+// pendingUpdateCounts returns the total number of queued live updates across all connections, and
+// the most queued on any one connection.
+func (h *SyncLiveHandler) pendingUpdateCounts() (total, max int) {
+	for _, conn := range h.ConnMap.AllConns() {
+		cs, ok := conn.Handler().(*ConnState)
+		if !ok || cs.live == nil {
+			continue
+		}
+		n := len(cs.live.updates)
+		total += n
+		if n > max {
+			max = n
+		}
+	}
+	return total, max
 }
 
 func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -214,17 +505,39 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 	start := time.Now()
 	defer func() {
 		dur := time.Since(start)
-		if dur > 50*time.Second {
+		breakdown := internal.RequestContextBreakdown(req.Context())
+		// don't count time spent long-polling for new data as processing time
+		processingDur := dur - breakdown.Wait
+		if processingDur > h.slowRequestThreshold {
 			if h.slowReqs != nil {
 				h.slowReqs.Add(1.0)
 			}
-			internal.DecorateLogger(req.Context(), log.Warn()).Dur("duration", dur).Msg("slow request")
+			internal.DecorateLogger(req.Context(), log.Warn()).
+				Dur("duration", dur).
+				Dur("processing", processingDur).
+				Dur("db", breakdown.DB).
+				Dur("sort", breakdown.Sort).
+				Dur("serialise", breakdown.Serialise).
+				Msg("slow request")
 		}
 	}()
 	var requestBody sync3.Request
 	if req.ContentLength != 0 {
 		defer req.Body.Close()
-		if err := json.NewDecoder(req.Body).Decode(&requestBody); err != nil {
+		body := req.Body
+		if h.maxRequestBodyBytes > 0 {
+			body = http.MaxBytesReader(w, req.Body, h.maxRequestBodyBytes)
+		}
+		if err := json.NewDecoder(body).Decode(&requestBody); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				log.Warn().Int64("limit", maxBytesErr.Limit).Msg("request body too large")
+				return &internal.HandlerError{
+					StatusCode: http.StatusRequestEntityTooLarge,
+					ErrCode:    "M_TOO_LARGE",
+					Err:        fmt.Errorf("request body exceeds %d bytes", maxBytesErr.Limit),
+				}
+			}
 			log.Warn().Err(err).Msg("failed to read/decode request body")
 			return &internal.HandlerError{
 				StatusCode: 400,
@@ -234,6 +547,7 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		if err := requestBody.Validate(); err != nil {
 			return &internal.HandlerError{
 				StatusCode: 400,
+				ErrCode:    "M_INVALID_PARAM",
 				Err:        err,
 			}
 		}
@@ -248,14 +562,6 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		c.Str("txn_id", requestBody.TxnID)
 		return c
 	})
-	for listKey, l := range requestBody.Lists {
-		if l.Ranges != nil && !l.Ranges.Valid() {
-			return &internal.HandlerError{
-				StatusCode: 400,
-				Err:        fmt.Errorf("list[%v] invalid ranges %v", listKey, l.Ranges),
-			}
-		}
-	}
 
 	logErrorOrWarning := func(msg string, herr *internal.HandlerError) {
 		if herr.StatusCode >= 500 {
@@ -267,28 +573,47 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 
 	cancelCtx, cancel := context.WithCancel(req.Context())
 	req = req.WithContext(cancelCtx)
-	req, conn, herr := h.setupConnection(req, cancel, &requestBody, req.URL.Query().Get("pos") != "")
+	// pos and timeout can be in the query params or the body
+	posParam := req.URL.Query().Get("pos")
+	if posParam == "" {
+		posParam = requestBody.Pos
+	}
+	req, conn, herr := h.setupConnection(req, cancel, &requestBody, posParam)
 	if herr != nil {
 		logErrorOrWarning("failed to get or create Conn", herr)
 		return herr
 	}
 	// set pos and timeout if specified
-	cpos, herr := parseIntFromQuery(req.URL, "pos")
-	if herr != nil {
-		return herr
+	var cpos int64
+	if posParam != "" {
+		var err error
+		cpos, err = h.posTokens.Parse(posParam)
+		if errors.Is(err, errPosTokenFromElsewhere) {
+			// e.g a load balancer sent the client to a different instance
+			hlog.FromRequest(req).Warn().Str("user", conn.UserID).Msg("received pos from another instance")
+			return internal.ExpiredSessionError()
+		} else if err != nil {
+			// e.g an integer pos from before tokens were signed, or a client sending garbage. Either
+			// way there's no session we can resume, so tell the client to start a new one rather
+			// than failing the request outright.
+			hlog.FromRequest(req).Warn().Err(err).Str("user", conn.UserID).Msg("received invalid pos")
+			return internal.ExpiredSessionError()
+		}
 	}
 	requestBody.SetPos(cpos)
 	log := hlog.FromRequest(req).With().Str("user", conn.UserID).Int64("pos", cpos).Logger()
 
 	var timeout int
-	if req.URL.Query().Get("timeout") == "" {
-		timeout = sync3.DefaultTimeoutMSecs
-	} else {
-		timeout64, herr := parseIntFromQuery(req.URL, "timeout")
+	if timeoutParam := req.URL.Query().Get("timeout"); timeoutParam != "" {
+		timeout64, herr := parseIntParam("timeout", timeoutParam)
 		if herr != nil {
 			return herr
 		}
 		timeout = int(timeout64)
+	} else if requestBody.Timeout != nil {
+		timeout = int(*requestBody.Timeout)
+	} else {
+		timeout = sync3.DefaultTimeoutMSecs
 	}
 
 	requestBody.SetTimeoutMSecs(timeout)
@@ -320,7 +645,15 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	serialiseStart := time.Now()
+	cw := &countingWriter{w: w}
+	// resp may be sent again if the client retries, so send the token on a copy
+	wireResp := *resp
+	wireResp.Pos = h.posTokens.Mint(resp.PosInt())
+	err := wireResp.EncodeTo(cw, h.eventAge)
+	internal.SetRequestContextSerialiseDuration(req.Context(), time.Since(serialiseStart))
+	h.trackResponseSize(resp, cw.n, cpos == 0)
+	if err != nil {
 		herr = &internal.HandlerError{
 			StatusCode: 500,
 			Err:        err,
@@ -344,7 +677,8 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 // setupConnection associates this request with an existing connection or makes a new connection.
 // It also sets a v2 sync poll loop going if one didn't exist already for this user.
 // When this function returns, the connection is alive and active.
-func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.CancelFunc, syncReq *sync3.Request, containsPos bool) (*http.Request, *sync3.Conn, *internal.HandlerError) {
+func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.CancelFunc, syncReq *sync3.Request, posParam string) (*http.Request, *sync3.Conn, *internal.HandlerError) {
+	containsPos := posParam != ""
 	ctx, task := internal.StartTask(req.Context(), "setupConnection")
 	req = req.WithContext(ctx)
 	defer task.End()
@@ -358,18 +692,38 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 			Err:        err,
 		}
 	}
+	// Appservices act as one of their users by passing its user ID alongside their token.
+	masqueradeUserID := req.URL.Query().Get("user_id")
+	if masqueradeUserID != "" {
+		accessToken = sync2.MasqueradingToken(accessToken, masqueradeUserID)
+	}
+
+	// Creating connections and identifying tokens is expensive (pollers, /whoami), so limit how often
+	// each client can do it.
+	if !containsPos {
+		if herr := h.checkNewConnRateLimit(req); herr != nil {
+			return req, nil, herr
+		}
+	}
 
 	// Try to lookup a record of this token
 	var token *sync2.Token
-	token, err = h.V2Store.TokensTable.Token(accessToken)
+	var isNewToken bool
+	token, err = h.V2Store.Token(accessToken)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			if containsPos {
+				if herr := h.checkNewConnRateLimit(req); herr != nil {
+					return req, nil, herr
+				}
+			}
 			hlog.FromRequest(req).Info().Msg("Received connection from unknown access token, querying with homeserver")
 			newToken, herr := h.identifyUnknownAccessToken(req.Context(), accessToken, hlog.FromRequest(req))
 			if herr != nil {
 				return req, nil, herr
 			}
 			token = newToken
+			isNewToken = true
 		} else {
 			hlog.FromRequest(req).Err(err).Msg("Failed to lookup access token")
 			return req, nil, &internal.HandlerError{
@@ -388,8 +742,16 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	req = req.WithContext(internal.AssociateUserIDWithRequest(req.Context(), token.UserID, token.DeviceID))
 	internal.Logf(req.Context(), "setupConnection", "identified access token as user=%s device=%s", token.UserID, token.DeviceID)
 
+	if allowed, retryAfter := h.userReqLimiter.Allow(token.UserID); !allowed {
+		log.Warn().Dur("retry_after", retryAfter).Msg("rate limiting request, user has exceeded their request budget")
+		if h.rateLimitedReqs != nil {
+			h.rateLimitedReqs.WithLabelValues("user").Inc()
+		}
+		return req, nil, internal.RateLimitedError(retryAfter, "too many requests for this user")
+	}
+
 	// Record the fact that we've recieved a request from this token
-	err = h.V2Store.TokensTable.MaybeUpdateLastSeen(token, time.Now())
+	err = h.V2Store.MaybeUpdateLastSeen(token, time.Now())
 	if err != nil {
 		// Not fatal---log and continue.
 		log.Warn().Err(err).Msg("Unable to update last seen timestamp")
@@ -404,14 +766,64 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	if containsPos {
 		// Lookup the connection
 		conn = h.ConnMap.Conn(connID)
+		if conn != nil && isNewToken {
+			// The device has a new access token, e.g after logging back in from a soft logout, so
+			// make sure it is being polled with it.
+			pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
+			if h.EnsurePoller.EnsurePolling(req.Context(), pid, token.AccessTokenHash) {
+				return req, nil, &internal.HandlerError{
+					StatusCode: http.StatusUnauthorized,
+					ErrCode:    "M_UNKNOWN_TOKEN",
+					Err:        fmt.Errorf("EnsurePolling failed: access token invalid or invalidated"),
+				}
+			}
+		}
 		if conn != nil {
 			conn.SetCancelCallback(cancel)
 			log.Trace().Str("conn", conn.ConnID.String()).Msg("reusing conn")
 			return req, conn, nil
 		}
-		// conn doesn't exist, we probably nuked it.
-		return req, nil, internal.ExpiredSessionError()
+		// conn doesn't exist, either because we nuked it or because we restarted since the client
+		// last used it. In the latter case we may be able to pick up where the client left off.
+		resumeReq, pos := h.loadResumableConnection(connID, posParam, log)
+		if resumeReq == nil {
+			return req, nil, internal.ExpiredSessionError()
+		}
+		return h.createConnection(req, cancel, connID, token, resumeReq, pos, log)
 	}
+	return h.createConnection(req, cancel, connID, token, nil, 0, log)
+}
+
+// loadResumableConnection returns the sticky request stored for this connection before the proxy
+// restarted, and the position the client is at, or nil if the connection can't be resumed.
+func (h *SyncLiveHandler) loadResumableConnection(connID sync3.ConnID, posParam string, log zerolog.Logger) (*sync3.Request, int64) {
+	pos, err := h.posTokens.Parse(posParam)
+	if err != nil || pos == 0 {
+		return nil, 0
+	}
+	reqJSON, err := h.Storage.LoadConnection(connID.UserID, connID.DeviceID, connID.CID, h.clock.Now().Add(-connTTL))
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load stored connection")
+		return nil, 0
+	}
+	if reqJSON == nil {
+		return nil, 0
+	}
+	var resumeReq sync3.Request
+	if err = json.Unmarshal(reqJSON, &resumeReq); err != nil {
+		log.Warn().Err(err).Msg("failed to unmarshal stored connection")
+		return nil, 0
+	}
+	return &resumeReq, pos
+}
+
+// createConnection makes a new connection, or resumes one from before the proxy restarted if
+// resumeReq is set, where the client is at pos. It also sets a v2 sync poll loop going if one didn't
+// exist already for this user.
+func (h *SyncLiveHandler) createConnection(
+	req *http.Request, cancel context.CancelFunc, connID sync3.ConnID, token *sync2.Token,
+	resumeReq *sync3.Request, pos int64, log zerolog.Logger,
+) (*http.Request, *sync3.Conn, *internal.HandlerError) {
 
 	pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
 	log.Trace().Any("pid", pid).Msg("checking poller exists and is running")
@@ -453,22 +865,80 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	// because we *either* do the existing check *or* make a new conn. It's important for CreateConn
 	// to check for an existing connection though, as it's possible for the client to call /sync
 	// twice for a new connection.
-	conn = h.ConnMap.CreateConn(connID, cancel, func() sync3.ConnHandler {
-		return NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
-	})
+	newConnHandler := func() sync3.ConnHandler {
+		var backfiller TimelineBackfiller
+		if h.timelineBackfill {
+			backfiller = &homeserverBackfiller{h: h, userID: token.UserID, deviceID: token.DeviceID, tokenID: token.AccessTokenHash}
+		}
+		cs := NewConnState(
+			token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec,
+			h.maxPendingEventUpdates, h.maxTransactionIDDelay, ConnStateOptions{
+				WakeupCounter:          h.connWakeups,
+				DeliveryHist:           h.deliveryHist,
+				TruncatedResponses:     h.truncatedResponses,
+				MaxRoomsPerResponse:    h.maxRoomsPerResponse,
+				DefaultLists:           h.defaultLists,
+				PhasedInitialSyncRooms: h.phasedInitialSyncRooms,
+				MaxResponseBytes:       h.maxResponseBytes,
+				MaxListOps:             h.maxListOps,
+				Backfiller:             backfiller,
+				InitialLoadSemaphore:   h.initialLoadSem,
+				ResumeRequest:          resumeReq,
+				Saver:                  h.Storage,
+				Clock:                  h.clock,
+			},
+		)
+		cs.hooks = h.hooks
+		return cs
+	}
+	if resumeReq != nil {
+		conn := h.ConnMap.ResumeConn(connID, pos, cancel, newConnHandler)
+		log.Info().Int64("pos", pos).Msg("resumed connection")
+		return req, conn, nil
+	}
+	conn := h.ConnMap.CreateConn(connID, cancel, newConnHandler)
 	log.Info().Msg("created new connection")
 	return req, conn, nil
 }
 
+// checkNewConnRateLimit returns an M_LIMIT_EXCEEDED error if the client IP making this request has
+// created too many connections recently.
+func (h *SyncLiveHandler) checkNewConnRateLimit(req *http.Request) *internal.HandlerError {
+	ip := internal.ClientIP(req, h.trustedProxies)
+	allowed, retryAfter := h.newConnLimiter.Allow(ip)
+	if allowed {
+		return nil
+	}
+	hlog.FromRequest(req).Warn().Str("ip", ip).Dur("retry_after", retryAfter).Msg("rate limiting new connection")
+	if h.rateLimitedReqs != nil {
+		h.rateLimitedReqs.WithLabelValues("new_conn").Inc()
+	}
+	return internal.RateLimitedError(retryAfter, "too many new connections from this address")
+}
+
 func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, accessToken string, logger *zerolog.Logger) (*sync2.Token, *internal.HandlerError) {
-	// We don't recognise the given accessToken. Ask the homeserver who owns it.
-	userID, deviceID, err := h.V2.WhoAmI(ctx, accessToken)
+	// We don't recognise the given accessToken. Ask who owns it, which is the homeserver by default.
+	userID, deviceID, err := h.Auth.WhoAmI(ctx, accessToken)
+	if wantUserID := sync2.MasqueradedUserID(accessToken); err == nil && wantUserID != "" {
+		if userID != wantUserID {
+			return nil, &internal.HandlerError{
+				StatusCode: http.StatusForbidden,
+				Err:        fmt.Errorf("/whoami returned %s when masquerading as %s", userID, wantUserID),
+				ErrCode:    "M_FORBIDDEN",
+			}
+		}
+		if deviceID == "" {
+			// the appservice isn't masquerading as a device, so give each virtual user one device
+			deviceID = sync2.AppserviceDeviceID
+		}
+	}
 	if err != nil {
-		if err == sync2.HTTP401 {
+		if err == sync2.HTTP401 || err == sync2.HTTP401SoftLogout {
 			return nil, &internal.HandlerError{
 				StatusCode: 401,
 				Err:        fmt.Errorf("/whoami returned HTTP 401"),
 				ErrCode:    "M_UNKNOWN_TOKEN",
+				SoftLogout: err == sync2.HTTP401SoftLogout,
 			}
 		}
 		log.Warn().Err(err).Msg("failed to get user ID from device ID")
@@ -478,25 +948,10 @@ func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, access
 		}
 	}
 
-	var token *sync2.Token
-	err = sqlutil.WithTransaction(h.V2Store.DB, func(txn *sqlx.Tx) error {
-		// Create a brand-new row for this token.
-		token, err = h.V2Store.TokensTable.Insert(txn, accessToken, userID, deviceID, time.Now())
-		if err != nil {
-			logger.Warn().Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to insert v2 token")
-			return err
-		}
-
-		// Ensure we have a device row for this token.
-		err = h.V2Store.DevicesTable.InsertDevice(txn, userID, deviceID)
-		if err != nil {
-			log.Warn().Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to insert v2 device")
-			return err
-		}
-		return nil
-	})
-
+	// Create a brand-new row for this token, and a device row if this is a new device.
+	token, err := h.V2Store.InsertTokenAndDevice(accessToken, userID, deviceID, time.Now())
 	if err != nil {
+		log.Warn().Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to store v2 token")
 		return nil, &internal.HandlerError{StatusCode: 500, Err: err}
 	}
 
@@ -528,9 +983,26 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	if ok {
 		return c.(*caches.UserCache), nil
 	}
+	// User caches are only loaded when the user makes their first request. Clients often open
+	// several connections at once, so make sure we only hit the database once per user.
+	c, err, _ := h.userCacheLoads.Do(userID, func() (interface{}, error) {
+		if c, ok := h.userCaches.Load(userID); ok {
+			// another load finished between our check and joining this one
+			return c, nil
+		}
+		return h.loadUserCache(userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.(*caches.UserCache), nil
+}
+
+// loadUserCache creates a user cache from the database and registers it with the dispatcher.
+func (h *SyncLiveHandler) loadUserCache(userID string) (*caches.UserCache, error) {
 	uc := caches.NewUserCache(userID, h.GlobalCache, h.Storage, h, h.Dispatcher)
 	// select all non-zero highlight or notif counts and set them, as this is less costly than looping every room/user pair
-	err := h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
+	err := h.Storage.AllNonZeroUnreadCounts(userID, func(roomID string, highlightCount, notificationCount int) {
 		uc.OnUnreadCounts(context.Background(), roomID, &highlightCount, &notificationCount)
 	})
 	if err != nil {
@@ -554,6 +1026,15 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnAccountData(context.Background(), []state.AccountData{ignoreEvent[0]})
 	}
 
+	// select the manual room order and set room positions
+	orderEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{caches.AccountDataTypeRoomOrder})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load manual room order for user %s: %w", userID, err)
+	}
+	if len(orderEvent) == 1 {
+		uc.OnAccountData(context.Background(), []state.AccountData{orderEvent[0]})
+	}
+
 	// select all room tag account data and set it
 	tagEvents, err := h.Storage.RoomAccountDatasWithType(userID, "m.tag")
 	if err != nil {
@@ -564,7 +1045,7 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	}
 
 	// select outstanding invites
-	invites, err := h.Storage.InvitesTable.SelectAllInvitesForUser(userID)
+	invites, err := h.Storage.AllInvitesForUser(userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load outstanding invites for user: %s", err)
 	}
@@ -623,7 +1104,7 @@ func (h *SyncLiveHandler) DeviceData(ctx context.Context, userID, deviceID strin
 	// Atomically move New to Sent so New is now empty and what was originally in Sent is forgotten.
 	shouldSwap := !isInitial
 
-	dd, err := h.Storage.DeviceDataTable.Select(userID, deviceID, shouldSwap)
+	dd, err := h.Storage.DeviceData(userID, deviceID, shouldSwap)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Msg("failed to SelectAndSwap device data")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -635,7 +1116,7 @@ func (h *SyncLiveHandler) DeviceData(ctx context.Context, userID, deviceID strin
 
 // Implements TransactionIDFetcher
 func (h *SyncLiveHandler) TransactionIDForEvents(userID string, deviceID string, eventIDs []string) (eventIDToTxnID map[string]string) {
-	eventIDToTxnID, err := h.Storage.TransactionsTable.Select(userID, deviceID, eventIDs)
+	eventIDToTxnID, err := h.Storage.TransactionIDs(userID, deviceID, eventIDs)
 	if err != nil {
 		logger.Warn().Str("err", err.Error()).Str("device", deviceID).Msg("failed to select txn IDs for events")
 	}
@@ -650,6 +1131,7 @@ func (h *SyncLiveHandler) OnInitialSyncComplete(p *pubsub.V2InitialSyncComplete)
 func (h *SyncLiveHandler) Accumulate(p *pubsub.V2Accumulate) {
 	ctx, task := internal.StartTask(context.Background(), "Accumulate")
 	defer task.End()
+	ctx = internal.ContextWithCommitTime(ctx, p.CommittedAt)
 	// note: events is sorted in ascending NID order, event if p.EventNIDs isn't.
 	events, err := h.Storage.EventNIDs(p.EventNIDs)
 	if err != nil {
@@ -665,6 +1147,10 @@ func (h *SyncLiveHandler) Accumulate(p *pubsub.V2Accumulate) {
 	for i := range events {
 		h.Dispatcher.OnNewEvent(ctx, p.RoomID, events[i], p.EventNIDs[i])
 	}
+	if h.webhooks != nil {
+		h.webhooks.OnNewEvents(p.RoomID, events)
+	}
+	h.hooks.eventsAccumulated(p.RoomID, events)
 }
 
 // OnTransactionID is called from the v2 poller, implements V2DataReceiver.
@@ -690,6 +1176,9 @@ func (h *SyncLiveHandler) Initialise(p *pubsub.V2Initialise) {
 	}
 	// we have new state, notify caches
 	h.Dispatcher.OnNewInitialRoomState(ctx, p.RoomID, state)
+	if h.webhooks != nil {
+		h.webhooks.OnNewRoomState(p.RoomID, state)
+	}
 }
 
 func (h *SyncLiveHandler) OnUnreadCounts(p *pubsub.V2UnreadCounts) {
@@ -734,7 +1223,7 @@ func (h *SyncLiveHandler) OnInvite(p *pubsub.V2InviteRoom) {
 	if !ok {
 		return
 	}
-	inviteState, err := h.Storage.InvitesTable.SelectInviteState(p.UserID, p.RoomID)
+	inviteState, err := h.Storage.InviteState(p.UserID, p.RoomID)
 	if err != nil {
 		logger.Err(err).Str("user", p.UserID).Str("room", p.RoomID).Msg("failed to get invite state")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -786,15 +1275,29 @@ func (h *SyncLiveHandler) OnReceipt(p *pubsub.V2Receipt) {
 }
 
 func (h *SyncLiveHandler) OnTyping(p *pubsub.V2Typing) {
+	h.typing.OnTyping(p.RoomID, p.EphemeralEvent)
+}
+
+func (h *SyncLiveHandler) dispatchTyping(roomID string, ephEvent json.RawMessage) {
 	ctx, task := internal.StartTask(context.Background(), "OnTyping")
 	defer task.End()
-	rooms := h.GlobalCache.LoadRooms(ctx, p.RoomID)
-	if rooms[p.RoomID] != nil {
-		if reflect.DeepEqual(p.EphemeralEvent, rooms[p.RoomID].TypingEvent) {
+	rooms := h.GlobalCache.LoadRooms(ctx, roomID)
+	if rooms[roomID] != nil {
+		if reflect.DeepEqual(ephEvent, rooms[roomID].TypingEvent) {
 			return // it's a duplicate, which happens when 2+ users are in the same room
 		}
 	}
-	h.Dispatcher.OnEphemeralEvent(ctx, p.RoomID, p.EphemeralEvent)
+	h.typingExpiry.OnTyping(roomID, ephEvent)
+	h.Dispatcher.OnEphemeralEvent(ctx, roomID, ephEvent)
+}
+
+// expireTyping tells connections that nobody is typing in these rooms, as there have been no typing
+// updates for them in a while.
+func (h *SyncLiveHandler) expireTyping(roomIDs []string) {
+	logger.Debug().Strs("rooms", roomIDs).Msg("expiring stale typing notifications")
+	for _, roomID := range roomIDs {
+		h.typing.OnTyping(roomID, json.RawMessage(`{"type":"m.typing","content":{"user_ids":[]}}`))
+	}
 }
 
 func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
@@ -815,6 +1318,17 @@ func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
 
 func (h *SyncLiveHandler) OnExpiredToken(p *pubsub.V2ExpiredToken) {
 	h.EnsurePoller.OnExpiredToken(p)
+	// Soft logged out devices keep their connections, so clients can carry on where they left off
+	// once they have logged back in.
+	if !p.SoftLogout {
+		h.ConnMap.CloseConnsForDevice(p.UserID, p.DeviceID)
+	}
+}
+
+func (h *SyncLiveHandler) OnPollerDied(p *pubsub.V2PollerDied) {
+	h.EnsurePoller.OnPollerDied(p)
+	// Close the device's connections so E2EE clients don't believe they are up to date whilst
+	// nothing is polling for their to-device messages. Their next request will poll again.
 	h.ConnMap.CloseConnsForDevice(p.UserID, p.DeviceID)
 }
 
@@ -876,17 +1390,28 @@ func (h *SyncLiveHandler) OnInvalidateRoom(p *pubsub.V2InvalidateRoom) {
 		Int("del_user_caches", len(unregistered)).Int("conns_destroyed", destroyed).Msg("OnInvalidateRoom")
 }
 
-func parseIntFromQuery(u *url.URL, param string) (result int64, err *internal.HandlerError) {
-	queryPos := u.Query().Get(param)
-	if queryPos != "" {
+func parseIntParam(param, value string) (result int64, err *internal.HandlerError) {
+	if value != "" {
 		var err error
-		result, err = strconv.ParseInt(queryPos, 10, 64)
+		result, err = strconv.ParseInt(value, 10, 64)
 		if err != nil {
 			return 0, &internal.HandlerError{
 				StatusCode: 400,
-				Err:        fmt.Errorf("invalid %s: %s", param, queryPos),
+				Err:        fmt.Errorf("invalid %s: %s", param, value),
 			}
 		}
 	}
 	return
 }
+
+// countingWriter counts the number of bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
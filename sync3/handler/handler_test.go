@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestTrackResponseSize(t *testing.T) {
+	newHistVec := func(name string) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name}, []string{"initial"})
+	}
+	h := &SyncLiveHandler{
+		responseBytesHistVec: newHistVec("bytes"),
+		responseOpsHistVec:   newHistVec("ops"),
+		responseRoomsHistVec: newHistVec("rooms"),
+	}
+	resp := &sync3.Response{
+		Rooms: map[string]sync3.Room{
+			"!a:localhost": {Name: "A"},
+			"!b:localhost": {Name: "B"},
+		},
+		Lists: map[string]sync3.ResponseList{
+			"a": {Ops: []sync3.ResponseOp{
+				&sync3.ResponseOpRange{Operation: sync3.OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"!a:localhost", "!b:localhost"}},
+			}},
+			"b": {Ops: []sync3.ResponseOp{
+				&sync3.ResponseOpSingle{Operation: sync3.OpInvalidate},
+				&sync3.ResponseOpSingle{Operation: sync3.OpInvalidate},
+			}},
+		},
+	}
+	var buf bytes.Buffer
+	cw := &countingWriter{w: &buf}
+	if err := json.NewEncoder(cw).Encode(resp); err != nil {
+		t.Fatalf("failed to encode response: %s", err)
+	}
+	if cw.n != int64(buf.Len()) {
+		t.Fatalf("countingWriter counted %d bytes, want %d", cw.n, buf.Len())
+	}
+	h.trackResponseSize(resp, cw.n, true)
+	h.trackResponseSize(&sync3.Response{}, 2, false)
+
+	histSum := func(hv *prometheus.HistogramVec, initial string) (count uint64, sum float64) {
+		var m dto.Metric
+		if err := hv.WithLabelValues(initial).(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatalf("failed to read histogram: %s", err)
+		}
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	testCases := []struct {
+		name      string
+		hv        *prometheus.HistogramVec
+		initial   string
+		wantCount uint64
+		wantSum   float64
+	}{
+		{name: "initial bytes", hv: h.responseBytesHistVec, initial: "1", wantCount: 1, wantSum: float64(buf.Len())},
+		{name: "initial ops", hv: h.responseOpsHistVec, initial: "1", wantCount: 1, wantSum: 3},
+		{name: "initial rooms", hv: h.responseRoomsHistVec, initial: "1", wantCount: 1, wantSum: 2},
+		{name: "incremental bytes", hv: h.responseBytesHistVec, initial: "0", wantCount: 1, wantSum: 2},
+		{name: "incremental ops", hv: h.responseOpsHistVec, initial: "0", wantCount: 1, wantSum: 0},
+		{name: "incremental rooms", hv: h.responseRoomsHistVec, initial: "0", wantCount: 1, wantSum: 0},
+	}
+	for _, tc := range testCases {
+		count, sum := histSum(tc.hv, tc.initial)
+		if count != tc.wantCount || sum != tc.wantSum {
+			t.Errorf("%s: got count=%d sum=%v, want count=%d sum=%v", tc.name, count, sum, tc.wantCount, tc.wantSum)
+		}
+	}
+
+	// no metrics is fine
+	(&SyncLiveHandler{}).trackResponseSize(resp, cw.n, true)
+}
+
+// stubV2Store is a V2Store which stores tokens in memory. Methods which aren't overridden panic.
+type stubV2Store struct {
+	V2Store
+	tokens []*sync2.Token
+}
+
+func (s *stubV2Store) InsertTokenAndDevice(accessToken, userID, deviceID string, lastSeen time.Time) (*sync2.Token, error) {
+	token := &sync2.Token{AccessToken: accessToken, UserID: userID, DeviceID: deviceID, LastSeen: lastSeen}
+	s.tokens = append(s.tokens, token)
+	return token, nil
+}
+
+func TestIdentifyUnknownAccessTokenUsesAuthenticator(t *testing.T) {
+	store := &stubV2Store{}
+	h := &SyncLiveHandler{
+		Auth: sync2.StaticAuthenticator{
+			"alice_token": {UserID: "@alice:localhost", DeviceID: "ALICE"},
+		},
+		V2Store: store,
+	}
+	token, herr := h.identifyUnknownAccessToken(context.Background(), "alice_token", &logger)
+	if herr != nil {
+		t.Fatalf("identifyUnknownAccessToken: %s", herr)
+	}
+	if token.UserID != "@alice:localhost" || token.DeviceID != "ALICE" {
+		t.Errorf("got token for %s %s want @alice:localhost ALICE", token.UserID, token.DeviceID)
+	}
+	if len(store.tokens) != 1 {
+		t.Errorf("stored %d tokens want 1", len(store.tokens))
+	}
+	_, herr = h.identifyUnknownAccessToken(context.Background(), "bob_token", &logger)
+	if herr == nil || herr.StatusCode != 401 || herr.ErrCode != "M_UNKNOWN_TOKEN" {
+		t.Errorf("got %v for unknown token, want 401 M_UNKNOWN_TOKEN", herr)
+	}
+}
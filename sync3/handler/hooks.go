@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// Hooks are called when sync activity happens, so programs which embed the proxy can react to it
+// (e.g to warm caches or trigger bots) without polling the database. Any hook may be nil.
+//
+// Hooks are called synchronously on the goroutine doing the work, which holds up syncing for
+// everyone, so they must return quickly and hand slow work to another goroutine. Arguments must not
+// be modified.
+type Hooks struct {
+	// OnEventAccumulated is called with each batch of new timeline events stored for a room, in
+	// timeline order.
+	OnEventAccumulated func(roomID string, events []*internal.Event)
+	// OnRoomJoined is called when a join event for userID arrives in a room's timeline. It is
+	// called for every user, not only those using the proxy.
+	OnRoomJoined func(userID, roomID string)
+	// OnListChanged is called when a response to a connection has operations for one of its lists.
+	OnListChanged func(userID, deviceID, listKey string, list sync3.ResponseList)
+}
+
+// hookRegistry holds the hooks added to a SyncLiveHandler. A nil registry has no hooks.
+type hookRegistry struct {
+	mu    sync.RWMutex
+	hooks []Hooks
+}
+
+func (r *hookRegistry) add(hooks Hooks) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, hooks)
+}
+
+func (r *hookRegistry) each(fn func(hooks *Hooks)) {
+	if r == nil {
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := range r.hooks {
+		fn(&r.hooks[i])
+	}
+}
+
+func (r *hookRegistry) eventsAccumulated(roomID string, events []*internal.Event) {
+	r.each(func(hooks *Hooks) {
+		if hooks.OnEventAccumulated != nil {
+			hooks.OnEventAccumulated(roomID, events)
+		}
+		if hooks.OnRoomJoined == nil {
+			return
+		}
+		for _, ev := range events {
+			if ev.IsMembershipChange && ev.StateKey != nil && ev.Content.Get("membership").Str == "join" {
+				hooks.OnRoomJoined(*ev.StateKey, roomID)
+			}
+		}
+	})
+}
+
+func (r *hookRegistry) listsChanged(userID, deviceID string, lists map[string]sync3.ResponseList) {
+	r.each(func(hooks *Hooks) {
+		if hooks.OnListChanged == nil {
+			return
+		}
+		for listKey, list := range lists {
+			if len(list.Ops) > 0 {
+				hooks.OnListChanged(userID, deviceID, listKey, list)
+			}
+		}
+	})
+}
+
+// AddHooks registers hooks which are called when sync activity happens. Hooks can't be removed.
+func (h *SyncLiveHandler) AddHooks(hooks Hooks) {
+	h.hooks.add(hooks)
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestHooks(t *testing.T) {
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	roomID := "!room:localhost"
+	events := []*internal.Event{
+		internal.NewEvent(testutils.NewJoinEvent(t, alice)),
+		internal.NewEvent(testutils.NewMessageEvent(t, alice, "hello")),
+		// a profile change, not a join
+		internal.NewEvent(testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{
+			"membership": "join", "displayname": "Alice",
+		}, testutils.WithUnsigned(map[string]interface{}{
+			"prev_content": map[string]interface{}{"membership": "join"},
+		}))),
+		internal.NewEvent(testutils.NewJoinEvent(t, bob)),
+	}
+
+	var accumulated [][]*internal.Event
+	var joined []string
+	var changedLists []string
+	r := &hookRegistry{}
+	r.add(Hooks{
+		OnEventAccumulated: func(gotRoomID string, evs []*internal.Event) {
+			if gotRoomID != roomID {
+				t.Errorf("OnEventAccumulated: got room %s want %s", gotRoomID, roomID)
+			}
+			accumulated = append(accumulated, evs)
+		},
+		OnRoomJoined: func(userID, gotRoomID string) {
+			joined = append(joined, userID+" "+gotRoomID)
+		},
+	})
+	r.add(Hooks{
+		OnListChanged: func(userID, deviceID, listKey string, list sync3.ResponseList) {
+			changedLists = append(changedLists, userID+" "+deviceID+" "+listKey)
+		},
+	})
+
+	r.eventsAccumulated(roomID, events)
+	if len(accumulated) != 1 || len(accumulated[0]) != len(events) {
+		t.Errorf("OnEventAccumulated: got %v", accumulated)
+	}
+	wantJoined := []string{alice + " " + roomID, bob + " " + roomID}
+	if !reflect.DeepEqual(joined, wantJoined) {
+		t.Errorf("OnRoomJoined: got %v want %v", joined, wantJoined)
+	}
+
+	r.listsChanged(alice, "DEVICE", map[string]sync3.ResponseList{
+		"a": {Ops: []sync3.ResponseOp{&sync3.ResponseOpSingle{Operation: sync3.OpInvalidate}}},
+		"b": {Count: 5},
+	})
+	if !reflect.DeepEqual(changedLists, []string{alice + " DEVICE a"}) {
+		t.Errorf("OnListChanged: got %v", changedLists)
+	}
+
+	// connections made without hooks have a nil registry
+	var none *hookRegistry
+	none.eventsAccumulated(roomID, events)
+	none.listsChanged(alice, "DEVICE", map[string]sync3.ResponseList{"a": {Ops: []sync3.ResponseOp{nil}}})
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// Pagination tokens issued by the proxy. Local tokens paginate back from an event NID. Homeserver
+	// tokens wrap a token which must be paginated on the homeserver, as the proxy has nothing older.
+	// Any other token is the homeserver's, e.g a prev_batch from a sliding sync timeline.
+	localMessagesTokenPrefix      = "syncv3_"
+	homeserverMessagesTokenPrefix = "syncv3_hs_"
+
+	defaultMessagesLimit = 10
+	maxMessagesLimit     = 100
+)
+
+// MessagesStore is the storage used by the messages API. Implemented by state.Storage.
+type MessagesStore interface {
+	LatestEventNID() (int64, error)
+	MessagesBefore(userID, roomID string, to int64, limit int) (events []state.Event, prevBatch string, err error)
+	PrevBatchEventNID(roomID, prevBatch string) (int64, error)
+	GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string)
+}
+
+// MessagesAPI serves GET /rooms/{roomID}/messages from the events the proxy has stored, so that
+// paginating back from a sliding sync timeline returns events in the same order. When the proxy
+// has no more events, or the request needs something it can't serve (e.g forwards pagination or
+// filters), the request is forwarded to the homeserver.
+type MessagesAPI struct {
+	store      MessagesStore
+	homeserver http.Handler
+	// returns the stored token for an access token, or sql.ErrNoRows
+	tokenFn func(accessToken string) (*sync2.Token, error)
+	// returns true if the user has ignored the sender
+	ignoreFn func(userID, sender string) bool
+}
+
+// NewMessagesAPI returns a messages API for h, which forwards requests it can't serve to homeserver.
+func NewMessagesAPI(h *SyncLiveHandler, homeserver http.Handler) *MessagesAPI {
+	return &MessagesAPI{
+		store:      h.Storage,
+		homeserver: homeserver,
+		tokenFn:    h.V2Store.Token,
+		ignoreFn: func(userID, sender string) bool {
+			uc := h.CacheForUser(userID)
+			return uc != nil && uc.ShouldIgnore(sender)
+		},
+	}
+}
+
+// MessagesResponse is the response to /messages.
+type MessagesResponse struct {
+	Chunk []json.RawMessage `json:"chunk"`
+	Start string            `json:"start"`
+	End   string            `json:"end,omitempty"`
+}
+
+func (a *MessagesAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	roomID := mux.Vars(req)["roomID"]
+	query := req.URL.Query()
+	from := query.Get("from")
+	if hsFrom, ok := strings.CutPrefix(from, homeserverMessagesTokenPrefix); ok {
+		a.forward(w, req, hsFrom)
+		return
+	}
+	fromNID, isLocal := parseLocalMessagesToken(from)
+	fallback := func() {
+		if isLocal {
+			// the homeserver will need a token it understands
+			from = a.store.GetClosestPrevBatch(roomID, fromNID)
+			if from == "" {
+				// the proxy has nothing older and no way to ask the homeserver for more
+				writeMessagesResponse(w, MessagesResponse{
+					Chunk: []json.RawMessage{},
+					Start: query.Get("from"),
+				})
+				return
+			}
+		}
+		a.forward(w, req, from)
+	}
+	if req.Method != "GET" || query.Get("dir") != "b" || query.Has("filter") || query.Has("to") {
+		fallback()
+		return
+	}
+	accessToken, err := internal.ExtractAccessToken(req)
+	if err != nil || accessToken == "" {
+		// let the homeserver reject it
+		fallback()
+		return
+	}
+	if masqueradeUserID := query.Get("user_id"); masqueradeUserID != "" {
+		accessToken = sync2.MasqueradingToken(accessToken, masqueradeUserID)
+	}
+	token, err := a.tokenFn(accessToken)
+	if err == sql.ErrNoRows {
+		// the proxy doesn't know who this is, so can't check what they can see
+		fallback()
+		return
+	} else if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	limit := defaultMessagesLimit
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			writeAdminError(w, &internal.HandlerError{
+				StatusCode: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid limit: %s", l),
+				ErrCode:    "M_INVALID_PARAM",
+			})
+			return
+		}
+	}
+	if limit == 0 {
+		limit = defaultMessagesLimit
+	} else if limit > maxMessagesLimit {
+		limit = maxMessagesLimit
+	}
+
+	var upper int64
+	switch {
+	case isLocal:
+		upper = fromNID - 1
+	case from == "":
+		upper, err = a.store.LatestEventNID()
+	default:
+		var nid int64
+		nid, err = a.store.PrevBatchEventNID(roomID, from)
+		if err == nil && nid == 0 {
+			// not a token for events we have
+			a.forward(w, req, from)
+			return
+		}
+		upper = nid - 1
+	}
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	events, prevBatch, err := a.store.MessagesBefore(token.UserID, roomID, upper, limit)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if len(events) == 0 {
+		fallback()
+		return
+	}
+	res := MessagesResponse{
+		Chunk: make([]json.RawMessage, 0, len(events)),
+		Start: query.Get("from"),
+	}
+	if len(events) == limit && !events[len(events)-1].MissingPrevious {
+		res.End = localMessagesTokenPrefix + strconv.FormatInt(events[len(events)-1].NID, 10)
+	} else if prevBatch != "" {
+		// we've reached a gap or the start of the user's visible history, so continue on the homeserver
+		res.End = homeserverMessagesTokenPrefix + prevBatch
+	}
+	for _, ev := range events {
+		parsed := gjson.ParseBytes(ev.JSON)
+		if !parsed.Get("state_key").Exists() && a.ignoreFn(token.UserID, parsed.Get("sender").Str) {
+			continue
+		}
+		evJSON := ev.JSON
+		if !parsed.Get("room_id").Exists() {
+			// sync timelines omit the room ID but /messages includes it
+			evJSON, _ = sjson.SetBytes(evJSON, "room_id", roomID)
+		}
+		res.Chunk = append(res.Chunk, evJSON)
+	}
+	writeMessagesResponse(w, res)
+}
+
+// forward sends the request to the homeserver, paginating from the given token.
+func (a *MessagesAPI) forward(w http.ResponseWriter, req *http.Request, from string) {
+	query := req.URL.Query()
+	if from == "" {
+		query.Del("from")
+	} else {
+		query.Set("from", from)
+	}
+	req.URL.RawQuery = query.Encode()
+	a.homeserver.ServeHTTP(w, req)
+}
+
+func writeMessagesResponse(w http.ResponseWriter, res MessagesResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(res)
+}
+
+// parseLocalMessagesToken returns the NID in a local pagination token.
+func parseLocalMessagesToken(token string) (int64, bool) {
+	nidStr, ok := strings.CutPrefix(token, localMessagesTokenPrefix)
+	if !ok {
+		return 0, false
+	}
+	nid, err := strconv.ParseInt(nidStr, 10, 64)
+	return nid, err == nil
+}
@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/tidwall/gjson"
+)
+
+// stubMessagesStore holds a single room's timeline, with NIDs 1..len(events).
+type stubMessagesStore struct {
+	events []state.Event
+	// NID -> prev_batch
+	prevBatches map[int64]string
+	// the oldest NID the user can see
+	visibleFrom int64
+}
+
+func (s *stubMessagesStore) LatestEventNID() (int64, error) {
+	return int64(len(s.events)), nil
+}
+
+func (s *stubMessagesStore) MessagesBefore(userID, roomID string, to int64, limit int) ([]state.Event, string, error) {
+	var events []state.Event
+	for nid := to; nid >= s.visibleFrom && nid >= 1 && len(events) < limit; nid-- {
+		ev := s.events[nid-1]
+		events = append(events, ev)
+		if ev.MissingPrevious {
+			break
+		}
+	}
+	if len(events) == 0 {
+		return nil, "", nil
+	}
+	return events, s.GetClosestPrevBatch(roomID, events[len(events)-1].NID), nil
+}
+
+func (s *stubMessagesStore) PrevBatchEventNID(roomID, prevBatch string) (int64, error) {
+	for nid, pb := range s.prevBatches {
+		if pb == prevBatch && !s.events[nid-1].MissingPrevious {
+			return nid, nil
+		}
+	}
+	return 0, nil
+}
+
+func (s *stubMessagesStore) GetClosestPrevBatch(roomID string, eventNID int64) string {
+	for nid := eventNID; nid <= int64(len(s.events)); nid++ {
+		if pb, ok := s.prevBatches[nid]; ok {
+			return pb
+		}
+	}
+	return ""
+}
+
+func TestMessagesAPI(t *testing.T) {
+	roomID := "!messages:localhost"
+	store := &stubMessagesStore{
+		prevBatches: map[int64]string{1: "hs_before_1", 4: "hs_before_4"},
+		visibleFrom: 1,
+	}
+	for i := 1; i <= 8; i++ {
+		store.events = append(store.events, state.Event{
+			NID:             int64(i),
+			JSON:            []byte(fmt.Sprintf(`{"event_id":"$%d","type":"m.room.message","sender":"@bob:localhost"}`, i)),
+			MissingPrevious: i == 4,
+		})
+	}
+	var forwardedFrom string
+	homeserver := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwardedFrom = req.URL.Query().Get("from")
+		w.WriteHeader(http.StatusTeapot)
+	})
+	api := &MessagesAPI{
+		store:      store,
+		homeserver: homeserver,
+		tokenFn: func(accessToken string) (*sync2.Token, error) {
+			if accessToken != "alice_token" {
+				return nil, sql.ErrNoRows
+			}
+			return &sync2.Token{AccessToken: accessToken, UserID: "@alice:localhost", DeviceID: "A"}, nil
+		},
+		ignoreFn: func(userID, sender string) bool {
+			return false
+		},
+	}
+	r := mux.NewRouter()
+	r.Handle("/rooms/{roomID}/messages", api)
+
+	testCases := []struct {
+		desc          string
+		query         string
+		token         string
+		wantForwarded bool
+		wantFrom      string
+		wantEventIDs  []string
+		wantEnd       string
+	}{
+		{
+			desc:         "from the latest event",
+			query:        "dir=b&limit=3",
+			wantEventIDs: []string{"$8", "$7", "$6"},
+			wantEnd:      "syncv3_6",
+		},
+		{
+			desc:         "from a local token, stopping at a gap",
+			query:        "dir=b&limit=3&from=syncv3_6",
+			wantEventIDs: []string{"$5", "$4"},
+			wantEnd:      "syncv3_hs_hs_before_4",
+		},
+		{
+			desc:          "from a homeserver token issued by the proxy",
+			query:         "dir=b&from=syncv3_hs_hs_before_4",
+			wantForwarded: true,
+			wantFrom:      "hs_before_4",
+		},
+		{
+			desc:          "from a prev_batch before a gap",
+			query:         "dir=b&from=hs_before_4",
+			wantForwarded: true,
+			wantFrom:      "hs_before_4",
+		},
+		{
+			desc:          "from an unknown token",
+			query:         "dir=b&from=unknown",
+			wantForwarded: true,
+			wantFrom:      "unknown",
+		},
+		{
+			desc:          "forwards pagination",
+			query:         "dir=f&from=syncv3_3",
+			wantForwarded: true,
+			wantFrom:      "hs_before_4",
+		},
+		{
+			desc:          "with a filter",
+			query:         "dir=b&filter=%7B%7D",
+			wantForwarded: true,
+		},
+		{
+			desc:          "unknown access token",
+			query:         "dir=b",
+			token:         "bob_token",
+			wantForwarded: true,
+		},
+		{
+			desc:          "no more local events",
+			query:         "dir=b&from=syncv3_1",
+			wantForwarded: true,
+			wantFrom:      "hs_before_1",
+		},
+	}
+	for _, tc := range testCases {
+		forwardedFrom = ""
+		req := httptest.NewRequest("GET", "/rooms/"+roomID+"/messages?"+tc.query, nil)
+		token := tc.token
+		if token == "" {
+			token = "alice_token"
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if tc.wantForwarded {
+			if w.Code != http.StatusTeapot {
+				t.Errorf("%s: got status %d, want request forwarded to the homeserver", tc.desc, w.Code)
+			}
+			if forwardedFrom != tc.wantFrom {
+				t.Errorf("%s: forwarded from %q want %q", tc.desc, forwardedFrom, tc.wantFrom)
+			}
+			continue
+		}
+		if w.Code != 200 {
+			t.Fatalf("%s: got status %d: %s", tc.desc, w.Code, w.Body.String())
+		}
+		var res MessagesResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: failed to unmarshal response: %s", tc.desc, err)
+		}
+		var gotEventIDs []string
+		for _, ev := range res.Chunk {
+			gotEventIDs = append(gotEventIDs, gjson.GetBytes(ev, "event_id").Str)
+			if gjson.GetBytes(ev, "room_id").Str != roomID {
+				t.Errorf("%s: event has no room_id: %s", tc.desc, ev)
+			}
+		}
+		if fmt.Sprint(gotEventIDs) != fmt.Sprint(tc.wantEventIDs) {
+			t.Errorf("%s: got events %v want %v", tc.desc, gotEventIDs, tc.wantEventIDs)
+		}
+		if res.End != tc.wantEnd {
+			t.Errorf("%s: got end %q want %q", tc.desc, res.End, tc.wantEnd)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidPosToken       = errors.New("invalid pos")
+	errPosTokenFromElsewhere = errors.New("pos was issued by another instance")
+)
+
+// posTokens mints and checks the position tokens sent to clients as `pos`. Connections only
+// exist on the instance which created them, so tokens identify that instance, and are signed so
+// that clients can't forge or guess positions.
+type posTokens struct {
+	instanceID string
+	key        []byte
+}
+
+// newPosTokens returns tokens signed with a key derived from the secret. The instance ID is
+// derived from the secret and the configured instance name rather than picked at random, so that
+// tokens minted before a restart are still recognised afterwards, while instances which share a
+// secret but are given different names can tell each other's tokens apart.
+func newPosTokens(secret, instanceName string) *posTokens {
+	key := sha256.Sum256([]byte("pos_token:" + secret))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("instance:" + instanceName))
+	return &posTokens{
+		instanceID: hex.EncodeToString(mac.Sum(nil)[:8]),
+		key:        key[:],
+	}
+}
+
+// Mint returns the token for this connection position.
+func (p *posTokens) Mint(pos int64) string {
+	payload := p.instanceID + "_" + strconv.FormatInt(pos, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + p.sign(payload)
+}
+
+// Parse returns the connection position in a token. Returns errInvalidPosToken if the token is
+// malformed or wasn't signed by us, and errPosTokenFromElsewhere if it was minted by another
+// instance.
+func (p *posTokens) Parse(token string) (int64, error) {
+	encodedPayload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, errInvalidPosToken
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return 0, errInvalidPosToken
+	}
+	payload := string(payloadBytes)
+	if !hmac.Equal([]byte(sig), []byte(p.sign(payload))) {
+		return 0, errInvalidPosToken
+	}
+	instanceID, posStr, ok := strings.Cut(payload, "_")
+	if !ok {
+		return 0, errInvalidPosToken
+	}
+	pos, err := strconv.ParseInt(posStr, 10, 64)
+	if err != nil || pos < 0 {
+		return 0, errInvalidPosToken
+	}
+	if instanceID != p.instanceID {
+		return 0, errPosTokenFromElsewhere
+	}
+	return pos, nil
+}
+
+func (p *posTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
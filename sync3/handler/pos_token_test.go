@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPosTokens(t *testing.T) {
+	tokens := newPosTokens("secret", "")
+	for _, pos := range []int64{0, 1, 1234567890} {
+		token := tokens.Mint(pos)
+		got, err := tokens.Parse(token)
+		if err != nil {
+			t.Fatalf("Parse(%s) returned error: %s", token, err)
+		}
+		if got != pos {
+			t.Errorf("Parse(%s) got %d want %d", token, got, pos)
+		}
+	}
+
+	token := tokens.Mint(5)
+	payload, sig, _ := strings.Cut(token, ".")
+	tampered := []byte(sig)
+	tampered[0] ^= 1
+	otherKey := newPosTokens("other secret", "")
+	otherKey.instanceID = tokens.instanceID
+	invalid := []string{
+		"",
+		"5",
+		payload,
+		payload + ".",
+		payload + "." + string(tampered),
+		otherKey.Mint(5),
+		otherKey.Mint(6)[:len(payload)] + "." + sig,
+	}
+	for _, tok := range invalid {
+		if _, err := tokens.Parse(tok); !errors.Is(err, errInvalidPosToken) {
+			t.Errorf("Parse(%q) got error %v want %v", tok, err, errInvalidPosToken)
+		}
+	}
+
+	// same secret and name, e.g after a restart
+	restarted := newPosTokens("secret", "")
+	if got, err := restarted.Parse(tokens.Mint(5)); err != nil || got != 5 {
+		t.Errorf("Parse() after restart got (%d, %v) want (5, nil)", got, err)
+	}
+
+	// same secret, different name
+	otherInstance := newPosTokens("secret", "some-other-instance")
+	if _, err := tokens.Parse(otherInstance.Mint(5)); !errors.Is(err, errPosTokenFromElsewhere) {
+		t.Errorf("Parse() of another instance's token got error %v want %v", err, errPosTokenFromElsewhere)
+	}
+}
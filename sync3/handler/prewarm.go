@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+const (
+	// the most accounts to prewarm at once, so the homeserver isn't flooded with initial syncs
+	maxParallelPrewarms = 4
+	// the most errors to remember for the status endpoint
+	maxPrewarmErrors = 100
+)
+
+// PrewarmAccount is an account to start polling for ahead of its first request.
+type PrewarmAccount struct {
+	// UserID, if set, is checked against the user who owns the access token.
+	UserID      string `json:"user_id,omitempty"`
+	AccessToken string `json:"access_token"`
+}
+
+// PrewarmStatus describes the progress of prewarming accounts since the proxy started.
+type PrewarmStatus struct {
+	Queued     int `json:"queued"`
+	InProgress int `json:"in_progress"`
+	Done       int `json:"done"`
+	Failed     int `json:"failed"`
+	// The most recent failures, oldest first. Access tokens are never included.
+	Errors []string `json:"errors"`
+}
+
+// prewarmer starts pollers for accounts and waits for their initial syncs to be processed, a few
+// at a time, so that migrating many users to the proxy doesn't make them all do their initial
+// syncs when they first open their clients.
+type prewarmer struct {
+	h *SyncLiveHandler
+	// prewarms a single account, replaceable in tests
+	prewarmFn func(ctx context.Context, account PrewarmAccount) error
+	mu        sync.Mutex
+	queue     []PrewarmAccount
+	workers   int
+	status    PrewarmStatus
+}
+
+func newPrewarmer(h *SyncLiveHandler) *prewarmer {
+	p := &prewarmer{
+		h: h,
+		status: PrewarmStatus{
+			Errors: []string{},
+		},
+	}
+	p.prewarmFn = p.prewarm
+	return p
+}
+
+// Add queues the accounts to be prewarmed in the background.
+func (p *prewarmer) Add(accounts []PrewarmAccount) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queue = append(p.queue, accounts...)
+	p.status.Queued += len(accounts)
+	for p.workers < maxParallelPrewarms && p.workers < len(p.queue) {
+		p.workers++
+		go p.work()
+	}
+}
+
+// Status returns the progress so far.
+func (p *prewarmer) Status() PrewarmStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := p.status
+	status.Errors = append([]string{}, p.status.Errors...)
+	return status
+}
+
+func (p *prewarmer) work() {
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			p.workers--
+			p.mu.Unlock()
+			return
+		}
+		account := p.queue[0]
+		p.queue = p.queue[1:]
+		p.status.Queued--
+		p.status.InProgress++
+		p.mu.Unlock()
+
+		err := p.prewarmFn(context.Background(), account)
+
+		p.mu.Lock()
+		p.status.InProgress--
+		if err != nil {
+			p.status.Failed++
+			p.status.Errors = append(p.status.Errors, err.Error())
+			if len(p.status.Errors) > maxPrewarmErrors {
+				p.status.Errors = p.status.Errors[1:]
+			}
+		} else {
+			p.status.Done++
+		}
+		p.mu.Unlock()
+	}
+}
+
+// prewarm identifies the access token, then blocks until the device's poller has processed its
+// initial sync.
+func (p *prewarmer) prewarm(ctx context.Context, account PrewarmAccount) error {
+	token, err := p.h.V2Store.Token(account.AccessToken)
+	if err == sql.ErrNoRows {
+		var herr *internal.HandlerError
+		token, herr = p.h.identifyUnknownAccessToken(ctx, account.AccessToken, &logger)
+		if herr != nil {
+			return fmt.Errorf("failed to identify access token for %q: %s", account.UserID, herr)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to look up access token for %q: %s", account.UserID, err)
+	}
+	if account.UserID != "" && token.UserID != account.UserID {
+		return fmt.Errorf("access token for %q belongs to %s", account.UserID, token.UserID)
+	}
+	pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
+	if expired := p.h.EnsurePoller.EnsurePolling(ctx, pid, token.AccessTokenHash); expired {
+		return fmt.Errorf("access token for %s device %s has expired", token.UserID, token.DeviceID)
+	}
+	logger.Info().Str("user", token.UserID).Str("device", token.DeviceID).Msg("prewarmed account")
+	return nil
+}
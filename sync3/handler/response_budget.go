@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// responseBudget limits how much is sent in one response, and remembers what was left out so that
+// it is sent in the following responses. Every limit on the size of a response goes through here:
+//   - maxRooms caps the rooms SYNCed by list operations, by splitting ranges.
+//   - phasedRooms sends large initial responses without room data, then fills it in.
+//   - maxBytes caps the encoded size of room data, trimming list operations to match.
+//   - maxListOps caps the list operations from live updates, by SYNCing busy lists instead.
+//
+// List ranges which were left out are SYNCed again later from pendingRanges, and rooms whose data
+// was left out are sent again later from pendingFill. Only used on the conn goroutine.
+type responseBudget struct {
+	maxRooms    int
+	phasedRooms int
+	maxBytes    int
+	maxListOps  int
+
+	pendingRanges map[string]sync3.SliceRanges // list key -> ranges not yet SYNCed
+	pendingFill   []BuiltSubscription
+	// the number of rooms which can still be SYNCed in the current response, if maxRooms is set.
+	roomsLeft int
+	// lists which reached maxListOps in the current response. Further live updates to them are
+	// coalesced into SYNCs of their ranges in the next response rather than sent as list operations.
+	throttledLists map[string]struct{}
+	// true if something was left out of the current response to be sent later.
+	truncated          bool
+	truncatedResponses prometheus.Counter
+}
+
+func newResponseBudget(opts ConnStateOptions) responseBudget {
+	return responseBudget{
+		maxRooms:           opts.MaxRoomsPerResponse,
+		phasedRooms:        opts.PhasedInitialSyncRooms,
+		maxBytes:           opts.MaxResponseBytes,
+		maxListOps:         opts.MaxListOps,
+		pendingRanges:      make(map[string]sync3.SliceRanges),
+		truncatedResponses: opts.TruncatedResponses,
+	}
+}
+
+// start resets the budget for a new response.
+func (b *responseBudget) start() {
+	b.roomsLeft = b.maxRooms
+	b.truncated = false
+}
+
+// finish ends the current response. Lists which were throttled are SYNCed in full in the next
+// response, if the client still wants them. Returns true if there is more to send.
+func (b *responseBudget) finish(ctx context.Context, reqLists map[string]sync3.RequestList) (pending bool) {
+	for listKey := range b.throttledLists {
+		if reqList, ok := reqLists[listKey]; ok {
+			b.deferRanges(listKey, reqList.Ranges)
+		}
+	}
+	b.throttledLists = nil
+	if b.truncated {
+		internal.Logf(ctx, "connstate", "truncated response: ranges=%v fill=%d", b.pendingRanges, len(b.pendingFill))
+		if b.truncatedResponses != nil {
+			b.truncatedResponses.Inc()
+		}
+	}
+	return len(b.pendingRanges) > 0 || len(b.pendingFill) > 0
+}
+
+// deferRanges remembers ranges of a list which should be SYNCed in a following response.
+func (b *responseBudget) deferRanges(listKey string, ranges sync3.SliceRanges) {
+	if len(ranges) == 0 {
+		return
+	}
+	b.pendingRanges[listKey] = append(b.pendingRanges[listKey], ranges...)
+	b.truncated = true
+}
+
+// takeRanges returns and forgets the ranges of a list which were left out of earlier responses.
+func (b *responseBudget) takeRanges(listKey string) sync3.SliceRanges {
+	pending := b.pendingRanges[listKey]
+	delete(b.pendingRanges, listKey)
+	return pending
+}
+
+// pendingListKeys returns the lists with ranges left out of earlier responses, in a stable order.
+func (b *responseBudget) pendingListKeys() []string {
+	keys := internal.Keys(b.pendingRanges)
+	sort.Strings(keys)
+	return keys
+}
+
+// fitRange returns the part of the range r which can be SYNCed in this response, deferring the
+// rest. Returns false if none of it fits.
+func (b *responseBudget) fitRange(listKey string, r [2]int64, listLen int64) ([2]int64, bool) {
+	if b.maxRooms <= 0 {
+		return r, true
+	}
+	if b.roomsLeft <= 0 {
+		b.deferRanges(listKey, sync3.SliceRanges{r})
+		return r, false
+	}
+	end := r[1]
+	if end >= listLen {
+		end = listLen - 1
+	}
+	if end-r[0]+1 > int64(b.roomsLeft) {
+		split := r[0] + int64(b.roomsLeft)
+		b.deferRanges(listKey, sync3.SliceRanges{{split, r[1]}})
+		r[1] = split - 1
+	}
+	return r, true
+}
+
+// spendRooms records that n rooms were SYNCed in this response.
+func (b *responseBudget) spendRooms(n int) {
+	b.roomsLeft -= n
+}
+
+// phase strips the room data from built subscriptions if this is an initial response with at
+// least phasedRooms rooms, so clients can render the room list straight away. The data is filled
+// in over the following responses.
+func (b *responseBudget) phase(ctx context.Context, builtSubs []BuiltSubscription, isInitial bool) []BuiltSubscription {
+	if b.phasedRooms <= 0 || !isInitial {
+		return builtSubs
+	}
+	numRooms := 0
+	for _, bs := range builtSubs {
+		numRooms += len(bs.RoomIDs)
+	}
+	if numRooms < b.phasedRooms {
+		return builtSubs
+	}
+	internal.Logf(ctx, "connstate", "phasing initial sync of %d rooms", numRooms)
+	b.pendingFill = append(b.pendingFill, builtSubs...)
+	stripped := make([]BuiltSubscription, len(builtSubs))
+	for i, bs := range builtSubs {
+		stripped[i] = BuiltSubscription{
+			// heroes are needed to show the names of unnamed rooms
+			RoomSubscription: sync3.RoomSubscription{Heroes: bs.RoomSubscription.Heroes},
+			RoomIDs:          bs.RoomIDs,
+		}
+	}
+	return stripped
+}
+
+// takeFill adds rooms which are waiting for their data to be sent to the builder, up to
+// phasedRooms rooms if set. Rooms for which wanted returns false are dropped.
+func (b *responseBudget) takeFill(ctx context.Context, builder *RoomsBuilder, wanted func(roomID string) bool) {
+	budget := b.phasedRooms
+	if budget <= 0 {
+		budget = math.MaxInt
+	}
+	for budget > 0 && len(b.pendingFill) > 0 {
+		bs := &b.pendingFill[0]
+		n := len(bs.RoomIDs)
+		if n > budget {
+			n = budget
+		}
+		var roomIDs []string
+		for _, roomID := range bs.RoomIDs[:n] {
+			if wanted(roomID) {
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+		if len(roomIDs) > 0 {
+			subID := builder.AddSubscription(bs.RoomSubscription)
+			builder.AddRoomsToSubscription(ctx, subID, roomIDs)
+		}
+		budget -= n
+		bs.RoomIDs = bs.RoomIDs[n:]
+		if len(bs.RoomIDs) == 0 {
+			b.pendingFill = b.pendingFill[1:]
+		}
+	}
+}
+
+// fitBytes removes rooms from the response once their encoded size exceeds maxBytes. Rooms are
+// kept in the order they appear in list SYNC operations, which are trimmed to the rooms that fit;
+// the rest of each range is SYNCed again in a following response. The data of every room which
+// was removed is remembered in pendingFill. At least one room is always sent, so the connection
+// makes progress however large rooms are.
+func (b *responseBudget) fitBytes(ctx context.Context, builtSubs []BuiltSubscription, response *sync3.Response) {
+	if b.maxBytes <= 0 || len(response.Rooms) == 0 {
+		return
+	}
+	size := 0
+	full := false
+	kept := make(map[string]bool, len(response.Rooms))
+	fits := func(roomID string) bool {
+		if kept[roomID] {
+			return true
+		}
+		room, ok := response.Rooms[roomID]
+		if !ok {
+			return true // no data to send
+		}
+		if full {
+			return false
+		}
+		roomSize := room.EncodedSize()
+		if size > 0 && size+roomSize > b.maxBytes {
+			full = true
+			return false
+		}
+		size += roomSize
+		kept[roomID] = true
+		return true
+	}
+
+	// rooms in list SYNC operations come first, in list order
+	listKeys := internal.Keys(response.Lists)
+	sort.Strings(listKeys)
+	for _, listKey := range listKeys {
+		resList := response.Lists[listKey]
+		ops := resList.Ops[:0]
+		for _, op := range resList.Ops {
+			syncOp, ok := op.(*sync3.ResponseOpRange)
+			if !ok || syncOp.Operation != sync3.OpSync {
+				ops = append(ops, op)
+				continue
+			}
+			n := 0
+			for n < len(syncOp.RoomIDs) && fits(syncOp.RoomIDs[n]) {
+				n++
+			}
+			if n < len(syncOp.RoomIDs) {
+				b.deferRanges(listKey, sync3.SliceRanges{{syncOp.Range[0] + int64(n), syncOp.Range[1]}})
+				syncOp.RoomIDs = syncOp.RoomIDs[:n]
+				syncOp.Range[1] = syncOp.Range[0] + int64(n) - 1
+			}
+			if n > 0 {
+				ops = append(ops, syncOp)
+			}
+		}
+		resList.Ops = ops
+		response.Lists[listKey] = resList
+	}
+
+	// then rooms which are only subscribed to or being filled in
+	numTruncated := 0
+	for _, bs := range builtSubs {
+		var truncated []string
+		for _, roomID := range bs.RoomIDs {
+			if _, ok := response.Rooms[roomID]; !ok || fits(roomID) {
+				continue
+			}
+			delete(response.Rooms, roomID)
+			truncated = append(truncated, roomID)
+		}
+		if len(truncated) > 0 {
+			b.pendingFill = append(b.pendingFill, BuiltSubscription{
+				RoomSubscription: bs.RoomSubscription,
+				RoomIDs:          truncated,
+			})
+			numTruncated += len(truncated)
+			b.truncated = true
+		}
+	}
+	if numTruncated > 0 {
+		internal.Logf(ctx, "connstate", "response size limit reached after %d bytes, %d rooms pending", size, numTruncated)
+	}
+}
+
+// listOpCounts returns the number of operations for each list in the response, or nil if list
+// operations aren't limited.
+func (b *responseBudget) listOpCounts(response *sync3.Response) map[string]int {
+	if b.maxListOps <= 0 {
+		return nil
+	}
+	counts := make(map[string]int, len(response.Lists))
+	for listKey, resList := range response.Lists {
+		counts[listKey] = len(resList.Ops)
+	}
+	return counts
+}
+
+// limitListOps keeps the response within maxListOps after a live update has been processed, given
+// the number of operations each list had before it. If the update took the response over the
+// limit, the operations it added are removed and those lists are throttled. Throttled lists lose
+// any further operations in this response, and are SYNCed in full in the next one instead, so a
+// burst of updates costs one operation per range however long it is.
+func (b *responseBudget) limitListOps(response *sync3.Response, opsBefore map[string]int) {
+	if opsBefore == nil {
+		return
+	}
+	overLimit := response.ListOps() > b.maxListOps
+	for listKey, resList := range response.Lists {
+		before := opsBefore[listKey]
+		if len(resList.Ops) == before {
+			continue
+		}
+		if _, throttled := b.throttledLists[listKey]; !throttled && !overLimit {
+			continue
+		}
+		resList.Ops = resList.Ops[:before]
+		response.Lists[listKey] = resList
+		if b.throttledLists == nil {
+			b.throttledLists = make(map[string]struct{})
+		}
+		b.throttledLists[listKey] = struct{}{}
+	}
+}
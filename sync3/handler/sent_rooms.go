@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// sentRoomFields are the values of a room's optional fields which the client was last sent.
+type sentRoomFields struct {
+	name         string
+	avatar       sync3.AvatarChange
+	heroes       []internal.Hero
+	joinedCount  int
+	invitedCount *int
+	timestamp    uint64
+}
+
+// sentRooms remembers what this connection last sent about each room, so fields which have not
+// changed can be left out of incremental room updates. Rooms are forgotten once the client stops
+// tracking them, so this doesn't grow with every room the client has ever scrolled past. Only used
+// on the conn goroutine.
+type sentRooms map[string]*sentRoomFields
+
+// suppressUnchanged removes fields from rooms which are not initial if the client already has the
+// same values, then records the values being sent. Initial rooms replace whatever the client had,
+// so they are always sent in full.
+func (s sentRooms) suppressUnchanged(rooms map[string]sync3.Room) {
+	for roomID, room := range rooms {
+		sent := s[roomID]
+		if room.Initial || sent == nil {
+			sent = &sentRoomFields{}
+			s[roomID] = sent
+		} else {
+			if room.Name == sent.name {
+				room.Name = ""
+			}
+			if room.AvatarChange == sent.avatar {
+				room.AvatarChange = sync3.UnchangedAvatar
+			}
+			if room.Heroes != nil && sameHeroes(room.Heroes, sent.heroes) {
+				room.Heroes = nil
+			}
+			if room.JoinedCount == sent.joinedCount {
+				room.JoinedCount = 0
+			}
+			if room.InvitedCount != nil && sent.invitedCount != nil && *room.InvitedCount == *sent.invitedCount {
+				room.InvitedCount = nil
+			}
+			if room.Timestamp == sent.timestamp {
+				room.Timestamp = 0
+			}
+			rooms[roomID] = room
+		}
+		// omitted fields are unchanged, so only remember fields which are set
+		if room.Name != "" {
+			sent.name = room.Name
+		}
+		if room.AvatarChange != sync3.UnchangedAvatar {
+			sent.avatar = room.AvatarChange
+		}
+		if room.Heroes != nil {
+			sent.heroes = room.Heroes
+		}
+		if room.JoinedCount != 0 {
+			sent.joinedCount = room.JoinedCount
+		}
+		if room.InvitedCount != nil {
+			invitedCount := *room.InvitedCount
+			sent.invitedCount = &invitedCount
+		}
+		if room.Timestamp != 0 {
+			sent.timestamp = room.Timestamp
+		}
+	}
+}
+
+// forget drops rooms for which isTracked returns false. Rooms are sent with initial: true when
+// they come back into view, so nothing needs to be remembered about them until then.
+func (s sentRooms) forget(isTracked func(roomID string) bool) {
+	for roomID := range s {
+		if !isTracked(roomID) {
+			delete(s, roomID)
+		}
+	}
+}
+
+func sameHeroes(a, b []internal.Hero) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
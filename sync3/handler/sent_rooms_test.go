@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestSentRoomsSuppressUnchanged(t *testing.T) {
+	one := 1
+	two := 2
+	heroes := []internal.Hero{{ID: "@bob:localhost", Name: "Bob"}}
+	sent := make(sentRooms)
+
+	testCases := []struct {
+		name string
+		in   sync3.Room
+		want sync3.Room
+	}{
+		{
+			name: "initial rooms are sent in full",
+			in: sync3.Room{
+				Name: "Room", AvatarChange: sync3.DeletedAvatar, Heroes: heroes, JoinedCount: 2,
+				InvitedCount: &one, Timestamp: 100, NotificationCount: 1, Initial: true,
+			},
+			want: sync3.Room{
+				Name: "Room", AvatarChange: sync3.DeletedAvatar, Heroes: heroes, JoinedCount: 2,
+				InvitedCount: &one, Timestamp: 100, NotificationCount: 1, Initial: true,
+			},
+		},
+		{
+			name: "unchanged fields are omitted",
+			in: sync3.Room{
+				Name: "Room", AvatarChange: sync3.DeletedAvatar, Heroes: heroes, JoinedCount: 2,
+				InvitedCount: &one, Timestamp: 100, NotificationCount: 1, NumLive: 1,
+			},
+			want: sync3.Room{NotificationCount: 1, NumLive: 1},
+		},
+		{
+			name: "changed fields are sent",
+			in: sync3.Room{
+				Name: "New name", AvatarChange: sync3.DeletedAvatar, JoinedCount: 3, InvitedCount: &two, Timestamp: 200,
+			},
+			want: sync3.Room{Name: "New name", JoinedCount: 3, InvitedCount: &two, Timestamp: 200},
+		},
+		{
+			name: "values are compared to the last sent",
+			in:   sync3.Room{Name: "Room", JoinedCount: 3, Timestamp: 200},
+			want: sync3.Room{Name: "Room"},
+		},
+		{
+			name: "initial rooms are sent in full even if unchanged",
+			in:   sync3.Room{Name: "Room", JoinedCount: 3, Timestamp: 200, Initial: true},
+			want: sync3.Room{Name: "Room", JoinedCount: 3, Timestamp: 200, Initial: true},
+		},
+	}
+	for _, tc := range testCases {
+		rooms := map[string]sync3.Room{"!a:localhost": tc.in}
+		sent.suppressUnchanged(rooms)
+		assertVal(t, rooms["!a:localhost"], tc.want)
+	}
+
+	// other rooms are unaffected
+	rooms := map[string]sync3.Room{"!b:localhost": {Name: "Room", Timestamp: 200}}
+	sent.suppressUnchanged(rooms)
+	assertVal(t, rooms["!b:localhost"], sync3.Room{Name: "Room", Timestamp: 200})
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+)
+
+// Store is the storage used by the sync v3 handler, which reads what the v2 pollers have stored.
+// Implemented by state.Storage and state.MemoryStorage. Other implementations let the handler run
+// against other backends, or serve canned data in tests.
+type Store interface {
+	caches.GlobalCacheStore
+	caches.UserCacheStore
+	extensions.Store
+	MessagesStore
+	stateQuerier
+	auditLog
+	ConnSaver
+
+	// GlobalSnapshot loads the metadata of every room, calling onJoinedMember for every joined member.
+	GlobalSnapshot(onJoinedMember state.JoinedMemberFunc) (state.StartupSnapshot, error)
+	AllNonZeroUnreadCounts(userID string, callback func(roomID string, highlightCount, notificationCount int)) error
+	AccountData(userID, roomID string, eventTypes []string) ([]state.AccountData, error)
+	RoomAccountDatasWithType(userID, eventType string) ([]state.AccountData, error)
+	AllInvitesForUser(userID string) (map[string][]json.RawMessage, error)
+	InviteState(userID, roomID string) ([]json.RawMessage, error)
+	DeviceData(userID, deviceID string, swap bool) (*internal.DeviceData, error)
+	TransactionIDs(userID, deviceID string, eventIDs []string) (map[string]string, error)
+	EventNIDs(eventNIDs []int64) ([]*internal.Event, error)
+	StateSnapshot(snapID int64) ([]json.RawMessage, error)
+	FetchMemberships(roomID string) (joins, invites, leaves []string, err error)
+	// TimelineLimit is the most timeline events stored per room, 0 for no limit.
+	TimelineLimit() int
+	// BackfillTimeline stores events which /messages returned to userID, newest first.
+	BackfillTimeline(userID, roomID string, events []json.RawMessage, prevBatch string) error
+	// BackfilledTimeline returns up to limit events previously backfilled for userID, newest first.
+	BackfilledTimeline(userID, roomID string, limit int) (events []json.RawMessage, prevBatch string, ok bool, err error)
+	// LoadConnection returns the sticky request saved for this connection after `after`, or nil.
+	LoadConnection(userID, deviceID, connID string, after time.Time) ([]byte, error)
+	Teardown()
+}
+
+// V2Store is the storage of access tokens and devices used by the sync v3 handler. Implemented by
+// sync2.Storage and sync2.MemoryStore.
+type V2Store interface {
+	// Token returns the stored token for an access token, or sql.ErrNoRows if there isn't one.
+	Token(accessToken string) (*sync2.Token, error)
+	GetTokenAndSince(userID, deviceID, tokenHash string) (accessToken, since string, err error)
+	MaybeUpdateLastSeen(token *sync2.Token, newLastSeen time.Time) error
+	InsertTokenAndDevice(accessToken, userID, deviceID string, lastSeen time.Time) (*sync2.Token, error)
+}
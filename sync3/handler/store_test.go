@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+// stubStore is a Store which serves canned data. Methods which aren't overridden panic.
+type stubStore struct {
+	Store
+	metadata     map[string]internal.RoomMetadata
+	joined       map[string][]string
+	unread       map[string][2]int
+	globalData   map[string]json.RawMessage
+	invites      map[string][]json.RawMessage
+	latestEvents map[string]*state.LatestEvents
+}
+
+func (s *stubStore) GlobalSnapshot(onJoinedMember state.JoinedMemberFunc) (state.StartupSnapshot, error) {
+	for roomID, userIDs := range s.joined {
+		for _, userID := range userIDs {
+			onJoinedMember(roomID, userID)
+		}
+	}
+	return state.StartupSnapshot{GlobalMetadata: s.metadata}, nil
+}
+
+func (s *stubStore) LatestEventNID() (int64, error) {
+	return 1, nil
+}
+
+func (s *stubStore) JoinedRoomsAfterPosition(userID string, pos int64) (map[string]internal.EventMetadata, error) {
+	joined := make(map[string]internal.EventMetadata)
+	for roomID, userIDs := range s.joined {
+		for _, u := range userIDs {
+			if u == userID {
+				joined[roomID] = internal.EventMetadata{NID: 1}
+			}
+		}
+	}
+	return joined, nil
+}
+
+func (s *stubStore) LatestEventMetadataInRooms(roomIDs []string, highestNID int64) (map[string]state.RoomLatestEvent, error) {
+	return nil, nil
+}
+
+func (s *stubStore) AllNonZeroUnreadCounts(userID string, callback func(roomID string, highlightCount, notificationCount int)) error {
+	for roomID, counts := range s.unread {
+		callback(roomID, counts[0], counts[1])
+	}
+	return nil
+}
+
+func (s *stubStore) AccountData(userID, roomID string, eventTypes []string) ([]state.AccountData, error) {
+	var data []state.AccountData
+	for _, evType := range eventTypes {
+		if ev, ok := s.globalData[evType]; ok && roomID == sync2.AccountDataGlobalRoom {
+			data = append(data, state.AccountData{UserID: userID, RoomID: roomID, Type: evType, Data: ev})
+		}
+	}
+	return data, nil
+}
+
+func (s *stubStore) RoomAccountDatasWithType(userID, eventType string) ([]state.AccountData, error) {
+	return nil, nil
+}
+
+func (s *stubStore) AllInvitesForUser(userID string) (map[string][]json.RawMessage, error) {
+	return s.invites, nil
+}
+
+func (s *stubStore) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int, filter *internal.TimelineFilter) (map[string]*state.LatestEvents, error) {
+	result := make(map[string]*state.LatestEvents, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if le, ok := s.latestEvents[roomID]; ok {
+			result[roomID] = le
+		}
+	}
+	return result, nil
+}
+
+// The sync v3 handler only talks to storage through Store, so it can load its caches without a
+// database.
+func TestSyncLiveHandlerWithStubStore(t *testing.T) {
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	dmRoom := "!dm:localhost"
+	inviteRoom := "!invite:localhost"
+	msg := testutils.NewMessageEvent(t, bob, "hello")
+	dmMetadata := internal.NewRoomMetadata(dmRoom)
+	dmMetadata.JoinCount = 2
+	dmMetadata.LastMessageTimestamp = 1
+	store := &stubStore{
+		metadata: map[string]internal.RoomMetadata{dmRoom: *dmMetadata},
+		joined:   map[string][]string{dmRoom: {alice, bob}},
+		unread:   map[string][2]int{dmRoom: {1, 4}},
+		globalData: map[string]json.RawMessage{
+			"m.direct": testutils.NewAccountData(t, "m.direct", map[string][]string{bob: {dmRoom}}),
+		},
+		invites: map[string][]json.RawMessage{
+			inviteRoom: {testutils.NewStateEvent(t, "m.room.member", alice, bob, map[string]interface{}{"membership": "invite"})},
+		},
+		latestEvents: map[string]*state.LatestEvents{
+			dmRoom: {Timeline: []json.RawMessage{msg}, LatestNID: 1},
+		},
+	}
+	h := &SyncLiveHandler{
+		Storage:     store,
+		userCaches:  &sync.Map{},
+		Dispatcher:  sync3.NewDispatcher(),
+		GlobalCache: caches.NewGlobalCache(store),
+	}
+	if err := h.Startup(); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	if !h.Dispatcher.IsUserJoined(alice, dmRoom) {
+		t.Errorf("alice is not joined to %s after startup", dmRoom)
+	}
+	uc, err := h.userCache(alice)
+	if err != nil {
+		t.Fatalf("userCache: %s", err)
+	}
+	dm := uc.LoadRoomData(dmRoom)
+	if !dm.IsDM {
+		t.Errorf("%s is not a DM", dmRoom)
+	}
+	if dm.HighlightCount != 1 || dm.NotificationCount != 4 {
+		t.Errorf("got counts %d/%d want 1/4", dm.HighlightCount, dm.NotificationCount)
+	}
+	if invite := uc.LoadRoomData(inviteRoom); !invite.IsInvite {
+		t.Errorf("%s is not an invite", inviteRoom)
+	}
+	timelines := uc.LazyLoadTimelines(context.Background(), 1, []string{dmRoom}, 10, nil)
+	if got := timelines[dmRoom].Timeline; len(got) != 1 || !bytes.Equal(got[0], msg) {
+		t.Errorf("got timeline %s want [%s]", got, msg)
+	}
+}
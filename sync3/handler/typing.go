@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+)
+
+// typingCoalescer limits how often typing notifications are dispatched for each room, as busy rooms
+// can see many typing changes per second. The first change in a room is dispatched immediately.
+// Changes during the following debounce window are held back, and only the latest is dispatched
+// when the window ends.
+type typingCoalescer struct {
+	debounce time.Duration
+	clock    internal.Clock
+	dispatch func(roomID string, ephEvent json.RawMessage)
+
+	mu sync.Mutex
+	// rooms which are in a debounce window -> the latest typing event which hasn't been dispatched
+	// yet, or nil if there isn't one.
+	pending map[string]json.RawMessage
+}
+
+func newTypingCoalescer(debounce time.Duration, clock internal.Clock, dispatch func(roomID string, ephEvent json.RawMessage)) *typingCoalescer {
+	return &typingCoalescer{
+		debounce: debounce,
+		clock:    clock,
+		dispatch: dispatch,
+		pending:  make(map[string]json.RawMessage),
+	}
+}
+
+func (c *typingCoalescer) OnTyping(roomID string, ephEvent json.RawMessage) {
+	if c.debounce <= 0 {
+		c.dispatch(roomID, ephEvent)
+		return
+	}
+	c.mu.Lock()
+	if _, inWindow := c.pending[roomID]; inWindow {
+		c.pending[roomID] = ephEvent
+		c.mu.Unlock()
+		return
+	}
+	c.pending[roomID] = nil
+	c.mu.Unlock()
+	c.dispatch(roomID, ephEvent)
+	c.flushAfterDebounce(roomID)
+}
+
+// flush dispatches the latest held back typing event for this room at the end of its debounce
+// window, starting a new window if there was one.
+func (c *typingCoalescer) flush(roomID string) {
+	c.mu.Lock()
+	ephEvent := c.pending[roomID]
+	if ephEvent == nil {
+		delete(c.pending, roomID)
+		c.mu.Unlock()
+		return
+	}
+	c.pending[roomID] = nil
+	c.mu.Unlock()
+	c.dispatch(roomID, ephEvent)
+	c.flushAfterDebounce(roomID)
+}
+
+func (c *typingCoalescer) flushAfterDebounce(roomID string) {
+	go func() {
+		defer internal.ReportPanicsToSentry()
+		<-c.clock.After(c.debounce)
+		c.flush(roomID)
+	}()
+}
+
+// typingExpiry clears typing notifications in rooms which have had no typing updates for a while,
+// so users don't appear to be typing forever if the update which stopped them was missed, e.g
+// because the pollers for the room were down.
+type typingExpiry struct {
+	ttl   time.Duration
+	clock internal.Clock
+	// called with the rooms whose typing notifications have expired
+	expire func(roomIDs []string)
+
+	mu sync.Mutex
+	// rooms with users typing -> when the typing notification was received
+	lastUpdated map[string]time.Time
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func newTypingExpiry(ttl time.Duration, clock internal.Clock, expire func(roomIDs []string)) *typingExpiry {
+	return &typingExpiry{
+		ttl:         ttl,
+		clock:       clock,
+		expire:      expire,
+		lastUpdated: make(map[string]time.Time),
+		stop:        make(chan struct{}),
+	}
+}
+
+// OnTyping records a typing notification which has been sent to connections.
+func (e *typingExpiry) OnTyping(roomID string, ephEvent json.RawMessage) {
+	if e.ttl <= 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(gjson.GetBytes(ephEvent, "content.user_ids").Array()) == 0 {
+		delete(e.lastUpdated, roomID)
+		return
+	}
+	e.lastUpdated[roomID] = e.clock.Now()
+}
+
+// sweep returns the rooms whose typing notifications have expired, and stops tracking them.
+func (e *typingExpiry) sweep() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var expired []string
+	for roomID, updatedAt := range e.lastUpdated {
+		if e.clock.Since(updatedAt) >= e.ttl {
+			expired = append(expired, roomID)
+			delete(e.lastUpdated, roomID)
+		}
+	}
+	return expired
+}
+
+// Start sweeps for expired typing notifications in the background until Stop is called.
+func (e *typingExpiry) Start() {
+	if e.ttl <= 0 {
+		return
+	}
+	go func() {
+		defer internal.ReportPanicsToSentry()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-e.clock.After(e.ttl / 2):
+			}
+			if expired := e.sweep(); len(expired) > 0 {
+				e.expire(expired)
+			}
+		}
+	}()
+}
+
+func (e *typingExpiry) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stop)
+	})
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+type dispatchedTyping struct {
+	roomID string
+	event  string
+}
+
+func TestTypingCoalescer(t *testing.T) {
+	var mu sync.Mutex
+	var dispatched []dispatchedTyping
+	clock := testutils.NewFakeClock(time.Now())
+	c := newTypingCoalescer(50*time.Millisecond, clock, func(roomID string, ephEvent json.RawMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		dispatched = append(dispatched, dispatchedTyping{roomID, string(ephEvent)})
+	})
+	getDispatched := func() []dispatchedTyping {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]dispatchedTyping(nil), dispatched...)
+	}
+
+	// the first change in each room is sent immediately
+	c.OnTyping("!a", json.RawMessage(`1`))
+	c.OnTyping("!b", json.RawMessage(`1`))
+	assertVal(t, getDispatched(), []dispatchedTyping{{"!a", "1"}, {"!b", "1"}})
+
+	// further changes in the window are coalesced into the latest
+	c.OnTyping("!a", json.RawMessage(`2`))
+	c.OnTyping("!a", json.RawMessage(`3`))
+	assertVal(t, len(getDispatched()), 2)
+	waitForWaiters(t, clock, 2)
+	clock.Advance(50 * time.Millisecond)
+	waitForDispatched(t, getDispatched, 3)
+	assertVal(t, getDispatched(), []dispatchedTyping{{"!a", "1"}, {"!b", "1"}, {"!a", "3"}})
+
+	// once a window passes without changes, the next change is sent immediately again
+	waitForWaiters(t, clock, 1) // the window started by dispatching "3"
+	clock.Advance(50 * time.Millisecond)
+	waitForPendingFlushed(t, c, "!a")
+	c.OnTyping("!a", json.RawMessage(`4`))
+	assertVal(t, getDispatched(), []dispatchedTyping{{"!a", "1"}, {"!b", "1"}, {"!a", "3"}, {"!a", "4"}})
+}
+
+func waitForWaiters(t *testing.T, clock *testutils.FakeClock, n int) {
+	t.Helper()
+	start := time.Now()
+	for clock.Waiters() != n {
+		if time.Since(start) > time.Second {
+			t.Fatalf("got %d clock waiters, want %d", clock.Waiters(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitForDispatched(t *testing.T, getDispatched func() []dispatchedTyping, n int) {
+	t.Helper()
+	start := time.Now()
+	for len(getDispatched()) < n {
+		if time.Since(start) > time.Second {
+			t.Fatalf("got %d dispatched typing events, want %d", len(getDispatched()), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitForPendingFlushed(t *testing.T, c *typingCoalescer, roomID string) {
+	t.Helper()
+	start := time.Now()
+	for {
+		c.mu.Lock()
+		_, inWindow := c.pending[roomID]
+		c.mu.Unlock()
+		if !inWindow {
+			return
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("debounce window for %s never ended", roomID)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTypingCoalescerDisabled(t *testing.T) {
+	var dispatched []string
+	c := newTypingCoalescer(0, internal.RealClock, func(roomID string, ephEvent json.RawMessage) {
+		dispatched = append(dispatched, string(ephEvent))
+	})
+	c.OnTyping("!a", json.RawMessage(`1`))
+	c.OnTyping("!a", json.RawMessage(`2`))
+	assertVal(t, dispatched, []string{"1", "2"})
+}
+
+func TestTypingExpiry(t *testing.T) {
+	clock := testutils.NewFakeClock(time.Now())
+	expiredCh := make(chan []string, 10)
+	e := newTypingExpiry(time.Minute, clock, func(roomIDs []string) {
+		sort.Strings(roomIDs)
+		expiredCh <- roomIDs
+	})
+	e.Start()
+	defer e.Stop()
+	waitForSweeper := func() {
+		t.Helper()
+		start := time.Now()
+		for clock.Waiters() == 0 {
+			if time.Since(start) > time.Second {
+				t.Fatalf("sweeper never waited")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	e.OnTyping("!a", json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@alice:localhost"]}}`))
+	e.OnTyping("!b", json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@bob:localhost"]}}`))
+	e.OnTyping("!c", json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@charlie:localhost"]}}`))
+	// nobody is typing in !c any more, so it doesn't need expiring
+	e.OnTyping("!c", json.RawMessage(`{"type":"m.typing","content":{"user_ids":[]}}`))
+
+	waitForSweeper()
+	clock.Advance(30 * time.Second)
+	// !b is refreshed, so expires later than !a
+	e.OnTyping("!b", json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@bob:localhost","@alice:localhost"]}}`))
+	waitForSweeper()
+	clock.Advance(30 * time.Second)
+	assertVal(t, <-expiredCh, []string{"!a"})
+
+	waitForSweeper()
+	clock.Advance(30 * time.Second)
+	assertVal(t, <-expiredCh, []string{"!b"})
+
+	// expired rooms are only expired once
+	waitForSweeper()
+	clock.Advance(time.Minute)
+	waitForSweeper()
+	select {
+	case roomIDs := <-expiredCh:
+		t.Fatalf("rooms expired twice: %v", roomIDs)
+	default:
+	}
+}
@@ -38,6 +38,7 @@ type RoomDelta struct {
 	InviteCountChanged       bool
 	NotificationCountChanged bool
 	HighlightCountChanged    bool
+	IsDMChanged              bool
 	Lists                    []RoomListDelta
 }
 
@@ -65,14 +66,15 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 		if existing.HighlightCount != r.HighlightCount {
 			delta.HighlightCountChanged = true
 		}
+		delta.IsDMChanged = existing.IsDM != r.IsDM
 		delta.InviteCountChanged = !existing.SameInviteCount(&r.RoomMetadata)
 		delta.JoinCountChanged = !existing.SameJoinCount(&r.RoomMetadata)
 		delta.RoomNameChanged = !existing.SameRoomName(&r.RoomMetadata)
 		if delta.RoomNameChanged {
 			// update the canonical name to allow room name sorting to continue to work
-			roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
+			r.CalculatedName, r.NameFromHeroes = internal.CalculateRoomName(&r.RoomMetadata, 5)
 			r.CanonicalisedName = strings.ToLower(
-				strings.Trim(roomName, "#!():_@"),
+				strings.Trim(r.CalculatedName, "#!():_@"),
 			)
 		} else {
 			// XXX: during TestConnectionTimeoutNotReset there is some situation where
@@ -84,6 +86,8 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 			//        b) that is not expected, in which case... erm, I don't know what
 			//           to conclude.
 			r.CanonicalisedName = existing.CanonicalisedName
+			r.CalculatedName = existing.CalculatedName
+			r.NameFromHeroes = existing.NameFromHeroes
 		}
 		delta.RoomAvatarChanged = !existing.SameRoomAvatar(&r)
 		if delta.RoomAvatarChanged {
@@ -108,11 +112,27 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 				}
 			}
 		}
+		// and likewise for NIDs
+		newNIDs := r.LastInterestedEventNIDs
+		r.LastInterestedEventNIDs = make(map[string]int64, len(s.lists))
+		for listKey := range s.lists {
+			newNID, bump := newNIDs[listKey]
+			if bump {
+				r.LastInterestedEventNIDs[listKey] = newNID
+			} else {
+				prevNID, hadPreviousNID := existing.LastInterestedEventNIDs[listKey]
+				if hadPreviousNID {
+					r.LastInterestedEventNIDs[listKey] = prevNID
+				} else {
+					r.LastInterestedEventNIDs[listKey] = existing.LastMessageNID()
+				}
+			}
+		}
 	} else {
 		// set the canonical name to allow room name sorting to work
-		roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
+		r.CalculatedName, r.NameFromHeroes = internal.CalculateRoomName(&r.RoomMetadata, 5)
 		r.CanonicalisedName = strings.ToLower(
-			strings.Trim(roomName, "#!():_@"),
+			strings.Trim(r.CalculatedName, "#!():_@"),
 		)
 		r.ResolvedAvatarURL = internal.CalculateAvatar(&r.RoomMetadata, r.IsDM)
 		// We'll automatically use the LastInterestedEventTimestamps provided by the
@@ -162,6 +182,7 @@ func (s *InternalRequestLists) DeleteList(listKey string) {
 	delete(s.lists, listKey)
 	for _, room := range s.allRooms {
 		delete(room.LastInterestedEventTimestamps, listKey)
+		delete(room.LastInterestedEventNIDs, listKey)
 	}
 }
 
@@ -252,6 +273,24 @@ func (s *InternalRequestLists) AssignList(ctx context.Context, listKey string, f
 	return roomList, true
 }
 
+// AssignSortedList is AssignList for when the filtered and sorted room IDs are already known, e.g.
+// because another connection with identical room data calculated them. roomIDs must be exactly the
+// rooms AssignList would have produced, in order. Any existing list is replaced.
+func (s *InternalRequestLists) AssignSortedList(listKey string, filters *RequestFilters, roomIDs []string) *FilteredSortableRooms {
+	if filters == nil {
+		filters = &RequestFilters{}
+	}
+	roomList := &FilteredSortableRooms{
+		SortableRooms: NewSortableRooms(s, listKey, append([]string(nil), roomIDs...)),
+		filter:        filters,
+	}
+	for i, roomID := range roomList.roomIDs {
+		roomList.roomIDToIndex[roomID] = i
+	}
+	s.lists[listKey] = roomList
+	return roomList
+}
+
 // Count returns the count of total rooms in this list
 func (s *InternalRequestLists) Count(listKey string) int {
 	return int(s.lists[listKey].Len())
@@ -260,3 +299,8 @@ func (s *InternalRequestLists) Count(listKey string) int {
 func (s *InternalRequestLists) Len() int {
 	return len(s.lists)
 }
+
+// NumRooms returns the number of rooms which lists are made from.
+func (s *InternalRequestLists) NumRooms() int {
+	return len(s.allRooms)
+}
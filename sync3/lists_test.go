@@ -10,6 +10,7 @@ import (
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/testutils"
 )
 
 var roomCounter atomic.Int64
@@ -49,3 +50,234 @@ func addRooms(list *sync3.InternalRequestLists, n int) {
 		})
 	}
 }
+
+// The number of rooms in the datasets used by the benchmarks below, from a light user to a very
+// heavy one.
+var benchmarkDatasetSizes = []int{100, 1000, 10000}
+
+// The lists a typical client requests: every room by recency, and DMs by name.
+var benchmarkLists = []struct {
+	key     string
+	filters sync3.RequestFilters
+	sort    []string
+}{
+	{key: "all", sort: []string{sync3.SortByRecency}},
+	{key: "dms", filters: sync3.RequestFilters{IsDM: &boolTrue}, sort: []string{sync3.SortByName}},
+}
+
+var boolTrue = true
+
+// Benchmark building the sorted lists for a new connection.
+func BenchmarkListConstruction(b *testing.B) {
+	for _, numRooms := range benchmarkDatasetSizes {
+		ds := newBenchmarkDataset(b, numRooms)
+		b.Run(fmt.Sprintf("num_rooms_%d", numRooms), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				newBenchmarkLists(ds.Rooms)
+			}
+		})
+	}
+}
+
+// Benchmark calculating list operations as new messages arrive in rooms, moving them to the top
+// of the recency list.
+func BenchmarkListDeltasUnderChurn(b *testing.B) {
+	const numUpdates = 100
+	for _, numRooms := range benchmarkDatasetSizes {
+		ds := newBenchmarkDataset(b, numRooms)
+		// Churn updates the dataset, so remember the rooms before the new messages
+		rooms := append([]testutils.DatasetRoom(nil), ds.Rooms...)
+		updates := ds.Churn(b, numUpdates)
+		b.Run(fmt.Sprintf("num_rooms_%d", numRooms), func(b *testing.B) {
+			ctx := context.Background()
+			reqLists := make(map[string]*sync3.RequestList)
+			for _, l := range benchmarkLists {
+				reqLists[l.key] = &sync3.RequestList{
+					Ranges: sync3.SliceRanges{{0, 19}},
+					Sort:   l.sort,
+				}
+			}
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				lists := newBenchmarkLists(rooms)
+				b.StartTimer()
+				for _, up := range updates {
+					room := *lists.ReadOnlyRoom(up.RoomID)
+					room.LastMessageTimestamp = up.Timestamp
+					room.LastInterestedEventTimestamps = make(map[string]uint64, len(benchmarkLists))
+					for _, l := range benchmarkLists {
+						room.LastInterestedEventTimestamps[l.key] = up.Timestamp
+					}
+					delta := lists.SetRoom(room)
+					for _, ld := range delta.Lists {
+						sync3.CalculateListOps(ctx, reqLists[ld.ListKey], lists.Get(ld.ListKey), up.RoomID, ld.Op)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*numUpdates), "ns/update")
+		})
+	}
+}
+
+func newBenchmarkDataset(b *testing.B, numRooms int) *testutils.Dataset {
+	return testutils.NewDataset(b, "@bench:dataset", testutils.DatasetOpts{
+		Name:       fmt.Sprintf("bench_%d", numRooms),
+		NumRooms:   numRooms,
+		MaxMembers: 50,
+		Seed:       1,
+	})
+}
+
+func newBenchmarkLists(rooms []testutils.DatasetRoom) *sync3.InternalRequestLists {
+	lists := sync3.NewInternalRequestLists()
+	for _, r := range rooms {
+		var heroes []internal.Hero
+		for _, userID := range r.Members {
+			if len(heroes) == 5 {
+				break
+			}
+			heroes = append(heroes, internal.Hero{ID: userID})
+		}
+		lists.SetRoom(sync3.RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:               r.RoomID,
+				NameEvent:            r.Name,
+				Heroes:               heroes,
+				JoinCount:            r.JoinCount,
+				LastMessageTimestamp: r.LastMessageTimestamp,
+			},
+			UserRoomData: caches.UserRoomData{
+				IsDM: r.IsDM,
+			},
+			LastInterestedEventTimestamps: make(map[string]uint64),
+		})
+	}
+	for _, l := range benchmarkLists {
+		filters := l.filters
+		lists.AssignList(context.Background(), l.key, &filters, l.sort, sync3.Overwrite)
+	}
+	return lists
+}
+
+func TestInternalRequestListsCachesRoomName(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	room := sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID:    "!a:localhost",
+			Heroes:    []internal.Hero{{ID: "@bob:localhost", Name: "Bob"}},
+			JoinCount: 2,
+		},
+	}
+	assertName := func(wantName string, wantCalculated bool) {
+		t.Helper()
+		r := list.ReadOnlyRoom(room.RoomID)
+		if r.CalculatedName != wantName || r.NameFromHeroes != wantCalculated {
+			t.Fatalf("got name %q calculated=%v, want %q calculated=%v", r.CalculatedName, r.NameFromHeroes, wantName, wantCalculated)
+		}
+		if name, calculated := r.RoomName(); name != wantName || calculated != wantCalculated {
+			t.Fatalf("RoomName: got %q calculated=%v, want %q calculated=%v", name, calculated, wantName, wantCalculated)
+		}
+	}
+	list.SetRoom(room)
+	assertName("Bob", true)
+
+	// unrelated changes keep the name
+	room.LastMessageTimestamp = 100
+	delta := list.SetRoom(room)
+	if delta.RoomNameChanged {
+		t.Errorf("RoomNameChanged set for a timestamp change")
+	}
+	assertName("Bob", true)
+
+	// hero changes recalculate it
+	room.Heroes = []internal.Hero{{ID: "@bob:localhost", Name: "Bobby"}}
+	list.SetRoom(room)
+	assertName("Bobby", true)
+
+	// as do name events
+	room.NameEvent = "The Room"
+	list.SetRoom(room)
+	assertName("The Room", false)
+}
+
+func TestInternalRequestListsDMStatusChange(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	room := sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID: "!a:localhost",
+		},
+	}
+	list.SetRoom(room)
+	isDM := true
+	list.AssignList(context.Background(), "dms", &sync3.RequestFilters{IsDM: &isDM}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if list.Count("dms") != 0 {
+		t.Fatalf("room is in the DM list before becoming a DM")
+	}
+
+	room.IsDM = true
+	delta := list.SetRoom(room)
+	if !delta.IsDMChanged {
+		t.Errorf("IsDMChanged not set when the room became a DM")
+	}
+	if len(delta.Lists) != 1 || delta.Lists[0].ListKey != "dms" || delta.Lists[0].Op != sync3.ListOpAdd {
+		t.Errorf("got list deltas %+v, want an addition to the DM list", delta.Lists)
+	}
+
+	// rebuild the list, now the room is a DM
+	list.AssignList(context.Background(), "dms", &sync3.RequestFilters{IsDM: &isDM}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if list.Count("dms") != 1 {
+		t.Fatalf("room is not in the DM list after becoming a DM")
+	}
+	room.IsDM = false
+	delta = list.SetRoom(room)
+	if !delta.IsDMChanged {
+		t.Errorf("IsDMChanged not set when the room stopped being a DM")
+	}
+	if len(delta.Lists) != 1 || delta.Lists[0].Op != sync3.ListOpDel {
+		t.Errorf("got list deltas %+v, want a removal from the DM list", delta.Lists)
+	}
+
+	delta = list.SetRoom(room)
+	if delta.IsDMChanged {
+		t.Errorf("IsDMChanged set when nothing changed")
+	}
+}
+
+func TestInternalRequestListsUnreadFilter(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	room := sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID: "!a:localhost",
+		},
+	}
+	list.SetRoom(room)
+	isUnread := true
+	list.AssignList(context.Background(), "unread", &sync3.RequestFilters{IsUnread: &isUnread}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if list.Count("unread") != 0 {
+		t.Fatalf("room is in the unread list before it has notifications")
+	}
+
+	room.HighlightCount = 1
+	delta := list.SetRoom(room)
+	if len(delta.Lists) != 1 || delta.Lists[0].ListKey != "unread" || delta.Lists[0].Op != sync3.ListOpAdd {
+		t.Errorf("got list deltas %+v, want an addition to the unread list", delta.Lists)
+	}
+	// rebuild the list, now the room is unread
+	list.AssignList(context.Background(), "unread", &sync3.RequestFilters{IsUnread: &isUnread}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if list.Count("unread") != 1 {
+		t.Fatalf("room is not in the unread list after being highlighted")
+	}
+	room.HighlightCount = 0
+	room.NotificationCount = 2
+	delta = list.SetRoom(room)
+	if len(delta.Lists) != 1 || delta.Lists[0].Op != sync3.ListOpChange {
+		t.Errorf("got list deltas %+v, want the room to stay in the unread list", delta.Lists)
+	}
+
+	// reading the room removes it
+	room.NotificationCount = 0
+	delta = list.SetRoom(room)
+	if len(delta.Lists) != 1 || delta.Lists[0].Op != sync3.ListOpDel {
+		t.Errorf("got list deltas %+v, want a removal from the unread list", delta.Lists)
+	}
+}
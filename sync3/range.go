@@ -14,13 +14,20 @@ import (
 type SliceRanges [][2]int64
 
 func (r SliceRanges) Valid() bool {
+	_, reason := r.firstInvalid()
+	return reason == ""
+}
+
+// firstInvalid returns the index of the first invalid range and why it is invalid, or an empty
+// reason if all ranges are valid.
+func (r SliceRanges) firstInvalid() (index int, reason string) {
 	for i, sr := range r {
 		// always goes from start to end
 		if sr[1] < sr[0] {
-			return false
+			return i, fmt.Sprintf("start %d is greater than end %d", sr[0], sr[1])
 		}
 		if sr[0] < 0 {
-			return false
+			return i, fmt.Sprintf("start %d is negative", sr[0])
 		}
 		// cannot have overlapping ranges
 		for j := i + 1; j < len(r); j++ {
@@ -28,17 +35,17 @@ func (r SliceRanges) Valid() bool {
 			// check both ranges with each other
 			for _, val := range sr {
 				if testRange[0] <= val && val <= testRange[1] {
-					return false
+					return i, fmt.Sprintf("overlaps with range %d", j)
 				}
 			}
 			for _, val := range testRange {
 				if sr[0] <= val && val <= sr[1] {
-					return false
+					return i, fmt.Sprintf("overlaps with range %d", j)
 				}
 			}
 		}
 	}
-	return true
+	return 0, ""
 }
 
 // Inside returns true if i is inside the range
@@ -254,6 +261,26 @@ func (r SliceRanges) Delta(next SliceRanges) (added SliceRanges, removed SliceRa
 	return
 }
 
+// Intersect returns the parts of these ranges which are also covered by the other ranges.
+func (r SliceRanges) Intersect(other SliceRanges) SliceRanges {
+	var result SliceRanges
+	for _, a := range r {
+		for _, b := range other {
+			start, end := a[0], a[1]
+			if b[0] > start {
+				start = b[0]
+			}
+			if b[1] < end {
+				end = b[1]
+			}
+			if start <= end {
+				result = append(result, [2]int64{start, end})
+			}
+		}
+	}
+	return result
+}
+
 // Slice into this range, returning subslices of slice
 func (r SliceRanges) SliceInto(slice Subslicer) []Subslicer {
 	var result []Subslicer
@@ -286,6 +313,14 @@ func (r SliceRanges) SliceInto(slice Subslicer) []Subslicer {
 // is an open not a close. We don't care if these points are old or new, as that just determines whether
 // they were added or removed, it doesn't change the range logic.
 func createRange(point, lastPoint *pointInfo, lastMergedRange *[2]int64) *[2]int64 {
+	if point.x == lastPoint.x && lastPoint.isOpen && !point.isOpen {
+		// a single element range e.g [21,21], unless that element was already included in the
+		// last range we made.
+		if lastMergedRange != nil && point.x <= lastMergedRange[1] {
+			return nil
+		}
+		return &[2]int64{point.x, point.x}
+	}
 	if point.x <= lastPoint.x {
 		// don't make 0-length ranges which would be possible in say `[0,20] -> [0,20]`
 		return nil
@@ -357,6 +357,16 @@ func TestRangeDelta(t *testing.T) {
 				{0, 9},
 			}),
 		},
+		// added single element range
+		{
+			oldRange: SliceRanges([][2]int64{}),
+			newRange: SliceRanges([][2]int64{
+				{45, 75}, {21, 21},
+			}),
+			wantAdded: SliceRanges([][2]int64{
+				{21, 21}, {45, 75},
+			}),
+		},
 		// removed
 		{
 			oldRange: SliceRanges([][2]int64{
@@ -526,6 +536,26 @@ func TestRangeDelta(t *testing.T) {
 	}
 }
 
+func TestRangeIntersect(t *testing.T) {
+	testCases := []struct {
+		a, b SliceRanges
+		want SliceRanges
+	}{
+		{a: SliceRanges{{0, 9}}, b: SliceRanges{{0, 9}}, want: SliceRanges{{0, 9}}},
+		{a: SliceRanges{{0, 9}}, b: SliceRanges{{5, 20}}, want: SliceRanges{{5, 9}}},
+		{a: SliceRanges{{10, 20}}, b: SliceRanges{{0, 9}}, want: nil},
+		{a: SliceRanges{{10, 20}}, b: SliceRanges{{0, 10}, {15, 30}}, want: SliceRanges{{10, 10}, {15, 20}}},
+		{a: SliceRanges{{0, 5}, {10, 20}}, b: SliceRanges{{3, 12}}, want: SliceRanges{{3, 5}, {10, 12}}},
+		{a: nil, b: SliceRanges{{0, 9}}, want: nil},
+	}
+	for _, tc := range testCases {
+		got := tc.a.Intersect(tc.b)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v intersect %v: got %v want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
 func TestSortPoints(t *testing.T) {
 	testCases := []struct {
 		name  string
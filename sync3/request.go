@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -13,15 +15,31 @@ import (
 var (
 	SortByName              = "by_name"
 	SortByRecency           = "by_recency"
+	SortByArrival           = "by_arrival"
 	SortByNotificationLevel = "by_notification_level"
 	SortByNotificationCount = "by_notification_count" // deprecated
 	SortByHighlightCount    = "by_highlight_count"    // deprecated
-	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByNotificationLevel}
+	SortByManual            = "by_manual"
+	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByArrival, SortByNotificationLevel, SortByManual}
+
+	// Activity other than timeline events which can bump rooms in lists, see RequestList.BumpOn
+	BumpOnReceipts    = "receipts"
+	BumpOnTyping      = "typing"
+	BumpOnAccountData = "account_data"
+	BumpOn            = []string{BumpOnReceipts, BumpOnTyping, BumpOnAccountData}
+
+	// How by_recency orders rooms, see RequestList.RecencyOrder
+	RecencyOrderTimestamp = "origin_server_ts"
+	RecencyOrderArrival   = "arrival"
+	RecencyOrders         = []string{RecencyOrderTimestamp, RecencyOrderArrival}
 
 	Wildcard     = "*"
 	StateKeyLazy = "$LAZY"
 	StateKeyMe   = "$ME"
 
+	// The revisions of the sliding sync API which requests and responses follow
+	ProtocolVersions = []string{"org.matrix.msc3575"}
+
 	DefaultTimelineLimit = int64(20)
 	DefaultTimeoutMSecs  = 10 * 1000 // 10s
 )
@@ -33,18 +51,61 @@ type Request struct {
 	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
 	UnsubscribeRooms  []string                    `json:"unsubscribe_rooms"`
 	Extensions        extensions.Request          `json:"extensions"`
+	// Pos and Timeout can be sent here instead of as query params, which take precedence.
+	Pos     string `json:"pos,omitempty"`
+	Timeout *int64 `json:"timeout,omitempty"`
 
 	// set via query params or inferred
 	pos          int64
 	timeoutMSecs int
 }
 
+// ValidationError is returned by Request.Validate and identifies the offending field in the
+// request body.
+type ValidationError struct {
+	// Field is the path to the offending field e.g `lists["a"].ranges[0]`.
+	Field string
+	// Reason explains why the field is invalid.
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+func invalidField(field, reason string, args ...interface{}) *ValidationError {
+	return &ValidationError{
+		Field:  field,
+		Reason: fmt.Sprintf(reason, args...),
+	}
+}
+
+// Validate checks the request body for invalid values. If the request is invalid, a
+// *ValidationError is returned.
 func (r *Request) Validate() error {
 	if len(r.ConnID) > 16 {
-		return fmt.Errorf("conn_id is too long: %d > 16", len(r.ConnID))
+		return invalidField("conn_id", "too long: %d > 16", len(r.ConnID))
 	}
 	if len(r.TxnID) > 64 {
-		return fmt.Errorf("txn_id is too long: %d > 64", len(r.TxnID))
+		return invalidField("txn_id", "too long: %d > 64", len(r.TxnID))
+	}
+	if r.Timeout != nil && *r.Timeout < 0 {
+		return invalidField("timeout", "must not be negative")
+	}
+	// check in a stable order so clients always see the same error for the same request.
+	listKeys := internal.Keys(r.Lists)
+	sort.Strings(listKeys)
+	for _, listKey := range listKeys {
+		if err := r.Lists[listKey].validate(fmt.Sprintf("lists[%q]", listKey)); err != nil {
+			return err
+		}
+	}
+	roomIDs := internal.Keys(r.RoomSubscriptions)
+	sort.Strings(roomIDs)
+	for _, roomID := range roomIDs {
+		if err := r.RoomSubscriptions[roomID].validate(fmt.Sprintf("room_subscriptions[%q]", roomID)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -57,22 +118,100 @@ type RequestList struct {
 	SlowGetAllRooms *bool           `json:"slow_get_all_rooms,omitempty"`
 	Deleted         bool            `json:"deleted,omitempty"`
 	BumpEventTypes  []string        `json:"bump_event_types"`
+	// BumpOn lists other activity which bumps rooms to the top of recency sorted lists, as if an
+	// event had just arrived. By default only timeline events bump rooms.
+	BumpOn []string `json:"bump_on,omitempty"`
+	// RecencyOrder is how by_recency orders rooms in this list: "origin_server_ts" (the default)
+	// uses event timestamps, "arrival" uses the order the proxy received events, as by_arrival
+	// does. Rooms with slow federated servers can otherwise jump about the list as old timestamps
+	// arrive.
+	RecencyOrder string `json:"recency_order,omitempty"`
+}
+
+func (rl RequestList) validate(path string) *ValidationError {
+	if i, reason := rl.Ranges.firstInvalid(); reason != "" {
+		return invalidField(fmt.Sprintf("%s.ranges[%d]", path, i), "%s", reason)
+	}
+	for i, sortBy := range rl.Sort {
+		known := false
+		for _, s := range SortBy {
+			if s == sortBy {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return invalidField(fmt.Sprintf("%s.sort[%d]", path, i), "unknown sort order '%s'", sortBy)
+		}
+	}
+	for i, bumpOn := range rl.BumpOn {
+		known := false
+		for _, b := range BumpOn {
+			if b == bumpOn {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return invalidField(fmt.Sprintf("%s.bump_on[%d]", path, i), "unknown activity '%s'", bumpOn)
+		}
+	}
+	if rl.RecencyOrder != "" {
+		known := false
+		for _, o := range RecencyOrders {
+			if o == rl.RecencyOrder {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return invalidField(path+".recency_order", "unknown recency order '%s'", rl.RecencyOrder)
+		}
+	}
+	return rl.RoomSubscription.validate(path)
 }
 
 func (rl *RequestList) ShouldGetAllRooms() bool {
 	return rl.SlowGetAllRooms != nil && *rl.SlowGetAllRooms
 }
 
-func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
-	prevLen := 0
-	if rl != nil {
-		prevLen = len(rl.Sort)
+// BumpsOn returns true if this kind of activity (see BumpOn) bumps rooms in this list.
+func (rl *RequestList) BumpsOn(activity string) bool {
+	for _, b := range rl.BumpOn {
+		if b == activity {
+			return true
+		}
 	}
-	if prevLen != len(next.Sort) {
-		return true
+	return false
+}
+
+// SortOrder returns the sort operations to apply to this list, which is Sort with by_recency
+// replaced by by_arrival if RecencyOrder asks for it.
+func (rl *RequestList) SortOrder() []string {
+	if rl == nil {
+		return nil
+	}
+	if rl.RecencyOrder != RecencyOrderArrival {
+		return rl.Sort
 	}
+	sortOrder := make([]string, len(rl.Sort))
 	for i := range rl.Sort {
-		if rl.Sort[i] != next.Sort[i] {
+		sortOrder[i] = rl.Sort[i]
+		if sortOrder[i] == SortByRecency {
+			sortOrder[i] = SortByArrival
+		}
+	}
+	return sortOrder
+}
+
+func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
+	prev := rl.SortOrder()
+	nextSort := next.SortOrder()
+	if len(prev) != len(nextSort) {
+		return true
+	}
+	for i := range prev {
+		if prev[i] != nextSort[i] {
 			return true
 		}
 	}
@@ -275,10 +414,11 @@ func (r *Request) SetTimeoutMSecs(timeout int) {
 func (r *Request) Same(other *Request) bool {
 	// If a client changes nothing but the txn_id field, we need to consider the
 	// requests the same. Therefore we blank out the txn_id before marshaling.
+	// The same goes for pos and timeout, which may be in the body.
 	rCopy := *r
 	otherCopy := *other
-	rCopy.TxnID = ""
-	otherCopy.TxnID = ""
+	rCopy.TxnID, rCopy.Pos, rCopy.Timeout = "", "", nil
+	otherCopy.TxnID, otherCopy.Pos, otherCopy.Timeout = "", "", nil
 	serialised, err := json.Marshal(rCopy)
 	if err != nil {
 		return false
@@ -366,8 +506,9 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if rooms == nil {
 			rooms = existingList.Ranges
 		}
+		// an empty sort is treated as missing, as it is for new lists
 		sort := nextList.Sort
-		if sort == nil {
+		if len(sort) == 0 {
 			sort = existingList.Sort
 		}
 		reqState := nextList.RequiredState
@@ -394,10 +535,22 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if bumpEventTypes == nil {
 			bumpEventTypes = existingList.BumpEventTypes
 		}
+		bumpOn := nextList.BumpOn
+		if bumpOn == nil {
+			bumpOn = existingList.BumpOn
+		}
+		recencyOrder := nextList.RecencyOrder
+		if recencyOrder == "" {
+			recencyOrder = existingList.RecencyOrder
+		}
 		heroes := nextList.Heroes
 		if heroes == nil {
 			heroes = existingList.Heroes
 		}
+		timelineFilter := nextList.TimelineFilter
+		if timelineFilter == nil {
+			timelineFilter = existingList.TimelineFilter
+		}
 
 		calculatedLists[listKey] = RequestList{
 			RoomSubscription: RoomSubscription{
@@ -405,12 +558,15 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 				TimelineLimit:   timelineLimit,
 				IncludeOldRooms: includeOldRooms,
 				Heroes:          heroes,
+				TimelineFilter:  timelineFilter,
 			},
 			Ranges:          rooms,
 			Sort:            sort,
 			Filters:         filters,
 			SlowGetAllRooms: slowGetAllRooms,
 			BumpEventTypes:  bumpEventTypes,
+			BumpOn:          bumpOn,
+			RecencyOrder:    recencyOrder,
 		}
 	}
 	result.Lists = calculatedLists
@@ -464,7 +620,7 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if oldSub, ok := r.RoomSubscriptions[roomID]; ok {
 			// if the subscription is different, mark it as a delta, else skip it as it hasn't changed
 			newSub := resultSubs[roomID]
-			if oldSub.RequiredStateChanged(newSub) || oldSub.TimelineLimit != newSub.TimelineLimit {
+			if oldSub.RequiredStateChanged(newSub) || oldSub.TimelineLimit != newSub.TimelineLimit || !reflect.DeepEqual(oldSub.TimelineFilter, newSub.TimelineFilter) {
 				delta.Subs = append(delta.Subs, roomID)
 			}
 			continue // already subscribed
@@ -486,11 +642,13 @@ func (r *Request) ListKeys() []string {
 }
 
 type RequestFilters struct {
-	Spaces         []string  `json:"spaces"`
-	IsDM           *bool     `json:"is_dm"`
-	IsEncrypted    *bool     `json:"is_encrypted"`
-	IsInvite       *bool     `json:"is_invite"`
-	IsTombstoned   *bool     `json:"is_tombstoned"` // deprecated
+	Spaces       []string `json:"spaces"`
+	IsDM         *bool    `json:"is_dm"`
+	IsEncrypted  *bool    `json:"is_encrypted"`
+	IsInvite     *bool    `json:"is_invite"`
+	IsTombstoned *bool    `json:"is_tombstoned"` // deprecated
+	// IsUnread filters on whether the room has notifications or highlights.
+	IsUnread       *bool     `json:"is_unread"`
 	RoomTypes      []*string `json:"room_types"`
 	NotRoomTypes   []*string `json:"not_room_types"`
 	RoomNameFilter string    `json:"room_name_like"`
@@ -522,10 +680,15 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 	if rf.IsInvite != nil && *rf.IsInvite != r.IsInvite {
 		return false
 	}
-	roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
-	if rf.RoomNameFilter != "" && !strings.Contains(strings.ToLower(roomName), strings.ToLower(rf.RoomNameFilter)) {
+	if rf.IsUnread != nil && *rf.IsUnread != (r.NotificationCount > 0 || r.HighlightCount > 0) {
 		return false
 	}
+	if rf.RoomNameFilter != "" {
+		roomName, _ := r.RoomName()
+		if !strings.Contains(strings.ToLower(roomName), strings.ToLower(rf.RoomNameFilter)) {
+			return false
+		}
+	}
 	if len(rf.NotTags) > 0 {
 		for _, t := range rf.NotTags {
 			if _, ok := r.Tags[t]; ok {
@@ -570,6 +733,18 @@ type RoomSubscription struct {
 	TimelineLimit   int64             `json:"timeline_limit"`
 	IncludeOldRooms *RoomSubscription `json:"include_old_rooms"`
 	Heroes          *bool             `json:"include_heroes"`
+	// TimelineFilter limits which events are returned in the timeline.
+	TimelineFilter *internal.TimelineFilter `json:"timeline_filter,omitempty"`
+}
+
+func (rs RoomSubscription) validate(path string) *ValidationError {
+	if rs.TimelineLimit < 0 {
+		return invalidField(path+".timeline_limit", "must not be negative, got %d", rs.TimelineLimit)
+	}
+	if rs.IncludeOldRooms != nil {
+		return rs.IncludeOldRooms.validate(path + ".include_old_rooms")
+	}
+	return nil
 }
 
 func (rs RoomSubscription) RequiredStateChanged(other RoomSubscription) bool {
@@ -613,6 +788,7 @@ func (rs RoomSubscription) combineRecursive(other RoomSubscription, checkOldRoom
 	}
 	// combine together required_state fields, we'll union them later
 	result.RequiredState = append(rs.RequiredState, other.RequiredState...)
+	result.TimelineFilter = rs.TimelineFilter.Union(other.TimelineFilter)
 
 	if checkOldRooms {
 		// set include_old_rooms if it is unset
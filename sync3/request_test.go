@@ -805,6 +805,39 @@ func TestRequestListDiffs(t *testing.T) {
 			},
 			sortChanged: &boolTrue,
 		},
+		{
+			name: "changed recency order",
+			a: &RequestList{
+				Sort: []string{SortByRecency},
+			},
+			b: RequestList{
+				Sort:         []string{SortByRecency},
+				RecencyOrder: RecencyOrderArrival,
+			},
+			sortChanged: &boolTrue,
+		},
+		{
+			name: "explicit default recency order",
+			a: &RequestList{
+				Sort: []string{SortByRecency},
+			},
+			b: RequestList{
+				Sort:         []string{SortByRecency},
+				RecencyOrder: RecencyOrderTimestamp,
+			},
+			sortChanged: &boolFalse,
+		},
+		{
+			name: "arrival recency order is by_arrival",
+			a: &RequestList{
+				Sort: []string{SortByArrival},
+			},
+			b: RequestList{
+				Sort:         []string{SortByRecency},
+				RecencyOrder: RecencyOrderArrival,
+			},
+			sortChanged: &boolFalse,
+		},
 	}
 	for _, tc := range testCases {
 		if tc.sortChanged != nil {
@@ -1003,6 +1036,7 @@ func TestRequestList_CalculateMoveIndexes(t *testing.T) {
 }
 
 func TestSame(t *testing.T) {
+	timeout := int64(30000)
 	cases := []struct {
 		a          Request
 		b          Request
@@ -1030,6 +1064,19 @@ func TestSame(t *testing.T) {
 			},
 			expectSame: true,
 		},
+		// Requests only differing in the pos and timeout sent in the body are the same.
+		{
+			a: Request{
+				ConnID: "conn",
+				Pos:    "10",
+			},
+			b: Request{
+				ConnID:  "conn",
+				Pos:     "11",
+				Timeout: &timeout,
+			},
+			expectSame: true,
+		},
 		// Requests only differing in some other field ConnID are NOT the same.
 		// TODO: would be better to change a more important field like lists rather than
 		// ConnID.
@@ -1131,3 +1178,147 @@ func jsonEqual(t *testing.T, name string, got, want interface{}) {
 func listPtr(l RequestList) *RequestList {
 	return &l
 }
+
+func TestRequestValidate(t *testing.T) {
+	negativeTimeout := int64(-1)
+	testCases := []struct {
+		name      string
+		req       Request
+		wantField string
+	}{
+		{
+			name: "valid request",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {
+						Ranges:           SliceRanges{{0, 10}, {20, 30}},
+						Sort:             []string{SortByRecency, SortByName},
+						RoomSubscription: RoomSubscription{TimelineLimit: 5},
+					},
+				},
+				RoomSubscriptions: map[string]RoomSubscription{
+					"!a:localhost": {TimelineLimit: 0},
+				},
+			},
+		},
+		{
+			name:      "conn_id too long",
+			req:       Request{ConnID: "01234567890123456"},
+			wantField: "conn_id",
+		},
+		{
+			name:      "negative timeout",
+			req:       Request{Timeout: &negativeTimeout},
+			wantField: "timeout",
+		},
+		{
+			name: "overlapping ranges",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {Ranges: SliceRanges{{0, 10}}},
+					"b": {Ranges: SliceRanges{{0, 10}, {5, 15}}},
+				},
+			},
+			wantField: `lists["b"].ranges[0]`,
+		},
+		{
+			name: "backwards range",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {Ranges: SliceRanges{{0, 10}, {30, 20}}},
+				},
+			},
+			wantField: `lists["a"].ranges[1]`,
+		},
+		{
+			name: "unknown sort",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {Sort: []string{SortByRecency, "by_vibes"}},
+				},
+			},
+			wantField: `lists["a"].sort[1]`,
+		},
+		{
+			name: "unknown bump_on",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {BumpOn: []string{BumpOnReceipts, "presence"}},
+				},
+			},
+			wantField: `lists["a"].bump_on[1]`,
+		},
+		{
+			name: "unknown recency order",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {RecencyOrder: "depth"},
+				},
+			},
+			wantField: `lists["a"].recency_order`,
+		},
+		{
+			name: "negative list timeline_limit",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {RoomSubscription: RoomSubscription{TimelineLimit: -1}},
+				},
+			},
+			wantField: `lists["a"].timeline_limit`,
+		},
+		{
+			name: "negative include_old_rooms timeline_limit",
+			req: Request{
+				RoomSubscriptions: map[string]RoomSubscription{
+					"!a:localhost": {IncludeOldRooms: &RoomSubscription{TimelineLimit: -5}},
+				},
+			},
+			wantField: `room_subscriptions["!a:localhost"].include_old_rooms.timeline_limit`,
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.req.Validate()
+		if tc.wantField == "" {
+			if err != nil {
+				t.Errorf("%s: got error %s want none", tc.name, err)
+			}
+			continue
+		}
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s: got error %v want *ValidationError", tc.name, err)
+			continue
+		}
+		if verr.Field != tc.wantField {
+			t.Errorf("%s: got field %s want %s", tc.name, verr.Field, tc.wantField)
+		}
+	}
+}
+
+func TestRequestListRecencyOrder(t *testing.T) {
+	list := RequestList{
+		Sort:         []string{SortByNotificationLevel, SortByRecency},
+		RecencyOrder: RecencyOrderArrival,
+	}
+	want := []string{SortByNotificationLevel, SortByArrival}
+	if got := list.SortOrder(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got sort order %v want %v", got, want)
+	}
+	if list.Sort[1] != SortByRecency {
+		t.Errorf("SortOrder modified Sort: %v", list.Sort)
+	}
+
+	// the recency order is sticky, and applies to sticky sort orders
+	var req *Request
+	req, _ = req.ApplyDelta(&Request{Lists: map[string]RequestList{"a": list}})
+	req, _ = req.ApplyDelta(&Request{Lists: map[string]RequestList{"a": {Ranges: SliceRanges{{0, 9}}}}})
+	got := req.Lists["a"]
+	if !reflect.DeepEqual(got.SortOrder(), want) {
+		t.Errorf("sticky list: got sort order %v want %v", got.SortOrder(), want)
+	}
+	req, _ = req.ApplyDelta(&Request{Lists: map[string]RequestList{"a": {RecencyOrder: RecencyOrderTimestamp}}})
+	got = req.Lists["a"]
+	if !reflect.DeepEqual(got.SortOrder(), list.Sort) {
+		t.Errorf("changed recency order: got sort order %v want %v", got.SortOrder(), list.Sort)
+	}
+}
@@ -1,9 +1,15 @@
 package sync3
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"io"
+	"sort"
 	"strconv"
+	"time"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/tidwall/gjson"
 )
@@ -23,6 +29,9 @@ type Response struct {
 
 	Pos   string `json:"pos"`
 	TxnID string `json:"txn_id,omitempty"`
+	// Pending is true if the proxy has more data for the current request which did not fit in this
+	// response, e.g because it was too large. Clients should make another request straight away.
+	Pending bool `json:"pending,omitempty"`
 }
 
 type ResponseList struct {
@@ -30,6 +39,143 @@ type ResponseList struct {
 	Count int          `json:"count"`
 }
 
+// EncodeTo writes the response as JSON to w, followed by a newline. The output is equivalent to
+// json.NewEncoder(w).Encode(r), but rooms are marshalled and written one at a time so the
+// serialised form of the whole response is never held in memory at once, and events are written
+// exactly as they are stored. unsigned.age in events is recomputed or stripped per eventAge as each
+// event is written, so the response itself keeps the stored events and retransmits get fresh ages.
+func (r *Response) EncodeTo(w io.Writer, eventAge internal.EventAgeOpts) error {
+	now := time.Now()
+	applyAge := func(ev json.RawMessage) json.RawMessage {
+		return eventAge.Apply(ev, now)
+	}
+	bw := bufio.NewWriterSize(w, 32*1024)
+	// fields must be written in struct order to match encoding/json
+	bw.WriteString(`{"lists":`)
+	if err := writeJSON(bw, r.Lists); err != nil {
+		return err
+	}
+	bw.WriteString(`,"rooms":`)
+	if r.Rooms == nil {
+		bw.WriteString("null")
+	} else {
+		// encoding/json sorts map keys
+		roomIDs := make([]string, 0, len(r.Rooms))
+		for roomID := range r.Rooms {
+			roomIDs = append(roomIDs, roomID)
+		}
+		sort.Strings(roomIDs)
+		bw.WriteByte('{')
+		for i, roomID := range roomIDs {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			if err := writeJSON(bw, roomID); err != nil {
+				return err
+			}
+			bw.WriteByte(':')
+			if err := writeRoom(bw, r.Rooms[roomID], applyAge); err != nil {
+				return err
+			}
+		}
+		bw.WriteByte('}')
+	}
+	bw.WriteString(`,"extensions":`)
+	if err := writeJSON(bw, r.Extensions); err != nil {
+		return err
+	}
+	bw.WriteString(`,"pos":`)
+	if err := writeJSON(bw, r.Pos); err != nil {
+		return err
+	}
+	if r.TxnID != "" {
+		bw.WriteString(`,"txn_id":`)
+		if err := writeJSON(bw, r.TxnID); err != nil {
+			return err
+		}
+	}
+	if r.Pending {
+		bw.WriteString(`,"pending":true`)
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// roomEventsEnd is the key of the first Room field after the event fields. It has no omitempty so
+// is always present.
+var roomEventsEnd = []byte(`"notification_count":`)
+
+// writeRoom writes a room as JSON to bw, with fields in the same order as encoding/json. Events
+// are written verbatim after transformEvent: encoding/json would scan and copy every event to
+// compact and escape it, which is wasted work as stored events are already valid JSON: events
+// which aren't are rejected when they are stored.
+func writeRoom(bw *bufio.Writer, room Room, transformEvent func(json.RawMessage) json.RawMessage) error {
+	eventFields := []struct {
+		key    string
+		events []json.RawMessage
+	}{
+		{`"required_state"`, room.RequiredState},
+		{`"timeline"`, room.Timeline},
+		{`"invite_state"`, room.InviteState},
+	}
+	room.RequiredState, room.Timeline, room.InviteState = nil, nil, nil
+	b, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+	// Keys can't appear inside string values as their quotes would be escaped, so this splits
+	// the object into the fields before and after the events.
+	split := bytes.Index(b, roomEventsEnd)
+	bw.Write(b[:split]) // includes the opening { and any trailing comma
+	for _, f := range eventFields {
+		if len(f.events) == 0 { // omitempty
+			continue
+		}
+		bw.WriteString(f.key)
+		bw.WriteString(":[")
+		for i, ev := range f.events {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			if len(ev) == 0 {
+				bw.WriteString("null")
+				continue
+			}
+			bw.Write(transformEvent(ev))
+		}
+		bw.WriteString("],")
+	}
+	_, err = bw.Write(b[split:])
+	return err
+}
+
+// EncodedSize returns the number of bytes the room takes up when a response is encoded.
+func (r Room) EncodedSize() int {
+	var c byteCounter
+	bw := bufio.NewWriter(&c)
+	writeRoom(bw, r, func(ev json.RawMessage) json.RawMessage { return ev })
+	bw.Flush()
+	return int(c)
+}
+
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// writeJSON marshals v and writes it to bw. Write errors are sticky in a bufio.Writer, so they are
+// returned by the final Flush.
+func writeJSON(bw *bufio.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = bw.Write(b)
+	return err
+}
+
 func (r *Response) PosInt() int64 {
 	p, _ := strconv.ParseInt(r.Pos, 10, 64)
 	return p
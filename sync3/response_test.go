@@ -0,0 +1,159 @@
+package sync3
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+)
+
+func TestResponseEncodeTo(t *testing.T) {
+	invitedCount := 2
+	testCases := []struct {
+		name string
+		res  Response
+	}{
+		{
+			name: "empty",
+			res:  Response{},
+		},
+		{
+			name: "everything",
+			res: Response{
+				Lists: map[string]ResponseList{
+					"a": {
+						Count: 3,
+						Ops: []ResponseOp{
+							&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"!b", "!a"}},
+						},
+					},
+				},
+				Rooms: map[string]Room{
+					"!b": {
+						Name:         "<b>old</b>",
+						AvatarChange: NewAvatarChange("mxc://b"),
+						Heroes:       []internal.Hero{{ID: "@alice:localhost", Name: "Alice"}},
+						Timeline:     []json.RawMessage{json.RawMessage(`{"type":  "m.room.message", "content": {"body": "a & b"}}`)},
+						Initial:      true,
+						InvitedCount: &invitedCount,
+					},
+					"!a": {
+						NotificationCount: 1,
+						AvatarChange:      DeletedAvatar,
+						RequiredState:     []json.RawMessage{json.RawMessage(`{"type":"m.room.create"}`), nil},
+						InviteState:       []json.RawMessage{json.RawMessage(`{"type":"m.room.member"}`)},
+					},
+				},
+				Extensions: extensions.Response{
+					ToDevice: &extensions.ToDeviceResponse{NextBatch: "5"},
+				},
+				Pos:     "10",
+				TxnID:   "txn",
+				Pending: true,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		var want bytes.Buffer
+		if err := json.NewEncoder(&want).Encode(&tc.res); err != nil {
+			t.Fatalf("%s: Encode: %s", tc.name, err)
+		}
+		var got bytes.Buffer
+		if err := tc.res.EncodeTo(&got, internal.EventAgeOpts{}); err != nil {
+			t.Fatalf("%s: EncodeTo: %s", tc.name, err)
+		}
+		if !bytes.HasSuffix(got.Bytes(), []byte("\n")) {
+			t.Errorf("%s: EncodeTo did not write a trailing newline", tc.name)
+		}
+		var gotJSON, wantJSON interface{}
+		if err := json.Unmarshal(got.Bytes(), &gotJSON); err != nil {
+			t.Fatalf("%s: EncodeTo wrote invalid JSON: %s\n%s", tc.name, err, got.String())
+		}
+		if err := json.Unmarshal(want.Bytes(), &wantJSON); err != nil {
+			t.Fatalf("%s: failed to unmarshal encoding/json output: %s", tc.name, err)
+		}
+		if !reflect.DeepEqual(gotJSON, wantJSON) {
+			t.Errorf("%s: EncodeTo did not match encoding/json:\ngot  %s\nwant %s", tc.name, got.String(), want.String())
+		}
+		// events are passed through as they are stored
+		for _, room := range tc.res.Rooms {
+			for _, ev := range room.Timeline {
+				if !bytes.Contains(got.Bytes(), ev) {
+					t.Errorf("%s: event %s was not written verbatim: %s", tc.name, ev, got.String())
+				}
+			}
+		}
+	}
+}
+
+func TestResponseEncodeToFieldOrder(t *testing.T) {
+	// with compact events and nothing to escape, the output is byte for byte what encoding/json writes
+	invitedCount := 1
+	res := Response{
+		Rooms: map[string]Room{
+			"!a": {
+				Name:              "A",
+				Heroes:            []internal.Hero{{ID: "@alice:localhost"}},
+				RequiredState:     []json.RawMessage{json.RawMessage(`{"type":"m.room.create"}`)},
+				Timeline:          []json.RawMessage{json.RawMessage(`{"type":"m.room.message"}`)},
+				NotificationCount: 2,
+				Initial:           true,
+				InvitedCount:      &invitedCount,
+				NumLive:           1,
+			},
+			"!b": {
+				InviteState: []json.RawMessage{json.RawMessage(`{"type":"m.room.member"}`)},
+			},
+			"!c": {},
+		},
+		Pos: "1",
+	}
+	var want bytes.Buffer
+	if err := json.NewEncoder(&want).Encode(&res); err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	var got bytes.Buffer
+	if err := res.EncodeTo(&got, internal.EventAgeOpts{}); err != nil {
+		t.Fatalf("EncodeTo: %s", err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("EncodeTo did not match encoding/json:\ngot  %s\nwant %s", got.String(), want.String())
+	}
+}
+
+func TestResponseEncodeToEvents(t *testing.T) {
+	res := Response{
+		Rooms: map[string]Room{
+			"!a": {
+				Timeline: []json.RawMessage{
+					json.RawMessage(`{"type":"m.room.message","unsigned":{"age":5}}`),
+					json.RawMessage(`{"type":"m.room.topic"}`),
+				},
+			},
+		},
+	}
+	var got bytes.Buffer
+	if err := res.EncodeTo(&got, internal.EventAgeOpts{Strip: true}); err != nil {
+		t.Fatalf("EncodeTo: %s", err)
+	}
+	var decoded Response
+	if err := json.Unmarshal(got.Bytes(), &decoded); err != nil {
+		t.Fatalf("EncodeTo wrote invalid JSON: %s\n%s", err, got.String())
+	}
+	// the age is stripped on the way out
+	wantTimeline := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.message","unsigned":{}}`),
+		json.RawMessage(`{"type":"m.room.topic"}`),
+	}
+	if gotTimeline := decoded.Rooms["!a"].Timeline; !reflect.DeepEqual(gotTimeline, wantTimeline) {
+		t.Errorf("got timeline %s want %s", gotTimeline, wantTimeline)
+	}
+	// but the response still holds the stored events, for retransmits
+	if !strings.Contains(string(res.Rooms["!a"].Timeline[0]), `"age":5`) {
+		t.Errorf("EncodeTo modified the response: %s", res.Rooms["!a"].Timeline[0])
+	}
+}
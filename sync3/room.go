@@ -19,6 +19,7 @@ type Room struct {
 	HighlightCount    int64             `json:"highlight_count"`
 	Initial           bool              `json:"initial,omitempty"`
 	IsDM              bool              `json:"is_dm,omitempty"`
+	DMPartner         *DMPartner        `json:"dm_partner,omitempty"`
 	JoinedCount       int               `json:"joined_count,omitempty"`
 	InvitedCount      *int              `json:"invited_count,omitempty"`
 	PrevBatch         string            `json:"prev_batch,omitempty"`
@@ -26,6 +27,27 @@ type Room struct {
 	Timestamp         uint64            `json:"timestamp,omitempty"`
 }
 
+// DMPartner is the other user in a DM, so clients can show DMs without requesting member state.
+type DMPartner struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// NewDMPartner returns the other user in this room if it is a DM with exactly one other user, else
+// nil. The requesting user must already have been removed from the heroes.
+func NewDMPartner(metadata *internal.RoomMetadata, isDM bool) *DMPartner {
+	if !isDM || len(metadata.Heroes) != 1 {
+		return nil
+	}
+	hero := metadata.Heroes[0]
+	return &DMPartner{
+		UserID:      hero.ID,
+		DisplayName: hero.Name,
+		AvatarURL:   hero.Avatar,
+	}
+}
+
 // RoomConnMetadata represents a room as seen by one specific connection (hence one
 // specific device).
 type RoomConnMetadata struct {
@@ -54,6 +76,24 @@ type RoomConnMetadata struct {
 	// list. See also the description of this in the React SDK docs:
 	//     https://github.com/matrix-org/matrix-react-sdk/blob/526645c79160ab1ad4b4c3845de27d51263a405e/docs/room-list-store.md#tag-sorting-algorithm-recent
 	LastInterestedEventTimestamps map[string]uint64
+	// LastInterestedEventNIDs is LastInterestedEventTimestamps, but tracking the NID of the event
+	// rather than its origin_server_ts. NIDs are assigned in the order the proxy receives events,
+	// so unlike timestamps they are not affected by slow or badly-clocked servers.
+	LastInterestedEventNIDs map[string]int64
+
+	// The calculated room name, and whether it was calculated from the heroes. Set by
+	// InternalRequestLists.SetRoom, which only recalculates it when the fields it depends on change.
+	CalculatedName string
+	NameFromHeroes bool
+}
+
+// RoomName returns the calculated name of the room and whether it was calculated from the heroes.
+// Uses the name cached by InternalRequestLists.SetRoom if there is one.
+func (r *RoomConnMetadata) RoomName() (name string, calculated bool) {
+	if r.CalculatedName != "" {
+		return r.CalculatedName, r.NameFromHeroes
+	}
+	return internal.CalculateRoomName(&r.RoomMetadata, 5)
 }
 
 // SameRoomAvatar checks if the fields relevant for room avatars have changed between the two metadatas.
@@ -105,3 +145,17 @@ func (r *RoomConnMetadata) GetLastInterestedEventTimestamp(listKey string) uint6
 	r.LastInterestedEventTimestamps[listKey] = ts
 	return ts
 }
+
+// GetLastInterestedEventNID is GetLastInterestedEventTimestamp for LastInterestedEventNIDs.
+func (r *RoomConnMetadata) GetLastInterestedEventNID(listKey string) int64 {
+	nid, ok := r.LastInterestedEventNIDs[listKey]
+	if ok {
+		return nid
+	}
+	nid = r.LastMessageNID()
+	if r.LastInterestedEventNIDs == nil {
+		r.LastInterestedEventNIDs = make(map[string]int64)
+	}
+	r.LastInterestedEventNIDs[listKey] = nid
+	return nid
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/tidwall/gjson"
 	"reflect"
 	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
 )
 
 func TestAvatarChangeMarshalling(t *testing.T) {
@@ -72,3 +74,41 @@ func TestAvatarChangeMarshalling(t *testing.T) {
 		})
 	}
 }
+
+func TestNewDMPartner(t *testing.T) {
+	bob := internal.Hero{ID: "@bob:localhost", Name: "Bob", Avatar: "mxc://bob"}
+	charlie := internal.Hero{ID: "@charlie:localhost"}
+	testCases := []struct {
+		name   string
+		heroes []internal.Hero
+		isDM   bool
+		want   *DMPartner
+	}{
+		{
+			name:   "DM",
+			heroes: []internal.Hero{bob},
+			isDM:   true,
+			want:   &DMPartner{UserID: bob.ID, DisplayName: bob.Name, AvatarURL: bob.Avatar},
+		},
+		{
+			name:   "not a DM",
+			heroes: []internal.Hero{bob},
+			isDM:   false,
+		},
+		{
+			name:   "DM with several other users",
+			heroes: []internal.Hero{bob, charlie},
+			isDM:   true,
+		},
+		{
+			name: "DM with nobody else",
+			isDM: true,
+		},
+	}
+	for _, tc := range testCases {
+		got := NewDMPartner(&internal.RoomMetadata{Heroes: tc.heroes}, tc.isDM)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -100,8 +100,12 @@ func (s *SortableRooms) Sort(sortBy []string) error {
 			comparators = append(comparators, s.comparatorSortByName)
 		case SortByRecency:
 			comparators = append(comparators, s.comparatorSortByRecency)
+		case SortByArrival:
+			comparators = append(comparators, s.comparatorSortByArrival)
 		case SortByNotificationLevel:
 			comparators = append(comparators, s.comparatorSortByNotificationLevel)
+		case SortByManual:
+			comparators = append(comparators, s.comparatorSortByManual)
 		default:
 			return fmt.Errorf("unknown sort order: %s", sort)
 		}
@@ -158,6 +162,40 @@ func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
 	return -1
 }
 
+// comparatorSortByArrival is like comparatorSortByRecency, but orders rooms by when the proxy
+// received their latest events rather than by origin_server_ts.
+func (s *SortableRooms) comparatorSortByArrival(i, j int) int {
+	ri, rj := s.resolveRooms(i, j)
+	nidRi := ri.GetLastInterestedEventNID(s.listKey)
+	nidRj := rj.GetLastInterestedEventNID(s.listKey)
+	if nidRi == nidRj {
+		return 0
+	}
+	if nidRi > nidRj {
+		return 1
+	}
+	return -1
+}
+
+// comparatorSortByManual orders the rooms the user has pinned first, in the order they were
+// pinned, followed by all other rooms by recency.
+func (s *SortableRooms) comparatorSortByManual(i, j int) int {
+	ri, rj := s.resolveRooms(i, j)
+	switch {
+	case ri.ManualOrder == 0 && rj.ManualOrder == 0:
+		return s.comparatorSortByRecency(i, j)
+	case ri.ManualOrder == rj.ManualOrder:
+		return 0
+	case rj.ManualOrder == 0:
+		return 1
+	case ri.ManualOrder == 0:
+		return -1
+	case ri.ManualOrder < rj.ManualOrder:
+		return 1
+	}
+	return -1
+}
+
 func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
 	if ri.HighlightCount == rj.HighlightCount {
@@ -48,6 +48,7 @@ func TestSortBySingleOperation(t *testing.T) {
 				CanonicalisedName: "foo",
 			},
 			LastInterestedEventTimestamps: map[string]uint64{listKey: 600},
+			LastInterestedEventNIDs:       map[string]int64{listKey: 40},
 		},
 		{
 			RoomMetadata: internal.RoomMetadata{
@@ -59,6 +60,7 @@ func TestSortBySingleOperation(t *testing.T) {
 				CanonicalisedName: "koo",
 			},
 			LastInterestedEventTimestamps: map[string]uint64{listKey: 700},
+			LastInterestedEventNIDs:       map[string]int64{listKey: 10},
 		},
 		{
 			RoomMetadata: internal.RoomMetadata{
@@ -70,6 +72,7 @@ func TestSortBySingleOperation(t *testing.T) {
 				CanonicalisedName: "yoo",
 			},
 			LastInterestedEventTimestamps: map[string]uint64{listKey: 900},
+			LastInterestedEventNIDs:       map[string]int64{listKey: 20},
 		},
 		{
 			RoomMetadata: internal.RoomMetadata{
@@ -81,16 +84,19 @@ func TestSortBySingleOperation(t *testing.T) {
 				CanonicalisedName: "boo",
 			},
 			LastInterestedEventTimestamps: map[string]uint64{listKey: 800},
+			LastInterestedEventNIDs:       map[string]int64{listKey: 30},
 		},
 	}
 	// name: 4,1,2,3
 	// recency: 3,4,2,1
+	// arrival: 1,4,3,2
 	// highlight: 1,3,4,2
 	// notif: 1,3,2,4
 	// level+recency: 3,4,1,2 as 3,4,1 have highlights then sorted by recency
 	wantMap := map[string][]string{
 		SortByName:              {room4, room1, room2, room3},
 		SortByRecency:           {room3, room4, room2, room1},
+		SortByArrival:           {room1, room4, room3, room2},
 		SortByHighlightCount:    {room1, room3, room4, room2},
 		SortByNotificationCount: {room1, room3, room2, room4},
 		SortByNotificationLevel + " " + SortByRecency: {room3, room4, room1, room2},
@@ -387,3 +393,36 @@ func TestSortByNotificationLevel(t *testing.T) {
 		t.Errorf("want: %v", wantRoomIDs)
 	}
 }
+
+func TestSortByManual(t *testing.T) {
+	const listKey = "my_list"
+	rooms := []*RoomConnMetadata{
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: "!old:localhost"},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 1},
+		},
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: "!pinned-second:localhost"},
+			UserRoomData:                  caches.UserRoomData{ManualOrder: 2},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 5},
+		},
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: "!new:localhost"},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 4},
+		},
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: "!pinned-first:localhost"},
+			UserRoomData:                  caches.UserRoomData{ManualOrder: 1},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 2},
+		},
+	}
+	f := newFinder(rooms)
+	sr := NewSortableRooms(f, listKey, f.roomIDs)
+	if err := sr.Sort([]string{SortByManual}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	want := []string{"!pinned-first:localhost", "!pinned-second:localhost", "!new:localhost", "!old:localhost"}
+	if got := sr.RoomIDs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
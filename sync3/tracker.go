@@ -33,24 +33,53 @@ func NewJoinedRoomsTracker() *JoinedRoomsTracker {
 // Startup efficiently sets up the joined rooms tracker, but isn't safe to call with live traffic,
 // as it replaces all known in-memory state. Panics if called on a non-empty tracker.
 func (t *JoinedRoomsTracker) Startup(roomToJoinedUsers map[string][]string) {
+	t.StartupFrom(func(onJoinedMember func(roomID, userID string)) error {
+		for roomID, userIDs := range roomToJoinedUsers {
+			for _, u := range userIDs {
+				onJoinedMember(roomID, u)
+			}
+		}
+		return nil
+	})
+}
+
+// StartupFrom is like Startup but is given joined members one at a time by load, so the caller
+// doesn't need to hold every membership in memory at once. load must call onJoinedMember for each
+// joined member of each room. Returns the error from load.
+func (t *JoinedRoomsTracker) StartupFrom(load func(onJoinedMember func(roomID, userID string)) error) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if len(t.roomIDToJoinedUsers) > 0 || len(t.userIDToJoinedRooms) > 0 {
 		panic("programming error: cannot call JoinedRoomsTracker.Startup with existing data already set!")
 	}
-	for roomID, userIDs := range roomToJoinedUsers {
-		userSet := make(set)
-		for _, u := range userIDs {
-			userSet[u] = struct{}{}
-			rooms := t.userIDToJoinedRooms[u]
-			if rooms == nil {
-				rooms = make(set)
-			}
-			rooms[roomID] = struct{}{}
-			t.userIDToJoinedRooms[u] = rooms
+	// Each membership comes with freshly allocated strings. Share one copy of each room and user ID
+	// between all the sets they appear in, so memory scales with the number of rooms and users
+	// rather than the number of memberships.
+	roomIDs := make(map[string]string)
+	userIDs := make(map[string]string)
+	intern := func(m map[string]string, s string) string {
+		if existing, ok := m[s]; ok {
+			return existing
 		}
-		t.roomIDToJoinedUsers[roomID] = userSet
+		m[s] = s
+		return s
 	}
+	return load(func(roomID, userID string) {
+		roomID = intern(roomIDs, roomID)
+		userID = intern(userIDs, userID)
+		users := t.roomIDToJoinedUsers[roomID]
+		if users == nil {
+			users = make(set)
+			t.roomIDToJoinedUsers[roomID] = users
+		}
+		users[userID] = struct{}{}
+		rooms := t.userIDToJoinedRooms[userID]
+		if rooms == nil {
+			rooms = make(set)
+			t.userIDToJoinedRooms[userID] = rooms
+		}
+		rooms[roomID] = struct{}{}
+	})
 }
 
 func (t *JoinedRoomsTracker) IsUserJoined(userID, roomID string) bool {
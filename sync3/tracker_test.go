@@ -3,6 +3,7 @@ package sync3
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -83,6 +84,35 @@ func TestTrackerStartup(t *testing.T) {
 	assertInt(t, jrt.NumInvitedUsersForRoom(roomC), 0)
 }
 
+func TestTrackerStartupFrom(t *testing.T) {
+	jrt := NewJoinedRoomsTracker()
+	err := jrt.StartupFrom(func(onJoinedMember func(roomID, userID string)) error {
+		// fresh strings each time, as if scanned from the database
+		for i := 0; i < 3; i++ {
+			onJoinedMember(fmt.Sprintf("!room%d", i), strings.Clone("@alice"))
+			onJoinedMember(fmt.Sprintf("!room%d", i), fmt.Sprintf("@bob%d", i))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StartupFrom returned error: %s", err)
+	}
+	assertEqualSlices(t, "", jrt.JoinedRoomsForUser("@alice"), []string{"!room0", "!room1", "!room2"})
+	assertEqualSlices(t, "", jrt.JoinedRoomsForUser("@bob1"), []string{"!room1"})
+	assertEqualSlices(t, "", joinedUsersForRoom(jrt, "!room2"), []string{"@alice", "@bob2"})
+
+	// load errors are returned
+	jrt = NewJoinedRoomsTracker()
+	wantErr := fmt.Errorf("db is down")
+	err = jrt.StartupFrom(func(onJoinedMember func(roomID, userID string)) error {
+		onJoinedMember("!room", "@alice")
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("StartupFrom returned %v want %v", err, wantErr)
+	}
+}
+
 func TestTrackerReload(t *testing.T) {
 	roomA := "!a"
 	roomB := "!b"
@@ -0,0 +1,96 @@
+package syncv3_test
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/matrix-org/sliding-sync/testutils/m"
+)
+
+// Walks a user through a typical lifecycle against a real homeserver on a single connection: log in
+// on a new device, upload keys, receive an invite, join the room, have a key claimed and then see the
+// room get upgraded. The individual steps are tested in more detail elsewhere; this test exists to
+// catch divergences between Synapse and the mock server used in tests-integration when the steps are
+// combined.
+func TestJourneyLoginInviteJoinUpgrade(t *testing.T) {
+	alice := registerNamedUser(t, "alice")
+	bob := registerNamedUser(t, "bob")
+	bob.Login(t, "password", "JOURNEY")
+
+	// upload OTKs for the new device. Synapse does not check the signatures.
+	bob.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "upload"}, client.WithJSONBody(t, map[string]any{
+		"one_time_keys": map[string]any{
+			"signed_curve25519:AAAAAAAAAA0": map[string]any{
+				"key": "IuCQvr2AaZC70tCG6g1ZardACNe3mcKZ2PjKJ2p49UM",
+				"signatures": map[string]any{
+					bob.UserID: map[string]any{"ed25519:JOURNEY": "FXBkzwuLkfriWJ1B2z9wTHvi7WTOZGvs2oSNJ7CycXJYC6k06sa7a+OMQtpMP2RTuIpiYC+wZ3nFoKp1FcCcBQ"},
+				},
+			},
+			"signed_curve25519:AAAAAAAAAA4": map[string]any{
+				"key": "pgeLFCJPLYUtyLPKDPr76xRYgPjjY4/lEUH98tExxCo",
+				"signatures": map[string]any{
+					bob.UserID: map[string]any{"ed25519:JOURNEY": "/o44D5qjTdiYORSXmCVYE3Vzvbz2OlIBC58ELe+EAAgIZTJyDxmBJIFotP6CIuFmB/p4lGCd41Fb6T5BnmLvBQ"},
+				},
+			},
+		},
+	}))
+
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 10,
+				},
+			},
+		},
+		Extensions: extensions.Request{
+			E2EE: &extensions.E2EERequest{
+				Core: extensions.Core{Enabled: &boolTrue},
+			},
+		},
+	}
+	res := bob.SlidingSync(t, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(0)), m.MatchOTKCounts(map[string]int{
+		"signed_curve25519": 2,
+	}))
+
+	// alice invites bob to a new room
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+	alice.InviteRoom(t, roomID, bob.UserID)
+	res = bob.SlidingSyncUntilMembership(t, res.Pos, roomID, bob, "invite")
+
+	// bob joins
+	bob.JoinRoom(t, roomID, nil)
+	res = bob.SlidingSyncUntilMembership(t, res.Pos, roomID, bob, "join")
+
+	// alice claims one of bob's keys. Claims don't wake up the sync loop, so send something too.
+	mustClaimOTK(t, alice, bob)
+	alice.SendEventSynced(t, roomID, b.Event{
+		Type:    "m.room.message",
+		Content: map[string]interface{}{"msgtype": "m.text", "body": "keys claimed"},
+	})
+	res = bob.SlidingSyncUntil(t, res.Pos, req, m.MatchOTKCounts(map[string]int{
+		"signed_curve25519": 1,
+	}))
+
+	// alice upgrades the room, bob sees the tombstone in the old room
+	newRoomID := upgradeRoom(t, alice, roomID)
+	res = bob.SlidingSyncUntilEvent(t, res.Pos, req, roomID, Event{
+		Type:     "m.room.tombstone",
+		StateKey: ptr(""),
+		Sender:   alice.UserID,
+	})
+
+	// a fresh connection on the new device sees the old room, as bob was not invited to the new room.
+	res = bob.SlidingSync(t, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 0, []string{roomID}),
+	)))
+	if _, ok := res.Rooms[newRoomID]; ok {
+		t.Errorf("bob was sent the upgraded room %s without being invited to it", newRoomID)
+	}
+}
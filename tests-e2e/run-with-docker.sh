@@ -0,0 +1,33 @@
+#!/bin/bash -eu
+# Runs the end-to-end tests against a containerised Synapse and Postgres, then tears them down.
+# Requires docker, and a `docker login` to ghcr.io to pull the Synapse image.
+# All arguments are passed to `go test`, e.g ./run-with-docker.sh -count=1 -run TestJourney .
+cd "$(dirname "$0")"
+
+SYNAPSE_IMAGE="${SYNAPSE_IMAGE:-ghcr.io/matrix-org/synapse-service:v1.94.0}"
+POSTGRES_IMAGE="${POSTGRES_IMAGE:-postgres:13-alpine}"
+SYNAPSE_PORT="${SYNAPSE_PORT:-8888}"
+POSTGRES_PORT="${POSTGRES_PORT:-5433}"
+
+SYNAPSE_CID=$(docker run -d --rm -e "SYNAPSE_COMPLEMENT_DATABASE=sqlite" -e "SERVER_NAME=synapse" -p "$SYNAPSE_PORT:8008" "$SYNAPSE_IMAGE")
+POSTGRES_CID=$(docker run -d --rm -e "POSTGRES_PASSWORD=postgres" -e "POSTGRES_DB=syncv3" -p "$POSTGRES_PORT:5432" "$POSTGRES_IMAGE")
+trap "docker stop $SYNAPSE_CID $POSTGRES_CID > /dev/null" EXIT
+
+attempts=0
+until curl -sf -o /dev/null "http://localhost:$SYNAPSE_PORT/_matrix/client/versions" && docker exec "$POSTGRES_CID" pg_isready -q -U postgres
+do
+  if [ "$attempts" -gt 60 ]; then
+    echo "Synapse or Postgres did not start after $attempts seconds"
+    exit 1
+  fi
+  echo "Waiting (total ${attempts}s) for Synapse and Postgres to start..."
+  sleep 1
+  attempts=$((attempts+1))
+done
+
+(cd .. && go build ./cmd/syncv3)
+
+export SYNCV3_SERVER="http://localhost:$SYNAPSE_PORT"
+export SYNCV3_DB="user=postgres dbname=syncv3 sslmode=disable password=postgres host=localhost port=$POSTGRES_PORT"
+export SYNCV3_SECRET="${SYNCV3_SECRET:-itsasecret}"
+./run-tests.sh "$@"
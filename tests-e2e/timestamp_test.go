@@ -77,13 +77,13 @@ func TestTimestamp(t *testing.T) {
 	})
 	time.Sleep(time.Millisecond)
 
+	// an unchanged timestamp is left out of incremental updates
 	resBob = bob.SlidingSyncUntilEventID(t, resBob.Pos, roomID, eventID)
 	gotTs = resBob.Rooms[roomID].Timestamp
-	expectedTs = resAlice.Rooms[roomID].Timestamp
-	if gotTs != expectedTs {
-		t.Fatalf("expected timestamps to be the same, but they aren't: %v vs %v", gotTs, expectedTs)
+	if gotTs != 0 {
+		t.Fatalf("expected timestamp to be omitted as it hasn't changed, got %v", gotTs)
 	}
-	expectedTs = gotTs
+	expectedTs = resAlice.Rooms[roomID].Timestamp
 
 	// Now send a message which bumps the timestamp in myFirstList
 	eventID = alice.SendEventSynced(t, roomID, b.Event{
@@ -134,8 +134,8 @@ func TestTimestamp(t *testing.T) {
 
 	resBob = bob.SlidingSyncUntilEventID(t, resBob.Pos, roomID, eventID)
 	gotTs = resBob.Rooms[roomID].Timestamp
-	if gotTs != expectedTs {
-		t.Fatalf("expected timestamps to be the same, but they aren't: %v, expected %v", gotTs, expectedTs)
+	if gotTs != 0 {
+		t.Fatalf("expected timestamp to be omitted as it hasn't changed, got %v", gotTs)
 	}
 
 	// Bob makes an initial sync again, he should still see the m.reaction timestamp
@@ -338,6 +338,61 @@ func TestTxnIDEcho(t *testing.T) {
 	m.MatchResponse(t, res, m.MatchTxnID(txnID2))
 }
 
+// Test that pos can be sent in the request body instead of as a query param.
+func TestPosInRequestBody(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	// setup code
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomID := "!a:localhost"
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	sub := map[string]sync3.RoomSubscription{
+		roomID: {
+			TimelineLimit: 5,
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: sub,
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, m.MatchRoomInitial(true)))
+
+	newEvent := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hi"})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{newEvent},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	// if the pos were ignored, this would be treated as a new connection and the room would be
+	// sent again with its whole timeline
+	res = v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Pos:               res.Pos,
+		RoomSubscriptions: sub,
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, m.MatchRoomInitial(false), m.MatchRoomTimeline([]json.RawMessage{newEvent})))
+
+	_, body, code := v3.doV3Request(t, context.Background(), aliceToken, "", sync3.Request{
+		Pos: "not-a-number",
+	})
+	if code != 400 || gjson.GetBytes(body, "errcode").Str != "M_UNKNOWN_POS" {
+		t.Errorf("got status %d for an invalid pos in the body, want 400 M_UNKNOWN_POS: %s", code, body)
+	}
+}
+
 // Test that we implement https://github.com/matrix-org/matrix-spec-proposals/blob/kegan/sync-v3/proposals/3575-sync.md#sticky-request-parameters
 // correctly server-side. We do this by:
 // - Create rooms A, B and C.
@@ -456,7 +511,7 @@ func TestEnsurePollingDoesntQueue(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	// setup code
 	v2 := runTestV2Server(t)
-	v2.timeToWaitForV2Response = 5 * time.Second
+	v2.TimeToWaitForV2Response = 5 * time.Second
 	v3 := runTestServer(t, v2, pqString)
 	defer v2.close()
 	defer v3.close()
@@ -707,3 +762,91 @@ func TestExpiredAccessTokenMultipleConns(t *testing.T) {
 		}
 	}
 }
+
+// Test that request bodies over the configured limit are rejected with a 413 rather than read
+// into memory.
+func TestRequestBodyTooLarge(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v2.addAccount(t, alice, aliceToken)
+	v3 := runTestServer(t, v2, pqString, slidingsync.Opts{
+		MaxRequestBodyBytes: 1024,
+	})
+	defer v2.close()
+	defer v3.close()
+	// small requests are fine
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+
+	subs := make(map[string]sync3.RoomSubscription)
+	for i := 0; i < 100; i++ {
+		subs[fmt.Sprintf("!room%d:localhost", i)] = sync3.RoomSubscription{TimelineLimit: 1}
+	}
+	_, body, statusCode := v3.doV3Request(t, context.Background(), aliceToken, "", sync3.Request{
+		RoomSubscriptions: subs,
+	})
+	if statusCode != 413 {
+		t.Fatalf("got %d want 413 : %v", statusCode, string(body))
+	}
+	if errcode := gjson.GetBytes(body, "errcode").Str; errcode != "M_TOO_LARGE" {
+		t.Fatalf("got errcode %s want M_TOO_LARGE", errcode)
+	}
+}
+
+// Test that clients cannot create new connections faster than the per-IP limit, but can keep
+// using existing connections.
+func TestNewConnRateLimit(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v2.addAccount(t, alice, aliceToken)
+	v3 := runTestServer(t, v2, pqString, slidingsync.Opts{
+		NewConnsPerIPPerMinute: 2,
+	})
+	defer v2.close()
+	defer v3.close()
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{ConnID: "A"})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{ConnID: "B"})
+
+	_, body, statusCode := v3.doV3Request(t, context.Background(), aliceToken, "", sync3.Request{ConnID: "C"})
+	if statusCode != 429 {
+		t.Fatalf("got %d want 429 : %v", statusCode, string(body))
+	}
+	if errcode := gjson.GetBytes(body, "errcode").Str; errcode != "M_LIMIT_EXCEEDED" {
+		t.Fatalf("got errcode %s want M_LIMIT_EXCEEDED", errcode)
+	}
+	if retryAfter := gjson.GetBytes(body, "retry_after_ms").Int(); retryAfter <= 0 {
+		t.Fatalf("got retry_after_ms %d want > 0", retryAfter)
+	}
+
+	// existing connections are not limited
+	req := sync3.Request{ConnID: "B"}
+	req.SetTimeoutMSecs(1)
+	v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+}
+
+// Test that a user cannot exceed their request budget, even when spreading requests over
+// multiple devices, and that other users are unaffected.
+func TestUserRequestBudget(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	aliceToken2 := "ALICE_BEARER_TOKEN_2"
+	v2.addAccount(t, alice, aliceToken)
+	v2.addAccountWithDeviceID(alice, "SECOND_DEVICE", aliceToken2)
+	v2.addAccount(t, bob, bobToken)
+	v3 := runTestServer(t, v2, pqString, slidingsync.Opts{
+		RequestsPerUserPerMinute: 2,
+	})
+	defer v2.close()
+	defer v3.close()
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	v3.mustDoV3Request(t, aliceToken2, sync3.Request{})
+
+	_, body, statusCode := v3.doV3Request(t, context.Background(), aliceToken, "", sync3.Request{})
+	if statusCode != 429 {
+		t.Fatalf("got %d want 429 : %v", statusCode, string(body))
+	}
+	if errcode := gjson.GetBytes(body, "errcode").Str; errcode != "M_LIMIT_EXCEEDED" {
+		t.Fatalf("got errcode %s want M_LIMIT_EXCEEDED", errcode)
+	}
+	// bob has a separate budget
+	v3.mustDoV3Request(t, bobToken, sync3.Request{})
+}
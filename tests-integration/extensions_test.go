@@ -12,6 +12,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/matrix-org/sliding-sync/testutils/m"
+	"github.com/tidwall/gjson"
 )
 
 var valTrue = true
@@ -893,3 +894,169 @@ func TestTypingMultiplePoller(t *testing.T) {
 		m.MatchResponse(t, res, m.MatchTyping(roomA, []string{bob}))
 	}
 }
+
+// Checks that data queued via the testV2Server helpers makes it to the extensions.
+func TestExtensionsFromV2ServerHelpers(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	roomID := "!helpers:localhost"
+	v2.addAccount(t, alice, aliceToken)
+	state := createRoomState(t, alice, time.Now())
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: state,
+			}),
+		},
+	})
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{{0, 10}},
+		}},
+		Extensions: extensions.Request{
+			ToDevice:    &extensions.ToDeviceRequest{Core: extensions.Core{Enabled: &boolTrue}},
+			E2EE:        &extensions.E2EERequest{Core: extensions.Core{Enabled: &boolTrue}},
+			AccountData: &extensions.AccountDataRequest{Core: extensions.Core{Enabled: &boolTrue}},
+			Typing:      &extensions.TypingRequest{Core: extensions.Core{Enabled: &boolTrue}},
+			Receipts:    &extensions.ReceiptsRequest{Core: extensions.Core{Enabled: &boolTrue}},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)))
+
+	lastEventID := gjson.ParseBytes(state[len(state)-1]).Get("event_id").Str
+	roomAccountData := testutils.NewAccountData(t, "com.example.helpers", map[string]interface{}{"foo": "bar"})
+	toDeviceMsg := json.RawMessage(`{"type":"m.room_key_request","sender":"@bob:localhost","content":{"action":"request_cancellation","request_id":"helpers","requesting_device_id":"BOB"}}`)
+	v2.queueTyping(alice, roomID, bob)
+	v2.queueReceipt(alice, roomID, lastEventID, "m.read", bob)
+	v2.queueAccountData(alice, roomID, roomAccountData)
+	v2.queueToDevice(alice, toDeviceMsg)
+	v2.queueDeviceLists(alice, []string{bob}, nil)
+	v2.waitUntilEmpty(t, alice)
+
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res,
+		m.MatchTyping(roomID, []string{bob}),
+		m.MatchReceipts(roomID, []m.Receipt{{
+			EventID: lastEventID,
+			UserID:  bob,
+			Type:    "m.read",
+		}}),
+		m.MatchHasRoomAccountData(roomID, roomAccountData),
+		m.MatchToDeviceMessages([]json.RawMessage{toDeviceMsg}),
+		m.MatchDeviceLists([]string{bob}, []string{}),
+	)
+
+	// invites and leaves come through as room updates.
+	inviteRoomID := "!helpers-invite:localhost"
+	v2.queueInvite(t, alice, inviteRoomID, bob)
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2)), m.MatchRoomSubscription(inviteRoomID, m.MatchRoomHasInviteState()))
+
+	v2.queueLeave(alice, inviteRoomID, testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{
+		"membership": "leave",
+	}))
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)))
+}
+
+// Test that private read receipts are sent to the user who sent them but never to anyone else, and
+// that the unread counts which come with them are used.
+func TestExtensionReceiptsPrivate(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	roomID := "!private-receipts:localhost"
+	v2.addAccount(t, alice, aliceToken)
+	v2.addAccount(t, bob, bobToken)
+	state := createRoomState(t, bob, time.Now())
+	aliceJoin := testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{
+		"membership": "join",
+	})
+	message := testutils.NewMessageEvent(t, bob, "read me")
+	messageID := gjson.GetBytes(message, "event_id").Str
+	for _, userID := range []string{alice, bob} {
+		v2.queueResponse(userID, sync2.SyncResponse{
+			Rooms: sync2.SyncRoomsResponse{
+				Join: v2JoinTimeline(roomEvents{
+					roomID:     roomID,
+					state:      state,
+					events:     []json.RawMessage{aliceJoin, message},
+					notifCount: ptr(1),
+				}),
+			},
+		})
+	}
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges:           sync3.SliceRanges{{0, 10}},
+			RoomSubscription: sync3.RoomSubscription{TimelineLimit: 1},
+		}},
+		Extensions: extensions.Request{
+			Receipts: &extensions.ReceiptsRequest{Core: extensions.Core{Enabled: &boolTrue}},
+		},
+	}
+	aliceRes := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, aliceRes, m.MatchRoomSubscription(roomID, m.MatchRoomNotificationCount(1)))
+	bobRes := v3.mustDoV3Request(t, bobToken, req)
+
+	t.Log("Alice reads the message privately, which clears her notifications.")
+	privateReceipt, _ := json.Marshal(map[string]interface{}{
+		"type": "m.receipt",
+		"content": map[string]interface{}{
+			messageID: map[string]interface{}{
+				"m.read.private": map[string]interface{}{
+					alice: map[string]interface{}{"ts": time.Now().UnixMilli()},
+				},
+			},
+		},
+	})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomID: {
+					Ephemeral:           sync2.EventsResponse{Events: []json.RawMessage{privateReceipt}},
+					UnreadNotifications: sync2.UnreadNotifications{NotificationCount: ptr(0)},
+				},
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, req)
+	m.MatchResponse(t, aliceRes,
+		m.MatchRoomSubscription(roomID, m.MatchRoomNotificationCount(0)),
+		m.MatchReceipts(roomID, []m.Receipt{{
+			EventID: messageID,
+			UserID:  alice,
+			Type:    "m.read.private",
+		}}),
+	)
+
+	t.Log("Bob sees Alice's public receipt, but not her private one.")
+	v2.queueReceipt(bob, roomID, messageID, "m.read", alice)
+	v2.waitUntilEmpty(t, bob)
+	bobRes = v3.mustDoV3RequestWithPos(t, bobToken, bobRes.Pos, req)
+	m.MatchResponse(t, bobRes, m.MatchReceipts(roomID, []m.Receipt{{
+		EventID: messageID,
+		UserID:  alice,
+		Type:    "m.read",
+	}}))
+
+	t.Log("Bob's new connections don't see Alice's private receipt either.")
+	bobRes = v3.mustDoV3Request(t, bobToken, req)
+	m.MatchResponse(t, bobRes, m.MatchReceipts(roomID, []m.Receipt{{
+		EventID: messageID,
+		UserID:  alice,
+		Type:    "m.read",
+	}}))
+}
@@ -623,3 +623,57 @@ func TestFiltersTags(t *testing.T) {
 		m.MatchV3InsertOp(3, fav2RoomID),
 	)))
 }
+
+// Test that favouriting a room moves it into tag-filtered lists without reconnecting.
+func TestFiltersTagsAddedLive(t *testing.T) {
+	tagFav := "m.favourite"
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	roomA := "!a-tagged-live:localhost"
+	roomB := "!b-tagged-live:localhost"
+	rig.SetupV2RoomsForUser(t, alice, NoFlush, map[string]RoomDescriptor{
+		roomA: {},
+		roomB: {},
+	})
+	aliceToken := rig.Token(alice)
+	lists := map[string]sync3.RequestList{
+		"fav": {
+			Ranges: sync3.SliceRanges{{0, 20}},
+			Filters: &sync3.RequestFilters{
+				Tags: []string{tagFav},
+			},
+		},
+		"nofav": {
+			Ranges: sync3.SliceRanges{{0, 20}},
+			Filters: &sync3.RequestFilters{
+				NotTags: []string{tagFav},
+			},
+		},
+	}
+	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{Lists: lists})
+	m.MatchResponse(t, res, m.MatchList("fav", m.MatchV3Count(0)), m.MatchList("nofav", m.MatchV3Count(2)))
+
+	rig.V2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomB: {
+					AccountData: sync2.EventsResponse{
+						Events: []json.RawMessage{
+							testutils.NewAccountData(t, "m.tag", map[string]interface{}{
+								"tags": map[string]interface{}{
+									tagFav: map[string]interface{}{"order": 0.5},
+								},
+							}),
+						},
+					},
+				},
+			},
+		},
+	})
+	rig.V2.waitUntilEmpty(t, alice)
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{Lists: lists})
+	m.MatchResponse(t, res, m.MatchList("fav", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3DeleteOp(0),
+		m.MatchV3InsertOp(0, roomB),
+	)), m.MatchList("nofav", m.MatchV3Count(1)))
+}
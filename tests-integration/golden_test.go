@@ -0,0 +1,100 @@
+package syncv3
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+// TestGoldenBasicScenario runs a scripted scenario covering lists, room subscriptions, live updates
+// and extensions, and compares the full responses with testdata/golden/basic_scenario.json.
+// Run with SYNCV3_UPDATE_GOLDEN=1 to update the golden file after an intended change.
+func TestGoldenBasicScenario(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	golden := testutils.NewGolden(t, "basic_scenario")
+
+	// fixed timestamps so the ordering of rooms is stable.
+	baseTimestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	roomA := "!golden-a:localhost"
+	roomB := "!golden-b:localhost"
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomA,
+				events: append(
+					createRoomState(t, alice, baseTimestamp),
+					testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Room A"}, testutils.WithTimestamp(baseTimestamp.Add(time.Second))),
+				),
+			}, roomEvents{
+				roomID: roomB,
+				events: append(
+					createRoomState(t, alice, baseTimestamp.Add(time.Minute)),
+					testutils.NewMessageEvent(t, alice, "hello B", testutils.WithTimestamp(baseTimestamp.Add(2*time.Minute))),
+				),
+			}),
+		},
+	})
+
+	do := func(pos string, req sync3.Request) *sync3.Response {
+		t.Helper()
+		res, body, code := v3.doV3Request(t, context.Background(), aliceToken, pos, req)
+		if code != 200 {
+			t.Fatalf("got HTTP %d: %s", code, string(body))
+		}
+		golden.Record(body)
+		return res
+	}
+
+	// initial sync of the list
+	res := do("", sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{{0, 10}},
+			Sort:   []string{sync3.SortByRecency},
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.name", ""}},
+			},
+		}},
+		Extensions: extensions.Request{
+			Typing: &extensions.TypingRequest{Core: extensions.Core{Enabled: &boolTrue}},
+		},
+	})
+
+	// subscribe to a room with a larger timeline
+	res = do(res.Pos, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA: {
+				TimelineLimit: 5,
+				RequiredState: [][2]string{{"m.room.create", ""}, {"m.room.member", "*"}},
+			},
+		},
+	})
+
+	// live message moves room A to the top, and someone starts typing
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomA,
+				events: []json.RawMessage{
+					testutils.NewMessageEvent(t, alice, "hello A", testutils.WithTimestamp(baseTimestamp.Add(3*time.Minute))),
+				},
+			}),
+		},
+	})
+	v2.queueTyping(alice, roomA, alice)
+	v2.waitUntilEmpty(t, alice)
+	do(res.Pos, sync3.Request{})
+
+	golden.Check()
+}
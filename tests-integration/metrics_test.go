@@ -165,3 +165,47 @@ func TestMetricsNumConns(t *testing.T) {
 
 	// TODO: now expire conn -> decrease
 }
+
+func TestMetricsDB(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, slidingsync.Opts{
+		AddPrometheusMetrics: true,
+	})
+	defer v2.close()
+	defer v3.close()
+	metricsServer := runMetricsServer(t)
+	defer metricsServer.Close()
+
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: "!unimportant",
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+
+	metrics := getMetrics(t, metricsServer)
+	wantPrefixes := []string{
+		`go_sql_in_use_connections{db_name="syncv3"}`,
+		`go_sql_idle_connections{db_name="syncv3"}`,
+		`go_sql_wait_duration_seconds_total{db_name="syncv3"}`,
+		`sliding_sync_db_query_duration_secs_count{family="insert syncv3_events"}`,
+		`sliding_sync_db_query_duration_secs_count{family="select syncv3_sync2_tokens"}`,
+	}
+	for _, prefix := range wantPrefixes {
+		found := false
+		for _, line := range metrics {
+			if strings.HasPrefix(line, prefix+" ") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("did not find metric %s", prefix)
+		}
+	}
+}
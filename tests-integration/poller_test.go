@@ -738,7 +738,7 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	// TODO remove this? Otherwise running tests is sloooooow
-	v2.timeToWaitForV2Response /= 20
+	v2.TimeToWaitForV2Response /= 20
 	defer v2.close()
 	v3 := runTestServer(t, v2, pqString)
 	defer v3.close()
@@ -1260,3 +1260,72 @@ func assertUnknownPos(t *testing.T, respBytes []byte, statusCode int) {
 		t.Errorf("Got errcode %s, expected %s", errcode, "M_UNKNOWN_POS")
 	}
 }
+
+// Test that the poller delivers every event exactly once when the homeserver is flakey: returning
+// errors, malformed responses, duplicate responses and responses out of order.
+func TestPollerHandlesChaos(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	roomID := "!chaos:localhost"
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	req := sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 10},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+
+	v2.setChaos(&v2Chaos{
+		Latency:            10 * time.Millisecond,
+		ErrorEvery:         4,
+		MalformedJSONEvery: 6,
+		DuplicateEvery:     2,
+		ReorderEvery:       3,
+	})
+	wantBodies := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		body := fmt.Sprintf("chaos %d", i)
+		wantBodies[body] = 0
+		v2.queueResponse(alice, sync2.SyncResponse{
+			Rooms: sync2.SyncRoomsResponse{
+				Join: v2JoinTimeline(roomEvents{
+					roomID: roomID,
+					events: []json.RawMessage{testutils.NewMessageEvent(t, alice, body)},
+				}),
+			},
+		})
+	}
+
+	// keep syncing until we've seen all the messages, as errors cause the poller to back off.
+	deadline := time.Now().Add(30 * time.Second)
+	seen := 0
+	for seen < len(wantBodies) && time.Now().Before(deadline) {
+		req.SetTimeoutMSecs(1000)
+		res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+		for _, ev := range res.Rooms[roomID].Timeline {
+			body := gjson.GetBytes(ev, "content.body").Str
+			if _, ok := wantBodies[body]; ok {
+				wantBodies[body]++
+				seen++
+			}
+		}
+	}
+	v2.setChaos(nil)
+	for body, count := range wantBodies {
+		if count != 1 {
+			t.Errorf("saw message %q %d times, want 1", body, count)
+		}
+	}
+}
@@ -254,7 +254,7 @@ func TestBadCreateInitialiseDoesntWedgePolling(t *testing.T) {
 	// we aren't returning DataErrors when we should be.
 	wantSinces := []string{"", "1", "2"}
 	ch := make(chan bool)
-	v2.checkRequest = func(token string, req *http.Request) {
+	v2.SetCheckRequest(func(token string, req *http.Request) {
 		if len(wantSinces) == 0 {
 			return
 		}
@@ -268,7 +268,7 @@ func TestBadCreateInitialiseDoesntWedgePolling(t *testing.T) {
 		if len(wantSinces) == 0 {
 			close(ch)
 		}
-	}
+	})
 
 	// initial sync, everything fine
 	v2.queueResponse(alice, sync2.SyncResponse{
@@ -368,7 +368,7 @@ func TestBadPollDataDoesntDropToDeviceMsgs(t *testing.T) {
 	// we aren't returning DataErrors when we should be.
 	wantSinces := []string{"", "1", "2"}
 	ch := make(chan bool)
-	v2.checkRequest = func(token string, req *http.Request) {
+	v2.SetCheckRequest(func(token string, req *http.Request) {
 		if len(wantSinces) == 0 {
 			return
 		}
@@ -382,7 +382,7 @@ func TestBadPollDataDoesntDropToDeviceMsgs(t *testing.T) {
 		if len(wantSinces) == 0 {
 			close(ch)
 		}
-	}
+	})
 
 	// initial sync, everything fine
 	v2.queueResponse(alice, sync2.SyncResponse{
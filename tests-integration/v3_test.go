@@ -10,8 +10,6 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"strings"
-	"sync"
 	"testing"
 	"time"
 
@@ -27,6 +25,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3/handler"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/matrix-org/sliding-sync/testutils/m"
+	"github.com/matrix-org/sliding-sync/testutils/v2server"
 	"github.com/tidwall/gjson"
 )
 
@@ -48,267 +47,82 @@ var (
 	boolTrue = true
 )
 
-// testV2Server is a fake stand-in for the v2 sync API provided by a homeserver.
+// testV2Server is a fake stand-in for the v2 sync API provided by a homeserver. It wraps the
+// shared mock server with the helper names these tests have always used.
 type testV2Server struct {
-	// checkRequest is an arbitrary function which runs after a request has been
-	// received from pollers, but before the response is generated. This allows us to
-	// confirm that the proxy is polling the homeserver's v2 sync endpoint in the
-	// manner that we expect.
-	//
-	// checkRequest is called before we lookup a user for the given token. Tests can
-	// use this to invalidate the token right before a poll is made.
-	checkRequest            func(token string, req *http.Request)
-	mu                      *sync.Mutex
-	tokenToUser             map[string]string
-	tokenToDevice           map[string]string
-	queues                  map[string]chan sync2.SyncResponse
-	waiting                 map[string]*sync.Cond // broadcasts when the server is about to read a blocking input
-	srv                     *httptest.Server
-	invalidations           map[string]func() // token -> callback
-	timeToWaitForV2Response time.Duration
-}
-
-func (s *testV2Server) SetCheckRequest(fn func(token string, req *http.Request)) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.checkRequest = fn
-}
-
-// Most tests only use a single device per user. Give them this helper so they don't
-// have to care about providing a device name.
+	*v2server.Server
+}
+
+type v2Chaos = v2server.Chaos
+
+// runTestV2Server starts a fake stand-in for the v2 sync API provided by a homeserver.
+func runTestV2Server(t testutils.TestBenchInterface) *testV2Server {
+	t.Helper()
+	return &testV2Server{v2server.Run()}
+}
+
+func (s *testV2Server) url() string {
+	return s.URL()
+}
+
+func (s *testV2Server) close() {
+	s.Close()
+}
+
+func (s *testV2Server) setChaos(c *v2Chaos) {
+	s.SetChaos(c)
+}
+
 func (s *testV2Server) addAccount(t testutils.TestBenchInterface, userID, token string) {
-	// To keep our future selves sane while debugging use a device name that
-	//  - includes the mxid localpart, and
-	//  - includes the test name (to avoid leaking state from previous tests).
-	atLocalPart, _, _ := strings.Cut(userID, ":")
-	deviceID := fmt.Sprintf("%s_%s_device", atLocalPart[1:], t.Name())
-	s.addAccountWithDeviceID(userID, deviceID, token)
+	s.AddAccount(t, userID, token)
 }
 
-// Tests that use multiple devices for the same user need to be more explicit.
 func (s *testV2Server) addAccountWithDeviceID(userID, deviceID, token string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.tokenToUser[token] = userID
-	s.tokenToDevice[token] = deviceID
-	s.queues[token] = make(chan sync2.SyncResponse, 100)
-	s.waiting[token] = &sync.Cond{
-		L: &sync.Mutex{},
-	}
+	s.AddAccountWithDeviceID(userID, deviceID, token)
 }
 
-// like invalidateToken, but doesn't do any waiting.
 func (s *testV2Server) invalidateTokenImmediately(token string) {
-	s.mu.Lock()
-	delete(s.tokenToUser, token)
-	delete(s.tokenToDevice, token)
-	s.mu.Unlock()
+	s.InvalidateTokenImmediately(token)
 }
 
-// remove the token and wait until the proxy sends a request with this token, then 401 it and return.
 func (s *testV2Server) invalidateToken(token string) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	// add callback and delete the token
-	s.mu.Lock()
-	s.invalidations[token] = func() {
-		wg.Done()
-	}
-	delete(s.tokenToUser, token)
-	delete(s.tokenToDevice, token)
-	s.mu.Unlock()
+	s.InvalidateToken(token)
+}
 
-	// kick over the connection so the next request 401s and wait till we get said request
-	s.srv.CloseClientConnections()
-	wg.Wait()
+func (s *testV2Server) queueResponse(userIDOrToken string, resp sync2.SyncResponse) {
+	s.QueueResponse(userIDOrToken, resp)
+}
 
-	// cleanup the callback
-	s.mu.Lock()
-	delete(s.invalidations, token)
-	s.mu.Unlock()
-	// need to wait for the HTTP 401 response to be processed :(
-	time.Sleep(100 * time.Millisecond)
+func (s *testV2Server) queueInvite(t testutils.TestBenchInterface, userIDOrToken, roomID, inviter string, extraInviteState ...json.RawMessage) {
+	s.QueueInvite(t, userIDOrToken, roomID, inviter, extraInviteState...)
 }
 
-func (s *testV2Server) userID(token string) string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.tokenToUser[token]
+func (s *testV2Server) queueLeave(userIDOrToken, roomID string, timeline ...json.RawMessage) {
+	s.QueueLeave(userIDOrToken, roomID, timeline...)
 }
 
-func (s *testV2Server) deviceID(token string) string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.tokenToDevice[token]
+func (s *testV2Server) queueTyping(userIDOrToken, roomID string, typingUserIDs ...string) {
+	s.QueueTyping(userIDOrToken, roomID, typingUserIDs...)
 }
 
-func (s *testV2Server) queueResponse(userIDOrToken string, resp sync2.SyncResponse) {
-	// ensure we send valid responses
-	for roomID, room := range resp.Rooms.Join {
-		if len(room.State.Events) > 0 && len(room.Timeline.Events) == 0 {
-			panic(fmt.Sprintf("invalid queued v2 response for room %s: no timeline events but %d events in state block", roomID, len(room.State.Events)))
-		}
-	}
-	s.mu.Lock()
-	ch := s.queues[userIDOrToken]
-	if ch == nil {
-		// try to find a token for this user
-		for token, userID := range s.tokenToUser {
-			if userIDOrToken == userID {
-				userIDOrToken = token
-				break
-			}
-		}
-		ch = s.queues[userIDOrToken]
-	}
-	s.mu.Unlock()
-	ch <- resp
-	if !testutils.Quiet {
-		log.Printf("testV2Server: enqueued v2 response for %s (%d join rooms)", userIDOrToken, len(resp.Rooms.Join))
-	}
+func (s *testV2Server) queueReceipt(userIDOrToken, roomID, eventID, receiptType, receiptUserID string) {
+	s.QueueReceipt(userIDOrToken, roomID, eventID, receiptType, receiptUserID)
 }
 
-// blocks until nextResponse is called with an empty channel (that is, the server has caught up with v2 responses)
-func (s *testV2Server) waitUntilEmpty(t *testing.T, userIDOrToken string) {
-	t.Helper()
-	s.mu.Lock()
-	// find the
-	cond := s.waiting[userIDOrToken]
-	if cond == nil {
-		// find the token for this user
-		for token, userID := range s.tokenToUser {
-			if userID == userIDOrToken {
-				userIDOrToken = token
-				break
-			}
-		}
-		cond = s.waiting[userIDOrToken]
-	}
-	if cond == nil {
-		t.Fatalf("waitUntilEmpty: cannot find active Cond for userID or token: %s - aware of %+v", userIDOrToken, s.tokenToUser)
-	}
-	s.mu.Unlock()
-	cond.L.Lock()
-	cond.Wait()
-	cond.L.Unlock()
-}
-
-func (s *testV2Server) nextResponse(userID, token string) *sync2.SyncResponse {
-	s.mu.Lock()
-	ch := s.queues[token]
-	cond := s.waiting[token]
-	s.mu.Unlock()
-	if ch == nil {
-		log.Fatalf("testV2Server: nextResponse called with %s but there is no chan for this user", userID)
-	}
-	if len(ch) == 0 {
-		// broadcast to tests (waitUntilEmpty) that we're going to block for new data.
-		// We need to do it like this so we can make sure that the server has fully processed
-		// the previous responses
-		cond.Broadcast()
-	}
-	select {
-	case data, stillOpen := <-ch:
-		if !stillOpen {
-			if !testutils.Quiet {
-				log.Printf("testV2Server: closing, returning null to %s %s", userID, token)
-			}
-			return nil
-		}
-		if !testutils.Quiet {
-			log.Printf(
-				"testV2Server: nextResponse %s %s returning data: [invite=%d,join=%d,leave=%d]",
-				userID, token, len(data.Rooms.Invite), len(data.Rooms.Join), len(data.Rooms.Leave),
-			)
-		}
-		return &data
-	case <-time.After(s.timeToWaitForV2Response):
-		if !testutils.Quiet {
-			log.Printf("testV2Server: nextResponse %s %s waited >%v for data, returning null", userID, token, s.timeToWaitForV2Response)
-		}
-		return nil
-	}
+func (s *testV2Server) queueAccountData(userIDOrToken, roomID string, events ...json.RawMessage) {
+	s.QueueAccountData(userIDOrToken, roomID, events...)
 }
 
-func (s *testV2Server) url() string {
-	return s.srv.URL
+func (s *testV2Server) queueToDevice(userIDOrToken string, events ...json.RawMessage) {
+	s.QueueToDevice(userIDOrToken, events...)
 }
 
-func (s *testV2Server) close() {
-	s.mu.Lock()
-	for _, ch := range s.queues {
-		close(ch)
-	}
-	s.mu.Unlock()
-	s.srv.Close()
+func (s *testV2Server) queueDeviceLists(userIDOrToken string, changed, left []string) {
+	s.QueueDeviceLists(userIDOrToken, changed, left)
 }
 
-func runTestV2Server(t testutils.TestBenchInterface) *testV2Server {
-	t.Helper()
-	server := &testV2Server{
-		tokenToUser:             make(map[string]string),
-		tokenToDevice:           make(map[string]string),
-		queues:                  make(map[string]chan sync2.SyncResponse),
-		waiting:                 make(map[string]*sync.Cond),
-		invalidations:           make(map[string]func()),
-		mu:                      &sync.Mutex{},
-		timeToWaitForV2Response: time.Second,
-	}
-	r := mux.NewRouter()
-	r.HandleFunc("/_matrix/client/versions", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte(`{"versions": ["v1.1"]}`))
-	})
-	r.HandleFunc("/_matrix/client/r0/account/whoami", func(w http.ResponseWriter, req *http.Request) {
-		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
-		userID := server.userID(token)
-		deviceID := server.deviceID(token)
-		if userID == "" || deviceID == "" {
-			w.WriteHeader(401)
-			server.mu.Lock()
-			fn := server.invalidations[token]
-			if fn != nil {
-				fn()
-			}
-			server.mu.Unlock()
-			return
-		}
-		w.WriteHeader(200)
-		w.Write([]byte(fmt.Sprintf(`{"user_id":"%s","device_id":"%s"}`, userID, deviceID)))
-	})
-	r.HandleFunc("/_matrix/client/r0/sync", func(w http.ResponseWriter, req *http.Request) {
-		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
-		server.mu.Lock()
-		check := server.checkRequest
-		server.mu.Unlock()
-		if check != nil {
-			check(token, req)
-		}
-		userID := server.userID(token)
-		if userID == "" {
-			w.WriteHeader(401)
-			server.mu.Lock()
-			fn := server.invalidations[token]
-			if fn != nil {
-				fn()
-			}
-			server.mu.Unlock()
-			return
-		}
-		resp := server.nextResponse(userID, token)
-		body, err := json.Marshal(resp)
-		if err != nil {
-			w.WriteHeader(500)
-			t.Errorf("failed to marshal response: %s", err)
-			return
-		}
-		w.WriteHeader(200)
-		w.Write(body)
-	})
-	srv := httptest.NewServer(r)
-	server.srv = srv
-	return server
+func (s *testV2Server) waitUntilEmpty(t testutils.TestBenchInterface, userIDOrToken string) {
+	s.WaitUntilEmpty(t, userIDOrToken)
 }
 
 type testV3Server struct {
@@ -333,7 +147,7 @@ func (s *testV3Server) restart(t *testing.T, v2 *testV2Server, pq string, opts .
 	s.h2 = ss.h2
 	s.handler = ss.handler
 	// kick over v2 conns
-	v2.srv.CloseClientConnections()
+	v2.CloseClientConnections()
 }
 
 func (s *testV3Server) mustDoV3Request(t testutils.TestBenchInterface, token string, reqBody sync3.Request) (respBody *sync3.Response) {
@@ -410,6 +224,9 @@ func runTestServer(t testutils.TestBenchInterface, v2Server *testV2Server, postg
 		combinedOpts.DBConnMaxIdleTime = opt.DBConnMaxIdleTime
 		combinedOpts.DBMaxConns = opt.DBMaxConns
 		combinedOpts.MaxTransactionIDDelay = opt.MaxTransactionIDDelay
+		combinedOpts.MaxRequestBodyBytes = opt.MaxRequestBodyBytes
+		combinedOpts.NewConnsPerIPPerMinute = opt.NewConnsPerIPPerMinute
+		combinedOpts.RequestsPerUserPerMinute = opt.RequestsPerUserPerMinute
 		if opt.MaxPendingEventUpdates > 0 {
 			combinedOpts.MaxPendingEventUpdates = opt.MaxPendingEventUpdates
 			handler.BufferWaitTime = 5 * time.Millisecond
@@ -0,0 +1,174 @@
+package testutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// datasetEpoch is the earliest timestamp in every dataset, so datasets are identical between runs.
+// Rooms are created at random times in the following datasetWindow.
+var (
+	datasetEpoch  = time.UnixMilli(1600000000000)
+	datasetWindow = 30 * 24 * time.Hour
+)
+
+// DatasetOpts controls the shape of a generated Dataset.
+type DatasetOpts struct {
+	// Included in every room ID, so that datasets generated with different names don't collide
+	// in a shared database.
+	Name string
+	// The number of rooms the user is joined to.
+	NumRooms int
+	// Every room has between 1 and MaxMembers other joined users. Defaults to 1.
+	MaxMembers int
+	// The number of messages in each room's timeline. Defaults to 1.
+	TimelineLength int
+	// Seeds the random choices made when generating rooms and churn. Datasets made with the same
+	// options are the same, apart from event IDs.
+	Seed int64
+}
+
+// Dataset is a set of rooms for a single user, used to benchmark the proxy against fixed workloads
+// which look roughly like a real account: a mix of DMs and group rooms of varying sizes, with
+// messages spread out over time.
+type Dataset struct {
+	UserID string
+	Rooms  []DatasetRoom
+	rng    *rand.Rand
+	// the time of the latest event in the dataset
+	now time.Time
+}
+
+// DatasetRoom is a single room in a Dataset.
+type DatasetRoom struct {
+	RoomID string
+	// The room name, or "" for DMs.
+	Name      string
+	IsDM      bool
+	JoinCount int
+	// The other joined users.
+	Members []string
+	// The create, join rules, power levels, name and member events for the room.
+	State []json.RawMessage
+	// Messages, oldest first.
+	Timeline []json.RawMessage
+	// The origin_server_ts of the last event in the timeline, in milliseconds.
+	LastMessageTimestamp uint64
+}
+
+// DatasetUpdate is a new message in a room, as returned by Dataset.Churn.
+type DatasetUpdate struct {
+	RoomID    string
+	Event     json.RawMessage
+	Timestamp uint64
+}
+
+// NewDataset generates a dataset for userID.
+func NewDataset(t TestBenchInterface, userID string, opts DatasetOpts) *Dataset {
+	t.Helper()
+	if opts.MaxMembers < 1 {
+		opts.MaxMembers = 1
+	}
+	if opts.TimelineLength < 1 {
+		opts.TimelineLength = 1
+	}
+	d := &Dataset{
+		UserID: userID,
+		Rooms:  make([]DatasetRoom, 0, opts.NumRooms),
+		rng:    rand.New(rand.NewSource(opts.Seed)),
+	}
+	for i := 0; i < opts.NumRooms; i++ {
+		room := DatasetRoom{
+			RoomID: fmt.Sprintf("!%s_%d:dataset", opts.Name, i),
+			// roughly a quarter of rooms are DMs, like a typical account
+			IsDM: d.rng.Intn(4) == 0,
+		}
+		numOthers := 1
+		if !room.IsDM {
+			numOthers = 1 + d.rng.Intn(opts.MaxMembers)
+			room.Name = fmt.Sprintf("Room %d", i)
+		}
+		room.JoinCount = numOthers + 1
+		createTime := datasetEpoch.Add(time.Duration(d.rng.Int63n(int64(datasetWindow))))
+		ts := WithTimestamp(createTime)
+		room.State = append(room.State,
+			NewStateEvent(t, "m.room.create", "", userID, map[string]interface{}{"creator": userID}, ts),
+			NewJoinEvent(t, userID, ts),
+			NewStateEvent(t, "m.room.join_rules", "", userID, map[string]interface{}{"join_rule": "invite"}, ts),
+			NewStateEvent(t, "m.room.power_levels", "", userID, map[string]interface{}{
+				"users": map[string]int{userID: 100},
+			}, ts),
+		)
+		if room.Name != "" {
+			room.State = append(room.State, NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{"name": room.Name}, ts))
+		}
+		others := make([]string, numOthers)
+		for j := range others {
+			others[j] = fmt.Sprintf("@user_%d_%d:dataset", i, j)
+			room.State = append(room.State, NewJoinEvent(t, others[j], ts))
+		}
+		room.Members = others
+		evTime := createTime
+		for j := 0; j < opts.TimelineLength; j++ {
+			sender := others[d.rng.Intn(len(others))]
+			if d.rng.Intn(2) == 0 {
+				sender = userID
+			}
+			evTime = d.tick(evTime)
+			room.Timeline = append(room.Timeline, NewMessageEvent(t, sender, fmt.Sprintf("message %d", j), WithTimestamp(evTime)))
+			room.LastMessageTimestamp = uint64(evTime.UnixMilli())
+		}
+		if evTime.After(d.now) {
+			d.now = evTime
+		}
+		d.Rooms = append(d.Rooms, room)
+	}
+	return d
+}
+
+// RoomIDs returns the IDs of every room in the dataset.
+func (d *Dataset) RoomIDs() []string {
+	roomIDs := make([]string, len(d.Rooms))
+	for i := range d.Rooms {
+		roomIDs[i] = d.Rooms[i].RoomID
+	}
+	return roomIDs
+}
+
+// Churn returns n new messages sent after every other event in the dataset. Like a real account,
+// most activity is in a few busy rooms: half the messages go to the busiest 10% of rooms. The
+// dataset's timelines are updated to include the new messages.
+func (d *Dataset) Churn(t TestBenchInterface, n int) []DatasetUpdate {
+	t.Helper()
+	if len(d.Rooms) == 0 {
+		return nil
+	}
+	busy := len(d.Rooms)/10 + 1
+	updates := make([]DatasetUpdate, n)
+	for i := range updates {
+		var room *DatasetRoom
+		if d.rng.Intn(2) == 0 {
+			room = &d.Rooms[d.rng.Intn(busy)]
+		} else {
+			room = &d.Rooms[d.rng.Intn(len(d.Rooms))]
+		}
+		d.now = d.tick(d.now)
+		evTime := d.now
+		ev := NewMessageEvent(t, d.UserID, fmt.Sprintf("churn %d", i), WithTimestamp(evTime))
+		room.Timeline = append(room.Timeline, ev)
+		room.LastMessageTimestamp = uint64(evTime.UnixMilli())
+		updates[i] = DatasetUpdate{
+			RoomID:    room.RoomID,
+			Event:     ev,
+			Timestamp: room.LastMessageTimestamp,
+		}
+	}
+	return updates
+}
+
+// tick returns a time up to a minute after t.
+func (d *Dataset) tick(t time.Time) time.Time {
+	return t.Add(time.Duration(1+d.rng.Intn(60000)) * time.Millisecond)
+}
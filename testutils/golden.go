@@ -0,0 +1,142 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// UpdateGoldenEnvVar is the environment variable which, when set to "1", makes Golden rewrite
+// golden files with the responses seen in this run rather than diffing against them.
+const UpdateGoldenEnvVar = "SYNCV3_UPDATE_GOLDEN"
+
+var (
+	eventIDRegexp   = regexp.MustCompile(`"(\$[^"]+)"`)
+	volatileFieldRe = regexp.MustCompile(`"(pos|txn_id|origin_server_ts|timestamp|ts|age)":\s*("[^"]*"|-?[0-9]+)`)
+)
+
+// Golden records a sequence of responses for a scripted scenario and compares them against a golden
+// file on disk. This catches unintended changes to the shape of responses which hand-written matchers
+// don't check. Responses are normalised before comparison so values which differ between runs (pos
+// tokens, timestamps, generated event IDs) don't cause spurious diffs.
+//
+// Golden files live in testdata/golden/<name>.json relative to the test's package and must be
+// committed. Set SYNCV3_UPDATE_GOLDEN=1 to create or rewrite them after an intended change.
+type Golden struct {
+	t         TestBenchInterface
+	path      string
+	responses []json.RawMessage
+}
+
+func NewGolden(t TestBenchInterface, name string) *Golden {
+	return &Golden{
+		t:    t,
+		path: filepath.Join("testdata", "golden", name+".json"),
+	}
+}
+
+// Record a raw response body. Responses are compared in the order they are recorded.
+func (g *Golden) Record(body []byte) {
+	g.t.Helper()
+	if !json.Valid(body) {
+		g.t.Fatalf("Golden.Record: response is not valid JSON: %s", string(body))
+	}
+	g.responses = append(g.responses, append(json.RawMessage(nil), body...))
+}
+
+// Check compares the recorded responses with the golden file, or writes the golden file if updates
+// have been requested. A missing golden file fails the test.
+func (g *Golden) Check() {
+	g.t.Helper()
+	got, err := g.normalise()
+	if err != nil {
+		g.t.Fatalf("Golden.Check: failed to normalise responses: %s", err)
+	}
+	if os.Getenv(UpdateGoldenEnvVar) == "1" {
+		if err := os.MkdirAll(filepath.Dir(g.path), 0755); err != nil {
+			g.t.Fatalf("Golden.Check: failed to make golden directory: %s", err)
+		}
+		if err := os.WriteFile(g.path, got, 0644); err != nil {
+			g.t.Fatalf("Golden.Check: failed to write golden file: %s", err)
+		}
+		g.t.Logf("Golden.Check: wrote %d responses to %s", len(g.responses), g.path)
+		return
+	}
+	want, err := os.ReadFile(g.path)
+	if os.IsNotExist(err) {
+		g.t.Fatalf("Golden.Check: golden file %s does not exist (set %s=1 to create it)", g.path, UpdateGoldenEnvVar)
+	}
+	if err != nil {
+		g.t.Fatalf("Golden.Check: failed to read golden file: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		g.t.Errorf("Golden.Check: responses differ from %s (set %s=1 to update):\n%s", g.path, UpdateGoldenEnvVar, lineDiff(string(want), string(got)))
+	}
+}
+
+// normalise the recorded responses into a single stable, indented JSON array.
+func (g *Golden) normalise() ([]byte, error) {
+	all, err := json.Marshal(g.responses)
+	if err != nil {
+		return nil, err
+	}
+	// Replace event IDs with placeholders in order of first appearance. This is done on the raw
+	// bytes so event IDs used as keys (e.g in receipts) are also replaced.
+	eventIDs := make(map[string]string)
+	all = eventIDRegexp.ReplaceAllFunc(all, func(match []byte) []byte {
+		id := string(match[1 : len(match)-1])
+		placeholder, ok := eventIDs[id]
+		if !ok {
+			placeholder = fmt.Sprintf("$EVENT_%d", len(eventIDs)+1)
+			eventIDs[id] = placeholder
+		}
+		return []byte(`"` + placeholder + `"`)
+	})
+	all = volatileFieldRe.ReplaceAll(all, []byte(`"$1":"<$1>"`))
+	// round trip so object keys are sorted, then indent so diffs are readable.
+	var v interface{}
+	if err := json.Unmarshal(all, &v); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// lineDiff returns a minimal description of where want and got first differ.
+func lineDiff(want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w == g {
+			continue
+		}
+		start := i - 3
+		if start < 0 {
+			start = 0
+		}
+		var sb strings.Builder
+		for j := start; j < i; j++ {
+			fmt.Fprintf(&sb, "  %d: %s\n", j+1, wantLines[j])
+		}
+		fmt.Fprintf(&sb, "- %d: %s\n+ %d: %s\n", i+1, w, i+1, g)
+		return sb.String()
+	}
+	return ""
+}
@@ -691,6 +691,22 @@ func MatchNoGlobalAccountData() RespMatcher {
 	}
 }
 
+// MatchHasRoomAccountData builds a matcher which asserts that the given event is present in
+// the room account data for the given room.
+func MatchHasRoomAccountData(roomID string, want json.RawMessage) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.AccountData == nil {
+			return fmt.Errorf("MatchHasRoomAccountData: no account data section in sync response")
+		}
+		for _, msg := range res.Extensions.AccountData.Rooms[roomID] {
+			if bytes.Equal(msg, want) {
+				return nil
+			}
+		}
+		return fmt.Errorf("MatchHasRoomAccountData: could not find %s in room account data for %s", want, roomID)
+	}
+}
+
 // MatchNoRoomAccountData builds a matcher which asserts that none of the given roomIDs
 // have room account data in a sync response.
 func MatchNoRoomAccountData(roomIDs []string) RespMatcher {
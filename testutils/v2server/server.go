@@ -0,0 +1,554 @@
+// Package v2server is a fake stand-in for the v2 sync API provided by a homeserver, which serves
+// responses queued for each access token. It is used by the integration tests and by the load
+// test command.
+package v2server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+// DefaultQueueSize is the number of responses which can be queued for each token before
+// QueueResponse blocks.
+const DefaultQueueSize = 100
+
+// Server is a fake stand-in for the v2 sync API provided by a homeserver.
+type Server struct {
+	// checkRequest is an arbitrary function which runs after a request has been
+	// received from pollers, but before the response is generated. This allows us to
+	// confirm that the proxy is polling the homeserver's v2 sync endpoint in the
+	// manner that we expect.
+	//
+	// checkRequest is called before we lookup a user for the given token. Tests can
+	// use this to invalidate the token right before a poll is made.
+	checkRequest  func(token string, req *http.Request)
+	mu            *sync.Mutex
+	tokenToUser   map[string]string
+	tokenToDevice map[string]string
+	queues        map[string]chan sync2.SyncResponse
+	waiting       map[string]*sync.Cond // broadcasts when the server is about to read a blocking input
+	router        *mux.Router
+	srv           *httptest.Server
+	invalidations map[string]func() // token -> callback
+	chaos         *Chaos
+
+	// TimeToWaitForV2Response is how long a /sync request waits for a queued response before
+	// returning an empty one.
+	TimeToWaitForV2Response time.Duration
+	// QueueSize is the number of responses which can be queued for accounts added from now on.
+	QueueSize int
+}
+
+// Chaos describes faults which the Server injects into /sync responses on a fixed schedule,
+// counted per access token. A value of N for an *Every field means every Nth /sync request is
+// affected, 0 disables that fault. Errors and malformed responses do not consume queued responses,
+// so the data is delivered when the poller retries.
+type Chaos struct {
+	// Latency is added to every /sync request.
+	Latency time.Duration
+	// ErrorEvery returns HTTP 502 to every Nth request.
+	ErrorEvery int
+	// MalformedJSONEvery returns a truncated JSON body with HTTP 200 to every Nth request.
+	MalformedJSONEvery int
+	// DuplicateEvery sends the previous response again on every Nth request.
+	DuplicateEvery int
+	// ReorderEvery swaps the next two queued responses on every Nth request.
+	ReorderEvery int
+
+	requests map[string]int                  // token -> number of /sync requests
+	last     map[string]*sync2.SyncResponse  // token -> last response sent
+	held     map[string][]sync2.SyncResponse // token -> responses held back due to reordering
+}
+
+// New returns a Server which isn't listening yet. Serve it with an http.Server, or use Run.
+func New() *Server {
+	server := &Server{
+		tokenToUser:             make(map[string]string),
+		tokenToDevice:           make(map[string]string),
+		queues:                  make(map[string]chan sync2.SyncResponse),
+		waiting:                 make(map[string]*sync.Cond),
+		invalidations:           make(map[string]func()),
+		mu:                      &sync.Mutex{},
+		TimeToWaitForV2Response: time.Second,
+		QueueSize:               DefaultQueueSize,
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/_matrix/client/versions", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"versions": ["v1.1"]}`))
+	})
+	r.HandleFunc("/_matrix/client/r0/account/whoami", func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		userID := server.UserID(token)
+		deviceID := server.DeviceID(token)
+		if userID == "" || deviceID == "" {
+			w.WriteHeader(401)
+			server.mu.Lock()
+			fn := server.invalidations[token]
+			if fn != nil {
+				fn()
+			}
+			server.mu.Unlock()
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(fmt.Sprintf(`{"user_id":"%s","device_id":"%s"}`, userID, deviceID)))
+	})
+	r.HandleFunc("/_matrix/client/r0/sync", func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		server.mu.Lock()
+		check := server.checkRequest
+		server.mu.Unlock()
+		if check != nil {
+			check(token, req)
+		}
+		userID := server.UserID(token)
+		if userID == "" {
+			w.WriteHeader(401)
+			server.mu.Lock()
+			fn := server.invalidations[token]
+			if fn != nil {
+				fn()
+			}
+			server.mu.Unlock()
+			return
+		}
+		written, resp := server.chaosResponse(w, userID, token)
+		if written {
+			return
+		}
+		if resp == nil {
+			resp = server.nextResponse(userID, token)
+		}
+		server.mu.Lock()
+		if server.chaos != nil && resp != nil {
+			server.chaos.last[token] = resp
+		}
+		server.mu.Unlock()
+		body, err := json.Marshal(resp)
+		if err != nil {
+			log.Printf("v2server: failed to marshal response: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(body)
+	})
+	server.router = r
+	return server
+}
+
+// Run returns a Server listening on a local port, see URL.
+func Run() *Server {
+	server := New()
+	server.srv = httptest.NewServer(server)
+	return server
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.router.ServeHTTP(w, req)
+}
+
+// URL returns the address of a Server started with Run.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// CloseClientConnections closes the connections the proxy has open to a Server started with Run,
+// e.g so that pollers reconnect after the proxy restarts.
+func (s *Server) CloseClientConnections() {
+	s.srv.CloseClientConnections()
+}
+
+// Close makes waiting /sync requests return, and stops listening if the Server was started with Run.
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, ch := range s.queues {
+		close(ch)
+	}
+	s.mu.Unlock()
+	if s.srv != nil {
+		s.srv.Close()
+	}
+}
+
+// SetChaos enables fault injection on /sync requests. Pass nil to disable it.
+func (s *Server) SetChaos(c *Chaos) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c != nil {
+		c.requests = make(map[string]int)
+		c.last = make(map[string]*sync2.SyncResponse)
+		c.held = make(map[string][]sync2.SyncResponse)
+	}
+	s.chaos = c
+}
+
+// chaosResponse applies any scheduled faults for this request. Returns true if a response has
+// been written, otherwise returns the response to send, which may be nil to use the queue as normal.
+func (s *Server) chaosResponse(w http.ResponseWriter, userID, token string) (bool, *sync2.SyncResponse) {
+	s.mu.Lock()
+	c := s.chaos
+	if c == nil {
+		s.mu.Unlock()
+		return false, nil
+	}
+	c.requests[token]++
+	n := c.requests[token]
+	due := func(every int) bool {
+		return every > 0 && n%every == 0
+	}
+	latency := c.Latency
+	s.mu.Unlock()
+	time.Sleep(latency)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case due(c.ErrorEvery):
+		log.Printf("v2server: chaos: returning 502 to %s", userID)
+		w.WriteHeader(502)
+		return true, nil
+	case due(c.MalformedJSONEvery):
+		log.Printf("v2server: chaos: returning malformed JSON to %s", userID)
+		w.WriteHeader(200)
+		w.Write([]byte(`{"next_batch":"chaos","rooms":{"join":`))
+		return true, nil
+	case due(c.DuplicateEvery) && c.last[token] != nil:
+		log.Printf("v2server: chaos: sending duplicate response to %s", userID)
+		return false, c.last[token]
+	}
+	if len(c.held[token]) > 0 {
+		resp := c.held[token][0]
+		c.held[token] = c.held[token][1:]
+		return false, &resp
+	}
+	if ch := s.queues[token]; due(c.ReorderEvery) && len(ch) >= 2 {
+		log.Printf("v2server: chaos: reordering responses for %s", userID)
+		first := <-ch
+		second := <-ch
+		c.held[token] = append(c.held[token], first)
+		return false, &second
+	}
+	return false, nil
+}
+
+func (s *Server) SetCheckRequest(fn func(token string, req *http.Request)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkRequest = fn
+}
+
+// Most tests only use a single device per user. Give them this helper so they don't
+// have to care about providing a device name.
+func (s *Server) AddAccount(t testutils.TestBenchInterface, userID, token string) {
+	// To keep our future selves sane while debugging use a device name that
+	//  - includes the mxid localpart, and
+	//  - includes the test name (to avoid leaking state from previous tests).
+	atLocalPart, _, _ := strings.Cut(userID, ":")
+	deviceID := fmt.Sprintf("%s_%s_device", atLocalPart[1:], t.Name())
+	s.AddAccountWithDeviceID(userID, deviceID, token)
+}
+
+// Tests that use multiple devices for the same user need to be more explicit.
+func (s *Server) AddAccountWithDeviceID(userID, deviceID, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenToUser[token] = userID
+	s.tokenToDevice[token] = deviceID
+	s.queues[token] = make(chan sync2.SyncResponse, s.QueueSize)
+	s.waiting[token] = &sync.Cond{
+		L: &sync.Mutex{},
+	}
+}
+
+// like InvalidateToken, but doesn't do any waiting.
+func (s *Server) InvalidateTokenImmediately(token string) {
+	s.mu.Lock()
+	delete(s.tokenToUser, token)
+	delete(s.tokenToDevice, token)
+	s.mu.Unlock()
+}
+
+// remove the token and wait until the proxy sends a request with this token, then 401 it and return.
+// The Server must have been started with Run.
+func (s *Server) InvalidateToken(token string) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// add callback and delete the token
+	s.mu.Lock()
+	s.invalidations[token] = func() {
+		wg.Done()
+	}
+	delete(s.tokenToUser, token)
+	delete(s.tokenToDevice, token)
+	s.mu.Unlock()
+
+	// kick over the connection so the next request 401s and wait till we get said request
+	s.CloseClientConnections()
+	wg.Wait()
+
+	// cleanup the callback
+	s.mu.Lock()
+	delete(s.invalidations, token)
+	s.mu.Unlock()
+	// need to wait for the HTTP 401 response to be processed :(
+	time.Sleep(100 * time.Millisecond)
+}
+
+func (s *Server) UserID(token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenToUser[token]
+}
+
+func (s *Server) DeviceID(token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenToDevice[token]
+}
+
+// QueueResponse queues a response for the user, blocking if their queue is full.
+func (s *Server) QueueResponse(userIDOrToken string, resp sync2.SyncResponse) {
+	ch := s.queue(userIDOrToken, resp)
+	ch <- resp
+	if !testutils.Quiet {
+		log.Printf("v2server: enqueued v2 response for %s (%d join rooms)", userIDOrToken, len(resp.Rooms.Join))
+	}
+}
+
+// TryQueueResponse queues a response for the user, returning false instead if their queue is full.
+func (s *Server) TryQueueResponse(userIDOrToken string, resp sync2.SyncResponse) bool {
+	ch := s.queue(userIDOrToken, resp)
+	select {
+	case ch <- resp:
+		return true
+	default:
+		return false
+	}
+}
+
+// queue returns the queue of the user for this response.
+func (s *Server) queue(userIDOrToken string, resp sync2.SyncResponse) chan sync2.SyncResponse {
+	// ensure we send valid responses
+	for roomID, room := range resp.Rooms.Join {
+		if len(room.State.Events) > 0 && len(room.Timeline.Events) == 0 {
+			panic(fmt.Sprintf("invalid queued v2 response for room %s: no timeline events but %d events in state block", roomID, len(room.State.Events)))
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := s.queues[userIDOrToken]
+	if ch == nil {
+		// try to find a token for this user
+		for token, userID := range s.tokenToUser {
+			if userIDOrToken == userID {
+				userIDOrToken = token
+				break
+			}
+		}
+		ch = s.queues[userIDOrToken]
+	}
+	return ch
+}
+
+// QueueInvite queues a v2 response which invites the user to the given room. The invite state
+// contains the invite event itself, plus any extra stripped state events provided.
+func (s *Server) QueueInvite(t testutils.TestBenchInterface, userIDOrToken, roomID, inviter string, extraInviteState ...json.RawMessage) {
+	t.Helper()
+	userID := s.userIDOrTokenToUserID(userIDOrToken)
+	inviteState := append([]json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.member", userID, inviter, map[string]interface{}{
+			"membership": "invite",
+		}),
+	}, extraInviteState...)
+	s.QueueResponse(userIDOrToken, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Invite: map[string]sync2.SyncV2InviteResponse{
+				roomID: {
+					InviteState: sync2.EventsResponse{Events: inviteState},
+				},
+			},
+		},
+	})
+}
+
+// QueueLeave queues a v2 response which puts the room in the user's leave section. The timeline
+// should end with the user's leave event.
+func (s *Server) QueueLeave(userIDOrToken, roomID string, timeline ...json.RawMessage) {
+	var leave sync2.SyncV2LeaveResponse
+	leave.Timeline.Events = timeline
+	s.QueueResponse(userIDOrToken, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Leave: map[string]sync2.SyncV2LeaveResponse{
+				roomID: leave,
+			},
+		},
+	})
+}
+
+// QueueEphemeral queues a v2 response with the given ephemeral events in an already joined room.
+func (s *Server) QueueEphemeral(userIDOrToken, roomID string, ephemeral ...json.RawMessage) {
+	s.QueueResponse(userIDOrToken, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomID: {
+					Ephemeral: sync2.EventsResponse{Events: ephemeral},
+				},
+			},
+		},
+	})
+}
+
+// QueueTyping queues a v2 response where exactly these users are typing in the given room.
+func (s *Server) QueueTyping(userIDOrToken, roomID string, typingUserIDs ...string) {
+	if typingUserIDs == nil {
+		typingUserIDs = []string{}
+	}
+	ev, _ := json.Marshal(map[string]interface{}{
+		"type": "m.typing",
+		"content": map[string]interface{}{
+			"user_ids": typingUserIDs,
+		},
+	})
+	s.QueueEphemeral(userIDOrToken, roomID, ev)
+}
+
+// QueueReceipt queues a v2 response where receiptUserID sent a receipt of the given type
+// (e.g m.read) for the event.
+func (s *Server) QueueReceipt(userIDOrToken, roomID, eventID, receiptType, receiptUserID string) {
+	ev, _ := json.Marshal(map[string]interface{}{
+		"type": "m.receipt",
+		"content": map[string]interface{}{
+			eventID: map[string]interface{}{
+				receiptType: map[string]interface{}{
+					receiptUserID: map[string]interface{}{
+						"ts": time.Now().UnixMilli(),
+					},
+				},
+			},
+		},
+	})
+	s.QueueEphemeral(userIDOrToken, roomID, ev)
+}
+
+// QueueAccountData queues a v2 response with account data events. If roomID is empty, the
+// events are global account data, otherwise they are room account data for an already joined room.
+func (s *Server) QueueAccountData(userIDOrToken, roomID string, events ...json.RawMessage) {
+	var resp sync2.SyncResponse
+	if roomID == "" {
+		resp.AccountData = sync2.EventsResponse{Events: events}
+	} else {
+		resp.Rooms.Join = map[string]sync2.SyncV2JoinResponse{
+			roomID: {
+				AccountData: sync2.EventsResponse{Events: events},
+			},
+		}
+	}
+	s.QueueResponse(userIDOrToken, resp)
+}
+
+// QueueToDevice queues a v2 response with the given to-device events.
+func (s *Server) QueueToDevice(userIDOrToken string, events ...json.RawMessage) {
+	s.QueueResponse(userIDOrToken, sync2.SyncResponse{
+		ToDevice: sync2.EventsResponse{Events: events},
+	})
+}
+
+// QueueDeviceLists queues a v2 response with device list changes.
+func (s *Server) QueueDeviceLists(userIDOrToken string, changed, left []string) {
+	var resp sync2.SyncResponse
+	resp.DeviceLists.Changed = changed
+	resp.DeviceLists.Left = left
+	s.QueueResponse(userIDOrToken, resp)
+}
+
+// QueueOTKCounts queues a v2 response with one-time key counts and unused fallback key types.
+func (s *Server) QueueOTKCounts(userIDOrToken string, otkCounts map[string]int, fallbackKeyTypes []string) {
+	s.QueueResponse(userIDOrToken, sync2.SyncResponse{
+		DeviceListsOTKCount:          otkCounts,
+		DeviceUnusedFallbackKeyTypes: fallbackKeyTypes,
+	})
+}
+
+func (s *Server) userIDOrTokenToUserID(userIDOrToken string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if userID, ok := s.tokenToUser[userIDOrToken]; ok {
+		return userID
+	}
+	return userIDOrToken
+}
+
+// blocks until nextResponse is called with an empty channel (that is, the server has caught up with v2 responses)
+func (s *Server) WaitUntilEmpty(t testutils.TestBenchInterface, userIDOrToken string) {
+	t.Helper()
+	s.mu.Lock()
+	// find the
+	cond := s.waiting[userIDOrToken]
+	if cond == nil {
+		// find the token for this user
+		for token, userID := range s.tokenToUser {
+			if userID == userIDOrToken {
+				userIDOrToken = token
+				break
+			}
+		}
+		cond = s.waiting[userIDOrToken]
+	}
+	if cond == nil {
+		t.Fatalf("WaitUntilEmpty: cannot find active Cond for userID or token: %s - aware of %+v", userIDOrToken, s.tokenToUser)
+	}
+	s.mu.Unlock()
+	cond.L.Lock()
+	cond.Wait()
+	cond.L.Unlock()
+}
+
+func (s *Server) nextResponse(userID, token string) *sync2.SyncResponse {
+	s.mu.Lock()
+	ch := s.queues[token]
+	cond := s.waiting[token]
+	s.mu.Unlock()
+	if ch == nil {
+		log.Fatalf("v2server: nextResponse called with %s but there is no chan for this user", userID)
+	}
+	if len(ch) == 0 {
+		// broadcast to tests (WaitUntilEmpty) that we're going to block for new data.
+		// We need to do it like this so we can make sure that the server has fully processed
+		// the previous responses
+		cond.Broadcast()
+	}
+	select {
+	case data, stillOpen := <-ch:
+		if !stillOpen {
+			if !testutils.Quiet {
+				log.Printf("v2server: closing, returning null to %s %s", userID, token)
+			}
+			return nil
+		}
+		if !testutils.Quiet {
+			log.Printf(
+				"v2server: nextResponse %s %s returning data: [invite=%d,join=%d,leave=%d]",
+				userID, token, len(data.Rooms.Invite), len(data.Rooms.Join), len(data.Rooms.Leave),
+			)
+		}
+		return &data
+	case <-time.After(s.TimeToWaitForV2Response):
+		if !testutils.Quiet {
+			log.Printf("v2server: nextResponse %s %s waited >%v for data, returning null", userID, token, s.TimeToWaitForV2Response)
+		}
+		return nil
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,23 +19,22 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/matrix-org/sliding-sync/state"
 	_ "github.com/matrix-org/sliding-sync/state/migrations"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/handler"
+	"github.com/matrix-org/sliding-sync/webhook"
 	"github.com/pressly/goose/v3"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 )
 
 //go:embed state/migrations/*
 var EmbedMigrations embed.FS
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger()
 var Version string
 
 type Opts struct {
@@ -51,20 +51,161 @@ type Opts struct {
 	// Set to 0 to disable this delay mechanism entirely.
 	MaxTransactionIDDelay time.Duration
 
+	// InMemoryStorage stores everything in memory instead of postgres, so the proxy can run
+	// without a database e.g for local development. Everything is lost when the proxy stops.
+	// The database options are ignored.
+	InMemoryStorage bool
+
 	DBMaxConns        int
 	DBConnMaxIdleTime time.Duration
+	// DSN, if set, is used instead of the postgres URI given to Setup. New database connections use
+	// its current value, so credentials can be reloaded without a restart.
+	DSN *sqlutil.ReloadableDSN
 
 	// HTTPTimeout is used for "normal" HTTP requests
 	HTTPTimeout time.Duration
 	// HTTPLongTimeout is used for initial sync requests
 	HTTPLongTimeout time.Duration
+
+	// SlowRequestThreshold is the amount of processing time after which a request is logged as
+	// slow. Time spent waiting for new data is not included. Defaults to 50s.
+	SlowRequestThreshold time.Duration
+
+	// MaxRequestBodyBytes is the largest request body which will be accepted. Larger requests
+	// are rejected with HTTP 413. Defaults to 10MiB.
+	MaxRequestBodyBytes int64
+
+	// NewConnsPerIPPerMinute limits how many new connections each client IP address can make per
+	// minute. 0 means no limit.
+	NewConnsPerIPPerMinute int
+	// RequestsPerUserPerMinute limits how many requests each user can make per minute, across
+	// all of their devices and connections. 0 means no limit.
+	RequestsPerUserPerMinute int
+	// MaxRoomsPerResponse caps the number of rooms sent in list SYNC operations in a single
+	// response. When a client's list ranges cover more rooms than this, the remaining rooms are
+	// sent in subsequent responses. Bounds memory use for users in very many rooms. 0 means no limit.
+	MaxRoomsPerResponse int
+	// TypingDebounce is the shortest time between typing notifications being sent to connections
+	// for each room. Typing changes in between are coalesced into the latest one. 0 sends every
+	// typing change immediately.
+	TypingDebounce time.Duration
+	// TypingExpiry clears typing notifications in rooms which have had no typing updates for this
+	// long, in case the update which stopped users typing was missed. 0 never clears them.
+	TypingExpiry time.Duration
+	// TrustedProxies is the number of reverse proxies in front of the proxy which append the address
+	// they received requests from to X-Forwarded-For. Client IP addresses are taken from that many
+	// entries from the right of the header. 0 ignores the header.
+	TrustedProxies int
+
+	// OIDCIntrospection, if set, identifies access tokens by introspecting them with an OIDC
+	// provider rather than calling the homeserver's /whoami. Needed for homeservers which
+	// delegate authentication (MSC3861).
+	OIDCIntrospection *sync2.IntrospectionOpts
+	// Authenticator, if set, identifies access tokens instead of the homeserver's /whoami, e.g to
+	// use shared secrets or a static map of tokens in tests. Can't be used with OIDCIntrospection.
+	Authenticator sync2.Authenticator
+
+	// Webhook, if set, sends notifications about new rooms, membership changes and other events
+	// to an external URL.
+	Webhook *webhook.Opts
+
+	// EventAge controls whether unsigned.age is recomputed or removed when events are served.
+	EventAge internal.EventAgeOpts
+
+	// ToDeviceMaxMessages caps the number of to-device messages sent in each response, overriding
+	// larger limits requested by clients. 0 means the client's limit is used.
+	ToDeviceMaxMessages int
+	// ToDeviceMaxBytes caps the total size of to-device messages sent in each response, so devices
+	// which have been offline for a long time catch up over several responses. 0 means no limit.
+	ToDeviceMaxBytes int
+
+	// TimelineBackfill fetches older events from the homeserver's /messages when a client asks for
+	// a deeper timeline than the proxy has stored for a room, storing them before responding.
+	TimelineBackfill bool
+
+	// DefaultLists are the lists used when the first request on a connection asks for no lists or
+	// room subscriptions, so very thin clients can poll with an empty body and still get a room
+	// list. They are sticky for the rest of the connection, like lists sent by the client.
+	DefaultLists map[string]sync3.RequestList
+
+	// PhasedInitialSyncRooms sends initial responses with at least this many rooms in phases. The
+	// first response has room names and ordering but no timelines or required state, so clients can
+	// render a room list quickly. Timelines and required state follow in the next responses, this
+	// many rooms at a time. 0 sends everything at once.
+	PhasedInitialSyncRooms int
+
+	// MaxResponseBytes caps the size of the room data in each response. Rooms which don't fit are
+	// sent in the following responses, and the response is marked as pending so clients request
+	// them straight away. At least one room is always sent. 0 means no limit.
+	MaxResponseBytes int
+
+	// MaxListOpsPerResponse caps the number of list operations caused by live updates in each
+	// response, so a burst of room reorderings doesn't produce a response which takes clients a
+	// long time to apply. Lists with further updates are re-sent with one SYNC per range in the
+	// following response instead, and the response is marked as pending. 0 means no limit.
+	MaxListOpsPerResponse int
+
+	// InstanceName distinguishes this instance from others which share the secret, so that
+	// connection positions issued by one instance are rejected by the others. Instances serving
+	// different clients from the same database must have different names.
+	InstanceName string
+
+	// RoomSummaryFallback fetches the homeserver's room summary for invites whose stripped state
+	// isn't enough to name the room, and stores it with the invite.
+	RoomSummaryFallback bool
+
+	// DisabledExtensions is a list of extension names (e.g "e2ee", "typing") which will be
+	// ignored if requested by clients.
+	DisabledExtensions []string
 }
 
+// RequestIDHeader is the response header containing the ID the proxy generated for the request.
+// The ID is included in the proxy's logs and traces for the request, so it can be quoted in bug reports.
+const RequestIDHeader = "X-Request-ID"
+
 type server struct {
 	chain []func(next http.Handler) http.Handler
 	final http.Handler
 }
 
+// newServer wraps the router with request IDs, request contexts and access logging.
+func newServer(r http.Handler) *server {
+	return &server{
+		chain: []func(next http.Handler) http.Handler{
+			hlog.NewHandler(logger),
+			hlog.RequestIDHandler("req_id", RequestIDHeader),
+			func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ctx := internal.RequestContext(r.Context())
+					if id, ok := hlog.IDFromRequest(r); ok {
+						ctx = internal.SetAttributeOnContext(ctx, internal.OTLPTagRequestID, id.String())
+					}
+					next.ServeHTTP(w, r.WithContext(ctx))
+				})
+			},
+			hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
+				if r.Method == "OPTIONS" {
+					return
+				}
+				entry := internal.DecorateLogger(r.Context(), hlog.FromRequest(r).Info())
+				if !strings.HasSuffix(r.URL.Path, "/sync") {
+					entry.Str("path", r.URL.Path)
+				}
+				durStr := fmt.Sprintf("%.3f", duration.Seconds())
+				setupDur, processingDur := internal.RequestContextDurations(r.Context())
+				if setupDur != 0 || processingDur != 0 {
+					durStr += fmt.Sprintf("(%.3f+%.3f)", setupDur.Seconds(), processingDur.Seconds())
+				}
+				entry.Int("status", status).
+					Int("size", size).
+					Str("duration", durStr).
+					Msg("")
+			}),
+		},
+		final: r,
+	}
+}
+
 func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h := s.final
 	for i := range s.chain {
@@ -73,11 +214,59 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h.ServeHTTP(w, req)
 }
 
-func allowCORS(next http.Handler) http.HandlerFunc {
+// CORSOpts controls the CORS headers served on client-facing endpoints.
+type CORSOpts struct {
+	// AllowedOrigins is the list of origins which may make cross-origin requests. "*" allows
+	// any origin. If empty, any origin is allowed.
+	AllowedOrigins []string
+	// AllowedHeaders is the list of request headers clients may send. If empty, a default
+	// set of headers which Matrix clients need is used.
+	AllowedHeaders []string
+	// MaxAge is how long browsers may cache the result of a preflight request. If 0, no
+	// Access-Control-Max-Age header is sent.
+	MaxAge time.Duration
+}
+
+var defaultCORSAllowedHeaders = []string{"Origin", "X-Requested-With", "Content-Type", "Accept", "Authorization"}
+
+// allowedOrigin returns the value to use for Access-Control-Allow-Origin for this request origin,
+// or "" if the origin is not allowed.
+func (c CORSOpts) allowedOrigin(origin string) string {
+	if len(c.AllowedOrigins) == 0 {
+		return "*"
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if o == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+func (c CORSOpts) allowCORS(next http.Handler) http.HandlerFunc {
+	allowedHeaders := c.AllowedHeaders
+	if len(allowedHeaders) == 0 {
+		allowedHeaders = defaultCORSAllowedHeaders
+	}
+	allowedHeadersStr := strings.Join(allowedHeaders, ", ")
 	return func(w http.ResponseWriter, req *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
+		allowOrigin := c.allowedOrigin(req.Header.Get("Origin"))
+		if allowOrigin != "*" {
+			// the response depends on the origin, so caches must key off it.
+			w.Header().Add("Vary", "Origin")
+		}
+		if allowOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", allowedHeadersStr)
+			w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader)
+			if c.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+			}
+		}
 		if req.Method == "OPTIONS" {
 			w.WriteHeader(200)
 			return
@@ -86,8 +275,21 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 	}
 }
 
-// Setup the proxy
+// Setup the proxy, panicking if it fails. Programs embedding the proxy should use New instead.
 func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Handler, http.Handler) {
+	h2, h3, err := setup(destHomeserver, postgresURI, secret, opts)
+	if err != nil {
+		sentry.CaptureException(err)
+		// TODO: if we panic(), will sentry have a chance to flush the event?
+		logger.Panic().Err(err).Msg("failed to set up the proxy")
+	}
+	return h2, h3
+}
+
+func setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Handler, *handler.SyncLiveHandler, error) {
+	if opts.Authenticator != nil && opts.OIDCIntrospection != nil {
+		return nil, nil, fmt.Errorf("Authenticator and OIDCIntrospection can't both be set")
+	}
 	// Setup shared DB and HTTP client
 	v2Client := sync2.NewHTTPClient(opts.HTTPTimeout, opts.HTTPLongTimeout, destHomeserver)
 
@@ -97,31 +299,34 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 		logger.Warn().Err(err).Str("dest", destHomeserver).Msg("Could not contact upstream homeserver. Is SYNCV3_SERVER set correctly?")
 	}
 
-	db, err := sqlx.Open("postgres", postgresURI)
-	if err != nil {
-		sentry.CaptureException(err)
-		// TODO: if we panic(), will sentry have a chance to flush the event?
-		logger.Panic().Err(err).Str("uri", postgresURI).Msg("failed to open SQL DB")
-	}
-
-	if opts.DBMaxConns > 0 {
-		// https://github.com/go-sql-driver/mysql#important-settings
-		// "db.SetMaxIdleConns() is recommended to be set same to db.SetMaxOpenConns(). When it is smaller
-		// than SetMaxOpenConns(), connections can be opened and closed much more frequently than you expect."
-		db.SetMaxOpenConns(opts.DBMaxConns)
-		db.SetMaxIdleConns(opts.DBMaxConns)
+	var store interface {
+		handler.Store
+		handler2.Store
 	}
-	if opts.DBConnMaxIdleTime > 0 {
-		db.SetConnMaxIdleTime(opts.DBConnMaxIdleTime)
+	var storev2 interface {
+		handler.V2Store
+		handler2.V2Store
 	}
-	store := state.NewStorageWithDB(db, opts.AddPrometheusMetrics)
-	storev2 := sync2.NewStoreWithDB(db, secret)
+	var db *sqlx.DB
+	if opts.InMemoryStorage {
+		logger.Warn().Msg("Storing everything in memory: all data will be lost when the proxy stops")
+		store = state.NewMemoryStorage()
+		storev2 = sync2.NewMemoryStore()
+	} else {
+		db, err = openDB(postgresURI, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		store = state.NewStorageWithDB(db, opts.AddPrometheusMetrics)
+		storev2 = sync2.NewStoreWithDB(db, secret)
 
-	// Automatically execute migrations
-	goose.SetBaseFS(EmbedMigrations)
-	err = goose.Up(db.DB, "state/migrations", goose.WithAllowMissing())
-	if err != nil {
-		logger.Panic().Err(err).Msg("failed to execute migrations")
+		// Automatically execute migrations
+		goose.SetBaseFS(EmbedMigrations)
+		err = goose.Up(db.DB, "state/migrations", goose.WithAllowMissing())
+		if err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("failed to execute migrations: %w", err)
+		}
 	}
 
 	bufferSize := 50
@@ -133,128 +338,335 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	if opts.MaxPendingEventUpdates == 0 {
 		opts.MaxPendingEventUpdates = 2000
 	}
+	if opts.SlowRequestThreshold == 0 {
+		opts.SlowRequestThreshold = 50 * time.Second
+	}
+	if opts.MaxRequestBodyBytes == 0 {
+		opts.MaxRequestBodyBytes = 10 * 1024 * 1024
+	}
 	pubSub := pubsub.NewPubSub(bufferSize)
 
 	pMap := sync2.NewPollerMap(v2Client, opts.AddPrometheusMetrics)
 	// create v2 handler
-	h2, err := handler2.NewHandler(pMap, storev2, store, pubSub, pubSub, opts.AddPrometheusMetrics, deviceDataUpdateFrequency)
+	h2, err := handler2.NewHandler(pMap, v2Client, storev2, store, pubSub, pubSub, opts.AddPrometheusMetrics, deviceDataUpdateFrequency, opts.RoomSummaryFallback)
 	if err != nil {
-		panic(err)
+		if db != nil {
+			db.Close()
+		}
+		return nil, nil, fmt.Errorf("failed to create v2 handler: %w", err)
 	}
 	pMap.SetCallbacks(h2)
 
+	auth := opts.Authenticator
+	if opts.OIDCIntrospection != nil {
+		auth = sync2.NewIntrospectingClient(v2Client, opts.HTTPTimeout, *opts.OIDCIntrospection)
+	}
+
+	var webhooks *webhook.Sink
+	if opts.Webhook != nil {
+		webhooks = webhook.NewSink(*opts.Webhook)
+	}
+
+	// Initial loads for large accounts run several queries at once. Leave half of the connection pool
+	// for pollers and everything else, so many clients connecting at once can't exhaust it.
+	maxParallelInitialLoads := 0
+	if db != nil {
+		if maxConns := db.Stats().MaxOpenConnections; maxConns > 0 {
+			maxParallelInitialLoads = maxConns / 2
+			if maxParallelInitialLoads < 1 {
+				maxParallelInitialLoads = 1
+			}
+		}
+	}
+
 	// create v3 handler
-	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay)
+	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay, handler.HandlerOptions{
+		DisabledExtensions:       opts.DisabledExtensions,
+		SlowRequestThreshold:     opts.SlowRequestThreshold,
+		MaxRequestBodyBytes:      opts.MaxRequestBodyBytes,
+		NewConnsPerIPPerMinute:   opts.NewConnsPerIPPerMinute,
+		TrustedProxies:           opts.TrustedProxies,
+		RequestsPerUserPerMinute: opts.RequestsPerUserPerMinute,
+		MaxRoomsPerResponse:      opts.MaxRoomsPerResponse,
+		TypingDebounce:           opts.TypingDebounce,
+		TypingExpiry:             opts.TypingExpiry,
+		Webhooks:                 webhooks,
+		EventAge:                 opts.EventAge,
+		ToDeviceMaxMessages:      opts.ToDeviceMaxMessages,
+		ToDeviceMaxBytes:         opts.ToDeviceMaxBytes,
+		TimelineBackfill:         opts.TimelineBackfill,
+		DefaultLists:             opts.DefaultLists,
+		PhasedInitialSyncRooms:   opts.PhasedInitialSyncRooms,
+		MaxResponseBytes:         opts.MaxResponseBytes,
+		MaxListOps:               opts.MaxListOpsPerResponse,
+		InstanceName:             opts.InstanceName,
+		Auth:                     auth,
+		MaxParallelInitialLoads:  maxParallelInitialLoads,
+	})
 	if err != nil {
-		panic(err)
+		h2.Teardown()
+		return nil, nil, fmt.Errorf("failed to create v3 handler: %w", err)
 	}
-	storeSnapshot, err := store.GlobalSnapshot()
-	if err != nil {
-		panic(err)
+	if err := h3.Startup(); err != nil {
+		h2.Teardown()
+		h3.Teardown()
+		return nil, nil, fmt.Errorf("failed to load caches: %w", err)
 	}
-	logger.Info().Msg("retrieved global snapshot from database")
-	h3.Startup(&storeSnapshot)
 
 	// begin consuming from these positions
 	h2.Listen()
 	h3.Listen()
-	return h2, h3
+	return h2, h3, nil
 }
 
-// RunSyncV3Server is the main entry point to the server
-func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) {
+// openDB opens the postgres database, configuring its connection pool from the options.
+func openDB(postgresURI string, opts Opts) (*sqlx.DB, error) {
+	driverName := "postgres"
+	if opts.AddPrometheusMetrics {
+		// records query latencies, which state.Storage exports
+		driverName = sqlutil.InstrumentedDriverName
+	}
+	var db *sqlx.DB
+	var err error
+	if opts.DSN != nil {
+		db, err = sqlutil.OpenReloadable(driverName, opts.DSN)
+	} else {
+		db, err = sqlx.Open(driverName, postgresURI)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQL DB: %w", err)
+	}
+
+	if opts.DBMaxConns > 0 {
+		// https://github.com/go-sql-driver/mysql#important-settings
+		// "db.SetMaxIdleConns() is recommended to be set same to db.SetMaxOpenConns(). When it is smaller
+		// than SetMaxOpenConns(), connections can be opened and closed much more frequently than you expect."
+		db.SetMaxOpenConns(opts.DBMaxConns)
+		db.SetMaxIdleConns(opts.DBMaxConns)
+	}
+	if opts.DBConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(opts.DBConnMaxIdleTime)
+	}
+	return db, nil
+}
+
+// ServerOpts configures how the HTTP server listens for and routes requests.
+type ServerOpts struct {
+	// BindAddrs is the list of addresses to listen on. Each is either a TCP host:port or a unix
+	// socket path.
+	BindAddrs []string
+	// TLSCert and TLSKey are paths to the certificate and key to serve over TCP. If unset, plain
+	// HTTP is served.
+	TLSCert string
+	TLSKey  string
+	// ReusePort sets SO_REUSEPORT on TCP listening sockets so a replacement process can bind the
+	// same addresses before this process exits.
+	ReusePort bool
+	// PathPrefix is prepended to all routes, e.g "/sliding-sync" will serve the sync endpoint at
+	// "/sliding-sync/_matrix/client/v3/sync".
+	PathPrefix string
+	CORS       CORSOpts
+	// Admin serves the admin API under /_syncv3/admin. If nil, the admin API is not served.
+	Admin http.Handler
+	// WellKnown serves /.well-known/matrix/client advertising the proxy. If nil, it is not served.
+	WellKnown *WellKnownOpts
+	// PassthroughPaths are client-server API paths e.g "/_matrix/client/versions" which are
+	// forwarded to the destination homeserver, so clients can use the proxy as their only base
+	// URL. Paths ending in "/" forward everything beneath them.
+	PassthroughPaths []string
+	// SyncPaths are the paths the sync endpoint is served on, beneath PathPrefix. Defaults to
+	// DefaultSyncPaths.
+	SyncPaths []string
+	// Messages, if set, makes the handler for /rooms/{roomID}/messages, which is given a handler that
+	// forwards requests to the destination homeserver. If nil, /messages is not served.
+	Messages func(homeserver http.Handler) http.Handler
+}
+
+// DefaultSyncPaths are the paths the sync endpoint is served on if none are configured: the
+// versioned path, and the unstable path from MSC3575.
+var DefaultSyncPaths = []string{
+	"/_matrix/client/v3/sync",
+	"/_matrix/client/unstable/org.matrix.msc3575/sync",
+}
+
+func (o ServerOpts) syncPaths() []string {
+	if len(o.SyncPaths) == 0 {
+		return DefaultSyncPaths
+	}
+	return o.SyncPaths
+}
+
+// normalisedPathPrefix returns the path prefix with a leading slash and without a trailing slash,
+// or "" if there is no prefix.
+func (o ServerOpts) normalisedPathPrefix() string {
+	prefix := strings.Trim(o.PathPrefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// Router returns the HTTP routes for the proxy, with h serving the sync endpoints.
+func (o ServerOpts) Router(h http.Handler, destV2Server string) *mux.Router {
+	allowCORS := o.CORS.allowCORS
+	prefix := o.normalisedPathPrefix()
 	// HTTP path routing
 	r := mux.NewRouter()
-	r.Handle("/_matrix/client/v3/sync", allowCORS(h))
-	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", allowCORS(h))
+	syncPaths := o.syncPaths()
+	for _, path := range syncPaths {
+		r.Handle(prefix+path, allowCORS(h))
+	}
 
+	// advertise where sync is served and which protocol revisions it speaks, so clients written
+	// against different revisions can pick what they understand
 	serverJSON, _ := json.Marshal(struct {
-		Server  string `json:"server"`
-		Version string `json:"version"`
+		Server           string   `json:"server"`
+		Version          string   `json:"version"`
+		SyncPaths        []string `json:"sync_paths"`
+		ProtocolVersions []string `json:"protocol_versions"`
 	}{
-		Server:  destV2Server,
-		Version: Version,
+		Server:           destV2Server,
+		Version:          Version,
+		SyncPaths:        syncPaths,
+		ProtocolVersions: sync3.ProtocolVersions,
 	})
-	r.Handle("/client/server.json", allowCORS(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+	r.Handle(prefix+"/client/server.json", allowCORS(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("Content-Type", "application/json")
 		rw.WriteHeader(200)
 		rw.Write(serverJSON)
 	})))
-	r.PathPrefix("/client/").HandlerFunc(
+	if o.Messages != nil {
+		messages := allowCORS(o.Messages(newPassthroughProxy(destV2Server, prefix)))
+		for _, version := range []string{"v3", "r0"} {
+			r.Handle(prefix+"/_matrix/client/"+version+"/rooms/{roomID}/messages", messages)
+		}
+	}
+	if o.WellKnown != nil {
+		// clients look for this at the root of the server name's domain, so it never has the prefix
+		r.Handle("/.well-known/matrix/client", allowCORS(newWellKnownHandler(*o.WellKnown, destV2Server)))
+	}
+	if o.Admin != nil {
+		r.PathPrefix(prefix + "/_syncv3/admin/").Handler(http.StripPrefix(prefix+"/_syncv3/admin", o.Admin))
+	}
+	r.PathPrefix(prefix + "/client/").HandlerFunc(
 		allowCORS(
-			http.StripPrefix("/client/", http.FileServer(http.Dir("./client"))),
+			http.StripPrefix(prefix+"/client/", http.FileServer(http.Dir("./client"))),
 		),
 	)
+	// routes match in the order they are added, so passthrough paths come last: a passthrough
+	// prefix such as "/_matrix/client/" must not shadow the routes the proxy serves itself.
+	addPassthroughRoutes(r, o.PassthroughPaths, destV2Server, prefix, allowCORS)
+	return r
+}
 
-	srv := &server{
-		chain: []func(next http.Handler) http.Handler{
-			hlog.NewHandler(logger),
-			func(next http.Handler) http.Handler {
-				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					r = r.WithContext(internal.RequestContext(r.Context()))
-					next.ServeHTTP(w, r)
-				})
-			},
-			hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
-				if r.Method == "OPTIONS" {
-					return
-				}
-				entry := internal.DecorateLogger(r.Context(), hlog.FromRequest(r).Info())
-				if !strings.HasSuffix(r.URL.Path, "/sync") {
-					entry.Str("path", r.URL.Path)
-				}
-				durStr := fmt.Sprintf("%.3f", duration.Seconds())
-				setupDur, processingDur := internal.RequestContextDurations(r.Context())
-				if setupDur != 0 || processingDur != 0 {
-					durStr += fmt.Sprintf("(%.3f+%.3f)", setupDur.Seconds(), processingDur.Seconds())
-				}
-				entry.Int("status", status).
-					Int("size", size).
-					Str("duration", durStr).
-					Msg("")
-			}),
-		},
-		final: r,
+// RunSyncV3Server serves h on bindAddr, blocking forever.
+//
+// Deprecated: use StartSyncV3Server, which supports more options and graceful shutdown.
+func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) {
+	StartSyncV3Server(h, destV2Server, ServerOpts{
+		BindAddrs: []string{bindAddr},
+		TLSCert:   tlsCert,
+		TLSKey:    tlsKey,
+	})
+	select {}
+}
+
+// StartSyncV3Server is the main entry point to the server. It starts serving in the background and
+// returns the underlying HTTP server, which can be used to gracefully shut down. If the process
+// was started via systemd socket activation, the inherited socket is used instead of the
+// configured bind addresses.
+func StartSyncV3Server(h http.Handler, destV2Server string, opts ServerOpts) *http.Server {
+	srv := newServer(opts.Router(h, destV2Server))
+
+	listeners, err := opts.listeners()
+	if err != nil {
+		sentry.CaptureException(err)
+		logger.Fatal().Err(err).Msg("failed to listen")
 	}
 
-	// Block forever
-	var err error
-	if internal.IsUnixSocket(bindAddr) {
-		logger.Info().Msgf("listening on unix socket %s", bindAddr)
-		listener := unixSocketListener(bindAddr)
-		err = http.Serve(listener, srv)
-	} else {
-		if tlsCert != "" && tlsKey != "" {
-			logger.Info().Msgf("listening TLS on %s", bindAddr)
-			err = http.ListenAndServeTLS(bindAddr, tlsCert, tlsKey, srv)
-		} else {
-			logger.Info().Msgf("listening on %s", bindAddr)
-			err = http.ListenAndServe(bindAddr, srv)
-		}
+	httpServer := &http.Server{
+		Handler: srv,
 	}
-	if err != nil {
+	opts.serve(httpServer, listeners, func(err error) {
 		sentry.CaptureException(err)
 		// TODO: Fatal() calls os.Exit. Will that give time for sentry.Flush() to run?
 		logger.Fatal().Err(err).Msg("failed to listen and serve")
+	})
+	return httpServer
+}
+
+// serve serves httpServer on each listener in the background, calling onError if any of them stop
+// for a reason other than the server being shut down.
+func (o ServerOpts) serve(httpServer *http.Server, listeners []net.Listener, onError func(error)) {
+	for _, listener := range listeners {
+		listener := listener
+		go func() {
+			var err error
+			// TLS is only used for TCP sockets.
+			if o.TLSCert != "" && o.TLSKey != "" && listener.Addr().Network() == "tcp" {
+				err = httpServer.ServeTLS(listener, o.TLSCert, o.TLSKey)
+			} else {
+				err = httpServer.Serve(listener)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				onError(err)
+			}
+		}()
+	}
+}
+
+func (o ServerOpts) listeners() ([]net.Listener, error) {
+	listener, err := internal.InheritedListener()
+	if err != nil {
+		return nil, fmt.Errorf("failed to use inherited socket: %w", err)
+	}
+	if listener != nil {
+		logger.Info().Msgf("listening on inherited socket %s", listener.Addr())
+		return []net.Listener{listener}, nil
+	}
+	listeners := make([]net.Listener, 0, len(o.BindAddrs))
+	for _, bindAddr := range o.BindAddrs {
+		if internal.IsUnixSocket(bindAddr) {
+			listener, err = unixSocketListener(bindAddr)
+			if err != nil {
+				return nil, err
+			}
+			logger.Info().Msgf("listening on unix socket %s", bindAddr)
+			listeners = append(listeners, listener)
+			continue
+		}
+		if o.ReusePort {
+			listener, err = internal.ListenReusePort(bindAddr)
+		} else {
+			listener, err = net.Listen("tcp", bindAddr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", bindAddr, err)
+		}
+		logger.Info().Bool("tls", o.TLSCert != "" && o.TLSKey != "").Bool("reuse_port", o.ReusePort).
+			Str("path_prefix", o.normalisedPathPrefix()).Msgf("listening on %s", bindAddr)
+		listeners = append(listeners, listener)
 	}
+	return listeners, nil
 }
 
-func unixSocketListener(bindAddr string) net.Listener {
+func unixSocketListener(bindAddr string) (net.Listener, error) {
 	err := os.Remove(bindAddr)
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		logger.Fatal().Err(err).Msg("failed to remove existing unix socket")
+		return nil, fmt.Errorf("failed to remove existing unix socket: %w", err)
 	}
 	listener, err := net.Listen("unix", bindAddr)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to serve unix socket")
+		return nil, fmt.Errorf("failed to serve unix socket: %w", err)
 	}
 	// least permissions and work out of box (-w--w--w-); could be extracted as
 	// env variable if needed
 	err = os.Chmod(bindAddr, 0222)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to set unix socket permissions")
+		listener.Close()
+		return nil, fmt.Errorf("failed to set unix socket permissions: %w", err)
 	}
-	return listener
+	return listener, nil
 }
 
 type HandlerError struct {
@@ -0,0 +1,173 @@
+package slidingsync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestCORS(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+	})
+	testCases := []struct {
+		name           string
+		opts           CORSOpts
+		method         string
+		origin         string
+		wantOrigin     string
+		wantHeaders    string
+		wantMaxAge     string
+		wantVaryOrigin bool
+	}{
+		{
+			name:        "defaults allow any origin",
+			method:      "POST",
+			origin:      "https://example.com",
+			wantOrigin:  "*",
+			wantHeaders: "Origin, X-Requested-With, Content-Type, Accept, Authorization",
+		},
+		{
+			name: "allowed origin is echoed back",
+			opts: CORSOpts{
+				AllowedOrigins: []string{"https://a.example.com", "https://b.example.com"},
+				AllowedHeaders: []string{"Authorization", "Content-Type"},
+				MaxAge:         time.Hour,
+			},
+			method:         "OPTIONS",
+			origin:         "https://b.example.com",
+			wantOrigin:     "https://b.example.com",
+			wantHeaders:    "Authorization, Content-Type",
+			wantMaxAge:     "3600",
+			wantVaryOrigin: true,
+		},
+		{
+			name: "unknown origin gets no CORS headers",
+			opts: CORSOpts{
+				AllowedOrigins: []string{"https://a.example.com"},
+			},
+			method:         "POST",
+			origin:         "https://evil.example.com",
+			wantVaryOrigin: true,
+		},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, "/_matrix/client/v3/sync", nil)
+		req.Header.Set("Origin", tc.origin)
+		w := httptest.NewRecorder()
+		tc.opts.allowCORS(ok).ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Errorf("%s: got status %d want 200", tc.name, w.Code)
+		}
+		h := w.Header()
+		if got := h.Get("Access-Control-Allow-Origin"); got != tc.wantOrigin {
+			t.Errorf("%s: got Access-Control-Allow-Origin '%s' want '%s'", tc.name, got, tc.wantOrigin)
+		}
+		if got := h.Get("Access-Control-Allow-Headers"); got != tc.wantHeaders {
+			t.Errorf("%s: got Access-Control-Allow-Headers '%s' want '%s'", tc.name, got, tc.wantHeaders)
+		}
+		if got := h.Get("Access-Control-Max-Age"); got != tc.wantMaxAge {
+			t.Errorf("%s: got Access-Control-Max-Age '%s' want '%s'", tc.name, got, tc.wantMaxAge)
+		}
+		if got := h.Get("Vary") == "Origin"; got != tc.wantVaryOrigin {
+			t.Errorf("%s: got Vary: Origin %v want %v", tc.name, got, tc.wantVaryOrigin)
+		}
+		if got := h.Get("Access-Control-Expose-Headers") == RequestIDHeader; got != (tc.wantOrigin != "") {
+			t.Errorf("%s: got Access-Control-Expose-Headers '%s'", tc.name, h.Get("Access-Control-Expose-Headers"))
+		}
+	}
+}
+
+func TestServerRequestID(t *testing.T) {
+	var gotIDs []string
+	srv := newServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, _ := req.Context().Value(internal.OTLPTagRequestID).(string)
+		gotIDs = append(gotIDs, id)
+		w.WriteHeader(200)
+	}))
+	var headerIDs []string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("POST", "/_matrix/client/v3/sync", nil))
+		headerIDs = append(headerIDs, w.Header().Get(RequestIDHeader))
+	}
+	if headerIDs[0] == "" || headerIDs[0] == headerIDs[1] {
+		t.Errorf("got request IDs %v, want unique IDs", headerIDs)
+	}
+	if !reflect.DeepEqual(gotIDs, headerIDs) {
+		t.Errorf("request context has IDs %v, response header has %v", gotIDs, headerIDs)
+	}
+}
+
+func TestRouterPathPrefix(t *testing.T) {
+	sync := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	testCases := []struct {
+		prefix   string
+		path     string
+		wantCode int
+	}{
+		{prefix: "", path: "/_matrix/client/v3/sync", wantCode: http.StatusTeapot},
+		{prefix: "/sliding-sync", path: "/sliding-sync/_matrix/client/v3/sync", wantCode: http.StatusTeapot},
+		{prefix: "sliding-sync/", path: "/sliding-sync/_matrix/client/unstable/org.matrix.msc3575/sync", wantCode: http.StatusTeapot},
+		{prefix: "/sliding-sync", path: "/_matrix/client/v3/sync", wantCode: http.StatusNotFound},
+		{prefix: "/sliding-sync", path: "/sliding-sync/client/server.json", wantCode: http.StatusOK},
+	}
+	for _, tc := range testCases {
+		r := ServerOpts{PathPrefix: tc.prefix}.Router(sync, "http://localhost")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", tc.path, nil))
+		if w.Code != tc.wantCode {
+			t.Errorf("prefix '%s' path %s: got status %d want %d", tc.prefix, tc.path, w.Code, tc.wantCode)
+		}
+	}
+}
+
+func TestRouterSyncPaths(t *testing.T) {
+	sync := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	opts := ServerOpts{
+		PathPrefix: "/sliding-sync",
+		SyncPaths:  []string{"/_matrix/client/v1/sync", "/_matrix/client/unstable/org.matrix.msc3575/sync"},
+	}
+	r := opts.Router(sync, "http://localhost")
+	testCases := []struct {
+		path     string
+		wantCode int
+	}{
+		{path: "/sliding-sync/_matrix/client/v1/sync", wantCode: http.StatusTeapot},
+		{path: "/sliding-sync/_matrix/client/unstable/org.matrix.msc3575/sync", wantCode: http.StatusTeapot},
+		{path: "/sliding-sync/_matrix/client/v3/sync", wantCode: http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", tc.path, nil))
+		if w.Code != tc.wantCode {
+			t.Errorf("path %s: got status %d want %d", tc.path, w.Code, tc.wantCode)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/sliding-sync/client/server.json", nil))
+	var serverJSON struct {
+		SyncPaths        []string `json:"sync_paths"`
+		ProtocolVersions []string `json:"protocol_versions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &serverJSON); err != nil {
+		t.Fatalf("failed to unmarshal server.json: %s", err)
+	}
+	if !reflect.DeepEqual(serverJSON.SyncPaths, opts.SyncPaths) {
+		t.Errorf("got sync_paths %v want %v", serverJSON.SyncPaths, opts.SyncPaths)
+	}
+	if !reflect.DeepEqual(serverJSON.ProtocolVersions, sync3.ProtocolVersions) {
+		t.Errorf("got protocol_versions %v want %v", serverJSON.ProtocolVersions, sync3.ProtocolVersions)
+	}
+}
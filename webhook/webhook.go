@@ -0,0 +1,202 @@
+// Package webhook POSTs notifications about new events seen by the proxy to an external URL, so
+// operators can integrate with other systems without running another sync consumer.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+var logger = internal.NewLogger()
+
+// SignatureHeader is the header which holds the hex-encoded HMAC-SHA256 of the request body,
+// prefixed with "sha256=", when a secret is configured.
+const SignatureHeader = "X-Sliding-Sync-Signature"
+
+// Kinds of notification
+const (
+	KindNewRoom    = "new_room"
+	KindMembership = "membership"
+	KindEvent      = "event"
+)
+
+// Opts configures which notifications are sent and where to.
+type Opts struct {
+	// URL to POST notifications to.
+	URL string
+	// Secret signs request bodies so the receiver can check they came from the proxy. If empty,
+	// requests are not signed.
+	Secret string
+	// NewRooms sends a notification when a room is created, or first seen by the proxy.
+	NewRooms bool
+	// Memberships sends a notification for each membership change.
+	Memberships bool
+	// EventTypes sends a notification for each timeline event with one of these types.
+	EventTypes []string
+	// MaxRetries is the number of times to retry a failed notification before dropping it.
+	MaxRetries int
+	// Timeout for each request.
+	Timeout time.Duration
+}
+
+// Notification is the JSON body sent to the webhook URL.
+type Notification struct {
+	Kind   string          `json:"kind"`
+	RoomID string          `json:"room_id"`
+	Event  json.RawMessage `json:"event"`
+}
+
+// queueSize is the most notifications which can be waiting to be sent. Further notifications are
+// dropped, so a slow or broken webhook cannot hold up the proxy.
+const queueSize = 1000
+
+// Sink sends notifications to the webhook URL in order, on a background goroutine.
+type Sink struct {
+	opts       Opts
+	eventTypes map[string]bool
+	client     *http.Client
+	queue      chan Notification
+	// how long to wait before the first retry, doubling for each retry after. Overridden in tests.
+	retryDelay time.Duration
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewSink creates a sink and starts sending notifications. Call Close to stop it.
+func NewSink(opts Opts) *Sink {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	s := &Sink{
+		opts:       opts,
+		eventTypes: make(map[string]bool, len(opts.EventTypes)),
+		client:     &http.Client{Timeout: opts.Timeout},
+		queue:      make(chan Notification, queueSize),
+		retryDelay: time.Second,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, evType := range opts.EventTypes {
+		s.eventTypes[evType] = true
+	}
+	go s.run()
+	return s
+}
+
+// Close stops sending notifications. Notifications which have not been sent yet are dropped.
+func (s *Sink) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
+
+// OnNewEvents is called with new timeline events in a room.
+func (s *Sink) OnNewEvents(roomID string, events []*internal.Event) {
+	for _, ev := range events {
+		switch {
+		case ev.Type == "m.room.create" && ev.StateKey != nil && *ev.StateKey == "" && s.opts.NewRooms:
+			s.enqueue(Notification{Kind: KindNewRoom, RoomID: roomID, Event: ev.JSON})
+		case ev.IsMembershipChange && s.opts.Memberships:
+			s.enqueue(Notification{Kind: KindMembership, RoomID: roomID, Event: ev.JSON})
+		case s.eventTypes[ev.Type]:
+			s.enqueue(Notification{Kind: KindEvent, RoomID: roomID, Event: ev.JSON})
+		}
+	}
+}
+
+// OnNewRoomState is called when the proxy first sees the state of a room. Only the room creation
+// is notified, as the other state is not new.
+func (s *Sink) OnNewRoomState(roomID string, state []json.RawMessage) {
+	if !s.opts.NewRooms {
+		return
+	}
+	for _, ev := range state {
+		parsed := internal.NewEvent(ev)
+		if parsed.Type == "m.room.create" && parsed.StateKey != nil && *parsed.StateKey == "" {
+			s.enqueue(Notification{Kind: KindNewRoom, RoomID: roomID, Event: ev})
+			return
+		}
+	}
+}
+
+func (s *Sink) enqueue(n Notification) {
+	select {
+	case s.queue <- n:
+	default:
+		logger.Warn().Str("room", n.RoomID).Str("kind", n.Kind).Msg("webhook: queue full, dropping notification")
+	}
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	for {
+		var n Notification
+		select {
+		case <-s.stop:
+			return
+		case n = <-s.queue:
+		}
+		body, err := json.Marshal(n)
+		if err != nil {
+			logger.Err(err).Str("room", n.RoomID).Msg("webhook: failed to marshal notification")
+			continue
+		}
+		delay := s.retryDelay
+		for attempt := 0; ; attempt++ {
+			err = s.send(body)
+			if err == nil {
+				break
+			}
+			if attempt >= s.opts.MaxRetries {
+				logger.Err(err).Str("room", n.RoomID).Str("kind", n.Kind).Int("attempts", attempt+1).Msg("webhook: giving up on notification")
+				break
+			}
+			logger.Warn().Err(err).Str("room", n.RoomID).Dur("retry_in", delay).Msg("webhook: failed to send notification, retrying")
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}
+}
+
+func (s *Sink) send(body []byte) error {
+	req, err := http.NewRequest("POST", s.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.opts.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(s.opts.Secret, body))
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of body with this secret, as sent in SignatureHeader.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
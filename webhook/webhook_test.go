@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+type receivedNotification struct {
+	Notification
+	signature string
+}
+
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	received []receivedNotification
+	// the number of requests to fail before succeeding
+	failures int
+}
+
+func newWebhookServer(t *testing.T) *webhookServer {
+	ws := &webhookServer{}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws.mu.Lock()
+		defer ws.mu.Unlock()
+		if ws.failures > 0 {
+			ws.failures--
+			w.WriteHeader(500)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("failed to read body: %s", err)
+		}
+		var n Notification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Errorf("failed to unmarshal notification: %s", err)
+		}
+		ws.received = append(ws.received, receivedNotification{n, req.Header.Get(SignatureHeader)})
+	}))
+	return ws
+}
+
+func (ws *webhookServer) waitForNotifications(t *testing.T, num int) []receivedNotification {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		ws.mu.Lock()
+		if len(ws.received) >= num {
+			received := ws.received
+			ws.mu.Unlock()
+			return received
+		}
+		ws.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d notifications", num)
+	return nil
+}
+
+func TestSinkNotifications(t *testing.T) {
+	ws := newWebhookServer(t)
+	defer ws.Close()
+	sink := NewSink(Opts{
+		URL:         ws.URL,
+		NewRooms:    true,
+		Memberships: true,
+		EventTypes:  []string{"m.room.encrypted"},
+	})
+	defer sink.Close()
+
+	roomID := "!a:localhost"
+	create := json.RawMessage(`{"type":"m.room.create","state_key":"","sender":"@alice:localhost","content":{},"event_id":"$create"}`)
+	join := json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","sender":"@alice:localhost","content":{"membership":"join"},"event_id":"$join"}`)
+	message := json.RawMessage(`{"type":"m.room.message","sender":"@alice:localhost","content":{"body":"hi"},"event_id":"$msg"}`)
+	encrypted := json.RawMessage(`{"type":"m.room.encrypted","sender":"@alice:localhost","content":{},"event_id":"$enc"}`)
+
+	sink.OnNewRoomState(roomID, []json.RawMessage{join, create})
+	sink.OnNewEvents(roomID, []*internal.Event{internal.NewEvent(message), internal.NewEvent(encrypted), internal.NewEvent(join)})
+
+	got := ws.waitForNotifications(t, 3)
+	want := []Notification{
+		{Kind: KindNewRoom, RoomID: roomID, Event: create},
+		{Kind: KindEvent, RoomID: roomID, Event: encrypted},
+		{Kind: KindMembership, RoomID: roomID, Event: join},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d notifications, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Kind != want[i].Kind || got[i].RoomID != want[i].RoomID || string(got[i].Event) != string(want[i].Event) {
+			t.Errorf("notification %d: got %+v want %+v", i, got[i].Notification, want[i])
+		}
+		if got[i].signature != "" {
+			t.Errorf("notification %d was signed without a secret", i)
+		}
+	}
+}
+
+func TestSinkRetriesAndSigns(t *testing.T) {
+	ws := newWebhookServer(t)
+	defer ws.Close()
+	ws.failures = 2
+	sink := NewSink(Opts{
+		URL:        ws.URL,
+		Secret:     "s3cret",
+		NewRooms:   true,
+		MaxRetries: 2,
+	})
+	sink.retryDelay = time.Millisecond
+	defer sink.Close()
+
+	create := json.RawMessage(`{"type":"m.room.create","state_key":"","content":{}}`)
+	sink.OnNewEvents("!a:localhost", []*internal.Event{internal.NewEvent(create)})
+	got := ws.waitForNotifications(t, 1)
+
+	body, _ := json.Marshal(Notification{Kind: KindNewRoom, RoomID: "!a:localhost", Event: create})
+	if got[0].signature != "sha256="+Sign("s3cret", body) {
+		t.Errorf("got signature %q, want %q", got[0].signature, "sha256="+Sign("s3cret", body))
+	}
+	if !reflect.DeepEqual(got[0].Notification.Event, create) {
+		t.Errorf("got event %s want %s", got[0].Event, create)
+	}
+}
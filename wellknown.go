@@ -0,0 +1,120 @@
+package slidingsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// WellKnownOpts configures serving /.well-known/matrix/client, so clients can discover the proxy.
+type WellKnownOpts struct {
+	// ProxyURL is the public URL of the proxy, advertised as org.matrix.msc3575.proxy.
+	ProxyURL string
+	// MergeURL is the URL of the homeserver's existing /.well-known/matrix/client, which the
+	// advertisement is added to. If empty, it is fetched from the destination homeserver.
+	MergeURL string
+	// CacheTTL is how long the homeserver's well-known is cached for. Defaults to 5 minutes.
+	CacheTTL time.Duration
+}
+
+// wellKnownHandler serves the homeserver's /.well-known/matrix/client with the proxy added to it.
+type wellKnownHandler struct {
+	proxyURL string
+	mergeURL string
+	cacheTTL time.Duration
+	client   *http.Client
+
+	mu        sync.Mutex
+	cached    []byte
+	fetchedAt time.Time
+}
+
+func newWellKnownHandler(opts WellKnownOpts, destV2Server string) *wellKnownHandler {
+	h := &wellKnownHandler{
+		proxyURL: opts.ProxyURL,
+		mergeURL: opts.MergeURL,
+		cacheTTL: opts.CacheTTL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if h.cacheTTL == 0 {
+		h.cacheTTL = 5 * time.Minute
+	}
+	if h.mergeURL == "" {
+		h.mergeURL = internal.GetBaseURL(destV2Server) + "/.well-known/matrix/client"
+		if internal.IsUnixSocket(destV2Server) {
+			h.client.Transport = internal.UnixTransport(destV2Server)
+		}
+	}
+	return h
+}
+
+func (h *wellKnownHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(h.wellKnown())
+}
+
+// wellKnown returns the merged well-known, refetching the homeserver's if the cached copy is too
+// old. If the homeserver's well-known cannot be fetched, the last copy is used, or just the proxy
+// advertisement if there has never been one.
+func (h *wellKnownHandler) wellKnown() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cached != nil && time.Since(h.fetchedAt) < h.cacheTTL {
+		return h.cached
+	}
+	upstream, err := h.fetch()
+	if err != nil {
+		logger.Warn().Err(err).Str("url", h.mergeURL).Msg("failed to fetch homeserver .well-known/matrix/client")
+		if h.cached == nil {
+			h.cached = h.merge(nil)
+		}
+		// don't hammer the homeserver while it is failing
+		h.fetchedAt = time.Now()
+		return h.cached
+	}
+	h.cached = h.merge(upstream)
+	h.fetchedAt = time.Now()
+	return h.cached
+}
+
+func (h *wellKnownHandler) fetch() (map[string]json.RawMessage, error) {
+	res, err := h.client.Get(h.mergeURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		// the homeserver doesn't have a well-known, so ours is the only one
+		return nil, nil
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	var upstream map[string]json.RawMessage
+	if err := json.Unmarshal(body, &upstream); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	return upstream, nil
+}
+
+func (h *wellKnownHandler) merge(upstream map[string]json.RawMessage) []byte {
+	merged := make(map[string]interface{}, len(upstream)+1)
+	for k, v := range upstream {
+		merged[k] = v
+	}
+	merged["org.matrix.msc3575.proxy"] = map[string]string{
+		"url": h.proxyURL,
+	}
+	b, _ := json.Marshal(merged)
+	return b
+}
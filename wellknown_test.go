@@ -0,0 +1,65 @@
+package slidingsync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWellKnownMergesHomeserverWellKnown(t *testing.T) {
+	var fetches atomic.Int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/.well-known/matrix/client" {
+			w.WriteHeader(404)
+			return
+		}
+		fetches.Add(1)
+		w.Write([]byte(`{"m.homeserver":{"base_url":"https://matrix.example.com"},"m.identity_server":{"base_url":"https://id.example.com"}}`))
+	}))
+	defer hs.Close()
+
+	r := ServerOpts{
+		PathPrefix: "/sliding-sync",
+		WellKnown:  &WellKnownOpts{ProxyURL: "https://example.com/sliding-sync"},
+	}.Router(http.NotFoundHandler(), hs.URL)
+	want := map[string]interface{}{
+		"m.homeserver":             map[string]interface{}{"base_url": "https://matrix.example.com"},
+		"m.identity_server":        map[string]interface{}{"base_url": "https://id.example.com"},
+		"org.matrix.msc3575.proxy": map[string]interface{}{"url": "https://example.com/sliding-sync"},
+	}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/matrix/client", nil))
+		if w.Code != 200 {
+			t.Fatalf("got status %d want 200", w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("got Access-Control-Allow-Origin %q want *", got)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("invalid JSON: %s", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v want %v", got, want)
+		}
+	}
+	// the homeserver's well-known is cached
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("fetched homeserver well-known %d times, want 1", got)
+	}
+}
+
+func TestWellKnownWithoutHomeserverWellKnown(t *testing.T) {
+	hs := httptest.NewServer(http.NotFoundHandler())
+	defer hs.Close()
+	h := newWellKnownHandler(WellKnownOpts{ProxyURL: "https://proxy.example.com"}, hs.URL)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/matrix/client", nil))
+	if got, want := w.Body.String(), `{"org.matrix.msc3575.proxy":{"url":"https://proxy.example.com"}}`; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+}